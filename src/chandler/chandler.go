@@ -2,6 +2,7 @@ package chandler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,12 +15,16 @@ import (
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollgate_protocol"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
 	"github.com/sirupsen/logrus"
 )
 
 // Module-level logger with pre-configured module field
 var logger = logrus.WithField("module", "chandler")
 
+// powTimeout bounds the proof-of-work computed for an upstream that requires it
+const powTimeout = 30 * time.Second
+
 // Chandler is the main implementation of ChandlerInterface
 type Chandler struct {
 	configManager *config_manager.ConfigManager
@@ -574,6 +579,17 @@ func (c *Chandler) createAndSendPayment(session *ChandlerSession, proposal *Paym
 		Content: "",
 	}
 
+	// Upstreams advertising a NIP-13 difficulty reject payments without proof-of-work
+	if difficulty := advertisedPoW(session.Advertisement); difficulty > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), powTimeout)
+		nonceTag, err := nip13.DoWork(ctx, paymentEvent, difficulty)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute proof-of-work of %d bits: %w", difficulty, err)
+		}
+		paymentEvent.Tags = append(paymentEvent.Tags, nonceTag)
+	}
+
 	// Sign with customer identity
 	err = paymentEvent.Sign(customerPrivateKey)
 	if err != nil {
@@ -596,6 +612,22 @@ func (c *Chandler) createAndSendPayment(session *ChandlerSession, proposal *Paym
 	return sessionEvent, nil
 }
 
+// advertisedPoW returns the NIP-13 difficulty an advertisement requires on payments, 0 if none
+func advertisedPoW(advertisement *nostr.Event) int {
+	if advertisement == nil {
+		return 0
+	}
+	powTag := advertisement.Tags.Find("pow")
+	if powTag == nil {
+		return 0
+	}
+	difficulty, err := strconv.Atoi(powTag[1])
+	if err != nil || difficulty < 0 {
+		return 0
+	}
+	return difficulty
+}
+
 // sendPaymentToUpstream sends a payment event to an upstream TollGate and returns the session event
 func (c *Chandler) sendPaymentToUpstream(paymentEvent *nostr.Event, gatewayIP string) (*nostr.Event, error) {
 	// Marshal payment event to JSON
@@ -5,6 +5,7 @@ import (
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollgate_protocol"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 // Mock implementations for testing
@@ -120,3 +121,19 @@ func TestTrustPolicy(t *testing.T) {
 		t.Error("Expected ValidateTrustPolicy to fail with blocked pubkey")
 	}
 }
+
+func TestAdvertisedPoW(t *testing.T) {
+	if difficulty := advertisedPoW(nil); difficulty != 0 {
+		t.Errorf("Expected no difficulty without advertisement, got %d", difficulty)
+	}
+
+	advertisement := &nostr.Event{Kind: 10021, Tags: nostr.Tags{{"metric", "milliseconds"}}}
+	if difficulty := advertisedPoW(advertisement); difficulty != 0 {
+		t.Errorf("Expected no difficulty without pow tag, got %d", difficulty)
+	}
+
+	advertisement.Tags = append(advertisement.Tags, nostr.Tag{"pow", "16"})
+	if difficulty := advertisedPoW(advertisement); difficulty != 16 {
+		t.Errorf("Expected difficulty 16, got %d", difficulty)
+	}
+}
@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// adminCommand is a command of the admin API. The same table dispatches the commands and describes them in the
+// OpenAPI document, so the document can't miss a command.
+type adminCommand struct {
+	name       string
+	handle     func(s *CLIServer, msg CLIMessage) CLIResponse
+	operations []adminOperation
+}
+
+// adminOperation is an action of an admin command, selected by its leading arguments
+type adminOperation struct {
+	args    []string // Leading arguments selecting the action, e.g. private status
+	params  string   // Usage of the remaining arguments
+	flags   []string // Flags read by the action
+	summary string
+	data    any // Zero value of the response data, nil if the response only carries a message
+}
+
+// adminCommands are the commands served on the CLI socket and the admin onion service
+var adminCommands = []adminCommand{
+	{
+		name:   "wallet",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleWalletCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"drain", "cashu"}, summary: "Drain the balance of every mint into Cashu tokens", data: WalletDrainResult{}},
+			{args: []string{"balance"}, summary: "Total wallet balance", data: WalletInfo{}},
+			{args: []string{"info"}, summary: "Balance and payout queue of each mint", data: map[string]any{}},
+			{args: []string{"fund"}, params: "<cashu token>", summary: "Receive a Cashu token into the wallet", data: map[string]any{}},
+			{args: []string{"reconcile"}, summary: "Compare the balance of each mint with what the mint confirms", data: []tollwallet.BalanceReconciliation{}},
+			{args: []string{"repair"}, params: "<mint url>", summary: "Schedule a balance repair of a mint for the next start"},
+		},
+	},
+	{
+		name:   "network",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleNetworkCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"private", "status"}, summary: "Private network configuration", data: PrivateNetworkInfo{}},
+			{args: []string{"private", "enable"}, summary: "Enable the private network"},
+			{args: []string{"private", "disable"}, summary: "Disable the private network"},
+			{args: []string{"private", "rename"}, params: "<ssid>", summary: "Rename the private network"},
+			{args: []string{"private", "set-password"}, params: "[password]", summary: "Set the private network password, a random one if left out", data: map[string]any{}},
+		},
+	},
+	{
+		name:   "status",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleStatusCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{summary: "Service status, onion address and operator report", data: ServiceStatus{}},
+		},
+	},
+	{
+		name:   "version",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleVersionCommand() },
+		operations: []adminOperation{
+			{summary: "Version of the service", data: map[string]any{}},
+		},
+	},
+	{
+		name:   "stats",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleStatsCommand() },
+		operations: []adminOperation{
+			{summary: "Anonymized aggregate device statistics", data: merchant.DeviceStats{}},
+		},
+	},
+	{
+		name:   "nds",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleNDSCommand(msg.Args) },
+		operations: []adminOperation{
+			{args: []string{"check"}, summary: "Check the captive portal configuration", data: []valve.NDSIssue{}},
+			{args: []string{"fix"}, summary: "Repair the captive portal configuration", data: []valve.NDSIssue{}},
+		},
+	},
+	{
+		name:   "clients",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleClientsCommand() },
+		operations: []adminOperation{
+			{summary: "Clients with their DHCP lease and session", data: []merchant.ClientInfo{}},
+		},
+	},
+	{
+		name:   "selftest",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleSelfTestCommand() },
+		operations: []adminOperation{
+			{summary: "Buy a session for a made-up device with the gateway's own funds", data: merchant.SelfTestReport{}},
+		},
+	},
+	{
+		name:   "audit",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleAuditCommand(msg.Args) },
+		operations: []adminOperation{
+			{params: "[financial] [entries]", summary: "Tail of the audit log and whether its hash chain is intact", data: AuditReport{}},
+		},
+	},
+	{
+		name:   "ledger",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleLedgerCommand(msg.Args) },
+		operations: []adminOperation{
+			{params: "[days]", summary: "Ledger entries of the last days", data: LedgerReport{}},
+		},
+	},
+	{
+		name:   "pricing",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handlePricingCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"simulate"}, params: "<price per step>", flags: []string{"days", "mint", "step_size", "elasticity"},
+				summary: "Replay the purchases of the last days at another price per step", data: merchant.PriceSimulationReport{}},
+		},
+	},
+	{
+		name:   "config",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleConfigCommand(msg.Args, msg.Actor) },
+		operations: []adminOperation{
+			{args: []string{"preset"}, params: "[name]", summary: "List the venue presets, or apply one by name", data: []config_manager.VenuePreset{}},
+		},
+	},
+	{
+		name:   "state",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleStateCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"export"}, params: "<archive path>", flags: []string{"passphrase"},
+				summary: "Export the gateway state into an encrypted archive", data: merchant.MigrationSummary{}},
+			{args: []string{"import"}, params: "<archive path>", flags: []string{"passphrase"},
+				summary: "Import the state archive of a replaced gateway and restart", data: merchant.MigrationSummary{}},
+		},
+	},
+	{
+		name:   "cards",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleCardsCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"issue"}, params: "<count> <allotment> [tier]", flags: []string{"days"},
+				summary: "Issue pre-paid cards, one code per line of the message"},
+		},
+	},
+	{
+		name:   "debug",
+		handle: func(s *CLIServer, msg CLIMessage) CLIResponse { return s.handleDebugCommand(msg.Args, msg.Flags) },
+		operations: []adminOperation{
+			{args: []string{"bundle"}, params: "<archive path>", flags: []string{"to"},
+				summary: "Write a debug bundle, optionally sending it to a maintainer's pubkey", data: merchant.DebugBundleSummary{}},
+		},
+	},
+}
+
+// lookupCommand returns the admin command with a name
+func lookupCommand(name string) (adminCommand, bool) {
+	for _, command := range adminCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return adminCommand{}, false
+}
@@ -5,6 +5,8 @@ go 1.24.2
 require (
 	github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager v0.0.0
 	github.com/OpenTollGate/tollgate-module-basic-go/src/merchant v0.0.0
+	github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet v0.0.0
+	github.com/OpenTollGate/tollgate-module-basic-go/src/valve v0.0.0
 	github.com/sirupsen/logrus v1.9.3
 )
 
@@ -15,4 +17,6 @@ require (
 replace (
 	github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager => ../config_manager
 	github.com/OpenTollGate/tollgate-module-basic-go/src/merchant => ../merchant
+	github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet => ../tollwallet
+	github.com/OpenTollGate/tollgate-module-basic-go/src/valve => ../valve
 )
\ No newline at end of file
@@ -0,0 +1,274 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// Delays between attempts to publish the onion service again after the control connection dropped
+var (
+	onionRetryMinDelay = 5 * time.Second
+	onionRetryMaxDelay = 5 * time.Minute
+)
+
+// OnionService exposes the CLI socket as a Tor onion service through an external tor control port.
+// The onion service lives as long as the control connection stays open, so it is published again when the
+// connection drops, e.g. because tor restarted.
+type OnionService struct {
+	config    config_manager.TorConfig
+	keyPath   string
+	mu        sync.Mutex
+	control   *controlConn
+	serviceID string
+	stop      chan struct{}
+}
+
+// controlConn is a connection to the tor control port
+type controlConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewOnionService creates a new onion service for the admin API.
+// keyPath is where the onion private key is persisted so the address survives restarts.
+func NewOnionService(config config_manager.TorConfig, keyPath string) *OnionService {
+	return &OnionService{
+		config:  config,
+		keyPath: keyPath,
+	}
+}
+
+// Start connects to the tor control port and publishes the onion service. The admin API grants full control of
+// the gateway, so it is only published with client authorization: at least one authorized client key is required.
+func (o *OnionService) Start() error {
+	if o.config.VirtualPort <= 0 || o.config.VirtualPort > 65535 {
+		return fmt.Errorf("invalid onion virtual port: %d", o.config.VirtualPort)
+	}
+	if len(o.config.AuthorizedClients) == 0 {
+		return fmt.Errorf("refusing to publish the admin API without authorized clients, add a client auth key to tor.authorized_clients")
+	}
+	for _, client := range o.config.AuthorizedClients {
+		if !validClientAuthKey(client) {
+			return fmt.Errorf("invalid authorized client key %q, expected a base32 x25519 public key", client)
+		}
+	}
+
+	control, serviceID, err := o.publish()
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.control = control
+	o.serviceID = serviceID
+	o.stop = make(chan struct{})
+	stop := o.stop
+	o.mu.Unlock()
+
+	go o.maintain(control, stop)
+	return nil
+}
+
+// publish connects to the tor control port, authenticates and adds the onion service
+func (o *OnionService) publish() (*controlConn, string, error) {
+	conn, err := net.DialTimeout("tcp", o.config.ControlAddress, 10*time.Second)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to tor control port %s: %v", o.config.ControlAddress, err)
+	}
+	control := &controlConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if _, err := control.command(fmt.Sprintf("AUTHENTICATE \"%s\"", escapeControlString(o.config.ControlPassword))); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("tor control authentication failed: %v", err)
+	}
+
+	key, err := o.loadKey()
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	cmd := fmt.Sprintf("ADD_ONION %s Port=%d,unix:%s", key, o.config.VirtualPort, SocketPath)
+	for _, client := range o.config.AuthorizedClients {
+		cmd += " ClientAuthV3=" + client
+	}
+
+	lines, err := control.command(cmd)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to add onion service: %v", err)
+	}
+
+	serviceID := ""
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			serviceID = strings.TrimPrefix(line, "ServiceID=")
+		case strings.HasPrefix(line, "PrivateKey="):
+			if err := o.saveKey(strings.TrimPrefix(line, "PrivateKey=")); err != nil {
+				cliLogger.WithError(err).Warn("Failed to persist onion service key, address will change on restart")
+			}
+		}
+	}
+
+	if serviceID == "" {
+		conn.Close()
+		return nil, "", fmt.Errorf("tor did not return a service ID")
+	}
+
+	cliLogger.WithFields(logrus.Fields{
+		"onion_address":      fmt.Sprintf("%s.onion:%d", serviceID, o.config.VirtualPort),
+		"virtual_port":       o.config.VirtualPort,
+		"authorized_clients": len(o.config.AuthorizedClients),
+	}).Info("Admin API published as Tor onion service")
+
+	return control, serviceID, nil
+}
+
+// maintain waits for the control connection to drop and publishes the onion service again, retrying with a
+// growing delay while tor is unreachable, until the service is stopped
+func (o *OnionService) maintain(control *controlConn, stop chan struct{}) {
+	for {
+		// Without event subscriptions tor doesn't write to the control connection, so this returns once it closes
+		io.Copy(io.Discard, control.reader)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		cliLogger.Warn("Lost tor control connection, publishing the admin onion service again")
+
+		o.mu.Lock()
+		o.serviceID = ""
+		o.mu.Unlock()
+
+		delay := onionRetryMinDelay
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+
+			next, serviceID, err := o.publish()
+			if err == nil {
+				o.mu.Lock()
+				select {
+				case <-stop:
+					o.mu.Unlock()
+					next.conn.Close()
+					return
+				default:
+				}
+				o.control = next
+				o.serviceID = serviceID
+				o.mu.Unlock()
+				control = next
+				break
+			}
+			cliLogger.WithError(err).WithField("retry_in", delay*2).Warn("Failed to publish the admin onion service again")
+			delay = min(delay*2, onionRetryMaxDelay)
+		}
+	}
+}
+
+// Stop closes the control connection, which removes the onion service, and stops publishing it again
+func (o *OnionService) Stop() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.stop != nil {
+		close(o.stop)
+		o.stop = nil
+	}
+	o.serviceID = ""
+	if o.control == nil {
+		return nil
+	}
+	err := o.control.conn.Close()
+	o.control = nil
+	return err
+}
+
+// Address returns the onion address of the admin API, or an empty string if not published
+func (o *OnionService) Address() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.serviceID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.onion:%d", o.serviceID, o.config.VirtualPort)
+}
+
+// validClientAuthKey reports whether a key is a base32 encoded x25519 public key, as ClientAuthV3 takes
+func validClientAuthKey(key string) bool {
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(key))
+	return err == nil && len(decoded) == 32
+}
+
+// loadKey returns the persisted onion key, or a request for a new key if none exists yet
+func (o *OnionService) loadKey() (string, error) {
+	data, err := os.ReadFile(o.keyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "NEW:ED25519-V3", nil
+		}
+		return "", fmt.Errorf("failed to read onion key %s: %v", o.keyPath, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// saveKey persists the onion key returned by tor
+func (o *OnionService) saveKey(key string) error {
+	return os.WriteFile(o.keyPath, []byte(key+"\n"), 0600)
+}
+
+// command sends a single control port command and returns the reply lines without status codes
+func (c *controlConn) command(cmd string) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed tor control reply: %q", line)
+		}
+
+		status, separator, text := line[:3], line[3], line[4:]
+		if status != "250" {
+			return nil, fmt.Errorf("tor control error: %s", line)
+		}
+		lines = append(lines, text)
+
+		// A space after the status code marks the final line of the reply
+		if separator == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// escapeControlString escapes a value for use inside a quoted control port string
+func escapeControlString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/base32"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+const (
+	fakeServiceID  = "abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstuvwx"
+	fakePrivateKey = "ED25519-V3:c2VjcmV0"
+)
+
+// fakeTor is a tor control port answering AUTHENTICATE and ADD_ONION, recording every command it receives
+type fakeTor struct {
+	listener net.Listener
+	password string
+	commands chan string
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newFakeTor(t *testing.T, password string) *fakeTor {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tor := &fakeTor{listener: listener, password: password, commands: make(chan string, 16)}
+	t.Cleanup(func() {
+		listener.Close()
+		tor.drop()
+	})
+	go tor.serve()
+	return tor
+}
+
+func (f *fakeTor) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeTor) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.commands <- line
+
+		switch {
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			if line != fmt.Sprintf("AUTHENTICATE %q", f.password) {
+				fmt.Fprint(conn, "515 Authentication failed: Password did not match HashedControlPassword value from configuration\r\n")
+				conn.Close()
+				return
+			}
+			fmt.Fprint(conn, "250 OK\r\n")
+		case strings.HasPrefix(line, "ADD_ONION "):
+			fmt.Fprintf(conn, "250-ServiceID=%s\r\n", fakeServiceID)
+			if strings.HasPrefix(line, "ADD_ONION NEW:") {
+				fmt.Fprintf(conn, "250-PrivateKey=%s\r\n", fakePrivateKey)
+			}
+			fmt.Fprint(conn, "250 OK\r\n")
+		default:
+			fmt.Fprint(conn, "510 Unrecognized command\r\n")
+		}
+	}
+}
+
+// drop closes the open control connections, as a tor restart does
+func (f *fakeTor) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// next returns the next command received by the control port
+func (f *fakeTor) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case command := <-f.commands:
+		return command
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a control port command")
+		return ""
+	}
+}
+
+func testClientKey(fill byte) string {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = fill
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+}
+
+func testTorConfig(address string, clients ...string) config_manager.TorConfig {
+	return config_manager.TorConfig{
+		Enabled:           true,
+		ControlAddress:    address,
+		ControlPassword:   `pass"word`,
+		VirtualPort:       2122,
+		AuthorizedClients: clients,
+	}
+}
+
+func TestOnionServiceRequiresAuthorizedClients(t *testing.T) {
+	tor := newFakeTor(t, `pass"word`)
+	keyPath := filepath.Join(t.TempDir(), "admin_onion_key")
+
+	tests := []struct {
+		name    string
+		clients []string
+	}{
+		{"no clients", nil},
+		{"invalid key", []string{"not-a-key"}},
+		{"short key", []string{"AAAAAAAA"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			onion := NewOnionService(testTorConfig(tor.listener.Addr().String(), tt.clients...), keyPath)
+			if err := onion.Start(); err == nil {
+				onion.Stop()
+				t.Fatal("Expected the onion service to refuse to start")
+			}
+			if onion.Address() != "" {
+				t.Errorf("Expected no onion address, got %q", onion.Address())
+			}
+		})
+	}
+
+	select {
+	case command := <-tor.commands:
+		t.Errorf("Expected no control port commands, got %q", command)
+	default:
+	}
+}
+
+func TestOnionServiceControlExchange(t *testing.T) {
+	tor := newFakeTor(t, `pass"word`)
+	keyPath := filepath.Join(t.TempDir(), "admin_onion_key")
+	first, second := testClientKey(0x01), strings.ToLower(testClientKey(0x02))
+
+	onion := NewOnionService(testTorConfig(tor.listener.Addr().String(), first, second), keyPath)
+	if err := onion.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer onion.Stop()
+
+	if command := tor.next(t); command != `AUTHENTICATE "pass\"word"` {
+		t.Errorf("Unexpected authentication command %q", command)
+	}
+	expected := fmt.Sprintf("ADD_ONION NEW:ED25519-V3 Port=2122,unix:%s ClientAuthV3=%s ClientAuthV3=%s", SocketPath, first, second)
+	if command := tor.next(t); command != expected {
+		t.Errorf("Expected %q, got %q", expected, command)
+	}
+
+	if address := onion.Address(); address != fakeServiceID+".onion:2122" {
+		t.Errorf("Unexpected onion address %q", address)
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("Expected the onion key to be persisted: %v", err)
+	}
+	if strings.TrimSpace(string(key)) != fakePrivateKey {
+		t.Errorf("Expected persisted key %q, got %q", fakePrivateKey, key)
+	}
+}
+
+func TestOnionServiceAuthenticationFailure(t *testing.T) {
+	tor := newFakeTor(t, "other")
+	onion := NewOnionService(testTorConfig(tor.listener.Addr().String(), testClientKey(0x01)), filepath.Join(t.TempDir(), "admin_onion_key"))
+
+	err := onion.Start()
+	if err == nil {
+		onion.Stop()
+		t.Fatal("Expected Start to fail with a wrong control password")
+	}
+	if !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+	if onion.Address() != "" {
+		t.Errorf("Expected no onion address, got %q", onion.Address())
+	}
+}
+
+func TestOnionServiceRepublishesAfterTorRestart(t *testing.T) {
+	minDelay, maxDelay := onionRetryMinDelay, onionRetryMaxDelay
+	onionRetryMinDelay, onionRetryMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+	defer func() { onionRetryMinDelay, onionRetryMaxDelay = minDelay, maxDelay }()
+
+	tor := newFakeTor(t, `pass"word`)
+	client := testClientKey(0x01)
+	onion := NewOnionService(testTorConfig(tor.listener.Addr().String(), client), filepath.Join(t.TempDir(), "admin_onion_key"))
+	if err := onion.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer onion.Stop()
+	tor.next(t)
+	tor.next(t)
+
+	tor.drop()
+
+	if command := tor.next(t); !strings.HasPrefix(command, "AUTHENTICATE ") {
+		t.Fatalf("Expected the service to authenticate again, got %q", command)
+	}
+	expected := fmt.Sprintf("ADD_ONION %s Port=2122,unix:%s ClientAuthV3=%s", fakePrivateKey, SocketPath, client)
+	if command := tor.next(t); command != expected {
+		t.Fatalf("Expected the service to be published again with its key, got %q", command)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for onion.Address() != fakeServiceID+".onion:2122" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the onion address to be restored, got %q", onion.Address())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnionServiceStopEndsRepublishing(t *testing.T) {
+	minDelay := onionRetryMinDelay
+	onionRetryMinDelay = 10 * time.Millisecond
+	defer func() { onionRetryMinDelay = minDelay }()
+
+	tor := newFakeTor(t, `pass"word`)
+	onion := NewOnionService(testTorConfig(tor.listener.Addr().String(), testClientKey(0x01)), filepath.Join(t.TempDir(), "admin_onion_key"))
+	if err := onion.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	tor.next(t)
+	tor.next(t)
+
+	if err := onion.Stop(); err != nil {
+		t.Fatalf("Stop returned error: %v", err)
+	}
+	if onion.Address() != "" {
+		t.Errorf("Expected no onion address after Stop, got %q", onion.Address())
+	}
+
+	select {
+	case command := <-tor.commands:
+		t.Errorf("Expected no reconnection after Stop, got %q", command)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
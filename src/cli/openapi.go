@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI document of the admin API is generated from the command table and the Go types the handlers
+// return, so clients generated from it stay in sync with the server without a hand-maintained spec.
+var (
+	openAPISpec     []byte
+	openAPISpecErr  error
+	openAPISpecOnce sync.Once
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchemas collects the component schemas of the Go types referenced by the spec
+type openAPISchemas map[string]any
+
+// schemaFor returns the schema of a Go type. Structs are added to the components and referenced by name.
+func (s openAPISchemas) schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"} // Encoded in base64
+		}
+		return map[string]any{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, known := s[name]; !known {
+			s[name] = nil // Placeholder, so recursive types don't loop
+			s[name] = s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// structSchema describes the JSON encoding of a struct, following its json tags
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	s.addFields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the properties of the fields of a struct, promoting the fields of untagged embedded structs as
+// encoding/json does
+func (s openAPISchemas) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schemaFor(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// jsonContent wraps a schema as an application/json body
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// operationPath returns the path of an admin operation: its command and leading arguments
+func operationPath(command adminCommand, operation adminOperation) string {
+	return "/" + strings.Join(append([]string{command.name}, operation.args...), "/")
+}
+
+// operationID returns the camel case identifier of an admin operation, e.g. networkPrivateSetPassword
+func operationID(command adminCommand, operation adminOperation) string {
+	id := command.name
+	for _, arg := range operation.args {
+		for _, word := range strings.Split(arg, "-") {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// operationSpec describes an admin operation: the message selecting it and the response it is answered with
+func (s openAPISchemas) operationSpec(command adminCommand, operation adminOperation) map[string]any {
+	usage := strings.TrimSpace(strings.Join(append(append([]string{"tollgate", command.name}, operation.args...), operation.params), " "))
+
+	args := map[string]any{
+		"type":        "array",
+		"items":       map[string]any{"type": "string"},
+		"description": "Arguments of: " + usage,
+	}
+	if len(operation.args) > 0 {
+		args["minItems"] = len(operation.args)
+	}
+	message := map[string]any{
+		"command": map[string]any{"type": "string", "enum": []string{command.name}},
+		"args":    args,
+	}
+	if len(operation.flags) > 0 {
+		flags := map[string]any{}
+		for _, flag := range operation.flags {
+			flags[flag] = map[string]any{"type": "string"}
+		}
+		message["flags"] = map[string]any{"type": "object", "properties": flags}
+	}
+
+	response := s.schemaFor(reflect.TypeOf(CLIResponse{}))
+	if operation.data != nil {
+		response = map[string]any{"allOf": []any{
+			response,
+			map[string]any{"properties": map[string]any{"data": s.schemaFor(reflect.TypeOf(operation.data))}},
+		}}
+	}
+
+	return map[string]any{
+		"operationId": operationID(command, operation),
+		"summary":     operation.summary,
+		"description": "Sent as the message {\"command\": \"" + command.name + "\", \"args\": [...]}: " + usage,
+		"tags":        []string{command.name},
+		"requestBody": map[string]any{
+			"required": true,
+			"content": jsonContent(map[string]any{"allOf": []any{
+				s.schemaFor(reflect.TypeOf(CLIMessage{})),
+				map[string]any{"properties": message},
+			}}),
+		},
+		"responses": map[string]any{
+			"200": map[string]any{
+				"description": "Result of the command, success is false with an error if it failed",
+				"content":     jsonContent(response),
+			},
+		},
+	}
+}
+
+// buildOpenAPISpec describes the admin API: every command of the command table with its actions
+func buildOpenAPISpec() ([]byte, error) {
+	schemas := openAPISchemas{}
+	paths := map[string]any{}
+	var tags []any
+	for _, command := range adminCommands {
+		tags = append(tags, map[string]any{"name": command.name})
+		for _, operation := range command.operations {
+			paths[operationPath(command, operation)] = map[string]any{"post": schemas.operationSpec(command, operation)}
+		}
+	}
+
+	spec := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "TollGate admin API",
+			"version": "1.0.0",
+			"description": "Admin API of a TollGate, served on the Unix socket " + SocketPath + " and, when enabled, the admin onion " +
+				"service. Each request is a single JSON message followed by a newline and is answered with a single JSON response. " +
+				"Paths name the command and its leading arguments, the message carries them in command and args.",
+		},
+		"tags":       tags,
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+// OpenAPISpec returns the OpenAPI document of the admin API, for generating clients
+func OpenAPISpec() ([]byte, error) {
+	openAPISpecOnce.Do(func() {
+		openAPISpec, openAPISpecErr = buildOpenAPISpec()
+	})
+	return openAPISpec, openAPISpecErr
+}
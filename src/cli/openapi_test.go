@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// parseOpenAPISpec builds the OpenAPI document and decodes it generically
+func parseOpenAPISpec(t *testing.T) map[string]any {
+	t.Helper()
+	data, err := buildOpenAPISpec()
+	if err != nil {
+		t.Fatalf("buildOpenAPISpec returned error: %v", err)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("Failed to parse OpenAPI document: %v", err)
+	}
+	return spec
+}
+
+// collectRefs returns every $ref in a decoded JSON value
+func collectRefs(value any, refs *[]string) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+				continue
+			}
+			collectRefs(child, refs)
+		}
+	case []any:
+		for _, child := range value {
+			collectRefs(child, refs)
+		}
+	}
+}
+
+func TestOpenAPISpecIsValid(t *testing.T) {
+	spec := parseOpenAPISpec(t)
+
+	if version, _ := spec["openapi"].(string); !strings.HasPrefix(version, "3.0.") {
+		t.Errorf("Expected an OpenAPI 3.0 document, got version %v", spec["openapi"])
+	}
+	info, _ := spec["info"].(map[string]any)
+	if info["title"] == "" || info["title"] == nil || info["version"] == "" || info["version"] == nil {
+		t.Errorf("Expected a title and version in info, got %v", info)
+	}
+
+	paths, ok := spec["paths"].(map[string]any)
+	if !ok || len(paths) == 0 {
+		t.Fatal("Expected paths in the OpenAPI document")
+	}
+	operationIDs := make(map[string]string)
+	for path, item := range paths {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("Expected path %q to start with /", path)
+		}
+		operation, ok := item.(map[string]any)["post"].(map[string]any)
+		if !ok {
+			t.Errorf("Expected a post operation for %s", path)
+			continue
+		}
+		id, _ := operation["operationId"].(string)
+		if id == "" {
+			t.Errorf("Expected an operationId for %s", path)
+		} else if other, taken := operationIDs[id]; taken {
+			t.Errorf("operationId %s of %s is also used by %s", id, path, other)
+		}
+		operationIDs[id] = path
+		if operation["summary"] == "" {
+			t.Errorf("Expected a summary for %s", path)
+		}
+		if _, ok := operation["requestBody"].(map[string]any)["content"].(map[string]any)["application/json"]; !ok {
+			t.Errorf("Expected a JSON request body for %s", path)
+		}
+		if _, ok := operation["responses"].(map[string]any)["200"].(map[string]any)["description"].(string); !ok {
+			t.Errorf("Expected a described 200 response for %s", path)
+		}
+	}
+
+	schemas, _ := spec["components"].(map[string]any)["schemas"].(map[string]any)
+	var refs []string
+	collectRefs(spec, &refs)
+	if len(refs) == 0 {
+		t.Fatal("Expected references to component schemas")
+	}
+	for _, ref := range refs {
+		name, found := strings.CutPrefix(ref, "#/components/schemas/")
+		if !found {
+			t.Errorf("Unexpected reference %q", ref)
+			continue
+		}
+		if schema, ok := schemas[name].(map[string]any); !ok || schema["type"] != "object" {
+			t.Errorf("Reference %q does not resolve to an object schema", ref)
+		}
+	}
+}
+
+func TestOpenAPISpecListsEveryAdminCommand(t *testing.T) {
+	spec := parseOpenAPISpec(t)
+	paths := spec["paths"].(map[string]any)
+
+	for _, command := range adminCommands {
+		if len(command.operations) == 0 {
+			t.Errorf("Expected the %s command to describe its operations", command.name)
+		}
+		for _, operation := range command.operations {
+			path := operationPath(command, operation)
+			item, ok := paths[path].(map[string]any)
+			if !ok {
+				t.Errorf("Expected path %s for the %s command", path, command.name)
+				continue
+			}
+			if id := item["post"].(map[string]any)["operationId"]; id != operationID(command, operation) {
+				t.Errorf("Expected operationId %s for %s, got %v", operationID(command, operation), path, id)
+			}
+		}
+	}
+	for _, path := range []string{"/status", "/wallet/balance", "/wallet/drain/cashu", "/network/private/set-password", "/pricing/simulate", "/debug/bundle"} {
+		if _, ok := paths[path]; !ok {
+			t.Errorf("Expected path %s in the OpenAPI document", path)
+		}
+	}
+	if _, ok := paths["/"]; ok {
+		t.Error("Expected no customer API paths in the admin OpenAPI document")
+	}
+}
+
+func TestOpenAPISpecSchemas(t *testing.T) {
+	spec := parseOpenAPISpec(t)
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	tests := []struct {
+		schema     string
+		properties []string
+	}{
+		{"CLIMessage", []string{"command", "args", "flags", "actor", "timestamp"}},
+		{"CLIResponse", []string{"success", "message", "data", "error", "timestamp"}},
+		{"ServiceStatus", []string{"running", "onion_address", "operator"}},
+		{"WalletInfo", []string{"balance_sats"}},
+		// Fields of embedded structs are promoted, as encoding/json does
+		{"PriceSimulationReport", []string{"price_per_step", "elasticity", "simulated_revenue"}},
+	}
+	for _, tt := range tests {
+		schema, ok := schemas[tt.schema].(map[string]any)
+		if !ok {
+			t.Errorf("Expected a %s schema", tt.schema)
+			continue
+		}
+		properties := schema["properties"].(map[string]any)
+		for _, property := range tt.properties {
+			if _, ok := properties[property]; !ok {
+				t.Errorf("Expected %q in the %s schema", property, tt.schema)
+			}
+		}
+	}
+
+	timestamp := schemas["CLIMessage"].(map[string]any)["properties"].(map[string]any)["timestamp"].(map[string]any)
+	if timestamp["format"] != "date-time" {
+		t.Errorf("Expected timestamps to be date-time strings, got %v", timestamp)
+	}
+}
+
+func TestProcessCommandRejectsUnknownCommand(t *testing.T) {
+	server := NewCLIServer(nil, nil)
+	response := server.processCommand(CLIMessage{Command: "unknown"})
+	if response.Success || !strings.Contains(response.Error, "Unknown command") {
+		t.Errorf("Expected an unknown command error, got %+v", response)
+	}
+
+	response = server.processCommand(CLIMessage{Command: "version"})
+	if !response.Success {
+		t.Errorf("Expected the version command to be dispatched, got %+v", response)
+	}
+}
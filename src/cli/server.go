@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,6 +33,7 @@ type CLIServer struct {
 	startTime     time.Time
 	listener      net.Listener
 	running       bool
+	onion         *OnionService
 }
 
 // NewCLIServer creates a new CLI server instance
@@ -66,6 +72,15 @@ func (s *CLIServer) Start() error {
 	// Accept connections in a goroutine
 	go s.acceptConnections()
 
+	// Optionally publish the socket as a Tor onion service for remote administration
+	if config := s.configManager.GetConfig(); config != nil && config.Tor.Enabled {
+		keyPath := filepath.Join(filepath.Dir(s.configManager.ConfigFilePath), "admin_onion_key")
+		s.onion = NewOnionService(config.Tor, keyPath)
+		if err := s.onion.Start(); err != nil {
+			cliLogger.WithError(err).Error("Failed to publish admin API as Tor onion service")
+		}
+	}
+
 	return nil
 }
 
@@ -77,6 +92,10 @@ func (s *CLIServer) Stop() error {
 
 	s.running = false
 
+	if s.onion != nil {
+		s.onion.Stop()
+	}
+
 	if s.listener != nil {
 		s.listener.Close()
 	}
@@ -132,6 +151,7 @@ func (s *CLIServer) handleConnection(conn net.Conn) {
 	}
 
 	response := s.processCommand(msg)
+	s.auditCommand(msg, response)
 	s.sendResponse(conn, response)
 }
 
@@ -142,22 +162,298 @@ func (s *CLIServer) processCommand(msg CLIMessage) CLIResponse {
 		"args":    msg.Args,
 	}).Debug("Processing CLI command")
 
+	command, exists := lookupCommand(msg.Command)
+	if !exists {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Unknown command: %s", msg.Command),
+			Timestamp: time.Now(),
+		}
+	}
+	return command.handle(s, msg)
+}
+
+// privilegedAction returns the audit action of a command that moves funds or changes the configuration
+func privilegedAction(msg CLIMessage) (string, bool) {
+	if len(msg.Args) == 0 {
+		return "", false
+	}
 	switch msg.Command {
 	case "wallet":
-		return s.handleWalletCommand(msg.Args, msg.Flags)
+		switch msg.Args[0] {
+		case "drain":
+			return config_manager.AuditWalletExport, true
+		case "fund":
+			return config_manager.AuditWalletFund, true
+		case "repair":
+			return config_manager.AuditWalletRepair, true
+		}
 	case "network":
-		return s.handleNetworkCommand(msg.Args, msg.Flags)
-	case "status":
-		return s.handleStatusCommand(msg.Args, msg.Flags)
-	case "version":
-		return s.handleVersionCommand()
-	default:
+		if len(msg.Args) > 1 && msg.Args[0] == "private" && msg.Args[1] != "status" {
+			return config_manager.AuditConfigChange, true
+		}
+	case "nds":
+		if msg.Args[0] == "fix" {
+			return config_manager.AuditConfigChange, true
+		}
+	case "state":
+		switch msg.Args[0] {
+		case "export":
+			return config_manager.AuditStateExport, true
+		case "import":
+			return config_manager.AuditStateImport, true
+		}
+	case "cards":
+		if msg.Args[0] == "issue" {
+			return config_manager.AuditCardIssue, true
+		}
+	case "debug":
+		if msg.Args[0] == "bundle" {
+			return config_manager.AuditDebugBundle, true
+		}
+	}
+	return "", false
+}
+
+// auditCommand records a successful privileged command. Arguments are left out, they may hold tokens or passwords.
+func (s *CLIServer) auditCommand(msg CLIMessage, response CLIResponse) {
+	action, privileged := privilegedAction(msg)
+	if !privileged || !response.Success {
+		return
+	}
+
+	actor := "cli"
+	if msg.Actor != "" {
+		actor = "cli:" + msg.Actor
+	}
+	command := msg.Command + " " + msg.Args[0]
+	if msg.Command == "network" {
+		command += " " + msg.Args[1]
+	}
+	s.configManager.Audit(actor, action, map[string]string{
+		"command": command,
+		"result":  response.Message,
+	})
+}
+
+// handleAuditCommand returns the latest audit log entries and verifies the hash chain. With "financial" first it
+// reads the log of receives, sends, melts, refunds and payouts instead of privileged actions.
+func (s *CLIServer) handleAuditCommand(args []string) CLIResponse {
+	auditLog := s.configManager.GetAuditLog()
+	if len(args) > 0 && args[0] == "financial" {
+		auditLog = s.configManager.GetFinancialAuditLog()
+		args = args[1:]
+	}
+	if auditLog == nil {
 		return CLIResponse{
 			Success:   false,
-			Error:     fmt.Sprintf("Unknown command: %s", msg.Command),
+			Error:     "Audit log not available",
+			Timestamp: time.Now(),
+		}
+	}
+
+	limit := 50
+	if len(args) > 0 {
+		parsed, err := strconv.Atoi(args[0])
+		if err != nil || parsed < 0 {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid number of entries: %s", args[0]),
+				Timestamp: time.Now(),
+			}
+		}
+		limit = parsed
+	}
+
+	entries, err := auditLog.Entries(limit)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to read audit log: %v", err),
+			Timestamp: time.Now(),
+		}
+	}
+
+	report := AuditReport{Entries: entries, Verified: true}
+	message := fmt.Sprintf("%d audit entries, hash chain intact", len(entries))
+	if err := auditLog.Verify(); err != nil {
+		report.Verified = false
+		report.VerifyError = err.Error()
+		message = fmt.Sprintf("%d audit entries, hash chain broken: %v", len(entries), err)
+	}
+
+	return CLIResponse{
+		Success:   true,
+		Message:   message,
+		Data:      report,
+		Timestamp: time.Now(),
+	}
+}
+
+// handlePricingCommand replays the purchases of the last days, 30 by default, at a hypothetical price per step
+func (s *CLIServer) handlePricingCommand(args []string, flags map[string]string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+	if len(args) != 2 || args[0] != "simulate" {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Pricing command requires: simulate <price_per_step>",
+			Timestamp: time.Now(),
+		}
+	}
+
+	pricePerStep, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Invalid price per step: %s", args[1]),
+			Timestamp: time.Now(),
+		}
+	}
+	simulation := merchant.PriceSimulation{PricePerStep: pricePerStep, MintURL: flags["mint"]}
+	days := 30
+	if value, ok := flags["days"]; ok {
+		if days, err = strconv.Atoi(value); err != nil || days <= 0 {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid number of days: %s", value),
+				Timestamp: time.Now(),
+			}
+		}
+	}
+	simulation.Since = time.Now().AddDate(0, 0, -days).Unix()
+	if value, ok := flags["step_size"]; ok {
+		if simulation.StepSize, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid step size: %s", value),
+				Timestamp: time.Now(),
+			}
+		}
+	}
+	if value, ok := flags["elasticity"]; ok {
+		if simulation.Elasticity, err = strconv.ParseFloat(value, 64); err != nil {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid elasticity: %s", value),
+				Timestamp: time.Now(),
+			}
+		}
+	}
+
+	report, err := s.merchant.SimulatePricing(simulation)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to simulate pricing: %v", err),
 			Timestamp: time.Now(),
 		}
 	}
+	return CLIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d purchases in the last %d days made %d sats, at %d sats per step they would have made %d sats (%+.1f%%)",
+			report.Purchases, days, report.ActualRevenue, pricePerStep, report.SimulatedRevenue, report.ChangePercent),
+		Data:      report,
+		Timestamp: time.Now(),
+	}
+}
+
+// handleLedgerCommand shows the ledger entries of the last days, 7 by default. Needs a storage backend with history.
+func (s *CLIServer) handleLedgerCommand(args []string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+
+	days := 7
+	if len(args) > 0 {
+		parsed, err := strconv.Atoi(args[0])
+		if err != nil || parsed <= 0 {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid number of days: %s", args[0]),
+				Timestamp: time.Now(),
+			}
+		}
+		days = parsed
+	}
+
+	since := time.Now().AddDate(0, 0, -days).Unix()
+	entries, err := s.merchant.GetLedger(since)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to read ledger: %v", err),
+			Timestamp: time.Now(),
+		}
+	}
+
+	report := LedgerReport{Since: since, Entries: entries, Totals: make(map[string]uint64)}
+	for _, entry := range entries {
+		report.Totals[entry.Type] += entry.Amount
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("%d ledger entries in the last %d days", len(entries), days),
+		Data:      report,
+		Timestamp: time.Now(),
+	}
+}
+
+// handleConfigCommand lists the venue presets or applies one. The config update is audited with its changed fields.
+func (s *CLIServer) handleConfigCommand(args []string, user string) CLIResponse {
+	if len(args) == 0 || args[0] != "preset" {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Config command requires an action (preset)",
+			Timestamp: time.Now(),
+		}
+	}
+
+	if len(args) == 1 {
+		presets := config_manager.VenuePresets()
+		return CLIResponse{
+			Success:   true,
+			Message:   fmt.Sprintf("%d venue presets available, apply one with 'tollgate config preset <name>'", len(presets)),
+			Data:      presets,
+			Timestamp: time.Now(),
+		}
+	}
+
+	actor := "cli"
+	if user != "" {
+		actor = "cli:" + user
+	}
+	name := args[1]
+	var presetErr error
+	err := s.configManager.UpdateConfigAs(actor, func(config *config_manager.Config) bool {
+		presetErr = config_manager.ApplyVenuePreset(config, name)
+		return presetErr == nil
+	})
+	if presetErr != nil {
+		err = presetErr
+	}
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to apply venue preset: %v", err),
+			Timestamp: time.Now(),
+		}
+	}
+
+	return CLIResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("Applied venue preset %s, adjust config.json to fine-tune it", name),
+		Timestamp: time.Now(),
+	}
 }
 
 // handleWalletCommand processes wallet-related commands
@@ -165,7 +461,7 @@ func (s *CLIServer) handleWalletCommand(args []string, flags map[string]string)
 	if len(args) == 0 {
 		return CLIResponse{
 			Success:   false,
-			Error:     "Wallet command requires an action (drain, balance, info)",
+			Error:     "Wallet command requires an action (drain, balance, info, fund, reconcile, repair)",
 			Timestamp: time.Now(),
 		}
 	}
@@ -180,10 +476,14 @@ func (s *CLIServer) handleWalletCommand(args []string, flags map[string]string)
 		return s.handleWalletInfo()
 	case "fund":
 		return s.handleWalletFund(args[1:], flags)
+	case "reconcile":
+		return s.handleWalletReconcile()
+	case "repair":
+		return s.handleWalletRepair(args[1:])
 	default:
 		return CLIResponse{
 			Success:   false,
-			Error:     fmt.Sprintf("Unknown wallet action: %s (supported: drain, balance, info, fund)", action),
+			Error:     fmt.Sprintf("Unknown wallet action: %s (supported: drain, balance, info, fund, reconcile, repair)", action),
 			Timestamp: time.Now(),
 		}
 	}
@@ -362,11 +662,80 @@ func (s *CLIServer) handleWalletInfo() CLIResponse {
 			"total_balance": totalBalance,
 			"mint_count":    len(acceptedMints),
 			"mint_balances": mintBalances,
+			"mint_queues":   s.merchant.GetWalletQueueMetrics(),
 		},
 		Timestamp: time.Now(),
 	}
 }
 
+// handleWalletReconcile compares the balance of each mint with what the mint confirms
+func (s *CLIServer) handleWalletReconcile() CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not available",
+			Timestamp: time.Now(),
+		}
+	}
+
+	reports, err := s.merchant.ReconcileBalances()
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     err.Error(),
+			Timestamp: time.Now(),
+		}
+	}
+
+	drifted := 0
+	for _, report := range reports {
+		if report.Error == "" && report.Drift != 0 {
+			drifted++
+		}
+	}
+	message := fmt.Sprintf("Reconciled %d mints, balances match", len(reports))
+	if drifted > 0 {
+		message = fmt.Sprintf("Reconciled %d mints, %d drifted, run 'wallet repair <mint>' to repair them", len(reports), drifted)
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   message,
+		Data:      reports,
+		Timestamp: time.Now(),
+	}
+}
+
+// handleWalletRepair schedules a balance repair of a mint for the next start
+func (s *CLIServer) handleWalletRepair(repairArgs []string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not available",
+			Timestamp: time.Now(),
+		}
+	}
+	if len(repairArgs) == 0 {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Repair command requires a mint URL",
+			Timestamp: time.Now(),
+		}
+	}
+
+	if err := s.merchant.RepairBalance(repairArgs[0]); err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     err.Error(),
+			Timestamp: time.Now(),
+		}
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("Balance repair of %s scheduled, restart TollGate to apply it", repairArgs[0]),
+		Timestamp: time.Now(),
+	}
+}
+
 // handleWalletFund processes the wallet fund command
 func (s *CLIServer) handleWalletFund(fundArgs []string, flags map[string]string) CLIResponse {
 	if len(fundArgs) == 0 {
@@ -432,6 +801,14 @@ func (s *CLIServer) handleStatusCommand(args []string, flags map[string]string)
 		NetworkOK: true, // TODO: Check actual network status
 	}
 
+	if s.onion != nil {
+		status.OnionAddress = s.onion.Address()
+	}
+	if s.merchant != nil {
+		operatorStatus := s.merchant.GetOperatorStatus()
+		status.Operator = &operatorStatus
+	}
+
 	return CLIResponse{
 		Success:   true,
 		Message:   "Service status retrieved",
@@ -440,6 +817,224 @@ func (s *CLIServer) handleStatusCommand(args []string, flags map[string]string)
 	}
 }
 
+// handleStatsCommand returns anonymized aggregate device statistics
+func (s *CLIServer) handleStatsCommand() CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+
+	config := s.configManager.GetConfig()
+	if config == nil || !config.Analytics.DeviceClassification {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Device analytics are disabled, set analytics.device_classification in config.json to enable them",
+			Timestamp: time.Now(),
+		}
+	}
+
+	return CLIResponse{
+		Success:   true,
+		Message:   "Device statistics retrieved",
+		Data:      s.merchant.GetDeviceStats(),
+		Timestamp: time.Now(),
+	}
+}
+
+// handleClientsCommand lists clients with their DHCP lease and session
+func (s *CLIServer) handleClientsCommand() CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+
+	clients := s.merchant.GetClients()
+	return CLIResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("%d clients", len(clients)),
+		Data:      clients,
+		Timestamp: time.Now(),
+	}
+}
+
+// handleNDSCommand checks or repairs the captive portal configuration
+func (s *CLIServer) handleNDSCommand(args []string) CLIResponse {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "fix") {
+		return CLIResponse{
+			Success:   false,
+			Error:     "NDS command requires an action (check, fix)",
+			Timestamp: time.Now(),
+		}
+	}
+
+	config := s.configManager.GetConfig()
+	if config == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Config not available",
+			Timestamp: time.Now(),
+		}
+	}
+
+	issues, err := valve.ValidateNDSConfig(config.NDS)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to check captive portal configuration: %v", err),
+			Timestamp: time.Now(),
+		}
+	}
+
+	if len(issues) == 0 {
+		return CLIResponse{
+			Success:   true,
+			Message:   "Captive portal configuration OK",
+			Timestamp: time.Now(),
+		}
+	}
+
+	if args[0] == "check" {
+		return CLIResponse{
+			Success:   false,
+			Message:   fmt.Sprintf("Found %d captive portal misconfigurations, run 'tollgate nds fix' to repair them", len(issues)),
+			Data:      issues,
+			Error:     "Captive portal misconfigured",
+			Timestamp: time.Now(),
+		}
+	}
+
+	if err := valve.FixNDSConfig(issues); err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to fix captive portal configuration: %v", err),
+			Data:      issues,
+			Timestamp: time.Now(),
+		}
+	}
+
+	return CLIResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("Fixed %d captive portal settings", len(issues)),
+		Data:      issues,
+		Timestamp: time.Now(),
+	}
+}
+
+// handleSelfTestCommand buys a session for a made-up device with the gateway's own funds and reports each stage
+func (s *CLIServer) handleSelfTestCommand() CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+
+	report := s.merchant.RunSelfTest()
+	if !report.Passed {
+		// Failed responses are shown without their data, name the stage that failed
+		failure := "Self-test failed"
+		for _, stage := range report.Stages {
+			if !stage.Passed {
+				failure = fmt.Sprintf("Self-test failed at the %s stage: %s", stage.Name, stage.Detail)
+				break
+			}
+		}
+		return CLIResponse{
+			Success:   false,
+			Error:     failure,
+			Data:      report,
+			Timestamp: time.Now(),
+		}
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   "Self-test passed, this gateway can sell access",
+		Data:      report,
+		Timestamp: time.Now(),
+	}
+}
+
+// serviceInitScript restarts the service after a state import, so imported identities and sessions take effect
+const serviceInitScript = "/etc/init.d/tollgate-wrt"
+
+// handleStateCommand exports the gateway state into an encrypted archive, or imports one on a replacement router
+func (s *CLIServer) handleStateCommand(args []string, flags map[string]string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+	if len(args) != 2 || (args[0] != "export" && args[0] != "import") {
+		return CLIResponse{
+			Success:   false,
+			Error:     "State command requires an action (export, import) and an archive path",
+			Timestamp: time.Now(),
+		}
+	}
+
+	action, path := args[0], args[1]
+	passphrase := flags["passphrase"]
+	if action == "export" {
+		summary, err := s.merchant.ExportState(path, passphrase)
+		if err != nil {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Failed to export state: %v", err),
+				Timestamp: time.Now(),
+			}
+		}
+		return CLIResponse{
+			Success: true,
+			Message: fmt.Sprintf("Exported %d sats, %d sessions and %d state files to %s. This gateway no longer sells sessions, "+
+				"import the archive on the replacement router and power this one off", summary.Amount, summary.Sessions, len(summary.Files), path),
+			Data:      summary,
+			Timestamp: time.Now(),
+		}
+	}
+
+	summary, err := s.merchant.ImportState(path, passphrase)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to import state: %v", err),
+			Data:      summary,
+			Timestamp: time.Now(),
+		}
+	}
+
+	// Restart once the response is out, the identities and sessions are loaded at startup
+	go func() {
+		time.Sleep(2 * time.Second)
+		if output, err := exec.Command(serviceInitScript, "restart").CombinedOutput(); err != nil {
+			cliLogger.WithFields(logrus.Fields{
+				"error":  err,
+				"output": string(output),
+			}).Error("Failed to restart after state import, restart the service manually")
+		}
+	}()
+
+	message := fmt.Sprintf("Imported %d sats, %d sessions and %d state files, restarting", summary.Amount, summary.Sessions, len(summary.Files))
+	if summary.UnredeemedAmount > 0 {
+		message += fmt.Sprintf(". %d sats could not be redeemed and are kept in migration_tokens.json, fund them once their mint is reachable",
+			summary.UnredeemedAmount)
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   message,
+		Data:      summary,
+		Timestamp: time.Now(),
+	}
+}
+
 // handleVersionCommand returns version information
 func (s *CLIServer) handleVersionCommand() CLIResponse {
 	return CLIResponse{
@@ -475,3 +1070,105 @@ func (s *CLIServer) sendError(conn net.Conn, errorMsg string) {
 	}
 	s.sendResponse(conn, response)
 }
+
+// handleCardsCommand issues pre-paid cards, printing one code per line for printing or writing to NFC tags
+func (s *CLIServer) handleCardsCommand(args []string, flags map[string]string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+	if len(args) < 3 || len(args) > 4 || args[0] != "issue" {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Cards command requires: issue <count> <allotment> [tier]",
+			Timestamp: time.Now(),
+		}
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Invalid number of cards: %s", args[1]),
+			Timestamp: time.Now(),
+		}
+	}
+	allotment, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Invalid allotment: %s", args[2]),
+			Timestamp: time.Now(),
+		}
+	}
+	tier := ""
+	if len(args) == 4 {
+		tier = args[3]
+	}
+	validDays := 0
+	if days, ok := flags["days"]; ok {
+		if validDays, err = strconv.Atoi(days); err != nil {
+			return CLIResponse{
+				Success:   false,
+				Error:     fmt.Sprintf("Invalid validity in days: %s", days),
+				Timestamp: time.Now(),
+			}
+		}
+	}
+
+	codes, err := s.merchant.IssueCards(count, allotment, tier, validDays)
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to issue cards: %v", err),
+			Timestamp: time.Now(),
+		}
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   strings.Join(codes, "\n"),
+		Timestamp: time.Now(),
+	}
+}
+
+// handleDebugCommand assembles a debug bundle for support, optionally sending it to a maintainer's pubkey
+func (s *CLIServer) handleDebugCommand(args []string, flags map[string]string) CLIResponse {
+	if s.merchant == nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Merchant not initialized",
+			Timestamp: time.Now(),
+		}
+	}
+	if len(args) != 2 || args[0] != "bundle" {
+		return CLIResponse{
+			Success:   false,
+			Error:     "Debug command requires: bundle <archive path>",
+			Timestamp: time.Now(),
+		}
+	}
+
+	summary, err := s.merchant.CreateDebugBundle(args[1], flags["to"])
+	if err != nil {
+		return CLIResponse{
+			Success:   false,
+			Error:     fmt.Sprintf("Failed to create debug bundle: %v", err),
+			Data:      summary,
+			Timestamp: time.Now(),
+		}
+	}
+
+	message := fmt.Sprintf("Wrote debug bundle of %d bytes to %s", summary.Size, summary.Path)
+	if summary.SentTo != "" {
+		message += fmt.Sprintf(" and sent it to %s in an encrypted direct message", summary.SentTo)
+	}
+	return CLIResponse{
+		Success:   true,
+		Message:   message,
+		Data:      summary,
+		Timestamp: time.Now(),
+	}
+}
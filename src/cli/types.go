@@ -1,12 +1,18 @@
 package cli
 
-import "time"
+import (
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
+)
 
 // CLIMessage represents communication between CLI client and service
 type CLIMessage struct {
 	Command   string            `json:"command"`
 	Args      []string          `json:"args,omitempty"`
 	Flags     map[string]string `json:"flags,omitempty"`
+	Actor     string            `json:"actor,omitempty"` // User running the CLI, recorded in the audit log
 	Timestamp time.Time         `json:"timestamp"`
 }
 
@@ -19,6 +25,20 @@ type CLIResponse struct {
 	Timestamp time.Time   `json:"timestamp"`
 }
 
+// AuditReport is the tail of the audit log and whether its hash chain is intact
+type AuditReport struct {
+	Entries     []config_manager.AuditEntry `json:"entries"`
+	Verified    bool                        `json:"verified"`
+	VerifyError string                      `json:"verify_error,omitempty"`
+}
+
+// LedgerReport is the ledger history of the last days, with the sats moved per entry type
+type LedgerReport struct {
+	Since   int64                  `json:"since"`
+	Entries []merchant.LedgerEntry `json:"entries"`
+	Totals  map[string]uint64      `json:"totals"`
+}
+
 // WalletInfo represents wallet information
 type WalletInfo struct {
 	Balance     uint64 `json:"balance_sats"`
@@ -42,12 +62,15 @@ type WalletDrainResult struct {
 
 // ServiceStatus represents basic service status
 type ServiceStatus struct {
-	Running   bool   `json:"running"`
-	Version   string `json:"version"`
-	Uptime    string `json:"uptime"`
-	ConfigOK  bool   `json:"config_ok"`
-	WalletOK  bool   `json:"wallet_ok"`
-	NetworkOK bool   `json:"network_ok"`
+	Running      bool   `json:"running"`
+	Version      string `json:"version"`
+	Uptime       string `json:"uptime"`
+	ConfigOK     bool   `json:"config_ok"`
+	WalletOK     bool   `json:"wallet_ok"`
+	NetworkOK    bool   `json:"network_ok"`
+	OnionAddress string `json:"onion_address,omitempty"`
+	// Same report the gateway sends to the owner in operator status events
+	Operator *merchant.OperatorStatus `json:"operator,omitempty"`
 }
 
 // PrivateNetworkInfo represents private network configuration
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut04"
+	"github.com/Origami74/gonuts-tollgate/wallet"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// faucetTimeout bounds how long the faucet mint may take to pay its own invoice
+const faucetTimeout = time.Minute
+
+// customer pays the TollGate from the machine running the scenarios
+type customer struct {
+	privateKey string
+	pubkey     string
+	mintURL    string
+	gatewayURL string
+	wallet     *wallet.Wallet
+	http       *http.Client
+	macAddress string // As seen by the TollGate
+	merchant   string // Pubkey of the TollGate's merchant
+}
+
+func newCustomer(privateKey, mintURL, gatewayURL, walletPath string) (*customer, error) {
+	pubkey, err := nostr.GetPublicKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer key: %w", err)
+	}
+	w, err := wallet.LoadWallet(wallet.Config{WalletPath: walletPath, CurrentMintURL: mintURL})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wallet: %w", err)
+	}
+
+	c := &customer{
+		privateKey: privateKey,
+		pubkey:     pubkey,
+		mintURL:    mintURL,
+		gatewayURL: gatewayURL,
+		wallet:     w,
+		http:       &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := c.discover(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// discover asks the TollGate for the customer's MAC address and the merchant's pubkey
+func (c *customer) discover() error {
+	body, err := c.get("/whoami")
+	if err != nil {
+		return fmt.Errorf("failed to look up own MAC address: %w", err)
+	}
+	c.macAddress = strings.TrimPrefix(strings.TrimSpace(string(body)), "mac=")
+
+	body, err = c.get("/")
+	if err != nil {
+		return fmt.Errorf("failed to fetch advertisement: %w", err)
+	}
+	var advertisement nostr.Event
+	if err := json.Unmarshal(body, &advertisement); err != nil {
+		return fmt.Errorf("failed to parse advertisement: %w", err)
+	}
+	c.merchant = advertisement.PubKey
+	return nil
+}
+
+// fund mints ecash at the faucet mint until the wallet holds the amount
+func (c *customer) fund(amount uint64) error {
+	balance := c.wallet.GetBalanceByMints()[c.mintURL]
+	if balance >= amount {
+		return nil
+	}
+
+	quote, err := c.wallet.RequestMint(amount-balance, c.mintURL)
+	if err != nil {
+		return fmt.Errorf("failed to request mint quote: %w", err)
+	}
+	deadline := time.Now().Add(faucetTimeout)
+	for {
+		state, err := c.wallet.MintQuoteState(quote.Quote)
+		if err != nil {
+			return fmt.Errorf("failed to check mint quote: %w", err)
+		}
+		if state.State == nut04.Paid {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("faucet mint did not pay quote %s within %s", quote.Quote, faucetTimeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	if _, err := c.wallet.MintTokens(quote.Quote); err != nil {
+		return fmt.Errorf("failed to mint: %w", err)
+	}
+	return nil
+}
+
+// pay sends a payment of amount sats for the customer's device and returns the TollGate's response
+func (c *customer) pay(amount uint64) (*nostr.Event, error) {
+	if err := c.fund(amount); err != nil {
+		return nil, err
+	}
+	proofs, err := c.wallet.Send(amount, c.mintURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take %d sats from wallet: %w", amount, err)
+	}
+	token, err := cashu.NewTokenV4(proofs, c.mintURL, cashu.Sat, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token: %w", err)
+	}
+	tokenString, err := token.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize token: %w", err)
+	}
+
+	return c.post(nostr.Event{
+		Kind: 21000,
+		Tags: nostr.Tags{
+			{"p", c.merchant},
+			{"device-identifier", "mac", c.macAddress},
+			{"payment", tokenString},
+		},
+	})
+}
+
+// cancel asks the TollGate to end the customer's session and refund the rest
+func (c *customer) cancel() (*nostr.Event, error) {
+	return c.post(nostr.Event{
+		Kind: 21029,
+		Tags: nostr.Tags{
+			{"p", c.merchant},
+			{"device-identifier", "mac", c.macAddress},
+		},
+	})
+}
+
+// post signs an event and sends it to the TollGate. Notices with an error status are returned as events.
+func (c *customer) post(event nostr.Event) (*nostr.Event, error) {
+	event.CreatedAt = nostr.Now()
+	if err := event.Sign(c.privateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign event: %w", err)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	resp, err := c.http.Post(c.gatewayURL+"/", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send event: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response nostr.Event
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected response (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+	if ok, err := response.CheckSignature(); err != nil || !ok {
+		return nil, fmt.Errorf("response %s has an invalid signature", response.ID)
+	}
+	return &response, nil
+}
+
+// get fetches a path from the TollGate
+func (c *customer) get(path string) ([]byte, error) {
+	resp, err := c.http.Get(c.gatewayURL + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,79 @@
+// Command e2e runs scripted scenarios against a TollGate on real hardware.
+//
+// It pays as a test customer from the machine it runs on, which must be a client of the router,
+// with ecash minted from a faucet mint (a test mint paying its own invoices), and asserts the
+// gate state on the router over SSH. The faucet mint must be accepted by the TollGate and
+// reachable before paying, e.g. through the walled garden. The revoke action needs cancellation enabled.
+//
+//	e2e -router 192.168.1.1 -mint https://nofees.testnut.cashu.space scenarios/*.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func main() {
+	routerHost := flag.String("router", "192.168.1.1", "Address of the router under test")
+	sshUser := flag.String("ssh-user", "root", "User to log in to the router as")
+	sshKey := flag.String("ssh-key", "", "SSH identity file, empty uses the SSH agent and defaults")
+	mintURL := flag.String("mint", "https://nofees.testnut.cashu.space", "Faucet mint funding the test customer")
+	customerKey := flag.String("key", "", "Private key of the test customer in hex, empty generates one")
+	walletDir := flag.String("wallet", "", "Wallet directory of the test customer, empty uses a temporary one")
+	rebootTimeout := flag.Duration("reboot-timeout", 3*time.Minute, "How long the router may take to come back after a reboot")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: e2e [flags] scenario.json...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if *customerKey == "" {
+		*customerKey = nostr.GeneratePrivateKey()
+	}
+	if *walletDir == "" {
+		dir, err := os.MkdirTemp("", "tollgate-e2e-wallet")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create wallet directory: %v\n", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		*walletDir = dir
+	}
+
+	r := &router{host: *routerHost, user: *sshUser, identity: *sshKey, rebootTimeout: *rebootTimeout}
+	c, err := newCustomer(*customerKey, *mintURL, fmt.Sprintf("http://%s:2121", *routerHost), filepath.Join(*walletDir, "wallet"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up test customer: %v\n", err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, path := range flag.Args() {
+		s, err := loadScenario(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+
+		start := time.Now()
+		if err := s.run(r, c); err != nil {
+			fmt.Printf("FAIL %s (%s): %v\n", s.Name, time.Since(start).Round(time.Second), err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS %s (%s)\n", s.Name, time.Since(start).Round(time.Second))
+	}
+
+	fmt.Printf("%d of %d scenarios passed\n", flag.NArg()-failed, flag.NArg())
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
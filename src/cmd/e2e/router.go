@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// router runs commands on the router under test over SSH
+type router struct {
+	host          string
+	user          string
+	identity      string
+	rebootTimeout time.Duration
+}
+
+// run executes a shell command on the router and returns its output
+func (r *router) run(command string) (string, error) {
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=5", "-o", "StrictHostKeyChecking=accept-new"}
+	if r.identity != "" {
+		args = append(args, "-i", r.identity)
+	}
+	args = append(args, fmt.Sprintf("%s@%s", r.user, r.host), command)
+
+	output, err := exec.Command("ssh", args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%q failed: %w (output: %s)", command, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// gateOpen asks nodogsplash whether a client is authenticated
+func (r *router) gateOpen(macAddress string) (bool, error) {
+	output, err := r.run("ndsctl json " + macAddress)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(output) == "" {
+		return false, nil // Unknown clients have no entry
+	}
+
+	var client struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal([]byte(output), &client); err != nil {
+		return false, fmt.Errorf("failed to parse ndsctl output: %w", err)
+	}
+	return client.State == "Authenticated", nil
+}
+
+// expectGate fails unless the gate of a client is in the expected state
+func (r *router) expectGate(macAddress string, open bool) error {
+	isOpen, err := r.gateOpen(macAddress)
+	if err != nil {
+		return err
+	}
+	if isOpen != open {
+		return fmt.Errorf("gate of %s is %s, expected %s", macAddress, gateState(isOpen), gateState(open))
+	}
+	return nil
+}
+
+// waitForGate polls until the gate of a client reaches the expected state
+func (r *router) waitForGate(macAddress string, open bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		isOpen, err := r.gateOpen(macAddress)
+		if err == nil && isOpen == open {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("gate of %s still %s after %s", macAddress, gateState(isOpen), timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// reboot restarts the router and waits until SSH and the TollGate answer again
+func (r *router) reboot(c *customer) error {
+	r.run("reboot") // The connection may drop before the command returns
+
+	// Give the router time to go down, so the old TollGate doesn't pass for the new one
+	time.Sleep(15 * time.Second)
+	deadline := time.Now().Add(r.rebootTimeout)
+	for {
+		if _, err := r.run("true"); err == nil {
+			if _, err := c.get("/"); err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("router did not come back within %s", r.rebootTimeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func gateState(open bool) string {
+	if open {
+		return "open"
+	}
+	return "closed"
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Step actions
+const (
+	actionPurchase   = "purchase"    // Pay amount sats and expect a session, or the notice in expect_notice
+	actionExtend     = "extend"      // Pay for an open session and expect its allotment to grow
+	actionRevoke     = "revoke"      // Cancel the session and expect the gate to close
+	actionExpire     = "expire"      // Wait up to seconds for the gate to close by itself
+	actionWait       = "wait"        // Sleep for seconds
+	actionExpectGate = "expect_gate" // Assert the gate is open or closed
+	actionReboot     = "reboot"      // Reboot the router and wait until the TollGate answers again
+	actionSSH        = "ssh"         // Run command on the router, e.g. to change the config before a step
+)
+
+// scenario is a named list of steps run in order, stopping at the first failure
+type scenario struct {
+	Name  string `json:"name"`
+	Steps []step `json:"steps"`
+}
+
+// step is one action of a scenario
+type step struct {
+	Action       string `json:"action"`
+	Amount       uint64 `json:"amount,omitempty"`
+	Seconds      int    `json:"seconds,omitempty"`
+	Open         bool   `json:"open,omitempty"`
+	Command      string `json:"command,omitempty"`
+	ExpectNotice string `json:"expect_notice,omitempty"` // Notice code a purchase must be answered with
+}
+
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	var s scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+	if s.Name == "" {
+		s.Name = path
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("scenario has no steps")
+	}
+	return &s, nil
+}
+
+// run executes the steps of the scenario as the customer against the router
+func (s *scenario) run(r *router, c *customer) error {
+	var allotment uint64
+	for i, st := range s.Steps {
+		log.Printf("%s: step %d: %s", s.Name, i+1, st.Action)
+
+		var err error
+		switch st.Action {
+		case actionPurchase:
+			allotment, err = purchase(c, st)
+		case actionExtend:
+			err = extend(r, c, st, &allotment)
+		case actionRevoke:
+			err = revoke(r, c)
+		case actionExpire:
+			err = r.waitForGate(c.macAddress, false, time.Duration(st.Seconds)*time.Second)
+		case actionWait:
+			time.Sleep(time.Duration(st.Seconds) * time.Second)
+		case actionExpectGate:
+			err = r.expectGate(c.macAddress, st.Open)
+		case actionReboot:
+			err = r.reboot(c)
+		case actionSSH:
+			_, err = r.run(st.Command)
+		default:
+			err = fmt.Errorf("unknown action %q", st.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, st.Action, err)
+		}
+	}
+	return nil
+}
+
+// purchase pays for a session and returns its allotment, or checks the expected notice
+func purchase(c *customer, st step) (uint64, error) {
+	response, err := c.pay(st.Amount)
+	if err != nil {
+		return 0, err
+	}
+
+	if st.ExpectNotice != "" {
+		if response.Kind != 21023 || tagValue(response, "code") != st.ExpectNotice {
+			return 0, fmt.Errorf("expected notice %s, got kind %d %s", st.ExpectNotice, response.Kind, response.Content)
+		}
+		return 0, nil
+	}
+	if response.Kind != 1022 {
+		return 0, fmt.Errorf("expected a session, got kind %d: %s %s", response.Kind, tagValue(response, "code"), response.Content)
+	}
+	return strconv.ParseUint(tagValue(response, "allotment"), 10, 64)
+}
+
+// extend pays for an open session, which must grow its allotment rather than start a new one
+func extend(r *router, c *customer, st step, allotment *uint64) error {
+	if err := r.expectGate(c.macAddress, true); err != nil {
+		return fmt.Errorf("nothing to extend: %w", err)
+	}
+	extended, err := purchase(c, st)
+	if err != nil {
+		return err
+	}
+	if extended <= *allotment {
+		return fmt.Errorf("allotment did not grow: %d before, %d after", *allotment, extended)
+	}
+	*allotment = extended
+	return nil
+}
+
+// revoke cancels the session, the gate must close right away
+func revoke(r *router, c *customer) error {
+	response, err := c.cancel()
+	if err != nil {
+		return err
+	}
+	if response.Kind != 21023 || tagValue(response, "code") != "session-cancelled" {
+		return fmt.Errorf("expected the session to be cancelled, got kind %d: %s %s", response.Kind, tagValue(response, "code"), response.Content)
+	}
+	return r.expectGate(c.macAddress, false)
+}
+
+// tagValue returns the first value of a tag, or "" if the event has none
+func tagValue(event *nostr.Event, name string) string {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +34,7 @@ type CLIMessage struct {
 	Command   string            `json:"command"`
 	Args      []string          `json:"args,omitempty"`
 	Flags     map[string]string `json:"flags,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
 	Timestamp time.Time         `json:"timestamp"`
 }
 
@@ -123,6 +126,26 @@ var fundCmd = &cobra.Command{
 	},
 }
 
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Compare balances with the mints",
+	Long:  "Compare the balance tracked for each mint with the proofs the mint confirms unspent, and report drift",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("wallet", []string{"reconcile"}, nil)
+	},
+}
+
+var repairCmd = &cobra.Command{
+	Use:   "repair <mint-url>",
+	Short: "Repair the balance of a mint",
+	Long: "Schedule a repair of the balance of a mint for the next restart: proofs the mint reports spent are " +
+		"quarantined, unspent proofs restored from the seed are added back",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("wallet", []string{"repair", args[0]}, nil)
+	},
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show service status",
@@ -132,6 +155,230 @@ var statusCmd = &cobra.Command{
 	},
 }
 
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show device statistics",
+	Long:  "Display anonymized counts of connected devices by type and vendor",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("stats", []string{}, nil)
+	},
+}
+
+var clientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "List clients",
+	Long:  "List clients by MAC address, IP address and hostname from the DHCP leases, with their session",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("clients", []string{}, nil)
+	},
+}
+
+var selfTestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Test the money path",
+	Long:  "Pay the smallest purchase from the wallet to itself and buy a session for a made-up device, reporting each stage. Costs the mint's swap fees.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("selftest", []string{}, nil)
+	},
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit [entries]",
+	Short: "Show the audit log",
+	Long:  "Show the latest payouts, wallet exports and configuration changes from the audit log and verify its hash chain",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("audit", args, nil)
+	},
+}
+
+var auditFinancialCmd = &cobra.Command{
+	Use:   "financial [entries]",
+	Short: "Show the financial audit log",
+	Long:  "Show the latest receives, sends, melts, refunds and payouts with their amounts, mints and counterparties from the financial audit log and verify its hash chain",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("audit", append([]string{"financial"}, args...), nil)
+	},
+}
+
+var ledgerCmd = &cobra.Command{
+	Use:   "ledger [days]",
+	Short: "Show the ledger history",
+	Long:  "Show the payments, refunds and other ledger entries of the last days (7 by default) with their totals. Needs the bolt or sqlite storage backend.",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("ledger", args, nil)
+	},
+}
+
+var pricingCmd = &cobra.Command{
+	Use:   "pricing",
+	Short: "Pricing tools",
+	Long:  "Tune the price with the purchase history of this gateway",
+}
+
+var pricingSimulateCmd = &cobra.Command{
+	Use:   "simulate [price_per_step]",
+	Short: "Simulate revenue at another price",
+	Long: "Replay the session purchases of the last days (30 by default) at a price per step in sats, optionally with another " +
+		"step size, and compare the revenue with what was made. By default customers buy the same allotment; --elasticity " +
+		"makes them buy less as the price per unit rises, e.g. 1 for 1% less per 1% more. Needs the bolt or sqlite storage backend.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := make(map[string]string)
+		days, _ := cmd.Flags().GetInt("days")
+		flags["days"] = strconv.Itoa(days)
+		if stepSize, _ := cmd.Flags().GetUint64("step-size"); stepSize > 0 {
+			flags["step_size"] = strconv.FormatUint(stepSize, 10)
+		}
+		if mint, _ := cmd.Flags().GetString("mint"); mint != "" {
+			flags["mint"] = mint
+		}
+		if elasticity, _ := cmd.Flags().GetFloat64("elasticity"); elasticity != 0 {
+			flags["elasticity"] = strconv.FormatFloat(elasticity, 'f', -1, 64)
+		}
+		return sendCommandAndDisplay("pricing", append([]string{"simulate"}, args...), flags)
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration presets",
+	Long:  "Set up the gateway from a built-in preset for its type of venue",
+}
+
+var configPresetCmd = &cobra.Command{
+	Use:   "preset [name]",
+	Short: "List or apply venue presets",
+	Long:  "List the venue presets, or apply one to pre-populate pricing, payouts, session rules and the walled garden",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("config", append([]string{"preset"}, args...), nil)
+	},
+}
+
+var ndsCmd = &cobra.Command{
+	Use:   "nds",
+	Short: "Captive portal configuration",
+	Long:  "Check and repair the nodogsplash/openNDS and uhttpd settings the gate depends on",
+}
+
+var ndsCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check captive portal configuration",
+	Long:  "List captive portal settings that don't match what TollGate expects",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("nds", []string{"check"}, nil)
+	},
+}
+
+var ndsFixCmd = &cobra.Command{
+	Use:   "fix",
+	Short: "Repair captive portal configuration",
+	Long:  "Apply the expected captive portal settings and restart the affected services",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendCommandAndDisplay("nds", []string{"fix"}, nil)
+	},
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Gateway state migration",
+	Long:  "Move the wallet, identities, sessions, ledgers and configuration to a replacement router",
+}
+
+var stateExportCmd = &cobra.Command{
+	Use:   "export [archive]",
+	Short: "Export the gateway state",
+	Long: "Write the wallet balance, identities, active sessions, ledgers and configuration into an archive encrypted with a passphrase. " +
+		"The balance leaves the wallet with the archive and the gateway stops selling sessions.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return sendStateCommand("export", args[0])
+	},
+}
+
+var stateImportCmd = &cobra.Command{
+	Use:   "import [archive]",
+	Short: "Import a gateway state",
+	Long:  "Restore an archive exported from the gateway this router replaces and restart the service",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !askConfirmation("This replaces the configuration and identities of this gateway. Continue?") {
+			fmt.Println("Operation cancelled.")
+			return nil
+		}
+		return sendStateCommand("import", args[0])
+	},
+}
+
+// sendStateCommand prompts for the archive passphrase and sends a state command with the archive's absolute path,
+// as the service doesn't share the working directory of the CLI
+func sendStateCommand(action, archive string) error {
+	path, err := filepath.Abs(archive)
+	if err != nil {
+		return fmt.Errorf("invalid archive path: %v", err)
+	}
+
+	fmt.Print("Archive passphrase: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read passphrase")
+	}
+	passphrase := strings.TrimSpace(scanner.Text())
+	if passphrase == "" {
+		return fmt.Errorf("no passphrase provided")
+	}
+
+	return sendCommandAndDisplay("state", []string{action, path}, map[string]string{"passphrase": passphrase})
+}
+
+var cardsCmd = &cobra.Command{
+	Use:   "cards",
+	Short: "Pre-paid cards",
+	Long:  "Issue pre-paid cards customers redeem for a session on the captive portal",
+}
+
+var cardsIssueCmd = &cobra.Command{
+	Use:   "issue [count] [allotment] [tier]",
+	Short: "Issue pre-paid cards",
+	Long: "Sign cards each worth an allotment in the gateway's metric and print their codes, one per line, " +
+		"for printing as QR codes or writing to NFC tags. Each card is redeemable once.",
+	Args: cobra.RangeArgs(2, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		days, _ := cmd.Flags().GetInt("days")
+		return sendCommandAndDisplay("cards", append([]string{"issue"}, args...), map[string]string{"days": strconv.Itoa(days)})
+	},
+}
+
+var debugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Support diagnostics",
+	Long:  "Collect diagnostics of this gateway for support",
+}
+
+var debugBundleCmd = &cobra.Command{
+	Use:   "bundle [archive]",
+	Short: "Create a debug bundle",
+	Long: "Write the latest logs, configuration, health checks, gate rules and a wallet summary into a tar.gz archive, " +
+		"with tokens, private keys and passwords redacted. With --to the archive is also sent to that npub in an encrypted DM.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		archive := fmt.Sprintf("/tmp/tollgate-debug-%s.tar.gz", time.Now().Format("20060102-150405"))
+		if len(args) == 1 {
+			archive = args[0]
+		}
+		// The service doesn't share the working directory of the CLI
+		path, err := filepath.Abs(archive)
+		if err != nil {
+			return fmt.Errorf("invalid archive path: %v", err)
+		}
+		to, _ := cmd.Flags().GetString("to")
+		return sendCommandAndDisplay("debug", []string{"bundle", path}, map[string]string{"to": to})
+	},
+}
+
 var privateStatusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show private network status",
@@ -205,10 +452,23 @@ var versionCmd = &cobra.Command{
 func init() {
 	// Build command tree
 	drainCmd.AddCommand(drainCashuCmd)
-	walletCmd.AddCommand(drainCmd, balanceCmd, infoCmd, fundCmd)
+	walletCmd.AddCommand(drainCmd, balanceCmd, infoCmd, fundCmd, reconcileCmd, repairCmd)
 	privateCmd.AddCommand(privateStatusCmd, privateEnableCmd, privateDisableCmd, privateRenameCmd, privateSetPasswordCmd)
 	networkCmd.AddCommand(privateCmd)
-	rootCmd.AddCommand(walletCmd, networkCmd, statusCmd, versionCmd)
+	ndsCmd.AddCommand(ndsCheckCmd, ndsFixCmd)
+	configCmd.AddCommand(configPresetCmd)
+	stateCmd.AddCommand(stateExportCmd, stateImportCmd)
+	cardsIssueCmd.Flags().Int("days", 365, "Days until the cards expire")
+	cardsCmd.AddCommand(cardsIssueCmd)
+	debugBundleCmd.Flags().String("to", "", "npub or hex pubkey of the maintainer to send the bundle to")
+	debugCmd.AddCommand(debugBundleCmd)
+	auditCmd.AddCommand(auditFinancialCmd)
+	pricingSimulateCmd.Flags().Int("days", 30, "Days of purchases to replay")
+	pricingSimulateCmd.Flags().Uint64("step-size", 0, "Step size to simulate, 0 keeps the step size of each mint")
+	pricingSimulateCmd.Flags().String("mint", "", "Only replay purchases with this mint")
+	pricingSimulateCmd.Flags().Float64("elasticity", 0, "Percent fewer units bought per percent the price per unit rises")
+	pricingCmd.AddCommand(pricingSimulateCmd)
+	rootCmd.AddCommand(walletCmd, networkCmd, statusCmd, statsCmd, clientsCmd, selfTestCmd, auditCmd, ledgerCmd, pricingCmd, ndsCmd, configCmd, stateCmd, cardsCmd, debugCmd, versionCmd)
 }
 
 func main() {
@@ -224,6 +484,7 @@ func sendCommandAndDisplay(command string, args []string, flags map[string]strin
 		Command:   command,
 		Args:      args,
 		Flags:     flags,
+		Actor:     currentUser(),
 		Timestamp: time.Now(),
 	}
 
@@ -243,6 +504,14 @@ func sendCommandAndDisplay(command string, args []string, flags map[string]strin
 	return nil
 }
 
+// currentUser names who runs the CLI for the audit log, the user behind sudo if any
+func currentUser() string {
+	if user := os.Getenv("SUDO_USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USER")
+}
+
 func sendCommand(msg CLIMessage) (*CLIResponse, error) {
 	// Connect to Unix socket
 	conn, err := net.Dial("unix", SocketPath)
@@ -10,6 +10,8 @@ import (
 	"path/filepath" // Add for backupAndLog
 	"regexp"        // Re-add for GetArchitecture
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-version"
@@ -85,11 +87,20 @@ type ConfigManager struct {
 	ConfigFilePath     string
 	InstallFilePath    string
 	IdentitiesFilePath string
-	config             *Config
+	config             atomic.Pointer[Config]
+	configUpdateMu     sync.Mutex
+	configListeners    []func(*Config)
+	listenersMu        sync.Mutex
 	installConfig      *InstallConfig
 	identitiesConfig   *IdentitiesConfig
 	PublicPool         *nostr.SimplePool
 	LocalPool          *nostr.SimplePool
+	auditLog           *AuditLog
+	financialLog       *AuditLog
+	// UCI package the config is synced with both ways, empty if it isn't
+	UCIFilePath string
+	uciMu       sync.Mutex
+	uciSynced   []byte // Package content last written or applied
 }
 
 // NewConfigManager creates a new ConfigManager instance and loads/ensures default configurations.
@@ -119,11 +130,11 @@ func NewConfigManager(configPath, installPath, identitiesPath string) (*ConfigMa
 		LocalPool:          localPool,
 	}
 
-	var err error
-	cm.config, err = EnsureDefaultConfig(cm.ConfigFilePath)
+	config, err := EnsureDefaultConfig(cm.ConfigFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to ensure default config: %w", err)
 	}
+	cm.config.Store(config)
 
 	cm.installConfig, err = EnsureDefaultInstall(cm.InstallFilePath)
 	if err != nil {
@@ -135,12 +146,112 @@ func NewConfigManager(configPath, installPath, identitiesPath string) (*ConfigMa
 		return nil, fmt.Errorf("failed to ensure default identities config: %w", err)
 	}
 
+	// An unreadable audit log must not keep the gateway from starting
+	cm.auditLog, err = OpenAuditLog(filepath.Join(filepath.Dir(cm.ConfigFilePath), "audit.log"))
+	if err != nil {
+		log.Printf("CRITICAL: Failed to open audit log, privileged actions are not recorded: %v", err)
+	}
+	cm.financialLog, err = OpenAuditLog(filepath.Join(filepath.Dir(cm.ConfigFilePath), "financial_audit.log"))
+	if err != nil {
+		log.Printf("CRITICAL: Failed to open financial audit log, payments and payouts are not recorded: %v", err)
+	}
+
+	cm.UCIFilePath = uciFilePath(cm.ConfigFilePath)
+	if cm.UCIFilePath != "" {
+		cm.startUCISync()
+	}
+
 	return cm, nil
 }
 
-// GetConfig returns the loaded main configuration.
+// GetConfig returns a snapshot of the main configuration.
+// The snapshot is shared and must be treated as read-only; use UpdateConfig to change it.
 func (cm *ConfigManager) GetConfig() *Config {
-	return cm.config
+	return cm.config.Load()
+}
+
+// UpdateConfig applies update to a copy of the main configuration, saves it and swaps it in.
+// update returns false if nothing changed. Listeners registered with OnConfigChange are notified
+// with the new snapshot after the update is stored.
+func (cm *ConfigManager) UpdateConfig(update func(config *Config) bool) error {
+	return cm.UpdateConfigAs("system", update)
+}
+
+// UpdateConfigAs is UpdateConfig on behalf of an actor, who is recorded in the audit log with the changed fields
+func (cm *ConfigManager) UpdateConfigAs(actor string, update func(config *Config) bool) error {
+	cm.configUpdateMu.Lock()
+	previous := cm.config.Load()
+	next, err := previous.Clone()
+	if err != nil {
+		cm.configUpdateMu.Unlock()
+		return fmt.Errorf("failed to copy config: %w", err)
+	}
+
+	if !update(next) {
+		cm.configUpdateMu.Unlock()
+		return nil
+	}
+
+	if err := SaveConfig(cm.ConfigFilePath, next); err != nil {
+		cm.configUpdateMu.Unlock()
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	cm.config.Store(next)
+	if cm.UCIFilePath != "" {
+		cm.syncToUCI(next)
+	}
+	cm.configUpdateMu.Unlock()
+
+	cm.Audit(actor, AuditConfigChange, map[string]string{
+		"fields": strings.Join(changedConfigFields(previous, next), ","),
+	})
+
+	cm.listenersMu.Lock()
+	listeners := append([]func(*Config){}, cm.configListeners...)
+	cm.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(next)
+	}
+	return nil
+}
+
+// Audit records a privileged action in the audit log. Failures are logged, they don't stop the action.
+func (cm *ConfigManager) Audit(actor, action string, details map[string]string) {
+	if cm.auditLog == nil {
+		return
+	}
+	if err := cm.auditLog.Record(actor, action, details); err != nil {
+		log.Printf("ERROR: Failed to record %s by %s in audit log: %v", action, actor, err)
+	}
+}
+
+// GetAuditLog returns the audit log of privileged actions
+func (cm *ConfigManager) GetAuditLog() *AuditLog {
+	return cm.auditLog
+}
+
+// AuditFinancial records ecash moving in or out of the gateway in the financial audit log. Failures are logged,
+// they don't stop the payment.
+func (cm *ConfigManager) AuditFinancial(actor, action string, details map[string]string) {
+	if cm.financialLog == nil {
+		return
+	}
+	if err := cm.financialLog.Record(actor, action, details); err != nil {
+		log.Printf("ERROR: Failed to record %s by %s in financial audit log: %v", action, actor, err)
+	}
+}
+
+// GetFinancialAuditLog returns the audit log of receives, sends, melts, refunds and payouts
+func (cm *ConfigManager) GetFinancialAuditLog() *AuditLog {
+	return cm.financialLog
+}
+
+// OnConfigChange registers a listener that is called with the new snapshot after every config update
+func (cm *ConfigManager) OnConfigChange(listener func(config *Config)) {
+	cm.listenersMu.Lock()
+	defer cm.listenersMu.Unlock()
+	cm.configListeners = append(cm.configListeners, listener)
 }
 
 // GetInstallConfig returns the loaded install configuration.
@@ -165,28 +276,27 @@ func (cm *ConfigManager) GetIdentity(name string) (*PublicIdentity, error) {
 
 // UpdatePricing updates the pricing information in the config file if it has changed.
 func (cm *ConfigManager) UpdatePricing(pricePerStep, stepSize int) error {
-	config := cm.GetConfig()
-	needsUpdate := false
+	return cm.UpdateConfig(func(config *Config) bool {
+		needsUpdate := false
+
+		// Assuming the first mint is the one to update. This may need to be revisited.
+		if len(config.AcceptedMints) > 0 {
+			if config.AcceptedMints[0].PricePerStep != uint64(pricePerStep) {
+				config.AcceptedMints[0].PricePerStep = uint64(pricePerStep)
+				needsUpdate = true
+			}
+		}
 
-	// Assuming the first mint is the one to update. This may need to be revisited.
-	if len(config.AcceptedMints) > 0 {
-		if config.AcceptedMints[0].PricePerStep != uint64(pricePerStep) {
-			config.AcceptedMints[0].PricePerStep = uint64(pricePerStep)
+		if config.StepSize != uint64(stepSize) {
+			config.StepSize = uint64(stepSize)
 			needsUpdate = true
 		}
-	}
-
-	if config.StepSize != uint64(stepSize) {
-		config.StepSize = uint64(stepSize)
-		needsUpdate = true
-	}
 
-	if needsUpdate {
-		log.Printf("Price changed. Udpating config file with price_per_step=%d, step_size=%d", pricePerStep, stepSize)
-		return SaveConfig(cm.ConfigFilePath, config)
-	}
-
-	return nil
+		if needsUpdate {
+			log.Printf("Price changed. Udpating config file with price_per_step=%d, step_size=%d", pricePerStep, stepSize)
+		}
+		return needsUpdate
+	})
 }
 
 // GetOwnedIdentity retrieves an owned identity by name.
@@ -361,6 +471,11 @@ func (cm *ConfigManager) GetLocalPool() *nostr.SimplePool {
 
 // PublishToLocalPool publishes an event to the local relay pool
 func (cm *ConfigManager) PublishToLocalPool(event nostr.Event) error {
+	return cm.PublishToLocalPoolContext(context.Background(), event)
+}
+
+// PublishToLocalPoolContext publishes an event to the local relay pool, giving up when the context is done
+func (cm *ConfigManager) PublishToLocalPoolContext(ctx context.Context, event nostr.Event) error {
 	localRelayURL := "ws://localhost:4242"
 
 	relay, err := cm.LocalPool.EnsureRelay(localRelayURL)
@@ -369,7 +484,7 @@ func (cm *ConfigManager) PublishToLocalPool(event nostr.Event) error {
 		return err
 	}
 
-	err = relay.Publish(context.Background(), event)
+	err = relay.Publish(ctx, event)
 	if err != nil {
 		log.Printf("Failed to publish event to local relay %s: %v", localRelayURL, err)
 		return err
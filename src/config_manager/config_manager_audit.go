@@ -0,0 +1,210 @@
+package config_manager
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Privileged actions recorded in the audit log
+const (
+	AuditConfigChange  = "config_change"
+	AuditPayout        = "payout"
+	AuditWalletExport  = "wallet_export"
+	AuditWalletFund    = "wallet_fund"
+	AuditColdSweep     = "cold_sweep"
+	AuditStateExport   = "state_export"
+	AuditStateImport   = "state_import"
+	AuditCardIssue     = "card_issue"
+	AuditDebugBundle   = "debug_bundle"
+	AuditEmergencyStop = "emergency_stop"
+	AuditWalletRepair  = "wallet_repair"
+)
+
+// AuditEntry is one privileged action. Each entry commits to the hash of the previous one,
+// so editing or removing an entry breaks the chain from there on.
+type AuditEntry struct {
+	Seq       uint64            `json:"seq"`
+	Timestamp int64             `json:"timestamp"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Details   map[string]string `json:"details,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// computeHash hashes the entry without its own hash
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog is an append-only, hash-chained log of privileged actions stored as JSON lines
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	lastSeq  uint64
+	lastHash string
+}
+
+// OpenAuditLog opens the audit log at path and continues its chain
+func OpenAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{path: path}
+
+	entries, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		l.lastSeq = last.Seq
+		l.lastHash = last.Hash
+	}
+	return l, nil
+}
+
+// Record appends an action to the log
+func (l *AuditLog) Record(actor, action string, details map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := AuditEntry{
+		Seq:       l.lastSeq + 1,
+		Timestamp: time.Now().Unix(),
+		Actor:     actor,
+		Action:    action,
+		Details:   details,
+		PrevHash:  l.lastHash,
+	}
+	entry.Hash = entry.computeHash()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+
+	l.lastSeq = entry.Seq
+	l.lastHash = entry.Hash
+	return nil
+}
+
+// Head returns the sequence number and hash of the last entry. Keeping a copy off the gateway shows later whether
+// the log was rewritten from an earlier entry on.
+func (l *AuditLog) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq, l.lastHash
+}
+
+// Entries returns the last limit entries, or all entries if limit is 0
+func (l *AuditLog) Entries(limit int) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// Verify checks the hash chain and returns an error naming the first entry that was tampered with
+func (l *AuditLog) Verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.read()
+	if err != nil {
+		return err
+	}
+	return VerifyAuditChain(entries)
+}
+
+// VerifyAuditChain checks that every entry links to the one before it and that its hash matches
+func VerifyAuditChain(entries []AuditEntry) error {
+	prevHash := ""
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) {
+			return fmt.Errorf("entry %d has sequence number %d, entries are missing", i+1, entry.Seq)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("entry %d does not link to the previous entry", entry.Seq)
+		}
+		if entry.computeHash() != entry.Hash {
+			return fmt.Errorf("entry %d was modified", entry.Seq)
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+// changedConfigFields lists the top-level config fields that differ between two configs
+func changedConfigFields(previous, next *Config) []string {
+	var before, after map[string]json.RawMessage
+	if data, err := json.Marshal(previous); err == nil {
+		json.Unmarshal(data, &before)
+	}
+	if data, err := json.Marshal(next); err == nil {
+		json.Unmarshal(data, &after)
+	}
+
+	var changed []string
+	for field, value := range after {
+		if string(before[field]) != string(value) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// read loads all entries. Caller must hold mu.
+func (l *AuditLog) read() ([]AuditEntry, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse audit entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
@@ -2,25 +2,92 @@ package config_manager
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 // Config represents the main configuration for the Tollgate service.
 type Config struct {
-	ConfigVersion string              `json:"config_version"`
-	LogLevel      string              `json:"log_level"`
-	AcceptedMints []MintConfig        `json:"accepted_mints"`
-	ProfitShare   []ProfitShareConfig `json:"profit_share"`
-	StepSize      uint64              `json:"step_size"`
-	Margin        float64             `json:"margin,omitempty"`
-	Metric        string              `json:"metric"`
-	Relays        []string            `json:"relays"`
-	ShowSetup     bool                `json:"show_setup"`
-	ResellerMode  bool                `json:"reseller_mode"`
-	Crowsnest     CrowsnestConfig     `json:"crowsnest"`
-	Chandler      ChandlerConfig      `json:"chandler"`
+	ConfigVersion       string                       `json:"config_version"`
+	LogLevel            string                       `json:"log_level"`
+	AcceptedMints       []MintConfig                 `json:"accepted_mints"`
+	ProfitShare         []ProfitShareConfig          `json:"profit_share"`
+	StepSize            uint64                       `json:"step_size"`
+	Margin              float64                      `json:"margin,omitempty"`
+	Metric              string                       `json:"metric"`
+	MetricOptions       []MetricOption               `json:"metric_options"` // Other metrics customers may request in their payment
+	Relays              []string                     `json:"relays"`
+	ShowSetup           bool                         `json:"show_setup"`
+	ResellerMode        bool                         `json:"reseller_mode"`
+	Crowsnest           CrowsnestConfig              `json:"crowsnest"`
+	Chandler            ChandlerConfig               `json:"chandler"`
+	Tor                 TorConfig                    `json:"tor"`
+	SessionCaps         SessionCapsConfig            `json:"session_caps"`
+	Hooks               HooksConfig                  `json:"hooks"`
+	Analytics           AnalyticsConfig              `json:"analytics"`
+	Reservations        ReservationsConfig           `json:"reservations"`
+	Pricing             PricingConfig                `json:"pricing"`
+	Wallet              WalletConfig                 `json:"wallet"`
+	Zaps                ZapsConfig                   `json:"zaps"`
+	Fleet               FleetConfig                  `json:"fleet"`
+	NDS                 NDSConfig                    `json:"nds"`
+	DHCP                DHCPConfig                   `json:"dhcp"`
+	Outbox              OutboxConfig                 `json:"outbox"`
+	Publishing          PublishingConfig             `json:"publishing"`
+	PaymentPoW          PaymentPoWConfig             `json:"payment_pow"`
+	Cancellation        CancellationConfig           `json:"cancellation"`
+	Profiles            []ProfileConfig              `json:"profiles"`
+	SLA                 SLAConfig                    `json:"sla"`
+	MintRecommendations MintRecommendationsConfig    `json:"mint_recommendations"`
+	DataQuota           DataQuotaConfig              `json:"data_quota"`
+	ColdSweep           ColdSweepConfig              `json:"cold_sweep"`
+	Diagnostics         DiagnosticsConfig            `json:"diagnostics"`
+	SessionGroups       SessionGroupsConfig          `json:"session_groups"`
+	Gifts               GiftsConfig                  `json:"gifts"`
+	IPv6Prefix          IPv6PrefixConfig             `json:"ipv6_prefix"`
+	Admission           AdmissionConfig              `json:"admission"`
+	NegativeCache       NegativeCacheConfig          `json:"negative_cache"`
+	GateVerification    GateVerificationConfig       `json:"gate_verification"`
+	Privacy             PrivacyConfig                `json:"privacy"`
+	PurchaseQueue       PurchaseQueueConfig          `json:"purchase_queue"`
+	Cards               CardsConfig                  `json:"cards"`
+	RandomizedMACs      RandomizedMACConfig          `json:"randomized_macs"`
+	CompanionSessions   CompanionSessionsConfig      `json:"companion_sessions"`
+	Loyalty             LoyaltyConfig                `json:"loyalty"`
+	GateLatency         GateLatencyConfig            `json:"gate_latency"`
+	Terms               TermsConfig                  `json:"terms"`
+	LegacyImport        LegacyImportConfig           `json:"legacy_import"`
+	TierUpgrade         TierUpgradeConfig            `json:"tier_upgrade"`
+	WANCapacity         WANCapacityConfig            `json:"wan_capacity"`
+	FiatDisplay         FiatDisplayConfig            `json:"fiat_display"`
+	SessionCookies      SessionCookiesConfig         `json:"session_cookies"`
+	Storage             StorageConfig                `json:"storage"`
+	FlashWrites         FlashWritesConfig            `json:"flash_writes"`
+	SessionAbuse        SessionAbuseConfig           `json:"session_abuse"`
+	AdvertisementCode   AdvertisementCodeConfig      `json:"advertisement_code"`
+	Shutdown            ShutdownConfig               `json:"shutdown"`
+	PaymentRequests     PaymentRequestsConfig        `json:"payment_requests"`
+	EmergencyStop       EmergencyStopConfig          `json:"emergency_stop"`
+	Usage               UsageConfig                  `json:"usage"`
+	History             HistoryConfig                `json:"history"`
+	NoticeCompat        NoticeCompatConfig           `json:"notice_compat"`
+	PubkeySessions      PubkeySessionsConfig         `json:"pubkey_sessions"`
+	FairUse             FairUseConfig                `json:"fair_use"`
+	DynamicPricing      DynamicPricingConfig         `json:"dynamic_pricing"`
+	Anomalies           AnomaliesConfig              `json:"anomalies"`
+	Tiers               []TierConfig                 `json:"tiers"`         // Tier ladder customers climb by paying more, see TierLadder
+	Services            []ServiceConfig              `json:"services"`      // Venue services sold besides internet access
+	Subscriptions       []SubscriptionPlanConfig     `json:"subscriptions"` // Passes granting daily time, e.g. weekly or monthly
+	Plans               []PlanConfig                 `json:"plans"`         // Low-rate plans for machine customers, e.g. IoT sensors
+	TierPolicies        map[string]DestinationPolicy `json:"tier_policies"` // Destinations blocked per tier, tiers without a policy are unrestricted
+	VenuePreset         string                       `json:"venue_preset"`  // Venue preset last applied, for reference; see ApplyVenuePreset
+	// Profit share of the revenue from customers on an interface, e.g. the wireless interface of a brand's SSID,
+	// replacing profit_share for that revenue. Keyed by interface name.
+	InterfaceProfitShare map[string][]ProfitShareConfig `json:"interface_profit_share"`
 }
 
 // MintConfig holds configuration for a specific mint.
@@ -31,8 +98,21 @@ type MintConfig struct {
 	PayoutIntervalSeconds   uint64 `json:"payout_interval_seconds"`
 	MinPayoutAmount         uint64 `json:"min_payout_amount"`
 	PricePerStep            uint64 `json:"price_per_step"`
-	PriceUnit               string `json:"price_unit"`
+	PriceUnit               string `json:"price_unit"` // "sat" (or "sats"), "msat" or "usd" (cents), see NormalizeUnit
 	MinPurchaseSteps        uint64 `json:"purchase_min_steps"`
+	ReceiveStrategy         string `json:"receive_strategy,omitempty"` // "swap" (default) or "hold" to defer swaps to payout
+	Metric                  string `json:"metric,omitempty"`           // Overrides the global metric for payments with this mint
+	StepSize                uint64 `json:"step_size,omitempty"`        // Overrides the global step size for payments with this mint
+	Recommended             bool   `json:"recommended,omitempty"`      // Added from mint recommendations, removed when no longer recommended
+	MaxExposure             uint64 `json:"max_exposure,omitempty"`     // Most sats held at this mint before the exposure policy applies, 0 = no cap
+	ExposurePolicy          string `json:"exposure_policy,omitempty"`  // "payout" (default) pays out over the cap right away, "pause" stops accepting the mint
+}
+
+// MetricOption is a metric customers can buy instead of the one configured for a mint.
+// A step costs the mint's price per step.
+type MetricOption struct {
+	Metric   string `json:"metric"` // "milliseconds" or "bytes"
+	StepSize uint64 `json:"step_size"`
 }
 
 // ProfitShareConfig defines how profits are shared.
@@ -94,6 +174,601 @@ type UsageTrackingConfig struct {
 	DataMonitoringInterval time.Duration `json:"data_monitoring_interval"` // How often to check data usage
 }
 
+// TorConfig holds configuration for exposing the admin API as a Tor onion service
+type TorConfig struct {
+	Enabled           bool     `json:"enabled"`
+	ControlAddress    string   `json:"control_address"`    // tor control port, e.g. "127.0.0.1:9051"
+	ControlPassword   string   `json:"control_password"`   // HashedControlPassword secret, empty if none
+	VirtualPort       int      `json:"virtual_port"`       // Onion port mapped to the admin socket
+	AuthorizedClients []string `json:"authorized_clients"` // x25519 client auth public keys (base32)
+}
+
+// SessionCapsConfig limits how much allotment a customer can buy per tier
+type SessionCapsConfig struct {
+	ExcessPolicy string                   `json:"excess_policy"` // "reject" or "refund"
+	Tiers        map[string]TierCapConfig `json:"tiers"`         // Keyed by tier name
+}
+
+// TierCapConfig holds the allotment caps for a single tier, in the configured metric (0 = unlimited)
+type TierCapConfig struct {
+	MaxSessionAllotment uint64 `json:"max_session_allotment"` // Max allotment bought with a single payment
+	MaxStackedAllotment uint64 `json:"max_stacked_allotment"` // Max remaining allotment after stacking payments
+}
+
+// HooksConfig holds paths of operator scripts run when the valve changes a gate (empty = disabled)
+type HooksConfig struct {
+	OnAuthorize    string `json:"on_authorize"`    // Run after a MAC address is authorized
+	OnDeauthorize  string `json:"on_deauthorize"`  // Run after a MAC address is deauthorized
+	OnLimitChange  string `json:"on_limit_change"` // Run after a bandwidth limit is applied
+	OnIPChange     string `json:"on_ip_change"`    // Run when a client with an open gate gets a new IP address
+	TimeoutSeconds int    `json:"timeout_seconds"` // Max runtime of a single hook
+}
+
+// AnalyticsConfig holds settings for anonymized audience analytics
+type AnalyticsConfig struct {
+	DeviceClassification bool `json:"device_classification"` // Count devices by vendor and type, no MACs are stored
+}
+
+// ReservationsConfig holds settings for two-phase purchases and venue capacity
+type ReservationsConfig struct {
+	TTLSeconds            uint64 `json:"ttl_seconds"`             // How long a reservation locks prices and capacity
+	MaxConcurrentSessions int    `json:"max_concurrent_sessions"` // Max active sessions plus reservations (0 = unlimited)
+}
+
+// PricingConfig selects an operator pricing hook that replaces the per-step prices (empty = disabled)
+type PricingConfig struct {
+	Script         string `json:"script"`          // Executable reading payment details as JSON on stdin
+	Plugin         string `json:"plugin"`          // Go plugin (.so) exporting Price, takes precedence over script
+	TimeoutSeconds int    `json:"timeout_seconds"` // Max runtime of the pricing script
+	ProRata        bool   `json:"pro_rata"`        // Allot partial steps in proportion to the payment instead of dropping the remainder
+}
+
+// WalletConfig bounds concurrent wallet operations against mints and reacts to mint fee changes (0 = default)
+type WalletConfig struct {
+	MaxConcurrentOperations int    `json:"max_concurrent_operations"` // Max mint operations in flight across all mints
+	MaxConcurrentPerMint    int    `json:"max_concurrent_per_mint"`   // Max mint operations in flight per mint
+	QueueTimeoutSeconds     int    `json:"queue_timeout_seconds"`     // Max wait for a free slot before an operation fails
+	MintInfoTTLSeconds      int    `json:"mint_info_ttl_seconds"`     // How often mint fees and keysets are checked
+	MaxFeePercent           uint64 `json:"max_fee_percent"`           // Largest share of a purchase the mint's swap fee may take
+	FeePolicy               string `json:"fee_policy"`                // "adjust" raises the minimum purchase, "pause" stops accepting the mint
+	ReconcileIntervalHours  int    `json:"reconcile_interval_hours"`  // How often balances are compared with the mints, 0 disables it
+	ReconcileToleranceSats  uint64 `json:"reconcile_tolerance_sats"`  // Drift per mint that isn't reported
+	// "powers-of-two" presplits single proofs of each power of two up to the largest presplit amount, "exact"
+	// presplits bundles of the amounts themselves
+	DenominationStrategy string   `json:"denomination_strategy"`
+	PresplitAmounts      []uint64 `json:"presplit_amounts"` // Sats paid without a swap, empty uses each mint's minimum purchase and step price
+	PresplitBundles      int      `json:"presplit_bundles"` // Bundles kept per amount, 0 disables presplitting
+}
+
+// ZapsConfig holds settings for NIP-57 zap payments to the owner's Lightning address
+type ZapsConfig struct {
+	Enabled           bool   `json:"enabled"`
+	PricePerStep      uint64 `json:"price_per_step"`      // In sats
+	MinPurchaseSteps  uint64 `json:"purchase_min_steps"`  // Minimum steps a single zap has to cover
+	RequestTTLSeconds uint64 `json:"request_ttl_seconds"` // How long the merchant watches for the zap receipt
+}
+
+// FleetConfig holds settings for gateways of the same owner: session handoff and status reports
+type FleetConfig struct {
+	HandoffEnabled        bool     `json:"handoff_enabled"`
+	TrustedGateways       []string `json:"trusted_gateways"`        // Merchant pubkeys whose session proofs are honored
+	HandoffCreditPercent  uint64   `json:"handoff_credit_percent"`  // Share of the remaining allotment credited on import
+	ProofTTLSeconds       uint64   `json:"proof_ttl_seconds"`       // How long an exported session proof can be redeemed
+	StatusReportsEnabled  bool     `json:"status_reports_enabled"`  // Publish encrypted operator status events to the owner
+	StatusIntervalSeconds uint64   `json:"status_interval_seconds"` // Time between operator status events
+}
+
+// Gate modes
+const (
+	GateModeCaptivePortal = "captive_portal" // The captive portal daemon authorizes clients and shows the portal (default)
+	GateModeWired         = "wired"          // nft forwarding rules allow paid MAC addresses on a wired bridge, without a captive portal daemon
+	GateModeIptables      = "iptables"       // Like wired, with iptables chains for routers without nftables
+	GateModeHostapd       = "hostapd"        // hostapd lets paid MAC addresses associate, needs macfilter 'allow' on the access points
+)
+
+// NDSConfig describes the captive portal setup the gate expects and whether to repair it at startup
+type NDSConfig struct {
+	Mode             string   `json:"mode"`              // How gates are enforced, see GateModeCaptivePortal and the other gate modes
+	AutoFix          bool     `json:"auto_fix"`          // Rewrite mismatching UCI settings and restart the services
+	GatewayInterface string   `json:"gateway_interface"` // Interface customers connect through
+	PortalPort       int      `json:"portal_port"`       // uhttpd port serving the captive portal
+	ProtocolPort     int      `json:"protocol_port"`     // Port of the TollGate protocol
+	WalledGarden     []string `json:"walled_garden"`     // Hosts or IP networks customers reach over HTTP(S) before paying
+	// Add the hosts of the accepted mints, relays and Lightning addresses to the walled garden, following their DNS
+	DeriveWalledGarden bool `json:"derive_walled_garden"`
+}
+
+// DHCPConfig holds settings for mapping clients through the dnsmasq lease file
+type DHCPConfig struct {
+	LeasesFile          string `json:"leases_file"`           // dnsmasq lease file
+	PollIntervalSeconds int    `json:"poll_interval_seconds"` // How often the lease file is checked for IP changes
+}
+
+// OutboxConfig bounds the queue of events waiting for unreachable public relays (0 = default)
+type OutboxConfig struct {
+	MaxEvents         int `json:"max_events"`          // Oldest events are dropped beyond this
+	MaxAgeSeconds     int `json:"max_age_seconds"`     // Events not delivered within this are dropped
+	MaxBackoffSeconds int `json:"max_backoff_seconds"` // Longest wait between retries to a relay
+}
+
+// Delivery policies of published events
+const (
+	DeliveryBestEffort = "best-effort"        // Publish once, failures are only logged
+	DeliveryAnyRelay   = "at-least-one-relay" // Retry until a relay accepted the event, then queue it in the outbox
+	DeliveryAllRelays  = "all-relays"         // Queue the event in the outbox until every relay accepted it
+)
+
+// PublishingConfig sets where the merchant publishes each type of event and how hard it tries
+type PublishingConfig struct {
+	TimeoutSeconds int                           `json:"timeout_seconds"` // Per attempt to publish to a relay
+	Retries        int                           `json:"retries"`         // Extra attempts of at-least-one-relay deliveries before queuing them
+	Routes         map[string]PublishRouteConfig `json:"routes"`          // By event type: session, notice, dm, advertisement, status, feedback
+}
+
+// PublishRouteConfig is where events of a type go
+type PublishRouteConfig struct {
+	Local  bool   `json:"local"`  // The gateway's own relay, reachable by customers before they paid
+	Public bool   `json:"public"` // The relays in relays
+	DM     bool   `json:"dm"`     // Also send a copy to the tagged recipient as encrypted direct message on the public relays
+	Policy string `json:"policy"` // Delivery policy for the public relays: best-effort, at-least-one-relay or all-relays
+}
+
+// PaymentPoWConfig requires NIP-13 proof-of-work on payment events to keep spam off the wallet
+type PaymentPoWConfig struct {
+	MinDifficulty int  `json:"min_difficulty"` // Leading zero bits required in the event ID, 0 = disabled
+	RequireOnLAN  bool `json:"require_on_lan"` // Also require it from private networks, not only public sources
+}
+
+// CancellationConfig lets customers end their session early and get the unused share refunded
+type CancellationConfig struct {
+	Enabled    bool   `json:"enabled"`
+	FeePercent uint64 `json:"fee_percent"` // Share of the refund kept by the gateway
+}
+
+// SLAConfig extends sessions by the time the uplink was down during them
+type SLAConfig struct {
+	Enabled              bool   `json:"enabled"`
+	CreditPercent        uint64 `json:"credit_percent"`         // Credit as a share of the outage, 100 = outage duration
+	ProbeTarget          string `json:"probe_target"`           // Host pinged to check the uplink
+	ProbeIntervalSeconds int    `json:"probe_interval_seconds"` // Time between uplink probes
+	MinOutageSeconds     int    `json:"min_outage_seconds"`     // Shorter outages are not credited
+}
+
+// MintRecommendationsConfig follows NIP-87 mint recommendations of curators the operator trusts.
+// Mints added automatically copy the pricing and payout settings of the first accepted mint.
+type MintRecommendationsConfig struct {
+	Enabled                bool     `json:"enabled"`
+	Curators               []string `json:"curators"`                 // Pubkeys whose recommendations are followed
+	MinCurators            int      `json:"min_curators"`             // Curators that must recommend a mint before it counts
+	AutoAdd                bool     `json:"auto_add"`                 // Accept recommended mints automatically
+	AutoRemove             bool     `json:"auto_remove"`              // Drop added mints once they are no longer recommended and have no balance
+	MaxMints               int      `json:"max_mints"`                // Auto-add stops at this many accepted mints
+	AllowedHosts           []string `json:"allowed_hosts"`            // Only mints on these hosts or their subdomains, empty = any
+	RefreshIntervalSeconds int      `json:"refresh_interval_seconds"` // Time between fetches of the recommendations
+}
+
+// DataQuotaConfig meters data-based sessions and slows them down near the end of their quota
+// instead of cutting them off at once
+type DataQuotaConfig struct {
+	PollIntervalSeconds int                       `json:"poll_interval_seconds"` // How often traffic counters are read
+	ThrottlingEnabled   bool                      `json:"throttling_enabled"`
+	Steps               []ThrottleStep            `json:"steps"`      // Applied to tiers without steps of their own
+	TierSteps           map[string][]ThrottleStep `json:"tier_steps"` // Steps per tier
+}
+
+// ThrottleStep limits the rate of a gate once a share of its quota is used
+type ThrottleStep struct {
+	AtPercent   uint64 `json:"at_percent"`
+	RatePercent uint64 `json:"rate_percent,omitempty"` // Share of the tier's bandwidth limit
+	RateKbps    int    `json:"rate_kbps,omitempty"`    // Absolute rate, takes precedence over rate_percent
+}
+
+// StepsFor returns the throttle steps of a tier
+func (c DataQuotaConfig) StepsFor(tier string) []ThrottleStep {
+	if steps, exists := c.TierSteps[tier]; exists {
+		return steps
+	}
+	return c.Steps
+}
+
+// ColdSweepConfig moves ecash above a threshold out of the router, independent of the profit share payouts,
+// so a stolen router holds little. The surplus goes to the Lightning address if set, otherwise as ecash to the npub.
+type ColdSweepConfig struct {
+	Enabled              bool   `json:"enabled"`
+	ThresholdSats        uint64 `json:"threshold_sats"`         // Total balance that triggers a sweep
+	KeepSats             uint64 `json:"keep_sats"`              // Balance left in the hot wallet after a sweep
+	LightningAddress     string `json:"lightning_address"`      // Cold Lightning destination
+	Npub                 string `json:"npub"`                   // Cold nostr key receiving the ecash in encrypted DMs
+	CheckIntervalSeconds int    `json:"check_interval_seconds"` // Time between balance checks
+}
+
+// DiagnosticsConfig adds debugging details to protocol events, for developers looking into slow gateways
+type DiagnosticsConfig struct {
+	TimingTags bool `json:"timing_tags"` // Add the time spent in each purchase step to session events
+}
+
+// SessionGroupsConfig lets one payment cover a family or team: devices joining with the group code
+// share the time or data of the device that paid
+type SessionGroupsConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxMembers int  `json:"max_members"` // Additional devices a group may have besides the one that paid
+}
+
+// GiftsConfig lets customers buy access for another device by naming it in a gift tag of their payment
+type GiftsConfig struct {
+	Enabled      bool `json:"enabled"`
+	RequireLease bool `json:"require_lease"` // Only gift devices that hold a DHCP lease, so a mistyped MAC doesn't swallow the payment
+}
+
+// IPv6PrefixConfig routes an IPv6 /64 to every client of the listed tiers while their gate is open,
+// with the firewall opened for inbound connections to it, e.g. for self-hosting or games
+type IPv6PrefixConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Pool         string   `json:"pool"`          // Prefix delegated to the gateway by the uplink, e.g. "2001:db8:0:100::/56". Its first /64 is left to the LAN.
+	Tiers        []string `json:"tiers"`         // Tiers getting a prefix
+	InboundPorts []int    `json:"inbound_ports"` // TCP and UDP ports opened inbound, empty opens all
+}
+
+// AdmissionConfig turns away or down-tiers purchases from wireless clients whose weak link would
+// take up airtime at the expense of everyone else, based on the station metrics of hostapd
+type AdmissionConfig struct {
+	Enabled           bool `json:"enabled"`
+	MinSignalDBm      int  `json:"min_signal_dbm"`       // Purchases from clients with a weaker signal are rejected, 0 = no minimum
+	DownTierSignalDBm int  `json:"down_tier_signal_dbm"` // Clients with a weaker signal get the lowest tier whatever they pay, 0 = never
+	MinTxRateMbps     int  `json:"min_tx_rate_mbps"`     // Purchases from clients the radio reaches slower than this are rejected, 0 = no minimum
+}
+
+// NegativeCacheConfig remembers tokens the mint reported as spent and pubkeys whose payments keep failing,
+// so repeated submissions are rejected without asking the mint again
+type NegativeCacheConfig struct {
+	Enabled        bool `json:"enabled"`
+	TTLSeconds     int  `json:"ttl_seconds"`     // How long a rejection is remembered
+	PubkeyFailures int  `json:"pubkey_failures"` // Failed payments within the TTL after which a pubkey is rejected, 0 = never
+}
+
+// GateVerificationConfig checks that newly opened gates pass traffic, catching captive portals that accept
+// ndsctl auth without enforcing it
+type GateVerificationConfig struct {
+	Enabled      bool `json:"enabled"`
+	DelaySeconds int  `json:"delay_seconds"` // How long after opening a gate the client must have traffic or open connections
+	Repair       bool `json:"repair"`        // Re-authorize clients whose gate doesn't pass traffic and check again
+}
+
+// PrivacyConfig blinds session metadata on public relays for privacy-sensitive venues. MAC addresses are
+// replaced by an HMAC under a gateway secret that rotates, so devices can't be followed across rotations,
+// and customer pubkeys are left out. The local relay and encrypted direct messages keep full detail.
+type PrivacyConfig struct {
+	Enabled             bool `json:"enabled"`
+	SecretRotationHours int  `json:"secret_rotation_hours"` // How long a blinding secret is used, 0 = never rotate
+}
+
+// PurchaseQueueConfig bounds the purchases worked on at once. Purchases beyond that wait in a queue,
+// and are answered with a busy notice telling when to retry once the queue is full or the wait too long.
+type PurchaseQueueConfig struct {
+	MaxConcurrent  int `json:"max_concurrent"`   // Purchases redeemed and opened at once
+	MaxDepth       int `json:"max_depth"`        // Purchases waiting for a slot, more are turned away right away
+	MaxWaitSeconds int `json:"max_wait_seconds"` // Max wait for a slot before a purchase is turned away
+}
+
+// CardsConfig enables pre-paid cards: claims signed by the operator, sold offline as printed codes or NFC tags,
+// that customers redeem once for a session
+type CardsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Issuers []string `json:"issuers"` // Pubkeys besides the merchant identity whose cards are honored, e.g. of the fleet operator
+}
+
+// Policies for devices with a locally administered (randomized) MAC address
+const (
+	RandomizedMACAllow  = "allow"  // Served like any other device (default)
+	RandomizedMACBind   = "bind"   // Sessions are bound to the paying pubkey, which re-attests periodically and can move them to a new address
+	RandomizedMACRefuse = "refuse" // Payments are refused until the customer turns off randomization for this network
+)
+
+// RandomizedMACConfig sets how devices with randomized MAC addresses are served. A new address per connection
+// loses the session and resets data caps, so venues can ask customers to bind their session or to turn randomization off.
+type RandomizedMACConfig struct {
+	Policy                     string `json:"policy"`                       // See RandomizedMACAllow, RandomizedMACBind and RandomizedMACRefuse
+	AttestationIntervalSeconds uint64 `json:"attestation_interval_seconds"` // Gates of bound sessions close unless re-attested within this interval
+}
+
+// CompanionSessionsConfig lets other TollGate modules on the router create sessions, e.g. a module selling
+// access another way, by publishing session events to the local relay signed by the owner or a trusted module key
+type CompanionSessionsConfig struct {
+	Enabled        bool     `json:"enabled"`
+	TrustedPubkeys []string `json:"trusted_pubkeys"` // Module keys whose session events are honored besides the owner's
+}
+
+// LoyaltyConfig rewards returning customers, recognized by their pubkey or device, with a lower price per step,
+// extra allotment or both
+type LoyaltyConfig struct {
+	Enabled         bool   `json:"enabled"`
+	MinPurchases    int    `json:"min_purchases"`    // Earlier purchases within the window that make a customer returning
+	WindowDays      int    `json:"window_days"`      // Purchases older than this are forgotten
+	DiscountPercent uint64 `json:"discount_percent"` // Taken off the price per step
+	BonusPercent    uint64 `json:"bonus_percent"`    // Added to the allotment bought
+}
+
+// GateLatencyConfig bounds the time from verifying a payment to the gate confirmed open. Customers whose gate
+// took longer are compensated with extra allotment, and the slow gate is recorded.
+type GateLatencyConfig struct {
+	BudgetMs      uint64 `json:"budget_ms"`      // Longest acceptable time to open a gate, 0 = no budget
+	CreditPercent uint64 `json:"credit_percent"` // Compensation as a share of the allotment bought, at least the time lost on time-based sessions
+}
+
+// TermsConfig requires customers to accept the venue's terms of service before buying access. Payments name the
+// hash of the terms they accepted, which is kept in the ledger as the venue's record of the acceptance.
+type TermsConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`  // Where customers read the terms, shown on the portal and in the advertisement
+	Hash    string `json:"hash"` // Hex SHA-256 of the terms document, change it with the terms so customers accept them again
+}
+
+// Captive portals whose clients can be adopted by LegacyImportConfig
+const (
+	LegacySourceOpenNDS     = "opennds"
+	LegacySourceCoovaChilli = "coovachilli"
+)
+
+// LegacyImportConfig adopts the clients an openNDS or CoovaChilli captive portal authorized as sessions, once,
+// when the merchant starts, so a venue moves to TollGate without logging out its customers
+type LegacyImportConfig struct {
+	Enabled                 bool   `json:"enabled"`
+	Source                  string `json:"source"`                    // LegacySourceOpenNDS or LegacySourceCoovaChilli
+	StateFile               string `json:"state_file"`                // Saved `ndsctl json` or `chilli_query list` output, empty to query the running portal
+	UnlimitedSessionMinutes int    `json:"unlimited_session_minutes"` // Session given to clients authorized without an end, 0 = skip them
+	Tier                    string `json:"tier"`                      // Tier of the adopted sessions
+}
+
+// TierUpgradeConfig lets customers move an active time-based session to a higher tier for the rest of its time,
+// paying a surcharge pro-rated to the time left. The session keeps its end.
+type TierUpgradeConfig struct {
+	Enabled      bool              `json:"enabled"`
+	PricePerHour map[string]uint64 `json:"price_per_hour"` // Sats per hour left in the session, per tier upgraded to; tiers without a price can't be upgraded to
+}
+
+// WANCapacityConfig sizes the root traffic control class to the WAN, so tier limits are enforced against what the
+// uplink carries instead of 1000 Mbit/s. The root class runs slightly below the capacity so queues build up on the
+// router, where the tiers apply, rather than in the modem.
+type WANCapacityConfig struct {
+	CapacityMbps           uint64 `json:"capacity_mbps"`            // Downlink capacity of the WAN, 0 = measure it or keep 1000 Mbit/s
+	MeasureURL             string `json:"measure_url"`              // Large file downloaded to measure the capacity, empty = don't measure
+	MeasureIntervalMinutes int    `json:"measure_interval_minutes"` // Time between measurements
+	MeasureSeconds         int    `json:"measure_seconds"`          // Longest a measurement downloads
+}
+
+// FiatDisplayConfig adds fiat equivalents of the prices to the advertisement and quotes, so portals and apps can show
+// familiar prices next to sats. Payments are still made and priced in sats.
+type FiatDisplayConfig struct {
+	Enabled        bool    `json:"enabled"`
+	Currency       string  `json:"currency"`        // ISO 4217 code, e.g. USD
+	RateURL        string  `json:"rate_url"`        // JSON endpoint with the price of one bitcoin, empty = use FixedRate
+	RatePath       string  `json:"rate_path"`       // Dot-separated path to the price in the response, e.g. bitcoin.usd
+	FixedRate      float64 `json:"fixed_rate"`      // Price of one bitcoin in the currency when there is no rate URL
+	RefreshMinutes int     `json:"refresh_minutes"` // Time between fetching the rate
+}
+
+// SessionCookiesConfig gives browsers that bought a time-based session through the portal a signed cookie bound to
+// their MAC address and the session's end. Presented to the session status endpoint after the router restarted,
+// it restores the session the restart lost.
+type SessionCookiesConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Storage backends
+const (
+	StorageJSON   = "json"   // Flat files with minimal writes, for routers with little flash; sessions are batched like other state
+	StorageBolt   = "bolt"   // BoltDB file, keeps sessions across power loss and the ledger history queryable
+	StorageSQLite = "sqlite" // SQLite database, same as bolt; not built in on MIPS routers or with the nosqlite tag
+)
+
+// StorageConfig selects where the ledger and customer sessions are persisted. The heavier backends keep
+// sessions across power loss and answer ledger history queries, at the cost of more writes to flash.
+// Read at startup; switching to a database moves the flat file ledger into it.
+type StorageConfig struct {
+	Backend string `json:"backend"` // "json" (default), "bolt" or "sqlite"
+	Path    string `json:"path"`    // Database file of the bolt and sqlite backends, empty = next to the wallet
+}
+
+// FlashWritesConfig batches writes of state rewritten on every payment, such as the loyalty counts and the
+// wallet's receive journal, to spare the router's flash. Writes are staged in tmpfs, which survives a crash
+// of the service but not a reboot: power loss loses at most the last flush interval. Ecash is always
+// written through.
+type FlashWritesConfig struct {
+	FlushIntervalSeconds int    `json:"flush_interval_seconds"` // 0 writes every change to flash right away
+	StagingDir           string `json:"staging_dir"`            // Directory on tmpfs
+}
+
+// Responses to a paid MAC address in use from several places at once
+const (
+	SessionAbuseAlert    = "alert"    // Logged and counted in operator status events (default)
+	SessionAbuseThrottle = "throttle" // The gate is throttled for the rest of the session
+	SessionAbuseRevoke   = "revoke"   // The session ends without a refund
+)
+
+// SessionAbuseConfig watches the bridge forwarding database and hostapd for the MAC address of a paid session
+// seen on several ports or access points at once, or bouncing between them, which means a spoofed address is
+// sharing one device's session
+type SessionAbuseConfig struct {
+	Enabled             bool   `json:"enabled"`
+	Policy              string `json:"policy"`                // See SessionAbuseAlert, SessionAbuseThrottle and SessionAbuseRevoke
+	PollIntervalSeconds int    `json:"poll_interval_seconds"` // How often the locations of session MACs are read
+	MaxReturns          int    `json:"max_returns"`           // Returns to the previous port within the window taken as concurrent use
+	WindowSeconds       int    `json:"window_seconds"`
+	ThrottleKbps        int    `json:"throttle_kbps"` // Rate of abused gates under the throttle policy
+}
+
+// AdvertisementCodeConfig sets the short link in the QR codes and NFC tags of the advertisement printed at the counter
+type AdvertisementCodeConfig struct {
+	BaseURL string `json:"base_url"` // Portal address the link starts with, empty for the address of the gateway interface
+}
+
+// ShutdownConfig sets what happens to open gates when the service stops
+type ShutdownConfig struct {
+	// Close every open gate instead of leaving clients online while the service restarts
+	DeauthorizeGates bool `json:"deauthorize_gates"`
+}
+
+// PaymentRequestsConfig adds a Cashu NUT-18 payment request per mint to the advertisement, for wallets that pay
+// requests but can't build payment events. Wallets post the payment to the gateway, which opens the gate of
+// the device the payment came from.
+type PaymentRequestsConfig struct {
+	Enabled         bool   `json:"enabled"`
+	RotationMinutes int    `json:"rotation_minutes"` // How long a request is advertised, it is honored for as long again
+	BaseURL         string `json:"base_url"`         // Address wallets post payments to, empty for the address of the gateway interface
+}
+
+// EmergencyStopConfig sets the owner keys that can halt the gateway remotely: stop taking payments, close every
+// gate and lock the wallet. A quorum of the keys has to sign the same request, to halt as well as to resume,
+// so a single compromised key can't do either.
+type EmergencyStopConfig struct {
+	OwnerPubkeys  []string `json:"owner_pubkeys"`  // Hex pubkeys, none disables remote stops
+	Threshold     int      `json:"threshold"`      // Signatures needed, at least 2 when two or more keys are configured
+	WindowSeconds int      `json:"window_seconds"` // How long signatures of the same request are collected
+}
+
+// UsageConfig controls the per-device traffic sampling of open gates and the usage report events published for
+// each session, so customers and operators can audit what a session consumed
+type UsageConfig struct {
+	Enabled               bool `json:"enabled"`
+	SampleIntervalSeconds int  `json:"sample_interval_seconds"` // How often the traffic counters of open gates are read
+	ReportIntervalMinutes int  `json:"report_interval_minutes"` // How often usage reports are published, 0 disables them
+}
+
+// HistoryConfig controls the public history of the gateway's uptime and price changes, so customer apps can
+// prefer reliable gateways and spot prices raised right before payment
+type HistoryConfig struct {
+	Enabled                bool `json:"enabled"`
+	WindowDays             int  `json:"window_days"`              // How far back the history goes
+	PublishIntervalMinutes int  `json:"publish_interval_minutes"` // How often the history event is replaced on the relays
+}
+
+// NoticeCompatConfig mirrors notices for clients that don't read kind 21023 notices. A client advertises what it
+// reads with notice-compat tags in its payment event: ["notice-compat", "nip04"] for a NIP-04 direct message, or
+// ["notice-compat", "kind", "<kind>"] for a copy of the notice under another kind.
+type NoticeCompatConfig struct {
+	Enabled        bool  `json:"enabled"`
+	DirectMessages bool  `json:"direct_messages"` // Honor requests for NIP-04 direct messages
+	MirrorKinds    []int `json:"mirror_kinds"`    // Kinds clients may ask for, accepted by the local relay from the next start
+}
+
+// PubkeySessionsConfig lets a customer use one session on several devices. The payments of a pubkey go to one
+// session, shared by the paying device and the devices named in further device-identifier tags of a payment.
+type PubkeySessionsConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxDevices int  `json:"max_devices"` // Devices sharing the session of a pubkey, including the one that paid first
+}
+
+// FairUseConfig caps the traffic of each device per day, whatever allotment it bought, by throttling it until the
+// day ends. The caps are counted from the samples of the usage tracker, which runs while they are enabled.
+type FairUseConfig struct {
+	Enabled        bool              `json:"enabled"`
+	DailyBytes     uint64            `json:"daily_bytes"`      // Cap per device per day, 0 = uncapped
+	TierDailyBytes map[string]uint64 `json:"tier_daily_bytes"` // Caps per tier, overriding daily_bytes
+	ThrottleKbps   int               `json:"throttle_kbps"`    // Rate of a device over its cap until midnight
+}
+
+// DailyBytesFor returns the daily cap of a tier, 0 if it is uncapped
+func (c FairUseConfig) DailyBytesFor(tier string) uint64 {
+	if dailyBytes, exists := c.TierDailyBytes[tier]; exists {
+		return dailyBytes
+	}
+	return c.DailyBytes
+}
+
+// DynamicPricingConfig raises the price per step of every mint while the gateway is busy, and republishes the
+// advertisement whenever the price changes. WAN utilization is measured against wan_capacity, so it needs the
+// capacity configured or measured.
+type DynamicPricingConfig struct {
+	Enabled         bool        `json:"enabled"`
+	IntervalSeconds int         `json:"interval_seconds"` // How often load is measured and prices are recomputed
+	Steps           []SurgeStep `json:"steps"`
+}
+
+// SurgeStep sets the price once the gateway has this many active sessions or uses this share of the WAN, whichever
+// is reached first. The step with the highest price reached applies.
+type SurgeStep struct {
+	ActiveSessions        int    `json:"active_sessions,omitempty"`         // 0 = not reached by sessions
+	WANUtilizationPercent int    `json:"wan_utilization_percent,omitempty"` // 0 = not reached by utilization
+	PricePercent          uint64 `json:"price_percent"`                     // Of the configured price per step, e.g. 150
+}
+
+// AnomaliesConfig flags payments that look like fraud or trouble at a mint, and sends the owner a daily report
+// of them with recommended actions as an encrypted direct message
+type AnomaliesConfig struct {
+	Enabled            bool   `json:"enabled"`
+	WindowSeconds      int    `json:"window_seconds"`       // Window the purchases and failures below are counted in
+	PurchasesPerPubkey int    `json:"purchases_per_pubkey"` // Purchases of one pubkey within the window that are a spike, 0 = off
+	FailuresPerPubkey  int    `json:"failures_per_pubkey"`  // Failed token redemptions of one pubkey within the window, 0 = off
+	Failures           int    `json:"failures"`             // Failed token redemptions of all customers within the window, 0 = off
+	LargePaymentFactor uint64 `json:"large_payment_factor"` // Payments this many times the average payment are unusual, 0 = off
+	LargePaymentSats   uint64 `json:"large_payment_sats"`   // Payments of at least this many sats are unusual, 0 = off
+	ReportHour         int    `json:"report_hour"`          // Local hour the daily report is sent at, 0 to 23
+}
+
+// TierConfig is a service tier. A payment reaches the highest tier whose threshold it meets, the lowest tier
+// serves payments below every other threshold.
+type TierConfig struct {
+	Name          string `json:"name"`
+	MinAmount     uint64 `json:"min_amount"`     // Sats a payment needs to reach the tier
+	BandwidthKbps int    `json:"bandwidth_kbps"` // 0 = unlimited
+	Priority      int    `json:"priority"`       // HTB priority of the tier's limited gates, 0 (highest) to 7
+}
+
+// ServiceConfig is something other than internet access customers can buy with the same wallet, e.g. printing
+// credits or a locker. Its hook fulfills the purchase, whatever the hook prints is returned to the customer as receipt.
+type ServiceConfig struct {
+	ID                 string `json:"id"` // Named in the service tag of payments
+	Name               string `json:"name"`
+	Unit               string `json:"unit"`                 // What one unit is, e.g. "page" or "hour"
+	PricePerUnit       uint64 `json:"price_per_unit"`       // In sats
+	MaxUnits           uint64 `json:"max_units"`            // Most units one payment buys, 0 = no limit
+	Hook               string `json:"hook"`                 // Script run with the purchase in TOLLGATE_* environment variables
+	HookTimeoutSeconds int    `json:"hook_timeout_seconds"` // Max runtime of the hook, the payment is refunded if it fails
+}
+
+// SubscriptionPlanConfig is a pass bought with a single payment that grants time every day for a number of days,
+// e.g. 2 hours a day for 30 days. Time not used on a day doesn't carry over to the next.
+type SubscriptionPlanConfig struct {
+	ID            string `json:"id"` // Named in the subscription tag of payments
+	Name          string `json:"name"`
+	Price         uint64 `json:"price"`           // In sats
+	MinutesPerDay int    `json:"minutes_per_day"` // Granted at the start of each day of the pass
+	Days          int    `json:"days"`
+	Tier          string `json:"tier"` // Tier of the daily sessions, empty for the tier the price reaches
+}
+
+// PlanConfig is a special-purpose plan outside the tier ladder, billed per day of always-on access at its own
+// rate, e.g. 64 kbps for IoT sensors that mostly upload. Its gates get their own shaping profile, PlanTier.
+// The valve shapes traffic to clients, so the rate limits downloads and leaves uploads unshaped.
+type PlanConfig struct {
+	ID            string `json:"id"` // Named in the plan tag of payments
+	Name          string `json:"name"`
+	PricePerDay   uint64 `json:"price_per_day"`  // In sats
+	BandwidthKbps int    `json:"bandwidth_kbps"` // 0 = unlimited
+	Priority      int    `json:"priority"`       // HTB priority of the plan's gates, 0 (highest) to 7
+	MaxDays       uint64 `json:"max_days"`       // Most days one payment buys, 0 = no limit
+}
+
+// PlanTier returns the name of the shaping profile the gates of a plan are opened with
+func PlanTier(planID string) string {
+	return "plan:" + planID
+}
+
+// DestinationPolicy lists destinations a tier can't reach, e.g. video streaming on the free tier
+type DestinationPolicy struct {
+	Description  string   `json:"description"`   // Advertised to customers, e.g. "no video streaming"
+	BlockedPorts []int    `json:"blocked_ports"` // TCP and UDP destination ports
+	BlockedCIDRs []string `json:"blocked_cidrs"` // Destination networks, e.g. the prefixes announced by a streaming provider's ASN
+}
+
+// ProfileConfig names an additional merchant run in the same process, e.g. a staff network next to the guest network.
+// A profile has its own config.json and identities.json, and with them its own identity, wallet, prices and
+// advertisement. It serves the customers of the gateway interface set in its config.
+type ProfileConfig struct {
+	Name      string `json:"name"`
+	ConfigDir string `json:"config_dir,omitempty"` // Defaults to profiles/<name> next to the main config
+}
+
 // LoadConfig loads and parses config.json.
 func LoadConfig(filePath string) (*Config, error) {
 	data, err := os.ReadFile(filePath)
@@ -114,6 +789,121 @@ func LoadConfig(filePath string) (*Config, error) {
 	return &config, nil
 }
 
+// Clone returns a deep copy of the config.
+func (c *Config) Clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var clone Config
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
+// MetricFor returns the metric sold for payments with a mint, which may override the global metric
+func (c *Config) MetricFor(mint MintConfig) string {
+	if mint.Metric != "" {
+		return mint.Metric
+	}
+	return c.Metric
+}
+
+// StepSizeFor returns the step size sold for payments with a mint, which may override the global step size
+func (c *Config) StepSizeFor(mint MintConfig) uint64 {
+	if mint.StepSize != 0 {
+		return mint.StepSize
+	}
+	return c.StepSize
+}
+
+// DefaultTiers returns the tier ladder used when none is configured: a free tier limited to 2 Mbps and
+// an unlimited premium tier from 10 sats
+func DefaultTiers() []TierConfig {
+	return []TierConfig{
+		{Name: "free", MinAmount: 0, BandwidthKbps: 2048, Priority: 1},
+		{Name: "premium", MinAmount: 10, BandwidthKbps: 0, Priority: 0},
+	}
+}
+
+// TierLadder returns the configured tiers in ascending order of their threshold, or the default tiers
+func (c *Config) TierLadder() []TierConfig {
+	if len(c.Tiers) == 0 {
+		return DefaultTiers()
+	}
+	tiers := append([]TierConfig(nil), c.Tiers...)
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].MinAmount < tiers[j].MinAmount })
+	return tiers
+}
+
+// BaseTier returns the lowest tier, which payments below every other threshold and free sessions get
+func (c *Config) BaseTier() string {
+	return c.TierLadder()[0].Name
+}
+
+// ShapingProfiles returns the tier ladder and a profile for each plan, everything the valve opens gates with
+func (c *Config) ShapingProfiles() []TierConfig {
+	profiles := c.TierLadder()
+	for _, plan := range c.Plans {
+		profiles = append(profiles, TierConfig{
+			Name:          PlanTier(plan.ID),
+			BandwidthKbps: plan.BandwidthKbps,
+			Priority:      plan.Priority,
+		})
+	}
+	return profiles
+}
+
+// Units mint prices can be set in. Amounts in usd are cents, as usd keysets count them.
+const (
+	UnitSat  = "sat"
+	UnitMsat = "msat"
+	UnitUSD  = "usd"
+)
+
+// NormalizeUnit returns the canonical name of a price or token unit, the spellings in use included,
+// or an error for a unit prices can't be set in. An empty unit is sats.
+func NormalizeUnit(unit string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(unit)) {
+	case "", "sat", "sats":
+		return UnitSat, nil
+	case "msat", "msats":
+		return UnitMsat, nil
+	case "usd":
+		return UnitUSD, nil
+	default:
+		return "", fmt.Errorf("unsupported price unit %q, use sat, msat or usd", unit)
+	}
+}
+
+// ForMetric returns a copy of the config in which payments with the mint buy the requested metric,
+// or an error if the metric is not offered for the mint
+func (c *Config) ForMetric(mintURL, metric string) (*Config, error) {
+	for i, mint := range c.AcceptedMints {
+		if mint.URL != mintURL {
+			continue
+		}
+		if metric == c.MetricFor(mint) {
+			return c, nil
+		}
+		for _, option := range c.MetricOptions {
+			if option.Metric != metric {
+				continue
+			}
+			clone, err := c.Clone()
+			if err != nil {
+				return nil, err
+			}
+			clone.AcceptedMints[i].Metric = option.Metric
+			clone.AcceptedMints[i].StepSize = option.StepSize
+			return clone, nil
+		}
+		return nil, fmt.Errorf("metric %s is not offered for payments with %s", metric, mintURL)
+	}
+	return nil, fmt.Errorf("mint configuration not found for URL: %s", mintURL)
+}
+
 // SaveConfig saves config.json.
 func SaveConfig(filePath string, config *Config) error {
 	data, err := json.MarshalIndent(config, "", "  ")
@@ -138,6 +928,7 @@ func NewDefaultConfig() *Config {
 				PricePerStep:            1,
 				PriceUnit:               "sats",
 				MinPurchaseSteps:        0,
+				ReceiveStrategy:         "swap",
 			},
 			{
 				URL:                     "https://mint.minibits.cash/Bitcoin",
@@ -148,6 +939,7 @@ func NewDefaultConfig() *Config {
 				PricePerStep:            1,
 				PriceUnit:               "sats",
 				MinPurchaseSteps:        0,
+				ReceiveStrategy:         "swap",
 			},
 		},
 		ProfitShare: []ProfitShareConfig{
@@ -160,9 +952,10 @@ func NewDefaultConfig() *Config {
 				Identity: "developer",
 			},
 		},
-		StepSize: 600000,
-		Margin:   0.1,
-		Metric:   "milliseconds",
+		StepSize:      600000,
+		Margin:        0.1,
+		Metric:        "milliseconds",
+		MetricOptions: []MetricOption{},
 		Relays: []string{
 			"wss://relay.damus.io",
 			"wss://nos.lol",
@@ -196,6 +989,306 @@ func NewDefaultConfig() *Config {
 				DataMonitoringInterval: 500 * time.Millisecond,
 			},
 		},
+		Tor: TorConfig{
+			Enabled:           false,
+			ControlAddress:    "127.0.0.1:9051",
+			ControlPassword:   "",
+			VirtualPort:       2122,
+			AuthorizedClients: []string{},
+		},
+		SessionCaps: SessionCapsConfig{
+			ExcessPolicy: "refund",
+			Tiers: map[string]TierCapConfig{
+				"premium": {
+					MaxSessionAllotment: 24 * 60 * 60 * 1000,     // 1 day
+					MaxStackedAllotment: 7 * 24 * 60 * 60 * 1000, // 1 week
+				},
+			},
+		},
+		Hooks: HooksConfig{
+			OnAuthorize:    "",
+			OnDeauthorize:  "",
+			OnLimitChange:  "",
+			OnIPChange:     "",
+			TimeoutSeconds: 10,
+		},
+		Analytics: AnalyticsConfig{
+			DeviceClassification: false,
+		},
+		Reservations: ReservationsConfig{
+			TTLSeconds:            300,
+			MaxConcurrentSessions: 0,
+		},
+		Pricing: PricingConfig{
+			Script:         "",
+			Plugin:         "",
+			TimeoutSeconds: 5,
+			ProRata:        false,
+		},
+		Wallet: WalletConfig{
+			MaxConcurrentOperations: 8,
+			MaxConcurrentPerMint:    2,
+			QueueTimeoutSeconds:     30,
+			MintInfoTTLSeconds:      600,
+			MaxFeePercent:           10,
+			FeePolicy:               "adjust",
+			ReconcileIntervalHours:  24,
+			ReconcileToleranceSats:  0,
+			DenominationStrategy:    "powers-of-two",
+			PresplitBundles:         0,
+		},
+		Zaps: ZapsConfig{
+			Enabled:           false,
+			PricePerStep:      1,
+			MinPurchaseSteps:  0,
+			RequestTTLSeconds: 600,
+		},
+		Fleet: FleetConfig{
+			HandoffEnabled:        false,
+			TrustedGateways:       []string{},
+			HandoffCreditPercent:  100,
+			ProofTTLSeconds:       3600,
+			StatusReportsEnabled:  false,
+			StatusIntervalSeconds: 300,
+		},
+		NDS: NDSConfig{
+			Mode:               GateModeCaptivePortal,
+			AutoFix:            false,
+			GatewayInterface:   "br-lan",
+			PortalPort:         8080,
+			ProtocolPort:       2121,
+			WalledGarden:       []string{},
+			DeriveWalledGarden: true,
+		},
+		DHCP: DHCPConfig{
+			LeasesFile:          "/tmp/dhcp.leases",
+			PollIntervalSeconds: 10,
+		},
+		Outbox: OutboxConfig{
+			MaxEvents:         500,
+			MaxAgeSeconds:     24 * 60 * 60,
+			MaxBackoffSeconds: 600,
+		},
+		Publishing: PublishingConfig{
+			TimeoutSeconds: 10,
+			Retries:        2,
+			Routes: map[string]PublishRouteConfig{
+				"session":       {Local: true, Policy: DeliveryBestEffort},
+				"notice":        {Local: true, Policy: DeliveryBestEffort},
+				"dm":            {Local: true, Public: true, Policy: DeliveryAllRelays},
+				"advertisement": {Public: true, Policy: DeliveryAllRelays},
+				"status":        {Public: true, Policy: DeliveryAllRelays},
+				"feedback":      {Public: true, Policy: DeliveryAllRelays},
+				"usage":         {Local: true, Policy: DeliveryBestEffort},
+				"history":       {Local: true, Public: true, Policy: DeliveryAllRelays},
+			},
+		},
+		PaymentPoW: PaymentPoWConfig{
+			MinDifficulty: 0,
+			RequireOnLAN:  false,
+		},
+		Cancellation: CancellationConfig{
+			Enabled:    false,
+			FeePercent: 10,
+		},
+		Profiles: []ProfileConfig{},
+		SLA: SLAConfig{
+			Enabled:              false,
+			CreditPercent:        100,
+			ProbeTarget:          "8.8.8.8",
+			ProbeIntervalSeconds: 30,
+			MinOutageSeconds:     60,
+		},
+		MintRecommendations: MintRecommendationsConfig{
+			Enabled:                false,
+			Curators:               []string{},
+			MinCurators:            1,
+			AutoAdd:                false,
+			AutoRemove:             false,
+			MaxMints:               5,
+			AllowedHosts:           []string{},
+			RefreshIntervalSeconds: 3600,
+		},
+		DataQuota: DataQuotaConfig{
+			PollIntervalSeconds: 10,
+			ThrottlingEnabled:   false,
+			Steps: []ThrottleStep{
+				{AtPercent: 90, RatePercent: 50},
+				{AtPercent: 99, RateKbps: 1024},
+			},
+			TierSteps: map[string][]ThrottleStep{},
+		},
+		ColdSweep: ColdSweepConfig{
+			Enabled:              false,
+			ThresholdSats:        200000,
+			KeepSats:             50000,
+			CheckIntervalSeconds: 300,
+		},
+		Diagnostics: DiagnosticsConfig{
+			TimingTags: false,
+		},
+		SessionGroups: SessionGroupsConfig{
+			Enabled:    false,
+			MaxMembers: 5,
+		},
+		Gifts: GiftsConfig{
+			Enabled:      false,
+			RequireLease: true,
+		},
+		IPv6Prefix: IPv6PrefixConfig{
+			Enabled:      false,
+			Pool:         "",
+			Tiers:        []string{"premium"},
+			InboundPorts: []int{},
+		},
+		Admission: AdmissionConfig{
+			Enabled:           false,
+			MinSignalDBm:      -85,
+			DownTierSignalDBm: -75,
+			MinTxRateMbps:     0,
+		},
+		NegativeCache: NegativeCacheConfig{
+			Enabled:        true,
+			TTLSeconds:     300,
+			PubkeyFailures: 5,
+		},
+		GateVerification: GateVerificationConfig{
+			Enabled:      true,
+			DelaySeconds: 30,
+			Repair:       true,
+		},
+		Privacy: PrivacyConfig{
+			Enabled:             false,
+			SecretRotationHours: 24,
+		},
+		PurchaseQueue: PurchaseQueueConfig{
+			MaxConcurrent:  4,
+			MaxDepth:       32,
+			MaxWaitSeconds: 10,
+		},
+		Cards: CardsConfig{
+			Enabled: false,
+			Issuers: []string{},
+		},
+		RandomizedMACs: RandomizedMACConfig{
+			Policy:                     RandomizedMACAllow,
+			AttestationIntervalSeconds: 900,
+		},
+		CompanionSessions: CompanionSessionsConfig{
+			Enabled:        false,
+			TrustedPubkeys: []string{},
+		},
+		Loyalty: LoyaltyConfig{
+			Enabled:         false,
+			MinPurchases:    3,
+			WindowDays:      30,
+			DiscountPercent: 10,
+			BonusPercent:    0,
+		},
+		GateLatency: GateLatencyConfig{
+			BudgetMs:      2000,
+			CreditPercent: 5,
+		},
+		Terms: TermsConfig{
+			Enabled: false,
+		},
+		LegacyImport: LegacyImportConfig{
+			Enabled:                 false,
+			Source:                  LegacySourceOpenNDS,
+			UnlimitedSessionMinutes: 60,
+			Tier:                    "premium",
+		},
+		TierUpgrade: TierUpgradeConfig{
+			Enabled:      false,
+			PricePerHour: map[string]uint64{"premium": 10},
+		},
+		WANCapacity: WANCapacityConfig{
+			CapacityMbps:           0,
+			MeasureIntervalMinutes: 360,
+			MeasureSeconds:         10,
+		},
+		FiatDisplay: FiatDisplayConfig{
+			Enabled:        false,
+			Currency:       "USD",
+			RateURL:        "https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=usd",
+			RatePath:       "bitcoin.usd",
+			RefreshMinutes: 30,
+		},
+		SessionCookies: SessionCookiesConfig{
+			Enabled: true,
+		},
+		Storage: StorageConfig{
+			Backend: StorageJSON,
+		},
+		FlashWrites: FlashWritesConfig{
+			FlushIntervalSeconds: 60,
+			StagingDir:           "/tmp/tollgate-state",
+		},
+		SessionAbuse: SessionAbuseConfig{
+			Enabled:             false,
+			Policy:              SessionAbuseAlert,
+			PollIntervalSeconds: 15,
+			MaxReturns:          3,
+			WindowSeconds:       300,
+			ThrottleKbps:        256,
+		},
+		PaymentRequests: PaymentRequestsConfig{
+			Enabled:         false,
+			RotationMinutes: 60,
+		},
+		EmergencyStop: EmergencyStopConfig{
+			OwnerPubkeys:  []string{},
+			Threshold:     2,
+			WindowSeconds: 3600,
+		},
+		Usage: UsageConfig{
+			Enabled:               true,
+			SampleIntervalSeconds: 60,
+			ReportIntervalMinutes: 15,
+		},
+		History: HistoryConfig{
+			Enabled:                true,
+			WindowDays:             30,
+			PublishIntervalMinutes: 60,
+		},
+		NoticeCompat: NoticeCompatConfig{
+			Enabled:        true,
+			DirectMessages: true,
+		},
+		PubkeySessions: PubkeySessionsConfig{
+			Enabled:    false,
+			MaxDevices: 3,
+		},
+		FairUse: FairUseConfig{
+			Enabled:        false,
+			DailyBytes:     20_000_000_000,
+			TierDailyBytes: map[string]uint64{},
+			ThrottleKbps:   256,
+		},
+		DynamicPricing: DynamicPricingConfig{
+			Enabled:         false,
+			IntervalSeconds: 60,
+			Steps: []SurgeStep{
+				{ActiveSessions: 20, WANUtilizationPercent: 70, PricePercent: 150},
+				{ActiveSessions: 40, WANUtilizationPercent: 90, PricePercent: 200},
+			},
+		},
+		Anomalies: AnomaliesConfig{
+			Enabled:            true,
+			WindowSeconds:      3600,
+			PurchasesPerPubkey: 20,
+			FailuresPerPubkey:  5,
+			Failures:           30,
+			LargePaymentFactor: 10,
+			LargePaymentSats:   0,
+			ReportHour:         8,
+		},
+		Tiers:                DefaultTiers(),
+		Services:             []ServiceConfig{},
+		Subscriptions:        []SubscriptionPlanConfig{},
+		Plans:                []PlanConfig{},
+		TierPolicies:         map[string]DestinationPolicy{},
+		InterfaceProfitShare: map[string][]ProfitShareConfig{},
 	}
 }
 
@@ -0,0 +1,145 @@
+package config_manager
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+)
+
+// VenuePreset pre-populates pricing, payouts, session rules and the walled garden for a type of venue.
+// Applying a preset overwrites those settings; the operator tweaks them afterwards like any other setting.
+type VenuePreset struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	apply       func(config *Config)
+}
+
+// venuePresets are the built-in presets, selected by name
+var venuePresets = []VenuePreset{
+	{
+		Name:        "coffee-shop",
+		Description: "Short visits paid by the minute, capped at a few hours, with hourly payouts",
+		apply: func(config *Config) {
+			setTimePricing(config, 60000, 1, 15, 3600)
+			config.SessionCaps = SessionCapsConfig{
+				ExcessPolicy: "refund",
+				Tiers: map[string]TierCapConfig{
+					"premium": {MaxStackedAllotment: 4 * 60 * 60 * 1000},
+				},
+			}
+			config.Reservations.MaxConcurrentSessions = 40
+			config.Cancellation.Enabled = false
+			config.SessionGroups.Enabled = false
+			config.SLA.Enabled = false
+			config.NDS.WalledGarden = walledGarden(config, false)
+		},
+	},
+	{
+		Name:        "campground",
+		Description: "Multi-day stays shared by families, credited for outages of a weak uplink, with daily payouts",
+		apply: func(config *Config) {
+			setTimePricing(config, 60000, 1, 60, 86400)
+			config.SessionCaps = SessionCapsConfig{ExcessPolicy: "refund", Tiers: map[string]TierCapConfig{}}
+			config.Reservations.MaxConcurrentSessions = 0
+			config.Cancellation = CancellationConfig{Enabled: true, FeePercent: 10}
+			config.SessionGroups = SessionGroupsConfig{Enabled: true, MaxMembers: 5}
+			config.SLA.Enabled = true
+			config.SLA.CreditPercent = 100
+			config.NDS.WalledGarden = walledGarden(config, true)
+		},
+	},
+	{
+		Name:        "co-working",
+		Description: "Hourly passes shared by teams, bookable ahead of time, with daily payouts",
+		apply: func(config *Config) {
+			setTimePricing(config, 60*60*1000, 60, 1, 86400)
+			config.SessionCaps = SessionCapsConfig{ExcessPolicy: "refund", Tiers: map[string]TierCapConfig{}}
+			config.Reservations = ReservationsConfig{TTLSeconds: 900, MaxConcurrentSessions: 50}
+			config.Cancellation = CancellationConfig{Enabled: true, FeePercent: 0}
+			config.SessionGroups = SessionGroupsConfig{Enabled: true, MaxMembers: 10}
+			config.SLA.Enabled = true
+			config.NDS.WalledGarden = walledGarden(config, false)
+		},
+	},
+	{
+		Name:        "mesh-reseller",
+		Description: "Upstream bandwidth resold by the megabyte and slowed down near the end of the quota",
+		apply: func(config *Config) {
+			config.ResellerMode = true
+			config.Metric = "bytes"
+			config.StepSize = 1024 * 1024
+			for i := range config.AcceptedMints {
+				mint := &config.AcceptedMints[i]
+				mint.Metric = ""
+				mint.StepSize = 0
+				mint.PricePerStep = 1
+				mint.MinPurchaseSteps = 10
+				mint.PayoutIntervalSeconds = 3600
+			}
+			config.SessionCaps = SessionCapsConfig{ExcessPolicy: "refund", Tiers: map[string]TierCapConfig{}}
+			config.Reservations.MaxConcurrentSessions = 0
+			config.Cancellation.Enabled = false
+			config.SessionGroups.Enabled = false
+			config.DataQuota.ThrottlingEnabled = true
+			config.NDS.WalledGarden = walledGarden(config, true)
+		},
+	},
+}
+
+// VenuePresets returns the built-in venue presets
+func VenuePresets() []VenuePreset {
+	return slices.Clone(venuePresets)
+}
+
+// ApplyVenuePreset overwrites the settings covered by the named preset and records it in the config
+func ApplyVenuePreset(config *Config, name string) error {
+	for _, preset := range venuePresets {
+		if preset.Name == name {
+			preset.apply(config)
+			config.VenuePreset = name
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown venue preset %q", name)
+}
+
+// setTimePricing sells time in steps of stepSize milliseconds with the same price and payout cadence at every mint
+func setTimePricing(config *Config, stepSize, pricePerStep, minSteps, payoutIntervalSeconds uint64) {
+	config.ResellerMode = false
+	config.Metric = "milliseconds"
+	config.StepSize = stepSize
+	for i := range config.AcceptedMints {
+		mint := &config.AcceptedMints[i]
+		mint.Metric = ""
+		mint.StepSize = 0
+		mint.PricePerStep = pricePerStep
+		mint.MinPurchaseSteps = minSteps
+		mint.PayoutIntervalSeconds = payoutIntervalSeconds
+	}
+}
+
+// walledGarden returns the hosts customers may reach before paying: the accepted mints, so they can
+// top up their wallet, and optionally the relays, so apps can find the gateway's advertisement
+func walledGarden(config *Config, includeRelays bool) []string {
+	urls := make([]string, 0, len(config.AcceptedMints)+len(config.Relays))
+	for _, mint := range config.AcceptedMints {
+		urls = append(urls, mint.URL)
+	}
+	if includeRelays {
+		urls = append(urls, config.Relays...)
+	}
+	return urlHosts(urls)
+}
+
+// urlHosts returns the distinct hosts of URLs, skipping those that don't parse
+func urlHosts(urls []string) []string {
+	var hosts []string
+	for _, rawURL := range urls {
+		parsed, err := url.Parse(rawURL)
+		if err != nil || parsed.Hostname() == "" || slices.Contains(hosts, parsed.Hostname()) {
+			continue
+		}
+		hosts = append(hosts, parsed.Hostname())
+	}
+	return hosts
+}
@@ -168,3 +168,259 @@ func TestSetUsername(t *testing.T) {
 	}
 	// Additional checks can be added here to verify the username is set correctly on relays
 }
+
+func TestUpdateConfig(t *testing.T) {
+	tempDir := t.TempDir()
+	configFilePath := filepath.Join(tempDir, "test_config.json")
+	installFilePath := filepath.Join(tempDir, "test_install.json")
+	identitiesFilePath := filepath.Join(tempDir, "test_identities.json")
+
+	cm, err := NewConfigManager(configFilePath, installFilePath, identitiesFilePath)
+	if err != nil {
+		t.Fatalf("Failed to create ConfigManager: %v", err)
+	}
+
+	var notified *Config
+	cm.OnConfigChange(func(config *Config) {
+		notified = config
+	})
+
+	oldConfig := cm.GetConfig()
+	oldStepSize := oldConfig.StepSize
+
+	if err := cm.UpdatePricing(int(oldConfig.AcceptedMints[0].PricePerStep), int(oldStepSize*2)); err != nil {
+		t.Fatalf("UpdatePricing returned error: %v", err)
+	}
+
+	newConfig := cm.GetConfig()
+	if newConfig.StepSize != oldStepSize*2 {
+		t.Errorf("Expected step size %d, got %d", oldStepSize*2, newConfig.StepSize)
+	}
+	if oldConfig.StepSize != oldStepSize {
+		t.Errorf("Previous snapshot was modified: step size %d, expected %d", oldConfig.StepSize, oldStepSize)
+	}
+	if notified != newConfig {
+		t.Errorf("Listener was not notified with the new snapshot")
+	}
+
+	loadedConfig, err := LoadConfig(configFilePath)
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if loadedConfig.StepSize != oldStepSize*2 {
+		t.Errorf("Saved step size %d, expected %d", loadedConfig.StepSize, oldStepSize*2)
+	}
+
+	// Unchanged pricing must not notify listeners
+	notified = nil
+	if err := cm.UpdatePricing(int(newConfig.AcceptedMints[0].PricePerStep), int(newConfig.StepSize)); err != nil {
+		t.Fatalf("UpdatePricing returned error: %v", err)
+	}
+	if notified != nil {
+		t.Errorf("Listener notified although config did not change")
+	}
+
+	entries, err := cm.GetAuditLog().Entries(0)
+	if err != nil {
+		t.Fatalf("Entries returned error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Action != AuditConfigChange || entries[0].Details["fields"] != "step_size" {
+		t.Errorf("Expected one audited step_size change, got %+v", entries)
+	}
+}
+
+func TestMintMetricOverrides(t *testing.T) {
+	config := &Config{Metric: "milliseconds", StepSize: 60000}
+
+	satMint := MintConfig{URL: "https://sats.example"}
+	if metric, stepSize := config.MetricFor(satMint), config.StepSizeFor(satMint); metric != "milliseconds" || stepSize != 60000 {
+		t.Errorf("Mint without overrides got %s/%d, expected milliseconds/60000", metric, stepSize)
+	}
+
+	stableMint := MintConfig{URL: "https://usd.example", Metric: "bytes", StepSize: 1024 * 1024}
+	if metric, stepSize := config.MetricFor(stableMint), config.StepSizeFor(stableMint); metric != "bytes" || stepSize != 1024*1024 {
+		t.Errorf("Mint with overrides got %s/%d, expected bytes/%d", metric, stepSize, 1024*1024)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog returned error: %v", err)
+	}
+	if err := auditLog.Record("cli", AuditPayout, map[string]string{"amount": "21"}); err != nil {
+		t.Fatalf("Record returned error: %v", err)
+	}
+
+	// A reopened log continues the chain
+	auditLog, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog returned error: %v", err)
+	}
+	if err := auditLog.Record("system", AuditConfigChange, map[string]string{"fields": "step_size"}); err != nil {
+		t.Fatalf("Record returned error: %v", err)
+	}
+	if err := auditLog.Verify(); err != nil {
+		t.Fatalf("Verify of untouched log returned error: %v", err)
+	}
+
+	entries, err := auditLog.Entries(0)
+	if err != nil {
+		t.Fatalf("Entries returned error: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Seq != 2 || entries[1].PrevHash != entries[0].Hash {
+		t.Fatalf("Expected two chained entries, got %+v", entries)
+	}
+	if seq, hash := auditLog.Head(); seq != 2 || hash != entries[1].Hash {
+		t.Errorf("Expected head at entry 2 with hash %s, got %d %s", entries[1].Hash, seq, hash)
+	}
+
+	tampered := append([]AuditEntry{}, entries...)
+	tampered[0].Details = map[string]string{"amount": "2100"}
+	if err := VerifyAuditChain(tampered); err == nil {
+		t.Errorf("Expected modified entry to break the chain")
+	}
+	if err := VerifyAuditChain(entries[1:]); err == nil {
+		t.Errorf("Expected removed entry to break the chain")
+	}
+}
+
+func TestDataQuotaStepsFor(t *testing.T) {
+	defaultSteps := []ThrottleStep{{AtPercent: 90, RatePercent: 50}}
+	freeSteps := []ThrottleStep{{AtPercent: 80, RateKbps: 512}}
+	config := DataQuotaConfig{
+		Steps:     defaultSteps,
+		TierSteps: map[string][]ThrottleStep{"free": freeSteps},
+	}
+
+	if steps := config.StepsFor("free"); !reflect.DeepEqual(steps, freeSteps) {
+		t.Errorf("Expected free tier steps %v, got %v", freeSteps, steps)
+	}
+	if steps := config.StepsFor("premium"); !reflect.DeepEqual(steps, defaultSteps) {
+		t.Errorf("Expected default steps %v for tier without own steps, got %v", defaultSteps, steps)
+	}
+}
+
+func TestConfigForMetric(t *testing.T) {
+	config := NewDefaultConfig()
+	config.MetricOptions = []MetricOption{{Metric: "bytes", StepSize: 1048576}}
+	mintURL := config.AcceptedMints[0].URL
+
+	same, err := config.ForMetric(mintURL, "milliseconds")
+	if err != nil {
+		t.Fatalf("Expected the configured metric to be offered, got %v", err)
+	}
+	if same != config {
+		t.Errorf("Expected the config itself for the configured metric")
+	}
+
+	bytesConfig, err := config.ForMetric(mintURL, "bytes")
+	if err != nil {
+		t.Fatalf("Expected bytes to be offered, got %v", err)
+	}
+	mint := bytesConfig.AcceptedMints[0]
+	if bytesConfig.MetricFor(mint) != "bytes" || bytesConfig.StepSizeFor(mint) != 1048576 {
+		t.Errorf("Expected bytes in steps of 1048576, got %s in steps of %d", bytesConfig.MetricFor(mint), bytesConfig.StepSizeFor(mint))
+	}
+	if config.AcceptedMints[0].Metric != "" {
+		t.Errorf("Expected the original config to be left unchanged")
+	}
+
+	if _, err := config.ForMetric(mintURL, "packets"); err == nil {
+		t.Errorf("Expected an error for a metric that is not offered")
+	}
+	if _, err := config.ForMetric("https://unknown.mint", "bytes"); err == nil {
+		t.Errorf("Expected an error for an unknown mint")
+	}
+}
+
+func TestApplyVenuePreset(t *testing.T) {
+	config := NewDefaultConfig()
+	if err := ApplyVenuePreset(config, "mesh-reseller"); err != nil {
+		t.Fatalf("ApplyVenuePreset returned error: %v", err)
+	}
+
+	mint := config.AcceptedMints[0]
+	if !config.ResellerMode || config.MetricFor(mint) != "bytes" || mint.MinPurchaseSteps != 10 {
+		t.Errorf("Expected reseller mode selling bytes, got reseller=%v metric=%s min steps=%d",
+			config.ResellerMode, config.MetricFor(mint), mint.MinPurchaseSteps)
+	}
+	if config.VenuePreset != "mesh-reseller" {
+		t.Errorf("Expected the applied preset to be recorded, got %q", config.VenuePreset)
+	}
+	if len(config.NDS.WalledGarden) == 0 || config.NDS.WalledGarden[0] != "mint.coinos.io" {
+		t.Errorf("Expected the mint hosts in the walled garden, got %v", config.NDS.WalledGarden)
+	}
+
+	if err := ApplyVenuePreset(config, "stadium"); err == nil {
+		t.Errorf("Expected an error for an unknown preset")
+	}
+	if config.VenuePreset != "mesh-reseller" {
+		t.Errorf("Expected an unknown preset to leave the config unchanged")
+	}
+}
+
+func TestUCIConfig(t *testing.T) {
+	config := NewDefaultConfig()
+	config.StepSize = 30000
+	config.Relays = []string{"wss://relay.example.com", "wss://it's.example.com"}
+
+	sections, err := parseUCI(formatUCI(configToUCI(config)))
+	if err != nil {
+		t.Fatalf("parseUCI of formatted config returned error: %v", err)
+	}
+	roundTripped := NewDefaultConfig()
+	roundTripped.AcceptedMints = roundTripped.AcceptedMints[:1]
+	if err := applyUCI(sections, roundTripped); err != nil {
+		t.Fatalf("applyUCI returned error: %v", err)
+	}
+	if changed := changedConfigFields(config, roundTripped); len(changed) > 0 {
+		t.Errorf("Expected config to survive the UCI round trip, fields %v differ", changed)
+	}
+
+	// Written with uci or LuCI: quoting, comments, booleans and a single mint replacing the list
+	sections, err = parseUCI([]byte(`
+config tollgate 'main'
+	option step_size 60000 # one minute
+	list relays "wss://relay.damus.io"
+
+config wallet 'wallet'
+	option presplit_bundles '4'
+
+config fair_use 'fair_use'
+	option enabled 'yes'
+
+config accepted_mints
+	option url 'https://mint.example.com'
+	option price_per_step '2'
+`))
+	if err != nil {
+		t.Fatalf("parseUCI returned error: %v", err)
+	}
+	if err := applyUCI(sections, config); err != nil {
+		t.Fatalf("applyUCI returned error: %v", err)
+	}
+	if config.StepSize != 60000 || !reflect.DeepEqual(config.Relays, []string{"wss://relay.damus.io"}) {
+		t.Errorf("Expected main section applied, got step size %d and relays %v", config.StepSize, config.Relays)
+	}
+	if config.Wallet.PresplitBundles != 4 || !config.FairUse.Enabled {
+		t.Errorf("Expected settings groups applied, got %+v and %+v", config.Wallet, config.FairUse)
+	}
+	if len(config.AcceptedMints) != 1 || config.AcceptedMints[0].URL != "https://mint.example.com" ||
+		config.AcceptedMints[0].PricePerStep != 2 || config.AcceptedMints[0].MinBalance != 64 {
+		t.Errorf("Expected the mint section to replace the mints keeping unlisted settings, got %+v", config.AcceptedMints)
+	}
+	if len(config.Tiers) != len(NewDefaultConfig().Tiers) || config.ConfigVersion != NewDefaultConfig().ConfigVersion {
+		t.Errorf("Expected lists without sections and unlisted options to be kept")
+	}
+
+	if _, err := parseUCI([]byte("config wallet 'wallet'\n\toption presplit_bundles '4")); err == nil {
+		t.Errorf("Expected unterminated quote to be rejected")
+	}
+	sections, _ = parseUCI([]byte("config wallet 'wallet'\n\toption presplit_bundles 'many'"))
+	if err := applyUCI(sections, config); err == nil {
+		t.Errorf("Expected invalid number to be rejected")
+	}
+}
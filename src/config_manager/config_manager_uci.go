@@ -0,0 +1,504 @@
+package config_manager
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uciPollInterval is how often the UCI package is checked for changes committed with uci or LuCI
+const uciPollInterval = 5 * time.Second
+
+// uciSectionMain holds the top-level settings of the config
+const uciSectionMain = "main"
+
+// uciSection is one "config" block of a UCI package. Name is empty for anonymous sections.
+type uciSection struct {
+	Type    string
+	Name    string
+	Options map[string]string
+	Lists   map[string][]string
+	order   []string // Option and list names in the order they were added, so a written package is stable
+}
+
+func newUCISection(sectionType, name string) *uciSection {
+	return &uciSection{Type: sectionType, Name: name, Options: make(map[string]string), Lists: make(map[string][]string)}
+}
+
+func (s *uciSection) setOption(name, value string) {
+	if _, exists := s.Options[name]; !exists {
+		s.order = append(s.order, name)
+	}
+	s.Options[name] = value
+}
+
+func (s *uciSection) addList(name, value string) {
+	if _, exists := s.Lists[name]; !exists {
+		s.order = append(s.order, name)
+	}
+	s.Lists[name] = append(s.Lists[name], value)
+}
+
+// uciFilePath returns the UCI package the config at configPath is synced with, empty if it isn't. Only the
+// gateway's own config is, configs of tests and tools elsewhere leave /etc/config alone.
+func uciFilePath(configPath string) string {
+	if filepath.Dir(configPath) != "/etc/tollgate" {
+		return ""
+	}
+	if info, err := os.Stat("/etc/config"); err != nil || !info.IsDir() {
+		return ""
+	}
+	return "/etc/config/tollgate"
+}
+
+// configToUCI maps the config to UCI sections. Top-level settings go to the "main" section, each settings group
+// to a named section of its own and each list entry, e.g. a mint or a tier, to an anonymous section typed by the
+// list. Only plain values and lists of them map to options; deeper settings and maps stay in the JSON config.
+func configToUCI(config *Config) []*uciSection {
+	main := newUCISection("tollgate", uciSectionMain)
+	sections := []*uciSection{main}
+
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name, ok := uciFieldName(value.Type().Field(i))
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			section := newUCISection(name, name)
+			addUCIOptions(section, field)
+			sections = append(sections, section)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len(); j++ {
+				section := newUCISection(name, "")
+				addUCIOptions(section, field.Index(j))
+				sections = append(sections, section)
+			}
+		default:
+			addUCIOption(main, name, field)
+		}
+	}
+	return sections
+}
+
+// addUCIOptions adds the plain fields of a struct to a section
+func addUCIOptions(section *uciSection, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		if name, ok := uciFieldName(value.Type().Field(i)); ok {
+			addUCIOption(section, name, value.Field(i))
+		}
+	}
+}
+
+// addUCIOption adds a plain value as an option, a list of them as a list. Empty strings and lists are left out,
+// as uci drops them.
+func addUCIOption(section *uciSection, name string, value reflect.Value) {
+	if value.Kind() == reflect.Slice {
+		if !isUCIScalar(value.Type().Elem().Kind()) {
+			return
+		}
+		for i := 0; i < value.Len(); i++ {
+			section.addList(name, formatUCIValue(value.Index(i)))
+		}
+		return
+	}
+	if !isUCIScalar(value.Kind()) {
+		return
+	}
+	if formatted := formatUCIValue(value); formatted != "" {
+		section.setOption(name, formatted)
+	}
+}
+
+// applyUCI overlays UCI sections on the config. Options missing from the package keep their value, so a package
+// written by hand only changes what it lists, and so do lists with no section in the package. List entries are
+// matched by position, so the settings their sections leave out stay with them.
+func applyUCI(sections []*uciSection, config *Config) error {
+	byName := make(map[string]*uciSection)
+	byType := make(map[string][]*uciSection)
+	for _, section := range sections {
+		if section.Name != "" {
+			byName[section.Name] = section
+		} else {
+			byType[section.Type] = append(byType[section.Type], section)
+		}
+	}
+
+	value := reflect.ValueOf(config).Elem()
+	main := byName[uciSectionMain]
+	for i := 0; i < value.NumField(); i++ {
+		name, ok := uciFieldName(value.Type().Field(i))
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			if section, exists := byName[name]; exists {
+				if err := setUCIOptions(section, field); err != nil {
+					return err
+				}
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			entries := byType[name]
+			if len(entries) == 0 {
+				continue
+			}
+			list := reflect.MakeSlice(field.Type(), len(entries), len(entries))
+			reflect.Copy(list, field)
+			for j, section := range entries {
+				if err := setUCIOptions(section, list.Index(j)); err != nil {
+					return err
+				}
+			}
+			field.Set(list)
+		default:
+			if main != nil {
+				if err := setUCIOption(main, name, field); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setUCIOptions sets the plain fields of a struct from a section
+func setUCIOptions(section *uciSection, value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		if name, ok := uciFieldName(value.Type().Field(i)); ok {
+			if err := setUCIOption(section, name, value.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setUCIOption(section *uciSection, name string, value reflect.Value) error {
+	if value.Kind() == reflect.Slice {
+		if !isUCIScalar(value.Type().Elem().Kind()) {
+			return nil
+		}
+		entries, exists := section.Lists[name]
+		if !exists {
+			return nil
+		}
+		list := reflect.MakeSlice(value.Type(), len(entries), len(entries))
+		for i, entry := range entries {
+			if err := parseUCIValue(entry, list.Index(i)); err != nil {
+				return fmt.Errorf("invalid %s in UCI section %s: %w", name, section.label(), err)
+			}
+		}
+		value.Set(list)
+		return nil
+	}
+	if !isUCIScalar(value.Kind()) {
+		return nil
+	}
+	option, exists := section.Options[name]
+	if !exists {
+		return nil
+	}
+	if err := parseUCIValue(option, value); err != nil {
+		return fmt.Errorf("invalid %s in UCI section %s: %w", name, section.label(), err)
+	}
+	return nil
+}
+
+func (s *uciSection) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "of type " + s.Type
+}
+
+// uciFieldName returns the JSON name of a field, which is also its UCI name
+func uciFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return "", false
+	}
+	return name, true
+}
+
+func isUCIScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// formatUCIValue formats a plain value, booleans as 1 or 0 like other OpenWrt packages
+func formatUCIValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return "1"
+		}
+		return "0"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 64)
+	}
+	return value.String()
+}
+
+// parseUCIValue parses an option into a plain value. Booleans take the spellings uci accepts.
+func parseUCIValue(option string, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Bool:
+		switch strings.ToLower(option) {
+		case "1", "true", "yes", "on", "enabled":
+			value.SetBool(true)
+		case "0", "false", "no", "off", "disabled":
+			value.SetBool(false)
+		default:
+			return fmt.Errorf("%q is not a boolean", option)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(option, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(option, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(option, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetFloat(parsed)
+	default:
+		value.SetString(option)
+	}
+	return nil
+}
+
+// formatUCI writes sections in the format of /etc/config files
+func formatUCI(sections []*uciSection) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Synced with /etc/tollgate/config.json; settings not listed here are kept in the JSON config\n")
+	for _, section := range sections {
+		buf.WriteString("\nconfig " + section.Type)
+		if section.Name != "" {
+			buf.WriteString(" " + quoteUCI(section.Name))
+		}
+		buf.WriteString("\n")
+		for _, name := range section.order {
+			if option, exists := section.Options[name]; exists {
+				fmt.Fprintf(&buf, "\toption %s %s\n", name, quoteUCI(option))
+				continue
+			}
+			for _, entry := range section.Lists[name] {
+				fmt.Fprintf(&buf, "\tlist %s %s\n", name, quoteUCI(entry))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func quoteUCI(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// parseUCI reads a UCI package in the format of /etc/config files
+func parseUCI(data []byte) ([]*uciSection, error) {
+	var sections []*uciSection
+	var current *uciSection
+	for number, line := range strings.Split(string(data), "\n") {
+		words, err := splitUCILine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number+1, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "package":
+		case "config":
+			if len(words) < 2 || len(words) > 3 {
+				return nil, fmt.Errorf("line %d: expected config <type> [name]", number+1)
+			}
+			current = newUCISection(words[1], "")
+			if len(words) == 3 {
+				current.Name = words[2]
+			}
+			sections = append(sections, current)
+		case "option", "list":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: %s outside of a section", number+1, words[0])
+			}
+			if len(words) != 3 {
+				return nil, fmt.Errorf("line %d: expected %s <name> <value>", number+1, words[0])
+			}
+			if words[0] == "option" {
+				current.setOption(words[1], words[2])
+			} else {
+				current.addList(words[1], words[2])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %q", number+1, words[0])
+		}
+	}
+	return sections, nil
+}
+
+// splitUCILine splits a line into words the way uci does: quotes group words and adjacent quoted parts join,
+// single quotes take everything literally and a # outside quotes starts a comment
+func splitUCILine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#' && !inWord:
+			return words, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// startUCISync brings the config and its UCI package in line, the one changed last winning, and then follows the
+// changes committed to the package
+func (cm *ConfigManager) startUCISync() {
+	configInfo, configErr := os.Stat(cm.ConfigFilePath)
+	uciInfo, uciErr := os.Stat(cm.UCIFilePath)
+	if uciErr == nil && configErr == nil && uciInfo.ModTime().After(configInfo.ModTime()) {
+		cm.syncFromUCI()
+	} else {
+		cm.syncToUCI(cm.GetConfig())
+	}
+	go func() {
+		for {
+			time.Sleep(uciPollInterval)
+			cm.syncFromUCI()
+		}
+	}()
+}
+
+// syncToUCI writes the config to its UCI package, unless the package already holds it
+func (cm *ConfigManager) syncToUCI(config *Config) {
+	data := formatUCI(configToUCI(config))
+
+	cm.uciMu.Lock()
+	defer cm.uciMu.Unlock()
+	if current, err := os.ReadFile(cm.UCIFilePath); err == nil && bytes.Equal(current, data) {
+		cm.uciSynced = data
+		return
+	}
+	temp := cm.UCIFilePath + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		log.Printf("Warning: failed to write UCI config %s: %v", cm.UCIFilePath, err)
+		return
+	}
+	if err := os.Rename(temp, cm.UCIFilePath); err != nil {
+		os.Remove(temp)
+		log.Printf("Warning: failed to write UCI config %s: %v", cm.UCIFilePath, err)
+		return
+	}
+	cm.uciSynced = data
+}
+
+// syncFromUCI applies the UCI package to the config if it changed since it was last synced
+func (cm *ConfigManager) syncFromUCI() {
+	data, err := os.ReadFile(cm.UCIFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read UCI config %s: %v", cm.UCIFilePath, err)
+		}
+		return
+	}
+
+	cm.uciMu.Lock()
+	if bytes.Equal(data, cm.uciSynced) {
+		cm.uciMu.Unlock()
+		return
+	}
+	// Remembered even when invalid, so a broken package is reported once rather than on every poll
+	cm.uciSynced = data
+	cm.uciMu.Unlock()
+
+	sections, err := parseUCI(data)
+	if err != nil {
+		log.Printf("ERROR: Ignoring UCI config %s: %v", cm.UCIFilePath, err)
+		return
+	}
+	var applyErr error
+	err = cm.UpdateConfigAs("uci", func(config *Config) bool {
+		before, _ := config.Clone()
+		if applyErr = applyUCI(sections, config); applyErr != nil {
+			return false
+		}
+		return len(changedConfigFields(before, config)) > 0
+	})
+	if applyErr != nil {
+		log.Printf("ERROR: Ignoring UCI config %s: %v", cm.UCIFilePath, applyErr)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to apply UCI config %s: %v", cm.UCIFilePath, err)
+		return
+	}
+	log.Printf("Applied UCI config %s", cm.UCIFilePath)
+}
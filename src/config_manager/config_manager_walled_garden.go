@@ -0,0 +1,44 @@
+package config_manager
+
+import (
+	"slices"
+	"strings"
+)
+
+// WalledGardenHosts returns the hosts and IP networks customers reach before paying: the configured walled garden
+// and, if derived, the accepted mints, the relays and the LNURL servers of the Lightning addresses in use
+func (cm *ConfigManager) WalledGardenHosts() []string {
+	config := cm.GetConfig()
+	if config == nil {
+		return nil
+	}
+	hosts := append([]string{}, config.NDS.WalledGarden...)
+	if !config.NDS.DeriveWalledGarden {
+		return hosts
+	}
+
+	lightningAddresses := []string{config.ColdSweep.LightningAddress}
+	if identities := cm.GetIdentities(); identities != nil {
+		for _, identity := range identities.PublicIdentities {
+			lightningAddresses = append(lightningAddresses, identity.LightningAddress)
+		}
+	}
+	// A Lightning address user@domain is paid through the LNURL server at https://domain/.well-known/lnurlp/user
+	urls := make([]string, 0, len(config.AcceptedMints)+len(config.Relays)+len(lightningAddresses))
+	for _, mint := range config.AcceptedMints {
+		urls = append(urls, mint.URL)
+	}
+	urls = append(urls, config.Relays...)
+	for _, address := range lightningAddresses {
+		if _, domain, found := strings.Cut(address, "@"); found && domain != "" {
+			urls = append(urls, "https://"+domain)
+		}
+	}
+
+	for _, host := range urlHosts(urls) {
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,66 @@
+//go:build dev
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/internal/testenv"
+	"github.com/sirupsen/logrus"
+)
+
+// devEnv is the local relay and mint of the --dev mode, nil otherwise
+var devEnv *testenv.Env
+
+// devModeRequested reports whether the module was started with --dev, or with TOLLGATE_DEV set. Flags are parsed
+// in main, after init loaded the config, so the arguments are checked directly.
+func devModeRequested() bool {
+	if os.Getenv("TOLLGATE_DEV") != "" {
+		return true
+	}
+	for _, arg := range os.Args[1:] {
+		if arg == "--dev" || arg == "-dev" {
+			return true
+		}
+	}
+	return false
+}
+
+// startDevEnv starts a local relay and mint and writes a config using them, so the module runs on a development
+// machine without touching /etc/tollgate or public mints. The config goes to TOLLGATE_TEST_CONFIG_DIR, which
+// defaults to a directory in the temporary directory.
+func startDevEnv() {
+	env, err := testenv.Start(context.Background(), testenv.Options{})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to start the development relay and mint")
+	}
+	devEnv = env
+
+	dir := os.Getenv("TOLLGATE_TEST_CONFIG_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "tollgate-dev")
+		os.Setenv("TOLLGATE_TEST_CONFIG_DIR", dir)
+	}
+	if err := env.WriteConfig(dir); err != nil {
+		env.Close()
+		logrus.WithError(err).Fatal("Failed to write the development config")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"relay":      env.RelayURL,
+		"mint":       env.MintURL,
+		"config_dir": dir,
+	}).Info("Development mode, using a local relay and mint")
+}
+
+// stopDevEnv removes the relay and mint of the --dev mode
+func stopDevEnv() {
+	if devEnv == nil {
+		return
+	}
+	if err := devEnv.Close(); err != nil {
+		mainLogger.WithError(err).Error("Failed to stop the development relay and mint")
+	}
+}
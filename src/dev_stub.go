@@ -0,0 +1,28 @@
+//go:build !dev
+
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// devModeRequested refuses --dev and TOLLGATE_DEV, as the local relay and mint and their known keys are only
+// built into development binaries
+func devModeRequested() bool {
+	requested := os.Getenv("TOLLGATE_DEV") != ""
+	for _, arg := range os.Args[1:] {
+		if arg == "--dev" || arg == "-dev" {
+			requested = true
+		}
+	}
+	if requested {
+		logrus.Fatal("Development mode is not built in, rebuild with -tags dev")
+	}
+	return false
+}
+
+func startDevEnv() {}
+
+func stopDevEnv() {}
@@ -60,6 +60,83 @@ func TestEventValidation(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			description:    "Should reject events without device identifier",
 		},
+		{
+			name: "Zero-Value Access Probe",
+			event: nostr.Event{
+				Kind: 21000,
+				Tags: nostr.Tags{
+					nostr.Tag{"device-identifier", "mac", "00:11:22:33:44:55"},
+					nostr.Tag{"payment", ""},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusOK, // No session yet, answered with an informational quote
+			description:    "Should answer zero-value payments as access probes",
+		},
+		{
+			name: "Reservation Request",
+			event: nostr.Event{
+				Kind: 21021, // Reservation request kind
+				Tags: nostr.Tags{
+					nostr.Tag{"device-identifier", "mac", "00:11:22:33:44:66"},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusOK,
+			description:    "Should answer reservation requests with a reservation",
+		},
+		{
+			name: "Payment With Unknown Reservation",
+			event: nostr.Event{
+				Kind: 21000,
+				Tags: nostr.Tags{
+					nostr.Tag{"device-identifier", "mac", "00:11:22:33:44:66"},
+					nostr.Tag{"payment", "test_token"},
+					nostr.Tag{"reservation", "does-not-exist"},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusBadRequest,
+			description:    "Should reject payments referencing unknown reservations",
+		},
+		{
+			name: "Zap Purchase Request With Zaps Disabled",
+			event: nostr.Event{
+				Kind: 21024, // Zap purchase request
+				Tags: nostr.Tags{
+					nostr.Tag{"device-identifier", "mac", "00:11:22:33:44:55"},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusBadRequest,
+			description:    "Should reject zap purchases while zaps are disabled",
+		},
+		{
+			name: "Session Handoff With Handoff Disabled",
+			event: nostr.Event{
+				Kind: 21027, // Session handoff
+				Tags: nostr.Tags{
+					nostr.Tag{"device-identifier", "mac", "00:11:22:33:44:55"},
+					nostr.Tag{"proof", "{}"},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusBadRequest,
+			description:    "Should reject session handoffs unless the fleet enables them",
+		},
+		{
+			name: "Feedback From Unknown Customer",
+			event: nostr.Event{
+				Kind: 1985, // NIP-32 label event
+				Tags: nostr.Tags{
+					nostr.Tag{"L", "tollgate/rating"},
+					nostr.Tag{"l", "5", "tollgate/rating"},
+				},
+				PubKey: "02a7451395735369f2ecdfc829c0f774e88ef1303dfe5b2f04dbaab30a535dfdd6",
+			},
+			expectedStatus: http.StatusBadRequest,
+			description:    "Should reject ratings from pubkeys without a recent session",
+		},
 	}
 
 	for _, tt := range tests {
@@ -268,3 +345,82 @@ func TestMACAddressValidation(t *testing.T) {
 		})
 	}
 }
+
+// TestPricingJSON tests the machine-readable pricing endpoint
+func TestPricingJSON(t *testing.T) {
+	req, err := http.NewRequest("GET", "/.well-known/tollgate.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(main.HandlePricingJSON)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected application/json content type, got %q", contentType)
+	}
+
+	var response map[string]interface{}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal("Failed to parse response:", err)
+	}
+
+	for _, key := range []string{"metric", "step_size", "accepted_mints", "tiers"} {
+		if _, ok := response[key]; !ok {
+			t.Errorf("Expected %q in pricing response", key)
+		}
+	}
+
+	// Only GET is supported
+	req, err = http.NewRequest("POST", "/.well-known/tollgate.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code for POST: got %v want %v", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	req, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(main.HandleOpenAPI)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &spec); err != nil {
+		t.Fatal("Failed to parse OpenAPI document:", err)
+	}
+
+	if spec.OpenAPI == "" {
+		t.Error("Expected an openapi version")
+	}
+	// The document describes the admin commands, not the customer API
+	for _, path := range []string{"/status", "/wallet/balance", "/clients"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("Expected path %q in OpenAPI document", path)
+		}
+	}
+	if _, ok := spec.Paths["/"]; ok {
+		t.Error("Expected no customer API paths in OpenAPI document")
+	}
+}
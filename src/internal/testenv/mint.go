@@ -0,0 +1,120 @@
+//go:build dev
+
+package testenv
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// composeFile runs nutshell with the fake Lightning backend, which pays every mint quote
+//
+//go:embed docker-compose.yml
+var composeFile []byte
+
+// ErrNoMint is returned by Start when no mint is given and docker compose isn't available to start one
+var ErrNoMint = errors.New("no test mint: set " + MintURLEnv + " or install docker compose")
+
+// composeMint is a nutshell container managed with docker compose, in a project of its own so parallel test
+// runs don't share a mint
+type composeMint struct {
+	command []string // docker compose, as the plugin or the standalone tool
+	project string
+	dir     string // Holds the compose file
+	port    int
+	url     string
+}
+
+// composeCommand returns the docker compose command installed on the machine
+func composeCommand() ([]string, error) {
+	if exec.Command("docker", "compose", "version").Run() == nil {
+		return []string{"docker", "compose"}, nil
+	}
+	if exec.Command("docker-compose", "version").Run() == nil {
+		return []string{"docker-compose"}, nil
+	}
+	return nil, ErrNoMint
+}
+
+// startComposeMint starts nutshell on a host port, without waiting for it to answer
+func startComposeMint(ctx context.Context, port int) (*composeMint, error) {
+	command, err := composeCommand()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "tollgate-testenv")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compose directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), composeFile, 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to write compose file: %w", err)
+	}
+
+	mint := &composeMint{
+		command: command,
+		project: fmt.Sprintf("tollgate-testenv-%d", port),
+		dir:     dir,
+		port:    port,
+		url:     fmt.Sprintf("http://127.0.0.1:%d", port),
+	}
+	if err := mint.run(ctx, "up", "-d"); err != nil {
+		mint.stop()
+		return nil, err
+	}
+	return mint, nil
+}
+
+// run runs a docker compose command on the project of the mint
+func (c *composeMint) run(ctx context.Context, args ...string) error {
+	commandArgs := append([]string{}, c.command[1:]...)
+	commandArgs = append(commandArgs, "-p", c.project, "-f", filepath.Join(c.dir, "docker-compose.yml"))
+	cmd := exec.CommandContext(ctx, c.command[0], append(commandArgs, args...)...)
+	cmd.Env = append(os.Environ(),
+		"TOLLGATE_TESTENV_MINT_PORT="+strconv.Itoa(c.port),
+		"TOLLGATE_TESTENV_MINT_KEY="+MintKey,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("docker compose %s failed: %w (output: %s)", args[0], err, string(output))
+	}
+	return nil
+}
+
+// stop removes the container with its database, so the next run starts from an empty mint
+func (c *composeMint) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := c.run(ctx, "down", "-v")
+	os.RemoveAll(c.dir)
+	return err
+}
+
+// waitForMint polls the info endpoint of a mint until it answers
+func waitForMint(ctx context.Context, mintURL string) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, mintURL+"/v1/info", nil)
+		if err != nil {
+			return fmt.Errorf("invalid mint URL %s: %w", mintURL, err)
+		}
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mint %s did not answer: %w", mintURL, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,237 @@
+//go:build dev
+
+// Package testenv starts a local relay and mint with known keys, so integration tests and the --dev mode run
+// payment flows on any machine, without public relays or mints. The mint is a nutshell container with a fake
+// Lightning backend started with docker compose, unless a running mint is given.
+package testenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/relay"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut04"
+	"github.com/Origami74/gonuts-tollgate/wallet"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Known keys, so tests can check signatures and a dev setup keeps its identities across runs. Never use them
+// outside of tests.
+const (
+	// MerchantPrivateKey is the merchant identity written by WriteConfig
+	MerchantPrivateKey = "4b2a13a75c2644b2ebd1f1ac28c991d8538a1e2a913fc4ab0301dc679eb3b973"
+	// CustomerPrivateKey signs the events of the test customer
+	CustomerPrivateKey = "9221f65991ec2ad258bb7893abd3327d777aecafae545f01586fc0c353d87d72"
+	// MintKey seeds the keysets of the nutshell mint, so its keyset IDs are the same on every run
+	MintKey = "tollgate-testenv-mint"
+)
+
+// MintURLEnv names the environment variable pointing testenv at a running mint instead of starting one
+const MintURLEnv = "TOLLGATE_TEST_MINT_URL"
+
+const (
+	// mintStartTimeout bounds how long the mint may take to answer, including pulling the image on the first run
+	mintStartTimeout = 5 * time.Minute
+	// mintQuoteTimeout bounds how long the fake Lightning backend may take to pay a mint quote
+	mintQuoteTimeout = 30 * time.Second
+)
+
+// Options configures Start. The zero value starts a relay and a mint on free ports on localhost.
+type Options struct {
+	RelayAddr string // Listen address of the relay, empty picks a free port on localhost
+	MintURL   string // Running mint to use, empty falls back to MintURLEnv and then starts nutshell
+	MintPort  int    // Host port of the nutshell container, 0 picks a free port
+}
+
+// Env is a running relay and mint
+type Env struct {
+	RelayURL string
+	MintURL  string
+	Relay    *relay.PrivateRelay
+
+	relayServer *http.Server
+	mint        *composeMint // Nil unless Start started the mint
+}
+
+// Start starts the relay and the mint and waits until both answer. It returns ErrNoMint when no mint is given
+// and docker compose isn't available, which tests treat as a reason to skip.
+func Start(ctx context.Context, options Options) (*Env, error) {
+	env := &Env{}
+	if err := env.startRelay(options.RelayAddr); err != nil {
+		return nil, err
+	}
+
+	mintURL := options.MintURL
+	if mintURL == "" {
+		mintURL = os.Getenv(MintURLEnv)
+	}
+	if mintURL == "" {
+		port := options.MintPort
+		if port == 0 {
+			var err error
+			if port, err = freePort(); err != nil {
+				env.Close()
+				return nil, err
+			}
+		}
+		mint, err := startComposeMint(ctx, port)
+		if err != nil {
+			env.Close()
+			return nil, err
+		}
+		env.mint = mint
+		mintURL = mint.url
+	}
+	env.MintURL = strings.TrimSuffix(mintURL, "/")
+
+	waitCtx, cancel := context.WithTimeout(ctx, mintStartTimeout)
+	defer cancel()
+	if err := waitForMint(waitCtx, env.MintURL); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+// startRelay serves an in-memory relay accepting the TollGate event kinds
+func (e *Env) startRelay(addr string) error {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the test relay: %w", err)
+	}
+
+	e.Relay = relay.NewPrivateRelay()
+	e.relayServer = &http.Server{Handler: e.Relay.GetRelay()}
+	e.RelayURL = "ws://" + listener.Addr().String()
+	go e.relayServer.Serve(listener)
+	return nil
+}
+
+// Close stops the relay and removes the mint container with its data
+func (e *Env) Close() error {
+	var errs []error
+	if e.relayServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.relayServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop test relay: %w", err))
+		}
+	}
+	if e.mint != nil {
+		if err := e.mint.stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteConfig writes a config directory, as read with TOLLGATE_TEST_CONFIG_DIR, accepting only the test mint,
+// publishing to the test relay and signing as MerchantPrivateKey
+func (e *Env) WriteConfig(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	config := config_manager.NewDefaultConfig()
+	mint := config.AcceptedMints[0]
+	mint.URL = e.MintURL
+	config.AcceptedMints = []config_manager.MintConfig{mint}
+	config.Relays = []string{e.RelayURL}
+	if err := config_manager.SaveConfig(filepath.Join(dir, "config.json"), config); err != nil {
+		return fmt.Errorf("failed to write test config: %w", err)
+	}
+
+	identities := config_manager.NewDefaultIdentitiesConfig()
+	for i := range identities.OwnedIdentities {
+		if identities.OwnedIdentities[i].Name == "merchant" {
+			identities.OwnedIdentities[i].PrivateKey = MerchantPrivateKey
+		}
+	}
+	if err := config_manager.SaveIdentities(filepath.Join(dir, "identities.json"), identities); err != nil {
+		return fmt.Errorf("failed to write test identities: %w", err)
+	}
+	return nil
+}
+
+// Token mints ecash worth amount sats at the test mint, with a wallet kept in walletDir, and returns it
+// serialized as a cashu token
+func (e *Env) Token(amount uint64, walletDir string) (string, error) {
+	w, err := wallet.LoadWallet(wallet.Config{WalletPath: walletDir, CurrentMintURL: e.MintURL})
+	if err != nil {
+		return "", fmt.Errorf("failed to load test wallet: %w", err)
+	}
+	defer w.Shutdown()
+
+	if balance := w.GetBalanceByMints()[e.MintURL]; balance < amount {
+		quote, err := w.RequestMint(amount-balance, e.MintURL)
+		if err != nil {
+			return "", fmt.Errorf("failed to request mint quote: %w", err)
+		}
+		deadline := time.Now().Add(mintQuoteTimeout)
+		for {
+			state, err := w.MintQuoteState(quote.Quote)
+			if err != nil {
+				return "", fmt.Errorf("failed to check mint quote: %w", err)
+			}
+			if state.State == nut04.Paid {
+				break
+			}
+			if time.Now().After(deadline) {
+				return "", fmt.Errorf("test mint did not pay quote %s within %s", quote.Quote, mintQuoteTimeout)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		if _, err := w.MintTokens(quote.Quote); err != nil {
+			return "", fmt.Errorf("failed to mint: %w", err)
+		}
+	}
+
+	proofs, err := w.Send(amount, e.MintURL, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to take %d sats from test wallet: %w", amount, err)
+	}
+	token, err := cashu.NewTokenV4(proofs, e.MintURL, cashu.Sat, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+	return token.Serialize()
+}
+
+// PaymentEvent returns a payment of the test customer for a device, signed with CustomerPrivateKey
+func PaymentEvent(merchantPubkey, macAddress, token string) (nostr.Event, error) {
+	event := nostr.Event{
+		Kind:      21000,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", merchantPubkey},
+			{"device-identifier", "mac", macAddress},
+			{"payment", token},
+		},
+	}
+	if err := event.Sign(CustomerPrivateKey); err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to sign payment: %w", err)
+	}
+	return event, nil
+}
+
+// freePort returns a TCP port on localhost nothing listens on
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,103 @@
+//go:build dev
+
+package testenv
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// TestPaymentFlow pays with ecash from the test mint, the way a customer does, relays the payment event and
+// hands it to a merchant, which has to redeem the token, open a session and answer with a session event
+func TestPaymentFlow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	env, err := Start(ctx, Options{})
+	if errors.Is(err, ErrNoMint) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer env.Close()
+
+	dir := t.TempDir()
+	t.Setenv("TOLLGATE_TEST_CONFIG_DIR", dir)
+	if err := env.WriteConfig(dir); err != nil {
+		t.Fatalf("WriteConfig() failed: %v", err)
+	}
+	configManager, err := config_manager.NewConfigManager(filepath.Join(dir, "config.json"),
+		filepath.Join(dir, "install.json"), filepath.Join(dir, "identities.json"))
+	if err != nil {
+		t.Fatalf("failed to load test config: %v", err)
+	}
+	m, err := merchant.New(configManager)
+	if err != nil {
+		t.Fatalf("merchant.New() failed: %v", err)
+	}
+	defer m.Shutdown()
+
+	// Open the gate in bookkeeping only, the test machine's firewall is left alone
+	const mac = "00:00:5e:00:53:01"
+	valve.SetDryRun(mac, true)
+	defer valve.SetDryRun(mac, false)
+	defer valve.CloseGate(mac)
+
+	token, err := env.Token(64, filepath.Join(t.TempDir(), "customer"))
+	if err != nil {
+		t.Fatalf("Token() failed: %v", err)
+	}
+	merchantPubkey, _ := nostr.GetPublicKey(MerchantPrivateKey)
+	payment, err := PaymentEvent(merchantPubkey, mac, token)
+	if err != nil {
+		t.Fatalf("PaymentEvent() failed: %v", err)
+	}
+
+	relay, err := nostr.RelayConnect(ctx, env.RelayURL)
+	if err != nil {
+		t.Fatalf("failed to connect to test relay: %v", err)
+	}
+	defer relay.Close()
+	if err := relay.Publish(ctx, payment); err != nil {
+		t.Fatalf("test relay rejected the payment: %v", err)
+	}
+	events, err := relay.QuerySync(ctx, nostr.Filter{Kinds: []int{21000}, Tags: nostr.TagMap{"p": {merchantPubkey}}})
+	if err != nil || len(events) != 1 || events[0].ID != payment.ID {
+		t.Fatalf("payment not found on test relay: %v (%d events)", err, len(events))
+	}
+
+	session, err := m.PurchaseSession(*events[0])
+	if err != nil {
+		t.Fatalf("PurchaseSession() failed: %v", err)
+	}
+	if session.Kind != 1022 {
+		t.Fatalf("expected a session event, got kind %d: %s", session.Kind, session.Content)
+	}
+	if ok, err := session.CheckSignature(); !ok || err != nil || session.PubKey != merchantPubkey {
+		t.Errorf("session event is not signed by the merchant: %v", err)
+	}
+	allotment, err := strconv.ParseUint(session.Tags.GetFirst([]string{"allotment"}).Value(), 10, 64)
+	if err != nil || allotment == 0 {
+		t.Errorf("expected an allotment in the session event, got %v", session.Tags)
+	}
+
+	if status := m.GetSessionStatus(mac); !status.Active {
+		t.Errorf("expected an active session for %s, got %+v", mac, status)
+	}
+	if !valve.IsGateOpen(mac) {
+		t.Errorf("expected the gate of %s to be open", mac)
+	}
+	if received := m.GetBalanceByMint(env.MintURL); received == 0 || received > 64 {
+		t.Errorf("merchant received %d sats, want up to 64", received)
+	}
+}
@@ -16,6 +16,8 @@ type LNURLPayResponse struct {
 	MaxSendable int64  `json:"maxSendable"` // millisatoshis
 	MinSendable int64  `json:"minSendable"` // millisatoshis
 	Metadata    string `json:"metadata"`
+	AllowsNostr bool   `json:"allowsNostr"` // NIP-57: the service publishes zap receipts
+	NostrPubkey string `json:"nostrPubkey"` // NIP-57: key signing the zap receipts
 }
 
 // LNURLInvoiceResponse is the response containing the invoice
@@ -25,12 +27,12 @@ type LNURLInvoiceResponse struct {
 	Routes        []interface{} `json:"routes,omitempty"`
 }
 
-// GetInvoiceFromLightningAddress requests an invoice from a Lightning Address for a specific amount
-func GetInvoiceFromLightningAddress(lightningAddr string, amountSats uint64) (string, error) {
+// GetLNURLPayInfo fetches the LNURL-pay parameters of a Lightning Address
+func GetLNURLPayInfo(lightningAddr string) (*LNURLPayResponse, error) {
 	// 1. Parse the Lightning Address (user@domain.com)
 	parts := strings.Split(lightningAddr, "@")
 	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid Lightning Address format (expected user@domain.com): %s", lightningAddr)
+		return nil, fmt.Errorf("invalid Lightning Address format (expected user@domain.com): %s", lightningAddr)
 	}
 	username := parts[0]
 	domain := parts[1]
@@ -41,19 +43,29 @@ func GetInvoiceFromLightningAddress(lightningAddr string, amountSats uint64) (st
 	// 3. Make initial request to the Lightning Address service
 	resp, err := http.Get(wellKnownURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to make request to Lightning Address service: %w", err)
+		return nil, fmt.Errorf("failed to make request to Lightning Address service: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// 4. Parse the LNURL response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read Lightning Address response: %w", err)
+		return nil, fmt.Errorf("failed to read Lightning Address response: %w", err)
 	}
 
 	var lnurlPayResp LNURLPayResponse
 	if err := json.Unmarshal(body, &lnurlPayResp); err != nil {
-		return "", fmt.Errorf("failed to parse Lightning Address response: %w", err)
+		return nil, fmt.Errorf("failed to parse Lightning Address response: %w", err)
+	}
+
+	return &lnurlPayResp, nil
+}
+
+// GetInvoiceFromLightningAddress requests an invoice from a Lightning Address for a specific amount
+func GetInvoiceFromLightningAddress(lightningAddr string, amountSats uint64) (string, error) {
+	lnurlPayResp, err := GetLNURLPayInfo(lightningAddr)
+	if err != nil {
+		return "", err
 	}
 
 	// 5. Check if amount is within allowed range
@@ -99,3 +111,143 @@ func GetInvoiceFromLightningAddress(lightningAddr string, amountSats uint64) (st
 
 	return invoice.PR, nil
 }
+
+// InvoiceAmountMsat returns the amount encoded in the human-readable part of a BOLT11 invoice
+func InvoiceAmountMsat(invoice string) (uint64, error) {
+	invoice = strings.ToLower(strings.TrimSpace(invoice))
+	separator := strings.LastIndex(invoice, "1")
+	if !strings.HasPrefix(invoice, "ln") || separator < 0 {
+		return 0, fmt.Errorf("not a BOLT11 invoice")
+	}
+
+	// The human-readable part is "ln" + currency prefix + optional amount and multiplier
+	hrp := invoice[2:separator]
+	amountStart := strings.IndexAny(hrp, "0123456789")
+	if amountStart < 0 {
+		return 0, fmt.Errorf("invoice has no amount")
+	}
+	amount := hrp[amountStart:]
+
+	// Amounts without multiplier are in BTC, 1 BTC = 10^11 msat
+	msatPerUnit := map[byte]float64{'m': 1e8, 'u': 1e5, 'n': 1e2, 'p': 1e-1}
+	multiplier := float64(1e11)
+	if last := amount[len(amount)-1]; last < '0' || last > '9' {
+		var ok bool
+		if multiplier, ok = msatPerUnit[last]; !ok {
+			return 0, fmt.Errorf("invalid invoice amount multiplier %q", last)
+		}
+		amount = amount[:len(amount)-1]
+	}
+
+	value, err := strconv.ParseUint(amount, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid invoice amount %q: %w", amount, err)
+	}
+	if multiplier < 1 {
+		// Pico-bitcoin amounts must be whole millisatoshis
+		if value%10 != 0 {
+			return 0, fmt.Errorf("invoice amount %dp is not a whole millisatoshi", value)
+		}
+		return value / 10, nil
+	}
+	return value * uint64(multiplier), nil
+}
+
+// bech32Charset maps the characters of the bech32 data part to their 5-bit values
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// Sizes of the fixed parts of a BOLT11 data part, in 5-bit groups
+const (
+	invoiceTimestampGroups = 7
+	invoiceSignatureGroups = 104
+	bech32ChecksumGroups   = 6
+)
+
+// invoiceFieldDescriptionHash is the type of the h field, the SHA-256 of a description too long for the invoice
+const invoiceFieldDescriptionHash = 23
+
+// InvoiceDescriptionHash returns the description hash (h field) of a BOLT11 invoice, which a zap invoice commits
+// the zap request with (NIP-57). The bech32 checksum is verified, the node signature is not.
+func InvoiceDescriptionHash(invoice string) ([]byte, error) {
+	invoice = strings.ToLower(strings.TrimSpace(invoice))
+	separator := strings.LastIndex(invoice, "1")
+	if !strings.HasPrefix(invoice, "ln") || separator < 0 {
+		return nil, fmt.Errorf("not a BOLT11 invoice")
+	}
+
+	hrp := invoice[:separator]
+	data := make([]byte, len(invoice)-separator-1)
+	for i, c := range invoice[separator+1:] {
+		value := strings.IndexRune(bech32Charset, c)
+		if value < 0 {
+			return nil, fmt.Errorf("invalid invoice character %q", c)
+		}
+		data[i] = byte(value)
+	}
+	if bech32Polymod(hrp, data) != 1 {
+		return nil, fmt.Errorf("invalid invoice checksum")
+	}
+	if len(data) < invoiceTimestampGroups+invoiceSignatureGroups+bech32ChecksumGroups {
+		return nil, fmt.Errorf("invoice is too short")
+	}
+
+	fields := data[invoiceTimestampGroups : len(data)-invoiceSignatureGroups-bech32ChecksumGroups]
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("truncated invoice field")
+		}
+		fieldType := fields[0]
+		length := int(fields[1])<<5 | int(fields[2])
+		if len(fields) < 3+length {
+			return nil, fmt.Errorf("truncated invoice field")
+		}
+		// Fields of unexpected length are skipped, as BOLT11 requires
+		if fieldType == invoiceFieldDescriptionHash && length == 52 {
+			return groupsToBytes(fields[3 : 3+length])[:32], nil
+		}
+		fields = fields[3+length:]
+	}
+	return nil, fmt.Errorf("invoice has no description hash")
+}
+
+// bech32Polymod computes the bech32 checksum over the human-readable part and the data, 1 if it is valid
+func bech32Polymod(hrp string, data []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	values := make([]byte, 0, len(hrp)*2+1+len(data))
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	values = append(values, data...)
+
+	checksum := uint32(1)
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	return checksum
+}
+
+// groupsToBytes packs 5-bit groups into bytes, dropping the padding bits at the end
+func groupsToBytes(groups []byte) []byte {
+	bytes := make([]byte, 0, len(groups)*5/8)
+	var accumulator uint32
+	var bits uint
+	for _, group := range groups {
+		accumulator = accumulator<<5 | uint32(group)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			bytes = append(bytes, byte(accumulator>>bits))
+		}
+	}
+	return bytes
+}
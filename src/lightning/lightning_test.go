@@ -0,0 +1,57 @@
+package lightning
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// Invoices from the BOLT11 test vectors
+const (
+	// $24 for an entire list of things, with the description hashed
+	hashedDescriptionInvoice = "lnbc20m1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqscc6gd6ql3jrc5yzme8v4ntcewwz5cnw92tz0pc8qcuufvq7khhr8wpald05e92xw006sq94mg8v2ndf4sefvf9sygkshp5zfem29trqq2yxxz7"
+	// $3 for a cup of coffee, with the description in the invoice
+	plainDescriptionInvoice = "lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpuaztrnwngzn3kdzw5hydlzf03qdgm2hdq27cqv3agm2awhz5se903vruatfhq77w3ls4evs3ch9zw97j25emudupq63nyw24cg27h2rspfj9srp"
+	hashedDescription       = "One piece of chocolate cake, one icecream cone, one pickle, one slice of swiss cheese, one slice of salami, one lollypop, one piece of cherry pie, one sausage, one cupcake, and one slice of watermelon"
+)
+
+func TestInvoiceAmountMsat(t *testing.T) {
+	tests := []struct {
+		invoice string
+		want    uint64
+	}{
+		{hashedDescriptionInvoice, 2000000000},
+		{plainDescriptionInvoice, 250000000},
+	}
+	for _, tt := range tests {
+		got, err := InvoiceAmountMsat(tt.invoice)
+		if err != nil || got != tt.want {
+			t.Errorf("InvoiceAmountMsat() = %d, %v, want %d", got, err, tt.want)
+		}
+	}
+}
+
+func TestInvoiceDescriptionHash(t *testing.T) {
+	want := sha256.Sum256([]byte(hashedDescription))
+	got, err := InvoiceDescriptionHash(hashedDescriptionInvoice)
+	if err != nil {
+		t.Fatalf("InvoiceDescriptionHash() failed: %v", err)
+	}
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("InvoiceDescriptionHash() = %x, want %x", got, want)
+	}
+
+	if _, err := InvoiceDescriptionHash(plainDescriptionInvoice); err == nil {
+		t.Error("Expected an error for an invoice without description hash")
+	}
+
+	// A changed character breaks the checksum
+	tampered := []byte(hashedDescriptionInvoice)
+	tampered[60] = 'q'
+	if tampered[60] == hashedDescriptionInvoice[60] {
+		tampered[60] = 'p'
+	}
+	if _, err := InvoiceDescriptionHash(string(tampered)); err == nil {
+		t.Error("Expected an error for an invoice with a broken checksum")
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net" // Added for net.Interfaces()
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/chandler"
@@ -20,8 +22,11 @@ import (
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/janitor"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/relay"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/wireless_gateway_manager"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,6 +47,15 @@ var tollgateDetailsString string
 var merchantInstance merchant.MerchantInterface
 var cliServer *cli.CLIServer
 
+// profileMerchant is an additional merchant serving the customers of one gateway interface
+type profileMerchant struct {
+	name          string
+	configManager *config_manager.ConfigManager
+	merchant      merchant.MerchantInterface
+}
+
+var profileMerchants []*profileMerchant
+
 // getTollgatePaths returns the configuration file paths based on the environment.
 // If TOLLGATE_TEST_CONFIG_DIR is set, it uses paths within that directory for testing.
 // Otherwise, it defaults to /etc/tollgate.
@@ -75,12 +89,24 @@ func InitializeGlobalLogger(logLevel string) {
 		ForceColors:   true,
 	})
 
+	// Redact payment tokens and private keys logged by any module, through logrus or the standard logger
+	logrus.SetOutput(utils.NewRedactingWriter(os.Stderr))
+	log.SetOutput(utils.NewRedactingWriter(os.Stderr))
+	if utils.LogSecrets() {
+		logrus.Warnf("%s is set: tokens and private keys are logged unredacted, for development only", utils.LogSecretsEnv)
+	}
+
 	logrus.WithField("log_level", level.String()).Info("Global logger initialized")
 }
 
 func init() {
 	var err error
 
+	// Run against a local relay and mint with known keys, see internal/testenv
+	if devModeRequested() {
+		startDevEnv()
+	}
+
 	configPath, installPath, identitiesPath := getTollgatePaths()
 
 	configManager, err = config_manager.NewConfigManager(configPath, installPath, identitiesPath)
@@ -110,6 +136,12 @@ func init() {
 
 	merchantInstance.StartPayoutRoutine()
 
+	// Start the merchants of additional profiles, e.g. a staff network next to the guest network
+	initProfiles()
+
+	// Catch captive portal misconfigurations that keep gates from opening
+	valve.CheckNDSConfig(mainConfig.NDS)
+
 	// Initialize CLI server
 	initCLIServer()
 
@@ -123,6 +155,138 @@ func init() {
 	initCrowsnest()
 }
 
+func initProfiles() {
+	for _, profile := range mainConfig.Profiles {
+		if profile.Name == "" || strings.ContainsAny(profile.Name, `/\`) {
+			mainLogger.WithField("profile", profile.Name).Error("Skipping merchant profile with invalid name")
+			continue
+		}
+
+		configDir := profile.ConfigDir
+		if configDir == "" {
+			configDir = filepath.Join(filepath.Dir(configManager.ConfigFilePath), "profiles", profile.Name)
+		}
+		if err := os.MkdirAll(configDir, 0700); err != nil {
+			mainLogger.WithError(err).WithField("profile", profile.Name).Error("Failed to create profile directory")
+			continue
+		}
+
+		profileConfigManager, err := config_manager.NewConfigManager(filepath.Join(configDir, "config.json"),
+			configManager.InstallFilePath, filepath.Join(configDir, "identities.json"))
+		if err != nil {
+			mainLogger.WithError(err).WithField("profile", profile.Name).Error("Failed to load profile config")
+			continue
+		}
+
+		profileMerchantInstance, err := merchant.New(profileConfigManager)
+		if err != nil {
+			mainLogger.WithError(err).WithField("profile", profile.Name).Error("Failed to create profile merchant")
+			continue
+		}
+		profileMerchantInstance.StartPayoutRoutine()
+
+		profileMerchants = append(profileMerchants, &profileMerchant{
+			name:          profile.Name,
+			configManager: profileConfigManager,
+			merchant:      profileMerchantInstance,
+		})
+		mainLogger.WithFields(logrus.Fields{
+			"profile":   profile.Name,
+			"interface": profileConfigManager.GetConfig().NDS.GatewayInterface,
+		}).Info("Merchant profile ready")
+	}
+}
+
+// shutdown persists the sessions of all merchants, then stops the gate timers and removes traffic control,
+// closing the gates too if configured
+func shutdown() {
+	merchants := []merchant.MerchantInterface{merchantInstance}
+	for _, profile := range profileMerchants {
+		merchants = append(merchants, profile.merchant)
+	}
+	for _, merchantInstance := range merchants {
+		if merchantInstance == nil {
+			continue
+		}
+		if err := merchantInstance.Shutdown(); err != nil {
+			mainLogger.WithError(err).Error("Failed to shut down merchant")
+		}
+	}
+
+	valve.Shutdown(configManager.GetConfig().Shutdown.DeauthorizeGates)
+	if err := utils.FlushStateWrites(); err != nil {
+		mainLogger.WithError(err).Error("Failed to flush state before stopping")
+	}
+	stopDevEnv()
+}
+
+// merchantFor returns the merchant of the profile serving the interface a request arrived on,
+// or the main merchant if no profile serves it
+func merchantFor(r *http.Request) merchant.MerchantInterface {
+	if profile := profileFor(r); profile != nil {
+		return profile.merchant
+	}
+	return merchantInstance
+}
+
+// configFor returns the config of the merchant merchantFor selects
+func configFor(r *http.Request) *config_manager.Config {
+	if profile := profileFor(r); profile != nil {
+		return profile.configManager.GetConfig()
+	}
+	return configManager.GetConfig()
+}
+
+// profileFor returns the profile serving the interface a request arrived on, nil if none does
+func profileFor(r *http.Request) *profileMerchant {
+	if len(profileMerchants) == 0 {
+		return nil
+	}
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	iface := interfaceForAddr(localAddr)
+	if iface == "" {
+		return nil
+	}
+	for _, profile := range profileMerchants {
+		if profile.configManager.GetConfig().NDS.GatewayInterface == iface {
+			return profile
+		}
+	}
+	return nil
+}
+
+// interfaceForAddr returns the name of the local interface holding an address
+func interfaceForAddr(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifaceAddr := range addrs {
+			if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
 func initJanitor() {
 	janitorInstance, err := janitor.NewJanitor(configManager)
 	if err != nil {
@@ -134,6 +298,12 @@ func initJanitor() {
 }
 
 func initPrivateRelay() {
+	// Kinds notices are mirrored as for clients that don't read kind 21023 notices
+	if config := configManager.GetConfig(); config != nil && config.NoticeCompat.Enabled {
+		for _, kind := range config.NoticeCompat.MirrorKinds {
+			relay.TollGateKinds[kind] = true
+		}
+	}
 	go startPrivateRelayWithAutoRestart()
 	mainLogger.Info("Private relay initialization started")
 }
@@ -202,17 +372,9 @@ func startPrivateRelayWithAutoRestart() {
 	}
 }
 
+// getMacAddress looks up the MAC address leased an IP address in the DHCP lease table
 func getMacAddress(ipAddress string) (string, error) {
-	cmdIn := `cat /tmp/dhcp.leases | cut -f 2,3,4 -s -d" " | grep -i ` + ipAddress + ` | cut -f 1 -s -d" "`
-	commandOutput, err := exec.Command("sh", "-c", cmdIn).Output()
-
-	var commandOutputString = string(commandOutput)
-	if err != nil {
-		fmt.Println(err, "Error when getting client's mac address. Command output: "+commandOutputString)
-		return "nil", err
-	}
-
-	return strings.Trim(commandOutputString, "\n"), nil
+	return merchantInstance.ResolveMAC(ipAddress)
 }
 
 // CORS middleware to handle Cross-Origin Resource Sharing
@@ -239,6 +401,48 @@ func CorsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// CredentialedCorsMiddleware is CorsMiddleware for the endpoints that set or read the session cookie. Browsers
+// only send cookies cross-origin to an echoed origin, so the origin of a request is allowed instead of any.
+func CredentialedCorsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			CorsMiddleware(next)(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// setSessionCookie gives a browser the signed cookie of its device's session, so the portal can restore it
+// if the router restarts. Devices without a time-based session get none.
+func setSessionCookie(w http.ResponseWriter, merchantInstance merchant.MerchantInterface, mac string) {
+	value, expires, err := merchantInstance.IssueSessionCookie(mac)
+	if err != nil {
+		mainLogger.WithError(err).WithField("mac", mac).Debug("No session cookie issued")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     merchant.SessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Unix(expires, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	var ip = getIP(r)
 	var mac, err = getMacAddress(ip)
@@ -254,7 +458,228 @@ func handler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleDetails(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, merchantInstance.GetAdvertisement())
+	fmt.Fprint(w, merchantFor(r).GetAdvertisement())
+}
+
+// HandlePricingJSON serves the current pricing, accepted mints and tiers as plain JSON
+// so captive portal pages and non-nostr clients can render prices. A returning device
+// is told whether it gets the loyalty price on its next purchase.
+func HandlePricingJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	merchantInstance := merchantFor(r)
+	info := merchantInstance.GetPricingInfo()
+	if info.Loyalty != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if mac, err := merchantInstance.ResolveMAC(host); err == nil {
+			info.Loyalty = merchantInstance.GetLoyaltyInfo(mac)
+		}
+		// The answer depends on the caller
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(info)
+	if err != nil {
+		mainLogger.WithError(err).Error("Error encoding pricing response")
+	}
+}
+
+// HandleAdvertisement serves the current advertisement on the short link printed at the counter, which stays
+// the same when prices change
+func HandleAdvertisement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, merchantFor(r).GetAdvertisement())
+}
+
+// HandleHistory serves the rolling uptime and price history of the gateway as plain JSON
+func HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(merchantFor(r).GetHistory()); err != nil {
+		mainLogger.WithError(err).Error("Error encoding history response")
+	}
+}
+
+// HandleAdvertisementCode serves the current advertisement as QR payload and NDEF message for printing at the
+// counter. format=qr answers with the bare QR payload, e.g. to pipe into qrencode, format=ndef with the NDEF
+// message bytes to write to a tag.
+func HandleAdvertisementCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	code, err := merchantFor(r).GetAdvertisementCode()
+	if err != nil {
+		mainLogger.WithError(err).Error("Error encoding advertisement code")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	switch r.URL.Query().Get("format") {
+	case "qr":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, code.QR)
+	case "ndef":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(code.NDEF)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(code); err != nil {
+			mainLogger.WithError(err).Error("Error encoding advertisement code response")
+		}
+	}
+}
+
+// HandleSessionStatus serves the remaining time or data and the tier of the calling device's session as plain JSON,
+// so the captive portal status page can show a countdown. The device is resolved from the connection address only,
+// as forwarding headers would let anyone read the session of another device. A session cookie only restores the
+// session of the device it was issued to.
+func HandleSessionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	merchantInstance := merchantFor(r)
+	mac, err := merchantInstance.ResolveMAC(host)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		mainLogger.WithError(err).WithField("ip", host).Debug("Session status for unknown device")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Device not found, reconnect to the network and try again"})
+		return
+	}
+
+	// A session lost to a restart comes back from the cookie the browser got when paying
+	status := merchantInstance.GetSessionStatus(mac)
+	if cookie, err := r.Cookie(merchant.SessionCookieName); err == nil && !status.Active {
+		restored, err := merchantInstance.RestoreSessionFromCookie(cookie.Value, mac)
+		if err != nil {
+			mainLogger.WithError(err).WithField("mac", mac).Debug("Session cookie not restored")
+		} else {
+			mainLogger.WithField("mac", mac).Info("Restored session from cookie")
+			status = restored
+		}
+	}
+	if status.Active {
+		setSessionCookie(w, merchantInstance, mac)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		mainLogger.WithError(err).Error("Error encoding session status response")
+	}
+}
+
+// CardRedemption is the body of a card redemption, the code as printed on the card or read from its NFC tag
+type CardRedemption struct {
+	Card string `json:"card"`
+}
+
+// HandleCardRedemption redeems a pre-paid card for the calling device and answers with its session status.
+// Like the session status, the device is resolved from the connection address only.
+func HandleCardRedemption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	var redemption CardRedemption
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8192)).Decode(&redemption); err != nil || redemption.Card == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected a card code"})
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	merchantInstance := merchantFor(r)
+	mac, err := merchantInstance.ResolveMAC(host)
+	if err != nil {
+		mainLogger.WithError(err).WithField("ip", host).Debug("Card redemption from unknown device")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Device not found, reconnect to the network and try again"})
+		return
+	}
+
+	status, err := merchantInstance.RedeemCard(redemption.Card, mac)
+	if err != nil {
+		mainLogger.WithError(err).WithField("mac", mac).Info("Card redemption refused")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		mainLogger.WithError(err).Error("Error encoding card redemption response")
+	}
+}
+
+// HandlePaymentRequest takes the payment of an advertised NUT-18 payment request, posted by the paying wallet,
+// and answers with the session or notice event. The device is resolved from the connection address.
+func HandlePaymentRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	var payload merchant.PaymentRequestPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected a payment request payload"})
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	merchantInstance := merchantFor(r)
+	// Payments relayed from elsewhere name the device in their memo
+	mac, err := merchantInstance.ResolveMAC(host)
+	if err != nil {
+		mac = ""
+	}
+
+	responseEvent, err := merchantInstance.PayPaymentRequest(payload, mac)
+	if err != nil {
+		mainLogger.WithError(err).WithField("ip", host).Info("Payment request payment refused")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(responseEvent); err != nil {
+		mainLogger.WithError(err).Error("Error encoding payment request response")
+	}
 }
 
 // handleRootPost handles POST requests to the root endpoint
@@ -270,6 +695,9 @@ func HandleRootPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Customers of a profile's interface pay that profile's merchant
+	merchantInstance := merchantFor(r)
+
 	// Read the request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -310,17 +738,50 @@ func HandleRootPost(w http.ResponseWriter, r *http.Request) {
 		"pubkey":     event.PubKey,
 	}).Info("Parsed nostr event")
 
-	// Validate that this is a payment event (kind 21000)
-	if event.Kind != 21000 {
+	// Reject payments without the required proof-of-work before any wallet work
+	if event.Kind == 21000 {
+		if err := checkPaymentPoW(&event, r, configFor(r).PaymentPoW); err != nil {
+			mainLogger.WithError(err).WithField("remote_addr", r.RemoteAddr).Warn("Rejected payment without proof-of-work")
+			sendNoticeResponse(w, merchantInstance, http.StatusBadRequest, "error", "pow-insufficient", err.Error(), event.PubKey)
+			return
+		}
+	}
+
+	// Process a payment (kind 21000), a reservation request ahead of a payment, a zap purchase request,
+	// a session handoff between fleet gateways, a session cancellation, a session group join, a session attestation,
+	// customer feedback or an owner's signature of an emergency stop
+	var responseEvent *nostr.Event
+	switch event.Kind {
+	case 21000:
+		responseEvent, err = merchantInstance.PurchaseSession(event)
+	case merchant.KindReservationRequest:
+		responseEvent, err = merchantInstance.CreateReservation(event)
+	case merchant.KindZapPurchaseRequest:
+		responseEvent, err = merchantInstance.RequestZapPurchase(event)
+	case merchant.KindSessionExportRequest:
+		responseEvent, err = merchantInstance.ExportSession(event)
+	case merchant.KindSessionHandoff:
+		responseEvent, err = merchantInstance.ImportSession(event)
+	case merchant.KindSessionCancel:
+		responseEvent, err = merchantInstance.CancelSession(event)
+	case merchant.KindSessionGroupJoin:
+		responseEvent, err = merchantInstance.JoinSessionGroup(event)
+	case merchant.KindSessionAttestation:
+		responseEvent, err = merchantInstance.AttestSession(event)
+	case merchant.KindFeedback:
+		responseEvent, err = merchantInstance.SubmitFeedback(event)
+	case merchant.KindEmergencyStop:
+		responseEvent, err = merchantInstance.SubmitEmergencyStop(event)
+	default:
 		mainLogger.WithField("kind", event.Kind).Error("Invalid event kind, expected 21000")
 		sendNoticeResponse(w, merchantInstance, http.StatusBadRequest, "error", "invalid-event",
-			fmt.Sprintf("Invalid event kind: %d, expected 21000", event.Kind), event.PubKey)
+			fmt.Sprintf("Invalid event kind: %d, expected 21000, %d, %d, %d, %d, %d, %d, %d, %d or %d", event.Kind,
+				merchant.KindReservationRequest, merchant.KindZapPurchaseRequest, merchant.KindSessionExportRequest,
+				merchant.KindSessionHandoff, merchant.KindSessionCancel, merchant.KindSessionGroupJoin,
+				merchant.KindSessionAttestation, merchant.KindFeedback, merchant.KindEmergencyStop), event.PubKey)
 		return
 	}
 
-	// Process payment and get session event
-	responseEvent, err := merchantInstance.PurchaseSession(event)
-
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
 
@@ -331,13 +792,31 @@ func HandleRootPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients that don't read notices get copies in the forms their request advertises
+	merchantInstance.MirrorNotice(event, responseEvent)
+
 	// Check if the response is a notice event (kind 21023) or session event (kind 1022)
-	if responseEvent.Kind == 21023 {
-		// It's a notice event (error case), return with appropriate status
-		w.WriteHeader(http.StatusBadRequest)
+	if responseEvent.Kind == merchant.KindNotice && getNoticeLevel(responseEvent) != "info" {
+		// It's a notice event (error case), return with appropriate status. Busy notices tell when to retry.
+		if retryAfter := getNoticeTag(responseEvent, "retry-after"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		err = json.NewEncoder(w).Encode(responseEvent)
 	} else {
-		// It's a session event (success case), return with OK status
+		// It's a session event or informational notice (success case), return with OK status.
+		// Browsers paying through the portal keep the session in a cookie.
+		if event.Kind == 21000 && responseEvent.Kind == 1022 {
+			host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+			if splitErr != nil {
+				host = r.RemoteAddr
+			}
+			if mac, resolveErr := merchantInstance.ResolveMAC(host); resolveErr == nil {
+				setSessionCookie(w, merchantInstance, mac)
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 		err = json.NewEncoder(w).Encode(responseEvent)
 	}
@@ -348,6 +827,60 @@ func HandleRootPost(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// checkPaymentPoW verifies the NIP-13 proof-of-work of a payment event. The difficulty must be committed
+// in the nonce tag, so IDs that are short by luck don't pass.
+func checkPaymentPoW(event *nostr.Event, r *http.Request, config config_manager.PaymentPoWConfig) error {
+	if config.MinDifficulty <= 0 {
+		return nil
+	}
+	if !config.RequireOnLAN && !isPublicSource(r) {
+		return nil
+	}
+
+	if committed := nip13.CommittedDifficulty(event); committed < config.MinDifficulty {
+		return fmt.Errorf("payment requires proof-of-work of %d bits committed in a nonce tag, got %d", config.MinDifficulty, committed)
+	}
+	// The ID is client supplied, the difficulty counts for the ID the content hashes to
+	if err := nip13.Check(event.GetID(), config.MinDifficulty); err != nil {
+		return fmt.Errorf("payment requires proof-of-work of %d bits: %w", config.MinDifficulty, err)
+	}
+	return nil
+}
+
+// isPublicSource reports whether a request comes from outside the local networks. It looks at the
+// connection address only, as forwarding headers can be set by anyone.
+func isPublicSource(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// getNoticeLevel returns the level tag of a notice event
+func getNoticeLevel(noticeEvent *nostr.Event) string {
+	for _, tag := range noticeEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "level" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// getNoticeTag returns the value of a tag of a notice event, "" if it has none
+func getNoticeTag(noticeEvent *nostr.Event, name string) string {
+	for _, tag := range noticeEvent.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
 // sendNoticeResponse creates and sends a notice event response
 func sendNoticeResponse(w http.ResponseWriter, merchantInstance merchant.MerchantInterface, statusCode int, level, code, message, customerPubkey string) {
 	noticeEvent, err := merchantInstance.CreateNoticeEvent(level, code, message, customerPubkey)
@@ -382,7 +915,47 @@ func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit / endpoint")
 
-		CorsMiddleware(HandleRoot)(w, r)
+		CredentialedCorsMiddleware(HandleRoot)(w, r)
+	})
+
+	http.HandleFunc("/.well-known/tollgate.json", func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /.well-known/tollgate.json endpoint")
+		CorsMiddleware(HandlePricingJSON)(w, r)
+	})
+
+	http.HandleFunc(merchant.AdvertisementPath, func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /ad endpoint")
+		CorsMiddleware(HandleAdvertisement)(w, r)
+	})
+
+	http.HandleFunc(merchant.AdvertisementPath+"/code", func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /ad/code endpoint")
+		CorsMiddleware(HandleAdvertisementCode)(w, r)
+	})
+
+	http.HandleFunc(merchant.HistoryPath, func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /history endpoint")
+		CorsMiddleware(HandleHistory)(w, r)
+	})
+
+	http.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /session endpoint")
+		CredentialedCorsMiddleware(HandleSessionStatus)(w, r)
+	})
+
+	http.HandleFunc("/card", func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /card endpoint")
+		CorsMiddleware(HandleCardRedemption)(w, r)
+	})
+
+	http.HandleFunc(merchant.PaymentRequestPath, func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /payment-request endpoint")
+		CorsMiddleware(HandlePaymentRequest)(w, r)
+	})
+
+	http.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		mainLogger.WithField("remote_addr", r.RemoteAddr).Debug("Hit /openapi.json endpoint")
+		CorsMiddleware(HandleOpenAPI)(w, r)
 	})
 
 	http.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
@@ -390,6 +963,16 @@ func main() {
 		CorsMiddleware(handler)(w, r)
 	})
 
+	// Persist sessions, write batched state to flash and clean up the gates when the service is stopped
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		mainLogger.WithField("signal", sig.String()).Info("Stopping, saving sessions and cleaning up gates")
+		shutdown()
+		os.Exit(0)
+	}()
+
 	mainLogger.Info("Starting HTTP server on all interfaces...")
 	server := &http.Server{
 		Addr: port,
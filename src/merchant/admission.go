@@ -0,0 +1,49 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// admission is the outcome of checking the radio link of a purchasing client
+type admission struct {
+	downTier  bool // Weak signal, the client gets the lowest tier
+	signalDBm int
+}
+
+// checkAdmission rejects purchases from wireless clients whose link is too weak to serve without
+// dragging down airtime for everyone, and down-tiers those close to the limit.
+// Clients hostapd doesn't know, e.g. wired ones, and failures to read the metrics are admitted.
+func (m *Merchant) checkAdmission(macAddress string) (admission, error) {
+	config := m.getConfig().Admission
+	if !config.Enabled {
+		return admission{}, nil
+	}
+
+	station, found, err := valve.GetStationMetrics(macAddress)
+	if err != nil {
+		log.Printf("Warning: failed to read station metrics of %s, admitting it: %v", macAddress, err)
+		return admission{}, nil
+	}
+	if !found {
+		return admission{}, nil
+	}
+
+	if config.MinSignalDBm != 0 && station.SignalDBm < config.MinSignalDBm {
+		return admission{}, fmt.Errorf("Your signal is too weak (%d dBm, at least %d dBm needed), please move closer to the access point and try again",
+			station.SignalDBm, config.MinSignalDBm)
+	}
+	if config.MinTxRateMbps != 0 && station.TxRateKbps < config.MinTxRateMbps*1000 {
+		return admission{}, fmt.Errorf("Your connection is too slow (%d Mbit/s, at least %d Mbit/s needed), please move closer to the access point and try again",
+			station.TxRateKbps/1000, config.MinTxRateMbps)
+	}
+
+	result := admission{signalDBm: station.SignalDBm}
+	if config.DownTierSignalDBm != 0 && station.SignalDBm < config.DownTierSignalDBm {
+		log.Printf("Signal of %s on %s is weak (%d dBm), down-tiering its purchase", macAddress, station.Interface, station.SignalDBm)
+		result.downTier = true
+	}
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package merchant
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// advertisementCodePrefix starts the QR payload of the advertisement, followed by the deflated advertisement
+// event in base32. Upper case only, so QR encoders use the denser alphanumeric mode.
+const advertisementCodePrefix = "TOLLGATE:AD:"
+
+// AdvertisementPath is where the portal serves the current advertisement, the short link printed at the counter
+const AdvertisementPath = "/ad"
+
+// ndefAdvertisementType is the MIME type of the NDEF record carrying the deflated advertisement event
+const ndefAdvertisementType = "application/vnd.tollgate.advertisement"
+
+var advertisementCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// AdvertisementCode is the advertisement in the forms printed at the counter: a QR payload wallets decode without
+// a connection, NDEF message bytes to write to an NFC tag and a short link to the portal for any other reader
+type AdvertisementCode struct {
+	QR        string `json:"qr"`
+	NDEF      []byte `json:"ndef"`                // NDEF message, a URI record with the short link followed by the advertisement
+	ShortURL  string `json:"short_url,omitempty"` // Empty if the gateway interface has no IPv4 address and no base URL is configured
+	CreatedAt int64  `json:"created_at"`          // When the advertisement was last signed, codes printed before show older prices
+}
+
+// GetAdvertisementCode returns the codes of the current advertisement, regenerated whenever it changes
+func (m *Merchant) GetAdvertisementCode() (AdvertisementCode, error) {
+	m.advertisementMu.RLock()
+	code := m.advertisementCode
+	m.advertisementMu.RUnlock()
+	if code.QR == "" {
+		return code, fmt.Errorf("no advertisement yet")
+	}
+	return code, nil
+}
+
+// newAdvertisementCode encodes a signed advertisement event for printing
+func newAdvertisementCode(config *config_manager.Config, advertisement string) (AdvertisementCode, error) {
+	compressed, err := deflate([]byte(advertisement))
+	if err != nil {
+		return AdvertisementCode{}, fmt.Errorf("failed to compress advertisement: %w", err)
+	}
+
+	code := AdvertisementCode{
+		QR:        advertisementCodePrefix + advertisementCodeEncoding.EncodeToString(compressed),
+		ShortURL:  advertisementURL(config),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	var records [][]byte
+	if code.ShortURL != "" {
+		records = append(records, ndefURIRecord(code.ShortURL))
+	}
+	records = append(records, ndefRecord(ndefTNFMedia, []byte(ndefAdvertisementType), compressed))
+	code.NDEF = ndefMessage(records)
+	return code, nil
+}
+
+// DecodeAdvertisementCode returns the advertisement event of a QR payload
+func DecodeAdvertisementCode(qr string) (string, error) {
+	encoded, found := strings.CutPrefix(strings.TrimSpace(qr), advertisementCodePrefix)
+	if !found {
+		return "", fmt.Errorf("not a TollGate advertisement code")
+	}
+	compressed, err := advertisementCodeEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("damaged advertisement code: %w", err)
+	}
+	advertisement, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("damaged advertisement code: %w", err)
+	}
+	return string(advertisement), nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// advertisementURL returns the short link to the advertisement, on the configured base URL or the address
+// of the gateway interface
+func advertisementURL(config *config_manager.Config) string {
+	if base := strings.TrimSuffix(config.AdvertisementCode.BaseURL, "/"); base != "" {
+		return base + AdvertisementPath
+	}
+	return gatewayURL(config, AdvertisementPath)
+}
+
+// gatewayURL returns the URL of a path on the portal at the IPv4 address of the gateway interface, which stays
+// the same as long as the LAN isn't renumbered. Empty if the interface has no IPv4 address.
+func gatewayURL(config *config_manager.Config, path string) string {
+	iface, err := net.InterfaceByName(config.NDS.GatewayInterface)
+	if err != nil {
+		return ""
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return fmt.Sprintf("http://%s:%d%s", ipNet.IP, config.NDS.ProtocolPort, path)
+		}
+	}
+	return ""
+}
+
+// Type name formats of NDEF records
+const (
+	ndefTNFWellKnown = 0x01
+	ndefTNFMedia     = 0x02
+)
+
+// ndefURIPrefixes are the abbreviations of URI records, by their identifier code
+var ndefURIPrefixes = []struct {
+	code   byte
+	prefix string
+}{
+	{0x04, "https://"},
+	{0x03, "http://"},
+}
+
+// ndefURIRecord returns a well-known URI record, its scheme abbreviated
+func ndefURIRecord(uri string) []byte {
+	payload := []byte{0x00}
+	for _, abbreviation := range ndefURIPrefixes {
+		if rest, found := strings.CutPrefix(uri, abbreviation.prefix); found {
+			payload = []byte{abbreviation.code}
+			uri = rest
+			break
+		}
+	}
+	return ndefRecord(ndefTNFWellKnown, []byte("U"), append(payload, uri...))
+}
+
+// ndefRecord returns a record without its message begin and end flags, which ndefMessage sets
+func ndefRecord(tnf byte, recordType, payload []byte) []byte {
+	header := tnf
+	var length []byte
+	if len(payload) < 256 {
+		header |= 0x10 // Short record
+		length = []byte{byte(len(payload))}
+	} else {
+		length = binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	}
+
+	record := []byte{header, byte(len(recordType))}
+	record = append(record, length...)
+	record = append(record, recordType...)
+	return append(record, payload...)
+}
+
+// ndefMessage joins records into a message, flagging the first and the last
+func ndefMessage(records [][]byte) []byte {
+	var message []byte
+	for i, record := range records {
+		if i == 0 {
+			record[0] |= 0x80
+		}
+		if i == len(records)-1 {
+			record[0] |= 0x40
+		}
+		message = append(message, record...)
+	}
+	return message
+}
@@ -0,0 +1,181 @@
+package merchant
+
+import (
+	"math"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+func TestStepAllotment(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     uint64
+		stepSize  uint64
+		want      uint64
+		wantError bool
+	}{
+		{"one step", 1, 60000, 60000, false},
+		{"several steps", 21, 60000, 1260000, false},
+		{"no steps", 0, 60000, 0, false},
+		{"largest product", 1 << 32, 1<<32 - 1, 1<<64 - 1<<32, false},
+		{"overflow", 1 << 32, 1 << 32, 0, true},
+		{"max steps overflow", math.MaxUint64, 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stepAllotment(tt.steps, tt.stepSize)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("Expected an overflow error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stepAllotment returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProRataAllotment(t *testing.T) {
+	tests := []struct {
+		name         string
+		amount       uint64
+		stepSize     uint64
+		pricePerStep uint64
+		want         uint64
+		wantError    bool
+	}{
+		{"whole steps", 20, 60000, 10, 120000, false},
+		{"partial step", 25, 60000, 10, 150000, false},
+		{"below one step", 3, 60000, 10, 18000, false},
+		// The product overflows 64 bits but the quotient fits
+		{"wide product", math.MaxUint64, 4, 8, math.MaxUint64 / 2, false},
+		{"large data step", 1 << 40, 1 << 30, 1 << 20, 1 << 50, false},
+		{"overflow", math.MaxUint64, 60000, 1, 0, true},
+		{"overflow at quotient limit", 1 << 63, 4, 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proRataAllotment(tt.amount, tt.stepSize, tt.pricePerStep)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("Expected an overflow error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proRataAllotment returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAllotmentForMint(t *testing.T) {
+	m := newTestMerchant(t)
+
+	tests := []struct {
+		name      string
+		metric    string
+		stepSize  uint64
+		proRata   bool
+		mint      config_manager.MintConfig
+		amount    uint64
+		want      uint64
+		wantError bool
+	}{
+		{"global step size", "milliseconds", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10}, 25, 120000, false},
+		{"mint step size", "milliseconds", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10, StepSize: 30000}, 25, 60000, false},
+		{"pro-rata with mint step size", "milliseconds", 60000, true,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10, StepSize: 30000}, 25, 75000, false},
+		{"mint metric", "milliseconds", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 1, Metric: "bytes", StepSize: 1 << 20}, 3, 3 << 20, false},
+		{"below minimum steps", "milliseconds", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10, MinPurchaseSteps: 3}, 25, 0, true},
+		{"no price", "milliseconds", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example"}, 25, 0, true},
+		{"unsupported metric", "packets", 60000, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10}, 25, 0, true},
+		{"overflow", "bytes", math.MaxUint64, false,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 1}, 2, 0, true},
+		{"pro-rata overflow", "bytes", math.MaxUint64, true,
+			config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 1}, 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *m.getConfig()
+			config.Metric = tt.metric
+			config.StepSize = tt.stepSize
+			config.Pricing.ProRata = tt.proRata
+
+			got, err := m.allotmentForMint(&config, tt.mint, tt.amount, false)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("allotmentForMint returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestZapAllotmentMatchesMintAllotment(t *testing.T) {
+	m := newTestMerchant(t)
+
+	tests := []struct {
+		name    string
+		metric  string
+		proRata bool
+		amount  uint64
+	}{
+		{"whole steps", "milliseconds", false, 30},
+		{"remainder dropped", "milliseconds", false, 35},
+		{"pro-rata remainder", "milliseconds", true, 35},
+		{"data metric", "bytes", false, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *m.getConfig()
+			config.Metric = tt.metric
+			config.StepSize = 60000
+			config.Pricing.ProRata = tt.proRata
+			config.Zaps.PricePerStep = 10
+			config.Zaps.MinPurchaseSteps = 1
+
+			zap, err := m.allotmentForMint(&config, zapMintConfig(&config), tt.amount, false)
+			if err != nil {
+				t.Fatalf("allotmentForMint returned error for a zap: %v", err)
+			}
+			mint := config_manager.MintConfig{URL: "https://mint.example", PricePerStep: 10, MinPurchaseSteps: 1}
+			paid, err := m.allotmentForMint(&config, mint, tt.amount, false)
+			if err != nil {
+				t.Fatalf("allotmentForMint returned error for a mint: %v", err)
+			}
+			if zap != paid {
+				t.Errorf("Expected a zap to buy what the same sats buy at a mint, got %d and %d", zap, paid)
+			}
+		})
+	}
+
+	config := *m.getConfig()
+	config.StepSize = math.MaxUint64
+	config.Zaps.PricePerStep = 1
+	if allotment, err := m.allotmentForMint(&config, zapMintConfig(&config), 2, false); err == nil {
+		t.Errorf("Expected an overflowing zap to be refused, got %d", allotment)
+	}
+}
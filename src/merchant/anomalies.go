@@ -0,0 +1,393 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// anomalyReportPollInterval is how often the hour of the daily report is checked
+const anomalyReportPollInterval = 10 * time.Minute
+
+// anomalyMinPayments is how many payments the average needs before payments are compared with it
+const anomalyMinPayments = 20
+
+// Kinds of anomalies
+const (
+	AnomalyPurchaseSpike     = "purchase-spike"
+	AnomalyFailedRedemptions = "failed-redemptions"
+	AnomalyLargePayment      = "large-payment"
+)
+
+// purchaseEntries are the ledger entries of customers paying
+var purchaseEntries = map[string]bool{LedgerPayment: true, LedgerService: true, LedgerUpgrade: true, LedgerSubscription: true}
+
+// anomalyFlag is one anomaly, kept for the next daily report
+type anomalyFlag struct {
+	Kind    string `json:"kind"`
+	Pubkey  string `json:"pubkey,omitempty"` // Empty for anomalies of all customers
+	MintURL string `json:"mint_url,omitempty"`
+	Amount  uint64 `json:"amount,omitempty"`
+	Detail  string `json:"detail"`
+	At      int64  `json:"at"`
+}
+
+// anomalyStore is what the next daily report covers, persisted as JSON next to the wallet
+type anomalyStore struct {
+	Since          int64             `json:"since"`        // Start of the period the next report covers
+	ReportedDay    string            `json:"reported_day"` // Local date of the last report
+	Purchases      uint64            `json:"purchases"`
+	Revenue        uint64            `json:"revenue"`  // In sats
+	Failures       uint64            `json:"failures"` // Failed token redemptions
+	FailuresByMint map[string]uint64 `json:"failures_by_mint"`
+	Flags          []anomalyFlag     `json:"flags"`
+	PaymentCount   uint64            `json:"payment_count"` // Every payment seen, for the average payment
+	PaymentTotal   uint64            `json:"payment_total"`
+}
+
+// anomalies counts purchases and failed redemptions to flag the unusual ones
+type anomalies struct {
+	mu          sync.Mutex
+	path        string
+	store       anomalyStore
+	purchases   map[string][]int64 // Recent purchase times by pubkey
+	failures    map[string][]int64 // Recent failure times by pubkey
+	allFailures []int64
+	flagged     map[string]int64 // Kind and pubkey already flagged, until when
+}
+
+func newAnomalies(path string) *anomalies {
+	a := &anomalies{
+		path:      path,
+		purchases: make(map[string][]int64),
+		failures:  make(map[string][]int64),
+		flagged:   make(map[string]int64),
+	}
+	data, err := utils.ReadState(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to read anomaly counters %s: %v", path, err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &a.store); err != nil {
+			log.Printf("Warning: failed to parse anomaly counters %s, starting empty: %v", path, err)
+			a.store = anomalyStore{}
+		}
+	}
+	if a.store.FailuresByMint == nil {
+		a.store.FailuresByMint = make(map[string]uint64)
+	}
+	if a.store.Since == 0 {
+		a.store.Since = time.Now().Unix()
+	}
+	return a
+}
+
+// recentTimes returns the times after since, appending now
+func recentTimes(times []int64, since, now int64) []int64 {
+	recent := times[:0]
+	for _, at := range times {
+		if at > since {
+			recent = append(recent, at)
+		}
+	}
+	return append(recent, now)
+}
+
+// flag records an anomaly unless the same kind was flagged for the pubkey within the window. Caller must hold mu.
+func (a *anomalies) flag(flag anomalyFlag, window int64) bool {
+	key := flag.Kind + ":" + flag.Pubkey
+	if a.flagged[key] > flag.At {
+		return false
+	}
+	a.flagged[key] = flag.At + window
+	a.store.Flags = append(a.store.Flags, flag)
+	return true
+}
+
+// observePurchase counts a purchase and returns the anomalies it raised
+func (a *anomalies) observePurchase(entry LedgerEntry, config config_manager.AnomaliesConfig, now time.Time) []anomalyFlag {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	window := int64(config.WindowSeconds)
+	at := now.Unix()
+	var flags []anomalyFlag
+
+	if entry.Pubkey != "" {
+		a.purchases[entry.Pubkey] = recentTimes(a.purchases[entry.Pubkey], at-window, at)
+		count := len(a.purchases[entry.Pubkey])
+		if config.PurchasesPerPubkey > 0 && count >= config.PurchasesPerPubkey {
+			flag := anomalyFlag{Kind: AnomalyPurchaseSpike, Pubkey: entry.Pubkey, At: at,
+				Detail: fmt.Sprintf("%d purchases within %s", count, time.Duration(window)*time.Second)}
+			if a.flag(flag, window) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	// Compared with the average before this payment counts into it
+	large := config.LargePaymentSats > 0 && entry.Amount >= config.LargePaymentSats
+	if config.LargePaymentFactor > 0 && a.store.PaymentCount >= anomalyMinPayments {
+		average := a.store.PaymentTotal / a.store.PaymentCount
+		large = large || entry.Amount > average*config.LargePaymentFactor
+	}
+	if large {
+		flag := anomalyFlag{Kind: AnomalyLargePayment, Pubkey: entry.Pubkey, MintURL: entry.MintURL, Amount: entry.Amount, At: at,
+			Detail: fmt.Sprintf("%s of %d sats at %s, the average payment is %d sats", entry.Type, entry.Amount, entry.MintURL, a.averagePayment())}
+		// Every large payment is worth a look, so they aren't held back by the window
+		if a.flag(flag, 0) {
+			flags = append(flags, flag)
+		}
+	}
+
+	a.store.Purchases++
+	a.store.Revenue += entry.Amount
+	a.store.PaymentCount++
+	a.store.PaymentTotal += entry.Amount
+	a.save()
+	return flags
+}
+
+// averagePayment returns the average payment in sats. Caller must hold mu.
+func (a *anomalies) averagePayment() uint64 {
+	if a.store.PaymentCount == 0 {
+		return 0
+	}
+	return a.store.PaymentTotal / a.store.PaymentCount
+}
+
+// observeFailure counts a failed token redemption and returns the anomalies it raised
+func (a *anomalies) observeFailure(pubkey, mintURL string, config config_manager.AnomaliesConfig, now time.Time) []anomalyFlag {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	window := int64(config.WindowSeconds)
+	at := now.Unix()
+	var flags []anomalyFlag
+
+	if pubkey != "" {
+		a.failures[pubkey] = recentTimes(a.failures[pubkey], at-window, at)
+		count := len(a.failures[pubkey])
+		if config.FailuresPerPubkey > 0 && count >= config.FailuresPerPubkey {
+			flag := anomalyFlag{Kind: AnomalyFailedRedemptions, Pubkey: pubkey, MintURL: mintURL, At: at,
+				Detail: fmt.Sprintf("%d failed token redemptions within %s", count, time.Duration(window)*time.Second)}
+			if a.flag(flag, window) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	a.allFailures = recentTimes(a.allFailures, at-window, at)
+	if config.Failures > 0 && len(a.allFailures) >= config.Failures {
+		flag := anomalyFlag{Kind: AnomalyFailedRedemptions, MintURL: mintURL, At: at,
+			Detail: fmt.Sprintf("%d failed token redemptions of all customers within %s", len(a.allFailures), time.Duration(window)*time.Second)}
+		if a.flag(flag, window) {
+			flags = append(flags, flag)
+		}
+	}
+
+	a.store.Failures++
+	if mintURL != "" {
+		a.store.FailuresByMint[mintURL]++
+	}
+	a.save()
+	return flags
+}
+
+// takeReport returns what the report covers and starts a new period, unless the report of the day was taken
+func (a *anomalies) takeReport(day string, now time.Time) (anomalyStore, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.store.ReportedDay == day {
+		return anomalyStore{}, false
+	}
+	report := a.store
+	// Windows are shorter than a day, so what is a day old is forgotten
+	stale := now.Add(-24 * time.Hour).Unix()
+	for _, times := range []map[string][]int64{a.purchases, a.failures} {
+		for pubkey, at := range times {
+			if at[len(at)-1] < stale {
+				delete(times, pubkey)
+			}
+		}
+	}
+	for key, until := range a.flagged {
+		if until < now.Unix() {
+			delete(a.flagged, key)
+		}
+	}
+	a.store = anomalyStore{
+		Since:          now.Unix(),
+		ReportedDay:    day,
+		FailuresByMint: make(map[string]uint64),
+		PaymentCount:   report.PaymentCount,
+		PaymentTotal:   report.PaymentTotal,
+	}
+	a.save()
+	return report, true
+}
+
+// save writes the counters to the store. Caller must hold mu.
+func (a *anomalies) save() {
+	data, err := json.Marshal(a.store)
+	if err != nil {
+		log.Printf("Warning: failed to encode anomaly counters: %v", err)
+		return
+	}
+	if err := utils.WriteState(a.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save anomaly counters %s: %v", a.path, err)
+	}
+}
+
+// observePurchase looks a ledger entry over for anomalies if a customer paid with it
+func (m *Merchant) observePurchase(entry LedgerEntry) {
+	config := m.getConfig().Anomalies
+	if !config.Enabled || !purchaseEntries[entry.Type] {
+		return
+	}
+	m.raiseAnomalies(m.anomalies.observePurchase(entry, config, time.Now()))
+}
+
+// observeFailedRedemption counts a payment token the wallet failed to redeem
+func (m *Merchant) observeFailedRedemption(customerPubkey, paymentToken string) {
+	config := m.getConfig().Anomalies
+	if !config.Enabled {
+		return
+	}
+	mintURL := ""
+	if token, err := tollwallet.ParseToken(paymentToken); err == nil {
+		mintURL = token.Mint()
+	}
+	m.raiseAnomalies(m.anomalies.observeFailure(customerPubkey, mintURL, config, time.Now()))
+}
+
+// raiseAnomalies logs new anomalies and counts them for operator status events; the owner gets the details
+// with the daily report
+func (m *Merchant) raiseAnomalies(flags []anomalyFlag) {
+	for _, flag := range flags {
+		m.errorCounters.add(flag.Kind)
+		if flag.Pubkey != "" {
+			log.Printf("Anomaly: %s from %s: %s", flag.Kind, flag.Pubkey, flag.Detail)
+		} else {
+			log.Printf("Anomaly: %s: %s", flag.Kind, flag.Detail)
+		}
+	}
+}
+
+// reportAnomalies sends the owner the daily report once the configured hour is reached each day
+func (m *Merchant) reportAnomalies() {
+	for {
+		time.Sleep(anomalyReportPollInterval)
+
+		config := m.getConfig()
+		now := time.Now()
+		if !config.Anomalies.Enabled || now.Hour() < config.Anomalies.ReportHour {
+			continue
+		}
+		ownerPubkey := m.ownerPubkey()
+		if ownerPubkey == "" {
+			continue
+		}
+		report, due := m.anomalies.takeReport(now.Format(time.DateOnly), now)
+		if !due {
+			continue
+		}
+
+		message, err := m.createDirectMessage(ownerPubkey, formatAnomalyReport(report, config, now))
+		if err != nil {
+			log.Printf("Failed to create daily report: %v", err)
+			continue
+		}
+		m.publisher.Publish(message)
+		log.Printf("Sent daily report with %d anomalies to the owner", len(report.Flags))
+	}
+}
+
+// formatAnomalyReport writes the daily report with an action recommended for each kind of anomaly found
+func formatAnomalyReport(report anomalyStore, config *config_manager.Config, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TollGate daily report, %s to %s\n\n", time.Unix(report.Since, 0).Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "Purchases: %d for %d sats\n", report.Purchases, report.Revenue)
+	fmt.Fprintf(&b, "Failed token redemptions: %d", report.Failures)
+	mints := make([]string, 0, len(report.FailuresByMint))
+	for mintURL := range report.FailuresByMint {
+		mints = append(mints, mintURL)
+	}
+	sort.Slice(mints, func(i, j int) bool { return report.FailuresByMint[mints[i]] > report.FailuresByMint[mints[j]] })
+	for i, mintURL := range mints {
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", mintURL, report.FailuresByMint[mintURL])
+		if i == len(mints)-1 {
+			b.WriteString(")")
+		}
+	}
+	b.WriteString("\n")
+
+	if len(report.Flags) == 0 {
+		b.WriteString("\nNo anomalies, no action needed.\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "\nAnomalies: %d\n", len(report.Flags))
+	var actions []string
+	recommended := make(map[string]bool)
+	for _, flag := range report.Flags {
+		who := "all customers"
+		if flag.Pubkey != "" {
+			who = shortPubkey(flag.Pubkey)
+		}
+		fmt.Fprintf(&b, "- %s %s, %s: %s\n", time.Unix(flag.At, 0).Format("15:04"), flag.Kind, who, flag.Detail)
+
+		action := anomalyAction(flag, who, mints, config)
+		if !recommended[action] {
+			recommended[action] = true
+			actions = append(actions, action)
+		}
+	}
+
+	b.WriteString("\nRecommended actions:\n")
+	for _, action := range actions {
+		fmt.Fprintf(&b, "- %s\n", action)
+	}
+	return b.String()
+}
+
+// anomalyAction recommends what the owner can do about an anomaly
+func anomalyAction(flag anomalyFlag, who string, failingMints []string, config *config_manager.Config) string {
+	switch {
+	case flag.Kind == AnomalyPurchaseSpike:
+		return fmt.Sprintf("Check whether %s resells access or shares its sessions; if it shouldn't, limit what one customer can buy with session_caps", who)
+	case flag.Kind == AnomalyFailedRedemptions && flag.Pubkey != "":
+		if config.NegativeCache.Enabled && config.NegativeCache.PubkeyFailures > 0 {
+			return fmt.Sprintf("%s is rejected after %d failed payments, no action needed unless it keeps coming back", who, config.NegativeCache.PubkeyFailures)
+		}
+		return fmt.Sprintf("Set negative_cache.pubkey_failures to reject customers like %s who keep sending bad tokens", who)
+	case flag.Kind == AnomalyFailedRedemptions:
+		if len(failingMints) > 0 {
+			return fmt.Sprintf("Most failed redemptions were at %s: check it is reachable with `tollgate wallet info` and consider removing it from accepted_mints", failingMints[0])
+		}
+		return "Check the mints are reachable with `tollgate wallet info`"
+	default:
+		return fmt.Sprintf("Confirm the large payments settled with `tollgate wallet reconcile`, and refund %s if one was a mistake", who)
+	}
+}
+
+// shortPubkey abbreviates a pubkey for the report
+func shortPubkey(pubkey string) string {
+	if len(pubkey) <= 16 {
+		return pubkey
+	}
+	return pubkey[:8] + "…" + pubkey[len(pubkey)-8:]
+}
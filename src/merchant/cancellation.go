@@ -0,0 +1,220 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// KindSessionCancel is a customer's signed request to end their session early for a refund
+const KindSessionCancel = 21029
+
+// cancelledSession is what a cancellation took from a session, kept to restore it if the refund fails
+type cancelledSession struct {
+	MacAddress    string
+	Metric        string
+	MintURL       string
+	Paid          uint64
+	PaidAllotment uint64
+	Remaining     uint64
+	Allotment     uint64 // Session allotment before the cancellation
+}
+
+// recordSessionPayment remembers who paid how much with which mint for the session of a device,
+// so a cancellation can refund the unused share. A new session forgets earlier payments.
+func (m *Merchant) recordSessionPayment(macAddress, pubkey, mintURL string, amount, allotment uint64, newSession bool) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	session, exists := m.customerSessions[macAddress]
+	if !exists {
+		return
+	}
+	if newSession || session.MintURL != mintURL {
+		// Refunds are paid from a single mint, only the latest mint's payments are refundable
+		session.Paid = 0
+		session.PaidAllotment = 0
+	}
+	session.Pubkey = pubkey
+	session.MintURL = mintURL
+	session.Paid += amount
+	session.PaidAllotment += allotment
+}
+
+// refundAmount pro-rates what was paid by the unused allotment and deducts the cancellation fee
+func refundAmount(cancelled cancelledSession, feePercent uint64) (refund, fee uint64) {
+	if cancelled.PaidAllotment == 0 {
+		return 0, 0
+	}
+	unused := min(cancelled.Remaining, cancelled.PaidAllotment)
+	refund = cancelled.Paid * unused / cancelled.PaidAllotment
+	fee = refund * min(feePercent, 100) / 100
+	return refund - fee, fee
+}
+
+// takeCancelledSession ends the active session of a device on behalf of the customer who paid for it
+func (m *Merchant) takeCancelledSession(macAddress, pubkey string) (cancelledSession, error) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	session, exists := m.customerSessions[macAddress]
+	if !exists || !isCustomerSessionActive(session) {
+		return cancelledSession{}, fmt.Errorf("no active session for %s", macAddress)
+	}
+	if session.Pubkey != pubkey {
+		return cancelledSession{}, fmt.Errorf("session of %s was not paid by this pubkey", macAddress)
+	}
+
+	cancelled := cancelledSession{
+		MacAddress:    macAddress,
+		Metric:        session.Metric,
+		MintURL:       session.MintURL,
+		Paid:          session.Paid,
+		PaidAllotment: session.PaidAllotment,
+		Allotment:     session.Allotment,
+	}
+
+	if session.Metric == "milliseconds" {
+		usedMs := uint64(time.Now().UnixMilli() - session.StartTime*1000)
+		cancelled.Remaining = session.Allotment - min(usedMs, session.Allotment)
+		session.Allotment = min(usedMs, session.Allotment)
+	} else {
+		cancelled.Remaining = session.Allotment
+		session.Allotment = 0
+	}
+	session.Paid = 0
+	session.PaidAllotment = 0
+
+	return cancelled, nil
+}
+
+// restoreCancelledSession puts back a session whose cancellation could not be refunded
+func (m *Merchant) restoreCancelledSession(cancelled cancelledSession) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	session, exists := m.customerSessions[cancelled.MacAddress]
+	if !exists {
+		return
+	}
+	session.Allotment = cancelled.Allotment
+	session.Paid = cancelled.Paid
+	session.PaidAllotment = cancelled.PaidAllotment
+}
+
+// CancelSession ends the customer's session and refunds the unused share of what they paid,
+// minus the cancellation fee, as a Cashu token in an encrypted direct message
+func (m *Merchant) CancelSession(cancelEvent nostr.Event) (*nostr.Event, error) {
+	config := m.getConfig()
+	if !config.Cancellation.Enabled {
+		return m.CreateNoticeEvent("error", "cancellation-disabled", "This TollGate does not cancel sessions", cancelEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(cancelEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), cancelEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), cancelEvent.PubKey)
+	}
+
+	cancelled, err := m.takeCancelledSession(macAddress, cancelEvent.PubKey)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "no-active-session", fmt.Sprintf("Cannot cancel session: %v", err), cancelEvent.PubKey)
+	}
+
+	refund, fee := refundAmount(cancelled, config.Cancellation.FeePercent)
+
+	var dmTags []nostr.Tag
+	if refund > 0 {
+		token, err := m.CreatePaymentToken(cancelled.MintURL, refund)
+		if err != nil {
+			m.restoreCancelledSession(cancelled)
+			return m.CreateNoticeEvent("error", "refund-failed",
+				fmt.Sprintf("Failed to create refund, session kept: %v", err), cancelEvent.PubKey)
+		}
+
+		dmEvent, err := m.createRefundMessage(cancelEvent.PubKey, refund, token)
+		if err != nil {
+			// The token is already taken from the wallet, keep it so the operator can still hand it over
+			log.Printf("ERROR: Failed to send refund of %d sats to %s: %v", refund, cancelEvent.PubKey, err)
+			m.keepUnsentToken(migrationToken{MintURL: cancelled.MintURL, Amount: refund, Token: token})
+		} else {
+			m.publisher.Publish(dmEvent)
+			dmTags = append(dmTags, nostr.Tag{"e", dmEvent.ID})
+		}
+	}
+
+	if _, err := valve.CloseGate(macAddress); err != nil {
+		log.Printf("Warning: failed to close gate for cancelled session of %s: %v", macAddress, err)
+	}
+	m.cookieRevocations.revoke(macAddress)
+	m.closeSessionGroup(macAddress)
+
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerCancellation,
+		MacAddress: macAddress,
+		Pubkey:     cancelEvent.PubKey,
+		MintURL:    cancelled.MintURL,
+		Amount:     refund,
+		Fee:        fee,
+		Allotment:  cancelled.Remaining,
+		Metric:     cancelled.Metric,
+		EventID:    cancelEvent.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record cancellation of %s: %v", macAddress, err)
+	}
+
+	log.Printf("Cancelled session of %s with %d %s remaining, refunded %d sats (fee %d)",
+		macAddress, cancelled.Remaining, cancelled.Metric, refund, fee)
+
+	return m.createNoticeEventWithTags("info", "session-cancelled",
+		fmt.Sprintf("Session cancelled, refunded %d sats (cancellation fee %d sats)", refund, fee),
+		cancelEvent.PubKey, append(dmTags, nostr.Tag{"refund", fmt.Sprintf("%d", refund)})...)
+}
+
+// createRefundMessage wraps a refund token in a NIP-04 encrypted direct message to the customer
+func (m *Merchant) createRefundMessage(customerPubkey string, amount uint64, token string) (*nostr.Event, error) {
+	return m.createDirectMessage(customerPubkey, fmt.Sprintf("Refund of %d sats for your cancelled session: %s", amount, token))
+}
+
+// createDirectMessage creates a NIP-04 encrypted direct message from the merchant
+func (m *Merchant) createDirectMessage(recipientPubkey, message string) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	sharedSecret, err := nip04.ComputeSharedSecret(recipientPubkey, merchantIdentity.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	ciphertext, err := nip04.Encrypt(message, sharedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt message: %w", err)
+	}
+
+	dmEvent := &nostr.Event{
+		Kind:      nostr.KindEncryptedDirectMessage,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", recipientPubkey},
+		},
+		Content: ciphertext,
+	}
+	if err := dmEvent.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign direct message: %w", err)
+	}
+	return dmEvent, nil
+}
@@ -0,0 +1,31 @@
+package merchant
+
+import "testing"
+
+func TestRefundAmount(t *testing.T) {
+	tests := []struct {
+		name       string
+		cancelled  cancelledSession
+		feePercent uint64
+		refund     uint64
+		fee        uint64
+	}{
+		{"just started", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 60000}, 10, 90, 10},
+		{"half used", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 30000}, 10, 45, 5},
+		{"expired", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 0}, 10, 0, 0},
+		{"pro-rata share rounds down", cancelledSession{Paid: 10, PaidAllotment: 3, Remaining: 2}, 0, 6, 0},
+		{"fee rounds down", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 60000}, 15, 85, 15},
+		{"fee below one sat is waived", cancelledSession{Paid: 10, PaidAllotment: 3, Remaining: 1}, 10, 3, 0},
+		{"time beyond what was paid is not refunded", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 90000}, 0, 100, 0},
+		{"fee capped at the refund", cancelledSession{Paid: 100, PaidAllotment: 60000, Remaining: 60000}, 150, 0, 100},
+		{"nothing paid", cancelledSession{Remaining: 60000}, 10, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refund, fee := refundAmount(tt.cancelled, tt.feePercent)
+			if refund != tt.refund || fee != tt.fee {
+				t.Errorf("refundAmount() = %d refund, %d fee, expected %d refund, %d fee", refund, fee, tt.refund, tt.fee)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package merchant
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindAccessCard is a pre-paid card: a claim on an allotment signed by the operator, redeemable once
+const KindAccessCard = 21031
+
+// cardCodePrefix starts the codes printed on cards or written to NFC tags, followed by the base64url encoded claim
+const cardCodePrefix = "tgcard:"
+
+// Limits of card issuance
+const (
+	maxCardsPerIssue = 500
+	defaultCardDays  = 365
+)
+
+// spentCard is a redeemed card in the registry
+type spentCard struct {
+	MacAddress string `json:"mac_address"`
+	RedeemedAt int64  `json:"redeemed_at"`
+	ExpiresAt  int64  `json:"expires_at"` // Expired cards are rejected anyway, their record is pruned
+}
+
+// cardRegistry persists the cards redeemed on this gateway, so each card buys one session even across restarts
+type cardRegistry struct {
+	mu    sync.Mutex
+	path  string
+	spent map[string]spentCard
+}
+
+func newCardRegistry(path string) *cardRegistry {
+	r := &cardRegistry{path: path, spent: make(map[string]spentCard)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read card registry %s: %v", path, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.spent); err != nil {
+		log.Printf("Warning: failed to parse card registry %s: %v", path, err)
+		r.spent = make(map[string]spentCard)
+	}
+	return r
+}
+
+// spend marks a card as redeemed by a device, failing if it already was or the registry can't be saved
+func (r *cardRegistry) spend(cardID string, card spentCard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().Unix()
+	for id, spent := range r.spent {
+		if spent.ExpiresAt < now {
+			delete(r.spent, id)
+		}
+	}
+
+	if previous, spent := r.spent[cardID]; spent {
+		return fmt.Errorf("card was already redeemed on %s", time.Unix(previous.RedeemedAt, 0).Format(time.DateOnly))
+	}
+	r.spent[cardID] = card
+	if err := r.save(); err != nil {
+		delete(r.spent, cardID)
+		return err
+	}
+	return nil
+}
+
+// unspend returns a card whose session could not be opened
+func (r *cardRegistry) unspend(cardID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.spent, cardID)
+	if err := r.save(); err != nil {
+		log.Printf("Warning: failed to return card %s to the registry: %v", cardID, err)
+	}
+}
+
+// save writes the registry. Caller must hold mu.
+func (r *cardRegistry) save() error {
+	data, err := json.Marshal(r.spent)
+	if err != nil {
+		return fmt.Errorf("failed to encode card registry: %w", err)
+	}
+	if err := utils.WriteStateDurable(r.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save card registry: %w", err)
+	}
+	return nil
+}
+
+// IssueCards signs claims on an allotment for offline sale and returns their codes. The cards are valid
+// for the given days and redeemable once on any gateway honoring this gateway's merchant identity.
+func (m *Merchant) IssueCards(count int, allotment uint64, tier string, validDays int) ([]string, error) {
+	if count < 1 || count > maxCardsPerIssue {
+		return nil, fmt.Errorf("number of cards must be between 1 and %d", maxCardsPerIssue)
+	}
+	if allotment == 0 {
+		return nil, fmt.Errorf("cards must carry an allotment")
+	}
+	if tier == "" {
+		tier = m.getConfig().BaseTier()
+	}
+	if _, known := valve.GetBandwidthLimit(m.getConfig().NDS.GatewayInterface, tier); !known {
+		return nil, fmt.Errorf("unknown tier %s", tier)
+	}
+	if validDays <= 0 {
+		validDays = defaultCardDays
+	}
+
+	metric := m.getConfig().Metric
+	expiresAt := time.Now().AddDate(0, 0, validDays).Unix()
+	codes := make([]string, 0, count)
+	for range count {
+		card := &nostr.Event{
+			Kind:      KindAccessCard,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				{"metric", metric},
+				{"allotment", strconv.FormatUint(allotment, 10)},
+				{"tier", tier},
+				{"expiration", strconv.FormatInt(expiresAt, 10)},
+				// Cards issued in the same second differ by their nonce
+				{"nonce", nostr.GeneratePrivateKey()[:16]},
+			},
+		}
+		if err := m.signMerchantEvent(card); err != nil {
+			return nil, fmt.Errorf("failed to sign card: %w", err)
+		}
+		data, err := json.Marshal(card)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode card: %w", err)
+		}
+		codes = append(codes, cardCodePrefix+base64.RawURLEncoding.EncodeToString(data))
+	}
+
+	log.Printf("Issued %d cards of %d %s at tier %s, valid until %s", count, allotment, metric, tier,
+		time.Unix(expiresAt, 0).Format(time.DateOnly))
+	return codes, nil
+}
+
+// RedeemCard verifies a card presented by a device, marks it spent and credits its allotment to the device's session
+func (m *Merchant) RedeemCard(code, macAddress string) (SessionStatus, error) {
+	config := m.getConfig()
+	if !config.Cards.Enabled {
+		return SessionStatus{}, fmt.Errorf("this TollGate does not accept cards")
+	}
+	if m.emergencyStop.halted() != nil {
+		return SessionStatus{}, fmt.Errorf("this TollGate is out of service, ask staff for access")
+	}
+
+	if m.refusesRandomizedMAC(macAddress) {
+		return SessionStatus{}, fmt.Errorf("this TollGate does not serve randomized MAC addresses, turn off the private Wi-Fi address for this network and reconnect")
+	}
+
+	card, err := decodeCard(code)
+	if err != nil {
+		return SessionStatus{}, err
+	}
+	issuers, err := m.cardIssuers(config)
+	if err != nil {
+		return SessionStatus{}, err
+	}
+	allotment, tier, expiresAt, err := verifyCard(card, issuers, config.Metric, config.BaseTier(), config.NDS.GatewayInterface)
+	if err != nil {
+		return SessionStatus{}, err
+	}
+
+	if !m.checkCapacity(macAddress) {
+		return SessionStatus{}, fmt.Errorf("no capacity left for new sessions, try again later")
+	}
+	if err := m.cards.spend(card.ID, spentCard{MacAddress: macAddress, RedeemedAt: time.Now().Unix(), ExpiresAt: expiresAt}); err != nil {
+		return SessionStatus{}, err
+	}
+
+	session, err := m.AddAllotment(macAddress, config.Metric, allotment)
+	if err != nil {
+		m.cards.unspend(card.ID)
+		return SessionStatus{}, fmt.Errorf("failed to manage session: %w", err)
+	}
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(session), tier); err != nil {
+		// The allotment stays on the session, the card is spent
+		return SessionStatus{}, fmt.Errorf("failed to open gate for session: %w", err)
+	}
+	m.setSessionTier(macAddress, tier)
+
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerCard,
+		MacAddress: macAddress,
+		Pubkey:     card.PubKey,
+		Allotment:  allotment,
+		Metric:     config.Metric,
+		EventID:    card.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record card redemption of %s: %v", macAddress, err)
+	}
+	log.Printf("Redeemed card %s issued by %s: credited %d %s to %s", card.ID, card.PubKey, allotment, config.Metric, macAddress)
+
+	return m.GetSessionStatus(macAddress), nil
+}
+
+// cardIssuers returns the pubkeys whose cards are honored: this gateway's merchant and the configured issuers
+func (m *Merchant) cardIssuers(config *config_manager.Config) ([]string, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+	merchantPubkey, err := nostr.GetPublicKey(merchantIdentity.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+	return append([]string{merchantPubkey}, config.Cards.Issuers...), nil
+}
+
+// decodeCard parses a card code as printed or read from an NFC tag
+func decodeCard(code string) (nostr.Event, error) {
+	var card nostr.Event
+	encoded, found := strings.CutPrefix(strings.TrimSpace(code), cardCodePrefix)
+	if !found {
+		return card, fmt.Errorf("not a TollGate card")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return card, fmt.Errorf("damaged card code: %w", err)
+	}
+	if err := json.Unmarshal(data, &card); err != nil {
+		return card, fmt.Errorf("damaged card code: %w", err)
+	}
+	return card, nil
+}
+
+// verifyCard checks that a card was signed by a trusted issuer and hasn't expired,
+// and returns the allotment, tier and expiration it carries. Cards naming no tier known on the interface get the
+// base tier.
+func verifyCard(card nostr.Event, issuers []string, metric, baseTier, iface string) (uint64, string, int64, error) {
+	if card.Kind != KindAccessCard {
+		return 0, "", 0, fmt.Errorf("not a TollGate card")
+	}
+	// The signature covers the content, not the ID, which keys the spent card registry
+	if !card.CheckID() {
+		return 0, "", 0, fmt.Errorf("damaged card code: ID does not match the card")
+	}
+	if ok, err := card.CheckSignature(); err != nil || !ok {
+		return 0, "", 0, fmt.Errorf("invalid card signature")
+	}
+	if !slices.Contains(issuers, card.PubKey) {
+		return 0, "", 0, fmt.Errorf("card was issued by another operator")
+	}
+
+	expirationTag := card.Tags.Find("expiration")
+	if expirationTag == nil {
+		return 0, "", 0, fmt.Errorf("card has no expiration")
+	}
+	expiresAt, err := strconv.ParseInt(expirationTag[1], 10, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("invalid card expiration: %w", err)
+	}
+	if time.Now().Unix() >= expiresAt {
+		return 0, "", 0, fmt.Errorf("card expired on %s", time.Unix(expiresAt, 0).Format(time.DateOnly))
+	}
+
+	if metricTag := card.Tags.Find("metric"); metricTag == nil || metricTag[1] != metric {
+		return 0, "", 0, fmt.Errorf("card is not valid for sessions metered in %s", metric)
+	}
+	allotmentTag := card.Tags.Find("allotment")
+	if allotmentTag == nil {
+		return 0, "", 0, fmt.Errorf("card carries no allotment")
+	}
+	allotment, err := strconv.ParseUint(allotmentTag[1], 10, 64)
+	if err != nil || allotment == 0 {
+		return 0, "", 0, fmt.Errorf("invalid card allotment")
+	}
+
+	tier := baseTier
+	if tierTag := card.Tags.Find("tier"); tierTag != nil {
+		if _, known := valve.GetBandwidthLimit(iface, tierTag[1]); known {
+			tier = tierTag[1]
+		}
+	}
+
+	return allotment, tier, expiresAt, nil
+}
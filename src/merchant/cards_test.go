@@ -0,0 +1,53 @@
+package merchant
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRedeemCardOnce(t *testing.T) {
+	m := newTestMerchant(t)
+	if err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.Cards.Enabled = true
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	const mac = "00:11:22:33:44:06"
+	valve.SetDryRun(mac, true)
+	t.Cleanup(func() {
+		valve.CloseGate(mac)
+		valve.SetDryRun(mac, false)
+	})
+
+	codes, err := m.IssueCards(1, 60000, "", 30)
+	if err != nil {
+		t.Fatalf("IssueCards failed: %v", err)
+	}
+	if _, err := m.RedeemCard(codes[0], mac); err != nil {
+		t.Fatalf("RedeemCard failed: %v", err)
+	}
+
+	// The signature doesn't cover the ID, a card under a fresh one is still the same card
+	card, err := decodeCard(codes[0])
+	if err != nil {
+		t.Fatalf("decodeCard failed: %v", err)
+	}
+	card.ID = nostr.GeneratePrivateKey()
+	data, _ := json.Marshal(card)
+	edited := cardCodePrefix + base64.RawURLEncoding.EncodeToString(data)
+	if _, err := m.RedeemCard(edited, mac); err == nil {
+		t.Error("Expected a card with an edited ID to be rejected")
+	}
+
+	if _, err := m.RedeemCard(codes[0], mac); err == nil || !strings.Contains(err.Error(), "already redeemed") {
+		t.Errorf("Expected a redeemed card to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package merchant
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// defaultColdSweepInterval applies when no check interval is configured
+const defaultColdSweepInterval = 5 * time.Minute
+
+// sweepShare is the amount swept from one mint
+type sweepShare struct {
+	mintURL string
+	amount  uint64
+}
+
+// planColdSweep splits the surplus over keep among the mints, taking from the largest balances first.
+// sweepable holds the amount each mint can give up. Nothing is swept until the total exceeds threshold.
+func planColdSweep(total, threshold, keep uint64, sweepable map[string]uint64) []sweepShare {
+	if total <= threshold || total <= keep {
+		return nil
+	}
+	surplus := total - keep
+
+	mintURLs := make([]string, 0, len(sweepable))
+	for mintURL := range sweepable {
+		mintURLs = append(mintURLs, mintURL)
+	}
+	slices.SortFunc(mintURLs, func(a, b string) int {
+		if sweepable[a] != sweepable[b] {
+			return cmp.Compare(sweepable[b], sweepable[a])
+		}
+		return strings.Compare(a, b)
+	})
+
+	var shares []sweepShare
+	for _, mintURL := range mintURLs {
+		if surplus == 0 {
+			break
+		}
+		amount := min(sweepable[mintURL], surplus)
+		if amount == 0 {
+			continue
+		}
+		shares = append(shares, sweepShare{mintURL: mintURL, amount: amount})
+		surplus -= amount
+	}
+	return shares
+}
+
+// sweepToCold periodically moves the balance above the threshold to the cold destination while enabled
+func (m *Merchant) sweepToCold() {
+	for {
+		config := m.getConfig().ColdSweep
+		interval := time.Duration(config.CheckIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultColdSweepInterval
+		}
+		time.Sleep(interval)
+
+		if config.Enabled {
+			m.sweepToColdOnce()
+		}
+	}
+}
+
+func (m *Merchant) sweepToColdOnce() {
+	if err := m.walletLocked(); err != nil {
+		log.Printf("Skipping cold sweep: %v", err)
+		return
+	}
+	config := m.getConfig()
+	settings := config.ColdSweep
+	if settings.LightningAddress == "" && settings.Npub == "" {
+		log.Printf("Cold sweep enabled without a lightning address or npub, nothing to sweep to")
+		return
+	}
+
+	total := m.tollwallet.GetBalance()
+	if total <= settings.ThresholdSats {
+		return
+	}
+
+	// Mints keep their minimum balance, and Lightning sweeps leave room for the melt fees
+	sweepable := make(map[string]uint64, len(config.AcceptedMints))
+	for _, mint := range config.AcceptedMints {
+		balance := m.tollwallet.GetBalanceByMint(mint.URL)
+		if balance <= mint.MinBalance {
+			continue
+		}
+		available := balance - mint.MinBalance
+		if settings.LightningAddress != "" {
+			available = available * 100 / (100 + mint.BalanceTolerancePercent)
+		}
+		sweepable[mint.URL] = available
+	}
+
+	shares := planColdSweep(total, settings.ThresholdSats, settings.KeepSats, sweepable)
+	log.Printf("Balance of %d sats exceeds the cold sweep threshold of %d sats, sweeping %d mints", total, settings.ThresholdSats, len(shares))
+
+	for _, share := range shares {
+		var destination string
+		var err error
+		if settings.LightningAddress != "" {
+			destination = settings.LightningAddress
+			err = m.sweepToLightning(config, share, settings.LightningAddress)
+		} else {
+			destination = settings.Npub
+			err = m.sweepToNpub(share, settings.Npub)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to sweep %d sats from %s to cold storage: %v", share.amount, share.mintURL, err)
+			m.errorCounters.add("cold-sweep-failed")
+			continue
+		}
+
+		log.Printf("Swept %d sats from %s to %s", share.amount, share.mintURL, destination)
+		m.configManager.Audit("cold-sweep", config_manager.AuditColdSweep, map[string]string{
+			"mint":        share.mintURL,
+			"amount":      fmt.Sprintf("%d", share.amount),
+			"destination": destination,
+		})
+	}
+}
+
+// sweepToLightning melts a share to the cold Lightning address
+func (m *Merchant) sweepToLightning(config *config_manager.Config, share sweepShare, lightningAddress string) error {
+	mintConfig := findMintConfigIn(config, share.mintURL)
+	if mintConfig == nil {
+		return fmt.Errorf("mint configuration not found for URL: %s", share.mintURL)
+	}
+	maxCost := share.amount + share.amount*mintConfig.BalanceTolerancePercent/100
+	return m.tollwallet.MeltToLightning(share.mintURL, share.amount, maxCost, lightningAddress)
+}
+
+// sweepToNpub sends a share as an ecash token in an encrypted DM to the cold npub.
+// If the DM can't be created the token is received back, so the funds stay in the wallet.
+func (m *Merchant) sweepToNpub(share sweepShare, npub string) error {
+	prefix, value, err := nip19.Decode(npub)
+	if err != nil || prefix != "npub" {
+		return fmt.Errorf("invalid cold sweep npub %q", npub)
+	}
+	pubkey, _ := value.(string)
+
+	token, err := m.CreatePaymentToken(share.mintURL, share.amount)
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+
+	dmEvent, err := m.createDirectMessage(pubkey, fmt.Sprintf("Cold sweep of %d sats from %s: %s", share.amount, share.mintURL, token))
+	if err != nil {
+		if decoded, decodeErr := cashu.DecodeToken(token); decodeErr == nil {
+			if _, receiveErr := m.tollwallet.Receive(decoded); receiveErr != nil {
+				log.Printf("CRITICAL: failed to take back cold sweep token of %d sats from %s: %v", share.amount, share.mintURL, receiveErr)
+			}
+		}
+		return fmt.Errorf("failed to create cold sweep message: %w", err)
+	}
+
+	m.publisher.Publish(dmEvent)
+	return nil
+}
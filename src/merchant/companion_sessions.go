@@ -0,0 +1,184 @@
+package merchant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// localRelayURL is the relay on the router that TollGate modules share events through
+const localRelayURL = "ws://localhost:4242"
+
+const (
+	// companionRetryInterval is the pause before subscribing again after the subscription ended or failed
+	companionRetryInterval = 10 * time.Second
+	// maxCompanionSessionAge bounds how old a session event may be when it arrives, older ones were missed
+	// while the merchant was down and the companion module is expected to publish them again
+	maxCompanionSessionAge = 10 * time.Minute
+)
+
+// companionSessions follows the session events other modules publish to the local relay
+type companionSessions struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc         // Ends the running subscription, so it is renewed with the current authors
+	seen   map[string]nostr.Timestamp // Session events already honored, by ID
+}
+
+func newCompanionSessions() *companionSessions {
+	return &companionSessions{seen: make(map[string]nostr.Timestamp)}
+}
+
+// restart ends the running subscription, the follow loop subscribes again with the current config
+func (c *companionSessions) restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// markSeen records a session event, returning false if it was honored already
+func (c *companionSessions) markSeen(event *nostr.Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := nostr.Timestamp(time.Now().Add(-maxCompanionSessionAge).Unix())
+	for id, createdAt := range c.seen {
+		if createdAt < oldest {
+			delete(c.seen, id)
+		}
+	}
+	if _, seen := c.seen[event.ID]; seen {
+		return false
+	}
+	c.seen[event.ID] = event.CreatedAt
+	return true
+}
+
+// companionAuthors returns the pubkeys whose session events are honored, none while disabled
+func (m *Merchant) companionAuthors() []string {
+	config := m.getConfig().CompanionSessions
+	if !config.Enabled {
+		return nil
+	}
+	authors := append([]string{}, config.TrustedPubkeys...)
+	if owner := m.ownerPubkey(); owner != "" {
+		authors = append(authors, owner)
+	}
+	return authors
+}
+
+// followCompanionSessions subscribes to session events of companion modules on the local relay
+// and opens the gates they grant, renewing the subscription when it ends or the config changes
+func (m *Merchant) followCompanionSessions() {
+	since := nostr.Now()
+	for {
+		authors := m.companionAuthors()
+		if len(authors) > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			m.companions.mu.Lock()
+			m.companions.cancel = cancel
+			m.companions.mu.Unlock()
+
+			var err error
+			since, err = m.subscribeCompanionSessions(ctx, authors, since)
+			cancel()
+			if err != nil {
+				log.Printf("Warning: companion session subscription failed: %v", err)
+			}
+		}
+		time.Sleep(companionRetryInterval)
+	}
+}
+
+// subscribeCompanionSessions honors session events until the subscription ends and returns
+// the timestamp to resume from
+func (m *Merchant) subscribeCompanionSessions(ctx context.Context, authors []string, since nostr.Timestamp) (nostr.Timestamp, error) {
+	relay, err := m.configManager.GetLocalPool().EnsureRelay(localRelayURL)
+	if err != nil {
+		return since, fmt.Errorf("failed to connect to local relay: %w", err)
+	}
+	sub, err := relay.Subscribe(ctx, []nostr.Filter{{
+		Kinds:   []int{1022},
+		Authors: authors,
+		Since:   &since,
+	}})
+	if err != nil {
+		return since, fmt.Errorf("failed to subscribe to local relay: %w", err)
+	}
+	defer sub.Unsub()
+	log.Printf("Following session events of %d companion module keys on the local relay", len(authors))
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return since, nil
+			}
+			if event.CreatedAt > since {
+				since = event.CreatedAt
+			}
+			if err := m.honorCompanionSession(event); err != nil {
+				log.Printf("Warning: ignoring session event %s of %s: %v", event.ID, event.PubKey, err)
+			}
+		case <-ctx.Done():
+			return since, nil
+		}
+	}
+}
+
+// honorCompanionSession credits the allotment of a session event created by a companion module
+// to the device it names and opens its gate, once per event
+func (m *Merchant) honorCompanionSession(event *nostr.Event) error {
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return fmt.Errorf("invalid signature")
+	}
+	if time.Since(event.CreatedAt.Time()) > maxCompanionSessionAge {
+		return fmt.Errorf("event is older than %s", maxCompanionSessionAge)
+	}
+
+	var macAddress string
+	if tag := event.Tags.Find("device-identifier"); len(tag) >= 3 {
+		macAddress = tag[2]
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return fmt.Errorf("invalid MAC address %q", macAddress)
+	}
+	allotment, err := m.extractAllotment(event)
+	if err != nil || allotment == 0 {
+		return fmt.Errorf("no allotment")
+	}
+	config := m.getConfig()
+	metric := config.Metric
+	if tag := event.Tags.Find("metric"); tag != nil {
+		metric = tag[1]
+	}
+	tier := config.BaseTier()
+	if tag := event.Tags.Find("tier"); tag != nil {
+		if _, known := valve.GetBandwidthLimit(config.NDS.GatewayInterface, tag[1]); known {
+			tier = tag[1]
+		}
+	}
+
+	if !m.companions.markSeen(event) {
+		return nil
+	}
+	session, err := m.AddAllotment(macAddress, metric, allotment)
+	if err != nil {
+		return fmt.Errorf("failed to manage session: %w", err)
+	}
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(session), tier); err != nil {
+		return fmt.Errorf("failed to open gate: %w", err)
+	}
+	m.setSessionTier(macAddress, tier)
+
+	log.Printf("Honored session event %s of companion module %s: credited %d %s to %s",
+		event.ID, event.PubKey, allotment, metric, macAddress)
+	return nil
+}
@@ -0,0 +1,213 @@
+package merchant
+
+// Concurrency tests for state shared between purchases, expiries, payouts and config reloads.
+// They only catch data races when run with the race detector: go test -race ./...
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const concurrencyWorkers = 8
+
+// newTestMerchant creates a merchant without a wallet, background routines or gates.
+// handleConfigChange is not registered as it reconfigures the wallet, which needs a reachable mint.
+func newTestMerchant(t *testing.T) *Merchant {
+	t.Helper()
+	dir := t.TempDir()
+
+	configManager, err := config_manager.NewConfigManager(filepath.Join(dir, "config.json"),
+		filepath.Join(dir, "install.json"), filepath.Join(dir, "identities.json"))
+	if err != nil {
+		t.Fatalf("Failed to create ConfigManager: %v", err)
+	}
+	err = configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.DHCP.LeasesFile = filepath.Join(dir, "dhcp.leases")
+		config.Analytics.DeviceClassification = true
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	return &Merchant{
+		configManager:    configManager,
+		customerSessions: make(map[string]*CustomerSession),
+		deviceAnalytics:  newDeviceAnalytics(),
+		reservations:     make(map[string]*reservation),
+		reputation:       newReputation(filepath.Join(dir, "reputation.json")),
+		zapPurchases:     make(map[string]*zapPurchase),
+		startTime:        time.Now(),
+		errorCounters:    newErrorCounters(),
+		negativeCache:    newNegativeCache(),
+		purchaseQueue:    newPurchaseQueue(config_manager.PurchaseQueueConfig{}),
+		exposure:         newExposureState(),
+		feeAdjustments:   make(map[string]mintFeeAdjustment),
+		mintKeysets:      make(map[string][]string),
+		dataQuota: dataQuotaState{
+			counters:  make(map[string]uint64),
+			throttles: make(map[string]int),
+		},
+		groups:              newSessionGroups(),
+		attestations:        make(map[string]int64),
+		companions:          newCompanionSessions(),
+		abuse:               newSessionAbuse(),
+		ledger:              newLedger(newJSONStore(filepath.Join(dir, "ledger.jsonl"), filepath.Join(dir, "sessions.json"))),
+		cards:               newCardRegistry(filepath.Join(dir, "spent_cards.json")),
+		loyalty:             newLoyalty(filepath.Join(dir, "loyalty.json")),
+		subscriptions:       newSubscriptions(filepath.Join(dir, "subscriptions.json")),
+		fairUse:             newFairUse(filepath.Join(dir, "fair_use.json")),
+		anomalies:           newAnomalies(filepath.Join(dir, "anomalies.json")),
+		emergencyStop:       newEmergencyStop(filepath.Join(dir, "emergency_stop.json")),
+		history:             newHistory(filepath.Join(dir, "history.json")),
+		cookieRevocations:   newCookieRevocations(filepath.Join(dir, "revoked_session_cookies.json")),
+		redeemedProofs:      newRedemptionRegistry(filepath.Join(dir, "redeemed_session_proofs.json"), "session proof"),
+		redeemedZapReceipts: newRedemptionRegistry(filepath.Join(dir, "redeemed_zap_receipts.json"), "zap receipt"),
+	}
+}
+
+// runConcurrently runs each function in several goroutines at once and waits for all of them
+func runConcurrently(iterations int, fns ...func(worker, iteration int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, fn := range fns {
+		for worker := 0; worker < concurrencyWorkers; worker++ {
+			wg.Add(1)
+			go func(fn func(worker, iteration int), worker int) {
+				defer wg.Done()
+				<-start
+				for i := 0; i < iterations; i++ {
+					fn(worker, i)
+				}
+			}(fn, worker)
+		}
+	}
+	close(start)
+	wg.Wait()
+}
+
+func testMAC(n int) string {
+	return fmt.Sprintf("00:11:22:33:44:%02x", n%4)
+}
+
+func TestConcurrentPurchases(t *testing.T) {
+	m := newTestMerchant(t)
+	customerPubkey := nostr.GeneratePrivateKey()
+
+	runConcurrently(50,
+		// Purchases adding to the same few sessions
+		func(worker, i int) {
+			macAddress := testMAC(worker)
+			newSession := m.remainingAllotment(macAddress) == 0
+			session, err := m.AddAllotment(macAddress, "milliseconds", 60000)
+			if err != nil {
+				t.Errorf("AddAllotment failed: %v", err)
+				return
+			}
+			m.setSessionTier(macAddress, "free")
+			m.recordSessionPayment(macAddress, customerPubkey, "https://mint.example.com", 1, 60000, newSession)
+			_ = sessionEndTimestamp(session)
+		},
+		// Access probes reading the sessions being extended
+		func(worker, i int) {
+			probe := nostr.Event{
+				Kind:   21000,
+				PubKey: customerPubkey,
+				Tags: nostr.Tags{
+					{"device-identifier", "mac", testMAC(worker + 1)},
+					{"payment", ""},
+				},
+			}
+			if _, err := m.PurchaseSession(probe); err != nil {
+				t.Errorf("Access probe failed: %v", err)
+			}
+		},
+		// Operator views of clients and sessions
+		func(worker, i int) {
+			m.GetClients()
+			m.GetDeviceStats()
+			m.countActiveSessions()
+			m.customerHistory(testMAC(worker))
+		},
+	)
+
+	for n := 0; n < 4; n++ {
+		session, err := m.GetSession(testMAC(n))
+		if err != nil {
+			t.Fatalf("Session of %s missing: %v", testMAC(n), err)
+		}
+		if session.Allotment == 0 || session.Purchases == 0 {
+			t.Errorf("Session of %s has no allotment after purchases: %+v", testMAC(n), session)
+		}
+	}
+}
+
+func TestConcurrentExpiries(t *testing.T) {
+	m := newTestMerchant(t)
+	quota := m.getConfig().DataQuota
+
+	runConcurrently(50,
+		// Data sessions running out while they are metered
+		func(worker, i int) {
+			if _, err := m.AddAllotment(testMAC(worker), "bytes", uint64(i%2)); err != nil {
+				t.Errorf("AddAllotment failed: %v", err)
+			}
+		},
+		func(worker, i int) {
+			m.meterDataSessionsOnce(quota)
+		},
+		// Reservations and redeemed session proofs expiring
+		func(worker, i int) {
+			m.checkCapacity(testMAC(worker))
+			m.redeemedProofs.redeem(fmt.Sprintf("proof-%d-%d", worker, i), time.Now().Unix()-1)
+		},
+	)
+}
+
+func TestConcurrentConfigReloads(t *testing.T) {
+	m := newTestMerchant(t)
+	m.configManager.OnConfigChange(func(config *config_manager.Config) {
+		if err := m.refreshAdvertisement(); err != nil {
+			t.Errorf("Failed to refresh advertisement: %v", err)
+		}
+		m.loadPricingStrategy(config.Pricing)
+	})
+	t.Cleanup(func() {
+		m.payoutMu.Lock()
+		defer m.payoutMu.Unlock()
+		if m.payoutStop != nil {
+			close(m.payoutStop)
+			m.payoutStop = nil
+		}
+	})
+
+	runConcurrently(20,
+		func(worker, i int) {
+			err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+				config.StepSize = uint64(60000 + worker*1000 + i)
+				return true
+			})
+			if err != nil {
+				t.Errorf("UpdateConfig failed: %v", err)
+			}
+		},
+		// Payout tickers restarted as mints change
+		func(worker, i int) {
+			m.StartPayoutRoutine()
+		},
+		// Readers of config-derived state
+		func(worker, i int) {
+			m.GetAdvertisement()
+			m.GetPricingInfo()
+			m.createQuoteMessage()
+			m.getPricingStrategy()
+			m.GetAcceptedMints()
+		},
+	)
+}
@@ -0,0 +1,176 @@
+package merchant
+
+import (
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// defaultQuotaPollInterval applies when no poll interval is configured
+const defaultQuotaPollInterval = 10 * time.Second
+
+// noThrottle marks a gate running at the limit of its tier
+const noThrottle = -1
+
+// dataQuotaState follows the traffic counters and throttling of data-metered gates
+type dataQuotaState struct {
+	counters  map[string]uint64 // Last traffic counter read per MAC address
+	throttles map[string]int    // Index of the throttle step applied per MAC address
+}
+
+// throttleStepFor returns the index of the step with the highest threshold reached by usedPercent, or noThrottle
+func throttleStepFor(steps []config_manager.ThrottleStep, usedPercent uint64) int {
+	index := noThrottle
+	for i, step := range steps {
+		if usedPercent >= step.AtPercent && (index == noThrottle || step.AtPercent >= steps[index].AtPercent) {
+			index = i
+		}
+	}
+	return index
+}
+
+// throttleRate returns the rate of a step for a tier limited to tierLimit kbps (0 = unlimited),
+// or 0 if the step can't be applied to the tier
+func throttleRate(step config_manager.ThrottleStep, tierLimit int) int {
+	if step.RateKbps > 0 {
+		if tierLimit > 0 {
+			return min(step.RateKbps, tierLimit)
+		}
+		return step.RateKbps
+	}
+	if tierLimit > 0 && step.RatePercent > 0 {
+		return max(tierLimit*int(step.RatePercent)/100, 1)
+	}
+	return 0
+}
+
+// meterDataSessions periodically charges the traffic of data-metered sessions against their allotment,
+// throttles gates close to their quota and closes gates whose quota is used up
+func (m *Merchant) meterDataSessions() {
+	for {
+		config := m.getConfig().DataQuota
+		interval := time.Duration(config.PollIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultQuotaPollInterval
+		}
+		time.Sleep(interval)
+
+		m.meterDataSessionsOnce(config)
+	}
+}
+
+func (m *Merchant) meterDataSessionsOnce(config config_manager.DataQuotaConfig) {
+	var macAddresses []string
+	m.sessionMu.Lock()
+	for macAddress, session := range m.customerSessions {
+		if session.Metric != "bytes" {
+			continue
+		}
+		if isCustomerSessionActive(session) {
+			macAddresses = append(macAddresses, macAddress)
+			// Traffic of group members draws from this session too
+			if group, exists := m.groups.byPrimary[macAddress]; exists {
+				for member := range group.members {
+					macAddresses = append(macAddresses, member)
+				}
+			}
+			continue
+		}
+		// The session ended elsewhere (export, cancellation), start over on the next purchase
+		session.UsedBytes = 0
+		delete(m.dataQuota.counters, macAddress)
+		delete(m.dataQuota.throttles, macAddress)
+	}
+	m.sessionMu.Unlock()
+
+	for _, macAddress := range macAddresses {
+		counter, err := valve.GetUsage(macAddress)
+		if err != nil {
+			log.Printf("Warning: failed to read traffic of %s: %v", macAddress, err)
+			continue
+		}
+
+		m.sessionMu.Lock()
+		pool := m.poolFor(macAddress)
+		session, exists := m.customerSessions[pool]
+		if !exists || session.Metric != "bytes" {
+			m.sessionMu.Unlock()
+			continue
+		}
+		used := counter
+		if last, known := m.dataQuota.counters[macAddress]; known && counter >= last {
+			used = counter - last
+		}
+		m.dataQuota.counters[macAddress] = counter
+
+		used = min(used, session.Allotment)
+		session.Allotment -= used
+		session.UsedBytes += used
+		remaining, usedTotal, tier := session.Allotment, session.UsedBytes, session.Tier
+		if remaining == 0 {
+			session.UsedBytes = 0
+			delete(m.dataQuota.counters, pool)
+			delete(m.dataQuota.throttles, pool)
+		}
+		current, throttled := m.dataQuota.throttles[macAddress]
+		if !throttled {
+			current = noThrottle
+		}
+		m.sessionMu.Unlock()
+
+		if remaining == 0 {
+			log.Printf("Data quota of %s used up after %d bytes, closing gate", pool, usedTotal)
+			wasOpen, err := valve.CloseGate(pool)
+			if err != nil {
+				log.Printf("Warning: failed to close gate of %s: %v", pool, err)
+			} else if !wasOpen {
+				log.Printf("Gate of %s was already closed", pool)
+			}
+			m.closeSessionGroup(pool)
+			continue
+		}
+
+		if !config.ThrottlingEnabled {
+			continue
+		}
+		m.applyThrottle(config, macAddress, tier, current, usedTotal*100/(usedTotal+remaining))
+	}
+}
+
+// applyThrottle moves a gate to the throttle step matching its used share of the quota. Gates over their
+// fair-use cap stay at its rate until the day ends.
+func (m *Merchant) applyThrottle(config config_manager.DataQuotaConfig, macAddress, tier string, current int, usedPercent uint64) {
+	if m.fairUse.isThrottled(macAddress) {
+		return
+	}
+	steps := config.StepsFor(tier)
+	next := throttleStepFor(steps, usedPercent)
+	if next == current {
+		return
+	}
+
+	if next == noThrottle {
+		if err := valve.RestoreTierLimit(macAddress, tier); err != nil {
+			log.Printf("Warning: failed to restore bandwidth of %s: %v", macAddress, err)
+			return
+		}
+		log.Printf("Restored %s tier bandwidth of %s at %d%% of its data quota", tier, macAddress, usedPercent)
+	} else {
+		tierLimit, _ := valve.GetBandwidthLimit(m.getConfig().NDS.GatewayInterface, tier)
+		rate := throttleRate(steps[next], tierLimit)
+		if rate == 0 {
+			return
+		}
+		if err := valve.ThrottleGate(macAddress, rate); err != nil {
+			log.Printf("Warning: failed to throttle %s: %v", macAddress, err)
+			return
+		}
+		log.Printf("Throttled %s to %d kbps at %d%% of its data quota", macAddress, rate, usedPercent)
+	}
+
+	m.sessionMu.Lock()
+	m.dataQuota.throttles[macAddress] = next
+	m.sessionMu.Unlock()
+}
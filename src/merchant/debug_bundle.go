@@ -0,0 +1,184 @@
+package merchant
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	// debugBundleLogLines is how many of the latest system log lines go into a debug bundle
+	debugBundleLogLines = 2000
+	// maxDebugBundleDMSize bounds the compressed bundle sent as a direct message, relays reject larger events
+	maxDebugBundleDMSize = 48 * 1024
+)
+
+// DebugBundleSummary reports what a debug bundle holds and where it went
+type DebugBundleSummary struct {
+	Path   string   `json:"path"`
+	Size   int      `json:"size"` // Bytes of the compressed archive
+	Files  []string `json:"files"`
+	SentTo string   `json:"sent_to,omitempty"` // Pubkey the bundle was sent to in an encrypted direct message
+	DMID   string   `json:"dm_id,omitempty"`
+}
+
+// debugBundleHealth is the health check output of a debug bundle
+type debugBundleHealth struct {
+	Operator  OperatorStatus   `json:"operator"`
+	NDSIssues []valve.NDSIssue `json:"nds_issues"`
+	NDSError  string           `json:"nds_error,omitempty"`
+}
+
+// debugBundleWallet summarizes the wallet in a debug bundle, without any tokens
+type debugBundleWallet struct {
+	Balance       uint64                                 `json:"balance"`
+	BalanceByMint map[string]uint64                      `json:"balance_by_mint"`
+	Queues        map[string]tollwallet.MintQueueMetrics `json:"queues"`
+}
+
+// CreateDebugBundle writes a gzipped tar archive for support: the latest logs, the configuration, the health
+// check output, the gates and rules of the valve and a wallet summary. Tokens, private keys and passwords are
+// left out or redacted. If recipient is an npub or hex pubkey, the archive is also sent to it in an encrypted
+// direct message.
+func (m *Merchant) CreateDebugBundle(path, recipient string) (DebugBundleSummary, error) {
+	summary := DebugBundleSummary{Path: path}
+
+	var recipientPubkey string
+	if recipient != "" {
+		var err error
+		if recipientPubkey, err = parsePubkey(recipient); err != nil {
+			return summary, err
+		}
+	}
+
+	files := []struct {
+		name    string
+		content func() ([]byte, error)
+	}{
+		{"logs.txt", debugBundleLogs},
+		{"config.json", m.debugBundleConfig},
+		{"health.json", func() ([]byte, error) { return json.MarshalIndent(m.debugBundleHealth(), "", "  ") }},
+		{"valve.json", func() ([]byte, error) { return json.MarshalIndent(valve.DumpRules(), "", "  ") }},
+		{"wallet.json", func() ([]byte, error) { return json.MarshalIndent(m.debugBundleWallet(), "", "  ") }},
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		content, err := file.content()
+		if err != nil {
+			// A bundle missing a part still helps, say what went wrong in its place
+			content = []byte(fmt.Sprintf("failed to collect %s: %v\n", file.name, err))
+		}
+		content = []byte(utils.RedactSecrets(string(content)))
+		header := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return summary, fmt.Errorf("failed to add %s to bundle: %w", file.name, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return summary, fmt.Errorf("failed to add %s to bundle: %w", file.name, err)
+		}
+		summary.Files = append(summary.Files, file.name)
+	}
+	if err := tw.Close(); err != nil {
+		return summary, fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return summary, fmt.Errorf("failed to compress bundle: %w", err)
+	}
+
+	summary.Size = archive.Len()
+	if err := os.WriteFile(path, archive.Bytes(), 0600); err != nil {
+		return summary, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	log.Printf("Wrote debug bundle of %d bytes to %s", summary.Size, path)
+
+	if recipientPubkey == "" {
+		return summary, nil
+	}
+	if summary.Size > maxDebugBundleDMSize {
+		return summary, fmt.Errorf("bundle of %d bytes is too large for a direct message (max %d), copy %s off the router instead",
+			summary.Size, maxDebugBundleDMSize, path)
+	}
+	dmEvent, err := m.createDirectMessage(recipientPubkey, fmt.Sprintf("TollGate debug bundle, base64 encoded tar.gz:\n%s",
+		base64.StdEncoding.EncodeToString(archive.Bytes())))
+	if err != nil {
+		return summary, fmt.Errorf("failed to create direct message: %w", err)
+	}
+	if err := m.publisher.Publish(dmEvent); err != nil {
+		return summary, fmt.Errorf("failed to send direct message: %w", err)
+	}
+	summary.SentTo = recipientPubkey
+	summary.DMID = dmEvent.ID
+	log.Printf("Sent debug bundle to %s in direct message %s", recipientPubkey, dmEvent.ID)
+	return summary, nil
+}
+
+// parsePubkey accepts a pubkey as npub or hex
+func parsePubkey(pubkey string) (string, error) {
+	if prefix, value, err := nip19.Decode(pubkey); err == nil && prefix == "npub" {
+		pubkey, _ = value.(string)
+	}
+	if !nostr.IsValidPublicKey(pubkey) {
+		return "", fmt.Errorf("invalid pubkey %q", pubkey)
+	}
+	return pubkey, nil
+}
+
+// debugBundleLogs returns the latest lines of the system log
+func debugBundleLogs() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "logread", "-l", fmt.Sprintf("%d", debugBundleLogLines)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system log: %w", err)
+	}
+	return output, nil
+}
+
+// debugBundleConfig returns the configuration without its passwords
+func (m *Merchant) debugBundleConfig() ([]byte, error) {
+	config := *m.getConfig()
+	if config.Tor.ControlPassword != "" {
+		config.Tor.ControlPassword = "redacted"
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+func (m *Merchant) debugBundleHealth() debugBundleHealth {
+	health := debugBundleHealth{Operator: m.GetOperatorStatus()}
+	issues, err := valve.ValidateNDSConfig(m.getConfig().NDS)
+	if err != nil {
+		health.NDSError = err.Error()
+	}
+	health.NDSIssues = issues
+	return health
+}
+
+func (m *Merchant) debugBundleWallet() debugBundleWallet {
+	wallet := debugBundleWallet{
+		Balance:       m.tollwallet.GetBalance(),
+		BalanceByMint: make(map[string]uint64),
+		Queues:        m.GetWalletQueueMetrics(),
+	}
+	for _, mint := range m.getConfig().AcceptedMints {
+		wallet.BalanceByMint[mint.URL] = m.tollwallet.GetBalanceByMint(mint.URL)
+	}
+	return wallet
+}
@@ -0,0 +1,86 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// DeviceStats holds anonymized aggregate counts of the devices that connected since startup
+type DeviceStats struct {
+	UniqueDevices int            `json:"unique_devices"`
+	DeviceTypes   map[string]int `json:"device_types"`
+	Vendors       map[string]int `json:"vendors"`
+}
+
+// deviceAnalytics classifies connecting devices without keeping their MAC addresses.
+// Devices are deduplicated by a salted hash; the salt only lives in memory.
+type deviceAnalytics struct {
+	mu    sync.Mutex
+	salt  []byte
+	seen  map[string]struct{}
+	stats DeviceStats
+}
+
+func newDeviceAnalytics() *deviceAnalytics {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	return &deviceAnalytics{
+		salt: salt,
+		seen: make(map[string]struct{}),
+		stats: DeviceStats{
+			DeviceTypes: make(map[string]int),
+			Vendors:     make(map[string]int),
+		},
+	}
+}
+
+// record counts a device the first time it is seen
+func (d *deviceAnalytics) record(macAddress string) {
+	hasher := sha256.New()
+	hasher.Write(d.salt)
+	hasher.Write([]byte(strings.ToUpper(macAddress)))
+	key := hex.EncodeToString(hasher.Sum(nil))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, seen := d.seen[key]; seen {
+		return
+	}
+	d.seen[key] = struct{}{}
+
+	vendor, deviceType := utils.ClassifyDevice(macAddress)
+	d.stats.UniqueDevices++
+	d.stats.DeviceTypes[deviceType]++
+	d.stats.Vendors[vendor]++
+}
+
+// snapshot returns a copy of the current counts
+func (d *deviceAnalytics) snapshot() DeviceStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := DeviceStats{
+		UniqueDevices: d.stats.UniqueDevices,
+		DeviceTypes:   make(map[string]int, len(d.stats.DeviceTypes)),
+		Vendors:       make(map[string]int, len(d.stats.Vendors)),
+	}
+	for deviceType, count := range d.stats.DeviceTypes {
+		stats.DeviceTypes[deviceType] = count
+	}
+	for vendor, count := range d.stats.Vendors {
+		stats.Vendors[vendor] = count
+	}
+	return stats
+}
+
+// GetDeviceStats returns aggregate device counts. Counts stay empty unless analytics are enabled.
+func (m *Merchant) GetDeviceStats() DeviceStats {
+	return m.deviceAnalytics.snapshot()
+}
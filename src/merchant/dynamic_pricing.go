@@ -0,0 +1,115 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultDynamicPricingInterval applies when no interval is configured
+const defaultDynamicPricingInterval = time.Minute
+
+// surgeState is the current dynamic price and the load it was set for
+type surgeState struct {
+	mu             sync.RWMutex
+	percent        uint64 // Of the configured price per step, 0 while prices aren't surged
+	activeSessions int
+	utilization    int // Percent of the WAN capacity, -1 if not measured yet
+}
+
+// surgePercent returns the price percent of the highest step the load reached, 0 if none was reached
+func surgePercent(steps []config_manager.SurgeStep, activeSessions, utilization int) uint64 {
+	var percent uint64
+	for _, step := range steps {
+		reached := (step.ActiveSessions > 0 && activeSessions >= step.ActiveSessions) ||
+			(step.WANUtilizationPercent > 0 && utilization >= step.WANUtilizationPercent)
+		if reached && step.PricePercent > percent {
+			percent = step.PricePercent
+		}
+	}
+	return percent
+}
+
+// surgePrice applies a price percent to a price per step, rounding up so a surge never lowers the price
+func surgePrice(pricePerStep, percent uint64) uint64 {
+	if percent == 0 || pricePerStep == 0 {
+		return pricePerStep
+	}
+	return max((pricePerStep*percent+99)/100, 1)
+}
+
+// currentSurge returns the price percent applied to every mint, 0 if prices aren't surged
+func (m *Merchant) currentSurge() uint64 {
+	m.surge.mu.RLock()
+	defer m.surge.mu.RUnlock()
+	return m.surge.percent
+}
+
+// surgeTags discloses a surged price in the advertisement with the load that caused it, so customers can tell
+// it from the configured price
+func (m *Merchant) surgeTags() []nostr.Tag {
+	m.surge.mu.RLock()
+	defer m.surge.mu.RUnlock()
+	if m.surge.percent == 0 {
+		return nil
+	}
+	return []nostr.Tag{{"surge", fmt.Sprintf("%d", m.surge.percent),
+		fmt.Sprintf("%d", m.surge.activeSessions), fmt.Sprintf("%d", max(m.surge.utilization, 0))}}
+}
+
+// priceByLoad periodically measures the load and republishes the advertisement when the price changes
+func (m *Merchant) priceByLoad() {
+	for {
+		config := m.getConfig().DynamicPricing
+		interval := time.Duration(config.IntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultDynamicPricingInterval
+		}
+		time.Sleep(interval)
+
+		if m.updateSurge(config) {
+			if err := m.refreshAdvertisement(); err != nil {
+				log.Printf("Warning: failed to refresh advertisement after price change: %v", err)
+			} else {
+				m.publishAdvertisement()
+			}
+		}
+	}
+}
+
+// updateSurge sets the price percent for the current load and returns whether it changed
+func (m *Merchant) updateSurge(config config_manager.DynamicPricingConfig) bool {
+	// Sampled while disabled too, so utilization is known as soon as it is enabled
+	utilization, measured := valve.SampleWANUtilization(m.getConfig().NDS.GatewayInterface)
+	if !measured {
+		utilization = -1
+	}
+	activeSessions := m.countActiveSessions()
+
+	var percent uint64
+	if config.Enabled {
+		percent = surgePercent(config.Steps, activeSessions, utilization)
+	}
+
+	m.surge.mu.Lock()
+	previous := m.surge.percent
+	m.surge.percent = percent
+	m.surge.activeSessions = activeSessions
+	m.surge.utilization = utilization
+	m.surge.mu.Unlock()
+
+	if percent == previous {
+		return false
+	}
+	if percent == 0 {
+		log.Printf("Load down to %d active sessions and %d%% WAN utilization, back to configured prices", activeSessions, utilization)
+	} else {
+		log.Printf("Prices at %d%% for %d active sessions and %d%% WAN utilization", percent, activeSessions, utilization)
+	}
+	return true
+}
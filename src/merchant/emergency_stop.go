@@ -0,0 +1,326 @@
+package merchant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindEmergencyStop is an owner's signature of a request to halt or resume the gateway.
+// Tags: ["p", gateway pubkey], ["action", "halt" or "resume"], ["request", id shared by the co-signers].
+const KindEmergencyStop = 21033
+
+// Actions of emergency stop requests
+const (
+	emergencyHalt   = "halt"
+	emergencyResume = "resume"
+)
+
+const (
+	// emergencyStopResubscribe renews the relay subscription, so it follows changes of the owner keys
+	emergencyStopResubscribe = 15 * time.Minute
+	// emergencyStopRetryInterval is the pause before subscribing again after the subscription failed
+	emergencyStopRetryInterval = 30 * time.Second
+	// emergencyStopClockSkew is how far in the future a signature may be dated
+	emergencyStopClockSkew = 5 * time.Minute
+)
+
+// EmergencyStopStatus describes a halted gateway, for operator status events
+type EmergencyStopStatus struct {
+	Since   int64    `json:"since"`
+	Reason  string   `json:"reason,omitempty"`
+	Request string   `json:"request"`
+	Signers []string `json:"signers"`
+}
+
+// emergencyStopState is persisted, so a halted gateway stays halted across restarts
+type emergencyStopState struct {
+	Halted    bool     `json:"halted"`
+	ChangedAt int64    `json:"changed_at"` // Signatures from before the last halt or resume are stale
+	Reason    string   `json:"reason,omitempty"`
+	Request   string   `json:"request,omitempty"`
+	Signers   []string `json:"signers,omitempty"`
+}
+
+// emergencyStop collects owner signatures per request and holds whether the gateway is halted
+type emergencyStop struct {
+	mu    sync.Mutex
+	path  string
+	state emergencyStopState
+	votes map[string]map[string]nostr.Timestamp // Signature times by signer, by action and request
+}
+
+func newEmergencyStop(path string) *emergencyStop {
+	e := &emergencyStop{path: path, votes: make(map[string]map[string]nostr.Timestamp)}
+	data, err := utils.ReadState(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read emergency stop state %s: %v", path, err)
+		}
+		return e
+	}
+	if err := json.Unmarshal(data, &e.state); err != nil {
+		log.Printf("Warning: failed to parse emergency stop state %s: %v", path, err)
+	}
+	if e.state.Halted {
+		log.Printf("Alert: gateway is halted by emergency stop %s since %d, payments and the wallet are locked",
+			e.state.Request, e.state.ChangedAt)
+	}
+	return e
+}
+
+// halted returns the halt in force, nil while the gateway runs
+func (e *emergencyStop) halted() *EmergencyStopStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.state.Halted {
+		return nil
+	}
+	return &EmergencyStopStatus{
+		Since:   e.state.ChangedAt,
+		Reason:  e.state.Reason,
+		Request: e.state.Request,
+		Signers: append([]string(nil), e.state.Signers...),
+	}
+}
+
+// vote records a signature and returns the signers of the request once they reach the threshold and the
+// gateway isn't in the requested state already
+func (e *emergencyStop) vote(action, request, signer string, signedAt nostr.Timestamp, window time.Duration,
+	threshold int, reason string) (signers []string, count int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if int64(signedAt) <= e.state.ChangedAt {
+		return nil, 0, fmt.Errorf("signature predates the last halt or resume")
+	}
+	oldest := nostr.Timestamp(time.Now().Add(-window).Unix())
+	for key, signatures := range e.votes {
+		for pubkey, at := range signatures {
+			if at < oldest {
+				delete(signatures, pubkey)
+			}
+		}
+		if len(signatures) == 0 {
+			delete(e.votes, key)
+		}
+	}
+
+	key := action + ":" + request
+	if e.votes[key] == nil {
+		e.votes[key] = make(map[string]nostr.Timestamp)
+	}
+	e.votes[key][signer] = signedAt
+	count = len(e.votes[key])
+	if count < threshold || e.state.Halted == (action == emergencyHalt) {
+		return nil, count, nil
+	}
+
+	for pubkey := range e.votes[key] {
+		signers = append(signers, pubkey)
+	}
+	sort.Strings(signers)
+	e.state = emergencyStopState{
+		Halted:    action == emergencyHalt,
+		ChangedAt: time.Now().Unix(),
+		Request:   request,
+		Signers:   signers,
+	}
+	if action == emergencyHalt {
+		e.state.Reason = reason
+	}
+	e.votes = make(map[string]map[string]nostr.Timestamp)
+
+	// Written through to flash, a halt must survive a power cut
+	data, err := json.Marshal(e.state)
+	if err == nil {
+		err = utils.WriteStateDurable(e.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save emergency stop state %s: %v", e.path, err)
+	}
+	return signers, count, nil
+}
+
+// emergencyStopThreshold returns how many owner keys have to sign, 0 if remote stops aren't configured
+func emergencyStopThreshold(config config_manager.EmergencyStopConfig) int {
+	if len(config.OwnerPubkeys) == 0 {
+		return 0
+	}
+	return min(max(config.Threshold, min(2, len(config.OwnerPubkeys))), len(config.OwnerPubkeys))
+}
+
+// walletLocked returns an error while an emergency stop locks the wallet
+func (m *Merchant) walletLocked() error {
+	if halt := m.emergencyStop.halted(); halt != nil {
+		return fmt.Errorf("wallet locked by emergency stop %s", halt.Request)
+	}
+	return nil
+}
+
+// SubmitEmergencyStop records an owner's signature of an emergency stop request posted to the gateway and
+// answers with a notice telling how many signatures the request has
+func (m *Merchant) SubmitEmergencyStop(stopEvent nostr.Event) (*nostr.Event, error) {
+	message, err := m.voteEmergencyStop(&stopEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "emergency-stop-invalid", err.Error(), stopEvent.PubKey)
+	}
+	return m.CreateNoticeEvent("info", "emergency-stop-signed", message, stopEvent.PubKey)
+}
+
+// voteEmergencyStop checks an emergency stop signature and halts or resumes the gateway once its request
+// reached the quorum
+func (m *Merchant) voteEmergencyStop(event *nostr.Event) (string, error) {
+	config := m.getConfig().EmergencyStop
+	threshold := emergencyStopThreshold(config)
+	if threshold == 0 {
+		return "", fmt.Errorf("remote emergency stop is not configured")
+	}
+	if !slices.Contains(config.OwnerPubkeys, event.PubKey) {
+		return "", fmt.Errorf("not signed by an owner key")
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return "", fmt.Errorf("invalid signature")
+	}
+
+	gatewayPubkey, err := m.merchantPubkey()
+	if err != nil {
+		return "", err
+	}
+	if tag := event.Tags.Find("p"); tag == nil || tag[1] != gatewayPubkey {
+		return "", fmt.Errorf("request is for another gateway")
+	}
+	window := time.Duration(config.WindowSeconds) * time.Second
+	signedAt := event.CreatedAt.Time()
+	if time.Since(signedAt) > window || time.Until(signedAt) > emergencyStopClockSkew {
+		return "", fmt.Errorf("signature is dated outside the %s window", window)
+	}
+
+	var action, request string
+	if tag := event.Tags.Find("action"); tag != nil {
+		action = tag[1]
+	}
+	if tag := event.Tags.Find("request"); tag != nil {
+		request = tag[1]
+	}
+	if action != emergencyHalt && action != emergencyResume {
+		return "", fmt.Errorf("unknown action %q, expected %s or %s", action, emergencyHalt, emergencyResume)
+	}
+	if request == "" {
+		return "", fmt.Errorf("no request tag")
+	}
+
+	signers, count, err := m.emergencyStop.vote(action, request, event.PubKey, event.CreatedAt, window, threshold, event.Content)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Emergency stop %s to %s signed by %s, %d of %d signatures", request, action, event.PubKey, count, threshold)
+	if signers == nil {
+		return fmt.Sprintf("Signature recorded, %d of %d signatures to %s", count, threshold, action), nil
+	}
+
+	m.configManager.Audit(strings.Join(signers, ","), config_manager.AuditEmergencyStop, map[string]string{
+		"action":  action,
+		"request": request,
+		"reason":  event.Content,
+	})
+	if action == emergencyHalt {
+		m.haltGateway(request)
+		return "Gateway halted", nil
+	}
+	log.Printf("Alert: gateway resumed by emergency stop request %s", request)
+	return "Gateway resumed", nil
+}
+
+// haltGateway ends every session and closes its gate. Sessions are used up rather than paused, so they
+// aren't restored and their gates opened again when the gateway restarts.
+func (m *Merchant) haltGateway(request string) {
+	log.Printf("Alert: gateway halted by emergency stop request %s, closing all gates", request)
+	m.errorCounters.add("emergency-stop")
+
+	var macAddresses []string
+	now := time.Now()
+	m.sessionMu.Lock()
+	for macAddress, session := range m.customerSessions {
+		if !isCustomerSessionActive(session) {
+			continue
+		}
+		if session.Metric == "milliseconds" {
+			usedMs := uint64(now.UnixMilli() - session.StartTime*1000)
+			session.Allotment = min(usedMs, session.Allotment)
+		} else {
+			session.Allotment = 0
+		}
+		macAddresses = append(macAddresses, macAddress)
+	}
+	m.sessionMu.Unlock()
+
+	for _, macAddress := range macAddresses {
+		if _, err := valve.CloseGate(macAddress); err != nil {
+			log.Printf("Warning: failed to close gate of %s for emergency stop: %v", macAddress, err)
+		}
+		m.cookieRevocations.revoke(macAddress)
+		m.closeSessionGroup(macAddress)
+	}
+	if err := m.ledger.store.SaveSessions(m.activeSessions()); err != nil {
+		log.Printf("Warning: failed to save sessions after emergency stop: %v", err)
+	}
+}
+
+// merchantPubkey returns the public key the gateway signs its events with
+func (m *Merchant) merchantPubkey() (string, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return "", fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return "", fmt.Errorf("merchant identity not found: %w", err)
+	}
+	return nostr.GetPublicKey(merchantIdentity.PrivateKey)
+}
+
+// followEmergencyStops subscribes to emergency stop signatures of the owner keys on the public relays
+func (m *Merchant) followEmergencyStops() {
+	for {
+		config := m.getConfig()
+		gatewayPubkey, err := m.merchantPubkey()
+		if emergencyStopThreshold(config.EmergencyStop) == 0 || len(config.Relays) == 0 || err != nil {
+			time.Sleep(emergencyStopRetryInterval)
+			continue
+		}
+
+		window := time.Duration(config.EmergencyStop.WindowSeconds) * time.Second
+		since := nostr.Timestamp(time.Now().Add(-window).Unix())
+		filter := nostr.Filter{
+			Kinds:   []int{KindEmergencyStop},
+			Authors: config.EmergencyStop.OwnerPubkeys,
+			Tags:    nostr.TagMap{"p": []string{gatewayPubkey}},
+			Since:   &since,
+		}
+
+		pool := m.configManager.GetPublicPool()
+		ctx, cancel := context.WithTimeout(pool.Context, emergencyStopResubscribe)
+		for relayEvent := range pool.SubscribeMany(ctx, config.Relays, filter) {
+			if _, err := m.voteEmergencyStop(relayEvent.Event); err != nil {
+				log.Printf("Ignoring emergency stop event %s of %s: %v", relayEvent.Event.ID, relayEvent.Event.PubKey, err)
+			}
+		}
+		cancel()
+		if ctx.Err() != context.DeadlineExceeded {
+			time.Sleep(emergencyStopRetryInterval)
+		}
+	}
+}
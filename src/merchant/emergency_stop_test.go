@@ -0,0 +1,64 @@
+package merchant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestHaltedGatewayOpensNoGates(t *testing.T) {
+	m := newTestMerchant(t)
+	if err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.SessionCookies.Enabled = true
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	subscriber, restored := "00:11:22:33:44:08", "00:11:22:33:44:09"
+	for _, macAddress := range []string{subscriber, restored} {
+		valve.SetDryRun(macAddress, true)
+		t.Cleanup(func() {
+			valve.CloseGate(macAddress)
+			valve.SetDryRun(macAddress, false)
+		})
+	}
+
+	// A cookie issued before the restart the restore happens after
+	m.customerSessions[restored] = &CustomerSession{
+		MacAddress: restored,
+		StartTime:  time.Now().Unix(),
+		Metric:     "milliseconds",
+		Allotment:  3600000,
+		Purchases:  1,
+	}
+	cookie, _, err := m.IssueSessionCookie(restored)
+	if err != nil {
+		t.Fatalf("IssueSessionCookie() failed: %v", err)
+	}
+	delete(m.customerSessions, restored)
+	m.startTime = time.Now().Add(time.Second)
+
+	if _, _, err := m.emergencyStop.vote(emergencyHalt, "halt-test", nostr.GeneratePrivateKey(), nostr.Now(), time.Minute, 1, ""); err != nil {
+		t.Fatalf("Failed to halt the gateway: %v", err)
+	}
+
+	sub := subscription{ID: "sub", MacAddress: subscriber, MinutesPerDay: 60, Days: 1, StartedAt: time.Now().Unix()}
+	if _, err := m.grantSubscriptionDay(sub); err == nil {
+		t.Error("Expected the subscription grant to fail while halted")
+	}
+	if _, err := m.RestoreSessionFromCookie(cookie, restored); err == nil {
+		t.Error("Expected the cookie restore to fail while halted")
+	}
+
+	for _, macAddress := range []string{subscriber, restored} {
+		if valve.IsGateOpen(macAddress) {
+			t.Errorf("Gate of %s opened while the gateway is halted", macAddress)
+		}
+		if m.GetSessionStatus(macAddress).Active {
+			t.Errorf("Session of %s is active while the gateway is halted", macAddress)
+		}
+	}
+}
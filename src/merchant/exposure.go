@@ -0,0 +1,118 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// Exposure policies applied when the balance held at a mint exceeds its cap
+const (
+	ExposurePolicyPayout = "payout" // Pay out right away (default)
+	ExposurePolicyPause  = "pause"  // Stop accepting the mint until payouts bring the balance under the cap
+)
+
+// exposureState tracks mints over their exposure cap
+type exposureState struct {
+	mu        sync.Mutex
+	paused    map[string]string // Why each paused mint is paused
+	payingOut map[string]bool   // Mints with a payout triggered by their cap in progress
+}
+
+func newExposureState() *exposureState {
+	return &exposureState{
+		paused:    make(map[string]string),
+		payingOut: make(map[string]bool),
+	}
+}
+
+// isPaused reports whether a mint is paused for holding more than its cap
+func (e *exposureState) isPaused(mintURL string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, paused := e.paused[mintURL]
+	return paused
+}
+
+// alerts returns why each paused mint is paused
+func (e *exposureState) alerts() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alerts := make(map[string]string, len(e.paused))
+	for mintURL, reason := range e.paused {
+		alerts[mintURL] = reason
+	}
+	return alerts
+}
+
+// checkExposure limits the counterparty risk of a mint after its balance grew: a balance over the cap is
+// paid out right away, or the mint is paused until the scheduled payouts bring the balance back under it
+func (m *Merchant) checkExposure(mintURL string) {
+	mint := m.findMintConfig(mintURL)
+	if mint == nil || mint.MaxExposure == 0 {
+		return
+	}
+
+	if mint.ExposurePolicy == ExposurePolicyPause {
+		m.updateExposurePause(*mint)
+		return
+	}
+
+	balance := m.tollwallet.GetBalanceByMint(mintURL)
+	if balance <= mint.MaxExposure {
+		return
+	}
+
+	m.exposure.mu.Lock()
+	if m.exposure.payingOut[mintURL] {
+		m.exposure.mu.Unlock()
+		return
+	}
+	m.exposure.payingOut[mintURL] = true
+	m.exposure.mu.Unlock()
+
+	log.Printf("Holding %d sats at %s, over its exposure cap of %d, paying out now", balance, mintURL, mint.MaxExposure)
+	go func() {
+		defer func() {
+			m.exposure.mu.Lock()
+			delete(m.exposure.payingOut, mintURL)
+			m.exposure.mu.Unlock()
+		}()
+		m.processPayout(*mint)
+	}()
+}
+
+// updateExposurePause pauses a mint whose balance is over its cap and resumes it once the balance
+// is back under it, republishing the advertisement so customers only see mints they can pay with
+func (m *Merchant) updateExposurePause(mint config_manager.MintConfig) {
+	balance := m.tollwallet.GetBalanceByMint(mint.URL)
+	pause := mint.ExposurePolicy == ExposurePolicyPause && mint.MaxExposure > 0 && balance > mint.MaxExposure
+
+	m.exposure.mu.Lock()
+	_, wasPaused := m.exposure.paused[mint.URL]
+	if pause {
+		m.exposure.paused[mint.URL] = fmt.Sprintf("holding %d sats, over the exposure cap of %d, mint paused until paid out",
+			balance, mint.MaxExposure)
+	} else {
+		delete(m.exposure.paused, mint.URL)
+	}
+	m.exposure.mu.Unlock()
+
+	if pause == wasPaused {
+		return
+	}
+	if pause {
+		log.Printf("ALERT: Mint %s: holding %d sats, over its exposure cap of %d, pausing it", mint.URL, balance, mint.MaxExposure)
+		m.errorCounters.add("mint-exposure-paused")
+	} else {
+		log.Printf("Mint %s is back under its exposure cap, accepting it again", mint.URL)
+	}
+	if err := m.refreshAdvertisement(); err != nil {
+		log.Printf("Warning: failed to refresh advertisement after exposure change of %s: %v", mint.URL, err)
+	} else {
+		go m.publishAdvertisement()
+	}
+}
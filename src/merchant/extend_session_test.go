@@ -0,0 +1,81 @@
+package merchant
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestExtendedAllotment(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name              string
+		metric            string
+		existing          uint64
+		additional        uint64
+		createdAt         time.Time
+		expectedRemaining uint64
+		expectedTotal     uint64
+	}{
+		{"Fresh time session", "milliseconds", 600000, 300000, now, 600000, 900000},
+		{"Partly used time session", "milliseconds", 600000, 300000, now.Add(-4 * time.Minute), 360000, 660000},
+		{"Expired time session", "milliseconds", 600000, 300000, now.Add(-time.Hour), 0, 300000},
+		{"Exactly used up time session", "milliseconds", 600000, 300000, now.Add(-10 * time.Minute), 0, 300000},
+		{"Session created in the future", "milliseconds", 600000, 300000, now.Add(time.Minute), 600000, 900000},
+		{"Data session carries over in full", "bytes", 5000000, 1000000, now.Add(-time.Hour), 5000000, 6000000},
+		{"Nothing added", "milliseconds", 600000, 0, now.Add(-time.Minute), 540000, 540000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, total := extendedAllotment(tt.metric, tt.existing, tt.additional, tt.createdAt, now)
+			if remaining != tt.expectedRemaining || total != tt.expectedTotal {
+				t.Errorf("extendedAllotment() = (%d, %d), want (%d, %d)",
+					remaining, total, tt.expectedRemaining, tt.expectedTotal)
+			}
+		})
+	}
+}
+
+func TestExtendSessionEvent(t *testing.T) {
+	m := newTestMerchant(t)
+
+	existing := &nostr.Event{
+		Kind:      1022,
+		CreatedAt: nostr.Timestamp(time.Now().Add(-4 * time.Minute).Unix()),
+		Tags: nostr.Tags{
+			{"p", "customer"},
+			{"device-identifier", "mac", "aa:bb:cc:dd:ee:ff"},
+			{"allotment", "600000"},
+			{"metric", "milliseconds"},
+		},
+	}
+
+	extended, err := m.extendSessionEvent(existing, 300000)
+	if err != nil {
+		t.Fatalf("extendSessionEvent() failed: %v", err)
+	}
+
+	for name, value := range map[string]string{"metric": "milliseconds", "original-allotment": "600000"} {
+		if tag := extended.Tags.Find(name); tag == nil || tag[1] != value {
+			t.Errorf("extended session %s tag = %v, want %s", name, tag, value)
+		}
+	}
+	// The existing event's timestamp has whole seconds, up to a second more may have passed
+	for name, value := range map[string]uint64{"allotment": 660000, "remaining-allotment": 360000} {
+		tag := extended.Tags.Find(name)
+		if tag == nil {
+			t.Errorf("extended session has no %s tag", name)
+			continue
+		}
+		got, err := strconv.ParseUint(tag[1], 10, 64)
+		if err != nil || got > value || got < value-1000 {
+			t.Errorf("extended session %s = %s, want %d (within a second)", name, tag[1], value)
+		}
+	}
+	if ok, err := extended.CheckSignature(); err != nil || !ok {
+		t.Errorf("extended session event is not signed by the merchant")
+	}
+}
@@ -0,0 +1,252 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fairUsePollInterval is how often the daily traffic of devices is checked against the fair-use caps
+const fairUsePollInterval = time.Minute
+
+// defaultFairUseThrottleKbps applies when the config leaves the rate of capped devices at 0
+const defaultFairUseThrottleKbps = 256
+
+// fairUseDevice is the traffic a device used today. Traffic samples count since the gate opened, so the opening
+// last counted and its bytes already counted are kept to add only what is new.
+type fairUseDevice struct {
+	Used        uint64 `json:"used"` // Bytes today
+	OpenedAt    int64  `json:"opened_at"`
+	Counted     uint64 `json:"counted"`
+	ThrottledAt int64  `json:"throttled_at,omitempty"` // Opening of the gate that was throttled, 0 if none
+	Tier        string `json:"tier,omitempty"`         // Restored when the day ends
+}
+
+// fairUseStore is persisted as JSON next to the wallet, so a restart doesn't reset the caps
+type fairUseStore struct {
+	Day     string                    `json:"day"` // Local date the traffic was counted on
+	Devices map[string]*fairUseDevice `json:"devices"`
+}
+
+// fairUse counts the daily traffic of devices for the fair-use caps
+type fairUse struct {
+	mu    sync.Mutex
+	path  string
+	store fairUseStore
+}
+
+func newFairUse(path string) *fairUse {
+	f := &fairUse{path: path, store: fairUseStore{Devices: make(map[string]*fairUseDevice)}}
+	data, err := utils.ReadState(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read fair-use counters %s: %v", path, err)
+		}
+		return f
+	}
+	if err := json.Unmarshal(data, &f.store); err != nil {
+		log.Printf("Warning: failed to parse fair-use counters %s, starting empty: %v", path, err)
+		f.store = fairUseStore{}
+	}
+	if f.store.Devices == nil {
+		f.store.Devices = make(map[string]*fairUseDevice)
+	}
+	return f
+}
+
+// startDay resets the daily traffic when the day changed, and returns the throttled devices with their tiers
+func (f *fairUse) startDay(day string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.store.Day == day {
+		return nil
+	}
+	throttled := make(map[string]string)
+	for macAddress, device := range f.store.Devices {
+		if device.ThrottledAt != 0 {
+			throttled[macAddress] = device.Tier
+		}
+		device.Used = 0
+		device.ThrottledAt = 0
+	}
+	f.store.Day = day
+	f.save()
+	return throttled
+}
+
+// count adds the traffic of a usage sample not counted yet, and returns the bytes the device used today
+func (f *fairUse) count(usage valve.Usage) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	device, exists := f.store.Devices[usage.MacAddress]
+	if !exists {
+		device = &fairUseDevice{}
+		f.store.Devices[usage.MacAddress] = device
+	}
+	total := usage.Downloaded + usage.Uploaded
+	added := total
+	if device.OpenedAt == usage.OpenedAt && total >= device.Counted {
+		added = total - device.Counted
+	}
+	device.OpenedAt = usage.OpenedAt
+	device.Counted = total
+	device.Used += added
+	return device.Used
+}
+
+// throttled reports whether the gate opening of a device was throttled for its cap
+func (f *fairUse) throttled(macAddress string, openedAt int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	device, exists := f.store.Devices[macAddress]
+	return exists && device.ThrottledAt != 0 && device.ThrottledAt == openedAt
+}
+
+// isThrottled reports whether a device is throttled for its cap
+func (f *fairUse) isThrottled(macAddress string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	device, exists := f.store.Devices[macAddress]
+	return exists && device.ThrottledAt != 0
+}
+
+// setThrottled records the gate opening of a device that was throttled
+func (f *fairUse) setThrottled(macAddress, tier string, openedAt int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if device, exists := f.store.Devices[macAddress]; exists {
+		device.ThrottledAt = openedAt
+		device.Tier = tier
+	}
+}
+
+// forget drops the devices that used nothing today and aren't in active, and saves the counters
+func (f *fairUse) forget(active map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for macAddress, device := range f.store.Devices {
+		if !active[macAddress] && device.Used == 0 {
+			delete(f.store.Devices, macAddress)
+		}
+	}
+	f.save()
+}
+
+// save writes the counters to the store. Caller must hold mu.
+func (f *fairUse) save() {
+	data, err := json.Marshal(f.store)
+	if err != nil {
+		log.Printf("Warning: failed to encode fair-use counters: %v", err)
+		return
+	}
+	if err := utils.WriteState(f.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save fair-use counters %s: %v", f.path, err)
+	}
+}
+
+// usageTrackingFor returns the usage tracker config, enabled while fair-use caps count its samples
+func usageTrackingFor(config *config_manager.Config) config_manager.UsageConfig {
+	usage := config.Usage
+	usage.Enabled = usage.Enabled || config.FairUse.Enabled
+	return usage
+}
+
+// fairUseTags discloses the daily caps in the advertisement: the cap of every tier without a cap of its own,
+// then a tag per tier with its own cap
+func fairUseTags(config *config_manager.Config) []nostr.Tag {
+	fairUse := config.FairUse
+	if !fairUse.Enabled {
+		return nil
+	}
+	rate := fairUse.ThrottleKbps
+	if rate <= 0 {
+		rate = defaultFairUseThrottleKbps
+	}
+	var tags []nostr.Tag
+	if fairUse.DailyBytes > 0 {
+		tags = append(tags, nostr.Tag{"fair_use", fmt.Sprintf("%d", fairUse.DailyBytes), fmt.Sprintf("%d", rate)})
+	}
+	for _, tier := range config.TierLadder() {
+		if dailyBytes, exists := fairUse.TierDailyBytes[tier.Name]; exists {
+			tags = append(tags, nostr.Tag{"fair_use", fmt.Sprintf("%d", dailyBytes), fmt.Sprintf("%d", rate), tier.Name})
+		}
+	}
+	return tags
+}
+
+// enforceFairUse periodically throttles devices over their daily cap, and restores them when the day ends
+func (m *Merchant) enforceFairUse() {
+	for {
+		time.Sleep(fairUsePollInterval)
+		m.enforceFairUseOnce(m.getConfig(), time.Now())
+	}
+}
+
+func (m *Merchant) enforceFairUseOnce(config *config_manager.Config, now time.Time) {
+	// Disabling the caps lifts them as a new day would
+	day := now.Format(time.DateOnly)
+	if !config.FairUse.Enabled {
+		day = ""
+	}
+	for macAddress, tier := range m.fairUse.startDay(day) {
+		if err := valve.RestoreTierLimit(macAddress, tier); err != nil {
+			// Closed gates reopen at the rate of their tier anyway
+			continue
+		}
+		log.Printf("Restored %s tier bandwidth of %s after its fair-use cap", tier, macAddress)
+	}
+	if !config.FairUse.Enabled {
+		return
+	}
+
+	rate := config.FairUse.ThrottleKbps
+	if rate <= 0 {
+		rate = defaultFairUseThrottleKbps
+	}
+	active := make(map[string]bool)
+	for _, session := range m.activeSessions() {
+		devices := append([]string{session.MacAddress}, m.groupMembers(session.MacAddress)...)
+		dailyBytes := config.FairUse.DailyBytesFor(session.Tier)
+		for _, macAddress := range devices {
+			active[macAddress] = true
+			usage, sampled := valve.LastUsage(macAddress)
+			if !sampled || usage.ClosedAt != 0 {
+				continue
+			}
+			used := m.fairUse.count(usage)
+			if dailyBytes == 0 || used < dailyBytes || m.fairUse.throttled(macAddress, usage.OpenedAt) {
+				continue
+			}
+
+			if err := valve.ThrottleGate(macAddress, rate); err != nil {
+				log.Printf("Warning: failed to throttle %s over its fair-use cap: %v", macAddress, err)
+				continue
+			}
+			m.fairUse.setThrottled(macAddress, session.Tier, usage.OpenedAt)
+			log.Printf("Throttled %s to %d kbps after %d bytes today, over its fair-use cap of %d", macAddress, rate, used, dailyBytes)
+
+			if session.Pubkey == "" {
+				continue
+			}
+			notice, err := m.CreateNoticeEvent("warning", "fair-use-cap-reached",
+				fmt.Sprintf("Device %s used %d of the %d bytes a device may use per day and is limited to %d kbps until midnight",
+					macAddress, used, dailyBytes, rate), session.Pubkey)
+			if err != nil {
+				log.Printf("Failed to create fair-use notice for %s: %v", macAddress, err)
+				continue
+			}
+			m.publisher.Publish(notice)
+		}
+	}
+	m.fairUse.forget(active)
+}
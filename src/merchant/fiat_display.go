@@ -0,0 +1,230 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// fiatRepublishChange is how far the rate moves before the advertisement is published again
+	fiatRepublishChange = 0.02
+	defaultFiatRefresh  = 30 * time.Minute
+	fiatRateTimeout     = 10 * time.Second
+)
+
+// fiatRate is the price of one bitcoin in the display currency, fetched from the operator's rate source
+type fiatRate struct {
+	mu         sync.RWMutex
+	currency   string
+	perBTC     float64
+	advertised float64 // Rate in the published advertisement
+	updatedAt  int64
+	wake       chan struct{}
+}
+
+// FiatPrice is the fiat equivalent of a mint's price, for display only
+type FiatPrice struct {
+	Currency   string  `json:"currency"`
+	Amount     float64 `json:"amount"`
+	Per        string  `json:"per"` // "hour" for time-based pricing, "gb" for data
+	RatePerBTC float64 `json:"rate_per_btc"`
+	UpdatedAt  int64   `json:"updated_at"`
+}
+
+// watchFiatRate fetches the rate at the configured interval, or when the config changed,
+// and publishes the advertisement again when the rate moved noticeably
+func (m *Merchant) watchFiatRate() {
+	for {
+		config := m.getConfig().FiatDisplay
+		if config.Enabled {
+			rate, err := fetchFiatRate(config)
+			if err != nil {
+				log.Printf("Warning: failed to fetch %s rate: %v", config.Currency, err)
+			} else if m.setFiatRate(config.Currency, rate) {
+				if err := m.refreshAdvertisement(); err != nil {
+					log.Printf("Warning: failed to refresh advertisement after %s rate change: %v", config.Currency, err)
+				} else {
+					m.publishAdvertisement()
+				}
+			}
+		}
+
+		interval := time.Duration(config.RefreshMinutes) * time.Minute
+		if interval <= 0 {
+			interval = defaultFiatRefresh
+		}
+		select {
+		case <-m.fiat.wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// wakeFiatRate fetches the rate again right away, after the config changed
+func (m *Merchant) wakeFiatRate() {
+	select {
+	case m.fiat.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setFiatRate stores a fetched rate and reports whether it moved enough to publish the advertisement again
+func (m *Merchant) setFiatRate(currency string, perBTC float64) bool {
+	m.fiat.mu.Lock()
+	defer m.fiat.mu.Unlock()
+
+	m.fiat.perBTC = perBTC
+	m.fiat.updatedAt = time.Now().Unix()
+	if currency != m.fiat.currency || m.fiat.advertised == 0 ||
+		math.Abs(perBTC-m.fiat.advertised)/m.fiat.advertised >= fiatRepublishChange {
+		m.fiat.currency = currency
+		m.fiat.advertised = perBTC
+		return true
+	}
+	return false
+}
+
+// currentFiatRate returns the advertised rate of the configured currency, false if there is none
+func (m *Merchant) currentFiatRate(config config_manager.FiatDisplayConfig) (float64, int64, bool) {
+	if !config.Enabled {
+		return 0, 0, false
+	}
+	m.fiat.mu.RLock()
+	defer m.fiat.mu.RUnlock()
+	if m.fiat.currency != config.Currency || m.fiat.advertised <= 0 {
+		return 0, 0, false
+	}
+	return m.fiat.advertised, m.fiat.updatedAt, true
+}
+
+// fetchFiatRate returns the price of one bitcoin from the rate source, or the fixed rate without one
+func fetchFiatRate(config config_manager.FiatDisplayConfig) (float64, error) {
+	if config.RateURL == "" {
+		if config.FixedRate <= 0 {
+			return 0, fmt.Errorf("neither a rate URL nor a fixed rate is configured")
+		}
+		return config.FixedRate, nil
+	}
+
+	client := &http.Client{Timeout: fiatRateTimeout}
+	resp, err := client.Get(config.RateURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach %s: %w", config.RateURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", config.RateURL, resp.Status)
+	}
+
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to parse response of %s: %w", config.RateURL, err)
+	}
+	return rateAtPath(body, config.RatePath)
+}
+
+// rateAtPath follows a dot-separated path through a decoded JSON document to a positive number,
+// which rate sources give as a JSON number or a string
+func rateAtPath(document any, path string) (float64, error) {
+	value := document
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			object, isObject := value.(map[string]any)
+			if !isObject {
+				return 0, fmt.Errorf("no %q in rate response", path)
+			}
+			value = object[key]
+		}
+	}
+
+	var rate float64
+	switch v := value.(type) {
+	case float64:
+		rate = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("rate %q at %q is not a number", v, path)
+		}
+		rate = parsed
+	default:
+		return 0, fmt.Errorf("no rate at %q in rate response", path)
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf("invalid rate %v at %q", rate, path)
+	}
+	return rate, nil
+}
+
+// fiatPrice converts the price of a mint to the display currency, per hour of time-based or per GB of data sessions
+func fiatPrice(config *config_manager.Config, mint config_manager.MintConfig, perBTC float64) (float64, string) {
+	stepSize := config.StepSizeFor(mint)
+	if stepSize == 0 {
+		return 0, ""
+	}
+	per, unitSize := "gb", float64(1_000_000_000)
+	if config.MetricFor(mint) == "milliseconds" {
+		per, unitSize = "hour", float64(time.Hour.Milliseconds())
+	}
+	price := float64(mint.PricePerStep) * unitSize / float64(stepSize)
+	switch unit, _ := config_manager.NormalizeUnit(mint.PriceUnit); unit {
+	case config_manager.UnitMsat:
+		return price / 1000 * perBTC / 100_000_000, per
+	case config_manager.UnitUSD:
+		// Cents, only payable while the display currency is USD
+		return price / 100, per
+	default:
+		return price * perBTC / 100_000_000, per
+	}
+}
+
+// formatFiat writes a fiat amount with enough decimals for the sub-cent prices of short steps
+func formatFiat(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 4, 64)
+}
+
+// mintFiatPrice returns the fiat equivalent of a mint's price, nil if fiat display is off or has no rate yet
+func (m *Merchant) mintFiatPrice(config *config_manager.Config, mint config_manager.MintConfig) *FiatPrice {
+	perBTC, updatedAt, ok := m.currentFiatRate(config.FiatDisplay)
+	if !ok {
+		return nil
+	}
+	amount, per := fiatPrice(config, mint, perBTC)
+	if per == "" {
+		return nil
+	}
+	return &FiatPrice{
+		Currency:   config.FiatDisplay.Currency,
+		Amount:     amount,
+		Per:        per,
+		RatePerBTC: perBTC,
+		UpdatedAt:  updatedAt,
+	}
+}
+
+// fiatTags advertises the rate and the fiat equivalent of each mint's price as
+// ["fiat_rate", currency, price of a bitcoin, updated at] and ["fiat_price", currency, amount, per, mint URL]
+func (m *Merchant) fiatTags(config *config_manager.Config, mints []config_manager.MintConfig) []nostr.Tag {
+	perBTC, updatedAt, ok := m.currentFiatRate(config.FiatDisplay)
+	if !ok {
+		return nil
+	}
+	currency := config.FiatDisplay.Currency
+	tags := []nostr.Tag{{"fiat_rate", currency, formatFiat(perBTC), fmt.Sprintf("%d", updatedAt)}}
+	for _, mint := range mints {
+		if amount, per := fiatPrice(config, mint, perBTC); per != "" {
+			tags = append(tags, nostr.Tag{"fiat_price", currency, formatFiat(amount), per, mint.URL})
+		}
+	}
+	return tags
+}
@@ -0,0 +1,90 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GateLatencyMetrics reports gates that opened slower than the latency budget since startup
+type GateLatencyMetrics struct {
+	Slow     uint64 `json:"slow"`     // Purchases whose gate took longer than the budget
+	Credited uint64 `json:"credited"` // Allotment granted as compensation, in the metric of each session
+	MaxMs    int64  `json:"max_ms"`   // Slowest gate opening
+}
+
+// gateLatency counts the gates that opened over budget
+type gateLatency struct {
+	mu      sync.Mutex
+	metrics GateLatencyMetrics
+}
+
+func (g *gateLatency) record(latency time.Duration, credit uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.metrics.Slow++
+	g.metrics.Credited += credit
+	g.metrics.MaxMs = max(g.metrics.MaxMs, latency.Milliseconds())
+}
+
+func (g *gateLatency) snapshot() GateLatencyMetrics {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.metrics
+}
+
+// gateLatencyCredit returns the compensation for a gate that took latency to open: the configured share
+// of the allotment bought, and at least the time lost for time-based sessions. 0 if within budget.
+func gateLatencyCredit(config config_manager.GateLatencyConfig, metric string, allotment uint64, latency time.Duration) uint64 {
+	if config.BudgetMs == 0 || latency <= time.Duration(config.BudgetMs)*time.Millisecond {
+		return 0
+	}
+	credit := allotment * config.CreditPercent / 100
+	if metric == "milliseconds" {
+		credit = max(credit, uint64(latency.Milliseconds()))
+	}
+	return credit
+}
+
+// compensateSlowGate credits the session of a purchase whose gate opened over the latency budget,
+// records the degradation and returns the tags telling the customer about the credit
+func (m *Merchant) compensateSlowGate(paymentEvent nostr.Event, macAddress, metric, tier string, allotment uint64, latency time.Duration) []nostr.Tag {
+	credit := gateLatencyCredit(m.getConfig().GateLatency, metric, allotment, latency)
+	if credit == 0 {
+		return nil
+	}
+
+	m.sessionMu.Lock()
+	session, exists := m.customerSessions[macAddress]
+	if !exists || session.Metric != metric {
+		m.sessionMu.Unlock()
+		return nil
+	}
+	session.Allotment += credit
+	snapshot := *session
+	m.sessionMu.Unlock()
+
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(&snapshot), tier); err != nil {
+		log.Printf("Warning: failed to extend gate of %s for its latency credit: %v", macAddress, err)
+	}
+	m.gateLatency.record(latency, credit)
+	m.errorCounters.add("gate-latency-exceeded")
+
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerCompensation,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		Allotment:  credit,
+		Metric:     metric,
+		EventID:    paymentEvent.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record latency credit of %s: %v", macAddress, err)
+	}
+	log.Printf("Gate of %s took %s to open, over the budget: credited %d %s", macAddress, latency.Round(time.Millisecond), credit, metric)
+
+	return []nostr.Tag{{"latency-credit", fmt.Sprintf("%d", credit), fmt.Sprintf("%d", latency.Milliseconds())}}
+}
@@ -0,0 +1,68 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// gift is the device a payment buys access for instead of the payer's own device
+type gift struct {
+	macAddress string
+	pubkey     string // Recipient receiving a copy of the session, empty if the payer didn't name one
+}
+
+// extractGift returns the gift of a payment event, or nil if the payer buys for their own device.
+// The tag is ["gift", <mac address>, <optional recipient pubkey>].
+func extractGift(paymentEvent nostr.Event) *gift {
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "gift" {
+			g := &gift{macAddress: tag[1]}
+			if len(tag) >= 3 {
+				g.pubkey = tag[2]
+			}
+			return g
+		}
+	}
+	return nil
+}
+
+// checkGift validates a gift before the payment is redeemed
+func (m *Merchant) checkGift(g *gift, payerMAC string) error {
+	config := m.getConfig().Gifts
+	if !config.Enabled {
+		return fmt.Errorf("this gateway does not offer gifts")
+	}
+	if !utils.ValidateMACAddress(g.macAddress) {
+		return fmt.Errorf("invalid gift MAC address: %s", g.macAddress)
+	}
+	if utils.NormalizeMAC(g.macAddress) == utils.NormalizeMAC(payerMAC) {
+		return fmt.Errorf("gift is for the paying device, pay without a gift tag instead")
+	}
+	if g.pubkey != "" && !nostr.IsValidPublicKey(g.pubkey) {
+		return fmt.Errorf("invalid gift recipient pubkey: %s", g.pubkey)
+	}
+	if config.RequireLease {
+		if _, found := m.leaseTable().ByMAC(g.macAddress); !found {
+			return fmt.Errorf("device %s is not connected to this gateway", g.macAddress)
+		}
+	}
+	return nil
+}
+
+// sendGiftReceipt publishes the session bought by a gift to its recipient, the payer gets the session as response
+func (m *Merchant) sendGiftReceipt(session *CustomerSession, g *gift, payerPubkey string, extraTags ...nostr.Tag) {
+	if g.pubkey == "" {
+		return
+	}
+
+	tags := append([]nostr.Tag{{"gift-from", payerPubkey}}, extraTags...)
+	sessionEvent, err := m.createSessionEvent(session, g.pubkey, tags...)
+	if err != nil {
+		log.Printf("Failed to create gift receipt for %s: %v", g.macAddress, err)
+		return
+	}
+	m.publisher.Publish(sessionEvent)
+}
@@ -0,0 +1,51 @@
+package merchant
+
+import (
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAccessProbeIgnoresGift(t *testing.T) {
+	m := newTestMerchant(t)
+	if err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.Gifts.Enabled = true
+		config.Gifts.RequireLease = false
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	payer, recipient := "00:11:22:33:44:01", "00:11:22:33:44:02"
+	if _, err := m.AddAllotment(recipient, "milliseconds", 600000); err != nil {
+		t.Fatalf("AddAllotment failed: %v", err)
+	}
+
+	probe := nostr.Event{
+		Kind:   21000,
+		PubKey: nostr.GeneratePrivateKey(),
+		Tags: nostr.Tags{
+			{"device-identifier", "mac", payer},
+			{"payment", ""},
+			{"gift", recipient},
+		},
+	}
+	response, err := m.PurchaseSession(probe)
+	if err != nil {
+		t.Fatalf("Access probe failed: %v", err)
+	}
+	if response.Kind == 1022 {
+		t.Fatalf("Expected the probe of %s not to reveal the session of %s, got %v", payer, recipient, response.Tags)
+	}
+
+	// Without a gift the device still learns its own status
+	probe.Tags = nostr.Tags{{"device-identifier", "mac", recipient}, {"payment", ""}}
+	response, err = m.PurchaseSession(probe)
+	if err != nil {
+		t.Fatalf("Access probe failed: %v", err)
+	}
+	if response.Kind != 1022 {
+		t.Errorf("Expected the session of %s, got kind %d: %s", recipient, response.Kind, response.Content)
+	}
+}
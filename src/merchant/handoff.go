@@ -0,0 +1,246 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event kinds of a session handoff between gateways of the same fleet
+const (
+	KindSessionExportRequest = 21025 // Customer asks to take the rest of their session elsewhere
+	KindSessionProof         = 21026 // Merchant attests the remaining allotment, redeemable once within the fleet
+	KindSessionHandoff       = 21027 // Customer presents a session proof to another gateway
+)
+
+// defaultProofTTL applies when no proof TTL is configured
+const defaultProofTTL = time.Hour
+
+// ExportSession ends the customer's session on this gateway and returns a signed session proof
+// for the remaining allotment, which an affiliated gateway credits on import
+func (m *Merchant) ExportSession(requestEvent nostr.Event) (*nostr.Event, error) {
+	config := m.getConfig()
+	if !config.Fleet.HandoffEnabled {
+		return m.CreateNoticeEvent("error", "handoff-disabled", "This TollGate does not hand over sessions", requestEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(requestEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), requestEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), requestEvent.PubKey)
+	}
+
+	metric, tier, remaining := m.takeRemainingAllotment(macAddress)
+	if remaining == 0 {
+		return m.CreateNoticeEvent("error", "no-active-session", "No active session to export", requestEvent.PubKey)
+	}
+
+	if _, err := valve.CloseGate(macAddress); err != nil {
+		log.Printf("Warning: failed to close gate for exported session of %s: %v", macAddress, err)
+	}
+	m.cookieRevocations.revoke(macAddress)
+	m.closeSessionGroup(macAddress)
+
+	ttl := time.Duration(config.Fleet.ProofTTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = defaultProofTTL
+	}
+
+	proofEvent := &nostr.Event{
+		Kind:      KindSessionProof,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", requestEvent.PubKey},
+			{"device-identifier", "mac", macAddress},
+			{"metric", metric},
+			{"remaining", fmt.Sprintf("%d", remaining)},
+			{"tier", tier},
+			{"expiration", fmt.Sprintf("%d", time.Now().Add(ttl).Unix())},
+		},
+		Content: "",
+	}
+	if err := m.signMerchantEvent(proofEvent); err != nil {
+		return nil, fmt.Errorf("failed to sign session proof: %w", err)
+	}
+
+	log.Printf("Exported session of %s with %d %s remaining as proof %s", macAddress, remaining, metric, proofEvent.ID)
+	return proofEvent, nil
+}
+
+// takeRemainingAllotment ends the session of a device and returns what was left of it
+func (m *Merchant) takeRemainingAllotment(macAddress string) (metric, tier string, remaining uint64) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	session, exists := m.customerSessions[macAddress]
+	if !exists || !isCustomerSessionActive(session) {
+		return "", "", 0
+	}
+
+	if session.Metric != "milliseconds" {
+		remaining = session.Allotment
+		session.Allotment = 0
+		return session.Metric, session.Tier, remaining
+	}
+
+	usedMs := uint64(time.Now().UnixMilli() - session.StartTime*1000)
+	if usedMs >= session.Allotment {
+		return "", "", 0
+	}
+	remaining = session.Allotment - usedMs
+	session.Allotment = usedMs
+	return session.Metric, session.Tier, remaining
+}
+
+// ImportSession verifies a session proof from a trusted fleet gateway and credits the remaining allotment
+func (m *Merchant) ImportSession(handoffEvent nostr.Event) (*nostr.Event, error) {
+	config := m.getConfig()
+	if !config.Fleet.HandoffEnabled {
+		return m.CreateNoticeEvent("error", "handoff-disabled", "This TollGate does not accept session handoffs", handoffEvent.PubKey)
+	}
+	if m.emergencyStop.halted() != nil {
+		return m.CreateNoticeEvent("error", "gateway-halted", "This TollGate is out of service", handoffEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(handoffEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), handoffEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), handoffEvent.PubKey)
+	}
+
+	proofTag := handoffEvent.Tags.Find("proof")
+	if proofTag == nil {
+		return m.CreateNoticeEvent("error", "invalid-session-proof", "No proof tag found in event", handoffEvent.PubKey)
+	}
+	var proofEvent nostr.Event
+	if err := json.Unmarshal([]byte(proofTag[1]), &proofEvent); err != nil {
+		return m.CreateNoticeEvent("error", "invalid-session-proof",
+			fmt.Sprintf("Failed to parse session proof: %v", err), handoffEvent.PubKey)
+	}
+
+	remaining, tier, expiresAt, err := verifySessionProof(proofEvent, handoffEvent.PubKey, config.Fleet.TrustedGateways, config.Metric, config.BaseTier(), config.NDS.GatewayInterface)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-session-proof", err.Error(), handoffEvent.PubKey)
+	}
+
+	if !m.checkCapacity(macAddress) {
+		return m.CreateNoticeEvent("error", "capacity-full",
+			"No capacity left for new sessions, try again later", handoffEvent.PubKey)
+	}
+
+	if err := m.redeemedProofs.redeem(proofEvent.ID, expiresAt); err != nil {
+		return m.CreateNoticeEvent("error", "session-proof-redeemed", err.Error(), handoffEvent.PubKey)
+	}
+
+	credit := remaining * config.Fleet.HandoffCreditPercent / 100
+	if credit == 0 {
+		return m.CreateNoticeEvent("error", "session-proof-empty", "Session proof carries no allotment", handoffEvent.PubKey)
+	}
+
+	session, err := m.AddAllotment(macAddress, config.Metric, credit)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "session-management-failed",
+			fmt.Sprintf("Failed to manage session: %v", err), handoffEvent.PubKey)
+	}
+
+	var endTimestamp int64
+	if session.Metric == "milliseconds" {
+		endTimestamp = session.StartTime + int64(session.Allotment/1000)
+	} else {
+		endTimestamp = time.Now().Unix() + (24 * 60 * 60) // 24 hours from now
+	}
+
+	if _, err := m.openGate(macAddress, endTimestamp, tier); err != nil {
+		return m.CreateNoticeEvent("error", "gate-opening-failed",
+			fmt.Sprintf("Failed to open gate for session: %v", err), handoffEvent.PubKey)
+	}
+	m.setSessionTier(macAddress, tier)
+	m.recordCustomerSession(handoffEvent.PubKey, endTimestamp)
+
+	log.Printf("Imported session proof %s from %s: credited %d %s to %s", proofEvent.ID, proofEvent.PubKey, credit, config.Metric, macAddress)
+
+	return m.createSessionEvent(session, handoffEvent.PubKey, nostr.Tag{"handoff", proofEvent.ID, proofEvent.PubKey})
+}
+
+// verifySessionProof checks that a proof was issued by a trusted gateway to the presenting customer
+// and returns the remaining allotment, tier and expiration it attests. Proofs naming no known tier get the base tier.
+func verifySessionProof(proofEvent nostr.Event, customerPubkey string, trustedGateways []string, metric, baseTier, iface string) (uint64, string, int64, error) {
+	if proofEvent.Kind != KindSessionProof {
+		return 0, "", 0, fmt.Errorf("proof has kind %d, expected %d", proofEvent.Kind, KindSessionProof)
+	}
+	// The signature covers the content, not the ID, which keys the redemption
+	if !proofEvent.CheckID() {
+		return 0, "", 0, fmt.Errorf("session proof ID does not match its content")
+	}
+	if ok, err := proofEvent.CheckSignature(); err != nil || !ok {
+		return 0, "", 0, fmt.Errorf("invalid session proof signature")
+	}
+	if !slices.Contains(trustedGateways, proofEvent.PubKey) {
+		return 0, "", 0, fmt.Errorf("session proof issued by untrusted gateway %s", proofEvent.PubKey)
+	}
+	if proofEvent.Tags.FindWithValue("p", customerPubkey) == nil {
+		return 0, "", 0, fmt.Errorf("session proof was issued to another customer")
+	}
+
+	expirationTag := proofEvent.Tags.Find("expiration")
+	if expirationTag == nil {
+		return 0, "", 0, fmt.Errorf("session proof has no expiration")
+	}
+	expiresAt, err := strconv.ParseInt(expirationTag[1], 10, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("invalid session proof expiration: %w", err)
+	}
+	if time.Now().Unix() >= expiresAt {
+		return 0, "", 0, fmt.Errorf("session proof expired")
+	}
+
+	if metricTag := proofEvent.Tags.Find("metric"); metricTag == nil || metricTag[1] != metric {
+		return 0, "", 0, fmt.Errorf("session proof metric does not match %s", metric)
+	}
+
+	remainingTag := proofEvent.Tags.Find("remaining")
+	if remainingTag == nil {
+		return 0, "", 0, fmt.Errorf("session proof has no remaining allotment")
+	}
+	remaining, err := strconv.ParseUint(remainingTag[1], 10, 64)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("invalid session proof allotment: %w", err)
+	}
+
+	tier := baseTier
+	if tierTag := proofEvent.Tags.Find("tier"); tierTag != nil {
+		if _, known := valve.GetBandwidthLimit(iface, tierTag[1]); known {
+			tier = tierTag[1]
+		}
+	}
+
+	return remaining, tier, expiresAt, nil
+}
+
+// signMerchantEvent sets the merchant pubkey on an event and signs it
+func (m *Merchant) signMerchantEvent(event *nostr.Event) error {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return fmt.Errorf("merchant identity not found: %w", err)
+	}
+	return event.Sign(merchantIdentity.PrivateKey)
+}
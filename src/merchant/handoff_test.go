@@ -0,0 +1,97 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// noticeCode returns the code of a notice event, or an empty string for other events
+func noticeCode(event *nostr.Event) string {
+	if event.Kind != KindNotice {
+		return ""
+	}
+	if tag := event.Tags.Find("code"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+func TestImportSessionRedeemsProofOnce(t *testing.T) {
+	m := newTestMerchant(t)
+	gatewayKey := nostr.GeneratePrivateKey()
+	gatewayPubkey, _ := nostr.GetPublicKey(gatewayKey)
+	customerKey := nostr.GeneratePrivateKey()
+	customerPubkey, _ := nostr.GetPublicKey(customerKey)
+	if err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.Fleet.HandoffEnabled = true
+		config.Fleet.TrustedGateways = []string{gatewayPubkey}
+		config.Fleet.HandoffCreditPercent = 100
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	const mac = "00:11:22:33:44:05"
+	valve.SetDryRun(mac, true)
+	t.Cleanup(func() {
+		valve.CloseGate(mac)
+		valve.SetDryRun(mac, false)
+	})
+
+	proof := nostr.Event{
+		Kind:      KindSessionProof,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", customerPubkey},
+			{"metric", m.getConfig().Metric},
+			{"remaining", "60000"},
+			{"expiration", fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())},
+		},
+	}
+	if err := proof.Sign(gatewayKey); err != nil {
+		t.Fatalf("Failed to sign proof: %v", err)
+	}
+	importProof := func(proof nostr.Event) *nostr.Event {
+		t.Helper()
+		data, _ := json.Marshal(proof)
+		handoff := nostr.Event{
+			Kind:   KindSessionHandoff,
+			PubKey: customerPubkey,
+			Tags: nostr.Tags{
+				{"device-identifier", "mac", mac},
+				{"proof", string(data)},
+			},
+		}
+		response, err := m.ImportSession(handoff)
+		if err != nil {
+			t.Fatalf("ImportSession failed: %v", err)
+		}
+		return response
+	}
+
+	if response := importProof(proof); response.Kind != 1022 {
+		t.Fatalf("Expected the proof to be credited, got notice %s: %s", noticeCode(response), response.Content)
+	}
+
+	// The signature doesn't cover the ID, a proof under a fresh one is still the same proof
+	replayed := proof
+	replayed.ID = nostr.GeneratePrivateKey()
+	if response := importProof(replayed); noticeCode(response) != "invalid-session-proof" {
+		t.Errorf("Expected a proof with an edited ID to be rejected, got kind %d %s", response.Kind, noticeCode(response))
+	}
+	if response := importProof(proof); noticeCode(response) != "session-proof-redeemed" {
+		t.Errorf("Expected a redeemed proof to be rejected, got kind %d %s", response.Kind, noticeCode(response))
+	}
+
+	// Redemptions survive a restart
+	m.redeemedProofs = newRedemptionRegistry(m.redeemedProofs.path, "session proof")
+	if response := importProof(proof); noticeCode(response) != "session-proof-redeemed" {
+		t.Errorf("Expected a redeemed proof to be rejected after a restart, got kind %d %s", response.Kind, noticeCode(response))
+	}
+}
@@ -0,0 +1,280 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindGatewayHistory is the replaceable event with the gateway's uptime and price history
+const KindGatewayHistory = 10024
+
+// HistoryPath serves the uptime and price history as plain JSON
+const HistoryPath = "/history"
+
+const (
+	// historyHeartbeat is how often the running gateway extends its uptime, an outage is noticed to this precision
+	historyHeartbeat = time.Minute
+	// maxPriceChanges bounds the history of gateways whose pricing strategy changes prices often
+	maxPriceChanges = 1000
+	// Defaults when the config leaves them at 0
+	defaultHistoryWindow          = 30 * 24 * time.Hour
+	defaultHistoryPublishInterval = time.Hour
+)
+
+// UptimePeriod is a period the gateway was running
+type UptimePeriod struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// PriceChange is the price of a mint from the time it was set
+type PriceChange struct {
+	At               int64  `json:"at"`
+	MintURL          string `json:"mint_url"`
+	PricePerStep     uint64 `json:"price_per_step"`
+	PriceUnit        string `json:"price_unit"`
+	MinPurchaseSteps uint64 `json:"min_purchase_steps"`
+	Metric           string `json:"metric"`
+	StepSize         uint64 `json:"step_size"`
+}
+
+// GatewayHistory is the rolling uptime and price history of the gateway. Price changes include the price each
+// mint had when the window starts, so the price at any time in the window can be told.
+type GatewayHistory struct {
+	Since         int64          `json:"since"`          // Start of the history, the window or when the gateway first ran
+	UptimePercent float64        `json:"uptime_percent"` // Share of the time since Since the gateway was running
+	Uptime        []UptimePeriod `json:"uptime"`
+	PriceChanges  []PriceChange  `json:"price_changes"`
+}
+
+// historyState is persisted, so the history spans restarts
+type historyState struct {
+	Uptime       []UptimePeriod `json:"uptime"`
+	PriceChanges []PriceChange  `json:"price_changes"`
+}
+
+// history records when the gateway ran and when prices changed
+type history struct {
+	mu    sync.Mutex
+	path  string
+	state historyState
+}
+
+// newHistory loads the history and starts an uptime period for this run
+func newHistory(path string) *history {
+	h := &history{path: path}
+	data, err := utils.ReadState(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to read history %s: %v", path, err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &h.state); err != nil {
+			log.Printf("Warning: failed to parse history %s: %v", path, err)
+			h.state = historyState{}
+		}
+	}
+
+	now := time.Now().Unix()
+	h.state.Uptime = append(h.state.Uptime, UptimePeriod{Start: now, End: now})
+	return h
+}
+
+// heartbeat extends the uptime period of this run to now and drops history older than the window
+func (h *history) heartbeat(window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.state.Uptime[len(h.state.Uptime)-1].End = now.Unix()
+	h.trim(now.Add(-window).Unix())
+	h.save()
+}
+
+// recordPrices adds a price change for every mint whose price differs from its last recorded one
+func (h *history) recordPrices(config *config_manager.Config, mints []config_manager.MintConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latest := make(map[string]PriceChange)
+	for _, change := range h.state.PriceChanges {
+		latest[change.MintURL] = change
+	}
+
+	now := time.Now().Unix()
+	changed := false
+	for _, mint := range mints {
+		change := PriceChange{
+			At:               now,
+			MintURL:          mint.URL,
+			PricePerStep:     mint.PricePerStep,
+			PriceUnit:        mint.PriceUnit,
+			MinPurchaseSteps: mint.MinPurchaseSteps,
+			Metric:           config.MetricFor(mint),
+			StepSize:         config.StepSizeFor(mint),
+		}
+		previous, exists := latest[mint.URL]
+		previous.At = now
+		if exists && previous == change {
+			continue
+		}
+		h.state.PriceChanges = append(h.state.PriceChanges, change)
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if excess := len(h.state.PriceChanges) - maxPriceChanges; excess > 0 {
+		h.state.PriceChanges = h.state.PriceChanges[excess:]
+	}
+	h.save()
+}
+
+// trim drops uptime periods that ended before the cutoff and price changes superseded before it, keeping the
+// price each mint had at the cutoff. Caller must hold mu.
+func (h *history) trim(cutoff int64) {
+	uptime := h.state.Uptime[:0]
+	for _, period := range h.state.Uptime {
+		if period.End >= cutoff {
+			uptime = append(uptime, period)
+		}
+	}
+	h.state.Uptime = uptime
+
+	// A change is superseded once a later change of the same mint took effect before the cutoff
+	supersededAt := make(map[string]int64)
+	for _, change := range h.state.PriceChanges {
+		if change.At <= cutoff {
+			supersededAt[change.MintURL] = change.At
+		}
+	}
+	prices := h.state.PriceChanges[:0]
+	for _, change := range h.state.PriceChanges {
+		if change.At >= supersededAt[change.MintURL] {
+			prices = append(prices, change)
+		}
+	}
+	h.state.PriceChanges = prices
+}
+
+// save persists the history. Caller must hold mu.
+func (h *history) save() {
+	data, err := json.Marshal(h.state)
+	if err == nil {
+		// Batched, a heartbeat lost to a power cut shortens the uptime by a few minutes at most
+		err = utils.WriteState(h.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save history %s: %v", h.path, err)
+	}
+}
+
+// snapshot returns the history of the window up to now
+func (h *history) snapshot(window time.Duration) GatewayHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now().Unix()
+	cutoff := now - int64(window.Seconds())
+	result := GatewayHistory{
+		Since:        now,
+		Uptime:       append([]UptimePeriod(nil), h.state.Uptime...),
+		PriceChanges: append([]PriceChange(nil), h.state.PriceChanges...),
+	}
+	result.Uptime[len(result.Uptime)-1].End = now
+
+	// A new gateway isn't held to account for the time before it first ran
+	if first := result.Uptime[0].Start; first < now {
+		result.Since = max(first, cutoff)
+	}
+	var up int64
+	for _, period := range result.Uptime {
+		if end, start := period.End, max(period.Start, result.Since); end > start {
+			up += end - start
+		}
+	}
+	result.UptimePercent = 100
+	if now > result.Since {
+		result.UptimePercent = float64(up) * 100 / float64(now-result.Since)
+	}
+	return result
+}
+
+// historyWindow returns how far back the history goes
+func historyWindow(config config_manager.HistoryConfig) time.Duration {
+	if config.WindowDays <= 0 {
+		return defaultHistoryWindow
+	}
+	return time.Duration(config.WindowDays) * 24 * time.Hour
+}
+
+// GetHistory returns the uptime and price history of the gateway
+func (m *Merchant) GetHistory() GatewayHistory {
+	return m.history.snapshot(historyWindow(m.getConfig().History))
+}
+
+// createHistoryEvent signs the history as a replaceable event, with the uptime in a tag for relay queries
+func (m *Merchant) createHistoryEvent(gatewayHistory GatewayHistory) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	content, err := json.Marshal(gatewayHistory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode history: %w", err)
+	}
+	historyEvent := &nostr.Event{
+		Kind:      KindGatewayHistory,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"uptime", fmt.Sprintf("%.2f", gatewayHistory.UptimePercent)},
+			{"since", fmt.Sprintf("%d", gatewayHistory.Since)},
+			{"price-changes", fmt.Sprintf("%d", len(gatewayHistory.PriceChanges))},
+		},
+		Content: string(content),
+	}
+	if err := historyEvent.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign history: %w", err)
+	}
+	return historyEvent, nil
+}
+
+// recordHistory extends the uptime every heartbeat and publishes the history at the configured interval
+func (m *Merchant) recordHistory() {
+	var lastPublished time.Time
+	for {
+		time.Sleep(historyHeartbeat)
+
+		config := m.getConfig().History
+		m.history.heartbeat(historyWindow(config))
+		if !config.Enabled {
+			continue
+		}
+
+		interval := time.Duration(config.PublishIntervalMinutes) * time.Minute
+		if interval <= 0 {
+			interval = defaultHistoryPublishInterval
+		}
+		if time.Since(lastPublished) < interval {
+			continue
+		}
+		historyEvent, err := m.createHistoryEvent(m.GetHistory())
+		if err != nil {
+			log.Printf("Failed to create history event: %v", err)
+			continue
+		}
+		m.publisher.Publish(historyEvent)
+		lastPublished = time.Now()
+	}
+}
@@ -0,0 +1,138 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// defaultLeasePollInterval applies when no lease poll interval is configured
+const defaultLeasePollInterval = 10 * time.Second
+
+// ClientInfo describes a client known from its DHCP lease or session
+type ClientInfo struct {
+	MacAddress    string `json:"mac_address"`
+	IPAddress     string `json:"ip_address,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	LeaseExpires  int64  `json:"lease_expires,omitempty"`
+	SessionActive bool   `json:"session_active"`
+	Metric        string `json:"metric,omitempty"`
+	Allotment     uint64 `json:"allotment,omitempty"`
+	Tier          string `json:"tier,omitempty"`
+}
+
+// leaseTable returns the lease table of the configured lease file, replacing it when the path changed
+func (m *Merchant) leaseTable() *utils.LeaseTable {
+	path := m.getConfig().DHCP.LeasesFile
+	if path == "" {
+		path = "/tmp/dhcp.leases"
+	}
+
+	m.leasesMu.Lock()
+	defer m.leasesMu.Unlock()
+	if m.leases == nil || m.leasesPath != path {
+		m.leases = utils.NewLeaseTable(path)
+		m.leasesPath = path
+	}
+	return m.leases
+}
+
+// ResolveMAC returns the MAC address leased the given IP address
+func (m *Merchant) ResolveMAC(ipAddress string) (string, error) {
+	lease, found := m.leaseTable().ByIP(ipAddress)
+	if !found {
+		return "", fmt.Errorf("no DHCP lease for %s", ipAddress)
+	}
+	return lease.MacAddress, nil
+}
+
+// GetClients returns all clients with a DHCP lease or a session, joining leases and sessions by MAC address
+func (m *Merchant) GetClients() []ClientInfo {
+	leases, err := m.leaseTable().Leases()
+	if err != nil {
+		log.Printf("Warning: failed to read DHCP leases: %v", err)
+	}
+
+	clients := make(map[string]*ClientInfo, len(leases))
+	for _, lease := range leases {
+		clients[utils.NormalizeMAC(lease.MacAddress)] = &ClientInfo{
+			MacAddress:   lease.MacAddress,
+			IPAddress:    lease.IPAddress,
+			Hostname:     lease.Hostname,
+			LeaseExpires: lease.Expires,
+		}
+	}
+
+	m.sessionMu.RLock()
+	for macAddress, session := range m.customerSessions {
+		key := utils.NormalizeMAC(macAddress)
+		client, exists := clients[key]
+		if !exists {
+			client = &ClientInfo{MacAddress: macAddress}
+			clients[key] = client
+		}
+		client.SessionActive = isCustomerSessionActive(session)
+		client.Metric = session.Metric
+		client.Allotment = session.Allotment
+		client.Tier = session.Tier
+	}
+	m.sessionMu.RUnlock()
+
+	result := make([]ClientInfo, 0, len(clients))
+	for _, client := range clients {
+		result = append(result, *client)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].MacAddress < result[j].MacAddress })
+	return result
+}
+
+// sessionMACs returns the session keys of a MAC address, which customers may send in any format
+func (m *Merchant) sessionMACs(macAddress string) []string {
+	normalized := utils.NormalizeMAC(macAddress)
+
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	var macAddresses []string
+	for sessionMAC := range m.customerSessions {
+		if utils.NormalizeMAC(sessionMAC) == normalized {
+			macAddresses = append(macAddresses, sessionMAC)
+		}
+	}
+	return macAddresses
+}
+
+// watchLeases polls the lease file and notifies the valve when a client with an open gate gets a new IP address
+func (m *Merchant) watchLeases() {
+	knownIPs := make(map[string]string)
+
+	for {
+		interval := time.Duration(m.getConfig().DHCP.PollIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultLeasePollInterval
+		}
+		time.Sleep(interval)
+
+		// Leases only parses the file again if it was modified
+		leases, err := m.leaseTable().Leases()
+		if err != nil {
+			continue
+		}
+
+		for _, lease := range leases {
+			oldIP, known := knownIPs[lease.MacAddress]
+			knownIPs[lease.MacAddress] = lease.IPAddress
+			if !known || oldIP == lease.IPAddress {
+				continue
+			}
+
+			for _, macAddress := range m.sessionMACs(lease.MacAddress) {
+				valve.NotifyIPChange(macAddress, oldIP, lease.IPAddress)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package merchant
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ledger entry types
+const (
+	LedgerPayment      = "payment"      // Customer paid for a session
+	LedgerCancellation = "cancellation" // Customer cancelled a session, Amount is what was refunded
+	LedgerService      = "service"      // Customer bought units of a venue service, Allotment is the units
+	LedgerCard         = "card"         // Customer redeemed a pre-paid card, Pubkey is the card's issuer
+	LedgerCompensation = "compensation" // Customer was credited Allotment for a gate that opened over the latency budget
+	LedgerUpgrade      = "upgrade"      // Customer paid to move an active session to Tier for the rest of its time
+	LedgerRefund       = "refund"       // A purchase failed after its payment was redeemed, Amount is what was returned
+	LedgerSubscription = "subscription" // Customer bought a pass, Allotment is what it grants each day
+)
+
+// LedgerEntry records money moving between the gateway and a customer
+type LedgerEntry struct {
+	Timestamp  int64  `json:"timestamp"`
+	Type       string `json:"type"`
+	MacAddress string `json:"mac_address"`
+	Pubkey     string `json:"pubkey"`
+	MintURL    string `json:"mint_url"`
+	Amount     uint64 `json:"amount"`              // In sats
+	Received   uint64 `json:"received,omitempty"`  // Value of the customer's token before the swap, in sats
+	SwapFee    uint64 `json:"swap_fee,omitempty"`  // Kept by the mint for swapping the token, in sats
+	Fee        uint64 `json:"fee,omitempty"`       // Kept by the gateway, in sats
+	Allotment  uint64 `json:"allotment,omitempty"` // Allotment bought or given up
+	Metric     string `json:"metric,omitempty"`
+	EventID    string `json:"event_id,omitempty"`  // Customer event that caused the entry
+	Interface  string `json:"interface,omitempty"` // Interface the customer paid from, when tracked for the revenue split
+	Service    string `json:"service,omitempty"`   // Venue service bought, empty for internet access
+	Tier       string `json:"tier,omitempty"`      // Tier a session was upgraded to
+	TermsHash  string `json:"tos_hash,omitempty"`  // Hash of the terms of service the customer accepted with the payment
+	Plan       string `json:"plan,omitempty"`      // Subscription or special-purpose plan bought
+}
+
+// ledger records entries in the configured store, one at a time
+type ledger struct {
+	mu       sync.Mutex
+	store    Store
+	onRecord func(entry LedgerEntry) // Called with each entry recorded, if set
+}
+
+func newLedger(store Store) *ledger {
+	return &ledger{store: store}
+}
+
+// record appends an entry, stamping it with the current time if it has none
+func (l *ledger) record(entry LedgerEntry) error {
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store.AppendLedger(entry); err != nil {
+		return err
+	}
+	if l.onRecord != nil {
+		l.onRecord(entry)
+	}
+	return nil
+}
+
+// ledgerRecorded records a ledger entry in the financial audit log and looks it over for anomalies
+func (m *Merchant) ledgerRecorded(entry LedgerEntry) {
+	m.configManager.AuditFinancial("merchant", entry.Type, auditDetails(entry))
+	m.observePurchase(entry)
+}
+
+// auditDetails lists the amounts and counterparties of an entry for the financial audit log
+func auditDetails(entry LedgerEntry) map[string]string {
+	details := map[string]string{
+		"mint":        entry.MintURL,
+		"amount":      fmt.Sprintf("%d", entry.Amount),
+		"pubkey":      entry.Pubkey,
+		"mac_address": entry.MacAddress,
+	}
+	optional := map[string]string{
+		"event_id": entry.EventID,
+		"service":  entry.Service,
+		"tier":     entry.Tier,
+		"plan":     entry.Plan,
+	}
+	for key, amount := range map[string]uint64{"received": entry.Received, "swap_fee": entry.SwapFee, "fee": entry.Fee} {
+		if amount > 0 {
+			optional[key] = fmt.Sprintf("%d", amount)
+		}
+	}
+	for key, value := range optional {
+		if value != "" {
+			details[key] = value
+		}
+	}
+	return details
+}
+
+// prepend puts the entries of another ledger, as JSON lines, before the existing ones, e.g. those of the
+// gateway this one replaces
+func (l *ledger) prepend(entries []byte) error {
+	parsed, err := parseLedgerLines(entries)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.ImportLedger(parsed)
+}
+
+// export returns the whole ledger as JSON lines, for a state archive
+func (l *ledger) export() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.ExportLedger()
+}
+
+// close closes the store once the entries being recorded are written
+func (l *ledger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.Close()
+}
+
+// GetLedger returns the ledger entries recorded since a unix time, if the storage backend keeps history
+func (m *Merchant) GetLedger(since int64) ([]LedgerEntry, error) {
+	m.ledger.mu.Lock()
+	defer m.ledger.mu.Unlock()
+	return m.ledger.store.LedgerEntries(since)
+}
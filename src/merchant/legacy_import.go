@@ -0,0 +1,80 @@
+package merchant
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// legacyImportFile records that the clients of the legacy captive portal were adopted, so they are adopted once
+const legacyImportFile = "legacy_import.json"
+
+// legacyImport is what legacyImportFile records
+type legacyImport struct {
+	ImportedAt int64    `json:"imported_at"`
+	Source     string   `json:"source"`
+	Sessions   []string `json:"sessions"` // MAC addresses of the adopted sessions
+}
+
+// importLegacySessions adopts the clients an openNDS or CoovaChilli captive portal authorized as sessions
+// with the time they have left, the first time the merchant starts with the legacy import enabled
+func (m *Merchant) importLegacySessions() {
+	config := m.getConfig().LegacyImport
+	if !config.Enabled {
+		return
+	}
+	path := m.stateFilePath(legacyImportFile)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+
+	clients, err := valve.ReadLegacyClients(config.Source, config.StateFile)
+	if err != nil {
+		log.Printf("Warning: failed to import sessions of the legacy captive portal, retrying at the next start: %v", err)
+		return
+	}
+	tier := config.Tier
+	if _, known := valve.GetBandwidthLimit(m.getConfig().NDS.GatewayInterface, tier); !known {
+		tier = m.getConfig().BaseTier()
+	}
+
+	record := legacyImport{ImportedAt: time.Now().Unix(), Source: config.Source, Sessions: []string{}}
+	for _, client := range clients {
+		remaining := client.Remaining
+		if remaining == 0 {
+			remaining = time.Duration(config.UnlimitedSessionMinutes) * time.Minute
+		}
+		if remaining <= 0 || !utils.ValidateMACAddress(client.MacAddress) {
+			continue
+		}
+		// Sessions paid on this gateway already are kept as they are
+		if m.remainingAllotment(client.MacAddress) > 0 {
+			continue
+		}
+
+		session, err := m.AddAllotment(client.MacAddress, "milliseconds", uint64(remaining.Milliseconds()))
+		if err != nil {
+			log.Printf("Warning: failed to adopt legacy session of %s: %v", client.MacAddress, err)
+			continue
+		}
+		if _, err := m.openGate(client.MacAddress, sessionEndTimestamp(session), tier); err != nil {
+			log.Printf("Warning: failed to open gate of legacy session of %s: %v", client.MacAddress, err)
+			continue
+		}
+		m.setSessionTier(client.MacAddress, tier)
+		record.Sessions = append(record.Sessions, client.MacAddress)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record the legacy session import, it runs again at the next start: %v", err)
+	}
+	log.Printf("Adopted %d of %d clients authorized by %s as sessions", len(record.Sessions), len(clients), config.Source)
+}
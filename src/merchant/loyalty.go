@@ -0,0 +1,188 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// maxLoyaltyPurchases caps the purchase times kept per customer, more don't change whether they are returning
+const maxLoyaltyPurchases = 100
+
+// LoyaltyInfo describes the returning customer pricing and whether the calling device qualifies for it
+type LoyaltyInfo struct {
+	MinPurchases    int           `json:"min_purchases"`
+	WindowDays      int           `json:"window_days"`
+	DiscountPercent uint64        `json:"discount_percent"`
+	BonusPercent    uint64        `json:"bonus_percent"`
+	Purchases       int           `json:"purchases"`      // Purchases of the calling device within the window
+	Returning       bool          `json:"returning"`      // The calling device gets the loyalty price on its next purchase
+	AcceptedMints   []MintPricing `json:"accepted_mints"` // Loyalty price per step and allotment per step of each mint
+}
+
+// loyalty remembers when customers bought sessions, by pubkey and by MAC address, persisted next to the wallet
+type loyalty struct {
+	mu        sync.Mutex
+	path      string
+	purchases map[string][]int64
+}
+
+func newLoyalty(path string) *loyalty {
+	l := &loyalty{path: path, purchases: make(map[string][]int64)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read loyalty store %s: %v", path, err)
+		}
+		return l
+	}
+	if err := json.Unmarshal(data, &l.purchases); err != nil {
+		log.Printf("Warning: failed to parse loyalty store %s, starting empty: %v", path, err)
+		l.purchases = make(map[string][]int64)
+	}
+	return l
+}
+
+// loyaltyWindow returns how far back purchases count
+func loyaltyWindow(config config_manager.LoyaltyConfig) time.Duration {
+	return time.Duration(config.WindowDays) * 24 * time.Hour
+}
+
+// count returns the most purchases within the window of any of the customer's keys
+func (l *loyalty) count(window time.Duration, keys ...string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-window).Unix()
+	most := 0
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		recent := 0
+		for _, purchasedAt := range l.purchases[key] {
+			if window <= 0 || purchasedAt >= cutoff {
+				recent++
+			}
+		}
+		most = max(most, recent)
+	}
+	return most
+}
+
+// record adds a purchase for each of the customer's keys and forgets purchases outside the window
+func (l *loyalty) record(window time.Duration, keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().Unix()
+	cutoff := time.Now().Add(-window).Unix()
+	for key, times := range l.purchases {
+		kept := times[:0]
+		for _, purchasedAt := range times {
+			if window <= 0 || purchasedAt >= cutoff {
+				kept = append(kept, purchasedAt)
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.purchases, key)
+		} else {
+			l.purchases[key] = kept
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		times := append(l.purchases[key], now)
+		if len(times) > maxLoyaltyPurchases {
+			times = times[len(times)-maxLoyaltyPurchases:]
+		}
+		l.purchases[key] = times
+	}
+
+	data, err := json.Marshal(l.purchases)
+	if err != nil {
+		log.Printf("Warning: failed to encode loyalty store: %v", err)
+		return
+	}
+	if err := utils.WriteState(l.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save loyalty store %s: %v", l.path, err)
+	}
+}
+
+// isReturningCustomer reports whether the customer bought enough sessions within the window for the loyalty price
+func (m *Merchant) isReturningCustomer(pubkey, macAddress string) bool {
+	config := m.getConfig().Loyalty
+	if !config.Enabled {
+		return false
+	}
+	return m.loyalty.count(loyaltyWindow(config), pubkey, macAddress) >= config.MinPurchases
+}
+
+// recordLoyaltyPurchase counts a purchase towards the customer's loyalty
+func (m *Merchant) recordLoyaltyPurchase(pubkey, macAddress string) {
+	config := m.getConfig().Loyalty
+	if !config.Enabled {
+		return
+	}
+	m.loyalty.record(loyaltyWindow(config), pubkey, macAddress)
+}
+
+// loyaltyPrice lowers a price per step by the loyalty discount, to no less than 1
+func loyaltyPrice(config config_manager.LoyaltyConfig, pricePerStep uint64) uint64 {
+	discount := min(config.DiscountPercent, 100)
+	return max(pricePerStep*(100-discount)/100, 1)
+}
+
+// loyaltyBonus adds the loyalty bonus to an allotment
+func loyaltyBonus(config config_manager.LoyaltyConfig, allotment uint64) uint64 {
+	return allotment + allotment*config.BonusPercent/100
+}
+
+// GetLoyaltyInfo returns the loyalty pricing as quoted to a device, nil while loyalty pricing is disabled
+func (m *Merchant) GetLoyaltyInfo(macAddress string) *LoyaltyInfo {
+	config := m.getConfig()
+	if !config.Loyalty.Enabled {
+		return nil
+	}
+
+	info := &LoyaltyInfo{
+		MinPurchases:    config.Loyalty.MinPurchases,
+		WindowDays:      config.Loyalty.WindowDays,
+		DiscountPercent: config.Loyalty.DiscountPercent,
+		BonusPercent:    config.Loyalty.BonusPercent,
+		AcceptedMints:   make([]MintPricing, 0, len(config.AcceptedMints)),
+	}
+	if macAddress != "" {
+		info.Purchases = m.loyalty.count(loyaltyWindow(config.Loyalty), macAddress)
+		info.Returning = info.Purchases >= config.Loyalty.MinPurchases
+	}
+	for _, mint := range m.pricedMints(config) {
+		info.AcceptedMints = append(info.AcceptedMints, MintPricing{
+			URL:              mint.URL,
+			PricePerStep:     loyaltyPrice(config.Loyalty, mint.PricePerStep),
+			PriceUnit:        mint.PriceUnit,
+			MinPurchaseSteps: mint.MinPurchaseSteps,
+			Metric:           config.MetricFor(mint),
+			StepSize:         loyaltyBonus(config.Loyalty, config.StepSizeFor(mint)),
+		})
+	}
+	return info
+}
+
+// loyaltyQuoteMessage describes the loyalty pricing for the quote of a customer, empty if it doesn't apply
+func (m *Merchant) loyaltyQuoteMessage(pubkey, macAddress string) string {
+	config := m.getConfig().Loyalty
+	if !m.isReturningCustomer(pubkey, macAddress) {
+		return ""
+	}
+	return fmt.Sprintf(" Welcome back: %d%% off the price per step and %d%% extra allotment.",
+		config.DiscountPercent, config.BonusPercent)
+}
@@ -1,10 +1,11 @@
 package merchant
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
@@ -27,6 +29,14 @@ type CustomerSession struct {
 	StartTime  int64  // Unix timestamp
 	Metric     string // "milliseconds" or "bytes"
 	Allotment  uint64 // Total allotment for this session
+	Purchases  uint64 // Number of payments that added to this session
+	Tier       string // Tier the gate was last opened with
+	// Payments of the current session, refunded pro-rata on cancellation
+	Pubkey        string // Customer who paid last
+	MintURL       string // Mint the refundable payments were made with
+	Paid          uint64 // Sats paid with that mint
+	PaidAllotment uint64 // Allotment bought with those sats
+	UsedBytes     uint64 // Traffic already charged against a data-metered session
 }
 
 // MerchantInterface defines the interface for merchant payment operations
@@ -38,24 +48,150 @@ type MerchantInterface interface {
 	GetBalanceByMint(mintURL string) uint64
 	PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, error)
 	GetAdvertisement() string
+	GetAdvertisementCode() (AdvertisementCode, error)
+	GetPricingInfo() PricingInfo
+	GetHistory() GatewayHistory
+	GetLoyaltyInfo(macAddress string) *LoyaltyInfo
+	GetUsage(macAddress string) (UsageReport, error)
+	GetDeviceStats() DeviceStats
+	GetWalletQueueMetrics() map[string]tollwallet.MintQueueMetrics
+	GetOperatorStatus() OperatorStatus
+	RunSelfTest() SelfTestReport
+	ReconcileBalances() ([]tollwallet.BalanceReconciliation, error)
+	RepairBalance(mintURL string) error
+	ExportState(path, passphrase string) (MigrationSummary, error)
+	ImportState(path, passphrase string) (MigrationSummary, error)
+	IssueCards(count int, allotment uint64, tier string, validDays int) ([]string, error)
+	CreateDebugBundle(path, recipient string) (DebugBundleSummary, error)
+	CreateReservation(requestEvent nostr.Event) (*nostr.Event, error)
+	SubmitFeedback(feedbackEvent nostr.Event) (*nostr.Event, error)
+	RequestZapPurchase(requestEvent nostr.Event) (*nostr.Event, error)
+	ExportSession(requestEvent nostr.Event) (*nostr.Event, error)
+	ImportSession(handoffEvent nostr.Event) (*nostr.Event, error)
+	CancelSession(cancelEvent nostr.Event) (*nostr.Event, error)
+	JoinSessionGroup(joinEvent nostr.Event) (*nostr.Event, error)
+	AttestSession(attestEvent nostr.Event) (*nostr.Event, error)
+	ResolveMAC(ipAddress string) (string, error)
+	GetClients() []ClientInfo
 	StartPayoutRoutine()
 	CreateNoticeEvent(level, code, message, customerPubkey string) (*nostr.Event, error)
+	MirrorNotice(request nostr.Event, notice *nostr.Event)
 	// New session management methods
 	GetSession(macAddress string) (*CustomerSession, error)
+	GetSessionStatus(macAddress string) SessionStatus
+	RedeemCard(code, macAddress string) (SessionStatus, error)
+	PayPaymentRequest(payload PaymentRequestPayload, macAddress string) (*nostr.Event, error)
+	SubmitEmergencyStop(stopEvent nostr.Event) (*nostr.Event, error)
+	GetLedger(since int64) ([]LedgerEntry, error)
+	SimulatePricing(simulation PriceSimulation) (PriceSimulationReport, error)
+	IssueSessionCookie(macAddress string) (string, int64, error)
+	RestoreSessionFromCookie(value, macAddress string) (SessionStatus, error)
 	AddAllotment(macAddress, metric string, amount uint64) (*CustomerSession, error)
 	// Wallet funding methods
 	Fund(cashuToken string) (uint64, error)
+	Shutdown() error
 }
 
 // Merchant represents the financial decision maker for the tollgate
 type Merchant struct {
-	config        *config_manager.Config
 	configManager *config_manager.ConfigManager
-	tollwallet    tollwallet.TollWallet
-	advertisement string
+	tollwallet    *tollwallet.TollWallet
+	// Derived from config, rebuilt on config changes
+	advertisement     string
+	advertisementCode AdvertisementCode // Printable codes of the advertisement, regenerated with it
+	advertisementMu   sync.RWMutex
+	// Closed to stop the running payout routine
+	payoutStop chan struct{}
+	payoutMu   sync.Mutex
 	// In-memory session store
 	customerSessions map[string]*CustomerSession
 	sessionMu        sync.RWMutex
+	// Anonymized device counts, only filled when analytics are enabled
+	deviceAnalytics *deviceAnalytics
+	// Pending reservations keyed by reservation ID
+	reservations   map[string]*reservation
+	reservationsMu sync.Mutex
+	// Optional operator pricing hook, nil when the configured prices apply
+	pricingStrategy PricingStrategy
+	pricingMu       sync.RWMutex
+	// Customer ratings summarized in the advertisement
+	reputation *reputation
+	// Zap purchase requests waiting for a receipt, keyed by request event ID
+	zapPurchases   map[string]*zapPurchase
+	zapPurchasesMu sync.Mutex
+	// Imported session proofs and when they expire, so each is redeemed once
+	redeemedProofs *redemptionRegistry
+	// Zap receipts that granted a session, so a receipt published again doesn't grant another
+	redeemedZapReceipts *redemptionRegistry
+	// DHCP leases mapping clients' MAC and IP addresses and hostnames
+	leases     *utils.LeaseTable
+	leasesPath string
+	leasesMu   sync.Mutex
+	// Reported in operator status events
+	startTime     time.Time
+	errorCounters *errorCounters
+	// Recently rejected tokens and failing pubkeys, turned away without asking the mint
+	negativeCache *negativeCache
+	// Bounds the purchases worked on at once, turning away bursts with a busy notice
+	purchaseQueue *purchaseQueue
+	// Pricing overrides of mints whose fees changed, and the keysets last seen per mint
+	feeAdjustments map[string]mintFeeAdjustment
+	mintKeysets    map[string][]string
+	mintFeesMu     sync.RWMutex
+	// Events waiting for unreachable public relays, persisted across restarts
+	outbox *outbox
+	// Routes events to the local and public relays by type
+	publisher Publisher
+	// Blinds MAC addresses of events published on public relays in privacy mode
+	blindingSecret *blindingSecret
+	// Mints paid out or paused for holding more than their exposure cap
+	exposure *exposureState
+	// Payments and refunds, appended to a file next to the wallet
+	ledger *ledger
+	// Pre-paid cards redeemed on this gateway, persisted next to the wallet
+	cards *cardRegistry
+	// When session cookies of a MAC address were last revoked, persisted next to the wallet
+	cookieRevocations *cookieRevocations
+	// Revenue not yet paid out per interface with its own profit share
+	revenueSplit *revenueSplit
+	// Traffic counters and throttling of data-metered gates, guarded by sessionMu
+	dataQuota dataQuotaState
+	// Traffic of each device today, for the fair-use caps
+	fairUse *fairUse
+	// Purchases and failed redemptions counted for anomalies and the daily report
+	anomalies *anomalies
+	// Devices sharing the session of another device, guarded by sessionMu
+	groups sessionGroups
+	// Last attestation of sessions bound to a pubkey per randomized MAC address, guarded by sessionMu
+	attestations map[string]int64
+	// Sessions created by other modules through the local relay
+	companions *companionSessions
+	// Where session MAC addresses are seen, to catch spoofed addresses sharing a session
+	abuse *sessionAbuse
+	// Purchase times per customer pubkey and MAC address, for the returning customer price
+	loyalty *loyalty
+	// Passes granting devices time every day
+	subscriptions *subscriptions
+	// Gates that opened over the latency budget
+	gateLatency gateLatency
+	// Running and last self-test of the money path
+	selfTest selfTestState
+	// Last balance reconciliation with each mint
+	reconciliation reconciliationState
+	// Price percent set by the load of the gateway
+	surge surgeState
+	// Price of a bitcoin in the currency prices are also shown in
+	fiat fiatRate
+	// Set once the state was exported for migration to a replacement router, no more sessions are sold
+	migrated atomic.Bool
+	// Uptime and price changes published for customer apps
+	history *history
+	// Owner signatures of emergency stop requests and whether the gateway is halted
+	emergencyStop *emergencyStop
+	// Payment requests advertised per mint
+	paymentRequests paymentRequests
+	// Set once the merchant was shut down, its store is closed
+	stopped atomic.Bool
 }
 
 func New(configManager *config_manager.ConfigManager) (MerchantInterface, error) {
@@ -67,10 +203,10 @@ func New(configManager *config_manager.ConfigManager) (MerchantInterface, error)
 	}
 
 	// Extract mint URLs from MintConfig
-	mintURLs := make([]string, len(config.AcceptedMints))
-	for i, mint := range config.AcceptedMints {
-		mintURLs[i] = mint.URL
-	}
+	mintURLs := acceptedMintURLs(config)
+
+	// Before anything loads its state, so state staged by a crashed process is on flash first
+	applyFlashWrites(config.FlashWrites)
 
 	log.Printf("Setting up wallet...")
 	walletDirPath := filepath.Dir(configManager.ConfigFilePath)
@@ -82,10 +218,21 @@ func New(configManager *config_manager.ConfigManager) (MerchantInterface, error)
 	if walletErr != nil {
 		return nil, fmt.Errorf("failed to create wallet: %w", walletErr)
 	}
+	tollwallet.SetConcurrencyLimits(config.Wallet.MaxConcurrentOperations, config.Wallet.MaxConcurrentPerMint,
+		time.Duration(config.Wallet.QueueTimeoutSeconds)*time.Second)
+	tollwallet.SetReceiveStrategies(receiveStrategies(config))
+	tollwallet.SetMintInfoTTL(time.Duration(config.Wallet.MintInfoTTLSeconds) * time.Second)
+	tollwallet.SetDenominations(config.Wallet.DenominationStrategy, config.Wallet.PresplitBundles)
+	tollwallet.SetAuditor(func(action string, details map[string]string) {
+		configManager.AuditFinancial("wallet", action, details)
+	})
 	balance := tollwallet.GetBalance()
 
+	// Load customer ratings before the advertisement so it carries the reputation summary
+	reputation := newReputation(filepath.Join(walletDirPath, "reputation.json"))
+
 	// Set advertisement
-	advertisementStr, err := CreateAdvertisement(configManager)
+	advertisementStr, err := CreateAdvertisement(configManager, reputation.summaryTags()...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create advertisement: %w", err)
 	}
@@ -95,35 +242,206 @@ func New(configManager *config_manager.ConfigManager) (MerchantInterface, error)
 	log.Printf("Advertisement: %s", advertisementStr)
 
 	// Initialize traffic control for bandwidth limiting (ignore errors on systems without tc)
-	if err := valve.InitTrafficControl(); err != nil {
+	if err := valve.InitTrafficControlOn(config.NDS.GatewayInterface); err != nil {
 		log.Printf("Warning: Failed to initialize traffic control: %v", err)
 		log.Printf("Bandwidth limiting may not work on this system")
 	} else {
 		log.Printf("Traffic control initialized for bandwidth limiting")
 	}
 
+	// Configure operator scripts run on gate changes, tiers and the gate mode of this merchant's interface
+	applyValveConfig(configManager, config)
+
 	log.Printf("=== Merchant ready ===")
 
-	return &Merchant{
-		config:           config,
+	merchant := &Merchant{
 		configManager:    configManager,
-		tollwallet:       *tollwallet,
+		tollwallet:       tollwallet,
 		advertisement:    advertisementStr,
 		customerSessions: make(map[string]*CustomerSession),
-	}, nil
+		deviceAnalytics:  newDeviceAnalytics(),
+		reservations:     make(map[string]*reservation),
+		reputation:       reputation,
+		zapPurchases:     make(map[string]*zapPurchase),
+		startTime:        time.Now(),
+		errorCounters:    newErrorCounters(),
+		negativeCache:    newNegativeCache(),
+		purchaseQueue:    newPurchaseQueue(config.PurchaseQueue),
+		exposure:         newExposureState(),
+		feeAdjustments:   make(map[string]mintFeeAdjustment),
+		mintKeysets:      make(map[string][]string),
+		dataQuota: dataQuotaState{
+			counters:  make(map[string]uint64),
+			throttles: make(map[string]int),
+		},
+		groups:       newSessionGroups(),
+		attestations: make(map[string]int64),
+		companions:   newCompanionSessions(),
+		abuse:        newSessionAbuse(),
+		fiat:         fiatRate{wake: make(chan struct{}, 1)},
+	}
+	if code, err := newAdvertisementCode(config, advertisementStr); err == nil {
+		merchant.advertisementCode = code
+	}
+	store, err := openStore(config.Storage, walletDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s storage: %w", config.Storage.Backend, err)
+	}
+	merchant.ledger = newLedger(store)
+	merchant.ledger.onRecord = merchant.ledgerRecorded
+	merchant.cards = newCardRegistry(filepath.Join(walletDirPath, "spent_cards.json"))
+	merchant.loyalty = newLoyalty(filepath.Join(walletDirPath, "loyalty.json"))
+	merchant.subscriptions = newSubscriptions(filepath.Join(walletDirPath, "subscriptions.json"))
+	merchant.fairUse = newFairUse(filepath.Join(walletDirPath, "fair_use.json"))
+	merchant.anomalies = newAnomalies(filepath.Join(walletDirPath, "anomalies.json"))
+	merchant.emergencyStop = newEmergencyStop(filepath.Join(walletDirPath, "emergency_stop.json"))
+	merchant.history = newHistory(filepath.Join(walletDirPath, "history.json"))
+	merchant.cookieRevocations = newCookieRevocations(filepath.Join(walletDirPath, "revoked_session_cookies.json"))
+	merchant.redeemedProofs = newRedemptionRegistry(filepath.Join(walletDirPath, "redeemed_session_proofs.json"), "session proof")
+	merchant.redeemedZapReceipts = newRedemptionRegistry(filepath.Join(walletDirPath, "redeemed_zap_receipts.json"), "zap receipt")
+	merchant.revenueSplit = newRevenueSplit(filepath.Join(walletDirPath, "revenue_split.json"))
+	merchant.blindingSecret = newBlindingSecret(filepath.Join(walletDirPath, "blinding_secret.json"))
+	merchant.outbox = newOutbox(filepath.Join(walletDirPath, "outbox.json"), func(relayURL string, event nostr.Event) error {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout(merchant.getConfig()))
+		defer cancel()
+		return merchant.publishToRelay(ctx, relayURL, event)
+	})
+	merchant.outbox.setLimits(config.Outbox.MaxEvents, time.Duration(config.Outbox.MaxAgeSeconds)*time.Second,
+		time.Duration(config.Outbox.MaxBackoffSeconds)*time.Second)
+	merchant.publisher = newRelayPublisher(merchant)
+	merchant.loadPricingStrategy(config.Pricing)
+	configManager.OnConfigChange(merchant.handleConfigChange)
+	valve.OnGateVerificationFailed(config.NDS.GatewayInterface, merchant.alertUnverifiedGate)
+	merchant.restoreImportedSessions()
+	merchant.importLegacySessions()
+	merchant.restoreStoredSessions()
+	// The advertisement was created before there were payment requests to add to it
+	if config.PaymentRequests.Enabled {
+		if err := merchant.refreshAdvertisement(); err != nil {
+			log.Printf("Warning: failed to add payment requests to the advertisement: %v", err)
+		}
+	}
+
+	// Follow clients whose IP address changes mid-session
+	go merchant.watchLeases()
+	go merchant.reportOperatorStatus()
+	go merchant.watchMintFees()
+	go merchant.priceByLoad()
+	go merchant.outbox.run()
+	go merchant.publishAdvertisement()
+	go merchant.monitorUplink()
+	go merchant.followMintRecommendations()
+	go merchant.meterDataSessions()
+	go merchant.enforceFairUse()
+	go merchant.reportAnomalies()
+	go merchant.sweepToCold()
+	go merchant.enforceAttestations()
+	go merchant.followCompanionSessions()
+	go merchant.watchFiatRate()
+	go merchant.snapshotSessions()
+	go merchant.detectSessionAbuse()
+	go merchant.grantSubscriptions()
+	go merchant.rotatePaymentRequests()
+	go merchant.followEmergencyStops()
+	go merchant.reconcileBalancesPeriodically()
+	go merchant.publishUsageReports()
+	go merchant.recordHistory()
+
+	return merchant, nil
 }
 
+// acceptedMintURLs returns the URLs of the accepted mints
+func acceptedMintURLs(config *config_manager.Config) []string {
+	mintURLs := make([]string, len(config.AcceptedMints))
+	for i, mint := range config.AcceptedMints {
+		mintURLs[i] = mint.URL
+	}
+	return mintURLs
+}
+
+// applyFlashWrites configures how state files are batched before they are written to flash
+func applyFlashWrites(config config_manager.FlashWritesConfig) {
+	utils.ConfigureStateWrites(config.StagingDir, time.Duration(config.FlushIntervalSeconds)*time.Second)
+}
+
+// receiveStrategies returns the receive strategy of each accepted mint
+func receiveStrategies(config *config_manager.Config) map[string]string {
+	strategies := make(map[string]string, len(config.AcceptedMints))
+	for _, mint := range config.AcceptedMints {
+		strategies[mint.URL] = mint.ReceiveStrategy
+	}
+	return strategies
+}
+
+// getConfig returns the current config snapshot. Read it once per operation for consistent values.
+func (m *Merchant) getConfig() *config_manager.Config {
+	return m.configManager.GetConfig()
+}
+
+// handleConfigChange rebuilds state derived from the config after it changes
+func (m *Merchant) handleConfigChange(config *config_manager.Config) {
+	log.Printf("Config changed, refreshing merchant state")
+
+	if err := m.refreshAdvertisement(); err != nil {
+		log.Printf("Warning: failed to refresh advertisement: %v", err)
+	} else {
+		go m.publishAdvertisement()
+	}
+
+	applyValveConfig(m.configManager, config)
+	applyFlashWrites(config.FlashWrites)
+	for _, mint := range config.AcceptedMints {
+		m.updateExposurePause(mint)
+	}
+	m.loadPricingStrategy(config.Pricing)
+	m.wakeFiatRate()
+	m.tollwallet.SetConcurrencyLimits(config.Wallet.MaxConcurrentOperations, config.Wallet.MaxConcurrentPerMint,
+		time.Duration(config.Wallet.QueueTimeoutSeconds)*time.Second)
+	m.tollwallet.SetAcceptedMints(acceptedMintURLs(config))
+	m.tollwallet.SetReceiveStrategies(receiveStrategies(config))
+	m.tollwallet.SetMintInfoTTL(time.Duration(config.Wallet.MintInfoTTLSeconds) * time.Second)
+	m.tollwallet.SetDenominations(config.Wallet.DenominationStrategy, config.Wallet.PresplitBundles)
+	m.outbox.setLimits(config.Outbox.MaxEvents, time.Duration(config.Outbox.MaxAgeSeconds)*time.Second,
+		time.Duration(config.Outbox.MaxBackoffSeconds)*time.Second)
+	m.purchaseQueue.setLimits(config.PurchaseQueue)
+	m.companions.restart()
+
+	// Restart payout tickers so they pick up added, removed or changed mints
+	m.payoutMu.Lock()
+	running := m.payoutStop != nil
+	m.payoutMu.Unlock()
+	if running {
+		m.StartPayoutRoutine()
+	}
+}
+
+// StartPayoutRoutine starts a payout ticker for each accepted mint, replacing any running tickers
 func (m *Merchant) StartPayoutRoutine() {
 	log.Printf("Starting payout routine")
 
+	m.payoutMu.Lock()
+	defer m.payoutMu.Unlock()
+
+	if m.payoutStop != nil {
+		close(m.payoutStop)
+	}
+	stop := make(chan struct{})
+	m.payoutStop = stop
+
 	// Create timer for each mint
-	for _, mint := range m.config.AcceptedMints {
+	for _, mint := range m.getConfig().AcceptedMints {
 		go func(mintConfig config_manager.MintConfig) {
 			ticker := time.NewTicker(1 * time.Minute)
 			defer ticker.Stop()
 
-			for range ticker.C {
-				m.processPayout(mintConfig)
+			for {
+				select {
+				case <-ticker.C:
+					m.processPayout(mintConfig)
+					m.presplitProofs(mintConfig)
+				case <-stop:
+					return
+				}
 			}
 		}(mint)
 	}
@@ -131,6 +449,29 @@ func (m *Merchant) StartPayoutRoutine() {
 	log.Printf("Payout routine started")
 }
 
+// presplitProofs tops up the proofs of a mint split ahead of payments, after the payout took what it pays out
+func (m *Merchant) presplitProofs(mintConfig config_manager.MintConfig) {
+	if m.getConfig().Wallet.PresplitBundles <= 0 {
+		return
+	}
+	if _, err := m.tollwallet.Presplit(mintConfig.URL, m.presplitAmounts(mintConfig)); err != nil {
+		log.Printf("Failed to presplit proofs of %s: %v", mintConfig.URL, err)
+	}
+}
+
+// presplitAmounts returns the amounts to presplit proofs for: the configured ones, or else the step price and
+// minimum purchase of the mint, which upstream gateways sharing the pricing also ask for
+func (m *Merchant) presplitAmounts(mintConfig config_manager.MintConfig) []uint64 {
+	if amounts := m.getConfig().Wallet.PresplitAmounts; len(amounts) > 0 {
+		return amounts
+	}
+	if unit, err := config_manager.NormalizeUnit(mintConfig.PriceUnit); err != nil || unit != config_manager.UnitSat {
+		return nil
+	}
+	mintConfig, _ = m.effectiveMintConfig(mintConfig)
+	return []uint64{mintConfig.PricePerStep, mintConfig.PricePerStep * max(mintConfig.MinPurchaseSteps, 1)}
+}
+
 // processPayout checks balances and processes payouts for each mint
 func (m *Merchant) processPayout(mintConfig config_manager.MintConfig) {
 	// Get current balance
@@ -143,6 +484,16 @@ func (m *Merchant) processPayout(mintConfig config_manager.MintConfig) {
 		return
 	}
 
+	// Proofs held without swapping are consolidated once they are about to be paid out
+	if _, err := m.tollwallet.ConsolidateHeldProofs(mintConfig.URL); err != nil {
+		log.Printf("Warning: failed to consolidate held proofs for %s: %v", mintConfig.URL, err)
+	}
+	balance = m.tollwallet.GetBalanceByMint(mintConfig.URL)
+	if balance < mintConfig.MinPayoutAmount {
+		log.Printf("Skipping payout %s, Balance %d after consolidation does not meet threshold of %d", mintConfig.URL, balance, mintConfig.MinPayoutAmount)
+		return
+	}
+
 	// Get the amount we intend to payout to the owner.
 	// The tolerancePaymentAmount is the max amount we're willing to spend on the transaction, most of which should come back as change.
 	aimedPaymentAmount := balance - mintConfig.MinBalance
@@ -152,21 +503,31 @@ func (m *Merchant) processPayout(mintConfig config_manager.MintConfig) {
 		return
 	}
 
-	for _, profitShare := range m.config.ProfitShare {
-		aimedAmount := uint64(math.Round(float64(aimedPaymentAmount) * profitShare.Factor))
+	// Revenue from interfaces with their own profit share flows to their owners, the rest to the default profit share
+	shares, settled := splitPayout(m.getConfig(), m.revenueSplit.get(mintConfig.URL), aimedPaymentAmount)
+	for _, share := range shares {
 		// Lookup lightning address from identities based on the profitShare.Identity name
-		profitShareIdentity, err := identities.GetPublicIdentity(profitShare.Identity)
+		profitShareIdentity, err := identities.GetPublicIdentity(share.identity)
 		if err != nil {
 			log.Printf("Warning: Could not find public identity for profit share: %v", err)
 			continue // Skip this profit share if identity not found
 		}
-		m.PayoutShare(mintConfig, aimedAmount, profitShareIdentity.LightningAddress)
+		m.PayoutShare(mintConfig, share.amount, profitShareIdentity.LightningAddress)
 	}
+	m.revenueSplit.settle(mintConfig.URL, settled)
 
 	log.Printf("Payout completed for mint %s", mintConfig.URL)
+
+	// Resume a mint paused for its exposure once the payout brought its balance under the cap
+	m.updateExposurePause(mintConfig)
 }
 
 func (m *Merchant) PayoutShare(mintConfig config_manager.MintConfig, aimedPaymentAmount uint64, lightningAddress string) {
+	if err := m.walletLocked(); err != nil {
+		log.Printf("Skipping payout for mint %s: %v", mintConfig.URL, err)
+		return
+	}
+
 	tolerancePaymentAmount := aimedPaymentAmount + (aimedPaymentAmount * mintConfig.BalanceTolerancePercent / 100)
 
 	log.Printf("Processing payout for mint %s: aiming for %d sats with %d sats tolerance", mintConfig.URL, aimedPaymentAmount, tolerancePaymentAmount)
@@ -177,8 +538,17 @@ func (m *Merchant) PayoutShare(mintConfig config_manager.MintConfig, aimedPaymen
 	// If melting fails try to return the money to the wallet
 	if meltErr != nil {
 		log.Printf("Error during payout for mint %s. Error melting to lightning. Skipping... %v", mintConfig.URL, meltErr)
+		m.errorCounters.add("payout-failed")
 		return
 	}
+
+	payout := map[string]string{
+		"mint":              mintConfig.URL,
+		"amount":            fmt.Sprintf("%d", aimedPaymentAmount),
+		"lightning_address": lightningAddress,
+	}
+	m.configManager.Audit("payout-routine", config_manager.AuditPayout, payout)
+	m.configManager.AuditFinancial("payout-routine", config_manager.AuditPayout, payout)
 }
 
 type PurchaseSessionResult struct {
@@ -188,6 +558,8 @@ type PurchaseSessionResult struct {
 
 // PurchaseSession processes a payment event and returns either a session event or a notice event
 func (m *Merchant) PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, error) {
+	purchaseStart := time.Now()
+
 	// Extract payment token from payment event
 	paymentToken, err := m.extractPaymentToken(paymentEvent)
 	if err != nil {
@@ -220,6 +592,146 @@ func (m *Merchant) PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, erro
 		return noticeEvent, nil
 	}
 
+	if m.getConfig().Analytics.DeviceClassification {
+		m.deviceAnalytics.record(deviceIdentifier)
+	}
+
+	// Zero-value payments are access probes: report session status without spending anything. They are answered
+	// before a gift retargets the payment, so a device only learns the status of its own session.
+	if isAccessProbe(paymentToken) {
+		return m.handleAccessProbe(deviceIdentifier, paymentEvent.PubKey)
+	}
+
+	// A gift buys access for another device, which takes the place of the payer's device from here on
+	paymentGift := extractGift(paymentEvent)
+	if paymentGift != nil {
+		if err := m.checkGift(paymentGift, deviceIdentifier); err != nil {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "gift-invalid", err.Error(), paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("invalid gift and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+		log.Printf("Payment from %s is a gift for %s", deviceIdentifier, paymentGift.macAddress)
+		deviceIdentifier = paymentGift.macAddress
+	}
+
+	// Turn away tokens and pubkeys that recently failed to pay before anything reaches the mint
+	negativeCacheTTL := m.negativeCacheTTL()
+	if negativeCacheTTL > 0 {
+		if rejection, found := m.negativeCache.rejectedToken(paymentToken); found {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", rejection.code, rejection.message, paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("token recently rejected and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+		if m.negativeCache.blockedPubkey(paymentEvent.PubKey, m.getConfig().NegativeCache.PubkeyFailures) {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "too-many-failed-payments",
+				fmt.Sprintf("Too many failed payments, try again in %s", negativeCacheTTL), paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("too many failed payments and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+	}
+
+	// Randomized addresses change between connections, losing the session and resetting data caps
+	if m.refusesRandomizedMAC(deviceIdentifier) {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "randomized-mac-refused",
+			"This TollGate does not serve randomized MAC addresses, turn off the private Wi-Fi address for this network and reconnect",
+			paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("randomized MAC refused and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Owners halted the gateway, nothing is sold until a quorum of them resumes it
+	if halt := m.emergencyStop.halted(); halt != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "gateway-halted",
+			"This TollGate is out of service, ask staff for access", paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("gateway halted and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// The wallet balance left with an exported state archive, payments belong to the replacement router now
+	if m.migrated.Load() {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "gateway-migrating",
+			"This TollGate is being replaced, try again once the new one is up", paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("gateway migrating and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// The venue requires the terms of service to be accepted before anyone pays
+	noticeEvent, err := m.rejectUnacceptedTerms(paymentEvent)
+	if err != nil {
+		return nil, fmt.Errorf("terms of service not accepted and failed to create notice: %w", err)
+	}
+	if noticeEvent != nil {
+		return noticeEvent, nil
+	}
+
+	// Shed bursts of payments with a busy notice instead of letting them time out against the mint and the valve
+	release, retryAfter, admitted := m.purchaseQueue.admit()
+	if !admitted {
+		return m.busyNotice(paymentEvent.PubKey, retryAfter)
+	}
+	defer release()
+
+	// Payments naming a venue service buy it instead of internet access
+	if serviceID := extractService(paymentEvent); serviceID != "" {
+		return m.purchaseService(paymentEvent, serviceID, paymentToken, deviceIdentifier)
+	}
+	// Payments naming a tier move the active session to it for the rest of its time
+	if tier := extractUpgrade(paymentEvent); tier != "" {
+		return m.purchaseUpgrade(paymentEvent, tier, paymentToken, deviceIdentifier)
+	}
+	// Payments naming a subscription plan buy time every day for the length of the pass
+	if planID := extractSubscription(paymentEvent); planID != "" {
+		return m.purchaseSubscription(paymentEvent, planID, paymentToken, deviceIdentifier)
+	}
+	// Payments naming a special-purpose plan buy days at the plan's rate, outside the tier ladder
+	if planID := extractPlan(paymentEvent); planID != "" {
+		return m.purchasePlan(paymentEvent, planID, paymentToken, deviceIdentifier)
+	}
+
+	// Use the prices locked by a reservation if the payment references one, otherwise the current config
+	pricingConfig := m.getConfig()
+	reservationID := extractReservationID(paymentEvent)
+	if reservationID != "" {
+		res, err := m.lookupReservation(reservationID, deviceIdentifier)
+		if err != nil {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "reservation-invalid", err.Error(), paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("invalid reservation and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+		pricingConfig = res.config
+	} else if !m.checkCapacity(deviceIdentifier) {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "capacity-full",
+			"No capacity left for new sessions, try again later", paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("no capacity left and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Refuse clients whose weak signal would take up airtime for everyone before redeeming the payment
+	stationAdmission, err := m.checkAdmission(deviceIdentifier)
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "signal-too-weak", err.Error(), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("signal too weak and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
 	// Process payment
 	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
 	if err != nil {
@@ -230,36 +742,111 @@ func (m *Merchant) PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, erro
 		}
 		return noticeEvent, nil
 	}
+	if err := checkTokenUnit(paymentCashuToken); err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "payment-error-unit", err.Error(), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("token unit not accepted and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
 
-	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
-	if err != nil {
-		var errorCode string
-		var errorMessage string
-
-		// Check for specific error types
-		if strings.Contains(err.Error(), "Token already spent") {
-			errorCode = "payment-error-token-spent"
-			errorMessage = "Token has already been spent"
-		} else {
-			errorCode = "payment-processing-failed"
-			errorMessage = fmt.Sprintf("Payment processing failed: %v", err)
+	// Price the metric the customer asked for, if the gateway offers it
+	if requestedMetric := extractRequestedMetric(paymentEvent); requestedMetric != "" {
+		metricConfig, err := pricingConfig.ForMetric(paymentCashuToken.Mint(), requestedMetric)
+		if err != nil {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "metric-not-offered", err.Error(), paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("metric not offered and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
 		}
+		pricingConfig = metricConfig
+	}
 
-		noticeEvent, noticeErr := m.CreateNoticeEvent("error", errorCode, errorMessage, paymentEvent.PubKey)
+	// Refuse group requests the gateway can't serve before redeeming the payment
+	groupSize, err := extractGroupSize(paymentEvent)
+	if err == nil && groupSize > 0 {
+		err = m.checkGroupRequest(groupSize)
+	}
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "group-not-offered", err.Error(), paymentEvent.PubKey)
 		if noticeErr != nil {
-			return nil, fmt.Errorf("payment processing failed and failed to create notice: %w", noticeErr)
+			return nil, fmt.Errorf("group not offered and failed to create notice: %w", noticeErr)
 		}
 		return noticeEvent, nil
 	}
 
+	// Refuse extra devices the gateway can't add to the customer's session before redeeming the payment
+	extraDevices := extractExtraDevices(paymentEvent)
+	if len(extraDevices) > 0 {
+		err := m.checkExtraDevices(deviceIdentifier, extraDevices)
+		if err == nil && paymentGift != nil {
+			err = fmt.Errorf("a gift is for a single device")
+		}
+		if err != nil {
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "devices-not-offered", err.Error(), paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("extra devices not offered and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+	}
+
+	// Refuse payments from mints paused for their fees or exposure before redeeming them
+	if mintConfig := m.findMintConfig(paymentCashuToken.Mint()); mintConfig != nil {
+		if _, accepted := m.effectiveMintConfig(*mintConfig); !accepted {
+			reason := "its fees exceed the price"
+			if m.exposure.isPaused(mintConfig.URL) {
+				reason = "this gateway holds enough of its ecash"
+			}
+			noticeEvent, noticeErr := m.CreateNoticeEvent("error", "mint-paused",
+				fmt.Sprintf("Payments from %s are paused because %s, please pay with another mint", mintConfig.URL, reason),
+				paymentEvent.PubKey)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("mint paused and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+	}
+
+	// Refuse payments over the tier caps before redeeming them
+	if m.getConfig().SessionCaps.ExcessPolicy == excessPolicyReject {
+		noticeEvent, err := m.rejectOverCap(pricingConfig, paymentCashuToken, deviceIdentifier, paymentEvent.PubKey)
+		if err != nil {
+			return nil, fmt.Errorf("payment exceeds session cap and failed to create notice: %w", err)
+		}
+		if noticeEvent != nil {
+			return noticeEvent, nil
+		}
+	}
+
+	redeemStart := time.Now()
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
+	redeemDuration := time.Since(redeemStart)
+	if err != nil {
+		return m.redeemFailedNotice(err, paymentToken, paymentEvent.PubKey)
+	}
+
+	// The customer paid, the latency budget runs from here until the gate is confirmed open
+	verifiedAt := time.Now()
 	log.Printf("Amount after swap: %d", amountAfterSwap)
+	m.checkExposure(paymentCashuToken.Mint())
+
+	// The payment is redeemed, the reservation has served its purpose
+	if reservationID != "" {
+		defer m.releaseReservation(reservationID)
+	}
 
 	// Calculate allotment using the configured metric and mint-specific pricing
 	mintURL := paymentCashuToken.Mint()
-	allotment, err := m.calculateAllotment(amountAfterSwap, mintURL)
+	returning := m.isReturningCustomer(paymentEvent.PubKey, deviceIdentifier)
+	allotment, err := m.calculateAllotment(pricingConfig, amountAfterSwap, mintURL, returning)
+	if strategy := m.getPricingStrategy(); strategy != nil {
+		allotment, err = m.priceWithStrategy(strategy, pricingConfig, amountAfterSwap, mintURL, deviceIdentifier, allotment, err)
+	}
 	if err != nil {
-		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "allotment-calculation-failed",
-			fmt.Sprintf("Failed to calculate allotment: %v", err), paymentEvent.PubKey)
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, deviceIdentifier, mintURL, amountAfterSwap,
+			"allotment-calculation-failed", fmt.Sprintf("Failed to calculate allotment: %v", err))
 		if noticeErr != nil {
 			return nil, fmt.Errorf("failed to calculate allotment and failed to create notice: %w", noticeErr)
 		}
@@ -269,44 +856,182 @@ func (m *Merchant) PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, erro
 	// Use MAC-address based session management
 	macAddress := deviceIdentifier
 
+	// Determine tier based on payment amount (Trail's Coffee pricing)
+	tier := determineTier(pricingConfig, amountAfterSwap)
+	if stationAdmission.downTier {
+		tier = pricingConfig.BaseTier()
+	}
+	log.Printf("Determined tier: %s for payment amount: %d", tier, amountAfterSwap)
+
+	// Return anything over the tier caps as change
+	var changeTags []nostr.Tag
+	paidAllotment := allotment
+	if m.getConfig().SessionCaps.ExcessPolicy == excessPolicyRefund {
+		var changeToken string
+		allotment, changeToken = m.refundOverCap(pricingConfig, tier, macAddress, mintURL, allotment)
+		if changeToken != "" {
+			changeTags = append(changeTags, nostr.Tag{"change", changeToken})
+		}
+		if allotment == 0 {
+			noticeEvent, noticeErr := m.createNoticeEventWithTags("error", "session-cap-exceeded",
+				fmt.Sprintf("Session cap for the %s tier reached, payment returned as change", tier),
+				paymentEvent.PubKey, changeTags...)
+			if noticeErr != nil {
+				return nil, fmt.Errorf("session cap reached and failed to create notice: %w", noticeErr)
+			}
+			return noticeEvent, nil
+		}
+	}
+
 	// Add allotment to session (creates new session if doesn't exist)
-	metric := "milliseconds" // Use milliseconds as default metric
-	session, err := m.AddAllotment(macAddress, metric, allotment)
+	metric := pricingConfig.Metric
+	if mintConfig := findMintConfigIn(pricingConfig, mintURL); mintConfig != nil {
+		metric = pricingConfig.MetricFor(*mintConfig)
+	}
+	// Only the share of the payment that was not returned as change is refundable
+	paid := amountAfterSwap
+	if paidAllotment > 0 && allotment < paidAllotment {
+		paid = amountAfterSwap * allotment / paidAllotment
+	}
+
+	// Devices sharing a session follow it. A group ends with its session, a new session starts without members.
+	// With pubkey sessions the payment goes to the session of the customer, wherever it is held.
+	sessionPubkey := paymentEvent.PubKey
+	if paymentGift != nil {
+		sessionPubkey = "" // A gift is for someone else's device
+	}
+	pool := m.pubkeySessionPool(sessionPubkey, macAddress)
+	if m.remainingAllotment(pool) == 0 {
+		m.closeSessionGroup(pool)
+		pool = macAddress
+	}
+	newSession := m.remainingAllotment(pool) == 0
+	session, err := m.addAllotment(macAddress, sessionPubkey, extraDevices, metric, allotment)
 	if err != nil {
-		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "session-management-failed",
-			fmt.Sprintf("Failed to manage session: %v", err), paymentEvent.PubKey)
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, paid,
+			"session-management-failed", fmt.Sprintf("Failed to manage session: %v", err), changeTags...)
 		if noticeErr != nil {
 			return nil, fmt.Errorf("failed to manage session and failed to create notice: %w", noticeErr)
 		}
 		return noticeEvent, nil
 	}
 
-	// Calculate end timestamp based on session allotment
-	var endTimestamp int64
-	if session.Metric == "milliseconds" {
-		endTimestamp = session.StartTime + int64(session.Allotment/1000)
-	} else {
-		// For other metrics, set to 24h from now
-		endTimestamp = time.Now().Unix() + (24 * 60 * 60) // 24 hours from now
-	}
+	// The customer sees the shared session under the paying device
+	pool = session.MacAddress
+	session.MacAddress = macAddress
 
-	// Determine tier based on payment amount (Trail's Coffee pricing)
-	tier := determineTier(amount)
-	log.Printf("Determined tier: %s for payment amount: %d", tier, amount)
+	// Calculate end timestamp based on session allotment
+	endTimestamp := sessionEndTimestamp(session)
 
 	// Open gate until the calculated end time with appropriate tier
-	err = valve.OpenGateUntil(macAddress, endTimestamp, tier)
+	gateStart := time.Now()
+	gate, err := m.openGate(macAddress, endTimestamp, tier)
+	gateDuration := time.Since(gateStart)
 	if err != nil {
-		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "gate-opening-failed",
-			fmt.Sprintf("Failed to open gate for session: %v", err), paymentEvent.PubKey)
+		m.withdrawAllotment(pool, allotment)
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, paid,
+			"gate-opening-failed", fmt.Sprintf("Failed to open gate for session: %v", err), changeTags...)
 		if noticeErr != nil {
 			return nil, fmt.Errorf("failed to open gate for session and failed to create notice: %w", noticeErr)
 		}
 		return noticeEvent, nil
 	}
+	if gate.Opened {
+		log.Printf("Opened gate of %s until %d", macAddress, endTimestamp)
+	} else {
+		log.Printf("Extended gate of %s from %d until %d", macAddress, gate.PreviousUntil, endTimestamp)
+	}
+
+	latencyTags := m.compensateSlowGate(paymentEvent, macAddress, metric, tier, allotment, time.Since(verifiedAt))
+
+	m.setSessionTier(pool, tier)
+
+	var groupTags []nostr.Tag
+	if groupSize > 0 {
+		group, err := m.createSessionGroup(macAddress, paymentEvent.PubKey, groupSize)
+		if err != nil {
+			log.Printf("Warning: failed to create session group for %s: %v", macAddress, err)
+		} else {
+			groupTags = append(groupTags, nostr.Tag{"group-code", group.code, fmt.Sprintf("%d", group.maxMembers)})
+		}
+	}
+	if pool != macAddress {
+		if _, err := m.openGate(pool, endTimestamp, tier); err != nil {
+			log.Printf("Warning: failed to extend gate of %s sharing the session: %v", pool, err)
+		}
+	}
+	m.extendGroupGates(pool, endTimestamp, tier)
+	if sessionPubkey != "" && m.getConfig().PubkeySessions.Enabled {
+		groupTags = append(groupTags, m.sharedDeviceTags(pool)...)
+	}
+
+	received := paymentCashuToken.Amount()
+	swapFee := uint64(0)
+	if received > amountAfterSwap {
+		swapFee = received - amountAfterSwap
+	}
+	m.recordSessionPayment(pool, paymentEvent.PubKey, mintURL, paid, allotment, newSession)
+	bindTags := m.bindRandomizedSession(macAddress)
+
+	// The self-test pays with the gateway's own money, which is neither revenue nor a customer to ask for feedback
+	if !m.isSelfTestPayment(paymentEvent.PubKey) {
+		iface := m.clientInterface(macAddress)
+		m.recordRevenue(mintURL, iface, paid)
+		if err := m.ledger.record(LedgerEntry{
+			Type:       LedgerPayment,
+			MacAddress: macAddress,
+			Pubkey:     paymentEvent.PubKey,
+			MintURL:    mintURL,
+			Amount:     paid,
+			Received:   received,
+			SwapFee:    swapFee,
+			Allotment:  allotment,
+			Metric:     metric,
+			EventID:    paymentEvent.ID,
+			Interface:  iface,
+			TermsHash:  extractAcceptedTerms(paymentEvent),
+		}); err != nil {
+			log.Printf("Warning: failed to record payment of %s: %v", macAddress, err)
+		}
+
+		// Ask the customer for feedback once the session ends
+		m.recordCustomerSession(paymentEvent.PubKey, endTimestamp)
+		m.recordLoyaltyPurchase(paymentEvent.PubKey, macAddress)
+	}
+
+	// Let customers and auditors check that nothing beyond the advertised price and the mint's fees was taken
+	sessionTags := append(changeTags, groupTags...)
+	sessionTags = append(sessionTags, bindTags...)
+	sessionTags = append(sessionTags, latencyTags...)
+	sessionTags = append(sessionTags,
+		nostr.Tag{"amount-received", fmt.Sprintf("%d", received)},
+		nostr.Tag{"swap-fee", fmt.Sprintf("%d", swapFee)},
+		nostr.Tag{"amount-credited", fmt.Sprintf("%d", paid)})
+
+	// Show developers where slow purchases spend their time
+	if m.getConfig().Diagnostics.TimingTags {
+		sessionTags = append(sessionTags,
+			nostr.Tag{"token-redeem-ms", fmt.Sprintf("%d", redeemDuration.Milliseconds())},
+			nostr.Tag{"gate-open-ms", fmt.Sprintf("%d", gateDuration.Milliseconds())},
+			nostr.Tag{"purchase-ms", fmt.Sprintf("%d", time.Since(purchaseStart).Milliseconds())})
+	}
+	// Tell down-tiered customers why they didn't get the tier they paid for
+	if stationAdmission.downTier {
+		sessionTags = append(sessionTags, nostr.Tag{"weak-signal", fmt.Sprintf("%d", stationAdmission.signalDBm)})
+	}
+	// The prefix routed to a premium device, which it configures to accept inbound connections
+	if prefix := valve.DelegatedPrefix(macAddress); prefix != "" {
+		sessionTags = append(sessionTags, nostr.Tag{"ipv6-prefix", prefix})
+	}
+
+	// The payer gets the session as response, the recipient of a gift a copy through the local relay
+	if paymentGift != nil {
+		m.sendGiftReceipt(session, paymentGift, paymentEvent.PubKey, groupTags...)
+		sessionTags = append(sessionTags, nostr.Tag{"gift", paymentGift.macAddress})
+	}
 
 	// Create a success notice event
-	sessionEvent, err := m.createSessionEvent(session, paymentEvent.PubKey)
+	sessionEvent, err := m.createSessionEvent(session, paymentEvent.PubKey, sessionTags...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session event: %w", err)
 	}
@@ -314,11 +1039,189 @@ func (m *Merchant) PurchaseSession(paymentEvent nostr.Event) (*nostr.Event, erro
 	return sessionEvent, nil
 }
 
+// redeemFailedNotice answers a payment the wallet failed to redeem, remembering the failure in the negative cache
+func (m *Merchant) redeemFailedNotice(err error, paymentToken, customerPubkey string) (*nostr.Event, error) {
+	var errorCode string
+	var errorMessage string
+
+	// Check for specific error types
+	if strings.Contains(err.Error(), "Token already spent") {
+		errorCode = "payment-error-token-spent"
+		errorMessage = "Token has already been spent"
+	} else {
+		errorCode = "payment-processing-failed"
+		errorMessage = fmt.Sprintf("Payment processing failed: %v", err)
+	}
+
+	// A spent token stays spent, other failures may pass once the mint is reachable again
+	if negativeCacheTTL := m.negativeCacheTTL(); negativeCacheTTL > 0 {
+		if errorCode == "payment-error-token-spent" {
+			m.negativeCache.rejectToken(paymentToken, errorCode, errorMessage, negativeCacheTTL)
+		}
+		m.negativeCache.recordFailure(customerPubkey, negativeCacheTTL)
+	}
+	m.observeFailedRedemption(customerPubkey, paymentToken)
+
+	noticeEvent, noticeErr := m.CreateNoticeEvent("error", errorCode, errorMessage, customerPubkey)
+	if noticeErr != nil {
+		return nil, fmt.Errorf("payment processing failed and failed to create notice: %w", noticeErr)
+	}
+	return noticeEvent, nil
+}
+
+// isAccessProbe reports whether a payment token carries no value and should be treated as an access probe
+func isAccessProbe(paymentToken string) bool {
+	token := strings.TrimSpace(paymentToken)
+	return token == "" || token == "0"
+}
+
+// handleAccessProbe answers a zero-value payment with the current session or, if there is none, a price quote
+func (m *Merchant) handleAccessProbe(macAddress, customerPubkey string) (*nostr.Event, error) {
+	session, err := m.GetSession(macAddress)
+	if err == nil && isCustomerSessionActive(session) {
+		log.Printf("Access probe for %s: session active", macAddress)
+		return m.createSessionEvent(session, customerPubkey)
+	}
+
+	log.Printf("Access probe for %s: no active session, returning quote", macAddress)
+	return m.CreateNoticeEvent("info", "access-probe-no-session",
+		m.createQuoteMessage()+m.loyaltyQuoteMessage(customerPubkey, macAddress), customerPubkey)
+}
+
+// isCustomerSessionActive checks whether a MAC-address based session still has allotment left
+func isCustomerSessionActive(session *CustomerSession) bool {
+	if session.Metric != "milliseconds" {
+		// Non-time metrics don't expire by themselves
+		return session.Allotment > 0
+	}
+	endTimestamp := session.StartTime + int64(session.Allotment/1000)
+	return time.Now().Unix() < endTimestamp
+}
+
+// createQuoteMessage describes the current pricing for customers without an active session
+func (m *Merchant) createQuoteMessage() string {
+	config := m.getConfig()
+	quotes := make([]string, 0, len(config.AcceptedMints))
+	for _, mint := range m.pricedMints(config) {
+		quote := fmt.Sprintf("%d %s per %d %s via %s (minimum %d steps)",
+			mint.PricePerStep, mint.PriceUnit, config.StepSizeFor(mint), config.MetricFor(mint), mint.URL, mint.MinPurchaseSteps)
+		if fiat := m.mintFiatPrice(config, mint); fiat != nil {
+			quote += fmt.Sprintf(", about %s %s per %s", formatFiat(fiat.Amount), fiat.Currency, fiat.Per)
+		}
+		quotes = append(quotes, quote)
+	}
+	return fmt.Sprintf("No active session. Pricing: %s", strings.Join(quotes, "; "))
+}
+
+// refreshAdvertisement rebuilds the advertisement from the current config and reputation
+func (m *Merchant) refreshAdvertisement() error {
+	config := m.getConfig()
+	mints := m.pricedMints(config)
+	extraTags := append(m.reputation.summaryTags(), m.fiatTags(config, mints)...)
+	extraTags = append(extraTags, m.priceUnitTags(config, mints)...)
+	extraTags = append(extraTags, m.paymentRequestTags(config, mints)...)
+	extraTags = append(extraTags, m.surgeTags()...)
+	advertisementStr, err := createAdvertisement(m.configManager, mints, extraTags...)
+	if err != nil {
+		return err
+	}
+	code, err := newAdvertisementCode(config, advertisementStr)
+	if err != nil {
+		log.Printf("Warning: failed to encode advertisement for printing: %v", err)
+	}
+
+	m.advertisementMu.Lock()
+	m.advertisement = advertisementStr
+	m.advertisementCode = code
+	m.advertisementMu.Unlock()
+	m.history.recordPrices(config, mints)
+	return nil
+}
+
 func (m *Merchant) GetAdvertisement() string {
+	m.advertisementMu.RLock()
+	defer m.advertisementMu.RUnlock()
 	return m.advertisement
 }
 
-func CreateAdvertisement(configManager *config_manager.ConfigManager) (string, error) {
+// MintPricing describes the price of a step when paying with a specific mint
+type MintPricing struct {
+	URL              string     `json:"url"`
+	PricePerStep     uint64     `json:"price_per_step"`
+	PriceUnit        string     `json:"price_unit"`
+	MinPurchaseSteps uint64     `json:"min_purchase_steps"`
+	Metric           string     `json:"metric"`
+	StepSize         uint64     `json:"step_size"`
+	Fiat             *FiatPrice `json:"fiat,omitempty"` // Price in the display currency, if shown
+}
+
+// TierInfo describes a service tier and the payment needed to reach it
+type TierInfo struct {
+	Name               string `json:"name"`
+	MinPaymentAmount   uint64 `json:"min_payment_amount"`
+	BandwidthLimitKbps int    `json:"bandwidth_limit_kbps"`             // 0 = unlimited
+	Restrictions       string `json:"restrictions,omitempty"`           // Destinations the tier can't reach, empty = unrestricted
+	UpgradePerHour     uint64 `json:"upgrade_price_per_hour,omitempty"` // Surcharge per hour left to upgrade an active session to the tier, 0 = not offered
+}
+
+// PricingInfo is a machine-readable summary of the current pricing for non-nostr clients
+type PricingInfo struct {
+	Metric        string        `json:"metric"`
+	StepSize      uint64        `json:"step_size"`
+	AcceptedMints []MintPricing `json:"accepted_mints"`
+	Tiers         []TierInfo    `json:"tiers"`
+	Loyalty       *LoyaltyInfo  `json:"loyalty,omitempty"` // Returning customer pricing, if offered
+	Terms         *TermsInfo    `json:"terms,omitempty"`   // Terms of service payments have to accept, if required
+}
+
+// GetPricingInfo returns the current pricing, accepted mints and tier details
+func (m *Merchant) GetPricingInfo() PricingInfo {
+	config := m.getConfig()
+	info := PricingInfo{
+		Metric:        config.Metric,
+		StepSize:      config.StepSize,
+		AcceptedMints: make([]MintPricing, 0, len(config.AcceptedMints)),
+		Tiers:         make([]TierInfo, 0, len(config.TierLadder())),
+	}
+
+	for _, mint := range m.pricedMints(config) {
+		info.AcceptedMints = append(info.AcceptedMints, MintPricing{
+			URL:              mint.URL,
+			PricePerStep:     mint.PricePerStep,
+			PriceUnit:        mint.PriceUnit,
+			MinPurchaseSteps: mint.MinPurchaseSteps,
+			Metric:           config.MetricFor(mint),
+			StepSize:         config.StepSizeFor(mint),
+			Fiat:             m.mintFiatPrice(config, mint),
+		})
+	}
+
+	for _, tier := range config.TierLadder() {
+		info.Tiers = append(info.Tiers, TierInfo{
+			Name:               tier.Name,
+			MinPaymentAmount:   tier.MinAmount,
+			BandwidthLimitKbps: tier.BandwidthKbps,
+			Restrictions:       config.TierPolicies[tier.Name].Description,
+			UpgradePerHour:     upgradePricePerHour(config.TierUpgrade, tier.Name),
+		})
+	}
+	info.Loyalty = m.GetLoyaltyInfo("")
+	info.Terms = termsInfo(config.Terms)
+
+	return info
+}
+
+// CreateAdvertisement creates the signed advertisement event, with optional extra tags such as the reputation summary
+func CreateAdvertisement(configManager *config_manager.ConfigManager, extraTags ...nostr.Tag) (string, error) {
+	config := configManager.GetConfig()
+	if config == nil {
+		return "", fmt.Errorf("main config is nil")
+	}
+	return createAdvertisement(configManager, config.AcceptedMints, extraTags...)
+}
+
+// createAdvertisement creates the signed advertisement event offering the given mints
+func createAdvertisement(configManager *config_manager.ConfigManager, mints []config_manager.MintConfig, extraTags ...nostr.Tag) (string, error) {
 	config := configManager.GetConfig()
 	if config == nil {
 		return "", fmt.Errorf("main config is nil")
@@ -335,16 +1238,68 @@ func CreateAdvertisement(configManager *config_manager.ConfigManager) (string, e
 	}
 
 	// Create a map of prices mints and their fees
-	for _, mintConfig := range config.AcceptedMints {
-		advertisementEvent.Tags = append(advertisementEvent.Tags, nostr.Tag{
-			"price_per_step",
-			"cashu",
-			fmt.Sprintf("%d", mintConfig.PricePerStep),
-			mintConfig.PriceUnit,
-			mintConfig.URL,
-			fmt.Sprintf("%d", mintConfig.MinPurchaseSteps),
-		})
+	for _, mintConfig := range mints {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, mintPriceTag(config, mintConfig))
+	}
+	// What each restricted tier can't reach, so customers know what they pay for
+	for _, tier := range config.TierLadder() {
+		if policy, restricted := config.TierPolicies[tier.Name]; restricted {
+			advertisementEvent.Tags = append(advertisementEvent.Tags, nostr.Tag{"tier_policy", tier.Name, policy.Description})
+		}
+	}
+	// Tiers getting a routed IPv6 prefix that accepts inbound connections
+	if config.IPv6Prefix.Enabled && len(config.IPv6Prefix.Tiers) > 0 {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, append(nostr.Tag{"ipv6_prefix", "64"}, config.IPv6Prefix.Tiers...))
 	}
+	// Metrics customers may request instead, at the same price per step
+	for _, option := range config.MetricOptions {
+		advertisementEvent.Tags = append(advertisementEvent.Tags,
+			nostr.Tag{"metric_option", option.Metric, fmt.Sprintf("%d", option.StepSize)})
+	}
+	if zapTag := zapPriceTag(configManager, config); zapTag != nil {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, zapTag)
+	}
+	// Amounts between step prices buy a partial step instead of being kept
+	if config.Pricing.ProRata {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, nostr.Tag{"pro_rata", "1"})
+	}
+	// Venue services sold with the same wallet
+	for _, service := range config.Services {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, serviceTag(service))
+	}
+	// Passes granting time every day
+	for _, plan := range config.Subscriptions {
+		if findSubscriptionPlan(config, plan.ID) != nil {
+			advertisementEvent.Tags = append(advertisementEvent.Tags, subscriptionTag(plan))
+		}
+	}
+	// Low-rate plans for machine customers, priced separately from the tier ladder
+	for _, plan := range config.Plans {
+		if findPlan(config, plan.ID) != nil {
+			advertisementEvent.Tags = append(advertisementEvent.Tags, planTag(plan))
+		}
+	}
+	// Surcharges per hour left to upgrade an active session
+	advertisementEvent.Tags = append(advertisementEvent.Tags, upgradeTags(config)...)
+	// Whether randomized MAC addresses have to bind their session to a pubkey or are refused
+	if tag := randomizedMACTag(config.RandomizedMACs); tag != nil {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, tag)
+	}
+	// Gates open within this many milliseconds of the payment, or the session is credited
+	if config.GateLatency.BudgetMs > 0 {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, nostr.Tag{"gate_latency_budget", fmt.Sprintf("%d", config.GateLatency.BudgetMs)})
+	}
+	// Terms of service payments have to accept in a tos-accepted tag with this hash
+	if tag := termsTag(config.Terms); tag != nil {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, tag)
+	}
+	// Daily traffic caps per device and the rate devices over them are throttled to
+	advertisementEvent.Tags = append(advertisementEvent.Tags, fairUseTags(config)...)
+	// Payments without this NIP-13 difficulty are rejected
+	if config.PaymentPoW.MinDifficulty > 0 {
+		advertisementEvent.Tags = append(advertisementEvent.Tags, nostr.Tag{"pow", fmt.Sprintf("%d", config.PaymentPoW.MinDifficulty)})
+	}
+	advertisementEvent.Tags = append(advertisementEvent.Tags, extraTags...)
 
 	identities := configManager.GetIdentities()
 	if identities == nil {
@@ -369,6 +1324,23 @@ func CreateAdvertisement(configManager *config_manager.ConfigManager) (string, e
 	return string(detailsBytes), nil
 }
 
+// mintPriceTag returns the price_per_step tag of a mint. Mints that override the metric or step size
+// carry them as two extra elements, so clients don't apply the global ones.
+func mintPriceTag(config *config_manager.Config, mint config_manager.MintConfig) nostr.Tag {
+	tag := nostr.Tag{
+		"price_per_step",
+		"cashu",
+		fmt.Sprintf("%d", mint.PricePerStep),
+		mint.PriceUnit,
+		mint.URL,
+		fmt.Sprintf("%d", mint.MinPurchaseSteps),
+	}
+	if mint.Metric != "" || mint.StepSize != 0 {
+		tag = append(tag, config.MetricFor(mint), fmt.Sprintf("%d", config.StepSizeFor(mint)))
+	}
+	return tag
+}
+
 // extractPaymentToken extracts the payment token from a payment event
 func (m *Merchant) extractPaymentToken(paymentEvent nostr.Event) (string, error) {
 	for _, tag := range paymentEvent.Tags {
@@ -379,6 +1351,16 @@ func (m *Merchant) extractPaymentToken(paymentEvent nostr.Event) (string, error)
 	return "", fmt.Errorf("no payment tag found in event")
 }
 
+// extractRequestedMetric returns the metric a payment event asks for, or "" for the mint's metric
+func extractRequestedMetric(paymentEvent nostr.Event) string {
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "metric" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
 // extractDeviceIdentifier extracts the device identifier (MAC address) from a payment event
 func (m *Merchant) extractDeviceIdentifier(paymentEvent nostr.Event) (string, error) {
 	for _, tag := range paymentEvent.Tags {
@@ -389,54 +1371,109 @@ func (m *Merchant) extractDeviceIdentifier(paymentEvent nostr.Event) (string, er
 	return "", fmt.Errorf("no device-identifier tag found in event")
 }
 
-// calculateAllotment calculates allotment using the configured metric and mint-specific pricing
-func (m *Merchant) calculateAllotment(amountSats uint64, mintURL string) (uint64, error) {
-	// Find the mint configuration for this mint
-	var mintConfig *config_manager.MintConfig
-	for _, mint := range m.config.AcceptedMints {
-		if mint.URL == mintURL {
-			mintConfig = &mint
-			break
-		}
+// calculateAllotment calculates allotment using the metric and mint-specific pricing of a config snapshot,
+// at the loyalty price for returning customers
+func (m *Merchant) calculateAllotment(config *config_manager.Config, amountSats uint64, mintURL string, returning bool) (uint64, error) {
+	configured := findMintConfigIn(config, mintURL)
+	if configured == nil {
+		return 0, fmt.Errorf("mint configuration not found for URL: %s", mintURL)
 	}
+	mintConfig, accepted := m.effectiveMintConfig(*configured)
+	if !accepted {
+		return 0, fmt.Errorf("mint %s is paused because its fees exceed the price", mintURL)
+	}
+	return m.allotmentForMint(config, mintConfig, amountSats, returning)
+}
 
-	if mintConfig == nil {
-		return 0, fmt.Errorf("mint configuration not found for URL: %s", mintURL)
+// allotmentForMint converts a payment in sats to allotment at the metric, step size and price of a mint. Zaps
+// are priced as a mint of their own, see zapMintConfig.
+func (m *Merchant) allotmentForMint(config *config_manager.Config, mintConfig config_manager.MintConfig, amountSats uint64, returning bool) (uint64, error) {
+	// Returning customers pay the loyalty price per step
+	if returning {
+		mintConfig.PricePerStep = loyaltyPrice(config.Loyalty, mintConfig.PricePerStep)
+	}
+	if mintConfig.PricePerStep == 0 {
+		return 0, fmt.Errorf("no price per step set for %s", mintConfig.URL)
 	}
 
-	steps := amountSats / mintConfig.PricePerStep
+	// The wallet received sats, the price may be set in another unit
+	amount, err := m.toPriceUnit(config, mintConfig, amountSats)
+	if err != nil {
+		return 0, fmt.Errorf("can't price payment with %s: %w", mintConfig.URL, err)
+	}
+	steps := amount / mintConfig.PricePerStep
 
 	// Check if payment meets minimum purchase requirement
 	if steps < mintConfig.MinPurchaseSteps {
 		return 0, fmt.Errorf("payment only covers %d steps, but minimum purchase is %d steps", steps, mintConfig.MinPurchaseSteps)
 	}
 
-	switch m.config.Metric {
-	case "milliseconds":
-		return m.calculateAllotmentMs(steps, mintConfig)
-	// case "bytes":
-	//     return m.calculateAllotmentBytes(steps, mintConfig)
-	default:
-		return 0, fmt.Errorf("unsupported metric: %s", m.config.Metric)
+	metric := config.MetricFor(mintConfig)
+	if metric != "milliseconds" && metric != "bytes" {
+		return 0, fmt.Errorf("unsupported metric: %s", metric)
+	}
+	stepSize := config.StepSizeFor(mintConfig)
+	var allotment uint64
+	if config.Pricing.ProRata {
+		allotment, err = proRataAllotment(amount, stepSize, mintConfig.PricePerStep)
+	} else {
+		allotment, err = stepAllotment(steps, stepSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Returning customers get the loyalty bonus on top
+	if returning {
+		allotment = loyaltyBonus(config.Loyalty, allotment)
+		log.Printf("Applied loyalty pricing: %d %s at %d per step", allotment, metric, mintConfig.PricePerStep)
 	}
+	return allotment, nil
 }
 
-// calculateAllotmentMs calculates allotment in milliseconds from steps
-func (m *Merchant) calculateAllotmentMs(steps uint64, mintConfig *config_manager.MintConfig) (uint64, error) {
-	// Convert steps to milliseconds using configured step size
-	totalMs := steps * m.config.StepSize
+// stepAllotment converts whole steps to allotment
+func stepAllotment(steps, stepSize uint64) (uint64, error) {
+	hi, allotment := bits.Mul64(steps, stepSize)
+	if hi != 0 {
+		return 0, fmt.Errorf("allotment of %d steps of %d overflows", steps, stepSize)
+	}
+	log.Printf("Converting %d steps to %d allotment using step size %d", steps, allotment, stepSize)
+	return allotment, nil
+}
 
-	log.Printf("Converting %d steps to %d ms using step size %d",
-		steps, totalMs, m.config.StepSize)
+// proRataAllotment converts a payment to allotment including the partial step its remainder pays for,
+// so customers get the full value of amounts that are not a multiple of the step price
+func proRataAllotment(amount, stepSize, pricePerStep uint64) (uint64, error) {
+	hi, lo := bits.Mul64(amount, stepSize)
+	// The quotient of the 128 bit product only fits 64 bits if its high half is below the divisor
+	if hi >= pricePerStep {
+		return 0, fmt.Errorf("pro-rata allotment of %d at %d per %d overflows", amount, pricePerStep, stepSize)
+	}
+	allotment, _ := bits.Div64(hi, lo, pricePerStep)
+	log.Printf("Converting %d to %d pro-rata allotment at %d per %d", amount, allotment, pricePerStep, stepSize)
+	return allotment, nil
+}
 
-	return totalMs, nil
+// findMintConfig returns the configuration of an accepted mint, or nil if the mint is not accepted
+func (m *Merchant) findMintConfig(mintURL string) *config_manager.MintConfig {
+	return findMintConfigIn(m.getConfig(), mintURL)
+}
+
+// findMintConfigIn returns the configuration of a mint accepted in the given config snapshot
+func findMintConfigIn(config *config_manager.Config, mintURL string) *config_manager.MintConfig {
+	for _, mint := range config.AcceptedMints {
+		if mint.URL == mintURL {
+			return &mint
+		}
+	}
+	return nil
 }
 
 // calculateAllotmentBytes calculates allotment in bytes from payment amount using mint-specific pricing
 // func (m *Merchant) calculateAllotmentBytes(amountSats uint64, mintURL string) (uint64, error) {
 //     // Find the mint configuration for this mint
 //     var mintConfig *MintConfig
-//     for _, mint := range m.config.AcceptedMints {
+//     for _, mint := range m.getConfig().AcceptedMints {
 //         if mint.URL == mintURL {
 //             mintConfig = &mint
 //             break
@@ -454,7 +1491,7 @@ func (m *Merchant) calculateAllotmentMs(steps uint64, mintConfig *config_manager
 //     }
 //
 //     // Convert steps to bytes using configured step size
-//     totalBytes := allottedSteps * m.config.StepSize
+//     totalBytes := allottedSteps * m.getConfig().StepSize
 //
 //     log.Printf("Calculated %d steps (%d bytes) from %d sats at %d sats per step",
 //         allottedSteps, totalBytes, amountSats, mintConfig.PricePerStep)
@@ -566,7 +1603,7 @@ func (m *Merchant) isSessionActive(sessionEvent *nostr.Event) bool {
 }
 
 // createSessionEvent creates a session event from the MAC-address based session
-func (m *Merchant) createSessionEvent(session *CustomerSession, customerPubkey string) (*nostr.Event, error) {
+func (m *Merchant) createSessionEvent(session *CustomerSession, customerPubkey string, extraTags ...nostr.Tag) (*nostr.Event, error) {
 	deviceIdentifier := session.MacAddress
 
 	identities := m.configManager.GetIdentities()
@@ -597,6 +1634,7 @@ func (m *Merchant) createSessionEvent(session *CustomerSession, customerPubkey s
 		},
 		Content: "",
 	}
+	sessionEvent.Tags = append(sessionEvent.Tags, extraTags...)
 
 	// Sign with tollgate private key
 	err = sessionEvent.Sign(merchantIdentity.PrivateKey)
@@ -607,7 +1645,24 @@ func (m *Merchant) createSessionEvent(session *CustomerSession, customerPubkey s
 	return sessionEvent, nil
 }
 
-// extendSessionEvent creates a new session event with extended duration
+// extendedAllotment returns what is left of a session's allotment and the allotment of its extension,
+// which is counted from now like the new session event. Time-based allotments run down from the
+// creation of the session event, others are only used up by metering and carry over in full.
+func extendedAllotment(metric string, existingAllotment, additionalAllotment uint64, createdAt, now time.Time) (remaining, total uint64) {
+	remaining = existingAllotment
+	if metric == "milliseconds" {
+		remaining = 0
+		if elapsed := now.Sub(createdAt); elapsed < 0 {
+			remaining = existingAllotment
+		} else if passed := uint64(elapsed.Milliseconds()); existingAllotment > passed {
+			remaining = existingAllotment - passed
+		}
+	}
+	return remaining, remaining + additionalAllotment
+}
+
+// extendSessionEvent creates a new session event with extended duration. The new event is counted from
+// its own creation, so its allotment is what is left of the existing session plus the additional allotment.
 func (m *Merchant) extendSessionEvent(existingSession *nostr.Event, additionalAllotment uint64) (*nostr.Event, error) {
 	// Extract existing allotment from the session
 	existingAllotment, err := m.extractAllotment(existingSession)
@@ -615,31 +1670,14 @@ func (m *Merchant) extendSessionEvent(existingSession *nostr.Event, additionalAl
 		return nil, fmt.Errorf("failed to extract existing allotment: %w", err)
 	}
 
-	// Calculate leftover allotment based on metric type
-	var leftoverAllotment uint64 = 0
-	if m.config.Metric == "milliseconds" {
-		// For time-based metrics, calculate how much time has passed
-		sessionCreatedAt := time.Unix(int64(existingSession.CreatedAt), 0)
-		timePassed := time.Since(sessionCreatedAt)
-		timePassedInMetric := uint64(timePassed.Milliseconds())
-
-		if existingAllotment > timePassedInMetric {
-			leftoverAllotment = existingAllotment - timePassedInMetric
-		}
-
-		log.Printf("Session extension: existing=%d %s, passed=%d %s, leftover=%d %s, additional=%d %s",
-			existingAllotment, m.config.Metric, timePassedInMetric, m.config.Metric,
-			leftoverAllotment, m.config.Metric, additionalAllotment, m.config.Metric)
-	} else {
-		// For non-time metrics (like bytes), keep the full existing allotment
-		leftoverAllotment = existingAllotment
-		log.Printf("Session extension: existing=%d %s, leftover=%d %s (no decay), additional=%d %s",
-			existingAllotment, m.config.Metric, leftoverAllotment, m.config.Metric,
-			additionalAllotment, m.config.Metric)
+	metric := m.getConfig().Metric
+	if metricTag := existingSession.Tags.Find("metric"); metricTag != nil {
+		metric = metricTag[1]
 	}
-
-	// Calculate new total allotment
-	newTotalAllotment := existingAllotment + additionalAllotment
+	remainingAllotment, newTotalAllotment := extendedAllotment(metric, existingAllotment, additionalAllotment,
+		existingSession.CreatedAt.Time(), time.Now())
+	log.Printf("Session extension: existing=%d %s, remaining=%d %s, additional=%d %s, total=%d %s",
+		existingAllotment, metric, remainingAllotment, metric, additionalAllotment, metric, newTotalAllotment, metric)
 
 	// Extract customer and device info from existing session
 	customerPubkey := ""
@@ -681,7 +1719,9 @@ func (m *Merchant) extendSessionEvent(existingSession *nostr.Event, additionalAl
 			{"p", customerPubkey},
 			{"device-identifier", "mac", deviceIdentifier},
 			{"allotment", fmt.Sprintf("%d", newTotalAllotment)},
-			{"metric", "milliseconds"},
+			{"metric", metric},
+			{"original-allotment", fmt.Sprintf("%d", existingAllotment)},
+			{"remaining-allotment", fmt.Sprintf("%d", remainingAllotment)},
 		},
 		Content: "",
 	}
@@ -709,48 +1749,13 @@ func (m *Merchant) extractAllotment(sessionEvent *nostr.Event) (uint64, error) {
 	return 0, fmt.Errorf("no allotment tag found in session event")
 }
 
-// publishLocal publishes a nostr event to the local relay pool
-func (m *Merchant) publishLocal(event *nostr.Event) error {
-	log.Printf("Publishing event kind=%d id=%s to local pool", event.Kind, event.ID)
-
-	err := m.configManager.PublishToLocalPool(*event)
-	if err != nil {
-		log.Printf("Failed to publish event to local pool: %v", err)
-		return err
-	}
-
-	log.Printf("Successfully published event %s to local pool", event.ID)
-	return nil
-}
-
-// publishPublic publishes a nostr event to public relay pools
-func (m *Merchant) publishPublic(event *nostr.Event) error {
-	log.Printf("Publishing event kind=%d id=%s to public pools", event.Kind, event.ID)
-
-	config := m.configManager.GetConfig()
-	if config == nil {
-		return fmt.Errorf("main config is nil")
-	}
-	for _, relayURL := range config.Relays {
-		relay, err := m.configManager.GetPublicPool().EnsureRelay(relayURL)
-		if err != nil {
-			log.Printf("Failed to connect to public relay %s: %v", relayURL, err)
-			continue
-		}
-
-		err = relay.Publish(m.configManager.GetPublicPool().Context, *event)
-		if err != nil {
-			log.Printf("Failed to publish event to public relay %s: %v", relayURL, err)
-		} else {
-			log.Printf("Successfully published event %s to public relay %s", event.ID, relayURL)
-		}
-	}
-
-	return nil
-}
-
 // CreateNoticeEvent creates a notice event for error communication
 func (m *Merchant) CreateNoticeEvent(level, code, message, customerPubkey string) (*nostr.Event, error) {
+	return m.createNoticeEventWithTags(level, code, message, customerPubkey)
+}
+
+// createNoticeEventWithTags creates a notice event carrying additional tags, such as a change token
+func (m *Merchant) createNoticeEventWithTags(level, code, message, customerPubkey string, extraTags ...nostr.Tag) (*nostr.Event, error) {
 	identities := m.configManager.GetIdentities()
 	if identities == nil {
 		return nil, fmt.Errorf("identities config is nil")
@@ -766,7 +1771,7 @@ func (m *Merchant) CreateNoticeEvent(level, code, message, customerPubkey string
 	}
 
 	noticeEvent := &nostr.Event{
-		Kind:      21023, // NIP-94 notice event
+		Kind:      KindNotice,
 		PubKey:    tollgatePubkey,
 		CreatedAt: nostr.Now(),
 		Tags: nostr.Tags{
@@ -780,6 +1785,11 @@ func (m *Merchant) CreateNoticeEvent(level, code, message, customerPubkey string
 	if customerPubkey != "" {
 		noticeEvent.Tags = append(noticeEvent.Tags, nostr.Tag{"p", customerPubkey})
 	}
+	noticeEvent.Tags = append(noticeEvent.Tags, extraTags...)
+
+	if level == "error" {
+		m.errorCounters.add(code)
+	}
 
 	// Sign with tollgate private key
 	err = noticeEvent.Sign(merchantIdentity.PrivateKey)
@@ -790,27 +1800,28 @@ func (m *Merchant) CreateNoticeEvent(level, code, message, customerPubkey string
 	return noticeEvent, nil
 }
 
-// determineTier determines the service tier based on payment amount
-// Trail's Coffee pricing tiers:
-// - Free: 0 sats (2Mbps limited)
-// - Premium: 10 sats/hour (unlimited speed)
-// - Staff: Special handling (unlimited, password-protected network)
-func determineTier(amount uint64) string {
-	if amount == 0 {
-		return "free"
-	} else if amount >= 10 {
-		// 10 sats or more = premium tier
-		return "premium"
-	} else {
-		// Small payments default to free tier with time limits
-		return "free"
+// determineTier determines the service tier of a payment in sats: the highest tier of the ladder whose
+// threshold it meets. Payments below every threshold get the lowest tier. The staff tier is not sold,
+// it is given to the password-protected network.
+func determineTier(config *config_manager.Config, amount uint64) string {
+	tiers := config.TierLadder()
+	tier := tiers[0].Name
+	for _, candidate := range tiers[1:] {
+		if amount >= candidate.MinAmount {
+			tier = candidate.Name
+		}
 	}
+	return tier
 }
 
 // MerchantInterface method implementations
 
 // CreatePaymentToken creates a payment token for the specified mint and amount
 func (m *Merchant) CreatePaymentToken(mintURL string, amount uint64) (string, error) {
+	if err := m.walletLocked(); err != nil {
+		return "", err
+	}
+
 	// Check balance before attempting to send
 	balance := m.tollwallet.GetBalanceByMint(mintURL)
 	totalBalance := m.tollwallet.GetBalance()
@@ -845,14 +1856,17 @@ func (m *Merchant) CreatePaymentToken(mintURL string, amount uint64) (string, er
 		return "", fmt.Errorf("token serialization returned empty string")
 	}
 
-	log.Printf("Successfully created payment token: length=%d, token_preview=%s...",
-		len(tokenString), tokenString[:min(50, len(tokenString))])
+	log.Printf("Successfully created payment token: length=%d, token=%s",
+		len(tokenString), utils.Redact(tokenString))
 
 	return tokenString, nil
 }
 
 // CreatePaymentTokenWithOverpayment creates a payment token with overpayment capability
 func (m *Merchant) CreatePaymentTokenWithOverpayment(mintURL string, amount uint64, maxOverpaymentPercent uint64, maxOverpaymentAbsolute uint64) (string, error) {
+	if err := m.walletLocked(); err != nil {
+		return "", err
+	}
 	// Use the tollwallet's new SendWithOverpayment method
 	tokenString, err := m.tollwallet.SendWithOverpayment(amount, mintURL, maxOverpaymentPercent, maxOverpaymentAbsolute)
 	if err != nil {
@@ -863,7 +1877,7 @@ func (m *Merchant) CreatePaymentTokenWithOverpayment(mintURL string, amount uint
 
 // GetAcceptedMints returns the list of accepted mints from the configuration
 func (m *Merchant) GetAcceptedMints() []config_manager.MintConfig {
-	return m.config.AcceptedMints
+	return m.getConfig().AcceptedMints
 }
 
 // GetBalance returns the total balance across all mints
@@ -876,7 +1890,73 @@ func (m *Merchant) GetBalanceByMint(mintURL string) uint64 {
 	return m.tollwallet.GetBalanceByMint(mintURL)
 }
 
-// GetSession retrieves a customer session by MAC address
+// GetWalletQueueMetrics returns the wallet's operation queue metrics per mint
+func (m *Merchant) GetWalletQueueMetrics() map[string]tollwallet.MintQueueMetrics {
+	return m.tollwallet.GetQueueMetrics()
+}
+
+// applyValveConfig passes the gate settings of the config to the valve. The valve keeps them for the interface
+// the merchant serves, so the merchants of other profiles keep theirs.
+func applyValveConfig(configManager *config_manager.ConfigManager, config *config_manager.Config) {
+	iface := config.NDS.GatewayInterface
+	valve.SetHooks(iface, config.Hooks)
+	valve.SetTiers(iface, config.ShapingProfiles())
+	if err := valve.SetTierPolicies(iface, config.TierPolicies); err != nil {
+		log.Printf("Warning: failed to apply tier destination policies: %v", err)
+	}
+	if err := valve.SetIPv6Prefixes(iface, config.IPv6Prefix); err != nil {
+		log.Printf("Warning: failed to apply IPv6 prefix delegation: %v", err)
+	}
+	valve.SetGateVerification(iface, config.GateVerification)
+	valve.SetUsageTracking(iface, usageTrackingFor(config))
+	if err := valve.SetGateMode(config.NDS); err != nil {
+		log.Printf("Warning: failed to apply gate mode: %v", err)
+	}
+	valve.SetWalledGarden(iface, configManager.WalledGardenHosts())
+	valve.SetWANCapacity(iface, config.WANCapacity)
+}
+
+// setSessionTier records the tier a session's gate was opened with
+func (m *Merchant) setSessionTier(macAddress, tier string) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if session, exists := m.customerSessions[macAddress]; exists {
+		session.Tier = tier
+	}
+}
+
+// openGate opens or extends the gate of a device on the interface this merchant serves.
+// A gate that was newly opened or moved to another tier runs at its tier limit, so any throttling is forgotten.
+// No gate opens while an emergency stop halts the gateway, whichever path grants the session.
+func (m *Merchant) openGate(macAddress string, untilTimestamp int64, tier string) (valve.GateResult, error) {
+	if halt := m.emergencyStop.halted(); halt != nil {
+		return valve.GateResult{}, fmt.Errorf("gateway halted by emergency stop %s", halt.Request)
+	}
+	valve.BindInterface(macAddress, m.getConfig().NDS.GatewayInterface)
+	result, err := valve.ExtendGate(macAddress, untilTimestamp, tier)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Opened || result.TierChanged {
+		m.sessionMu.Lock()
+		delete(m.dataQuota.throttles, macAddress)
+		m.sessionMu.Unlock()
+	}
+	return result, nil
+}
+
+// alertUnverifiedGate counts gates that were opened but didn't pass traffic, reported in operator status events
+func (m *Merchant) alertUnverifiedGate(failure valve.GateVerificationFailure) {
+	code := "gate-unverified"
+	if failure.Repaired {
+		code = "gate-repair-failed"
+	}
+	m.errorCounters.add(code)
+	log.Printf("Alert: gate of %s doesn't pass traffic (%s): %s", failure.MacAddress, code, failure.Reason)
+}
+
+// GetSession retrieves a copy of a customer session by MAC address
 func (m *Merchant) GetSession(macAddress string) (*CustomerSession, error) {
 	m.sessionMu.RLock()
 	defer m.sessionMu.RUnlock()
@@ -886,14 +1966,30 @@ func (m *Merchant) GetSession(macAddress string) (*CustomerSession, error) {
 		return nil, fmt.Errorf("session not found for MAC address: %s", macAddress)
 	}
 
-	return session, nil
+	snapshot := *session
+	return &snapshot, nil
 }
 
-// AddAllotment adds allotment to a customer session, creating it if it doesn't exist
+// AddAllotment adds allotment to a customer session, creating it if it doesn't exist.
+// It returns a copy of the session, as concurrent purchases keep changing the stored one.
 func (m *Merchant) AddAllotment(macAddress, metric string, amount uint64) (*CustomerSession, error) {
+	return m.addAllotment(macAddress, "", nil, metric, amount)
+}
+
+// addAllotment is AddAllotment for a payment of a customer. With pubkey sessions the allotment goes to the
+// customer's session, which the device and the extra devices join first, and the returned copy is that session.
+func (m *Merchant) addAllotment(macAddress, pubkey string, extraDevices []string, metric string, amount uint64) (*CustomerSession, error) {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
+	if pubkey != "" && m.getConfig().PubkeySessions.Enabled {
+		pool, err := m.joinPubkeySession(pubkey, macAddress, extraDevices)
+		if err != nil {
+			return nil, err
+		}
+		macAddress = pool
+	}
+
 	session, exists := m.customerSessions[macAddress]
 	if !exists {
 		// Create new session
@@ -902,15 +1998,27 @@ func (m *Merchant) AddAllotment(macAddress, metric string, amount uint64) (*Cust
 			StartTime:  time.Now().Unix(),
 			Metric:     metric,
 			Allotment:  amount,
+			Purchases:  1,
 		}
 		m.customerSessions[macAddress] = session
+	} else if session.Metric != metric {
+		// Allotments in different metrics can't be added up, a new session starts once the old one ran out
+		if isCustomerSessionActive(session) {
+			return nil, fmt.Errorf("active session is metered in %s, cannot add %s", session.Metric, metric)
+		}
+		session.Metric = metric
+		session.Allotment = amount
+		session.StartTime = time.Now().Unix()
+		session.Purchases++
 	} else {
 		// Add to existing session and reset start time to now
 		session.Allotment += amount
 		session.StartTime = time.Now().Unix()
+		session.Purchases++
 	}
 
-	return session, nil
+	snapshot := *session
+	return &snapshot, nil
 }
 
 // Fund adds a cashu token to the wallet
@@ -923,11 +2031,7 @@ func (m *Merchant) Fund(cashuToken string) (uint64, error) {
 	}
 
 	// Parse the cashu token with error recovery
-	tokenPreview := cashuToken
-	if len(cashuToken) > 50 {
-		tokenPreview = cashuToken[:50] + "..."
-	}
-	log.Printf("Attempting to decode token (length: %d, preview: %s)", len(cashuToken), tokenPreview)
+	log.Printf("Attempting to decode token (length: %d, token: %s)", len(cashuToken), utils.Redact(cashuToken))
 
 	parsedToken, err := cashu.DecodeTokenV4(cashuToken)
 	if err != nil {
@@ -0,0 +1,453 @@
+package merchant
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+)
+
+// State archives start with this magic, followed by the key salt, the nonce and the AES-GCM sealed archive
+const stateArchiveMagic = "TGSTATE1"
+
+// stateArchiveVersion is the version of the archive content written by ExportState
+const stateArchiveVersion = 1
+
+// Key derivation of state archives from the passphrase
+const (
+	stateArchiveSaltSize   = 16
+	stateArchiveIterations = 600000
+	minPassphraseLength    = 12
+)
+
+// importedSessionsFile holds the sessions of an imported archive until the merchant restarts and reopens their gates
+const importedSessionsFile = "imported_sessions.json"
+
+// migrationTokensFile keeps the tokens of an imported archive the wallet could not redeem,
+// and tokens taken from the wallet that could not be delivered
+const migrationTokensFile = "migration_tokens.json"
+
+// migratedStateFiles are the state files next to the configuration that move to a replacement gateway.
+// Identities are read from and written to the identities path of the config manager.
+var migratedStateFiles = []string{
+	"identities.json",
+	"ledger.jsonl",
+	"revenue_split.json",
+	"reputation.json",
+	"blinding_secret.json",
+	"outbox.json",
+	"held_proofs.json",
+	"quarantined_proofs.json",
+}
+
+// stateArchive is the content of an encrypted gateway state archive
+type stateArchive struct {
+	Version   int               `json:"version"`
+	CreatedAt int64             `json:"created_at"`
+	Config    json.RawMessage   `json:"config"`
+	Files     map[string][]byte `json:"files"`  // State files by name, see migratedStateFiles
+	Tokens    []migrationToken  `json:"tokens"` // Wallet balance per mint, as tokens
+	Sessions  []CustomerSession `json:"sessions"`
+}
+
+// migrationToken is the balance of a mint taken out of the wallet for migration
+type migrationToken struct {
+	MintURL string `json:"mint_url"`
+	Amount  uint64 `json:"amount"`
+	Token   string `json:"token"`
+}
+
+// MigrationSummary reports what a state export or import moved
+type MigrationSummary struct {
+	Path     string   `json:"path"`
+	Amount   uint64   `json:"amount"` // Sats moved as tokens
+	Tokens   int      `json:"tokens"`
+	Sessions int      `json:"sessions"`
+	Files    []string `json:"files"`
+	// Tokens of an import the wallet could not redeem, kept in migration_tokens.json to fund them later
+	UnredeemedAmount uint64 `json:"unredeemed_amount,omitempty"`
+}
+
+// ExportState writes the wallet balance, identities, active sessions, ledgers and configuration into an archive
+// encrypted with the passphrase, so a replacement router can take over with ImportState. The balance leaves
+// the wallet as tokens inside the archive, and this gateway stops selling sessions until it restarts.
+func (m *Merchant) ExportState(path, passphrase string) (MigrationSummary, error) {
+	summary := MigrationSummary{Path: path}
+	if err := m.walletLocked(); err != nil {
+		return summary, err
+	}
+	if len(passphrase) < minPassphraseLength {
+		return summary, fmt.Errorf("passphrase must be at least %d characters", minPassphraseLength)
+	}
+	if !m.migrated.CompareAndSwap(false, true) {
+		return summary, fmt.Errorf("state was already exported, restart the gateway to sell sessions again")
+	}
+
+	// The archive reads the state files from flash
+	if err := utils.FlushStateWrites(); err != nil {
+		m.migrated.Store(false)
+		return summary, fmt.Errorf("failed to flush state before export: %w", err)
+	}
+
+	config := m.getConfig()
+	archive := stateArchive{
+		Version:   stateArchiveVersion,
+		CreatedAt: time.Now().Unix(),
+		Files:     make(map[string][]byte),
+	}
+
+	var err error
+	archive.Config, err = json.Marshal(config)
+	if err != nil {
+		m.migrated.Store(false)
+		return summary, fmt.Errorf("failed to encode config: %w", err)
+	}
+	for _, name := range migratedStateFiles {
+		var data []byte
+		var err error
+		if name == "ledger.jsonl" {
+			// The ledger may live in a database, the archive carries it as JSON lines
+			data, err = m.ledger.export()
+			if err == nil && len(data) == 0 {
+				continue
+			}
+		} else {
+			data, err = os.ReadFile(m.stateFilePath(name))
+			if os.IsNotExist(err) {
+				continue
+			}
+		}
+		if err != nil {
+			m.migrated.Store(false)
+			return summary, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		archive.Files[name] = data
+		summary.Files = append(summary.Files, name)
+	}
+
+	m.sessionMu.RLock()
+	for _, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			archive.Sessions = append(archive.Sessions, *session)
+		}
+	}
+	m.sessionMu.RUnlock()
+
+	// Take the balance out last, so nothing has to be put back if an earlier step fails
+	for _, mint := range config.AcceptedMints {
+		balance := m.tollwallet.GetBalanceByMint(mint.URL)
+		if balance == 0 {
+			continue
+		}
+		token, err := m.CreatePaymentToken(mint.URL, balance)
+		if err != nil {
+			m.restoreMigrationTokens(archive.Tokens)
+			m.migrated.Store(false)
+			return summary, fmt.Errorf("failed to take %d sats out of %s: %w", balance, mint.URL, err)
+		}
+		archive.Tokens = append(archive.Tokens, migrationToken{MintURL: mint.URL, Amount: balance, Token: token})
+	}
+
+	if err := writeStateArchive(path, passphrase, archive); err != nil {
+		m.restoreMigrationTokens(archive.Tokens)
+		m.migrated.Store(false)
+		return summary, err
+	}
+
+	for _, token := range archive.Tokens {
+		summary.Amount += token.Amount
+	}
+	summary.Tokens = len(archive.Tokens)
+	summary.Sessions = len(archive.Sessions)
+	log.Printf("Exported gateway state to %s: %d sats in %d tokens, %d sessions, %d files; no longer selling sessions",
+		path, summary.Amount, summary.Tokens, summary.Sessions, len(summary.Files))
+	return summary, nil
+}
+
+// ImportState restores an archive written by ExportState on this gateway. The configuration applies right away and
+// the tokens are redeemed into the wallet. Identities, ledgers and sessions take effect when the gateway restarts.
+func (m *Merchant) ImportState(path, passphrase string) (MigrationSummary, error) {
+	summary := MigrationSummary{Path: path}
+	archive, err := readStateArchive(path, passphrase)
+	if err != nil {
+		return summary, err
+	}
+	if archive.Version != stateArchiveVersion {
+		return summary, fmt.Errorf("unsupported state archive version %d", archive.Version)
+	}
+
+	// The imported configuration accepts the mints of the tokens, so it goes first
+	var config config_manager.Config
+	if err := json.Unmarshal(archive.Config, &config); err != nil {
+		return summary, fmt.Errorf("failed to parse imported config: %w", err)
+	}
+	if err := m.configManager.UpdateConfig(func(current *config_manager.Config) bool {
+		*current = config
+		return true
+	}); err != nil {
+		return summary, fmt.Errorf("failed to apply imported config: %w", err)
+	}
+
+	var unredeemed []migrationToken
+	for _, token := range archive.Tokens {
+		if _, err := m.Fund(token.Token); err != nil {
+			log.Printf("Warning: failed to redeem migrated token of %d sats from %s: %v", token.Amount, token.MintURL, err)
+			unredeemed = append(unredeemed, token)
+			summary.UnredeemedAmount += token.Amount
+			continue
+		}
+		summary.Amount += token.Amount
+		summary.Tokens++
+	}
+	if len(unredeemed) > 0 {
+		if err := m.saveUnredeemedTokens(unredeemed); err != nil {
+			return summary, err
+		}
+	}
+
+	for _, name := range migratedStateFiles {
+		data, exists := archive.Files[name]
+		if !exists {
+			continue
+		}
+		// Proofs are merged into the running wallet rather than written over its files
+		switch name {
+		case "ledger.jsonl":
+			err = m.ledger.prepend(data)
+		case "held_proofs.json":
+			err = m.importHeldProofs(data)
+		case "quarantined_proofs.json":
+			err = m.importQuarantine(data)
+		default:
+			err = utils.WriteStateDurable(m.stateFilePath(name), data, 0600)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		summary.Files = append(summary.Files, name)
+	}
+
+	data, err := json.Marshal(archive.Sessions)
+	if err != nil {
+		return summary, fmt.Errorf("failed to encode imported sessions: %w", err)
+	}
+	if err := utils.WriteStateDurable(m.stateFilePath(importedSessionsFile), data, 0600); err != nil {
+		return summary, fmt.Errorf("failed to save imported sessions: %w", err)
+	}
+	summary.Sessions = len(archive.Sessions)
+
+	log.Printf("Imported gateway state from %s: %d sats redeemed, %d sats unredeemed, %d sessions, %d files",
+		path, summary.Amount, summary.UnredeemedAmount, summary.Sessions, len(summary.Files))
+	return summary, nil
+}
+
+// restoreImportedSessions reopens the gates of sessions imported before the restart, skipping those that ended
+func (m *Merchant) restoreImportedSessions() {
+	path := m.stateFilePath(importedSessionsFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read imported sessions: %v", err)
+		}
+		return
+	}
+	defer os.Remove(path)
+
+	var sessions []CustomerSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		log.Printf("Warning: failed to parse imported sessions: %v", err)
+		return
+	}
+
+	restored := 0
+	for i := range sessions {
+		session := sessions[i]
+		if !isCustomerSessionActive(&session) {
+			continue
+		}
+
+		var endTimestamp int64
+		if session.Metric == "milliseconds" {
+			endTimestamp = session.StartTime + int64(session.Allotment/1000)
+		} else {
+			endTimestamp = time.Now().Unix() + (24 * 60 * 60) // 24 hours from now
+		}
+
+		m.sessionMu.Lock()
+		m.customerSessions[session.MacAddress] = &session
+		m.sessionMu.Unlock()
+
+		if _, err := m.openGate(session.MacAddress, endTimestamp, session.Tier); err != nil {
+			log.Printf("Warning: failed to reopen gate of imported session of %s: %v", session.MacAddress, err)
+			continue
+		}
+		restored++
+	}
+	log.Printf("Restored %d imported sessions", restored)
+}
+
+// restoreMigrationTokens puts the tokens of a failed export back into the wallet
+func (m *Merchant) restoreMigrationTokens(tokens []migrationToken) {
+	for _, token := range tokens {
+		if _, err := m.Fund(token.Token); err != nil {
+			log.Printf("CRITICAL: failed to put %d sats back into the wallet after a failed export: %v", token.Amount, err)
+			m.keepUnsentToken(token)
+		}
+	}
+}
+
+// keepUnsentToken saves a token taken from the wallet that could neither be delivered nor put back,
+// so the operator can recover it from the migration tokens file rather than from the logs
+func (m *Merchant) keepUnsentToken(token migrationToken) {
+	if err := m.saveUnredeemedTokens([]migrationToken{token}); err != nil {
+		log.Printf("CRITICAL: failed to keep token of %d sats (%s): %v", token.Amount, utils.Redact(token.Token), err)
+		return
+	}
+	log.Printf("Kept token of %d sats in %s", token.Amount, m.stateFilePath(migrationTokensFile))
+}
+
+// saveUnredeemedTokens adds tokens the wallet could not redeem to the migration tokens file, keeping earlier ones
+func (m *Merchant) saveUnredeemedTokens(tokens []migrationToken) error {
+	path := m.stateFilePath(migrationTokensFile)
+
+	var saved []migrationToken
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	data, err := json.MarshalIndent(append(saved, tokens...), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode unredeemed tokens: %w", err)
+	}
+	if err := utils.WriteStateDurable(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save unredeemed tokens: %w", err)
+	}
+	return nil
+}
+
+// importHeldProofs holds the unswapped proofs of an imported held_proofs.json in the wallet
+func (m *Merchant) importHeldProofs(data []byte) error {
+	var proofs map[string]cashu.Proofs
+	if err := json.Unmarshal(data, &proofs); err != nil {
+		return fmt.Errorf("failed to parse held proofs: %w", err)
+	}
+	amount, err := m.tollwallet.ImportHeldProofs(proofs)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d sats of held proofs", amount)
+	return nil
+}
+
+// importQuarantine adds the proofs of an imported quarantined_proofs.json to the wallet's quarantine
+func (m *Merchant) importQuarantine(data []byte) error {
+	var proofs []tollwallet.QuarantinedProof
+	if err := json.Unmarshal(data, &proofs); err != nil {
+		return fmt.Errorf("failed to parse quarantined proofs: %w", err)
+	}
+	return m.tollwallet.ImportQuarantine(proofs)
+}
+
+// stateFilePath returns where a migrated state file lives on this gateway
+func (m *Merchant) stateFilePath(name string) string {
+	if name == "identities.json" {
+		return m.configManager.IdentitiesFilePath
+	}
+	return filepath.Join(filepath.Dir(m.configManager.ConfigFilePath), name)
+}
+
+// writeStateArchive encrypts an archive with a key derived from the passphrase and writes it atomically
+func writeStateArchive(path, passphrase string, archive stateArchive) error {
+	plaintext, err := json.Marshal(archive)
+	if err != nil {
+		return fmt.Errorf("failed to encode state archive: %w", err)
+	}
+
+	salt := make([]byte, stateArchiveSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := stateArchiveCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := slices.Concat([]byte(stateArchiveMagic), salt, nonce)
+	data := aead.Seal(header, nonce, plaintext, []byte(stateArchiveMagic))
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state archive: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write state archive: %w", err)
+	}
+	return nil
+}
+
+// readStateArchive decrypts an archive written by writeStateArchive
+func readStateArchive(path, passphrase string) (stateArchive, error) {
+	var archive stateArchive
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return archive, fmt.Errorf("failed to read state archive: %w", err)
+	}
+
+	headerSize := len(stateArchiveMagic) + stateArchiveSaltSize
+	if len(data) < headerSize || string(data[:len(stateArchiveMagic)]) != stateArchiveMagic {
+		return archive, fmt.Errorf("%s is not a gateway state archive", path)
+	}
+	salt := data[len(stateArchiveMagic):headerSize]
+	aead, err := stateArchiveCipher(passphrase, salt)
+	if err != nil {
+		return archive, err
+	}
+	if len(data) < headerSize+aead.NonceSize() {
+		return archive, fmt.Errorf("state archive is truncated")
+	}
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], []byte(stateArchiveMagic))
+	if err != nil {
+		return archive, fmt.Errorf("failed to decrypt state archive, wrong passphrase or damaged file")
+	}
+	if err := json.Unmarshal(plaintext, &archive); err != nil {
+		return archive, fmt.Errorf("failed to parse state archive: %w", err)
+	}
+	return archive, nil
+}
+
+// stateArchiveCipher derives the AES-256-GCM cipher of a state archive from the passphrase
+func stateArchiveCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, stateArchiveIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive archive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
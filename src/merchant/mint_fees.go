@@ -0,0 +1,199 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+)
+
+// Fee policies applied when a mint's fees eat too much of a purchase
+const (
+	FeePolicyAdjust = "adjust" // Raise the minimum purchase until the fee fits (default)
+	FeePolicyPause  = "pause"  // Stop accepting the mint until its fees go down
+)
+
+// Defaults for fee checks when the config leaves them at 0
+const (
+	defaultMaxFeePercent = 10
+	// maxAdjustedSteps bounds how far the minimum purchase is raised before the mint is paused instead
+	maxAdjustedSteps = 1000
+)
+
+// mintFeeAdjustment overrides the configured pricing of a mint whose fees changed
+type mintFeeAdjustment struct {
+	MinPurchaseSteps uint64 // Raised minimum purchase, only set when not paused
+	Paused           bool
+	Reason           string
+}
+
+// feeAdjustment decides how a mint's pricing has to change for its fees to take at most maxFeePercent
+// of a minimum purchase. Returns false if the configured pricing covers the fees.
+func feeAdjustment(mint config_manager.MintConfig, fees tollwallet.MintFees, maxFeePercent uint64, policy string) (mintFeeAdjustment, bool) {
+	if mint.PricePerStep == 0 || fees.InputFeePPK == 0 {
+		return mintFeeAdjustment{}, false
+	}
+	if maxFeePercent == 0 {
+		maxFeePercent = defaultMaxFeePercent
+	}
+
+	covers := func(steps uint64) bool {
+		amount := steps * mint.PricePerStep
+		return fees.EstimateReceiveFee(amount)*100 <= amount*maxFeePercent
+	}
+
+	configuredSteps := max(mint.MinPurchaseSteps, 1)
+	if covers(configuredSteps) {
+		return mintFeeAdjustment{}, false
+	}
+
+	for steps := configuredSteps + 1; steps <= maxAdjustedSteps; steps++ {
+		if !covers(steps) {
+			continue
+		}
+		if policy == FeePolicyPause {
+			break
+		}
+		return mintFeeAdjustment{
+			MinPurchaseSteps: steps,
+			Reason: fmt.Sprintf("input fee of %d ppk exceeds %d%% of a %d step purchase, minimum raised to %d steps",
+				fees.InputFeePPK, maxFeePercent, configuredSteps, steps),
+		}, true
+	}
+
+	return mintFeeAdjustment{
+		Paused: true,
+		Reason: fmt.Sprintf("input fee of %d ppk exceeds %d%% of a %d step purchase, mint paused",
+			fees.InputFeePPK, maxFeePercent, configuredSteps),
+	}, true
+}
+
+// effectiveMintConfig applies the fee adjustment and the price set by load of a mint to its configuration.
+// Returns false if the mint is paused for its fees or its exposure.
+func (m *Merchant) effectiveMintConfig(mint config_manager.MintConfig) (config_manager.MintConfig, bool) {
+	if m.exposure.isPaused(mint.URL) {
+		return mint, false
+	}
+	mint.PricePerStep = surgePrice(mint.PricePerStep, m.currentSurge())
+
+	m.mintFeesMu.RLock()
+	adjustment, adjusted := m.feeAdjustments[mint.URL]
+	m.mintFeesMu.RUnlock()
+
+	if !adjusted {
+		return mint, true
+	}
+	if adjustment.Paused {
+		return mint, false
+	}
+	mint.MinPurchaseSteps = max(mint.MinPurchaseSteps, adjustment.MinPurchaseSteps)
+	return mint, true
+}
+
+// pricedMints returns the mints customers can pay with, with fee adjustments applied. Mints whose price unit
+// can't be converted from the sats they are paid in are left out.
+func (m *Merchant) pricedMints(config *config_manager.Config) []config_manager.MintConfig {
+	mints := make([]config_manager.MintConfig, 0, len(config.AcceptedMints))
+	for _, mint := range config.AcceptedMints {
+		if !m.payableUnit(config, mint) {
+			continue
+		}
+		if effective, accepted := m.effectiveMintConfig(mint); accepted {
+			mints = append(mints, effective)
+		}
+	}
+	return mints
+}
+
+// mintFeeAlerts returns why the pricing of each adjusted or paused mint differs from the config
+func (m *Merchant) mintFeeAlerts() map[string]string {
+	m.mintFeesMu.RLock()
+	defer m.mintFeesMu.RUnlock()
+
+	alerts := make(map[string]string, len(m.feeAdjustments))
+	for mintURL, adjustment := range m.feeAdjustments {
+		alerts[mintURL] = adjustment.Reason
+	}
+	return alerts
+}
+
+// checkMintFees fetches the fees and keysets of each accepted mint and adjusts or pauses mints
+// whose fees no longer fit their price. Returns whether any mint's pricing changed.
+func (m *Merchant) checkMintFees(config *config_manager.Config) bool {
+	changed := false
+
+	for _, mint := range config.AcceptedMints {
+		fees, err := m.tollwallet.GetMintFees(mint.URL)
+		if err != nil {
+			log.Printf("Warning: failed to check fees of mint %s: %v", mint.URL, err)
+			continue
+		}
+
+		// Fees are charged in sats, so compare them to the price in sats
+		priced := mint
+		if pricePerStep, err := m.toWalletUnit(config, mint, mint.PricePerStep); err == nil {
+			priced.PricePerStep = max(pricePerStep, 1)
+		}
+		adjustment, adjusted := feeAdjustment(priced, fees, config.Wallet.MaxFeePercent, config.Wallet.FeePolicy)
+
+		m.mintFeesMu.Lock()
+		if previous, known := m.mintKeysets[mint.URL]; known && !slices.Equal(previous, fees.ActiveKeysets) {
+			log.Printf("Mint %s rotated its active keysets from %v to %v (input fee %d ppk)",
+				mint.URL, previous, fees.ActiveKeysets, fees.InputFeePPK)
+		}
+		m.mintKeysets[mint.URL] = fees.ActiveKeysets
+
+		previous, wasAdjusted := m.feeAdjustments[mint.URL]
+		switch {
+		case adjusted && (!wasAdjusted || previous != adjustment):
+			m.feeAdjustments[mint.URL] = adjustment
+			changed = true
+			log.Printf("ALERT: Mint %s: %s", mint.URL, adjustment.Reason)
+			if adjustment.Paused {
+				m.errorCounters.add("mint-paused")
+			} else {
+				m.errorCounters.add("mint-minimum-raised")
+			}
+		case !adjusted && wasAdjusted:
+			delete(m.feeAdjustments, mint.URL)
+			changed = true
+			log.Printf("Mint %s fees fit the configured price again, restoring its pricing", mint.URL)
+		}
+		m.mintFeesMu.Unlock()
+	}
+
+	// Forget mints that are no longer accepted
+	m.mintFeesMu.Lock()
+	for mintURL := range m.feeAdjustments {
+		if findMintConfigIn(config, mintURL) == nil {
+			delete(m.feeAdjustments, mintURL)
+			changed = true
+		}
+	}
+	m.mintFeesMu.Unlock()
+
+	return changed
+}
+
+// watchMintFees periodically checks mint fees and republishes the advertisement when a mint's pricing changes
+func (m *Merchant) watchMintFees() {
+	for {
+		config := m.getConfig()
+		if m.checkMintFees(config) {
+			if err := m.refreshAdvertisement(); err != nil {
+				log.Printf("Warning: failed to refresh advertisement after mint fee change: %v", err)
+			} else {
+				m.publishAdvertisement()
+			}
+		}
+
+		interval := time.Duration(config.Wallet.MintInfoTTLSeconds) * time.Second
+		if interval <= 0 {
+			interval = tollwallet.DefaultMintInfoTTL
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,210 @@
+package merchant
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-87 kinds of a mint recommendation and the cashu mint announcement it refers to
+const (
+	KindMintRecommendation = 38000
+	KindCashuMintInfo      = 38172
+)
+
+// Defaults for mint recommendations when the config leaves them at 0
+const (
+	defaultRecommendationInterval = time.Hour
+	recommendationFetchTimeout    = 30 * time.Second
+)
+
+// fetchMintRecommendations returns the recommended mint URLs with the number of curators recommending each
+func (m *Merchant) fetchMintRecommendations(config *config_manager.Config) map[string]int {
+	pool := m.configManager.GetPublicPool()
+	ctx, cancel := context.WithTimeout(pool.Context, recommendationFetchTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{
+		Kinds:   []int{KindMintRecommendation},
+		Authors: config.MintRecommendations.Curators,
+		Tags:    nostr.TagMap{"k": []string{strconv.Itoa(KindCashuMintInfo)}},
+	}
+
+	// Recommendations are addressable, only the latest per curator and d tag counts
+	latest := make(map[string]*nostr.Event)
+	for relayEvent := range pool.FetchMany(ctx, config.Relays, filter) {
+		event := relayEvent.Event
+		key := event.PubKey + ":" + event.Tags.GetD()
+		if previous, exists := latest[key]; !exists || event.CreatedAt > previous.CreatedAt {
+			latest[key] = event
+		}
+	}
+
+	curatorsByMint := make(map[string]map[string]bool)
+	for _, event := range latest {
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "u" {
+				continue
+			}
+			mintURL := strings.TrimRight(tag[1], "/")
+			if curatorsByMint[mintURL] == nil {
+				curatorsByMint[mintURL] = make(map[string]bool)
+			}
+			curatorsByMint[mintURL][event.PubKey] = true
+		}
+	}
+
+	recommended := make(map[string]int, len(curatorsByMint))
+	for mintURL, curators := range curatorsByMint {
+		recommended[mintURL] = len(curators)
+	}
+	return recommended
+}
+
+// mintHostAllowed reports whether a mint URL is served over HTTPS from one of the allowed hosts or their subdomains
+func mintHostAllowed(mintURL string, allowedHosts []string) bool {
+	parsed, err := url.Parse(mintURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return false
+	}
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// planMintChanges decides which recommended mints to add and which previously added mints to remove,
+// within the operator's constraints. balance returns the wallet balance held at a mint.
+func planMintChanges(config *config_manager.Config, recommended map[string]int, balance func(mintURL string) uint64) (add, remove []string) {
+	settings := config.MintRecommendations
+	minCurators := max(settings.MinCurators, 1)
+
+	accepted := make(map[string]bool, len(config.AcceptedMints))
+	for _, mint := range config.AcceptedMints {
+		accepted[mint.URL] = true
+	}
+
+	if settings.AutoRemove {
+		for _, mint := range config.AcceptedMints {
+			if !mint.Recommended || recommended[mint.URL] >= minCurators {
+				continue
+			}
+			// Keep mints still holding funds until they are paid out
+			if balance(mint.URL) > 0 {
+				continue
+			}
+			remove = append(remove, mint.URL)
+		}
+		// Never remove the last accepted mint
+		if len(remove) == len(config.AcceptedMints) {
+			remove = remove[1:]
+		}
+	}
+
+	if settings.AutoAdd {
+		candidates := make([]string, 0, len(recommended))
+		for mintURL, curators := range recommended {
+			if curators >= minCurators && !accepted[mintURL] && mintHostAllowed(mintURL, settings.AllowedHosts) {
+				candidates = append(candidates, mintURL)
+			}
+		}
+		// Most recommended first, then by URL for a stable order
+		slices.SortFunc(candidates, func(a, b string) int {
+			if recommended[a] != recommended[b] {
+				return recommended[b] - recommended[a]
+			}
+			return strings.Compare(a, b)
+		})
+
+		room := settings.MaxMints - (len(config.AcceptedMints) - len(remove))
+		if settings.MaxMints <= 0 {
+			room = len(candidates)
+		}
+		if room > 0 && len(candidates) > room {
+			candidates = candidates[:room]
+		}
+		if room > 0 {
+			add = candidates
+		}
+	}
+
+	return add, remove
+}
+
+// applyMintRecommendations fetches the recommendations and adds or removes mints if the operator allowed it
+func (m *Merchant) applyMintRecommendations() {
+	config := m.getConfig()
+	settings := config.MintRecommendations
+	if len(settings.Curators) == 0 {
+		log.Printf("Mint recommendations enabled without curators, nothing to follow")
+		return
+	}
+
+	recommended := m.fetchMintRecommendations(config)
+	add, remove := planMintChanges(config, recommended, m.tollwallet.GetBalanceByMint)
+
+	if !settings.AutoAdd {
+		for mintURL, curators := range recommended {
+			if findMintConfigIn(config, mintURL) == nil && curators >= max(settings.MinCurators, 1) {
+				log.Printf("Mint %s is recommended by %d curators but not accepted, enable auto_add to accept it", mintURL, curators)
+			}
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return
+	}
+
+	err := m.configManager.UpdateConfigAs("mint-recommendations", func(next *config_manager.Config) bool {
+		next.AcceptedMints = slices.DeleteFunc(next.AcceptedMints, func(mint config_manager.MintConfig) bool {
+			return slices.Contains(remove, mint.URL)
+		})
+		if len(next.AcceptedMints) == 0 {
+			return false
+		}
+
+		template := next.AcceptedMints[0]
+		for _, mintURL := range add {
+			mint := template
+			mint.URL = mintURL
+			mint.Recommended = true
+			next.AcceptedMints = append(next.AcceptedMints, mint)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Warning: failed to apply mint recommendations: %v", err)
+		return
+	}
+
+	log.Printf("Applied mint recommendations: added %v, removed %v", add, remove)
+}
+
+// followMintRecommendations periodically applies mint recommendations while enabled
+func (m *Merchant) followMintRecommendations() {
+	for {
+		settings := m.getConfig().MintRecommendations
+		if settings.Enabled {
+			m.applyMintRecommendations()
+		}
+
+		interval := time.Duration(settings.RefreshIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultRecommendationInterval
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,149 @@
+package merchant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Negative cache hit kinds, reported in operator status events
+const (
+	negativeHitToken  = "token"
+	negativeHitPubkey = "pubkey"
+)
+
+// negativeCache remembers recent payment rejections, so a token resubmitted after the mint
+// reported it spent, or another payment from a pubkey whose payments keep failing, is turned
+// away without a round trip to the mint
+type negativeCache struct {
+	mu        sync.Mutex
+	tokens    map[string]cachedRejection // Keyed by token hash
+	pubkeys   map[string]*pubkeyFailures
+	hits      map[string]uint64 // Rejections answered from the cache since startup, by kind
+	lastPrune time.Time
+}
+
+// cachedRejection is the notice a token was rejected with
+type cachedRejection struct {
+	code    string
+	message string
+	expires time.Time
+}
+
+// pubkeyFailures counts failed payments of a pubkey until the TTL after the last one passes
+type pubkeyFailures struct {
+	count   int
+	expires time.Time
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{
+		tokens:  make(map[string]cachedRejection),
+		pubkeys: make(map[string]*pubkeyFailures),
+		hits:    make(map[string]uint64),
+	}
+}
+
+// tokenHash identifies a token without keeping the ecash itself in memory
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// rejectedToken returns the rejection of a token still cached
+func (c *negativeCache) rejectedToken(token string) (cachedRejection, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rejection, found := c.tokens[tokenHash(token)]
+	if !found || time.Now().After(rejection.expires) {
+		return cachedRejection{}, false
+	}
+	c.hits[negativeHitToken]++
+	return rejection, true
+}
+
+// rejectToken caches the rejection of a token for ttl
+func (c *negativeCache) rejectToken(token, code, message string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.tokens[tokenHash(token)] = cachedRejection{code: code, message: message, expires: now.Add(ttl)}
+	c.prune(now, ttl)
+}
+
+// blockedPubkey reports whether a pubkey failed to pay at least limit times within the TTL
+func (c *negativeCache) blockedPubkey(pubkey string, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failures, found := c.pubkeys[pubkey]
+	if !found || time.Now().After(failures.expires) || failures.count < limit {
+		return false
+	}
+	c.hits[negativeHitPubkey]++
+	return true
+}
+
+// recordFailure counts a failed payment of a pubkey, the count expires ttl after the last failure
+func (c *negativeCache) recordFailure(pubkey string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	failures, found := c.pubkeys[pubkey]
+	if !found || now.After(failures.expires) {
+		failures = &pubkeyFailures{}
+		c.pubkeys[pubkey] = failures
+	}
+	failures.count++
+	failures.expires = now.Add(ttl)
+	c.prune(now, ttl)
+}
+
+// prune drops expired entries, at most once per ttl so a flood of rejections doesn't rescan the cache each time.
+// Must be called with mu held.
+func (c *negativeCache) prune(now time.Time, ttl time.Duration) {
+	if now.Sub(c.lastPrune) < ttl {
+		return
+	}
+	c.lastPrune = now
+
+	for hash, rejection := range c.tokens {
+		if now.After(rejection.expires) {
+			delete(c.tokens, hash)
+		}
+	}
+	for pubkey, failures := range c.pubkeys {
+		if now.After(failures.expires) {
+			delete(c.pubkeys, pubkey)
+		}
+	}
+}
+
+// hitCounts returns the rejections answered from the cache since startup, by kind
+func (c *negativeCache) hitCounts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hits := make(map[string]uint64, len(c.hits))
+	for kind, count := range c.hits {
+		hits[kind] = count
+	}
+	return hits
+}
+
+// negativeCacheTTL returns how long rejections are cached, 0 if the cache is disabled
+func (m *Merchant) negativeCacheTTL() time.Duration {
+	config := m.getConfig().NegativeCache
+	if !config.Enabled || config.TTLSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(config.TTLSeconds) * time.Second
+}
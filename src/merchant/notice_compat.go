@@ -0,0 +1,126 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindNotice is the TollGate notice event, answering requests that don't result in a session
+const KindNotice = 21023
+
+// noticeCompat is what a client reads besides kind 21023 notices, as advertised in its payment event
+type noticeCompat struct {
+	directMessage bool
+	kinds         []int
+}
+
+// noticeCompatOf returns the notice forms a request advertises that the config allows
+func noticeCompatOf(config config_manager.NoticeCompatConfig, request nostr.Event) noticeCompat {
+	var compat noticeCompat
+	if !config.Enabled {
+		return compat
+	}
+	for _, tag := range request.Tags {
+		if len(tag) < 2 || tag[0] != "notice-compat" {
+			continue
+		}
+		switch tag[1] {
+		case "nip04":
+			compat.directMessage = config.DirectMessages
+		case "kind":
+			if len(tag) < 3 {
+				continue
+			}
+			kind, err := strconv.Atoi(tag[2])
+			if err != nil || !slices.Contains(config.MirrorKinds, kind) || slices.Contains(compat.kinds, kind) {
+				continue
+			}
+			compat.kinds = append(compat.kinds, kind)
+		}
+	}
+	return compat
+}
+
+// isNoticeMirrorKind reports whether events of a kind are notices mirrored for clients, routed like notices
+func isNoticeMirrorKind(config *config_manager.Config, kind int) bool {
+	return config.NoticeCompat.Enabled && slices.Contains(config.NoticeCompat.MirrorKinds, kind)
+}
+
+// MirrorNotice publishes copies of a notice answering a request in the forms the request advertises, for
+// clients that don't read kind 21023 notices. The notice itself is still returned to the client as is.
+func (m *Merchant) MirrorNotice(request nostr.Event, notice *nostr.Event) {
+	if notice == nil || notice.Kind != KindNotice {
+		return
+	}
+	compat := noticeCompatOf(m.getConfig().NoticeCompat, request)
+	if !compat.directMessage && len(compat.kinds) == 0 {
+		return
+	}
+
+	// Mirrors go out in the background, the response to the client doesn't wait for the relays
+	go func() {
+		if compat.directMessage {
+			dmEvent, err := m.createDirectMessage(request.PubKey, noticeText(notice))
+			if err != nil {
+				log.Printf("Failed to mirror notice %s as direct message: %v", notice.ID, err)
+			} else {
+				m.publisher.Publish(dmEvent)
+			}
+		}
+		for _, kind := range compat.kinds {
+			mirrorEvent, err := m.createNoticeMirror(notice, kind)
+			if err != nil {
+				log.Printf("Failed to mirror notice %s as kind %d: %v", notice.ID, kind, err)
+				continue
+			}
+			m.publisher.Publish(mirrorEvent)
+		}
+	}()
+}
+
+// noticeText renders a notice for clients that only show the text of direct messages
+func noticeText(notice *nostr.Event) string {
+	var level, code string
+	for _, tag := range notice.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "level":
+			level = tag[1]
+		case "code":
+			code = tag[1]
+		}
+	}
+	return fmt.Sprintf("TollGate %s (%s): %s", level, code, notice.Content)
+}
+
+// createNoticeMirror copies a notice under another kind, referencing the original
+func (m *Merchant) createNoticeMirror(notice *nostr.Event, kind int) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	tags := make(nostr.Tags, 0, len(notice.Tags)+1)
+	tags = append(tags, notice.Tags...)
+	mirrorEvent := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: notice.CreatedAt,
+		Tags:      append(tags, nostr.Tag{"e", notice.ID}),
+		Content:   notice.Content,
+	}
+	if err := mirrorEvent.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign notice mirror: %w", err)
+	}
+	return mirrorEvent, nil
+}
@@ -0,0 +1,213 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+// KindOperatorStatus is a NIP-44 encrypted status report addressed to the owner
+const KindOperatorStatus = 21028
+
+// defaultStatusInterval applies when no status interval is configured
+const defaultStatusInterval = 5 * time.Minute
+
+// OperatorStatus is the content of an operator status event, for fleet dashboards
+type OperatorStatus struct {
+	Version        string            `json:"version"`
+	UptimeSeconds  int64             `json:"uptime_seconds"`
+	Balance        uint64            `json:"balance"`
+	BalanceByMint  map[string]uint64 `json:"balance_by_mint"`
+	ActiveSessions int               `json:"active_sessions"`
+	ErrorCounts    map[string]uint64 `json:"error_counts"`   // Errors since startup by notice code
+	MintAlerts     map[string]string `json:"mint_alerts"`    // Mints adjusted or paused due to their fees or exposure
+	OutboxPending  int               `json:"outbox_pending"` // Events still waiting for public relays
+	// Payments rejected from the negative cache without asking the mint, by "token" or "pubkey"
+	NegativeCacheHits map[string]uint64 `json:"negative_cache_hits"`
+	// Load of the purchase queue, with purchases turned away as busy
+	PurchaseQueue PurchaseQueueMetrics `json:"purchase_queue"`
+	// Gates that opened over the latency budget and what their customers were credited
+	GateLatency GateLatencyMetrics `json:"gate_latency"`
+	// Proofs quarantined by the wallet store check at startup, nil if the store was consistent
+	WalletCheck *tollwallet.StoreCheckReport `json:"wallet_check,omitempty"`
+	// Outcome of the last self-test of the money path, nil if none ran since startup
+	SelfTest *SelfTestReport `json:"self_test,omitempty"`
+	// Mints whose balance drifted from what the mint confirms at the last reconciliation
+	BalanceDrift []tollwallet.BalanceReconciliation `json:"balance_drift,omitempty"`
+	// Balance repairs applied at startup
+	BalanceRepairs []tollwallet.BalanceRepair `json:"balance_repairs,omitempty"`
+	// Payouts melted at a mint that hasn't settled them yet
+	PendingMelts []tollwallet.MeltRecord `json:"pending_melts,omitempty"`
+	// Last entry of the financial audit log, kept by the owner to detect a log rewritten since
+	FinancialAuditHead *AuditHead `json:"financial_audit_head,omitempty"`
+	// Emergency stop in force, nil while the gateway runs
+	EmergencyStop *EmergencyStopStatus `json:"emergency_stop,omitempty"`
+}
+
+// AuditHead is the sequence number and hash of the last entry of a hash-chained audit log
+type AuditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// errorCounters counts errors by code since startup
+type errorCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newErrorCounters() *errorCounters {
+	return &errorCounters{counts: make(map[string]uint64)}
+}
+
+func (c *errorCounters) add(code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[code]++
+}
+
+func (c *errorCounters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]uint64, len(c.counts))
+	for code, count := range c.counts {
+		counts[code] = count
+	}
+	return counts
+}
+
+// GetOperatorStatus summarizes wallet, sessions and errors of this gateway
+func (m *Merchant) GetOperatorStatus() OperatorStatus {
+	status := OperatorStatus{
+		UptimeSeconds: int64(time.Since(m.startTime).Seconds()),
+		Balance:       m.tollwallet.GetBalance(),
+		BalanceByMint: make(map[string]uint64),
+		ErrorCounts:   m.errorCounters.snapshot(),
+		MintAlerts:    m.mintFeeAlerts(),
+		OutboxPending: m.outbox.pending(),
+	}
+	status.NegativeCacheHits = m.negativeCache.hitCounts()
+	status.PurchaseQueue = m.purchaseQueue.snapshot()
+	status.GateLatency = m.gateLatency.snapshot()
+	status.EmergencyStop = m.emergencyStop.halted()
+	for mintURL, reason := range m.exposure.alerts() {
+		status.MintAlerts[mintURL] = reason
+	}
+	status.SelfTest = m.lastSelfTest()
+	status.BalanceDrift = m.balanceDrift()
+	status.BalanceRepairs = m.tollwallet.GetRepairs()
+	status.PendingMelts = m.tollwallet.GetPendingMelts()
+	if financialLog := m.configManager.GetFinancialAuditLog(); financialLog != nil {
+		if seq, hash := financialLog.Head(); seq > 0 {
+			status.FinancialAuditHead = &AuditHead{Seq: seq, Hash: hash}
+		}
+	}
+	if check := m.tollwallet.GetStoreCheck(); len(check.Quarantined) > 0 || check.Error != "" {
+		status.WalletCheck = &check
+	}
+	if installConfig := m.configManager.GetInstallConfig(); installConfig != nil {
+		status.Version = installConfig.InstalledVersion
+	}
+
+	for _, mint := range m.getConfig().AcceptedMints {
+		status.BalanceByMint[mint.URL] = m.tollwallet.GetBalanceByMint(mint.URL)
+	}
+
+	m.sessionMu.RLock()
+	for _, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			status.ActiveSessions++
+		}
+	}
+	m.sessionMu.RUnlock()
+
+	return status
+}
+
+// createOperatorStatusEvent encrypts the operator status to the owner's pubkey and signs it
+func (m *Merchant) createOperatorStatusEvent(ownerPubkey string) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	content, err := json.Marshal(m.GetOperatorStatus())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode operator status: %w", err)
+	}
+
+	conversationKey, err := nip44.GenerateConversationKey(ownerPubkey, merchantIdentity.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive conversation key: %w", err)
+	}
+	ciphertext, err := nip44.Encrypt(string(content), conversationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt operator status: %w", err)
+	}
+
+	statusEvent := &nostr.Event{
+		Kind:      KindOperatorStatus,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", ownerPubkey},
+		},
+		Content: ciphertext,
+	}
+	if err := statusEvent.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign operator status: %w", err)
+	}
+	return statusEvent, nil
+}
+
+// ownerPubkey returns the owner's pubkey, or an empty string if the owner is not set up yet
+func (m *Merchant) ownerPubkey() string {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return ""
+	}
+	owner, err := identities.GetPublicIdentity("owner")
+	if err != nil || !nostr.IsValidPublicKey(owner.PubKey) {
+		return ""
+	}
+	return owner.PubKey
+}
+
+// reportOperatorStatus periodically publishes the operator status to the public relays while enabled
+func (m *Merchant) reportOperatorStatus() {
+	for {
+		config := m.getConfig()
+		interval := time.Duration(config.Fleet.StatusIntervalSeconds) * time.Second
+		if interval == 0 {
+			interval = defaultStatusInterval
+		}
+		time.Sleep(interval)
+
+		if !m.getConfig().Fleet.StatusReportsEnabled {
+			continue
+		}
+
+		ownerPubkey := m.ownerPubkey()
+		if ownerPubkey == "" {
+			log.Printf("Skipping operator status, owner pubkey is not configured")
+			continue
+		}
+
+		statusEvent, err := m.createOperatorStatusEvent(ownerPubkey)
+		if err != nil {
+			log.Printf("Failed to create operator status: %v", err)
+			continue
+		}
+		m.publisher.Publish(statusEvent)
+	}
+}
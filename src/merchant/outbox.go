@@ -0,0 +1,241 @@
+package merchant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Defaults for the outbox when the config leaves them at 0
+const (
+	defaultOutboxMaxEvents  = 500
+	defaultOutboxMaxAge     = 24 * time.Hour
+	defaultOutboxMaxBackoff = 10 * time.Minute
+	outboxMinBackoff        = 5 * time.Second
+)
+
+// outboxEntry is an event waiting to reach some of its relays
+type outboxEntry struct {
+	Event    nostr.Event `json:"event"`
+	Pending  []string    `json:"pending"` // Relays that have not accepted the event yet
+	QueuedAt time.Time   `json:"queued_at"`
+}
+
+// relayBackoff tracks failed deliveries to a relay
+type relayBackoff struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+// outbox persists events for public relays and retries them with backoff until each relay accepted them.
+// Events reach every relay in the order they were queued.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	entries []*outboxEntry
+	backoff map[string]*relayBackoff
+	wake    chan struct{}
+	publish func(relayURL string, event nostr.Event) error
+
+	maxEvents  int
+	maxAge     time.Duration
+	maxBackoff time.Duration
+}
+
+func newOutbox(path string, publish func(relayURL string, event nostr.Event) error) *outbox {
+	o := &outbox{
+		path:       path,
+		backoff:    make(map[string]*relayBackoff),
+		wake:       make(chan struct{}, 1),
+		publish:    publish,
+		maxEvents:  defaultOutboxMaxEvents,
+		maxAge:     defaultOutboxMaxAge,
+		maxBackoff: defaultOutboxMaxBackoff,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read outbox %s: %v", path, err)
+		}
+		return o
+	}
+	if err := json.Unmarshal(data, &o.entries); err != nil {
+		log.Printf("Warning: failed to parse outbox %s: %v", path, err)
+		o.entries = nil
+	}
+	if len(o.entries) > 0 {
+		log.Printf("Outbox: %d events from a previous run still waiting for public relays", len(o.entries))
+	}
+	return o
+}
+
+// setLimits bounds the size and age of the queue and the retry backoff (0 = default)
+func (o *outbox) setLimits(maxEvents int, maxAge, maxBackoff time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.maxEvents = maxEvents
+	if o.maxEvents <= 0 {
+		o.maxEvents = defaultOutboxMaxEvents
+	}
+	o.maxAge = maxAge
+	if o.maxAge <= 0 {
+		o.maxAge = defaultOutboxMaxAge
+	}
+	o.maxBackoff = maxBackoff
+	if o.maxBackoff <= 0 {
+		o.maxBackoff = defaultOutboxMaxBackoff
+	}
+}
+
+// save persists the queue. Caller must hold mu.
+func (o *outbox) save() {
+	data, err := json.Marshal(o.entries)
+	if err != nil {
+		log.Printf("Warning: failed to encode outbox: %v", err)
+		return
+	}
+	if err := utils.WriteState(o.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save outbox: %v", err)
+	}
+}
+
+// enqueue queues an event for the given relays and wakes the sender.
+// A replaceable event supersedes queued events of the same kind and author.
+func (o *outbox) enqueue(event nostr.Event, relays []string) {
+	if len(relays) == 0 {
+		return
+	}
+
+	o.mu.Lock()
+	if nostr.IsReplaceableKind(event.Kind) {
+		o.entries = slices.DeleteFunc(o.entries, func(entry *outboxEntry) bool {
+			return entry.Event.Kind == event.Kind && entry.Event.PubKey == event.PubKey
+		})
+	}
+	o.entries = append(o.entries, &outboxEntry{
+		Event:    event,
+		Pending:  slices.Clone(relays),
+		QueuedAt: time.Now(),
+	})
+	if dropped := len(o.entries) - o.maxEvents; dropped > 0 {
+		log.Printf("Warning: outbox full, dropping %d oldest events", dropped)
+		o.entries = o.entries[dropped:]
+	}
+	o.save()
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pending returns the number of queued events
+func (o *outbox) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// run delivers queued events until the process exits
+func (o *outbox) run() {
+	for {
+		wait := o.deliver()
+		select {
+		case <-o.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliver sends queued events to every relay that is not backing off, oldest first,
+// and returns how long to wait before the next attempt
+func (o *outbox) deliver() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire()
+
+	now := time.Now()
+	next := o.maxBackoff
+	blocked := make(map[string]bool)
+
+	// Iterate a copy, enqueue may change the queue while a publish is in flight
+	for _, entry := range slices.Clone(o.entries) {
+		for _, relayURL := range slices.Clone(entry.Pending) {
+			if blocked[relayURL] {
+				continue
+			}
+			if backoff := o.backoff[relayURL]; backoff != nil && now.Before(backoff.nextAttempt) {
+				// Keep later events behind this one so the relay receives them in order
+				blocked[relayURL] = true
+				next = min(next, backoff.nextAttempt.Sub(now))
+				continue
+			}
+
+			// Publishing may block on the network, don't hold up enqueue meanwhile
+			o.mu.Unlock()
+			err := o.publish(relayURL, entry.Event)
+			o.mu.Lock()
+
+			if err != nil {
+				backoff := o.backoff[relayURL]
+				if backoff == nil {
+					backoff = &relayBackoff{}
+					o.backoff[relayURL] = backoff
+				}
+				backoff.failures++
+				delay := min(outboxMinBackoff<<min(backoff.failures-1, 16), o.maxBackoff)
+				backoff.nextAttempt = time.Now().Add(delay)
+				blocked[relayURL] = true
+				next = min(next, delay)
+				log.Printf("Outbox: failed to publish event %s to %s, retrying in %s: %v", entry.Event.ID, relayURL, delay, err)
+				continue
+			}
+
+			delete(o.backoff, relayURL)
+			entry.Pending = slices.DeleteFunc(entry.Pending, func(pending string) bool { return pending == relayURL })
+		}
+	}
+
+	o.entries = slices.DeleteFunc(o.entries, func(entry *outboxEntry) bool { return len(entry.Pending) == 0 })
+	o.save()
+	return next
+}
+
+// expire drops events that could not be delivered within the max age. Caller must hold mu.
+func (o *outbox) expire() {
+	cutoff := time.Now().Add(-o.maxAge)
+	o.entries = slices.DeleteFunc(o.entries, func(entry *outboxEntry) bool {
+		if entry.QueuedAt.Before(cutoff) {
+			log.Printf("Outbox: dropping event %s (kind %d), relays %v unreachable since %s",
+				entry.Event.ID, entry.Event.Kind, entry.Pending, entry.QueuedAt.Format(time.RFC3339))
+			return true
+		}
+		return false
+	})
+}
+
+// publishToRelay publishes an event to a single public relay
+func (m *Merchant) publishToRelay(ctx context.Context, relayURL string, event nostr.Event) error {
+	pool := m.configManager.GetPublicPool()
+	relay, err := pool.EnsureRelay(relayURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	if err := relay.Publish(ctx, event); err != nil {
+		return err
+	}
+	log.Printf("Successfully published event %s to public relay %s", event.ID, relayURL)
+	return nil
+}
@@ -0,0 +1,232 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// paymentRequestPrefix starts an encoded NUT-18 payment request, followed by its CBOR in base64url
+const paymentRequestPrefix = "creqA"
+
+// PaymentRequestPath is where wallets post payments of the advertised payment requests
+const PaymentRequestPath = "/payment-request"
+
+// defaultPaymentRequestRotation applies when no rotation interval is configured
+const defaultPaymentRequestRotation = time.Hour
+
+// nut18Request is a Cashu payment request as encoded by NUT-18
+type nut18Request struct {
+	ID          string           `cbor:"i,omitempty"`
+	Amount      uint64           `cbor:"a,omitempty"`
+	Unit        string           `cbor:"u,omitempty"`
+	SingleUse   bool             `cbor:"s,omitempty"`
+	Mints       []string         `cbor:"m,omitempty"`
+	Description string           `cbor:"d,omitempty"`
+	Transports  []nut18Transport `cbor:"t,omitempty"`
+}
+
+// nut18Transport tells the wallet where to send the payment
+type nut18Transport struct {
+	Type   string     `cbor:"t"`
+	Target string     `cbor:"a"`
+	Tags   [][]string `cbor:"g,omitempty"`
+}
+
+// PaymentRequestPayload is the payment a wallet posts for a payment request, as defined by NUT-18
+type PaymentRequestPayload struct {
+	ID     string       `json:"id"`
+	Memo   string       `json:"memo,omitempty"` // MAC address of the device to pay for, if the payment doesn't come from it
+	Mint   string       `json:"mint"`
+	Unit   string       `json:"unit"`
+	Proofs cashu.Proofs `json:"proofs"`
+}
+
+// paymentRequests are the request IDs advertised per mint. A rotated out request is honored until the next
+// rotation, so wallets that fetched the advertisement just before can still pay it.
+type paymentRequests struct {
+	mu       sync.Mutex
+	current  map[string]string // Request ID by mint URL
+	previous map[string]string
+}
+
+// rotate replaces the request of each mint with a new one
+func (p *paymentRequests) rotate(mints []config_manager.MintConfig) error {
+	current := make(map[string]string, len(mints))
+	for _, mint := range mints {
+		idBytes := make([]byte, 8)
+		if _, err := rand.Read(idBytes); err != nil {
+			return fmt.Errorf("failed to generate payment request ID: %w", err)
+		}
+		current[mint.URL] = hex.EncodeToString(idBytes)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.previous = p.current
+	p.current = current
+	return nil
+}
+
+// ids returns the current request ID of each mint, creating them the first time
+func (p *paymentRequests) ids(mints []config_manager.MintConfig) map[string]string {
+	p.mu.Lock()
+	missing := false
+	for _, mint := range mints {
+		if _, exists := p.current[mint.URL]; !exists {
+			missing = true
+		}
+	}
+	p.mu.Unlock()
+	if missing {
+		if err := p.rotate(mints); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make(map[string]string, len(p.current))
+	for mintURL, id := range p.current {
+		ids[mintURL] = id
+	}
+	return ids
+}
+
+// honored reports whether a request ID was advertised for the mint and hasn't been rotated out twice
+func (p *paymentRequests) honored(id, mintURL string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return id != "" && (p.current[mintURL] == id || p.previous[mintURL] == id)
+}
+
+// encodePaymentRequest returns a payment request in its NUT-18 string form
+func encodePaymentRequest(request nut18Request) (string, error) {
+	data, err := cbor.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	return paymentRequestPrefix + base64.URLEncoding.EncodeToString(data), nil
+}
+
+// paymentRequestTags advertises a payment request per mint as ["payment_request", mint URL, request], asking for
+// the minimum purchase in sats and to be posted to the gateway
+func (m *Merchant) paymentRequestTags(config *config_manager.Config, mints []config_manager.MintConfig) []nostr.Tag {
+	if !config.PaymentRequests.Enabled {
+		return nil
+	}
+	target := strings.TrimSuffix(config.PaymentRequests.BaseURL, "/") + PaymentRequestPath
+	if config.PaymentRequests.BaseURL == "" {
+		target = gatewayURL(config, PaymentRequestPath)
+	}
+	if target == "" {
+		return nil
+	}
+
+	ids := m.paymentRequests.ids(mints)
+	var tags []nostr.Tag
+	for _, mint := range mints {
+		request := nut18Request{
+			ID:          ids[mint.URL],
+			Unit:        walletUnit,
+			Mints:       []string{mint.URL},
+			Description: "Internet access",
+			Transports:  []nut18Transport{{Type: "post", Target: target}},
+		}
+		// Wallets that can't choose an amount pay for the minimum purchase
+		minPrice := mint.PricePerStep * max(mint.MinPurchaseSteps, 1)
+		if sats, err := convertAmount(minPrice, mint.PriceUnit, walletUnit, m.usdPerBTC(config)); err == nil {
+			request.Amount = sats
+		}
+
+		encoded, err := encodePaymentRequest(request)
+		if err != nil {
+			log.Printf("Warning: failed to encode payment request for %s: %v", mint.URL, err)
+			continue
+		}
+		tags = append(tags, nostr.Tag{"payment_request", mint.URL, encoded})
+	}
+	return tags
+}
+
+// rotatePaymentRequests replaces the advertised payment requests at the configured interval
+func (m *Merchant) rotatePaymentRequests() {
+	for {
+		config := m.getConfig()
+		interval := time.Duration(config.PaymentRequests.RotationMinutes) * time.Minute
+		if interval <= 0 {
+			interval = defaultPaymentRequestRotation
+		}
+		time.Sleep(interval)
+
+		config = m.getConfig()
+		if !config.PaymentRequests.Enabled {
+			continue
+		}
+		if err := m.paymentRequests.rotate(m.pricedMints(config)); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if err := m.refreshAdvertisement(); err != nil {
+			log.Printf("Warning: failed to refresh advertisement after rotating payment requests: %v", err)
+			continue
+		}
+		m.publishAdvertisement()
+	}
+}
+
+// PayPaymentRequest buys a session with the payment of an advertised payment request. The payment is for the
+// device it was posted from, or for the device in its memo if the gateway couldn't tell where it came from.
+// It is processed like a payment event, without a customer pubkey the response could be addressed to.
+func (m *Merchant) PayPaymentRequest(payload PaymentRequestPayload, macAddress string) (*nostr.Event, error) {
+	if !m.getConfig().PaymentRequests.Enabled {
+		return nil, fmt.Errorf("this TollGate does not accept payment requests")
+	}
+	if !m.paymentRequests.honored(payload.ID, payload.Mint) {
+		return nil, fmt.Errorf("unknown or expired payment request %s for %s", payload.ID, payload.Mint)
+	}
+	if unit, err := config_manager.NormalizeUnit(payload.Unit); err != nil || unit != walletUnit {
+		return nil, fmt.Errorf("payment requests are paid in %s", walletUnit)
+	}
+	if len(payload.Proofs) == 0 {
+		return nil, fmt.Errorf("payment has no proofs")
+	}
+
+	if macAddress == "" {
+		macAddress = strings.TrimSpace(payload.Memo)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return nil, fmt.Errorf("device not found, pay from the device to connect or put its MAC address in the memo")
+	}
+
+	token, err := cashu.NewTokenV4(payload.Proofs, payload.Mint, cashu.Sat, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proofs: %w", err)
+	}
+	paymentToken, err := token.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("invalid proofs: %w", err)
+	}
+
+	log.Printf("Payment of request %s for %s received", payload.ID, macAddress)
+	return m.PurchaseSession(nostr.Event{
+		Kind:      21000,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"payment", paymentToken},
+			{"device-identifier", "mac", macAddress},
+			{"payment-request", payload.ID},
+		},
+	})
+}
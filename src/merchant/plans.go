@@ -0,0 +1,165 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// extractPlan returns the special-purpose plan a payment buys days of, empty for a regular purchase
+func extractPlan(paymentEvent nostr.Event) string {
+	if tag := paymentEvent.Tags.Find("plan"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+// findPlan returns the configured plan with the ID, nil if the venue doesn't offer it
+func findPlan(config *config_manager.Config, planID string) *config_manager.PlanConfig {
+	for i := range config.Plans {
+		if config.Plans[i].ID == planID && config.Plans[i].PricePerDay > 0 {
+			return &config.Plans[i]
+		}
+	}
+	return nil
+}
+
+// planTag advertises a plan as ["plan", id, price per day, bandwidth kbps, max days, name]
+func planTag(plan config_manager.PlanConfig) nostr.Tag {
+	return nostr.Tag{
+		"plan",
+		plan.ID,
+		fmt.Sprintf("%d", plan.PricePerDay),
+		fmt.Sprintf("%d", plan.BandwidthKbps),
+		fmt.Sprintf("%d", plan.MaxDays),
+		plan.Name,
+	}
+}
+
+// purchasePlan sells whole days of a special-purpose plan, its gate opened with the plan's shaping profile.
+// The payment is checked against the price before it is redeemed. What is left over after whole days is kept,
+// like amounts between step prices of sessions.
+func (m *Merchant) purchasePlan(paymentEvent nostr.Event, planID, paymentToken, macAddress string) (*nostr.Event, error) {
+	plan := findPlan(m.getConfig(), planID)
+	if plan == nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "plan-not-offered",
+			fmt.Sprintf("Plan %s is not offered here", planID), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("plan not offered and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	tier := config_manager.PlanTier(plan.ID)
+
+	// A device is on a plan or on the tier ladder, the gate can't shape it as both
+	if current, err := m.GetSession(macAddress); err == nil && isCustomerSessionActive(current) && current.Tier != tier {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "plan-session-conflict",
+			fmt.Sprintf("Device has an active %s session, buy the plan once it ended", current.Tier), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("plan conflicts with session and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "payment-error-invalid-token",
+			fmt.Sprintf("Invalid cashu token: %v", err), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid cashu token and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Refuse payments that don't buy a day, or buy more than allowed, before redeeming them
+	received := paymentCashuToken.Amount()
+	if received < plan.PricePerDay || (plan.MaxDays > 0 && received/plan.PricePerDay > plan.MaxDays) {
+		message := fmt.Sprintf("%s costs %d sats per day", plan.Name, plan.PricePerDay)
+		if plan.MaxDays > 0 {
+			message += fmt.Sprintf(", up to %d days per payment", plan.MaxDays)
+		}
+		noticeEvent, noticeErr := m.createNoticeEventWithTags("error", "plan-payment-invalid", message,
+			paymentEvent.PubKey, nostr.Tag{"price", fmt.Sprintf("%d", plan.PricePerDay)})
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid plan payment and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
+	if err != nil {
+		return m.redeemFailedNotice(err, paymentToken, paymentEvent.PubKey)
+	}
+	mintURL := paymentCashuToken.Mint()
+	m.checkExposure(mintURL)
+	swapFee := uint64(0)
+	if received > amountAfterSwap {
+		swapFee = received - amountAfterSwap
+	}
+
+	days := amountAfterSwap / plan.PricePerDay
+	if days == 0 {
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"plan-payment-invalid", fmt.Sprintf("%d sats left after the mint's fees don't buy a day", amountAfterSwap))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid plan payment and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	allotment := days * uint64((24 * time.Hour).Milliseconds())
+	paid := days * plan.PricePerDay
+
+	session, err := m.AddAllotment(macAddress, "milliseconds", allotment)
+	if err != nil {
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"session-management-failed", fmt.Sprintf("Failed to manage session: %v", err))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("failed to manage session and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	endTimestamp := sessionEndTimestamp(session)
+	if _, err := m.openGate(macAddress, endTimestamp, tier); err != nil {
+		m.withdrawAllotment(macAddress, allotment)
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"gate-opening-failed", fmt.Sprintf("Failed to open gate for plan: %v", err))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("failed to open gate for plan and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	m.setSessionTier(macAddress, tier)
+	session.Tier = tier
+	log.Printf("Sold %d days of plan %s to %s, gate open until %d", days, plan.ID, macAddress, endTimestamp)
+
+	iface := m.clientInterface(macAddress)
+	m.recordRevenue(mintURL, iface, amountAfterSwap)
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerPayment,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		MintURL:    mintURL,
+		Amount:     amountAfterSwap,
+		Received:   received,
+		SwapFee:    swapFee,
+		Allotment:  allotment,
+		Metric:     "milliseconds",
+		EventID:    paymentEvent.ID,
+		Interface:  iface,
+		Tier:       tier,
+		Plan:       plan.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record plan payment of %s: %v", macAddress, err)
+	}
+
+	return m.createSessionEvent(session, paymentEvent.PubKey,
+		nostr.Tag{"plan", plan.ID, fmt.Sprintf("%d", days)},
+		nostr.Tag{"amount-received", fmt.Sprintf("%d", received)},
+		nostr.Tag{"swap-fee", fmt.Sprintf("%d", swapFee)},
+		nostr.Tag{"amount-credited", fmt.Sprintf("%d", paid)})
+}
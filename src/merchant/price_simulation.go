@@ -0,0 +1,119 @@
+package merchant
+
+import (
+	"fmt"
+	"math"
+)
+
+// PriceSimulation is a hypothetical price to replay the purchase history with
+type PriceSimulation struct {
+	PricePerStep uint64  `json:"price_per_step"` // In sats
+	StepSize     uint64  `json:"step_size"`      // 0 keeps the step size of each mint
+	MintURL      string  `json:"mint_url"`       // Only purchases with this mint, empty for all
+	Since        int64   `json:"since"`          // Unix time the replayed history starts at
+	Elasticity   float64 `json:"elasticity"`     // Percent fewer units bought per percent the price per unit rises, 0 = customers buy the same
+}
+
+// PriceSimulationReport compares the revenue of the purchase history with what the simulated price would have made
+type PriceSimulationReport struct {
+	PriceSimulation
+	Purchases          int                       `json:"purchases"`
+	Skipped            int                       `json:"skipped"` // Purchases of a metric the mint doesn't sell anymore
+	ActualRevenue      uint64                    `json:"actual_revenue"`
+	SimulatedRevenue   uint64                    `json:"simulated_revenue"`
+	ActualAllotment    uint64                    `json:"actual_allotment"`
+	SimulatedAllotment uint64                    `json:"simulated_allotment"`
+	ChangePercent      float64                   `json:"change_percent"` // Of the simulated revenue over the actual one
+	ByMint             map[string]MintSimulation `json:"by_mint"`
+}
+
+// MintSimulation is the share of a mint in a price simulation
+type MintSimulation struct {
+	Purchases        int    `json:"purchases"`
+	ActualRevenue    uint64 `json:"actual_revenue"`
+	SimulatedRevenue uint64 `json:"simulated_revenue"`
+}
+
+// SimulatePricing replays the session purchases in the ledger since a time at another price per step. Each
+// customer is assumed to buy the same allotment in whole steps of the simulated size, less or more of it as the
+// elasticity says when the price per unit changes. Needs a storage backend with history.
+func (m *Merchant) SimulatePricing(simulation PriceSimulation) (PriceSimulationReport, error) {
+	report := PriceSimulationReport{PriceSimulation: simulation, ByMint: make(map[string]MintSimulation)}
+	if simulation.PricePerStep == 0 {
+		return report, fmt.Errorf("price per step must be at least 1 sat")
+	}
+	if simulation.Elasticity < 0 {
+		return report, fmt.Errorf("elasticity can't be negative")
+	}
+
+	entries, err := m.GetLedger(simulation.Since)
+	if err != nil {
+		return report, err
+	}
+
+	config := m.getConfig()
+	var simulatedRevenue, simulatedAllotment float64
+	for _, entry := range entries {
+		if entry.Type != LedgerPayment || entry.Allotment == 0 || entry.Amount == 0 {
+			continue
+		}
+		if simulation.MintURL != "" && entry.MintURL != simulation.MintURL {
+			continue
+		}
+
+		metric, stepSize := config.Metric, config.StepSize
+		for _, mint := range config.AcceptedMints {
+			if mint.URL == entry.MintURL {
+				metric, stepSize = config.MetricFor(mint), config.StepSizeFor(mint)
+				break
+			}
+		}
+		if entry.Metric != "" && entry.Metric != metric {
+			report.Skipped++
+			continue
+		}
+		if simulation.StepSize > 0 {
+			stepSize = simulation.StepSize
+		}
+		if stepSize == 0 {
+			report.Skipped++
+			continue
+		}
+
+		cost, allotment := simulatePurchase(entry, simulation.PricePerStep, stepSize, simulation.Elasticity)
+		simulatedRevenue += cost
+		simulatedAllotment += allotment
+
+		report.Purchases++
+		report.ActualRevenue += entry.Amount
+		report.ActualAllotment += entry.Allotment
+		mintReport := report.ByMint[entry.MintURL]
+		mintReport.Purchases++
+		mintReport.ActualRevenue += entry.Amount
+		mintReport.SimulatedRevenue += uint64(math.Round(cost))
+		report.ByMint[entry.MintURL] = mintReport
+	}
+
+	report.SimulatedRevenue = uint64(math.Round(simulatedRevenue))
+	report.SimulatedAllotment = uint64(math.Round(simulatedAllotment))
+	if report.ActualRevenue > 0 {
+		report.ChangePercent = (simulatedRevenue - float64(report.ActualRevenue)) * 100 / float64(report.ActualRevenue)
+	}
+	return report, nil
+}
+
+// simulatePurchase returns what a purchase would have cost at the simulated price and the allotment bought. The
+// allotment is rounded up to whole steps, then scaled by the change of the price per unit to the power of the
+// negated elasticity.
+func simulatePurchase(entry LedgerEntry, pricePerStep, stepSize uint64, elasticity float64) (float64, float64) {
+	steps := (entry.Allotment + stepSize - 1) / stepSize
+	cost := float64(steps * pricePerStep)
+
+	demand := 1.0
+	if elasticity > 0 {
+		actualUnitPrice := float64(entry.Amount) / float64(entry.Allotment)
+		simulatedUnitPrice := float64(pricePerStep) / float64(stepSize)
+		demand = math.Pow(simulatedUnitPrice/actualUnitPrice, -elasticity)
+	}
+	return cost * demand, float64(entry.Allotment) * demand
+}
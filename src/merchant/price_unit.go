@@ -0,0 +1,122 @@
+package merchant
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// walletUnit is the unit the wallet holds and reports received amounts in
+const walletUnit = config_manager.UnitSat
+
+// tokenUnit returns the unit of a token's keyset as the token states it, sats for tokens that don't
+func tokenUnit(token cashu.Token) string {
+	var unit string
+	switch t := token.(type) {
+	case *cashu.TokenV4:
+		unit = t.Unit
+	case *cashu.TokenV3:
+		unit = t.Unit
+	}
+	normalized, err := config_manager.NormalizeUnit(unit)
+	if err != nil {
+		return strings.ToLower(unit)
+	}
+	return normalized
+}
+
+// checkTokenUnit refuses tokens in a unit the wallet can't receive, whatever unit the mint's price is set in
+func checkTokenUnit(token cashu.Token) error {
+	if unit := tokenUnit(token); unit != walletUnit {
+		return fmt.Errorf("tokens in %s can't be received here, please pay with a %s token from %s", unit, walletUnit, token.Mint())
+	}
+	return nil
+}
+
+// usdPerBTC returns the rate usd prices are converted with, the fiat display rate when its currency is USD
+func (m *Merchant) usdPerBTC(config *config_manager.Config) float64 {
+	if !strings.EqualFold(config.FiatDisplay.Currency, "USD") {
+		return 0
+	}
+	rate, _, ok := m.currentFiatRate(config.FiatDisplay)
+	if !ok {
+		return 0
+	}
+	return rate
+}
+
+// convertAmount converts an amount between units, rounding down. Converting from or to usd cents takes the
+// price of a bitcoin in USD.
+func convertAmount(amount uint64, from, to string, usdPerBTC float64) (uint64, error) {
+	from, err := config_manager.NormalizeUnit(from)
+	if err != nil {
+		return 0, err
+	}
+	to, err = config_manager.NormalizeUnit(to)
+	if err != nil {
+		return 0, err
+	}
+	if from == to {
+		return amount, nil
+	}
+	if (from == config_manager.UnitUSD || to == config_manager.UnitUSD) && usdPerBTC <= 0 {
+		return 0, fmt.Errorf("no USD rate to convert %s to %s, enable fiat display in USD", from, to)
+	}
+
+	// Through msats, the smallest unit
+	var msats float64
+	switch from {
+	case config_manager.UnitSat:
+		msats = float64(amount) * 1000
+	case config_manager.UnitMsat:
+		msats = float64(amount)
+	case config_manager.UnitUSD:
+		msats = float64(amount) / 100 / usdPerBTC * 100_000_000_000
+	}
+	switch to {
+	case config_manager.UnitSat:
+		return uint64(msats / 1000), nil
+	case config_manager.UnitMsat:
+		return uint64(msats), nil
+	default:
+		return uint64(msats / 100_000_000_000 * usdPerBTC * 100), nil
+	}
+}
+
+// toPriceUnit converts sats received by the wallet to the unit a mint's price is set in
+func (m *Merchant) toPriceUnit(config *config_manager.Config, mint config_manager.MintConfig, amountSats uint64) (uint64, error) {
+	return convertAmount(amountSats, walletUnit, mint.PriceUnit, m.usdPerBTC(config))
+}
+
+// toWalletUnit converts an amount in a mint's price unit to the sats the wallet pays out
+func (m *Merchant) toWalletUnit(config *config_manager.Config, mint config_manager.MintConfig, amount uint64) (uint64, error) {
+	return convertAmount(amount, mint.PriceUnit, walletUnit, m.usdPerBTC(config))
+}
+
+// payableUnit reports whether payments to a mint can be priced: its unit is known and, for usd, a rate is available
+func (m *Merchant) payableUnit(config *config_manager.Config, mint config_manager.MintConfig) bool {
+	_, err := m.toPriceUnit(config, mint, 1)
+	return err == nil
+}
+
+// priceUnitTags tells clients what a step of the mints priced in another unit costs in the sats they pay with,
+// as ["price_in_sats", mint URL, sats per step]
+func (m *Merchant) priceUnitTags(config *config_manager.Config, mints []config_manager.MintConfig) []nostr.Tag {
+	var tags []nostr.Tag
+	for _, mint := range mints {
+		if unit, _ := config_manager.NormalizeUnit(mint.PriceUnit); unit == walletUnit {
+			continue
+		}
+		// In msats to keep the fraction of a sat a step may cost
+		msatsPerStep, err := convertAmount(mint.PricePerStep, mint.PriceUnit, config_manager.UnitMsat, m.usdPerBTC(config))
+		if err != nil {
+			continue
+		}
+		tags = append(tags, nostr.Tag{"price_in_sats", mint.URL, strconv.FormatFloat(float64(msatsPerStep)/1000, 'f', -1, 64)})
+	}
+	return tags
+}
@@ -0,0 +1,230 @@
+package merchant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"plugin"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// PricingInput describes a payment to a pricing strategy
+type PricingInput struct {
+	Amount           uint64          `json:"amount"`
+	Unit             string          `json:"unit"`
+	MintURL          string          `json:"mint_url"`
+	Metric           string          `json:"metric"`
+	StepSize         uint64          `json:"step_size"`
+	DefaultAllotment uint64          `json:"default_allotment"` // Allotment under the configured prices, 0 if the payment doesn't qualify
+	Timestamp        int64           `json:"timestamp"`
+	HourOfDay        int             `json:"hour_of_day"`
+	ActiveSessions   int             `json:"active_sessions"`
+	Customer         CustomerHistory `json:"customer"`
+}
+
+// CustomerHistory describes what the merchant knows about the paying device
+type CustomerHistory struct {
+	MacAddress         string `json:"mac_address"`
+	HasActiveSession   bool   `json:"has_active_session"`
+	RemainingAllotment uint64 `json:"remaining_allotment"`
+	Purchases          uint64 `json:"purchases"`
+}
+
+// PricingOutput is the decision of a pricing strategy
+type PricingOutput struct {
+	Allotment uint64 `json:"allotment"`
+	Reason    string `json:"reason,omitempty"` // Reported to the customer when the allotment is 0
+}
+
+// PricingStrategy decides the allotment for a payment, replacing the configured per-step prices
+type PricingStrategy interface {
+	Allotment(input PricingInput) (PricingOutput, error)
+}
+
+// newPricingStrategy creates the strategy selected in the config, or nil to use the configured prices
+func newPricingStrategy(config config_manager.PricingConfig) (PricingStrategy, error) {
+	switch {
+	case config.Plugin != "":
+		return newPluginPricing(config.Plugin)
+	case config.Script != "":
+		timeout := time.Duration(config.TimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		return &scriptPricing{path: config.Script, timeout: timeout}, nil
+	}
+	return nil, nil
+}
+
+// scriptPricing runs an executable that reads a PricingInput as JSON on stdin
+// and writes a PricingOutput as JSON to stdout
+type scriptPricing struct {
+	path    string
+	timeout time.Duration
+}
+
+func (s *scriptPricing) Allotment(input PricingInput) (PricingOutput, error) {
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return PricingOutput{}, fmt.Errorf("failed to encode pricing input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.path)
+	cmd.Stdin = bytes.NewReader(inputJSON)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return PricingOutput{}, fmt.Errorf("pricing script %s failed: %w (stderr: %s)", s.path, err, stderr.String())
+	}
+
+	var output PricingOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return PricingOutput{}, fmt.Errorf("invalid pricing script output: %w", err)
+	}
+	return output, nil
+}
+
+// pluginPricing calls a Go plugin exporting
+//
+//	func Price(input []byte) ([]byte, error)
+//
+// with the same JSON contract as pricing scripts, so plugins don't depend on merchant types
+type pluginPricing struct {
+	price func([]byte) ([]byte, error)
+}
+
+func newPluginPricing(path string) (*pluginPricing, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pricing plugin %s: %w", path, err)
+	}
+
+	symbol, err := p.Lookup("Price")
+	if err != nil {
+		return nil, fmt.Errorf("pricing plugin %s has no Price function: %w", path, err)
+	}
+
+	price, ok := symbol.(func([]byte) ([]byte, error))
+	if !ok {
+		return nil, fmt.Errorf("pricing plugin %s: Price has type %T, expected func([]byte) ([]byte, error)", path, symbol)
+	}
+
+	return &pluginPricing{price: price}, nil
+}
+
+func (p *pluginPricing) Allotment(input PricingInput) (PricingOutput, error) {
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return PricingOutput{}, fmt.Errorf("failed to encode pricing input: %w", err)
+	}
+
+	outputJSON, err := p.price(inputJSON)
+	if err != nil {
+		return PricingOutput{}, fmt.Errorf("pricing plugin failed: %w", err)
+	}
+
+	var output PricingOutput
+	if err := json.Unmarshal(outputJSON, &output); err != nil {
+		return PricingOutput{}, fmt.Errorf("invalid pricing plugin output: %w", err)
+	}
+	return output, nil
+}
+
+// getPricingStrategy returns the active pricing strategy, or nil if the configured prices apply
+func (m *Merchant) getPricingStrategy() PricingStrategy {
+	m.pricingMu.RLock()
+	defer m.pricingMu.RUnlock()
+	return m.pricingStrategy
+}
+
+// loadPricingStrategy (re)loads the pricing strategy from the config.
+// On failure the configured prices are used, so a broken hook never blocks sales.
+func (m *Merchant) loadPricingStrategy(config config_manager.PricingConfig) {
+	strategy, err := newPricingStrategy(config)
+	if err != nil {
+		log.Printf("Warning: failed to load pricing strategy, using configured prices: %v", err)
+	}
+
+	m.pricingMu.Lock()
+	m.pricingStrategy = strategy
+	m.pricingMu.Unlock()
+}
+
+// priceWithStrategy asks the strategy for the allotment of a payment.
+// If the strategy fails the default allotment and error are returned unchanged.
+func (m *Merchant) priceWithStrategy(strategy PricingStrategy, config *config_manager.Config, amount uint64, mintURL, macAddress string, defaultAllotment uint64, defaultErr error) (uint64, error) {
+	now := time.Now()
+	input := PricingInput{
+		Amount:         amount,
+		MintURL:        mintURL,
+		Metric:         config.Metric,
+		StepSize:       config.StepSize,
+		Timestamp:      now.Unix(),
+		HourOfDay:      now.Hour(),
+		ActiveSessions: m.countActiveSessions(),
+		Customer:       m.customerHistory(macAddress),
+	}
+	if mintConfig := findMintConfigIn(config, mintURL); mintConfig != nil {
+		input.Unit = mintConfig.PriceUnit
+		input.Metric = config.MetricFor(*mintConfig)
+		input.StepSize = config.StepSizeFor(*mintConfig)
+	}
+	if defaultErr == nil {
+		input.DefaultAllotment = defaultAllotment
+	}
+
+	output, err := strategy.Allotment(input)
+	if err != nil {
+		log.Printf("Warning: pricing strategy failed, using configured prices: %v", err)
+		return defaultAllotment, defaultErr
+	}
+
+	if output.Allotment == 0 {
+		if output.Reason != "" {
+			return 0, fmt.Errorf("payment rejected: %s", output.Reason)
+		}
+		return 0, fmt.Errorf("payment rejected by pricing strategy")
+	}
+
+	log.Printf("Pricing strategy granted %d %s for %d (default %d)", output.Allotment, input.Metric, amount, input.DefaultAllotment)
+	return output.Allotment, nil
+}
+
+// countActiveSessions returns the number of sessions with allotment left
+func (m *Merchant) countActiveSessions() int {
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	active := 0
+	for _, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			active++
+		}
+	}
+	return active
+}
+
+// customerHistory summarizes the session of a device for pricing decisions
+func (m *Merchant) customerHistory(macAddress string) CustomerHistory {
+	history := CustomerHistory{
+		MacAddress:         macAddress,
+		RemainingAllotment: m.remainingAllotment(macAddress),
+	}
+
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+	if session, exists := m.customerSessions[macAddress]; exists {
+		history.HasActiveSession = isCustomerSessionActive(session)
+		history.Purchases = session.Purchases
+	}
+	return history
+}
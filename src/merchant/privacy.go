@@ -0,0 +1,128 @@
+package merchant
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blindingSecret is the gateway secret MAC addresses are blinded with on public relays,
+// persisted so blinded MACs stay stable across restarts until the secret rotates
+type blindingSecret struct {
+	mu    sync.Mutex
+	path  string
+	store blindingSecretStore
+}
+
+// blindingSecretStore is the content of the blinding secret file
+type blindingSecretStore struct {
+	Secret    string `json:"secret"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func newBlindingSecret(path string) *blindingSecret {
+	s := &blindingSecret{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read blinding secret %s: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.store); err != nil {
+		log.Printf("Warning: failed to parse blinding secret %s, starting a new one: %v", path, err)
+		s.store = blindingSecretStore{}
+	}
+	return s
+}
+
+// current returns the secret, replacing it with a new one once it is older than rotation
+func (s *blindingSecret) current(rotation time.Duration) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := rotation > 0 && time.Since(time.Unix(s.store.CreatedAt, 0)) > rotation
+	if s.store.Secret == "" || expired {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate blinding secret: %w", err)
+		}
+		s.store = blindingSecretStore{Secret: hex.EncodeToString(secret), CreatedAt: time.Now().Unix()}
+
+		data, err := json.Marshal(s.store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode blinding secret: %w", err)
+		}
+		if err := os.WriteFile(s.path, data, 0600); err != nil {
+			log.Printf("Warning: failed to save blinding secret %s: %v", s.path, err)
+		}
+		log.Printf("Rotated the secret blinding MAC addresses on public relays")
+	}
+
+	return hex.DecodeString(s.store.Secret)
+}
+
+// blindMAC returns the HMAC of a MAC address under the secret, the same for any spelling of the address
+func blindMAC(secret []byte, macAddress string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToLower(macAddress)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// blindEvent returns a copy of an event for public relays with MAC addresses blinded and customer pubkeys
+// left out, signed by the merchant. Events of other kinds than sessions, notices and usage reports are returned
+// unchanged.
+func (m *Merchant) blindEvent(event nostr.Event) (nostr.Event, error) {
+	eventType := eventTypeFor(m.getConfig(), event.Kind)
+	if eventType != eventTypeSession && eventType != eventTypeNotice && eventType != eventTypeUsage {
+		return event, nil
+	}
+
+	rotation := time.Duration(m.getConfig().Privacy.SecretRotationHours) * time.Hour
+	secret, err := m.blindingSecret.current(rotation)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	blinded := event
+	blinded.Tags = make(nostr.Tags, 0, len(event.Tags))
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			blinded.Tags = append(blinded.Tags, tag)
+			continue
+		}
+		switch {
+		case tag[0] == "p" || tag[0] == "gift-from":
+			continue
+		case tag[0] == "device-identifier" && len(tag) >= 3 && tag[1] == "mac":
+			blinded.Tags = append(blinded.Tags, nostr.Tag{"device-identifier", "mac-hmac", blindMAC(secret, tag[2])})
+		case tag[0] == "gift":
+			blinded.Tags = append(blinded.Tags, nostr.Tag{"gift", blindMAC(secret, tag[1])})
+		default:
+			blinded.Tags = append(blinded.Tags, tag)
+		}
+	}
+
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nostr.Event{}, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("merchant identity not found: %w", err)
+	}
+	if err := blinded.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to sign blinded event: %w", err)
+	}
+	return blinded, nil
+}
@@ -0,0 +1,143 @@
+package merchant
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Pubkey sessions let a customer pay once for a phone and a laptop. The payments of a pubkey go to one session,
+// led by the device that paid first. The other devices named in device-identifier tags of the payments share it,
+// up to the configured number of devices. They are session groups indexed by pubkey instead of found by code.
+
+// extractExtraDevices returns the MAC addresses of the device-identifier tags after the first, which names the
+// paying device
+func extractExtraDevices(paymentEvent nostr.Event) []string {
+	var devices []string
+	first := true
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) < 3 || tag[0] != "device-identifier" {
+			continue
+		}
+		if first {
+			first = false
+			continue
+		}
+		devices = append(devices, tag[2])
+	}
+	return devices
+}
+
+// checkExtraDevices validates the devices a payment names besides the paying one, before it is redeemed
+func (m *Merchant) checkExtraDevices(payerMAC string, devices []string) error {
+	config := m.getConfig().PubkeySessions
+	if !config.Enabled {
+		return fmt.Errorf("this TollGate does not offer sessions shared by several devices")
+	}
+	if config.MaxDevices > 0 && len(devices)+1 > config.MaxDevices {
+		return fmt.Errorf("sessions are limited to %d devices", config.MaxDevices)
+	}
+	for _, device := range devices {
+		if !utils.ValidateMACAddress(device) {
+			return fmt.Errorf("invalid MAC address: %s", device)
+		}
+		if utils.NormalizeMAC(device) == utils.NormalizeMAC(payerMAC) {
+			return fmt.Errorf("device %s is the paying device", device)
+		}
+	}
+	return nil
+}
+
+// pubkeySessionPool returns the MAC address whose session the payments of a customer go to
+func (m *Merchant) pubkeySessionPool(pubkey, macAddress string) string {
+	if !m.getConfig().PubkeySessions.Enabled {
+		return macAddress
+	}
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+	if group, exists := m.groups.byPubkey[pubkey]; exists {
+		return group.primary
+	}
+	return macAddress
+}
+
+// joinPubkeySession adds the paying and extra devices to the session of a customer, creating it with the paying
+// device leading. It refuses devices sharing another session or holding their own, and more devices than the
+// config allows, before anything is added. It returns the MAC address holding the session. Called with sessionMu
+// held.
+func (m *Merchant) joinPubkeySession(pubkey, macAddress string, extraDevices []string) (string, error) {
+	maxDevices := m.getConfig().PubkeySessions.MaxDevices
+
+	group, exists := m.groups.byPubkey[pubkey]
+	if !exists {
+		if _, isMember := m.groups.byMember[macAddress]; isMember {
+			return "", fmt.Errorf("device %s already shares another session", macAddress)
+		}
+		group = m.groups.byPrimary[macAddress] // A group bought with a group tag becomes the customer's session
+	}
+	primary := macAddress
+	members := 0
+	if group != nil {
+		primary = group.primary
+		members = len(group.members)
+	}
+
+	var joining []string
+	for _, device := range append([]string{macAddress}, extraDevices...) {
+		if device == primary || (group != nil && group.members[device]) || slices.Contains(joining, device) {
+			continue
+		}
+		if _, isMember := m.groups.byMember[device]; isMember {
+			return "", fmt.Errorf("device %s already shares another session", device)
+		}
+		if _, leads := m.groups.byPrimary[device]; leads {
+			return "", fmt.Errorf("device %s already leads a shared session", device)
+		}
+		if own, exists := m.customerSessions[device]; exists && isCustomerSessionActive(own) {
+			return "", fmt.Errorf("device %s has a session of its own", device)
+		}
+		joining = append(joining, device)
+	}
+	if maxDevices > 0 && 1+members+len(joining) > maxDevices {
+		return "", fmt.Errorf("sessions are limited to %d devices, %d would share this one", maxDevices, 1+members+len(joining))
+	}
+
+	if group == nil {
+		code, err := newGroupCode()
+		if err != nil {
+			return "", err
+		}
+		group = &sessionGroup{
+			code:    code,
+			primary: primary,
+			members: make(map[string]bool),
+		}
+		m.groups.byCode[code] = group
+		m.groups.byPrimary[primary] = group
+	}
+	group.pubkey = pubkey
+	if maxDevices > 0 {
+		group.maxMembers = max(group.maxMembers, maxDevices-1)
+	}
+	m.groups.byPubkey[pubkey] = group
+	for _, device := range joining {
+		group.members[device] = true
+		m.groups.byMember[device] = group
+	}
+	return group.primary, nil
+}
+
+// sharedDeviceTags lists the devices sharing the session held by pool, for the session event
+func (m *Merchant) sharedDeviceTags(pool string) []nostr.Tag {
+	members := m.groupMembers(pool)
+	if len(members) == 0 {
+		return nil
+	}
+	tags := []nostr.Tag{{"shared-device", pool}}
+	for _, member := range members {
+		tags = append(tags, nostr.Tag{"shared-device", member})
+	}
+	return tags
+}
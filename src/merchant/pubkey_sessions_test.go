@@ -0,0 +1,52 @@
+package merchant
+
+import (
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+func TestPubkeySessionDeviceLimit(t *testing.T) {
+	m := newTestMerchant(t)
+	err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.PubkeySessions = config_manager.PubkeySessionsConfig{Enabled: true, MaxDevices: 3}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	phone, laptop, tablet, tv := "00:11:22:33:44:01", "00:11:22:33:44:02", "00:11:22:33:44:03", "00:11:22:33:44:04"
+	session, err := m.addAllotment(phone, "customer", []string{laptop}, "milliseconds", 60000)
+	if err != nil {
+		t.Fatalf("addAllotment() failed: %v", err)
+	}
+	if session.MacAddress != phone {
+		t.Errorf("session held by %s, want the paying device %s", session.MacAddress, phone)
+	}
+
+	// A payment from the laptop tops up the session of the phone
+	session, err = m.addAllotment(laptop, "customer", nil, "milliseconds", 60000)
+	if err != nil {
+		t.Fatalf("addAllotment() from a sharing device failed: %v", err)
+	}
+	if session.MacAddress != phone || session.Allotment != 120000 {
+		t.Errorf("session = %s with %d ms, want %s with 120000 ms", session.MacAddress, session.Allotment, phone)
+	}
+
+	// The fourth device is over the limit, nothing is added
+	if _, err := m.addAllotment(phone, "customer", []string{tablet, tv}, "milliseconds", 60000); err == nil {
+		t.Errorf("addAllotment() let 4 devices share a session limited to 3")
+	}
+	if session, _ := m.GetSession(phone); session.Allotment != 120000 {
+		t.Errorf("refused payment added allotment, session has %d ms", session.Allotment)
+	}
+	if _, err := m.addAllotment(tablet, "customer", nil, "milliseconds", 60000); err != nil {
+		t.Errorf("addAllotment() refused the third device: %v", err)
+	}
+
+	// Other customers' devices can't be pulled into the session
+	if _, err := m.addAllotment(tv, "other", []string{laptop}, "milliseconds", 60000); err == nil {
+		t.Errorf("addAllotment() added a device sharing another customer's session")
+	}
+}
@@ -0,0 +1,275 @@
+package merchant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Defaults for publishing when the config leaves them at 0
+const (
+	defaultPublishTimeout = 10 * time.Second
+	publishRetryDelay     = time.Second
+)
+
+// Event types routed by the publishing config
+const (
+	eventTypeSession       = "session"
+	eventTypeNotice        = "notice"
+	eventTypeDM            = "dm"
+	eventTypeAdvertisement = "advertisement"
+	eventTypeStatus        = "status"
+	eventTypeFeedback      = "feedback"
+	eventTypeUsage         = "usage"
+	eventTypeHistory       = "history"
+)
+
+// Publisher delivers events to relays. Where an event goes and how hard delivery is tried depends on its type.
+type Publisher interface {
+	Publish(event *nostr.Event) error
+}
+
+// relayPublisher publishes to the local relay and the public relays, leaving retries of
+// events that must reach every public relay to the outbox
+type relayPublisher struct {
+	config        func() *config_manager.Config
+	publishLocal  func(ctx context.Context, event nostr.Event) error
+	publishRelay  func(ctx context.Context, relayURL string, event nostr.Event) error
+	directMessage func(recipientPubkey, message string) (*nostr.Event, error)
+	blind         func(event nostr.Event) (nostr.Event, error)
+	outbox        *outbox
+}
+
+// newRelayPublisher creates the publisher of a merchant, its outbox must be set up already
+func newRelayPublisher(m *Merchant) *relayPublisher {
+	return &relayPublisher{
+		config:        m.getConfig,
+		publishLocal:  m.configManager.PublishToLocalPoolContext,
+		publishRelay:  m.publishToRelay,
+		directMessage: m.createDirectMessage,
+		blind:         m.blindEvent,
+		outbox:        m.outbox,
+	}
+}
+
+// eventTypeOf returns the type an event kind is routed as
+func eventTypeOf(kind int) string {
+	switch kind {
+	case 1022:
+		return eventTypeSession
+	case KindNotice:
+		return eventTypeNotice
+	case nostr.KindEncryptedDirectMessage:
+		return eventTypeDM
+	case 10021:
+		return eventTypeAdvertisement
+	case KindOperatorStatus:
+		return eventTypeStatus
+	case KindFeedback:
+		return eventTypeFeedback
+	case KindUsageReport:
+		return eventTypeUsage
+	case KindGatewayHistory:
+		return eventTypeHistory
+	}
+	return ""
+}
+
+// eventTypeFor returns the type an event kind is routed as, including the kinds notices are mirrored as
+func eventTypeFor(config *config_manager.Config, kind int) string {
+	if isNoticeMirrorKind(config, kind) {
+		return eventTypeNotice
+	}
+	return eventTypeOf(kind)
+}
+
+// defaultPublishRoutes apply to event types the config has no route for, e.g. configs from before routes existed
+var defaultPublishRoutes = config_manager.NewDefaultConfig().Publishing.Routes
+
+// publishRoute returns the route of an event type. Unknown types only go to the local relay.
+func publishRoute(config *config_manager.Config, eventType string) config_manager.PublishRouteConfig {
+	if route, exists := config.Publishing.Routes[eventType]; exists {
+		return route
+	}
+	if route, exists := defaultPublishRoutes[eventType]; exists {
+		return route
+	}
+	return config_manager.PublishRouteConfig{Local: true, Policy: config_manager.DeliveryBestEffort}
+}
+
+// publishTimeout returns how long a single attempt to publish to a relay may take
+func publishTimeout(config *config_manager.Config) time.Duration {
+	if config.Publishing.TimeoutSeconds <= 0 {
+		return defaultPublishTimeout
+	}
+	return time.Duration(config.Publishing.TimeoutSeconds) * time.Second
+}
+
+// Publish delivers an event along the route of its type
+func (p *relayPublisher) Publish(event *nostr.Event) error {
+	config := p.config()
+	if config == nil {
+		return fmt.Errorf("main config is nil")
+	}
+	eventType := eventTypeFor(config, event.Kind)
+	route := publishRoute(config, eventType)
+
+	var errs []error
+	if route.Local {
+		if err := p.deliverLocal(config, route.Policy, *event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if route.Public {
+		publicEvent, err := p.publicCopy(config, *event)
+		if err == nil {
+			err = p.deliverPublic(config, route.Policy, publicEvent)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if route.DM && eventType != eventTypeDM {
+		if err := p.deliverDM(config, route.Policy, *event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publicCopy returns the event as it may appear on public relays. In privacy mode session metadata is blinded,
+// an event that can't be blinded isn't published publicly at all.
+func (p *relayPublisher) publicCopy(config *config_manager.Config, event nostr.Event) (nostr.Event, error) {
+	if !config.Privacy.Enabled {
+		return event, nil
+	}
+	blinded, err := p.blind(event)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to blind event %s for public relays: %w", event.ID, err)
+	}
+	return blinded, nil
+}
+
+// deliverLocal publishes to the local relay, retrying unless the policy is best-effort
+func (p *relayPublisher) deliverLocal(config *config_manager.Config, policy string, event nostr.Event) error {
+	attempts := 1
+	if policy != config_manager.DeliveryBestEffort {
+		attempts += config.Publishing.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(publishRetryDelay << (attempt - 1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout(config))
+		err = p.publishLocal(ctx, event)
+		cancel()
+		if err == nil {
+			log.Printf("Published event kind=%d id=%s to local relay", event.Kind, event.ID)
+			return nil
+		}
+	}
+	log.Printf("Failed to publish event kind=%d id=%s to local relay: %v", event.Kind, event.ID, err)
+	return fmt.Errorf("local relay: %w", err)
+}
+
+// deliverPublic publishes to the public relays according to the delivery policy
+func (p *relayPublisher) deliverPublic(config *config_manager.Config, policy string, event nostr.Event) error {
+	if len(config.Relays) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case config_manager.DeliveryBestEffort:
+		if accepted := p.publishToRelays(config, config.Relays, event); accepted == 0 {
+			return fmt.Errorf("no public relay accepted event %s", event.ID)
+		}
+		return nil
+
+	case config_manager.DeliveryAnyRelay:
+		for attempt := 0; attempt <= config.Publishing.Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(publishRetryDelay << (attempt - 1))
+			}
+			if accepted := p.publishToRelays(config, config.Relays, event); accepted > 0 {
+				return nil
+			}
+		}
+		log.Printf("No public relay accepted event kind=%d id=%s, queuing it in the outbox", event.Kind, event.ID)
+		p.outbox.enqueue(event, config.Relays)
+		return nil
+
+	default:
+		log.Printf("Queuing event kind=%d id=%s for public relays", event.Kind, event.ID)
+		p.outbox.enqueue(event, config.Relays)
+		return nil
+	}
+}
+
+// deliverDM sends a copy of the event to its tagged recipient as encrypted direct message on the public relays
+func (p *relayPublisher) deliverDM(config *config_manager.Config, policy string, event nostr.Event) error {
+	recipient := ""
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			recipient = tag[1]
+			break
+		}
+	}
+	if recipient == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event %s for direct message: %w", event.ID, err)
+	}
+	dmEvent, err := p.directMessage(recipient, string(content))
+	if err != nil {
+		return fmt.Errorf("failed to create direct message for event %s: %w", event.ID, err)
+	}
+	return p.deliverPublic(config, policy, *dmEvent)
+}
+
+// publishToRelays publishes to relays in parallel and returns how many accepted the event
+func (p *relayPublisher) publishToRelays(config *config_manager.Config, relays []string, event nostr.Event) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, relayURL := range relays {
+		wg.Add(1)
+		go func(relayURL string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), publishTimeout(config))
+			defer cancel()
+			if err := p.publishRelay(ctx, relayURL, event); err != nil {
+				log.Printf("Failed to publish event %s to %s: %v", event.ID, relayURL, err)
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+		}(relayURL)
+	}
+	wg.Wait()
+	return accepted
+}
+
+// publishAdvertisement announces the current advertisement along its route
+func (m *Merchant) publishAdvertisement() {
+	var advertisement nostr.Event
+	if err := json.Unmarshal([]byte(m.GetAdvertisement()), &advertisement); err != nil {
+		log.Printf("Warning: failed to parse advertisement for publishing: %v", err)
+		return
+	}
+	if err := m.publisher.Publish(&advertisement); err != nil {
+		log.Printf("Warning: failed to publish advertisement: %v", err)
+	}
+}
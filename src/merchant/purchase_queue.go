@@ -0,0 +1,165 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Default limits of the purchase queue
+const (
+	defaultMaxConcurrentPurchases = 4
+	defaultPurchaseQueueDepth     = 32
+	defaultPurchaseQueueWait      = 10 * time.Second
+)
+
+// PurchaseQueueMetrics reports the load of the purchase queue
+type PurchaseQueueMetrics struct {
+	Waiting       int    `json:"waiting"`
+	Active        int    `json:"active"`
+	Completed     uint64 `json:"completed"`
+	Rejected      uint64 `json:"rejected"` // Purchases answered with a busy notice
+	AvgWaitMs     int64  `json:"avg_wait_ms"`
+	MaxWaitMs     int64  `json:"max_wait_ms"`
+	AvgPurchaseMs int64  `json:"avg_purchase_ms"` // Time from leaving the queue to answering the purchase
+}
+
+// purchaseQueue bounds the purchases worked on at once, so a burst of payments queues up to a depth
+// and the rest is told to come back later instead of piling up against the mint and the valve
+type purchaseQueue struct {
+	mu            sync.Mutex
+	slots         chan struct{}
+	maxDepth      int
+	maxWait       time.Duration
+	metrics       PurchaseQueueMetrics
+	totalWait     time.Duration
+	totalPurchase time.Duration
+}
+
+func newPurchaseQueue(config config_manager.PurchaseQueueConfig) *purchaseQueue {
+	q := &purchaseQueue{}
+	q.setLimits(config)
+	return q
+}
+
+// setLimits replaces the limits. Running purchases finish under the limits they started with.
+func (q *purchaseQueue) setLimits(config config_manager.PurchaseQueueConfig) {
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentPurchases
+	}
+	maxDepth := config.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultPurchaseQueueDepth
+	}
+	maxWait := time.Duration(config.MaxWaitSeconds) * time.Second
+	if maxWait <= 0 {
+		maxWait = defaultPurchaseQueueWait
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.slots == nil || cap(q.slots) != maxConcurrent {
+		q.slots = make(chan struct{}, maxConcurrent)
+	}
+	q.maxDepth = maxDepth
+	q.maxWait = maxWait
+}
+
+// admit waits for a free slot and returns the function releasing it. A purchase finding the queue full,
+// or waiting longer than the max wait, is turned away with an estimate of when to retry.
+func (q *purchaseQueue) admit() (func(), time.Duration, bool) {
+	q.mu.Lock()
+	slots, maxWait := q.slots, q.maxWait
+	if q.metrics.Waiting >= q.maxDepth {
+		q.metrics.Rejected++
+		retryAfter := q.retryAfter()
+		q.mu.Unlock()
+		return nil, retryAfter, false
+	}
+	q.metrics.Waiting++
+	q.mu.Unlock()
+
+	start := time.Now()
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+
+	select {
+	case slots <- struct{}{}:
+	case <-timeout.C:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.metrics.Waiting--
+		q.metrics.Rejected++
+		return nil, q.retryAfter(), false
+	}
+
+	wait := time.Since(start)
+	q.mu.Lock()
+	q.metrics.Waiting--
+	q.metrics.Active++
+	q.totalWait += wait
+	if wait.Milliseconds() > q.metrics.MaxWaitMs {
+		q.metrics.MaxWaitMs = wait.Milliseconds()
+	}
+	q.mu.Unlock()
+
+	admitted := time.Now()
+	return func() {
+		<-slots
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.metrics.Active--
+		q.metrics.Completed++
+		q.totalPurchase += time.Since(admitted)
+	}, 0, true
+}
+
+// retryAfter estimates how long the purchases ahead take to get through, at least a second.
+// Must be called with the lock held.
+func (q *purchaseQueue) retryAfter() time.Duration {
+	perPurchase := time.Second
+	if q.metrics.Completed > 0 {
+		perPurchase = q.totalPurchase / time.Duration(q.metrics.Completed)
+	}
+	ahead := q.metrics.Waiting + q.metrics.Active
+	estimate := perPurchase * time.Duration(ahead) / time.Duration(cap(q.slots))
+	if estimate < time.Second {
+		return time.Second
+	}
+	return estimate.Round(time.Second)
+}
+
+// snapshot returns the current queue metrics
+func (q *purchaseQueue) snapshot() PurchaseQueueMetrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	metrics := q.metrics
+	if started := metrics.Completed + uint64(metrics.Active); started > 0 {
+		metrics.AvgWaitMs = q.totalWait.Milliseconds() / int64(started)
+	}
+	if metrics.Completed > 0 {
+		metrics.AvgPurchaseMs = q.totalPurchase.Milliseconds() / int64(metrics.Completed)
+	}
+	return metrics
+}
+
+// busyNotice turns away a purchase the queue has no room for, telling the customer when to retry
+func (m *Merchant) busyNotice(customerPubkey string, retryAfter time.Duration) (*nostr.Event, error) {
+	seconds := int(retryAfter.Seconds())
+	log.Printf("Purchase queue is full, asking %s to retry in %d seconds", customerPubkey, seconds)
+
+	noticeEvent, err := m.createNoticeEventWithTags("error", "busy",
+		fmt.Sprintf("Gateway is busy, retry in %d seconds", seconds), customerPubkey,
+		nostr.Tag{"retry-after", fmt.Sprintf("%d", seconds)})
+	if err != nil {
+		return nil, fmt.Errorf("purchase queue full and failed to create notice: %w", err)
+	}
+	return noticeEvent, nil
+}
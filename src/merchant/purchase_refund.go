@@ -0,0 +1,55 @@
+package merchant
+
+import (
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// refundFailedPurchase answers a purchase that failed after its payment was redeemed with an error notice
+// returning the payment as change, so failed purchases are not kept. If the wallet can't create the change
+// token, the notice sends the customer to staff and the failure is counted in operator status events.
+func (m *Merchant) refundFailedPurchase(paymentEvent nostr.Event, macAddress, mintURL string, amount uint64,
+	code, message string, tags ...nostr.Tag) (*nostr.Event, error) {
+	if amount == 0 {
+		return m.createNoticeEventWithTags("error", code, message, paymentEvent.PubKey, tags...)
+	}
+
+	changeToken, err := m.CreatePaymentToken(mintURL, amount)
+	if err != nil {
+		m.errorCounters.add("refund-failed")
+		log.Printf("ERROR: Failed to refund %d sats of failed purchase %s to %s: %v", amount, paymentEvent.ID, paymentEvent.PubKey, err)
+		return m.createNoticeEventWithTags("error", code, message+", and the payment could not be returned, please ask staff",
+			paymentEvent.PubKey, tags...)
+	}
+
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerRefund,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		MintURL:    mintURL,
+		Amount:     amount,
+		EventID:    paymentEvent.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record refund to %s: %v", macAddress, err)
+	}
+	log.Printf("Refunded %d sats of failed purchase %s to %s", amount, paymentEvent.ID, paymentEvent.PubKey)
+
+	return m.createNoticeEventWithTags("error", code, message+", payment returned as change",
+		paymentEvent.PubKey, append(tags, nostr.Tag{"change", changeToken})...)
+}
+
+// withdrawAllotment takes back allotment credited by a purchase that failed before its gate opened
+func (m *Merchant) withdrawAllotment(macAddress string, allotment uint64) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	session, exists := m.customerSessions[macAddress]
+	if !exists {
+		return
+	}
+	session.Allotment -= min(allotment, session.Allotment)
+	if session.Purchases > 0 {
+		session.Purchases--
+	}
+}
@@ -0,0 +1,189 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindSessionAttestation is signed by the customer who paid for a session on a randomized MAC address,
+// keeping its gate open or moving the session to the address the device connects with now
+const KindSessionAttestation = 21032
+
+const (
+	// defaultAttestationInterval applies when the bind policy has no interval configured
+	defaultAttestationInterval = 15 * time.Minute
+	// attestationCheckInterval is how often gates of bound sessions are checked for a lapsed attestation
+	attestationCheckInterval = 30 * time.Second
+	// maxAttestationAge bounds how old an attestation event may be, so a captured one can't be replayed later
+	maxAttestationAge = 5 * time.Minute
+)
+
+// attestationInterval returns how long the gate of a bound session stays open without an attestation,
+// 0 unless the bind policy is configured
+func attestationInterval(config config_manager.RandomizedMACConfig) time.Duration {
+	if config.Policy != config_manager.RandomizedMACBind {
+		return 0
+	}
+	if config.AttestationIntervalSeconds == 0 {
+		return defaultAttestationInterval
+	}
+	return time.Duration(config.AttestationIntervalSeconds) * time.Second
+}
+
+// randomizedMACTag advertises how randomized MAC addresses are served, nil if like any other device
+func randomizedMACTag(config config_manager.RandomizedMACConfig) nostr.Tag {
+	switch config.Policy {
+	case config_manager.RandomizedMACBind:
+		return nostr.Tag{"randomized_mac", config.Policy, fmt.Sprintf("%d", int64(attestationInterval(config).Seconds()))}
+	case config_manager.RandomizedMACRefuse:
+		return nostr.Tag{"randomized_mac", config.Policy}
+	}
+	return nil
+}
+
+// refusesRandomizedMAC reports whether the device is turned away for its randomized MAC address
+func (m *Merchant) refusesRandomizedMAC(macAddress string) bool {
+	return m.getConfig().RandomizedMACs.Policy == config_manager.RandomizedMACRefuse && utils.IsRandomizedMAC(macAddress)
+}
+
+// bindRandomizedSession binds the session of a randomized MAC address to the pubkey that paid for it
+// and returns the tag telling the customer when to attest next, nil if the session isn't bound
+func (m *Merchant) bindRandomizedSession(macAddress string) []nostr.Tag {
+	interval := attestationInterval(m.getConfig().RandomizedMACs)
+	if interval == 0 || !utils.IsRandomizedMAC(macAddress) {
+		return nil
+	}
+
+	m.sessionMu.Lock()
+	m.attestations[macAddress] = time.Now().Unix()
+	m.sessionMu.Unlock()
+	return []nostr.Tag{{"attest-within", fmt.Sprintf("%d", int64(interval.Seconds()))}}
+}
+
+// AttestSession keeps the gate of a session bound to the customer's pubkey open. A device that came back
+// with a new randomized MAC address takes its session along, the gate of the old address is closed.
+func (m *Merchant) AttestSession(attestEvent nostr.Event) (*nostr.Event, error) {
+	interval := attestationInterval(m.getConfig().RandomizedMACs)
+	if interval == 0 {
+		return m.CreateNoticeEvent("error", "attestation-not-required",
+			"This TollGate does not bind sessions to pubkeys", attestEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(attestEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), attestEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), attestEvent.PubKey)
+	}
+	if age := time.Since(attestEvent.CreatedAt.Time()); age > maxAttestationAge || age < -maxAttestationAge {
+		return m.CreateNoticeEvent("error", "attestation-expired",
+			"Attestation is too old, sign a new one with the current time", attestEvent.PubKey)
+	}
+
+	session, previous, err := m.attest(macAddress, attestEvent.PubKey)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "attestation-failed", fmt.Sprintf("Cannot attest session: %v", err), attestEvent.PubKey)
+	}
+	if previous != "" {
+		if _, err := valve.CloseGate(previous); err != nil {
+			log.Printf("Warning: failed to close gate of %s after its session moved: %v", previous, err)
+		}
+		log.Printf("Moved session bound to %s from %s to %s", attestEvent.PubKey, previous, macAddress)
+	}
+
+	// Reopens a gate closed for a lapsed attestation, or extends the open one
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(&session), session.Tier); err != nil {
+		return m.CreateNoticeEvent("error", "gate-opening-failed",
+			fmt.Sprintf("Failed to open gate for session: %v", err), attestEvent.PubKey)
+	}
+
+	return m.createSessionEvent(&session, attestEvent.PubKey,
+		nostr.Tag{"attest-within", fmt.Sprintf("%d", int64(interval.Seconds()))})
+}
+
+// attest records an attestation of the session bound to a pubkey from the device's current MAC address.
+// It returns a copy of the session and, if the session moved, the address it was bound to before.
+func (m *Merchant) attest(macAddress, pubkey string) (CustomerSession, string, error) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	now := time.Now().Unix()
+	if session, exists := m.customerSessions[macAddress]; exists && isCustomerSessionActive(session) {
+		if session.Pubkey != pubkey {
+			return CustomerSession{}, "", fmt.Errorf("device has a session paid by another pubkey")
+		}
+		if _, bound := m.attestations[macAddress]; !bound {
+			return CustomerSession{}, "", fmt.Errorf("session of %s is not bound to a pubkey", macAddress)
+		}
+		m.attestations[macAddress] = now
+		return *session, "", nil
+	}
+
+	for previous := range m.attestations {
+		session, exists := m.customerSessions[previous]
+		if !exists || !isCustomerSessionActive(session) || session.Pubkey != pubkey {
+			continue
+		}
+		if _, leads := m.groups.byPrimary[previous]; leads {
+			return CustomerSession{}, "", fmt.Errorf("sessions shared with a group stay on their device")
+		}
+
+		delete(m.customerSessions, previous)
+		delete(m.attestations, previous)
+		delete(m.dataQuota.counters, previous)
+		delete(m.dataQuota.throttles, previous)
+		session.MacAddress = macAddress
+		m.customerSessions[macAddress] = session
+		m.attestations[macAddress] = now
+		return *session, previous, nil
+	}
+	return CustomerSession{}, "", fmt.Errorf("no active session is bound to this pubkey")
+}
+
+// enforceAttestations periodically closes the gates of bound sessions whose customer stopped attesting.
+// The session is kept, an attestation from the device reopens its gate.
+func (m *Merchant) enforceAttestations() {
+	for {
+		time.Sleep(attestationCheckInterval)
+		m.enforceAttestationsOnce()
+	}
+}
+
+func (m *Merchant) enforceAttestationsOnce() {
+	interval := attestationInterval(m.getConfig().RandomizedMACs)
+	now := time.Now().Unix()
+
+	var lapsed []string
+	m.sessionMu.Lock()
+	for macAddress, attestedAt := range m.attestations {
+		session, exists := m.customerSessions[macAddress]
+		if !exists || !isCustomerSessionActive(session) {
+			delete(m.attestations, macAddress)
+			continue
+		}
+		if interval > 0 && now-attestedAt > int64(interval.Seconds()) {
+			lapsed = append(lapsed, macAddress)
+		}
+	}
+	m.sessionMu.Unlock()
+
+	for _, macAddress := range lapsed {
+		closed, err := valve.CloseGate(macAddress)
+		if err != nil {
+			log.Printf("Warning: failed to close gate of %s with a lapsed attestation: %v", macAddress, err)
+			continue
+		}
+		if closed {
+			log.Printf("Closed gate of %s, its session was not attested within %s", macAddress, interval)
+		}
+	}
+}
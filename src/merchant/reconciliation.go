@@ -0,0 +1,133 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+)
+
+// reconciliationStartDelay gives the mints time to become reachable before the first reconciliation
+const reconciliationStartDelay = 10 * time.Minute
+
+// reconciliationState keeps reconciliations from overlapping and remembers the last report of each mint
+type reconciliationState struct {
+	mu      sync.Mutex
+	running bool
+	reports map[string]tollwallet.BalanceReconciliation
+}
+
+// ReconcileBalances compares the balance tracked for each accepted mint with the balance the mint confirms.
+// Drift beyond the tolerance is counted as "balance-drift" and sent to the owner in an operator status event.
+func (m *Merchant) ReconcileBalances() ([]tollwallet.BalanceReconciliation, error) {
+	m.reconciliation.mu.Lock()
+	if m.reconciliation.running {
+		m.reconciliation.mu.Unlock()
+		return nil, fmt.Errorf("another reconciliation is running")
+	}
+	m.reconciliation.running = true
+	m.reconciliation.mu.Unlock()
+
+	config := m.getConfig()
+	var reports []tollwallet.BalanceReconciliation
+	newDrift := false
+	for _, mint := range config.AcceptedMints {
+		report := m.tollwallet.Reconcile(mint.URL)
+		reports = append(reports, report)
+		if report.Error != "" {
+			log.Printf("Warning: failed to reconcile balance of %s: %s", mint.URL, report.Error)
+			continue
+		}
+		if !balanceDrifted(report, config.Wallet.ReconcileToleranceSats) {
+			continue
+		}
+
+		m.errorCounters.add("balance-drift")
+		log.Printf("Alert: balance of %s drifted by %d sats, tracked %d + %d held, mint confirms %d + %d held",
+			mint.URL, report.Drift, report.Tracked, report.HeldTracked, report.Restored, report.HeldUnspent)
+		m.reconciliation.mu.Lock()
+		if previous, exists := m.reconciliation.reports[mint.URL]; !exists || previous.Drift != report.Drift {
+			newDrift = true
+		}
+		m.reconciliation.mu.Unlock()
+	}
+
+	m.reconciliation.mu.Lock()
+	if m.reconciliation.reports == nil {
+		m.reconciliation.reports = make(map[string]tollwallet.BalanceReconciliation)
+	}
+	for _, report := range reports {
+		// A failed run keeps the last comparison, the drift it found hasn't gone away
+		if report.Error == "" || m.reconciliation.reports[report.MintURL].CheckedAt == 0 {
+			m.reconciliation.reports[report.MintURL] = report
+		}
+	}
+	m.reconciliation.running = false
+	m.reconciliation.mu.Unlock()
+
+	// The owner hears of new drift right away rather than with the next status report
+	if newDrift {
+		if ownerPubkey := m.ownerPubkey(); ownerPubkey != "" {
+			statusEvent, err := m.createOperatorStatusEvent(ownerPubkey)
+			if err != nil {
+				log.Printf("Failed to create operator status for balance drift: %v", err)
+			} else {
+				m.publisher.Publish(statusEvent)
+			}
+		}
+	}
+	return reports, nil
+}
+
+// balanceDrifted reports whether a reconciliation found the balance off by more than the tolerance
+func balanceDrifted(report tollwallet.BalanceReconciliation, toleranceSats uint64) bool {
+	drift := report.Drift
+	if drift < 0 {
+		drift = -drift
+	}
+	return report.Error == "" && uint64(drift) > toleranceSats
+}
+
+// balanceDrift returns the last reconciliation of each mint whose balance drifted, for operator status events
+func (m *Merchant) balanceDrift() []tollwallet.BalanceReconciliation {
+	tolerance := m.getConfig().Wallet.ReconcileToleranceSats
+	m.reconciliation.mu.Lock()
+	defer m.reconciliation.mu.Unlock()
+
+	var drifted []tollwallet.BalanceReconciliation
+	for _, report := range m.reconciliation.reports {
+		if balanceDrifted(report, tolerance) {
+			drifted = append(drifted, report)
+		}
+	}
+	return drifted
+}
+
+// RepairBalance schedules a repair of the balance of a mint, applied when the gateway restarts
+func (m *Merchant) RepairBalance(mintURL string) error {
+	for _, mint := range m.getConfig().AcceptedMints {
+		if mint.URL == mintURL {
+			return m.tollwallet.ScheduleRepair(mintURL)
+		}
+	}
+	return fmt.Errorf("mint %s is not accepted", mintURL)
+}
+
+// reconcileBalancesPeriodically runs the balance reconciliation at the configured interval
+func (m *Merchant) reconcileBalancesPeriodically() {
+	time.Sleep(reconciliationStartDelay)
+	for {
+		interval := time.Duration(m.getConfig().Wallet.ReconcileIntervalHours) * time.Hour
+		if interval <= 0 {
+			// Disabled, check again later in case it is enabled
+			time.Sleep(time.Hour)
+			continue
+		}
+		if _, err := m.ReconcileBalances(); err != nil {
+			log.Printf("Skipping balance reconciliation: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
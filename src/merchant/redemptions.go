@@ -0,0 +1,74 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// redemptionRegistry persists the IDs of signed events redeemed on this gateway until they expire, such as session
+// proofs and zap receipts, so each is credited once even across restarts
+type redemptionRegistry struct {
+	mu       sync.Mutex
+	path     string
+	what     string           // What is redeemed, for errors and logs
+	redeemed map[string]int64 // Expiration by event ID
+}
+
+func newRedemptionRegistry(path, what string) *redemptionRegistry {
+	r := &redemptionRegistry{path: path, what: what, redeemed: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read redeemed %ss %s: %v", what, path, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.redeemed); err != nil {
+		log.Printf("Warning: failed to parse redeemed %ss %s: %v", what, path, err)
+		r.redeemed = make(map[string]int64)
+	}
+	return r
+}
+
+// redeem marks an event as redeemed until it expires, failing if it already was or the registry can't be saved.
+// Callers check that the ID matches the event, a signature doesn't cover it.
+func (r *redemptionRegistry) redeem(id string, expiresAt int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Expired events are rejected anyway, no need to remember them
+	now := time.Now().Unix()
+	for redeemedID, expiry := range r.redeemed {
+		if expiry < now {
+			delete(r.redeemed, redeemedID)
+		}
+	}
+
+	if _, redeemed := r.redeemed[id]; redeemed {
+		return fmt.Errorf("%s was already redeemed", r.what)
+	}
+	r.redeemed[id] = expiresAt
+	if err := r.save(); err != nil {
+		delete(r.redeemed, id)
+		return err
+	}
+	return nil
+}
+
+// save writes the registry. Caller must hold mu.
+func (r *redemptionRegistry) save() error {
+	data, err := json.Marshal(r.redeemed)
+	if err != nil {
+		return fmt.Errorf("failed to encode redeemed %ss: %w", r.what, err)
+	}
+	if err := utils.WriteStateDurable(r.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save redeemed %ss: %w", r.what, err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package merchant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Customer feedback is a NIP-32 label event so relays store it and anyone can verify the summary
+const (
+	KindFeedback           = 1985
+	feedbackLabelNamespace = "tollgate/rating"
+	minRating              = 1
+	maxRating              = 5
+	// Customers can rate the gateway for this long after their last session ended
+	feedbackWindow = 30 * 24 * time.Hour
+)
+
+// feedbackEntry is the latest rating of a single customer
+type feedbackEntry struct {
+	EventID   string `json:"event_id"`
+	Rating    int    `json:"rating"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// reputationStore is persisted as JSON next to the config
+type reputationStore struct {
+	Customers map[string]int64         `json:"customers"` // Customer pubkey -> end of last session (unix)
+	Ratings   map[string]feedbackEntry `json:"ratings"`   // Customer pubkey -> latest rating
+}
+
+// reputation collects signed customer ratings and keeps feedback requests scheduled
+type reputation struct {
+	mu     sync.Mutex
+	path   string
+	store  reputationStore
+	timers map[string]*time.Timer
+}
+
+// newReputation loads the persisted ratings, starting empty if there are none
+func newReputation(path string) *reputation {
+	r := &reputation{
+		path: path,
+		store: reputationStore{
+			Customers: make(map[string]int64),
+			Ratings:   make(map[string]feedbackEntry),
+		},
+		timers: make(map[string]*time.Timer),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read reputation store %s: %v", path, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.store); err != nil {
+		log.Printf("Warning: failed to parse reputation store %s, starting empty: %v", path, err)
+		r.store = reputationStore{}
+	}
+	if r.store.Customers == nil {
+		r.store.Customers = make(map[string]int64)
+	}
+	if r.store.Ratings == nil {
+		r.store.Ratings = make(map[string]feedbackEntry)
+	}
+	return r
+}
+
+// save persists the store. Caller must hold mu.
+func (r *reputation) save() {
+	data, err := json.MarshalIndent(r.store, "", "  ")
+	if err != nil {
+		log.Printf("Warning: failed to encode reputation store: %v", err)
+		return
+	}
+	if err := utils.WriteState(r.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save reputation store %s: %v", r.path, err)
+	}
+}
+
+// pruneCustomers forgets customers whose feedback window has closed. Caller must hold mu.
+func (r *reputation) pruneCustomers() {
+	cutoff := time.Now().Add(-feedbackWindow).Unix()
+	for pubkey, sessionEnd := range r.store.Customers {
+		if sessionEnd < cutoff {
+			delete(r.store.Customers, pubkey)
+		}
+	}
+}
+
+// summaryTags returns the reputation tag for the advertisement: average rating, number of ratings and
+// a hash over the sorted feedback event IDs, so anyone can fetch the events and recompute the summary.
+// Returns no tags until the first rating arrives.
+func (r *reputation) summaryTags() nostr.Tags {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.store.Ratings) == 0 {
+		return nostr.Tags{}
+	}
+
+	eventIDs := make([]string, 0, len(r.store.Ratings))
+	total := 0
+	for _, entry := range r.store.Ratings {
+		eventIDs = append(eventIDs, entry.EventID)
+		total += entry.Rating
+	}
+	sort.Strings(eventIDs)
+	hash := sha256.Sum256([]byte(strings.Join(eventIDs, ",")))
+
+	average := float64(total) / float64(len(r.store.Ratings))
+	return nostr.Tags{{
+		"reputation",
+		strconv.FormatFloat(average, 'f', 2, 64),
+		strconv.Itoa(len(r.store.Ratings)),
+		hex.EncodeToString(hash[:]),
+	}}
+}
+
+// recordCustomerSession makes the customer eligible to rate the gateway and
+// schedules a feedback request for when their session ends
+func (m *Merchant) recordCustomerSession(customerPubkey string, endTimestamp int64) {
+	if customerPubkey == "" {
+		return
+	}
+
+	r := m.reputation
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneCustomers()
+	r.store.Customers[customerPubkey] = endTimestamp
+	r.save()
+
+	if timer, exists := r.timers[customerPubkey]; exists {
+		timer.Stop()
+	}
+	delay := time.Until(time.Unix(endTimestamp, 0))
+	r.timers[customerPubkey] = time.AfterFunc(delay, func() {
+		r.mu.Lock()
+		delete(r.timers, customerPubkey)
+		r.mu.Unlock()
+
+		m.requestFeedback(customerPubkey)
+	})
+}
+
+// requestFeedback asks a customer whose session ended to rate the gateway
+func (m *Merchant) requestFeedback(customerPubkey string) {
+	noticeEvent, err := m.CreateNoticeEvent("info", "feedback-request",
+		fmt.Sprintf("Your session has ended. Rate this TollGate from %d to %d with a kind %d label event (namespace %s)",
+			minRating, maxRating, KindFeedback, feedbackLabelNamespace), customerPubkey)
+	if err != nil {
+		log.Printf("Failed to create feedback request for %s: %v", customerPubkey, err)
+		return
+	}
+	m.publisher.Publish(noticeEvent)
+}
+
+// SubmitFeedback accepts a signed rating from a recent customer and returns a notice event
+func (m *Merchant) SubmitFeedback(feedbackEvent nostr.Event) (*nostr.Event, error) {
+	rating, err := extractRating(feedbackEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-feedback", err.Error(), feedbackEvent.PubKey)
+	}
+
+	r := m.reputation
+	r.mu.Lock()
+	r.pruneCustomers()
+	if _, isCustomer := r.store.Customers[feedbackEvent.PubKey]; !isCustomer {
+		r.mu.Unlock()
+		return m.CreateNoticeEvent("error", "feedback-not-eligible",
+			"Only customers with a recent session can rate this TollGate", feedbackEvent.PubKey)
+	}
+
+	// A customer's latest rating replaces earlier ones
+	r.store.Ratings[feedbackEvent.PubKey] = feedbackEntry{
+		EventID:   feedbackEvent.ID,
+		Rating:    rating,
+		CreatedAt: int64(feedbackEvent.CreatedAt),
+	}
+	r.save()
+	r.mu.Unlock()
+
+	log.Printf("Accepted rating %d from %s", rating, feedbackEvent.PubKey)
+
+	// Publish the signed feedback so discovery apps can verify the summary
+	m.publisher.Publish(&feedbackEvent)
+
+	if err := m.refreshAdvertisement(); err != nil {
+		log.Printf("Warning: failed to refresh advertisement after feedback: %v", err)
+	} else {
+		go m.publishAdvertisement()
+	}
+
+	return m.CreateNoticeEvent("info", "feedback-accepted", "Thank you for your feedback", feedbackEvent.PubKey)
+}
+
+// extractRating returns the rating of a NIP-32 label event in the TollGate rating namespace
+func extractRating(feedbackEvent nostr.Event) (int, error) {
+	for _, tag := range feedbackEvent.Tags {
+		if len(tag) >= 3 && tag[0] == "l" && tag[2] == feedbackLabelNamespace {
+			rating, err := strconv.Atoi(tag[1])
+			if err != nil || rating < minRating || rating > maxRating {
+				return 0, fmt.Errorf("rating must be a number from %d to %d", minRating, maxRating)
+			}
+			return rating, nil
+		}
+	}
+	return 0, fmt.Errorf("no %s label found in feedback event", feedbackLabelNamespace)
+}
@@ -0,0 +1,210 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event kinds of the two-phase purchase
+const (
+	KindReservationRequest = 21021 // Customer asks to lock prices and capacity
+	KindReservation        = 21022 // Merchant confirms the reservation
+)
+
+// defaultReservationTTL applies when no reservation TTL is configured
+const defaultReservationTTL = 5 * time.Minute
+
+// reservation locks the pricing of a config snapshot and a capacity slot for a device until it expires
+type reservation struct {
+	id         string
+	macAddress string
+	pubkey     string
+	expiresAt  time.Time
+	config     *config_manager.Config
+}
+
+// CreateReservation handles a reservation request and returns a reservation event or a notice event
+func (m *Merchant) CreateReservation(requestEvent nostr.Event) (*nostr.Event, error) {
+	macAddress, err := m.extractDeviceIdentifier(requestEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), requestEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), requestEvent.PubKey)
+	}
+
+	config := m.getConfig()
+
+	m.reservationsMu.Lock()
+	m.pruneReservations()
+
+	// A device holds at most one reservation, a new request replaces the old one
+	for id, existing := range m.reservations {
+		if existing.macAddress == macAddress {
+			delete(m.reservations, id)
+		}
+	}
+
+	if !m.hasCapacity(macAddress, config.Reservations.MaxConcurrentSessions) {
+		m.reservationsMu.Unlock()
+		return m.CreateNoticeEvent("error", "capacity-full",
+			"No capacity left for new sessions, try again later", requestEvent.PubKey)
+	}
+
+	ttl := time.Duration(config.Reservations.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = defaultReservationTTL
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		m.reservationsMu.Unlock()
+		return nil, fmt.Errorf("failed to generate reservation ID: %w", err)
+	}
+
+	res := &reservation{
+		id:         hex.EncodeToString(idBytes),
+		macAddress: macAddress,
+		pubkey:     requestEvent.PubKey,
+		expiresAt:  time.Now().Add(ttl),
+		config:     config,
+	}
+	m.reservations[res.id] = res
+	m.reservationsMu.Unlock()
+
+	log.Printf("Created reservation %s for %s until %s", res.id, macAddress, res.expiresAt.Format(time.RFC3339))
+
+	return m.createReservationEvent(res)
+}
+
+// lookupReservation returns the unexpired reservation with the given ID if it belongs to the device
+func (m *Merchant) lookupReservation(id, macAddress string) (*reservation, error) {
+	m.reservationsMu.Lock()
+	defer m.reservationsMu.Unlock()
+	m.pruneReservations()
+
+	res, exists := m.reservations[id]
+	if !exists {
+		return nil, fmt.Errorf("reservation %s not found or expired", id)
+	}
+	if res.macAddress != macAddress {
+		return nil, fmt.Errorf("reservation %s belongs to another device", id)
+	}
+	return res, nil
+}
+
+// releaseReservation frees the capacity held by a reservation
+func (m *Merchant) releaseReservation(id string) {
+	m.reservationsMu.Lock()
+	defer m.reservationsMu.Unlock()
+	delete(m.reservations, id)
+}
+
+// checkCapacity reports whether a device without a reservation may start a session
+func (m *Merchant) checkCapacity(macAddress string) bool {
+	m.reservationsMu.Lock()
+	defer m.reservationsMu.Unlock()
+	m.pruneReservations()
+	return m.hasCapacity(macAddress, m.getConfig().Reservations.MaxConcurrentSessions)
+}
+
+// hasCapacity reports whether there is room for the device next to active sessions and other devices'
+// reservations. Devices with an active session can always extend. Caller must hold reservationsMu.
+func (m *Merchant) hasCapacity(macAddress string, maxSessions int) bool {
+	if maxSessions <= 0 {
+		return true
+	}
+
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	if session, exists := m.customerSessions[macAddress]; exists && isCustomerSessionActive(session) {
+		return true
+	}
+
+	used := 0
+	for _, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			used++
+		}
+	}
+	for _, res := range m.reservations {
+		if res.macAddress != macAddress {
+			used++
+		}
+	}
+
+	return used < maxSessions
+}
+
+// pruneReservations drops expired reservations. Caller must hold reservationsMu.
+func (m *Merchant) pruneReservations() {
+	now := time.Now()
+	for id, res := range m.reservations {
+		if now.After(res.expiresAt) {
+			delete(m.reservations, id)
+		}
+	}
+}
+
+// extractReservationID extracts the reservation ID from a payment event, if any
+func extractReservationID(paymentEvent nostr.Event) string {
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "reservation" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// createReservationEvent creates a signed reservation event with the locked prices
+func (m *Merchant) createReservationEvent(res *reservation) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	tollgatePubkey, err := nostr.GetPublicKey(merchantIdentity.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	reservationEvent := &nostr.Event{
+		Kind:      KindReservation,
+		PubKey:    tollgatePubkey,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", res.pubkey},
+			{"reservation", res.id},
+			{"device-identifier", "mac", res.macAddress},
+			{"expiration", fmt.Sprintf("%d", res.expiresAt.Unix())},
+			{"metric", res.config.Metric},
+			{"step_size", fmt.Sprintf("%d", res.config.StepSize)},
+		},
+		Content: "",
+	}
+
+	for _, mint := range m.pricedMints(res.config) {
+		reservationEvent.Tags = append(reservationEvent.Tags, mintPriceTag(res.config, mint))
+	}
+
+	err = reservationEvent.Sign(merchantIdentity.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign reservation event: %w", err)
+	}
+
+	return reservationEvent, nil
+}
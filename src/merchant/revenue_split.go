@@ -0,0 +1,214 @@
+package merchant
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// revenueSplit tracks the revenue not yet paid out per mint and interface, persisted as JSON next to the wallet.
+// Only revenue from interfaces with their own profit share is tracked, the rest goes to the default profit share.
+type revenueSplit struct {
+	mu      sync.Mutex
+	path    string
+	revenue map[string]map[string]uint64 // Mint URL -> interface -> sats
+}
+
+func newRevenueSplit(path string) *revenueSplit {
+	r := &revenueSplit{
+		path:    path,
+		revenue: make(map[string]map[string]uint64),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read revenue split %s: %v", path, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.revenue); err != nil {
+		log.Printf("Warning: failed to parse revenue split %s: %v", path, err)
+		r.revenue = make(map[string]map[string]uint64)
+	}
+	return r
+}
+
+// save persists the tracked revenue. Caller must hold mu.
+func (r *revenueSplit) save() {
+	data, err := json.Marshal(r.revenue)
+	if err == nil {
+		err = utils.WriteState(r.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save revenue split %s: %v", r.path, err)
+	}
+}
+
+// add tracks revenue received through an interface
+func (r *revenueSplit) add(mintURL, iface string, amount uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.revenue[mintURL] == nil {
+		r.revenue[mintURL] = make(map[string]uint64)
+	}
+	r.revenue[mintURL][iface] += amount
+	r.save()
+}
+
+// get returns a copy of the revenue tracked for a mint
+func (r *revenueSplit) get(mintURL string) map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	revenue := make(map[string]uint64, len(r.revenue[mintURL]))
+	for iface, amount := range r.revenue[mintURL] {
+		revenue[iface] = amount
+	}
+	return revenue
+}
+
+// settle deducts revenue that was paid out
+func (r *revenueSplit) settle(mintURL string, paid map[string]uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for iface, amount := range paid {
+		if r.revenue[mintURL][iface] <= amount {
+			delete(r.revenue[mintURL], iface)
+		} else {
+			r.revenue[mintURL][iface] -= amount
+		}
+	}
+	if len(r.revenue[mintURL]) == 0 {
+		delete(r.revenue, mintURL)
+	}
+	r.save()
+}
+
+// clientInterface returns the interface a paying client is connected to, or "" when no
+// interface has its own profit share and looking it up is not worth the effort
+func (m *Merchant) clientInterface(macAddress string) string {
+	if len(m.getConfig().InterfaceProfitShare) == 0 {
+		return ""
+	}
+	iface, err := valve.ClientPort(macAddress)
+	if err != nil {
+		log.Printf("Warning: failed to determine interface of %s: %v", macAddress, err)
+		return ""
+	}
+	return iface
+}
+
+// recordRevenue tracks a payment for the profit share of the interface it came from
+func (m *Merchant) recordRevenue(mintURL, iface string, amount uint64) {
+	if _, overridden := m.getConfig().InterfaceProfitShare[iface]; !overridden || amount == 0 {
+		return
+	}
+	m.revenueSplit.add(mintURL, iface, amount)
+}
+
+// payoutShare is the amount paid out to a single identity
+type payoutShare struct {
+	identity string
+	amount   uint64
+}
+
+// splitPayout divides a payout between the profit shares of the interfaces revenue came from.
+// Each interface with its own profit share gets the revenue tracked for it, scaled down if the payout
+// is smaller, the default profit share gets the remainder. Also returns the revenue settled per interface.
+func splitPayout(config *config_manager.Config, revenue map[string]uint64, aimed uint64) ([]payoutShare, map[string]uint64) {
+	var tracked uint64
+	ifaces := make([]string, 0, len(revenue))
+	for iface, amount := range revenue {
+		// A profit share that pays no one leaves its revenue to the default profit share
+		if profitShare, overridden := config.InterfaceProfitShare[iface]; overridden && paysAnyone(profitShare) {
+			ifaces = append(ifaces, iface)
+			tracked += amount
+		}
+	}
+	sort.Strings(ifaces)
+
+	settled := make(map[string]uint64, len(ifaces))
+	var shares []payoutShare
+	remainder := aimed
+	for _, iface := range ifaces {
+		amount := revenue[iface]
+		if tracked > aimed {
+			amount = aimed * amount / tracked
+		}
+		settled[iface] = amount
+		remainder -= amount
+		shares = append(shares, profitShares(config.InterfaceProfitShare[iface], amount)...)
+	}
+
+	// The default profit share is paid first, as before interfaces had their own
+	return append(profitShares(config.ProfitShare, remainder), shares...), settled
+}
+
+// paysAnyone reports whether a profit share has a recipient with a positive factor
+func paysAnyone(profitShare []config_manager.ProfitShareConfig) bool {
+	for _, share := range profitShare {
+		if share.Factor > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// profitShares divides an amount by the factors of a profit share, weighed against their sum, so the shares
+// add up to the amount. Sats left over by rounding down go to the largest fractions. Recipients without
+// a positive factor get nothing.
+func profitShares(profitShare []config_manager.ProfitShareConfig, amount uint64) []payoutShare {
+	var totalFactor float64
+	for _, share := range profitShare {
+		if share.Factor > 0 {
+			totalFactor += share.Factor
+		}
+	}
+	if !paysAnyone(profitShare) {
+		return nil
+	}
+
+	amounts := make([]uint64, len(profitShare))
+	fractions := make([]float64, len(profitShare))
+	var distributed uint64
+	for i, share := range profitShare {
+		if share.Factor <= 0 {
+			continue
+		}
+		exact := float64(amount) * share.Factor / totalFactor
+		amounts[i] = min(uint64(math.Floor(exact)), amount-distributed)
+		fractions[i] = exact - math.Floor(exact)
+		distributed += amounts[i]
+	}
+
+	order := make([]int, 0, len(profitShare))
+	for i, share := range profitShare {
+		if share.Factor > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return fractions[order[a]] > fractions[order[b]] })
+	for j := 0; distributed < amount; j = (j + 1) % len(order) {
+		amounts[order[j]]++
+		distributed++
+	}
+
+	var shares []payoutShare
+	for i, share := range profitShare {
+		if amounts[i] == 0 {
+			continue
+		}
+		shares = append(shares, payoutShare{identity: share.Identity, amount: amounts[i]})
+	}
+	return shares
+}
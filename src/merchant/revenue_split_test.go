@@ -0,0 +1,77 @@
+package merchant
+
+import (
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+func TestSplitPayout(t *testing.T) {
+	config := &config_manager.Config{
+		ProfitShare: []config_manager.ProfitShareConfig{
+			{Factor: 0.79, Identity: "owner"},
+			{Factor: 0.21, Identity: "developer"},
+		},
+		InterfaceProfitShare: map[string][]config_manager.ProfitShareConfig{
+			"wlan1": {
+				{Factor: 1, Identity: "host-a"},
+				{Factor: 1, Identity: "host-b"},
+				{Factor: 1, Identity: "host-c"},
+				{Factor: 0, Identity: "unpaid"},
+			},
+			"wlan2": {{Factor: 0, Identity: "unpaid"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		revenue map[string]uint64
+		aimed   uint64
+		want    map[string]uint64
+	}{
+		{"default share rounds to the larger fraction", nil, 1, map[string]uint64{"owner": 1}},
+		{"default share of an odd amount", nil, 3, map[string]uint64{"owner": 2, "developer": 1}},
+		{"remainder of equal weights", map[string]uint64{"wlan1": 10}, 10,
+			map[string]uint64{"host-a": 4, "host-b": 3, "host-c": 3}},
+		{"interface revenue scaled to the payout", map[string]uint64{"wlan1": 200}, 100,
+			map[string]uint64{"host-a": 34, "host-b": 33, "host-c": 33}},
+		{"zero weight interface pays the default share", map[string]uint64{"wlan2": 50}, 100,
+			map[string]uint64{"owner": 79, "developer": 21}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, _ := splitPayout(config, tt.revenue, tt.aimed)
+			got := make(map[string]uint64)
+			for _, share := range shares {
+				got[share.identity] += share.amount
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitPayout() = %v, expected %v", got, tt.want)
+			}
+			for identity, amount := range tt.want {
+				if got[identity] != amount {
+					t.Errorf("splitPayout() = %v, expected %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	// Whatever the amount, the shares add up to the payout and zero weights get nothing
+	for aimed := uint64(0); aimed <= 1000; aimed++ {
+		shares, settled := splitPayout(config, map[string]uint64{"wlan1": aimed / 3, "wlan2": aimed / 5}, aimed)
+		var total uint64
+		for _, share := range shares {
+			if share.identity == "unpaid" {
+				t.Fatalf("Recipient without weight got %d of %d", share.amount, aimed)
+			}
+			total += share.amount
+		}
+		if total != aimed {
+			t.Fatalf("Shares of %d add up to %d", aimed, total)
+		}
+		if _, exists := settled["wlan2"]; exists {
+			t.Fatalf("Revenue of an interface that pays no one was settled")
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Self-test stages, in the order they run
+const (
+	selfTestStageWallet   = "wallet"   // An accepted mint holds enough to pay for the smallest purchase
+	selfTestStageToken    = "token"    // The wallet can take a payment token out of its balance
+	selfTestStagePurchase = "purchase" // The token buys a session like a customer's payment would
+	selfTestStageGate     = "gate"     // The session opened the gate
+	selfTestStageCleanup  = "cleanup"  // The session and gate are gone again
+)
+
+// SelfTestStage is the outcome of one stage of a self-test
+type SelfTestStage struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// SelfTestReport tells whether the gateway could sell access when the self-test ran, stage by stage
+type SelfTestReport struct {
+	Passed     bool            `json:"passed"`
+	Timestamp  int64           `json:"timestamp"`
+	MintURL    string          `json:"mint_url,omitempty"`
+	Amount     uint64          `json:"amount,omitempty"`
+	MacAddress string          `json:"mac_address,omitempty"` // Made-up device the session was bought for
+	Stages     []SelfTestStage `json:"stages"`
+}
+
+// selfTestState keeps self-tests from overlapping and remembers the last report
+type selfTestState struct {
+	mu      sync.Mutex
+	running bool
+	pubkey  string // Customer key of the running self-test, its payment isn't revenue
+	last    *SelfTestReport
+}
+
+// RunSelfTest checks the money path end to end: the wallet pays itself the smallest purchase at an
+// accepted mint, and the payment buys a session for a made-up device whose gate only opens in the valve's
+// bookkeeping. Only the mint's swap fees are spent. The payment is kept out of the ledger and revenue split.
+func (m *Merchant) RunSelfTest() SelfTestReport {
+	report := SelfTestReport{Timestamp: time.Now().Unix(), Passed: true}
+
+	customerKey := nostr.GeneratePrivateKey()
+	customerPubkey, err := nostr.GetPublicKey(customerKey)
+	if err != nil {
+		report.fail(selfTestStageWallet, time.Now(), fmt.Sprintf("failed to create customer key: %v", err))
+		return report
+	}
+
+	m.selfTest.mu.Lock()
+	if m.selfTest.running {
+		m.selfTest.mu.Unlock()
+		report.fail(selfTestStageWallet, time.Now(), "another self-test is running")
+		return report
+	}
+	m.selfTest.running = true
+	m.selfTest.pubkey = customerPubkey
+	m.selfTest.mu.Unlock()
+
+	defer func() {
+		m.selfTest.mu.Lock()
+		defer m.selfTest.mu.Unlock()
+		m.selfTest.running = false
+		m.selfTest.pubkey = ""
+		m.selfTest.last = &report
+	}()
+
+	m.runSelfTestStages(&report, customerKey)
+	log.Printf("Self-test finished, passed: %t", report.Passed)
+	return report
+}
+
+// runSelfTestStages runs the stages until one fails, cleaning up after a purchase in any case
+func (m *Merchant) runSelfTestStages(report *SelfTestReport, customerKey string) {
+	start := time.Now()
+	mintURL, amount, err := m.selfTestPayment()
+	if err != nil {
+		report.fail(selfTestStageWallet, start, err.Error())
+		return
+	}
+	report.MintURL = mintURL
+	report.Amount = amount
+	report.pass(selfTestStageWallet, start, fmt.Sprintf("%d sats available at %s", m.tollwallet.GetBalanceByMint(mintURL), mintURL))
+
+	start = time.Now()
+	token, err := m.CreatePaymentToken(mintURL, amount)
+	if err != nil {
+		report.fail(selfTestStageToken, start, err.Error())
+		return
+	}
+	report.pass(selfTestStageToken, start, fmt.Sprintf("%d sats", amount))
+
+	macAddress, err := selfTestMAC()
+	if err != nil {
+		report.fail(selfTestStagePurchase, time.Now(), err.Error())
+		m.reclaimSelfTestToken(token)
+		return
+	}
+	report.MacAddress = macAddress
+	valve.SetDryRun(macAddress, true)
+	defer func() {
+		start := time.Now()
+		if err := m.cleanUpSelfTest(macAddress); err != nil {
+			report.fail(selfTestStageCleanup, start, err.Error())
+			return
+		}
+		report.pass(selfTestStageCleanup, start, "")
+	}()
+
+	start = time.Now()
+	paymentEvent := nostr.Event{
+		Kind:      21000,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"device-identifier", "mac", macAddress},
+			{"payment", token},
+		},
+	}
+	if err := paymentEvent.Sign(customerKey); err != nil {
+		report.fail(selfTestStagePurchase, start, fmt.Sprintf("failed to sign payment: %v", err))
+		m.reclaimSelfTestToken(token)
+		return
+	}
+	response, err := m.PurchaseSession(paymentEvent)
+	if err != nil {
+		report.fail(selfTestStagePurchase, start, err.Error())
+		m.reclaimSelfTestToken(token)
+		return
+	}
+	if response.Kind != 1022 {
+		report.fail(selfTestStagePurchase, start, fmt.Sprintf("%s: %s", firstTagValue(response, "code"), response.Content))
+		m.reclaimSelfTestToken(token)
+		return
+	}
+	report.pass(selfTestStagePurchase, start, fmt.Sprintf("allotment %s", firstTagValue(response, "allotment")))
+
+	start = time.Now()
+	if !valve.IsGateOpen(macAddress) {
+		report.fail(selfTestStageGate, start, "gate did not open")
+		return
+	}
+	report.pass(selfTestStageGate, start, "")
+}
+
+// selfTestPayment picks the first accepted mint the wallet can pay the smallest purchase from
+func (m *Merchant) selfTestPayment() (string, uint64, error) {
+	mints := m.getConfig().AcceptedMints
+	if len(mints) == 0 {
+		return "", 0, fmt.Errorf("no accepted mints configured")
+	}
+
+	for _, mint := range mints {
+		amount := mint.PricePerStep * max(mint.MinPurchaseSteps, 1)
+		if amount > 0 && m.tollwallet.GetBalanceByMint(mint.URL) >= amount {
+			return mint.URL, amount, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no accepted mint holds enough to pay for the smallest purchase, fund the wallet first")
+}
+
+// reclaimSelfTestToken puts a payment token back into the wallet if the purchase didn't redeem it
+func (m *Merchant) reclaimSelfTestToken(token string) {
+	if _, err := m.Fund(token); err != nil {
+		log.Printf("Self-test token was not reclaimed, it may have been redeemed: %v", err)
+	}
+}
+
+// cleanUpSelfTest ends the session bought for the made-up device
+func (m *Merchant) cleanUpSelfTest(macAddress string) error {
+	defer valve.SetDryRun(macAddress, false)
+
+	m.sessionMu.Lock()
+	delete(m.customerSessions, macAddress)
+	m.sessionMu.Unlock()
+
+	if _, err := valve.CloseGate(macAddress); err != nil {
+		return fmt.Errorf("failed to close gate: %w", err)
+	}
+	if valve.IsGateOpen(macAddress) {
+		return fmt.Errorf("gate is still open")
+	}
+	return nil
+}
+
+// isSelfTestPayment reports whether a payment comes from the running self-test
+func (m *Merchant) isSelfTestPayment(pubkey string) bool {
+	m.selfTest.mu.Lock()
+	defer m.selfTest.mu.Unlock()
+	return m.selfTest.running && m.selfTest.pubkey == pubkey
+}
+
+// lastSelfTest returns the report of the last self-test, nil if none ran since startup
+func (m *Merchant) lastSelfTest() *SelfTestReport {
+	m.selfTest.mu.Lock()
+	defer m.selfTest.mu.Unlock()
+	return m.selfTest.last
+}
+
+// selfTestMACPrefix is the OUI IANA reserves for documentation (RFC 7042). It is globally administered, so
+// the made-up device isn't refused or bound by the randomized MAC policy, yet no real device is shipped with it.
+const selfTestMACPrefix = "00:00:5e:00:53"
+
+// selfTestMAC makes up a MAC address in the documentation range
+func selfTestMAC() (string, error) {
+	suffix := make([]byte, 1)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to make up a MAC address: %w", err)
+	}
+	return fmt.Sprintf("%s:%02x", selfTestMACPrefix, suffix[0]), nil
+}
+
+// firstTagValue returns the value of the first tag with the name, "" if the event has none
+func firstTagValue(event *nostr.Event, name string) string {
+	if tag := event.Tags.Find(name); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+func (r *SelfTestReport) pass(stage string, start time.Time, detail string) {
+	r.Stages = append(r.Stages, SelfTestStage{Name: stage, Passed: true, Detail: detail, DurationMs: time.Since(start).Milliseconds()})
+}
+
+func (r *SelfTestReport) fail(stage string, start time.Time, detail string) {
+	r.Passed = false
+	r.Stages = append(r.Stages, SelfTestStage{Name: stage, Detail: detail, DurationMs: time.Since(start).Milliseconds()})
+}
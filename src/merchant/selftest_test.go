@@ -0,0 +1,99 @@
+package merchant
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+func TestSelfTestMACPassesRandomizedMACPolicy(t *testing.T) {
+	m := newTestMerchant(t)
+	err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.RandomizedMACs.Policy = config_manager.RandomizedMACRefuse
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	for i := 0; i < 32; i++ {
+		macAddress, err := selfTestMAC()
+		if err != nil {
+			t.Fatalf("selfTestMAC returned error: %v", err)
+		}
+		if !utils.ValidateMACAddress(macAddress) {
+			t.Fatalf("selfTestMAC returned invalid MAC address %q", macAddress)
+		}
+		if !strings.HasPrefix(macAddress, selfTestMACPrefix+":") {
+			t.Errorf("Expected %q to be in the documentation range %s", macAddress, selfTestMACPrefix)
+		}
+		if utils.IsRandomizedMAC(macAddress) {
+			t.Errorf("Expected %q to be globally administered", macAddress)
+		}
+		if m.refusesRandomizedMAC(macAddress) {
+			t.Errorf("Expected the refuse policy to let the self-test device %q pay", macAddress)
+		}
+	}
+}
+
+func TestSelfTestFailsWithoutMints(t *testing.T) {
+	m := newTestMerchant(t)
+	err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.AcceptedMints = nil
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	report := m.RunSelfTest()
+	if report.Passed {
+		t.Fatal("Expected the self-test to fail without accepted mints")
+	}
+	if len(report.Stages) != 1 || report.Stages[0].Name != selfTestStageWallet || report.Stages[0].Passed {
+		t.Fatalf("Expected only a failed wallet stage, got %+v", report.Stages)
+	}
+
+	last := m.lastSelfTest()
+	if last == nil || last.Timestamp != report.Timestamp || last.Passed {
+		t.Errorf("Expected the failed report to be remembered, got %+v", last)
+	}
+	if m.selfTest.running {
+		t.Error("Expected the self-test to be finished")
+	}
+}
+
+func TestSelfTestDoesNotOverlap(t *testing.T) {
+	m := newTestMerchant(t)
+	m.selfTest.running = true
+	m.selfTest.pubkey = "running-self-test"
+
+	report := m.RunSelfTest()
+	if report.Passed {
+		t.Fatal("Expected the self-test to refuse to run while another one runs")
+	}
+	if len(report.Stages) != 1 || !strings.Contains(report.Stages[0].Detail, "another self-test") {
+		t.Errorf("Expected an overlap failure, got %+v", report.Stages)
+	}
+	if !m.selfTest.running || m.selfTest.pubkey != "running-self-test" {
+		t.Error("Expected the running self-test to be left alone")
+	}
+}
+
+func TestIsSelfTestPayment(t *testing.T) {
+	m := newTestMerchant(t)
+	if m.isSelfTestPayment("customer") {
+		t.Error("Expected no self-test payment while none runs")
+	}
+
+	m.selfTest.running = true
+	m.selfTest.pubkey = "self-test"
+	if !m.isSelfTestPayment("self-test") {
+		t.Error("Expected the running self-test's payment to be recognized")
+	}
+	if m.isSelfTestPayment("customer") {
+		t.Error("Expected a customer's payment not to be taken for the self-test's")
+	}
+}
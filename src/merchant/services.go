@@ -0,0 +1,188 @@
+package merchant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultServiceHookTimeout applies to service hooks without a configured timeout
+const defaultServiceHookTimeout = 30 * time.Second
+
+// maxServiceReceiptLength caps how much of a hook's output is returned as receipt
+const maxServiceReceiptLength = 1024
+
+// extractService returns the ID in the service tag of a payment, "" for internet access
+func extractService(paymentEvent nostr.Event) string {
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "service" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// findService returns the configured service with the ID, nil if the venue doesn't offer it
+func findService(config *config_manager.Config, serviceID string) *config_manager.ServiceConfig {
+	for i := range config.Services {
+		if config.Services[i].ID == serviceID {
+			return &config.Services[i]
+		}
+	}
+	return nil
+}
+
+// serviceTag advertises a service as ["service", id, price per unit, unit, name, max units]
+func serviceTag(service config_manager.ServiceConfig) nostr.Tag {
+	return nostr.Tag{
+		"service",
+		service.ID,
+		fmt.Sprintf("%d", service.PricePerUnit),
+		service.Unit,
+		service.Name,
+		fmt.Sprintf("%d", service.MaxUnits),
+	}
+}
+
+// purchaseService sells units of a venue service instead of internet access. The payment is checked
+// against the price before it is redeemed, and refunded as change if the fulfillment hook fails.
+// What is left over after whole units is kept, like amounts between step prices of sessions.
+func (m *Merchant) purchaseService(paymentEvent nostr.Event, serviceID, paymentToken, macAddress string) (*nostr.Event, error) {
+	service := findService(m.getConfig(), serviceID)
+	if service == nil || service.PricePerUnit == 0 {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "service-not-offered",
+			fmt.Sprintf("Service %s is not offered here", serviceID), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("service not offered and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "payment-error-invalid-token",
+			fmt.Sprintf("Invalid cashu token: %v", err), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid cashu token and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Refuse payments that don't buy a unit, or buy more than allowed, before redeeming them
+	received := paymentCashuToken.Amount()
+	if received < service.PricePerUnit || (service.MaxUnits > 0 && received/service.PricePerUnit > service.MaxUnits) {
+		message := fmt.Sprintf("%s costs %d sats per %s", service.Name, service.PricePerUnit, service.Unit)
+		if service.MaxUnits > 0 {
+			message += fmt.Sprintf(", up to %d per payment", service.MaxUnits)
+		}
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "service-payment-invalid", message, paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid service payment and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
+	if err != nil {
+		return m.redeemFailedNotice(err, paymentToken, paymentEvent.PubKey)
+	}
+	mintURL := paymentCashuToken.Mint()
+	m.checkExposure(mintURL)
+	swapFee := uint64(0)
+	if received > amountAfterSwap {
+		swapFee = received - amountAfterSwap
+	}
+
+	units := amountAfterSwap / service.PricePerUnit
+	var receipt string
+	if units == 0 {
+		err = fmt.Errorf("%d sats left after the mint's fees don't buy a %s", amountAfterSwap, service.Unit)
+	} else {
+		receipt, err = runServiceHook(*service, units, amountAfterSwap, macAddress, paymentEvent.PubKey)
+	}
+	if err != nil {
+		log.Printf("Failed to fulfill %d %s of %s for %s: %v", units, service.Unit, service.ID, macAddress, err)
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"service-fulfillment-failed", fmt.Sprintf("%s could not be delivered", service.Name))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("service fulfillment failed and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerService,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		MintURL:    mintURL,
+		Amount:     amountAfterSwap,
+		Received:   received,
+		SwapFee:    swapFee,
+		Allotment:  units,
+		Metric:     service.Unit,
+		EventID:    paymentEvent.ID,
+		Service:    service.ID,
+		TermsHash:  extractAcceptedTerms(paymentEvent),
+	}); err != nil {
+		log.Printf("Warning: failed to record %s purchase of %s: %v", service.ID, macAddress, err)
+	}
+	log.Printf("Sold %d %s of %s to %s for %d sats", units, service.Unit, service.ID, macAddress, amountAfterSwap)
+
+	noticeEvent, err := m.createNoticeEventWithTags("info", "service-purchased", receipt, paymentEvent.PubKey,
+		nostr.Tag{"service", service.ID},
+		nostr.Tag{"units", fmt.Sprintf("%d", units), service.Unit},
+		nostr.Tag{"amount-received", fmt.Sprintf("%d", received)},
+		nostr.Tag{"swap-fee", fmt.Sprintf("%d", swapFee)},
+		nostr.Tag{"amount-credited", fmt.Sprintf("%d", amountAfterSwap)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service receipt: %w", err)
+	}
+	return noticeEvent, nil
+}
+
+// runServiceHook runs the fulfillment hook of a service and returns its output as receipt, e.g. a locker code.
+// Services without a hook are delivered by staff checking the ledger or the receipt.
+func runServiceHook(service config_manager.ServiceConfig, units, amount uint64, macAddress, pubkey string) (string, error) {
+	paid := fmt.Sprintf("%d %s of %s paid", units, service.Unit, service.Name)
+	if service.Hook == "" {
+		return paid, nil
+	}
+
+	timeout := time.Duration(service.HookTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultServiceHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, service.Hook)
+	cmd.Env = append(os.Environ(),
+		"TOLLGATE_EVENT=service",
+		"TOLLGATE_SERVICE="+service.ID,
+		fmt.Sprintf("TOLLGATE_UNITS=%d", units),
+		fmt.Sprintf("TOLLGATE_AMOUNT=%d", amount),
+		"TOLLGATE_MAC="+macAddress,
+		"TOLLGATE_PUBKEY="+pubkey,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("hook %s failed: %w", service.Hook, err)
+	}
+
+	receipt := strings.TrimSpace(string(output))
+	if len(receipt) > maxServiceReceiptLength {
+		receipt = receipt[:maxServiceReceiptLength]
+	}
+	if receipt == "" {
+		receipt = paid
+	}
+	return receipt, nil
+}
@@ -0,0 +1,186 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+)
+
+// defaultAbusePollInterval applies when no poll interval is configured
+const defaultAbusePollInterval = 15 * time.Second
+
+// sessionAbuse follows where the MAC addresses of paid sessions are seen, to catch a spoofed address
+// sharing one device's session
+type sessionAbuse struct {
+	mu      sync.Mutex
+	tracks  map[string]*locationTrack // By session MAC address
+	flagged map[string]string         // Session MAC addresses responded to, with the reason, until their session ends
+}
+
+// locationTrack is where a MAC address was seen last and before, and when it went back to the place before
+type locationTrack struct {
+	current  string
+	previous string
+	returns  []int64
+}
+
+func newSessionAbuse() *sessionAbuse {
+	return &sessionAbuse{
+		tracks:  make(map[string]*locationTrack),
+		flagged: make(map[string]string),
+	}
+}
+
+// observe records where a MAC address is seen now and returns why its use looks concurrent, empty if it doesn't.
+// Two devices with the same address are seen in two places at once, or, where the bridge only learns one port,
+// make it bounce between two ports. A device roaming between access points moves on instead of going back
+// and forth all the time.
+func (a *sessionAbuse) observe(macAddress string, places []string, now time.Time, config config_manager.SessionAbuseConfig) string {
+	if len(places) > 1 {
+		return fmt.Sprintf("seen on %s at once", strings.Join(places, ", "))
+	}
+	if len(places) == 0 {
+		return ""
+	}
+
+	track, exists := a.tracks[macAddress]
+	if !exists {
+		track = &locationTrack{}
+		a.tracks[macAddress] = track
+	}
+	place := places[0]
+	if place == track.current {
+		return ""
+	}
+
+	if place == track.previous {
+		since := now.Add(-time.Duration(config.WindowSeconds) * time.Second).Unix()
+		recent := track.returns[:0]
+		for _, at := range track.returns {
+			if at >= since {
+				recent = append(recent, at)
+			}
+		}
+		track.returns = append(recent, now.Unix())
+	}
+	track.previous, track.current = track.current, place
+
+	if config.MaxReturns > 0 && len(track.returns) >= config.MaxReturns {
+		return fmt.Sprintf("moved back and forth between %s and %s %d times within %ds",
+			track.previous, track.current, len(track.returns), config.WindowSeconds)
+	}
+	return ""
+}
+
+// forget drops what is known of the MAC addresses whose session ended
+func (a *sessionAbuse) forget(active map[string]bool) {
+	for macAddress := range a.tracks {
+		if !active[macAddress] {
+			delete(a.tracks, macAddress)
+		}
+	}
+	for macAddress := range a.flagged {
+		if !active[macAddress] {
+			delete(a.flagged, macAddress)
+		}
+	}
+}
+
+// detectSessionAbuse periodically looks for session MAC addresses in use from several places at once
+func (m *Merchant) detectSessionAbuse() {
+	for {
+		config := m.getConfig().SessionAbuse
+		interval := time.Duration(config.PollIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultAbusePollInterval
+		}
+		time.Sleep(interval)
+
+		if config.Enabled {
+			m.detectSessionAbuseOnce(config)
+		}
+	}
+}
+
+func (m *Merchant) detectSessionAbuseOnce(config config_manager.SessionAbuseConfig) {
+	locations, err := valve.ClientLocations()
+	if err != nil {
+		log.Printf("Warning: failed to read where clients are connected: %v", err)
+		return
+	}
+	placesByMAC := make(map[string][]string, len(locations))
+	for macAddress, places := range locations {
+		placesByMAC[utils.NormalizeMAC(macAddress)] = places
+	}
+
+	active := make(map[string]bool)
+	m.sessionMu.RLock()
+	for macAddress, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			active[macAddress] = true
+		}
+	}
+	m.sessionMu.RUnlock()
+
+	abused := make(map[string]string)
+	now := time.Now()
+	m.abuse.mu.Lock()
+	m.abuse.forget(active)
+	for macAddress := range active {
+		if _, flagged := m.abuse.flagged[macAddress]; flagged {
+			continue
+		}
+		if reason := m.abuse.observe(macAddress, placesByMAC[utils.NormalizeMAC(macAddress)], now, config); reason != "" {
+			m.abuse.flagged[macAddress] = reason
+			abused[macAddress] = reason
+		}
+	}
+	m.abuse.mu.Unlock()
+
+	for macAddress, reason := range abused {
+		m.respondToAbuse(config, macAddress, reason)
+	}
+}
+
+// respondToAbuse alerts the operator to a session used from several places at once and applies the policy
+func (m *Merchant) respondToAbuse(config config_manager.SessionAbuseConfig, macAddress, reason string) {
+	m.errorCounters.add("session-abuse")
+	log.Printf("Alert: session of %s looks shared by devices spoofing its address, %s", macAddress, reason)
+
+	switch config.Policy {
+	case config_manager.SessionAbuseThrottle:
+		if config.ThrottleKbps <= 0 {
+			return
+		}
+		if err := valve.ThrottleGate(macAddress, config.ThrottleKbps); err != nil {
+			log.Printf("Warning: failed to throttle shared session of %s: %v", macAddress, err)
+			return
+		}
+		log.Printf("Throttled shared session of %s to %d kbps", macAddress, config.ThrottleKbps)
+
+	case config_manager.SessionAbuseRevoke:
+		m.sessionMu.Lock()
+		if session, exists := m.customerSessions[macAddress]; exists && isCustomerSessionActive(session) {
+			if session.Metric == "milliseconds" {
+				usedMs := uint64(time.Now().UnixMilli() - session.StartTime*1000)
+				session.Allotment = min(usedMs, session.Allotment)
+			} else {
+				session.Allotment = 0
+			}
+		}
+		m.sessionMu.Unlock()
+
+		if _, err := valve.CloseGate(macAddress); err != nil {
+			log.Printf("Warning: failed to close gate of shared session of %s: %v", macAddress, err)
+		}
+		m.cookieRevocations.revoke(macAddress)
+		m.closeSessionGroup(macAddress)
+		log.Printf("Revoked shared session of %s", macAddress)
+	}
+}
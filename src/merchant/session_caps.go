@@ -0,0 +1,159 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Excess policies for purchases that exceed a tier's session caps
+const (
+	excessPolicyReject = "reject" // Refuse the payment before redeeming it
+	excessPolicyRefund = "refund" // Sell up to the cap and return the rest as a change token
+)
+
+// remainingAllotment returns how much allotment a MAC address still has left on its session
+func (m *Merchant) remainingAllotment(macAddress string) uint64 {
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	session, exists := m.customerSessions[macAddress]
+	if !exists || !isCustomerSessionActive(session) {
+		return 0
+	}
+
+	if session.Metric != "milliseconds" {
+		return session.Allotment
+	}
+
+	remainingMs := session.StartTime*1000 + int64(session.Allotment) - time.Now().UnixMilli()
+	if remainingMs <= 0 {
+		return 0
+	}
+	return uint64(remainingMs)
+}
+
+// allowedAllotment returns the most allotment a new purchase may add for a tier.
+// The boolean is false if the tier has no caps configured.
+func (m *Merchant) allowedAllotment(tier, macAddress string) (uint64, bool) {
+	caps, exists := m.getConfig().SessionCaps.Tiers[tier]
+	if !exists {
+		return 0, false
+	}
+
+	var allowed uint64
+	capped := false
+
+	if caps.MaxSessionAllotment > 0 {
+		allowed = caps.MaxSessionAllotment
+		capped = true
+	}
+
+	if caps.MaxStackedAllotment > 0 {
+		var stackable uint64
+		remaining := m.remainingAllotment(macAddress)
+		if remaining < caps.MaxStackedAllotment {
+			stackable = caps.MaxStackedAllotment - remaining
+		}
+		if !capped || stackable < allowed {
+			allowed = stackable
+		}
+		capped = true
+	}
+
+	return allowed, capped
+}
+
+// capSteps splits a purchase into the steps that fit within the tier caps and the excess steps.
+// Caps are durations, so purchases metered in other metrics are not capped.
+func (m *Merchant) capSteps(config *config_manager.Config, tier, macAddress string, steps uint64, mintConfig config_manager.MintConfig) (allowedSteps, excessSteps uint64) {
+	stepSize := config.StepSizeFor(mintConfig)
+	if config.MetricFor(mintConfig) != "milliseconds" {
+		return steps, 0
+	}
+	allowed, capped := m.allowedAllotment(tier, macAddress)
+	if !capped || stepSize == 0 {
+		return steps, 0
+	}
+
+	maxSteps := allowed / stepSize
+	if steps <= maxSteps {
+		return steps, 0
+	}
+	return maxSteps, steps - maxSteps
+}
+
+// rejectOverCap returns a notice if the payment would exceed the tier caps, before the token is redeemed.
+// Returns nil if the payment fits or can't be priced yet; pricing errors are reported later in the flow.
+func (m *Merchant) rejectOverCap(config *config_manager.Config, token cashu.Token, macAddress, customerPubkey string) (*nostr.Event, error) {
+	configured := findMintConfigIn(config, token.Mint())
+	if configured == nil {
+		return nil, nil
+	}
+	mintConfig, _ := m.effectiveMintConfig(*configured)
+	if mintConfig.PricePerStep == 0 {
+		return nil, nil
+	}
+
+	amount, err := m.toPriceUnit(config, mintConfig, token.Amount())
+	if err != nil {
+		return nil, nil
+	}
+	steps := amount / mintConfig.PricePerStep
+	tier := determineTier(config, token.Amount())
+
+	allowedSteps, excessSteps := m.capSteps(config, tier, macAddress, steps, mintConfig)
+	if excessSteps == 0 {
+		return nil, nil
+	}
+
+	log.Printf("Rejecting payment of %d steps for %s: %s tier allows %d more steps", steps, macAddress, tier, allowedSteps)
+
+	return m.CreateNoticeEvent("error", "session-cap-exceeded",
+		fmt.Sprintf("Payment covers %d steps but the %s tier allows at most %d more steps (%d %s)",
+			steps, tier, allowedSteps, allowedSteps*mintConfig.PricePerStep, mintConfig.PriceUnit), customerPubkey)
+}
+
+// refundOverCap trims an allotment to the tier caps and returns the excess to the customer as a change token.
+// If the change token can't be created the full allotment is granted, so the customer never pays for nothing.
+func (m *Merchant) refundOverCap(config *config_manager.Config, tier, macAddress, mintURL string, allotment uint64) (uint64, string) {
+	configured := findMintConfigIn(config, mintURL)
+	if configured == nil {
+		return allotment, ""
+	}
+	// Refunded at the price the allotment was sold at
+	mintConfig, _ := m.effectiveMintConfig(*configured)
+	stepSize := config.StepSizeFor(mintConfig)
+	if stepSize == 0 {
+		return allotment, ""
+	}
+
+	steps := allotment / stepSize
+	allowedSteps, excessSteps := m.capSteps(config, tier, macAddress, steps, mintConfig)
+	if excessSteps == 0 {
+		return allotment, ""
+	}
+
+	// Change is paid in sats, whatever unit the price is set in
+	refundAmount, err := m.toWalletUnit(config, mintConfig, excessSteps*mintConfig.PricePerStep)
+	if err != nil || refundAmount == 0 {
+		log.Printf("Warning: can't refund the excess over the %s tier cap for %s in sats, granting full allotment: %v",
+			tier, macAddress, err)
+		return allotment, ""
+	}
+	changeToken, err := m.CreatePaymentToken(mintURL, refundAmount)
+	if err != nil {
+		log.Printf("Warning: failed to refund %d sats over the %s tier cap for %s, granting full allotment: %v",
+			refundAmount, tier, macAddress, err)
+		return allotment, ""
+	}
+
+	log.Printf("Refunded %d sats over the %s tier cap for %s (%d of %d steps granted)",
+		refundAmount, tier, macAddress, allowedSteps, steps)
+
+	return allotment - excessSteps*stepSize, changeToken
+}
@@ -0,0 +1,228 @@
+package merchant
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// SessionCookieName is the cookie browsers keep their session in
+const SessionCookieName = "tollgate_session"
+
+// cookieRevocationRetention is how long a revocation is kept, longer than any session a cookie restores
+const cookieRevocationRetention = 30 * 24 * time.Hour
+
+// sessionCookie is the signed content of a session cookie
+type sessionCookie struct {
+	MacAddress string `json:"mac"`
+	Tier       string `json:"tier"`
+	StartTime  int64  `json:"start"`
+	Allotment  uint64 `json:"allotment"` // In milliseconds, only time-based sessions get a cookie
+	IssuedAt   int64  `json:"iat"`
+}
+
+// cookieRevocations records when sessions of a MAC address were cancelled or handed off, so cookies issued
+// before can't bring them back after a restart. Persisted next to the wallet.
+type cookieRevocations struct {
+	mu      sync.Mutex
+	path    string
+	revoked map[string]int64
+}
+
+func newCookieRevocations(path string) *cookieRevocations {
+	r := &cookieRevocations{path: path, revoked: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read session cookie revocations %s: %v", path, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.revoked); err != nil {
+		log.Printf("Warning: failed to parse session cookie revocations %s: %v", path, err)
+		r.revoked = make(map[string]int64)
+	}
+	return r
+}
+
+// revoke invalidates the cookies issued for a MAC address until now
+func (r *cookieRevocations) revoke(macAddress string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.revoked[utils.NormalizeMAC(macAddress)] = now.Unix()
+	for mac, revokedAt := range r.revoked {
+		if now.Sub(time.Unix(revokedAt, 0)) > cookieRevocationRetention {
+			delete(r.revoked, mac)
+		}
+	}
+
+	data, err := json.Marshal(r.revoked)
+	if err == nil {
+		err = utils.WriteStateDurable(r.path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to save session cookie revocations: %v", err)
+	}
+}
+
+// revokedAt returns when the cookies of a MAC address were last revoked, 0 if never
+func (r *cookieRevocations) revokedAt(macAddress string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoked[utils.NormalizeMAC(macAddress)]
+}
+
+// cookieKey derives the key cookies are signed with from the merchant's private key, so they stay valid
+// across restarts without another secret to keep
+func (m *Merchant) cookieKey() ([]byte, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+	key := sha256.Sum256([]byte("tollgate-session-cookie:" + merchantIdentity.PrivateKey))
+	return key[:], nil
+}
+
+// IssueSessionCookie returns a signed cookie for the active time-based session of a device and when it expires
+func (m *Merchant) IssueSessionCookie(macAddress string) (string, int64, error) {
+	if !m.getConfig().SessionCookies.Enabled {
+		return "", 0, fmt.Errorf("session cookies are disabled")
+	}
+
+	// Sessions are keyed by the MAC address as the customer sent it, which may be formatted differently
+	if sessionMACs := m.sessionMACs(macAddress); len(sessionMACs) > 0 {
+		macAddress = sessionMACs[0]
+	}
+
+	m.sessionMu.RLock()
+	session, exists := m.customerSessions[macAddress]
+	var cookie sessionCookie
+	active := exists && isCustomerSessionActive(session) && session.Metric == "milliseconds"
+	if active {
+		cookie = sessionCookie{
+			MacAddress: utils.NormalizeMAC(macAddress),
+			Tier:       session.Tier,
+			StartTime:  session.StartTime,
+			Allotment:  session.Allotment,
+			IssuedAt:   time.Now().Unix(),
+		}
+	}
+	m.sessionMu.RUnlock()
+	if !active {
+		return "", 0, fmt.Errorf("no active time-based session for %s", macAddress)
+	}
+
+	key, err := m.cookieKey()
+	if err != nil {
+		return "", 0, err
+	}
+	payload, err := json.Marshal(cookie)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode session cookie: %w", err)
+	}
+	signature := hmac.New(sha256.New, key)
+	signature.Write(payload)
+	value := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature.Sum(nil))
+	return value, cookie.StartTime + int64(cookie.Allotment/1000), nil
+}
+
+// verifySessionCookie checks the signature of a cookie and returns its content
+func (m *Merchant) verifySessionCookie(value string) (sessionCookie, error) {
+	encodedPayload, encodedSignature, found := strings.Cut(value, ".")
+	if !found {
+		return sessionCookie{}, fmt.Errorf("malformed session cookie")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return sessionCookie{}, fmt.Errorf("malformed session cookie")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return sessionCookie{}, fmt.Errorf("malformed session cookie")
+	}
+
+	key, err := m.cookieKey()
+	if err != nil {
+		return sessionCookie{}, err
+	}
+	expected := hmac.New(sha256.New, key)
+	expected.Write(payload)
+	if !hmac.Equal(signature, expected.Sum(nil)) {
+		return sessionCookie{}, fmt.Errorf("session cookie not issued by this TollGate")
+	}
+
+	var cookie sessionCookie
+	if err := json.Unmarshal(payload, &cookie); err != nil {
+		return sessionCookie{}, fmt.Errorf("malformed session cookie")
+	}
+	return cookie, nil
+}
+
+// RestoreSessionFromCookie brings back the session a restart lost for the device the cookie was issued to.
+// Only cookies issued before this start are honored: since then the merchant knows the session itself.
+func (m *Merchant) RestoreSessionFromCookie(value, macAddress string) (SessionStatus, error) {
+	if !m.getConfig().SessionCookies.Enabled {
+		return SessionStatus{}, fmt.Errorf("session cookies are disabled")
+	}
+	cookie, err := m.verifySessionCookie(value)
+	if err != nil {
+		return SessionStatus{}, err
+	}
+
+	switch {
+	case cookie.MacAddress != utils.NormalizeMAC(macAddress):
+		return SessionStatus{}, fmt.Errorf("session cookie was issued to another device")
+	case cookie.IssuedAt >= m.startTime.Unix():
+		return SessionStatus{}, fmt.Errorf("session cookie is not older than the running session state")
+	case cookie.IssuedAt <= m.cookieRevocations.revokedAt(macAddress):
+		return SessionStatus{}, fmt.Errorf("session was cancelled or handed off")
+	case m.GetSessionStatus(macAddress).Active:
+		return SessionStatus{}, fmt.Errorf("device already has an active session")
+	}
+
+	session := CustomerSession{
+		MacAddress: macAddress,
+		StartTime:  cookie.StartTime,
+		Metric:     "milliseconds",
+		Allotment:  cookie.Allotment,
+		Tier:       cookie.Tier,
+		Purchases:  1,
+	}
+	if !isCustomerSessionActive(&session) {
+		return SessionStatus{}, fmt.Errorf("session ended")
+	}
+
+	m.sessionMu.Lock()
+	if existing, exists := m.customerSessions[macAddress]; exists && isCustomerSessionActive(existing) {
+		m.sessionMu.Unlock()
+		return SessionStatus{}, fmt.Errorf("device already has an active session")
+	}
+	m.customerSessions[macAddress] = &session
+	m.sessionMu.Unlock()
+
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(&session), session.Tier); err != nil {
+		m.sessionMu.Lock()
+		if m.customerSessions[macAddress] == &session {
+			delete(m.customerSessions, macAddress)
+		}
+		m.sessionMu.Unlock()
+		return SessionStatus{}, fmt.Errorf("failed to open gate for session: %w", err)
+	}
+	log.Printf("Restored session of %s from its cookie until %d", macAddress, sessionEndTimestamp(&session))
+	return m.GetSessionStatus(macAddress), nil
+}
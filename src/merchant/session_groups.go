@@ -0,0 +1,275 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindSessionGroupJoin is sent by a device joining a session group with the group code
+const KindSessionGroupJoin = 21030
+
+// sessionGroup lets secondary devices share the session of the device that paid for it
+type sessionGroup struct {
+	code       string
+	primary    string          // MAC address holding the shared pool
+	pubkey     string          // Customer who created the group
+	maxMembers int             // Secondary devices allowed besides the primary
+	members    map[string]bool // MAC addresses of the secondary devices
+}
+
+// sessionGroups indexes the groups by code, primary and member, and the pubkey sessions by customer.
+// Guarded by sessionMu.
+type sessionGroups struct {
+	byCode    map[string]*sessionGroup
+	byPrimary map[string]*sessionGroup
+	byMember  map[string]*sessionGroup
+	byPubkey  map[string]*sessionGroup // Pubkey sessions, see pubkey_sessions.go
+}
+
+func newSessionGroups() sessionGroups {
+	return sessionGroups{
+		byCode:    make(map[string]*sessionGroup),
+		byPrimary: make(map[string]*sessionGroup),
+		byMember:  make(map[string]*sessionGroup),
+		byPubkey:  make(map[string]*sessionGroup),
+	}
+}
+
+// extractGroupSize returns the number of secondary devices a payment event asks a group for, or 0 for none
+func extractGroupSize(paymentEvent nostr.Event) (int, error) {
+	for _, tag := range paymentEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "group" {
+			size, err := strconv.Atoi(tag[1])
+			if err != nil || size < 1 {
+				return 0, fmt.Errorf("invalid group size %q", tag[1])
+			}
+			return size, nil
+		}
+	}
+	return 0, nil
+}
+
+// extractGroupCode returns the group code of a join event
+func extractGroupCode(joinEvent nostr.Event) string {
+	for _, tag := range joinEvent.Tags {
+		if len(tag) >= 2 && tag[0] == "group-code" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// checkGroupRequest validates a requested group size against the config, before the payment is redeemed
+func (m *Merchant) checkGroupRequest(size int) error {
+	config := m.getConfig().SessionGroups
+	if !config.Enabled {
+		return fmt.Errorf("this TollGate does not offer session groups")
+	}
+	if config.MaxMembers > 0 && size > config.MaxMembers {
+		return fmt.Errorf("groups are limited to %d additional devices", config.MaxMembers)
+	}
+	return nil
+}
+
+// createSessionGroup makes a device's session shareable. Buying a group for a device that already
+// leads one keeps its code and members and only raises the member limit.
+func (m *Merchant) createSessionGroup(primary, pubkey string, size int) (*sessionGroup, error) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	if group, exists := m.groups.byPrimary[primary]; exists {
+		group.maxMembers = max(group.maxMembers, size)
+		return group, nil
+	}
+	if _, isMember := m.groups.byMember[primary]; isMember {
+		return nil, fmt.Errorf("device %s already belongs to a group", primary)
+	}
+
+	code, err := newGroupCode()
+	if err != nil {
+		return nil, err
+	}
+
+	group := &sessionGroup{
+		code:       code,
+		primary:    primary,
+		pubkey:     pubkey,
+		maxMembers: size,
+		members:    make(map[string]bool),
+	}
+	m.groups.byCode[group.code] = group
+	m.groups.byPrimary[primary] = group
+	return group, nil
+}
+
+// newGroupCode returns a random code devices join a group with
+func newGroupCode() (string, error) {
+	codeBytes := make([]byte, 4)
+	if _, err := rand.Read(codeBytes); err != nil {
+		return "", fmt.Errorf("failed to generate group code: %w", err)
+	}
+	return hex.EncodeToString(codeBytes), nil
+}
+
+// poolFor returns the MAC address whose session a device draws from, which is its own unless it joined a group
+func (m *Merchant) poolFor(macAddress string) string {
+	if group, isMember := m.groups.byMember[macAddress]; isMember {
+		return group.primary
+	}
+	return macAddress
+}
+
+// groupMembers returns the secondary devices of the group a device leads
+func (m *Merchant) groupMembers(primary string) []string {
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	group, exists := m.groups.byPrimary[primary]
+	if !exists {
+		return nil
+	}
+	members := make([]string, 0, len(group.members))
+	for member := range group.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// sessionEndTimestamp returns when the gate of a session closes. Sessions metered in other
+// metrics than time are closed by metering, their gates are opened for 24h at a time.
+func sessionEndTimestamp(session *CustomerSession) int64 {
+	if session.Metric == "milliseconds" {
+		return session.StartTime + int64(session.Allotment/1000)
+	}
+	return time.Now().Unix() + 24*60*60
+}
+
+// extendGroupGates opens the gates of a group's members until the shared session ends
+func (m *Merchant) extendGroupGates(primary string, untilTimestamp int64, tier string) {
+	for _, member := range m.groupMembers(primary) {
+		if _, err := m.openGate(member, untilTimestamp, tier); err != nil {
+			log.Printf("Warning: failed to extend gate of group member %s: %v", member, err)
+		}
+	}
+}
+
+// closeSessionGroup closes the gates of a group's members and dissolves the group, once the shared session ended
+func (m *Merchant) closeSessionGroup(primary string) {
+	m.sessionMu.Lock()
+	group, exists := m.groups.byPrimary[primary]
+	if exists {
+		delete(m.groups.byPrimary, primary)
+		delete(m.groups.byCode, group.code)
+		if m.groups.byPubkey[group.pubkey] == group {
+			delete(m.groups.byPubkey, group.pubkey)
+		}
+		for member := range group.members {
+			delete(m.groups.byMember, member)
+			delete(m.dataQuota.counters, member)
+			delete(m.dataQuota.throttles, member)
+		}
+	}
+	m.sessionMu.Unlock()
+	if !exists {
+		return
+	}
+
+	for member := range group.members {
+		if _, err := valve.CloseGate(member); err != nil {
+			log.Printf("Warning: failed to close gate of group member %s: %v", member, err)
+		}
+	}
+	log.Printf("Dissolved session group %s of %s with %d members", group.code, primary, len(group.members))
+}
+
+// JoinSessionGroup adds a device to the group matching the code and opens its gate on the shared session
+func (m *Merchant) JoinSessionGroup(joinEvent nostr.Event) (*nostr.Event, error) {
+	if !m.getConfig().SessionGroups.Enabled {
+		return m.CreateNoticeEvent("error", "groups-disabled", "This TollGate does not offer session groups", joinEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(joinEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), joinEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), joinEvent.PubKey)
+	}
+
+	code := extractGroupCode(joinEvent)
+	if code == "" {
+		return m.CreateNoticeEvent("error", "invalid-group-code", "No group-code tag found in event", joinEvent.PubKey)
+	}
+
+	session, err := m.joinGroup(code, macAddress)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "group-join-failed", fmt.Sprintf("Cannot join group: %v", err), joinEvent.PubKey)
+	}
+
+	if _, err := m.openGate(macAddress, sessionEndTimestamp(&session), session.Tier); err != nil {
+		m.leaveGroup(code, macAddress)
+		return m.CreateNoticeEvent("error", "gate-opening-failed",
+			fmt.Sprintf("Failed to open gate for session: %v", err), joinEvent.PubKey)
+	}
+
+	log.Printf("Device %s joined session group %s of %s", macAddress, code, session.MacAddress)
+
+	// The member sees the shared session under its own device identifier
+	session.MacAddress = macAddress
+	return m.createSessionEvent(&session, joinEvent.PubKey, nostr.Tag{"group-code", code})
+}
+
+// joinGroup records a device as member of a group and returns a copy of the shared session
+func (m *Merchant) joinGroup(code, macAddress string) (CustomerSession, error) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	group, exists := m.groups.byCode[code]
+	if !exists {
+		return CustomerSession{}, fmt.Errorf("unknown group code")
+	}
+	session, exists := m.customerSessions[group.primary]
+	if !exists || !isCustomerSessionActive(session) {
+		return CustomerSession{}, fmt.Errorf("the group's session has ended")
+	}
+	if macAddress == group.primary || group.members[macAddress] {
+		return *session, nil
+	}
+	if _, isMember := m.groups.byMember[macAddress]; isMember {
+		return CustomerSession{}, fmt.Errorf("device already belongs to another group")
+	}
+	if _, leads := m.groups.byPrimary[macAddress]; leads {
+		return CustomerSession{}, fmt.Errorf("device already leads a group")
+	}
+	if own, exists := m.customerSessions[macAddress]; exists && isCustomerSessionActive(own) {
+		return CustomerSession{}, fmt.Errorf("device has a session of its own")
+	}
+	if len(group.members) >= group.maxMembers {
+		return CustomerSession{}, fmt.Errorf("group is full (%d devices)", group.maxMembers)
+	}
+
+	group.members[macAddress] = true
+	m.groups.byMember[macAddress] = group
+	return *session, nil
+}
+
+// leaveGroup removes a device from a group again
+func (m *Merchant) leaveGroup(code, macAddress string) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	if group, exists := m.groups.byCode[code]; exists {
+		delete(group.members, macAddress)
+		delete(m.groups.byMember, macAddress)
+	}
+}
@@ -0,0 +1,48 @@
+package merchant
+
+import "time"
+
+// SessionStatus is what the captive portal status page shows a client about its own session
+type SessionStatus struct {
+	Active         bool   `json:"active"`
+	Metric         string `json:"metric,omitempty"`
+	Tier           string `json:"tier,omitempty"`
+	RemainingMs    uint64 `json:"remaining_ms"`    // Time left of a time-metered session
+	RemainingBytes uint64 `json:"remaining_bytes"` // Data left of a data-metered session
+	EndsAt         int64  `json:"ends_at,omitempty"`
+	Shared         bool   `json:"shared,omitempty"` // The device draws from the session of another device in its group
+}
+
+// GetSessionStatus returns the remaining allotment and tier of the session a device draws from
+func (m *Merchant) GetSessionStatus(macAddress string) SessionStatus {
+	// Sessions are keyed by the MAC address as the customer sent it, which may be formatted differently
+	if sessionMACs := m.sessionMACs(macAddress); len(sessionMACs) > 0 {
+		macAddress = sessionMACs[0]
+	}
+
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	pool := m.poolFor(macAddress)
+	session, exists := m.customerSessions[pool]
+	if !exists || !isCustomerSessionActive(session) {
+		return SessionStatus{}
+	}
+
+	status := SessionStatus{
+		Active: true,
+		Metric: session.Metric,
+		Tier:   session.Tier,
+		Shared: pool != macAddress,
+	}
+	if session.Metric == "milliseconds" {
+		endMs := session.StartTime*1000 + int64(session.Allotment)
+		if remaining := endMs - time.Now().UnixMilli(); remaining > 0 {
+			status.RemainingMs = uint64(remaining)
+		}
+		status.EndsAt = endMs / 1000
+	} else {
+		status.RemainingBytes = session.Allotment
+	}
+	return status
+}
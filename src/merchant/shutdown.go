@@ -0,0 +1,43 @@
+package merchant
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// meltShutdownTimeout is how long shutdown waits for a payout melting at the mint
+const meltShutdownTimeout = 30 * time.Second
+
+// Shutdown persists the open sessions and closes the store when the service stops, so the sessions and their
+// gates are restored when it starts again. The gates themselves are left to valve.Shutdown, which is shared
+// by the merchants of all profiles.
+func (m *Merchant) Shutdown() error {
+	if m.stopped.Swap(true) {
+		return nil
+	}
+
+	// A payout killed mid-melt is settled from the melt journal at the next start, but one left to finish
+	// doesn't wait on the mint until then
+	if !m.tollwallet.StopMelts(meltShutdownTimeout) {
+		log.Printf("Payout still melting after %s, it is settled at the next start", meltShutdownTimeout)
+	}
+
+	var errs []error
+	sessions := m.activeSessions()
+	if err := m.ledger.store.SaveSessions(sessions); err != nil {
+		errs = append(errs, fmt.Errorf("failed to save sessions: %w", err))
+	} else {
+		log.Printf("Saved %d open sessions for the next start", len(sessions))
+	}
+	if err := utils.FlushStateWrites(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush state: %w", err))
+	}
+	if err := m.ledger.close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close store: %w", err))
+	}
+	return errors.Join(errs...)
+}
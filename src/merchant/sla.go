@@ -0,0 +1,144 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Defaults for the uplink monitor when the config leaves them at 0
+const (
+	defaultUplinkProbeTarget   = "8.8.8.8"
+	defaultUplinkProbeInterval = 30 * time.Second
+	// uplinkFailuresForOutage consecutive failed probes mark the uplink as down
+	uplinkFailuresForOutage = 2
+)
+
+// uplinkOutage is a period in which the gateway could not reach the internet
+type uplinkOutage struct {
+	Start time.Time
+	End   time.Time
+}
+
+// slaCredit returns how long a session ending at sessionEnd is extended for an outage, covering the part
+// of the outage that fell into the session scaled by creditPercent
+func slaCredit(sessionStart, sessionEnd time.Time, outage uplinkOutage, creditPercent uint64) time.Duration {
+	start := sessionStart
+	if outage.Start.After(start) {
+		start = outage.Start
+	}
+	end := sessionEnd
+	if outage.End.Before(end) {
+		end = outage.End
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start) * time.Duration(creditPercent) / 100
+}
+
+// probeUplink pings the probe target once
+func probeUplink(target string) error {
+	return exec.Command("ping", "-c", "1", "-W", "5", target).Run()
+}
+
+// monitorUplink probes the uplink while SLA credits are enabled and credits sessions after each outage
+func (m *Merchant) monitorUplink() {
+	var failures int
+	var outageStart time.Time
+
+	for {
+		config := m.getConfig().SLA
+		interval := time.Duration(config.ProbeIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultUplinkProbeInterval
+		}
+		time.Sleep(interval)
+
+		if !config.Enabled {
+			failures = 0
+			continue
+		}
+
+		target := config.ProbeTarget
+		if target == "" {
+			target = defaultUplinkProbeTarget
+		}
+
+		if err := probeUplink(target); err != nil {
+			if failures == 0 {
+				// The uplink was last seen up one interval ago at most, count the outage from the first failure
+				outageStart = time.Now()
+			}
+			failures++
+			if failures == uplinkFailuresForOutage {
+				log.Printf("Uplink down since %s, probes to %s fail: %v", outageStart.Format(time.RFC3339), target, err)
+			}
+			continue
+		}
+
+		if failures >= uplinkFailuresForOutage {
+			outage := uplinkOutage{Start: outageStart, End: time.Now()}
+			log.Printf("Uplink back after an outage of %s", outage.End.Sub(outage.Start).Round(time.Second))
+			if outage.End.Sub(outage.Start) >= time.Duration(config.MinOutageSeconds)*time.Second {
+				m.creditOutage(outage, config.CreditPercent)
+			}
+		}
+		failures = 0
+	}
+}
+
+// creditOutage extends every time-based session that ran during an outage and publishes the updated session
+func (m *Merchant) creditOutage(outage uplinkOutage, creditPercent uint64) {
+	type credited struct {
+		session CustomerSession
+		credit  time.Duration
+	}
+	var creditedSessions []credited
+	now := time.Now()
+
+	m.sessionMu.Lock()
+	for _, session := range m.customerSessions {
+		if session.Metric != "milliseconds" || session.Allotment == 0 {
+			continue
+		}
+		sessionStart := time.Unix(session.StartTime, 0)
+		sessionEnd := sessionStart.Add(time.Duration(session.Allotment) * time.Millisecond)
+		credit := slaCredit(sessionStart, sessionEnd, outage, creditPercent)
+		// Sessions that would still be over after the credit have nothing left to extend
+		if credit < time.Second || !sessionEnd.Add(credit).After(now) {
+			continue
+		}
+		session.Allotment += uint64(credit.Milliseconds())
+		creditedSessions = append(creditedSessions, credited{session: *session, credit: credit})
+	}
+	m.sessionMu.Unlock()
+
+	for _, c := range creditedSessions {
+		session := c.session
+		endTimestamp := session.StartTime + int64(session.Allotment/1000)
+		gate, err := m.openGate(session.MacAddress, endTimestamp, session.Tier)
+		if err != nil {
+			log.Printf("Warning: failed to extend gate of %s for SLA credit: %v", session.MacAddress, err)
+			continue
+		}
+		if gate.Opened {
+			log.Printf("Gate of %s had closed during the outage, reopened it", session.MacAddress)
+		}
+		log.Printf("Credited %s to the session of %s for an uplink outage", c.credit.Round(time.Second), session.MacAddress)
+
+		if session.Pubkey == "" {
+			continue
+		}
+		sessionEvent, err := m.createSessionEvent(&session, session.Pubkey,
+			nostr.Tag{"sla-credit", fmt.Sprintf("%d", c.credit.Milliseconds())})
+		if err != nil {
+			log.Printf("Warning: failed to create session event for SLA credit: %v", err)
+			continue
+		}
+		m.publisher.Publish(sessionEvent)
+	}
+}
@@ -0,0 +1,292 @@
+package merchant
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// sessionSnapshotInterval is how often the sessions are written to a backend that keeps them
+const sessionSnapshotInterval = 30 * time.Second
+
+// ErrHistoryUnavailable is returned for ledger history queries against the flat file backend
+var ErrHistoryUnavailable = errors.New("ledger history needs the bolt or sqlite storage backend")
+
+// Store persists the ledger and the customer sessions. The flat file backend keeps writes to a minimum for
+// routers with little flash: it appends ledger entries and batches session snapshots through the staged state
+// writes. The database backends also answer ledger history queries.
+type Store interface {
+	// AppendLedger records a ledger entry
+	AppendLedger(entry LedgerEntry) error
+	// ImportLedger adds the entries of the gateway this one replaces, before the existing ones
+	ImportLedger(entries []LedgerEntry) error
+	// ExportLedger returns all entries as JSON lines, oldest first
+	ExportLedger() ([]byte, error)
+	// LedgerEntries returns the entries recorded since a unix time, oldest first, or ErrHistoryUnavailable
+	LedgerEntries(since int64) ([]LedgerEntry, error)
+	// SaveSessions replaces the stored sessions
+	SaveSessions(sessions []CustomerSession) error
+	// LoadSessions returns the stored sessions
+	LoadSessions() ([]CustomerSession, error)
+	Close() error
+}
+
+// openStore opens the configured storage backend. A database backend that was asked for but can't be opened is an
+// error rather than a silent fallback to flat files, which would keep selling without the history and crash safety
+// the operator chose.
+func openStore(config config_manager.StorageConfig, dir string) (Store, error) {
+	ledgerPath := filepath.Join(dir, "ledger.jsonl")
+	sessionsPath := filepath.Join(dir, "sessions.json")
+
+	var store Store
+	var err error
+	switch config.Backend {
+	case "", config_manager.StorageJSON:
+		return newJSONStore(ledgerPath, sessionsPath), nil
+	case config_manager.StorageBolt:
+		store, err = openBoltStore(storePath(config, dir, "tollgate.bolt"))
+	case config_manager.StorageSQLite:
+		store, err = openSQLiteStore(storePath(config, dir, "tollgate.sqlite"))
+	default:
+		err = fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Carry over the ledger kept in flat files before the switch
+	if data, err := os.ReadFile(ledgerPath); err == nil && len(data) > 0 {
+		entries, err := parseLedgerLines(data)
+		if err == nil {
+			err = store.ImportLedger(entries)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to move %s into %s storage: %v", ledgerPath, config.Backend, err)
+		} else if err := os.Rename(ledgerPath, ledgerPath+".imported"); err != nil {
+			log.Printf("Warning: failed to retire %s after moving it into %s storage: %v", ledgerPath, config.Backend, err)
+		} else {
+			log.Printf("Moved %d ledger entries into %s storage", len(entries), config.Backend)
+		}
+	}
+	return store, nil
+}
+
+// storePath returns the database file of a backend, the configured one or a file next to the wallet
+func storePath(config config_manager.StorageConfig, dir, name string) string {
+	if config.Path != "" {
+		return config.Path
+	}
+	return filepath.Join(dir, name)
+}
+
+// parseLedgerLines decodes a ledger in JSON lines, skipping blank lines
+func parseLedgerLines(data []byte) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("invalid ledger entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// formatLedgerLines encodes entries as JSON lines
+func formatLedgerLines(entries []LedgerEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode ledger entry: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonStore appends the ledger to a JSON lines file and keeps the sessions in a JSON file
+type jsonStore struct {
+	ledgerPath   string
+	sessionsPath string
+}
+
+func newJSONStore(ledgerPath, sessionsPath string) *jsonStore {
+	return &jsonStore{ledgerPath: ledgerPath, sessionsPath: sessionsPath}
+}
+
+func (s *jsonStore) AppendLedger(entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger entry: %w", err)
+	}
+
+	file, err := os.OpenFile(s.ledgerPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open ledger: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write ledger entry: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonStore) ImportLedger(entries []LedgerEntry) error {
+	imported, err := formatLedgerLines(entries)
+	if err != nil {
+		return err
+	}
+	existing, err := os.ReadFile(s.ledgerPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read ledger: %w", err)
+	}
+
+	tmpPath := s.ledgerPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(imported, existing...), 0600); err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.ledgerPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonStore) ExportLedger() ([]byte, error) {
+	data, err := os.ReadFile(s.ledgerPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// LedgerEntries is not offered: reading the whole file into memory is more than small routers can spare
+func (s *jsonStore) LedgerEntries(since int64) ([]LedgerEntry, error) {
+	return nil, ErrHistoryUnavailable
+}
+
+// SaveSessions stages the snapshot, it reaches flash with the next flush of the state writes
+func (s *jsonStore) SaveSessions(sessions []CustomerSession) error {
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return fmt.Errorf("failed to encode sessions: %w", err)
+	}
+	return utils.WriteState(s.sessionsPath, data, 0600)
+}
+
+func (s *jsonStore) LoadSessions() ([]CustomerSession, error) {
+	data, err := utils.ReadState(s.sessionsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+	var sessions []CustomerSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("invalid sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// activeSessions returns copies of the sessions that haven't ended
+func (m *Merchant) activeSessions() []CustomerSession {
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+
+	sessions := make([]CustomerSession, 0, len(m.customerSessions))
+	for _, session := range m.customerSessions {
+		if isCustomerSessionActive(session) {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions
+}
+
+// snapshotSessions writes the sessions to the store whenever they changed since the last snapshot
+func (m *Merchant) snapshotSessions() {
+	var lastHash [sha256.Size]byte
+	for {
+		time.Sleep(sessionSnapshotInterval)
+		if m.stopped.Load() {
+			return
+		}
+
+		sessions := m.activeSessions()
+		data, err := json.Marshal(sessions)
+		if err != nil {
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if hash == lastHash {
+			continue
+		}
+		if err := m.ledger.store.SaveSessions(sessions); err != nil {
+			log.Printf("Warning: failed to save sessions: %v", err)
+			continue
+		}
+		lastHash = hash
+	}
+}
+
+// restoreStoredSessions reopens the gates of the sessions the store kept across the restart
+func (m *Merchant) restoreStoredSessions() {
+	if m.emergencyStop.halted() != nil {
+		log.Printf("Not restoring stored sessions, the gateway is halted")
+		return
+	}
+
+	sessions, err := m.ledger.store.LoadSessions()
+	if err != nil {
+		log.Printf("Warning: failed to load stored sessions: %v", err)
+		return
+	}
+
+	restored := 0
+	for i := range sessions {
+		session := sessions[i]
+		if !isCustomerSessionActive(&session) {
+			continue
+		}
+
+		m.sessionMu.Lock()
+		if existing, exists := m.customerSessions[session.MacAddress]; exists && isCustomerSessionActive(existing) {
+			m.sessionMu.Unlock()
+			continue
+		}
+		m.customerSessions[session.MacAddress] = &session
+		m.sessionMu.Unlock()
+
+		if _, err := m.openGate(session.MacAddress, sessionEndTimestamp(&session), session.Tier); err != nil {
+			log.Printf("Warning: failed to reopen gate of stored session of %s: %v", session.MacAddress, err)
+			continue
+		}
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("Restored %d stored sessions", restored)
+	}
+}
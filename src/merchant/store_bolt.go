@@ -0,0 +1,142 @@
+package merchant
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLedgerBucket   = []byte("ledger")
+	boltSessionsBucket = []byte("sessions")
+)
+
+// boltStore keeps the ledger and sessions in a BoltDB file. Ledger entries are keyed by timestamp and
+// sequence, so history queries seek to their start instead of reading everything.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLedgerBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltSessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// putLedgerEntry stores an entry under its timestamp followed by the bucket's next sequence
+func putLedgerEntry(bucket *bolt.Bucket, entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger entry: %w", err)
+	}
+	sequence, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(entry.Timestamp))
+	binary.BigEndian.PutUint64(key[8:], sequence)
+	return bucket.Put(key, data)
+}
+
+func (s *boltStore) AppendLedger(entry LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putLedgerEntry(tx.Bucket(boltLedgerBucket), entry)
+	})
+}
+
+func (s *boltStore) ImportLedger(entries []LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltLedgerBucket)
+		for _, entry := range entries {
+			if err := putLedgerEntry(bucket, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ExportLedger() ([]byte, error) {
+	entries, err := s.LedgerEntries(0)
+	if err != nil {
+		return nil, err
+	}
+	return formatLedgerLines(entries)
+}
+
+func (s *boltStore) LedgerEntries(since int64) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(max(since, 0)))
+
+		cursor := tx.Bucket(boltLedgerBucket).Cursor()
+		for key, value := cursor.Seek(start); key != nil; key, value = cursor.Next() {
+			var entry LedgerEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("invalid ledger entry %x: %w", key, err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *boltStore) SaveSessions(sessions []CustomerSession) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltSessionsBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		bucket, err := tx.CreateBucket(boltSessionsBucket)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			data, err := json.Marshal(session)
+			if err != nil {
+				return fmt.Errorf("failed to encode session of %s: %w", session.MacAddress, err)
+			}
+			if err := bucket.Put([]byte(session.MacAddress), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) LoadSessions() ([]CustomerSession, error) {
+	var sessions []CustomerSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).ForEach(func(key, value []byte) error {
+			var session CustomerSession
+			if err := json.Unmarshal(value, &session); err != nil {
+				return fmt.Errorf("invalid session of %s: %w", key, err)
+			}
+			sessions = append(sessions, session)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
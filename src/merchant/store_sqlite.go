@@ -0,0 +1,150 @@
+package merchant
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// sqliteDriver is the database/sql driver the sqlite backend opens, registered by modernc.org/sqlite where it's
+// built in, see store_sqlite_driver.go
+const sqliteDriver = "sqlite"
+
+// sqliteStore keeps the ledger and sessions in an SQLite database, entries as JSON indexed by timestamp
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s, SQLite is not built in on MIPS or with the nosqlite tag: %w", path, err)
+	}
+	// SQLite serializes writers, a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS ledger (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, entry TEXT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS ledger_timestamp ON ledger (timestamp)`,
+		`CREATE TABLE IF NOT EXISTS sessions (mac_address TEXT PRIMARY KEY, session TEXT NOT NULL)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to prepare %s: %w", path, err)
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// sqlExecer is what inserting a ledger entry needs of a database or transaction
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertLedgerEntry(db sqlExecer, entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger entry: %w", err)
+	}
+	if _, err := db.Exec(`INSERT INTO ledger (timestamp, entry) VALUES (?, ?)`, entry.Timestamp, string(data)); err != nil {
+		return fmt.Errorf("failed to write ledger entry: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) AppendLedger(entry LedgerEntry) error {
+	return insertLedgerEntry(s.db, entry)
+}
+
+func (s *sqliteStore) ImportLedger(entries []LedgerEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := insertLedgerEntry(tx, entry); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ExportLedger() ([]byte, error) {
+	entries, err := s.LedgerEntries(0)
+	if err != nil {
+		return nil, err
+	}
+	return formatLedgerLines(entries)
+}
+
+func (s *sqliteStore) LedgerEntries(since int64) ([]LedgerEntry, error) {
+	rows, err := s.db.Query(`SELECT entry FROM ledger WHERE timestamp >= ? ORDER BY timestamp, id`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("invalid ledger entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) SaveSessions(sessions []CustomerSession) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, session := range sessions {
+		data, err := json.Marshal(session)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to encode session of %s: %w", session.MacAddress, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO sessions (mac_address, session) VALUES (?, ?)`, session.MacAddress, string(data)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) LoadSessions() ([]CustomerSession, error) {
+	rows, err := s.db.Query(`SELECT session FROM sessions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []CustomerSession
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var session CustomerSession
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			return nil, fmt.Errorf("invalid session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
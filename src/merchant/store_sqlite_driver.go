@@ -0,0 +1,7 @@
+//go:build !nosqlite && (amd64 || arm64 || arm || 386 || riscv64 || loong64 || ppc64le || s390x)
+
+package merchant
+
+// Registers the pure Go SQLite driver the sqlite storage backend opens, on the architectures it supports. MIPS
+// routers build without it, as can firmware that doesn't need the backend with the nosqlite build tag.
+import _ "modernc.org/sqlite"
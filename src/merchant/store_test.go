@@ -0,0 +1,176 @@
+package merchant
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+var storeBackends = []string{config_manager.StorageJSON, config_manager.StorageBolt, config_manager.StorageSQLite}
+
+func openTestStore(t *testing.T, backend, dir string) Store {
+	t.Helper()
+	if backend == config_manager.StorageSQLite && !slices.Contains(sql.Drivers(), sqliteDriver) {
+		t.Skip("SQLite is not built in")
+	}
+	store, err := openStore(config_manager.StorageConfig{Backend: backend}, dir)
+	if err != nil {
+		t.Fatalf("Failed to open %s store: %v", backend, err)
+	}
+	return store
+}
+
+func ledgerTimestamps(t *testing.T, store Store) []int64 {
+	t.Helper()
+	data, err := store.ExportLedger()
+	if err != nil {
+		t.Fatalf("ExportLedger returned error: %v", err)
+	}
+	entries, err := parseLedgerLines(data)
+	if err != nil {
+		t.Fatalf("Failed to parse exported ledger: %v", err)
+	}
+	var timestamps []int64
+	for _, entry := range entries {
+		timestamps = append(timestamps, entry.Timestamp)
+	}
+	return timestamps
+}
+
+func loadSortedSessions(t *testing.T, store Store) []CustomerSession {
+	t.Helper()
+	sessions, err := store.LoadSessions()
+	if err != nil {
+		t.Fatalf("LoadSessions returned error: %v", err)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].MacAddress < sessions[j].MacAddress })
+	return sessions
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestStore(t, backend, dir)
+
+			for _, timestamp := range []int64{100, 200, 300} {
+				entry := LedgerEntry{Timestamp: timestamp, Type: LedgerPayment, MacAddress: "aa:bb:cc:dd:ee:ff", MintURL: "https://mint.example", Amount: 21, Allotment: 60000}
+				if err := store.AppendLedger(entry); err != nil {
+					t.Fatalf("AppendLedger returned error: %v", err)
+				}
+			}
+			if err := store.ImportLedger([]LedgerEntry{{Timestamp: 50, Type: LedgerPayment, Amount: 5}}); err != nil {
+				t.Fatalf("ImportLedger returned error: %v", err)
+			}
+			if timestamps := ledgerTimestamps(t, store); !reflect.DeepEqual(timestamps, []int64{50, 100, 200, 300}) {
+				t.Errorf("Expected the imported entry before the recorded ones, got %v", timestamps)
+			}
+
+			entries, err := store.LedgerEntries(150)
+			if backend == config_manager.StorageJSON {
+				if !errors.Is(err, ErrHistoryUnavailable) {
+					t.Errorf("Expected ErrHistoryUnavailable from flat files, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("LedgerEntries returned error: %v", err)
+				}
+				if len(entries) != 2 || entries[0].Timestamp != 200 || entries[1].Timestamp != 300 {
+					t.Errorf("Expected the entries since 150, got %+v", entries)
+				}
+				if entries[0].MintURL != "https://mint.example" || entries[0].Allotment != 60000 {
+					t.Errorf("Expected the entry to round-trip, got %+v", entries[0])
+				}
+			}
+
+			sessions := []CustomerSession{
+				{MacAddress: "aa:bb:cc:dd:ee:01", StartTime: 1000, Metric: "milliseconds", Allotment: 60000, Purchases: 1, Tier: "basic", Pubkey: "pubkey", MintURL: "https://mint.example", Paid: 21, PaidAllotment: 60000},
+				{MacAddress: "aa:bb:cc:dd:ee:02", StartTime: 2000, Metric: "bytes", Allotment: 1 << 30, UsedBytes: 4096},
+			}
+			if err := store.SaveSessions(sessions); err != nil {
+				t.Fatalf("SaveSessions returned error: %v", err)
+			}
+			if loaded := loadSortedSessions(t, store); !reflect.DeepEqual(loaded, sessions) {
+				t.Errorf("Expected sessions %+v, got %+v", sessions, loaded)
+			}
+			if err := store.SaveSessions(sessions[1:]); err != nil {
+				t.Fatalf("SaveSessions returned error: %v", err)
+			}
+			if loaded := loadSortedSessions(t, store); !reflect.DeepEqual(loaded, sessions[1:]) {
+				t.Errorf("Expected the snapshot to replace the stored sessions, got %+v", loaded)
+			}
+
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close returned error: %v", err)
+			}
+			reopened := openTestStore(t, backend, dir)
+			defer reopened.Close()
+			if timestamps := ledgerTimestamps(t, reopened); !reflect.DeepEqual(timestamps, []int64{50, 100, 200, 300}) {
+				t.Errorf("Expected the ledger to survive reopening, got %v", timestamps)
+			}
+			if loaded := loadSortedSessions(t, reopened); !reflect.DeepEqual(loaded, sessions[1:]) {
+				t.Errorf("Expected the sessions to survive reopening, got %+v", loaded)
+			}
+		})
+	}
+}
+
+func TestOpenStoreFailsInsteadOfFallingBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+	}{
+		{"bolt", config_manager.StorageBolt},
+		{"sqlite", config_manager.StorageSQLite},
+		{"unknown", "postgres"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// A directory where the database file should be can't be opened as a database
+			path := filepath.Join(dir, "database")
+			if err := os.Mkdir(path, 0700); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+
+			store, err := openStore(config_manager.StorageConfig{Backend: tt.backend, Path: path}, dir)
+			if err == nil {
+				store.Close()
+				t.Fatalf("Expected opening the %s backend to fail", tt.backend)
+			}
+			if store != nil {
+				t.Errorf("Expected no store, got %T", store)
+			}
+		})
+	}
+}
+
+func TestOpenStoreMovesFlatFileLedger(t *testing.T) {
+	for _, backend := range []string{config_manager.StorageBolt, config_manager.StorageSQLite} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			flat := openTestStore(t, config_manager.StorageJSON, dir)
+			for _, timestamp := range []int64{10, 20} {
+				if err := flat.AppendLedger(LedgerEntry{Timestamp: timestamp, Type: LedgerPayment, Amount: 1}); err != nil {
+					t.Fatalf("AppendLedger returned error: %v", err)
+				}
+			}
+
+			store := openTestStore(t, backend, dir)
+			defer store.Close()
+			if timestamps := ledgerTimestamps(t, store); !reflect.DeepEqual(timestamps, []int64{10, 20}) {
+				t.Errorf("Expected the flat file ledger to be moved into %s storage, got %v", backend, timestamps)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "ledger.jsonl.imported")); err != nil {
+				t.Errorf("Expected the flat file ledger to be retired: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subscriptionPollInterval is how often subscriptions are checked for a new day or their end
+const subscriptionPollInterval = time.Minute
+
+// subscriptionDay is the period each grant of a subscription lasts, counted from its purchase
+const subscriptionDay = 24 * time.Hour
+
+// subscription is a pass bought for a device, granting it time at the start of each of its days
+type subscription struct {
+	ID            string `json:"id"`
+	Plan          string `json:"plan"`
+	MacAddress    string `json:"mac_address"`
+	Pubkey        string `json:"pubkey"` // Subscriber, receives the renewal and expiry events
+	Tier          string `json:"tier"`
+	MinutesPerDay int    `json:"minutes_per_day"`
+	Days          int    `json:"days"`
+	StartedAt     int64  `json:"started_at"`
+	DaysGranted   int    `json:"days_granted"`
+}
+
+// expiresAt returns when the last day of the subscription ends
+func (s *subscription) expiresAt() int64 {
+	return s.StartedAt + int64(s.Days)*int64(subscriptionDay/time.Second)
+}
+
+// dueDays returns how many days of the subscription have started by now
+func (s *subscription) dueDays(now time.Time) int {
+	elapsed := now.Unix() - s.StartedAt
+	if elapsed < 0 {
+		return 0
+	}
+	return min(int(elapsed/int64(subscriptionDay/time.Second))+1, s.Days)
+}
+
+// subscriptions keeps the active subscriptions, persisted next to the wallet so they survive reboots
+type subscriptions struct {
+	mu   sync.Mutex
+	path string
+	byID map[string]*subscription
+}
+
+func newSubscriptions(path string) *subscriptions {
+	s := &subscriptions{path: path, byID: make(map[string]*subscription)}
+	data, err := utils.ReadState(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read subscriptions %s: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.byID); err != nil {
+		log.Printf("Warning: failed to parse subscriptions %s, starting empty: %v", path, err)
+		s.byID = make(map[string]*subscription)
+	}
+	return s
+}
+
+// add stores a new subscription
+func (s *subscriptions) add(sub subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[sub.ID] = &sub
+	s.save()
+}
+
+// due returns copies of the subscriptions with a day to grant or that ended by now
+func (s *subscriptions) due(now time.Time) []subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []subscription
+	for _, sub := range s.byID {
+		if sub.DaysGranted < sub.dueDays(now) || now.Unix() >= sub.expiresAt() {
+			due = append(due, *sub)
+		}
+	}
+	return due
+}
+
+// granted records that the days of a subscription up to the given one were granted
+func (s *subscriptions) granted(id string, days int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, exists := s.byID[id]; exists {
+		sub.DaysGranted = days
+		s.save()
+	}
+}
+
+// remove drops a subscription that ended
+func (s *subscriptions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, id)
+	s.save()
+}
+
+// save writes the subscriptions to the store. Caller must hold mu.
+func (s *subscriptions) save() {
+	data, err := json.Marshal(s.byID)
+	if err != nil {
+		log.Printf("Warning: failed to encode subscriptions: %v", err)
+		return
+	}
+	if err := utils.WriteState(s.path, data, 0600); err != nil {
+		log.Printf("Warning: failed to save subscriptions %s: %v", s.path, err)
+	}
+}
+
+// extractSubscription returns the plan a payment subscribes to, empty for a regular purchase
+func extractSubscription(paymentEvent nostr.Event) string {
+	if tag := paymentEvent.Tags.Find("subscription"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+// findSubscriptionPlan returns the configured plan with the ID, nil if the venue doesn't offer it
+func findSubscriptionPlan(config *config_manager.Config, planID string) *config_manager.SubscriptionPlanConfig {
+	for i := range config.Subscriptions {
+		plan := &config.Subscriptions[i]
+		if plan.ID == planID && plan.Price > 0 && plan.MinutesPerDay > 0 && plan.Days > 0 {
+			return plan
+		}
+	}
+	return nil
+}
+
+// subscriptionTag advertises a plan as ["subscription", id, price, minutes per day, days, name]
+func subscriptionTag(plan config_manager.SubscriptionPlanConfig) nostr.Tag {
+	return nostr.Tag{
+		"subscription",
+		plan.ID,
+		fmt.Sprintf("%d", plan.Price),
+		fmt.Sprintf("%d", plan.MinutesPerDay),
+		fmt.Sprintf("%d", plan.Days),
+		plan.Name,
+	}
+}
+
+// purchaseSubscription sells a pass granting the device time every day. The first day is granted right away,
+// the following ones by grantSubscriptions.
+func (m *Merchant) purchaseSubscription(paymentEvent nostr.Event, planID, paymentToken, macAddress string) (*nostr.Event, error) {
+	config := m.getConfig()
+	plan := findSubscriptionPlan(config, planID)
+	if plan == nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "subscription-not-offered",
+			fmt.Sprintf("Subscription %s is not offered here", planID), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("subscription not offered and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "payment-error-invalid-token",
+			fmt.Sprintf("Invalid cashu token: %v", err), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid cashu token and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Refuse payments short of the price before redeeming them
+	received := paymentCashuToken.Amount()
+	if received < plan.Price {
+		noticeEvent, noticeErr := m.createNoticeEventWithTags("error", "subscription-payment-insufficient",
+			fmt.Sprintf("%s costs %d sats", plan.Name, plan.Price),
+			paymentEvent.PubKey, nostr.Tag{"price", fmt.Sprintf("%d", plan.Price)})
+		if noticeErr != nil {
+			return nil, fmt.Errorf("subscription payment insufficient and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate subscription ID: %w", err)
+	}
+
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
+	if err != nil {
+		return m.redeemFailedNotice(err, paymentToken, paymentEvent.PubKey)
+	}
+	mintURL := paymentCashuToken.Mint()
+	m.checkExposure(mintURL)
+	swapFee := uint64(0)
+	if received > amountAfterSwap {
+		swapFee = received - amountAfterSwap
+	}
+
+	tier := plan.Tier
+	if tier == "" {
+		tier = determineTier(config, plan.Price)
+	}
+	sub := subscription{
+		ID:            hex.EncodeToString(idBytes),
+		Plan:          plan.ID,
+		MacAddress:    macAddress,
+		Pubkey:        paymentEvent.PubKey,
+		Tier:          tier,
+		MinutesPerDay: plan.MinutesPerDay,
+		Days:          plan.Days,
+		StartedAt:     time.Now().Unix(),
+		DaysGranted:   1,
+	}
+
+	session, err := m.grantSubscriptionDay(sub)
+	if err != nil {
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"subscription-failed", fmt.Sprintf("Failed to start subscription: %v", err))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("failed to start subscription and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	m.subscriptions.add(sub)
+	log.Printf("Subscribed %s to %s for %d days, %d minutes a day", macAddress, plan.ID, plan.Days, plan.MinutesPerDay)
+
+	iface := m.clientInterface(macAddress)
+	m.recordRevenue(mintURL, iface, amountAfterSwap)
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerSubscription,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		MintURL:    mintURL,
+		Amount:     amountAfterSwap,
+		Received:   received,
+		SwapFee:    swapFee,
+		Allotment:  subscriptionAllotment(sub),
+		Metric:     "milliseconds",
+		EventID:    paymentEvent.ID,
+		Interface:  iface,
+		Tier:       tier,
+		Plan:       plan.ID,
+	}); err != nil {
+		log.Printf("Warning: failed to record subscription of %s: %v", macAddress, err)
+	}
+
+	return m.createSessionEvent(session, paymentEvent.PubKey, append(subscriptionTags(sub),
+		nostr.Tag{"amount-received", fmt.Sprintf("%d", received)},
+		nostr.Tag{"swap-fee", fmt.Sprintf("%d", swapFee)},
+		nostr.Tag{"amount-credited", fmt.Sprintf("%d", amountAfterSwap)})...)
+}
+
+// subscriptionAllotment returns the time a subscription grants each day, in milliseconds
+func subscriptionAllotment(sub subscription) uint64 {
+	return uint64(time.Duration(sub.MinutesPerDay) * time.Minute / time.Millisecond)
+}
+
+// subscriptionTags tell the subscriber which subscription a session event belongs to and how far along it is
+func subscriptionTags(sub subscription) []nostr.Tag {
+	return []nostr.Tag{
+		{"subscription", sub.ID, sub.Plan},
+		{"subscription-day", fmt.Sprintf("%d", sub.DaysGranted), fmt.Sprintf("%d", sub.Days)},
+		{"subscription-expiration", fmt.Sprintf("%d", sub.expiresAt())},
+	}
+}
+
+// grantSubscriptionDay adds a day's time to the session of a subscribed device and opens its gate until the
+// session ends. Time left over from before carries over.
+func (m *Merchant) grantSubscriptionDay(sub subscription) (*CustomerSession, error) {
+	allotment := subscriptionAllotment(sub)
+	session, err := m.AddAllotment(sub.MacAddress, "milliseconds", allotment)
+	if err != nil {
+		return nil, err
+	}
+
+	endTimestamp := sessionEndTimestamp(session)
+	if _, err := m.openGate(sub.MacAddress, endTimestamp, sub.Tier); err != nil {
+		m.withdrawAllotment(sub.MacAddress, allotment)
+		return nil, fmt.Errorf("failed to open gate: %w", err)
+	}
+	m.setSessionTier(sub.MacAddress, sub.Tier)
+	m.extendGroupGates(sub.MacAddress, endTimestamp, sub.Tier)
+	session.Tier = sub.Tier
+	return session, nil
+}
+
+// grantSubscriptions periodically grants subscriptions the time of each day that started and ends those
+// whose last day is over. Days that passed while the gateway was down are not made up.
+func (m *Merchant) grantSubscriptions() {
+	for {
+		time.Sleep(subscriptionPollInterval)
+		m.grantSubscriptionsOnce(time.Now())
+	}
+}
+
+func (m *Merchant) grantSubscriptionsOnce(now time.Time) {
+	for _, sub := range m.subscriptions.due(now) {
+		if due := sub.dueDays(now); sub.DaysGranted < due {
+			sub.DaysGranted = due
+			session, err := m.grantSubscriptionDay(sub)
+			if err != nil {
+				// Retried on the next poll
+				log.Printf("Warning: failed to grant day %d of subscription %s to %s: %v", due, sub.ID, sub.MacAddress, err)
+				continue
+			}
+			m.subscriptions.granted(sub.ID, due)
+			log.Printf("Granted day %d of %d of subscription %s to %s", due, sub.Days, sub.ID, sub.MacAddress)
+			m.publishSubscriptionRenewal(session, sub)
+		}
+
+		if now.Unix() >= sub.expiresAt() {
+			m.subscriptions.remove(sub.ID)
+			log.Printf("Subscription %s of %s expired", sub.ID, sub.MacAddress)
+			m.publishSubscriptionExpiry(sub)
+		}
+	}
+}
+
+// publishSubscriptionRenewal sends the subscriber the session of a new day
+func (m *Merchant) publishSubscriptionRenewal(session *CustomerSession, sub subscription) {
+	sessionEvent, err := m.createSessionEvent(session, sub.Pubkey, subscriptionTags(sub)...)
+	if err != nil {
+		log.Printf("Warning: failed to create renewal of subscription %s: %v", sub.ID, err)
+		return
+	}
+	m.publisher.Publish(sessionEvent)
+}
+
+// publishSubscriptionExpiry tells the subscriber their subscription ended
+func (m *Merchant) publishSubscriptionExpiry(sub subscription) {
+	noticeEvent, err := m.createNoticeEventWithTags("info", "subscription-expired",
+		fmt.Sprintf("Your %d day subscription ended", sub.Days), sub.Pubkey,
+		nostr.Tag{"subscription", sub.ID, sub.Plan},
+		nostr.Tag{"device-identifier", "mac", sub.MacAddress})
+	if err != nil {
+		log.Printf("Warning: failed to create expiry of subscription %s: %v", sub.ID, err)
+		return
+	}
+	m.publisher.Publish(noticeEvent)
+}
@@ -0,0 +1,61 @@
+package merchant
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// TermsInfo tells the portal which terms of service customers have to accept before paying
+type TermsInfo struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"` // Named in the tos-accepted tag of payments
+}
+
+// termsRequired reports whether payments have to accept the terms of service
+func termsRequired(config config_manager.TermsConfig) bool {
+	return config.Enabled && config.Hash != ""
+}
+
+// termsInfo returns the terms customers have to accept, nil if none
+func termsInfo(config config_manager.TermsConfig) *TermsInfo {
+	if !termsRequired(config) {
+		return nil
+	}
+	return &TermsInfo{URL: config.URL, Hash: strings.ToLower(config.Hash)}
+}
+
+// termsTag advertises the terms customers have to accept, nil if none
+func termsTag(config config_manager.TermsConfig) nostr.Tag {
+	terms := termsInfo(config)
+	if terms == nil {
+		return nil
+	}
+	return nostr.Tag{"tos", terms.URL, terms.Hash}
+}
+
+// extractAcceptedTerms returns the hash of the terms a payment accepted, empty if none
+func extractAcceptedTerms(paymentEvent nostr.Event) string {
+	if tag := paymentEvent.Tags.Find("tos-accepted"); tag != nil {
+		return strings.ToLower(strings.TrimSpace(tag[1]))
+	}
+	return ""
+}
+
+// rejectUnacceptedTerms answers a payment that didn't accept the current terms of service with a notice
+// naming them, nil if the terms were accepted or none are required
+func (m *Merchant) rejectUnacceptedTerms(paymentEvent nostr.Event) (*nostr.Event, error) {
+	terms := termsInfo(m.getConfig().Terms)
+	if terms == nil || extractAcceptedTerms(paymentEvent) == terms.Hash {
+		return nil, nil
+	}
+
+	message := fmt.Sprintf("Accept the terms of service at %s before paying", terms.URL)
+	if extractAcceptedTerms(paymentEvent) != "" {
+		message = fmt.Sprintf("The terms of service changed, accept the current terms at %s before paying", terms.URL)
+	}
+	return m.createNoticeEventWithTags("error", "tos-not-accepted", message, paymentEvent.PubKey,
+		nostr.Tag{"tos", terms.URL, terms.Hash})
+}
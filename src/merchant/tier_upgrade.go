@@ -0,0 +1,175 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// extractUpgrade returns the tier a payment upgrades the active session to, empty for a regular purchase
+func extractUpgrade(paymentEvent nostr.Event) string {
+	if tag := paymentEvent.Tags.Find("upgrade"); tag != nil {
+		return tag[1]
+	}
+	return ""
+}
+
+// tierRank returns the position of a tier in the tier ladder, 0 for tiers it doesn't list
+func tierRank(ladder []config_manager.TierConfig, tier string) int {
+	for i, paid := range ladder {
+		if paid.Name == tier {
+			return i
+		}
+	}
+	return 0
+}
+
+// upgradePrice prices moving to a tier for the time left in a session, rounded up to the next sat
+func upgradePrice(pricePerHour uint64, remaining time.Duration) uint64 {
+	return (pricePerHour*uint64(remaining.Milliseconds()) + uint64(time.Hour.Milliseconds()) - 1) / uint64(time.Hour.Milliseconds())
+}
+
+// upgradeTags advertises the price per hour left of each tier a session can be upgraded to
+func upgradeTags(config *config_manager.Config) []nostr.Tag {
+	if !config.TierUpgrade.Enabled {
+		return nil
+	}
+	var tags []nostr.Tag
+	for _, tier := range config.TierLadder() {
+		if price, offered := config.TierUpgrade.PricePerHour[tier.Name]; offered && price > 0 {
+			tags = append(tags, nostr.Tag{"tier_upgrade", tier.Name, fmt.Sprintf("%d", price)})
+		}
+	}
+	return tags
+}
+
+// purchaseUpgrade moves the active session of a device to a higher tier for the rest of its time.
+// The surcharge is pro-rated to the time left and the gate keeps its end, only its limits change.
+func (m *Merchant) purchaseUpgrade(paymentEvent nostr.Event, tier, paymentToken, macAddress string) (*nostr.Event, error) {
+	config := m.getConfig().TierUpgrade
+	pricePerHour, offered := config.PricePerHour[tier]
+	if !config.Enabled || !offered || pricePerHour == 0 {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "upgrade-not-offered",
+			fmt.Sprintf("Upgrades to the %s tier are not offered here", tier), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("upgrade not offered and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	m.sessionMu.RLock()
+	var current CustomerSession
+	session, exists := m.customerSessions[macAddress]
+	active := exists && isCustomerSessionActive(session) && session.Metric == "milliseconds"
+	if active {
+		current = *session
+	}
+	m.sessionMu.RUnlock()
+
+	if !active {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "upgrade-without-session",
+			"Upgrades apply to an active time-based session, buy a session at the tier instead", paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("no session to upgrade and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	if ladder := m.getConfig().TierLadder(); tierRank(ladder, tier) <= tierRank(ladder, current.Tier) {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "upgrade-not-needed",
+			fmt.Sprintf("The session already runs at the %s tier", current.Tier), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("upgrade not needed and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
+	if err != nil {
+		noticeEvent, noticeErr := m.CreateNoticeEvent("error", "payment-error-invalid-token",
+			fmt.Sprintf("Invalid cashu token: %v", err), paymentEvent.PubKey)
+		if noticeErr != nil {
+			return nil, fmt.Errorf("invalid cashu token and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	// Refuse payments short of the surcharge before redeeming them
+	endTimestamp := sessionEndTimestamp(&current)
+	price := upgradePrice(pricePerHour, time.Until(time.Unix(endTimestamp, 0)))
+	received := paymentCashuToken.Amount()
+	if received < price {
+		noticeEvent, noticeErr := m.createNoticeEventWithTags("error", "upgrade-payment-insufficient",
+			fmt.Sprintf("Upgrading to the %s tier for the rest of the session costs %d sats", tier, price),
+			paymentEvent.PubKey, nostr.Tag{"price", fmt.Sprintf("%d", price)})
+		if noticeErr != nil {
+			return nil, fmt.Errorf("upgrade payment insufficient and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
+	if err != nil {
+		return m.redeemFailedNotice(err, paymentToken, paymentEvent.PubKey)
+	}
+	mintURL := paymentCashuToken.Mint()
+	m.checkExposure(mintURL)
+	swapFee := uint64(0)
+	if received > amountAfterSwap {
+		swapFee = received - amountAfterSwap
+	}
+
+	// Same end, new tier: the valve applies the tier's limits to the open gate
+	if _, err := m.openGate(macAddress, endTimestamp, tier); err != nil {
+		noticeEvent, noticeErr := m.refundFailedPurchase(paymentEvent, macAddress, mintURL, amountAfterSwap,
+			"gate-opening-failed", fmt.Sprintf("Failed to upgrade gate: %v", err))
+		if noticeErr != nil {
+			return nil, fmt.Errorf("failed to upgrade gate and failed to create notice: %w", noticeErr)
+		}
+		return noticeEvent, nil
+	}
+	m.setSessionTier(macAddress, tier)
+	m.extendGroupGates(macAddress, endTimestamp, tier)
+
+	iface := m.clientInterface(macAddress)
+	m.recordRevenue(mintURL, iface, amountAfterSwap)
+	if err := m.ledger.record(LedgerEntry{
+		Type:       LedgerUpgrade,
+		MacAddress: macAddress,
+		Pubkey:     paymentEvent.PubKey,
+		MintURL:    mintURL,
+		Amount:     amountAfterSwap,
+		Received:   received,
+		SwapFee:    swapFee,
+		EventID:    paymentEvent.ID,
+		Interface:  iface,
+		Tier:       tier,
+		TermsHash:  extractAcceptedTerms(paymentEvent),
+	}); err != nil {
+		log.Printf("Warning: failed to record upgrade of %s: %v", macAddress, err)
+	}
+	log.Printf("Upgraded session of %s from %s to %s until %d for %d sats", macAddress, current.Tier, tier, endTimestamp, amountAfterSwap)
+
+	upgraded := current
+	upgraded.Tier = tier
+	sessionEvent, err := m.createSessionEvent(&upgraded, paymentEvent.PubKey,
+		nostr.Tag{"upgrade", tier, current.Tier},
+		nostr.Tag{"amount-received", fmt.Sprintf("%d", received)},
+		nostr.Tag{"swap-fee", fmt.Sprintf("%d", swapFee)},
+		nostr.Tag{"amount-credited", fmt.Sprintf("%d", amountAfterSwap)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session event: %w", err)
+	}
+	return sessionEvent, nil
+}
+
+// upgradePricePerHour returns the surcharge per hour left to upgrade to a tier, 0 if not offered
+func upgradePricePerHour(config config_manager.TierUpgradeConfig, tier string) uint64 {
+	if !config.Enabled {
+		return 0
+	}
+	return config.PricePerHour[tier]
+}
@@ -0,0 +1,116 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindUsageReport is a usage report of a session: the time and traffic it consumed, signed by the gateway
+const KindUsageReport = 1023
+
+// UsageReport is what a device's session consumed. Traffic is counted since the gate last opened, which is the
+// start of the session unless the gate was reopened, e.g. after a restart.
+type UsageReport struct {
+	MacAddress   string `json:"mac_address"`
+	SessionStart int64  `json:"session_start"`
+	SecondsUsed  int64  `json:"seconds_used"`
+	Downloaded   uint64 `json:"downloaded"` // Bytes
+	Uploaded     uint64 `json:"uploaded"`   // Bytes
+	GateOpenedAt int64  `json:"gate_opened_at,omitempty"`
+	SampledAt    int64  `json:"sampled_at,omitempty"` // When the traffic was counted, 0 if it wasn't yet
+	Metric       string `json:"metric"`
+	Allotment    uint64 `json:"allotment"` // Left of the session
+}
+
+// GetUsage returns what the session of a device consumed as of the last traffic sample
+func (m *Merchant) GetUsage(macAddress string) (UsageReport, error) {
+	session, err := m.GetSession(macAddress)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	return usageReport(session, time.Now()), nil
+}
+
+// usageReport combines a session with the last traffic sample of its gate
+func usageReport(session *CustomerSession, now time.Time) UsageReport {
+	report := UsageReport{
+		MacAddress:   session.MacAddress,
+		SessionStart: session.StartTime,
+		SecondsUsed:  max(now.Unix()-session.StartTime, 0),
+		Metric:       session.Metric,
+		Allotment:    session.Allotment,
+	}
+	if usage, sampled := valve.LastUsage(session.MacAddress); sampled {
+		report.Downloaded = usage.Downloaded
+		report.Uploaded = usage.Uploaded
+		report.GateOpenedAt = usage.OpenedAt
+		report.SampledAt = usage.SampledAt
+		if usage.ClosedAt != 0 {
+			report.SecondsUsed = max(usage.ClosedAt-session.StartTime, 0)
+		}
+	}
+	return report
+}
+
+// createUsageReportEvent signs a usage report addressed to the customer who paid for the session
+func (m *Merchant) createUsageReportEvent(report UsageReport, customerPubkey string) (*nostr.Event, error) {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return nil, fmt.Errorf("identities config is nil")
+	}
+	merchantIdentity, err := identities.GetOwnedIdentity("merchant")
+	if err != nil {
+		return nil, fmt.Errorf("merchant identity not found: %w", err)
+	}
+
+	usageEvent := &nostr.Event{
+		Kind:      KindUsageReport,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"device-identifier", "mac", report.MacAddress},
+			{"start-time", fmt.Sprintf("%d", report.SessionStart)},
+			{"seconds-used", fmt.Sprintf("%d", report.SecondsUsed)},
+			{"downloaded", fmt.Sprintf("%d", report.Downloaded)},
+			{"uploaded", fmt.Sprintf("%d", report.Uploaded)},
+			{"sampled-at", fmt.Sprintf("%d", report.SampledAt)},
+			{"metric", report.Metric},
+			{"allotment", fmt.Sprintf("%d", report.Allotment)},
+		},
+		Content: "",
+	}
+	if customerPubkey != "" {
+		usageEvent.Tags = append(nostr.Tags{{"p", customerPubkey}}, usageEvent.Tags...)
+	}
+	if err := usageEvent.Sign(merchantIdentity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to sign usage report: %w", err)
+	}
+	return usageEvent, nil
+}
+
+// publishUsageReports periodically publishes a usage report of every active session
+func (m *Merchant) publishUsageReports() {
+	for {
+		config := m.getConfig().Usage
+		interval := time.Duration(config.ReportIntervalMinutes) * time.Minute
+		if !config.Enabled || interval <= 0 {
+			// Disabled, check again later in case it is enabled
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+
+		now := time.Now()
+		for _, session := range m.activeSessions() {
+			usageEvent, err := m.createUsageReportEvent(usageReport(&session, now), session.Pubkey)
+			if err != nil {
+				log.Printf("Failed to create usage report of %s: %v", session.MacAddress, err)
+				continue
+			}
+			m.publisher.Publish(usageEvent)
+		}
+	}
+}
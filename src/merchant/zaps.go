@@ -0,0 +1,334 @@
+package merchant
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/lightning"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Event kinds of a zap payment. The customer zaps their purchase request and the
+// merchant grants the session once the zap receipt shows up on its relays.
+const (
+	KindZapPurchaseRequest = 21024 // Customer asks to pay for a session with a zap
+	KindZapRequest         = 9734  // NIP-57 zap request, embedded in the receipt
+	KindZapReceipt         = 9735  // NIP-57 zap receipt, published by the Lightning address provider
+)
+
+// defaultZapRequestTTL applies when no zap request TTL is configured
+const defaultZapRequestTTL = 10 * time.Minute
+
+// zapReceiptRetention is how long receipts that granted a session are remembered. Receipts older than a purchase
+// request are refused for it anyway, so they only need to be remembered while requests created before them wait.
+const zapReceiptRetention = 24 * time.Hour
+
+// zapPurchase is a purchase request waiting for its zap receipt
+type zapPurchase struct {
+	id             string // ID of the purchase request event the customer zaps
+	macAddress     string
+	pubkey         string
+	providerPubkey string    // Key the Lightning address provider signs receipts with
+	createdAt      time.Time // Receipts published before the request was registered pay for an earlier purchase
+	expiresAt      time.Time
+	config         *config_manager.Config
+}
+
+// zapLightningAddress returns the owner's Lightning address that zaps are paid to
+func (m *Merchant) zapLightningAddress() string {
+	identities := m.configManager.GetIdentities()
+	if identities == nil {
+		return ""
+	}
+	owner, err := identities.GetPublicIdentity("owner")
+	if err != nil {
+		return ""
+	}
+	return owner.LightningAddress
+}
+
+// zapPriceTag returns the advertisement price tag for zap payments, or nil if zaps are disabled
+func zapPriceTag(configManager *config_manager.ConfigManager, config *config_manager.Config) nostr.Tag {
+	if !config.Zaps.Enabled || config.Zaps.PricePerStep == 0 {
+		return nil
+	}
+	identities := configManager.GetIdentities()
+	if identities == nil {
+		return nil
+	}
+	owner, err := identities.GetPublicIdentity("owner")
+	if err != nil || owner.LightningAddress == "" {
+		return nil
+	}
+	return nostr.Tag{
+		"price_per_step",
+		"zap",
+		fmt.Sprintf("%d", config.Zaps.PricePerStep),
+		"sats",
+		owner.LightningAddress,
+		fmt.Sprintf("%d", config.Zaps.MinPurchaseSteps),
+	}
+}
+
+// RequestZapPurchase registers a purchase request the customer pays by zapping it.
+// Returns an info notice telling the customer where to zap, or an error notice.
+func (m *Merchant) RequestZapPurchase(requestEvent nostr.Event) (*nostr.Event, error) {
+	config := m.getConfig()
+	if !config.Zaps.Enabled || config.Zaps.PricePerStep == 0 {
+		return m.CreateNoticeEvent("error", "zaps-disabled", "This TollGate does not accept zaps", requestEvent.PubKey)
+	}
+	if m.emergencyStop.halted() != nil {
+		return m.CreateNoticeEvent("error", "gateway-halted", "This TollGate is out of service, ask staff for access", requestEvent.PubKey)
+	}
+	// Receipts are found by the request ID, which the request signature doesn't cover
+	if !requestEvent.CheckID() {
+		return m.CreateNoticeEvent("error", "invalid-purchase-request",
+			"Purchase request ID does not match its content", requestEvent.PubKey)
+	}
+
+	macAddress, err := m.extractDeviceIdentifier(requestEvent)
+	if err != nil {
+		return m.CreateNoticeEvent("error", "invalid-device-identifier",
+			fmt.Sprintf("Failed to extract device identifier: %v", err), requestEvent.PubKey)
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return m.CreateNoticeEvent("error", "invalid-mac-address",
+			fmt.Sprintf("Invalid MAC address: %s", macAddress), requestEvent.PubKey)
+	}
+
+	if !m.checkCapacity(macAddress) {
+		return m.CreateNoticeEvent("error", "capacity-full",
+			"No capacity left for new sessions, try again later", requestEvent.PubKey)
+	}
+
+	lightningAddress := m.zapLightningAddress()
+	if lightningAddress == "" {
+		return m.CreateNoticeEvent("error", "zaps-disabled", "No Lightning address configured for zaps", requestEvent.PubKey)
+	}
+
+	// Receipts are only trusted if signed by the key the provider announces
+	payInfo, err := lightning.GetLNURLPayInfo(lightningAddress)
+	if err != nil {
+		log.Printf("Failed to look up Lightning address %s: %v", lightningAddress, err)
+		return m.CreateNoticeEvent("error", "zaps-unavailable",
+			"Lightning address provider is unreachable, try again later", requestEvent.PubKey)
+	}
+	if !payInfo.AllowsNostr || payInfo.NostrPubkey == "" {
+		return m.CreateNoticeEvent("error", "zaps-unavailable",
+			fmt.Sprintf("Lightning address %s does not support zaps", lightningAddress), requestEvent.PubKey)
+	}
+
+	ttl := time.Duration(config.Zaps.RequestTTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = defaultZapRequestTTL
+	}
+
+	now := time.Now()
+	purchase := &zapPurchase{
+		id:             requestEvent.ID,
+		macAddress:     macAddress,
+		pubkey:         requestEvent.PubKey,
+		providerPubkey: payInfo.NostrPubkey,
+		createdAt:      now,
+		expiresAt:      now.Add(ttl),
+		config:         config,
+	}
+
+	m.zapPurchasesMu.Lock()
+	if _, exists := m.zapPurchases[purchase.id]; exists {
+		m.zapPurchasesMu.Unlock()
+		return m.CreateNoticeEvent("error", "zap-request-duplicate",
+			"This purchase request is already waiting for a zap", requestEvent.PubKey)
+	}
+	m.zapPurchases[purchase.id] = purchase
+	m.zapPurchasesMu.Unlock()
+
+	go m.watchZapReceipts(purchase)
+
+	log.Printf("Waiting for zap receipt for purchase %s by %s until %s", purchase.id, macAddress, purchase.expiresAt.Format(time.RFC3339))
+
+	relaysTag := append(nostr.Tag{"relays"}, config.Relays...)
+	return m.createNoticeEventWithTags("info", "zap-pending",
+		fmt.Sprintf("Zap event %s via %s at %d sats per %d %s (minimum %d steps) within %s, publishing the receipt to the listed relays",
+			purchase.id, lightningAddress, config.Zaps.PricePerStep, config.StepSize, config.Metric,
+			config.Zaps.MinPurchaseSteps, ttl),
+		requestEvent.PubKey,
+		nostr.Tag{"e", purchase.id},
+		nostr.Tag{"lud16", lightningAddress},
+		relaysTag)
+}
+
+// watchZapReceipts waits for a valid zap receipt for the purchase until it expires
+func (m *Merchant) watchZapReceipts(purchase *zapPurchase) {
+	defer func() {
+		m.zapPurchasesMu.Lock()
+		delete(m.zapPurchases, purchase.id)
+		m.zapPurchasesMu.Unlock()
+	}()
+
+	pool := m.configManager.GetPublicPool()
+	ctx, cancel := context.WithDeadline(pool.Context, purchase.expiresAt)
+	defer cancel()
+
+	since := nostr.Timestamp(purchase.createdAt.Unix())
+	filter := nostr.Filter{
+		Kinds: []int{KindZapReceipt},
+		Tags:  nostr.TagMap{"e": []string{purchase.id}},
+		Since: &since,
+	}
+
+	for relayEvent := range pool.SubscribeMany(ctx, purchase.config.Relays, filter) {
+		amountSats, err := validateZapReceipt(relayEvent.Event, purchase)
+		if err == nil {
+			err = m.redeemedZapReceipts.redeem(relayEvent.Event.ID, time.Now().Add(zapReceiptRetention).Unix())
+		}
+		if err != nil {
+			log.Printf("Ignoring zap receipt %s for purchase %s: %v", relayEvent.Event.ID, purchase.id, err)
+			continue
+		}
+
+		m.grantZapPurchase(purchase, relayEvent.Event, amountSats)
+		return
+	}
+
+	log.Printf("Zap purchase %s expired without a valid receipt", purchase.id)
+}
+
+// validateZapReceipt checks a zap receipt against the purchase as described in NIP-57
+// and returns the amount paid in sats
+func validateZapReceipt(receipt *nostr.Event, purchase *zapPurchase) (uint64, error) {
+	if receipt.PubKey != purchase.providerPubkey {
+		return 0, fmt.Errorf("receipt not signed by the Lightning address provider")
+	}
+	// The receipt ID keys the redeemed receipts, the signature doesn't cover it
+	if !receipt.CheckID() {
+		return 0, fmt.Errorf("receipt ID does not match its content")
+	}
+	if ok, err := receipt.CheckSignature(); err != nil || !ok {
+		return 0, fmt.Errorf("invalid receipt signature")
+	}
+	// Relays may ignore the since filter
+	if receipt.CreatedAt.Time().Before(purchase.createdAt.Truncate(time.Second)) {
+		return 0, fmt.Errorf("receipt predates the purchase request")
+	}
+
+	descriptionTag := receipt.Tags.Find("description")
+	bolt11Tag := receipt.Tags.Find("bolt11")
+	if descriptionTag == nil || bolt11Tag == nil {
+		return 0, fmt.Errorf("receipt lacks description or bolt11 tag")
+	}
+
+	// The description is the zap request the customer signed
+	var zapRequest nostr.Event
+	if err := json.Unmarshal([]byte(descriptionTag[1]), &zapRequest); err != nil {
+		return 0, fmt.Errorf("invalid zap request in receipt: %w", err)
+	}
+	if zapRequest.Kind != KindZapRequest {
+		return 0, fmt.Errorf("embedded event has kind %d, expected %d", zapRequest.Kind, KindZapRequest)
+	}
+	if ok, err := zapRequest.CheckSignature(); err != nil || !ok {
+		return 0, fmt.Errorf("invalid zap request signature")
+	}
+	if zapRequest.PubKey != purchase.pubkey {
+		return 0, fmt.Errorf("zap request not signed by the customer")
+	}
+	if zapRequest.Tags.FindWithValue("e", purchase.id) == nil {
+		return 0, fmt.Errorf("zap request does not reference the purchase request")
+	}
+
+	// The invoice commits to the zap request, so the receipt can't pair a paid invoice with another request
+	descriptionHash, err := lightning.InvoiceDescriptionHash(bolt11Tag[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid bolt11 invoice: %w", err)
+	}
+	if expected := sha256.Sum256([]byte(descriptionTag[1])); !bytes.Equal(descriptionHash, expected[:]) {
+		return 0, fmt.Errorf("invoice description hash does not match the zap request")
+	}
+
+	amountMsat, err := lightning.InvoiceAmountMsat(bolt11Tag[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid bolt11 invoice: %w", err)
+	}
+	if amountTag := zapRequest.Tags.Find("amount"); amountTag != nil {
+		requested, err := strconv.ParseUint(amountTag[1], 10, 64)
+		if err != nil || requested != amountMsat {
+			return 0, fmt.Errorf("invoice amount %d msat does not match zap request amount %s", amountMsat, amountTag[1])
+		}
+	}
+
+	return amountMsat / 1000, nil
+}
+
+// grantZapPurchase opens the gate for a paid zap purchase and publishes the session event locally
+func (m *Merchant) grantZapPurchase(purchase *zapPurchase, receipt *nostr.Event, amountSats uint64) {
+	config := purchase.config
+
+	zapMint := zapMintConfig(config)
+	allotment, err := m.allotmentForMint(config, zapMint, amountSats, false)
+	if err == nil && allotment == 0 {
+		err = fmt.Errorf("payment doesn't cover a step")
+	}
+	if err != nil {
+		log.Printf("Zap of %d sats for purchase %s doesn't buy a session (%v), keeping it as a tip", amountSats, purchase.id, err)
+		m.publishZapNotice("error", "zap-amount-too-low",
+			fmt.Sprintf("Your zap of %d sats does not buy a session: %v", amountSats, err), purchase.pubkey)
+		return
+	}
+
+	tier := determineTier(config, amountSats)
+	metric := config.MetricFor(zapMint)
+	session, err := m.AddAllotment(purchase.macAddress, metric, allotment)
+	if err != nil {
+		log.Printf("Failed to add allotment for zap purchase %s: %v", purchase.id, err)
+		m.publishZapNotice("error", "session-management-failed",
+			fmt.Sprintf("Failed to manage session: %v", err), purchase.pubkey)
+		return
+	}
+
+	endTimestamp := sessionEndTimestamp(session)
+	if _, err := m.openGate(purchase.macAddress, endTimestamp, tier); err != nil {
+		log.Printf("Failed to open gate for zap purchase %s: %v", purchase.id, err)
+		m.publishZapNotice("error", "gate-opening-failed",
+			fmt.Sprintf("Failed to open gate for session: %v", err), purchase.pubkey)
+		return
+	}
+
+	m.setSessionTier(purchase.macAddress, tier)
+	m.recordCustomerSession(purchase.pubkey, endTimestamp)
+
+	log.Printf("Zap of %d sats granted %d %s to %s (receipt %s)", amountSats, allotment, metric, purchase.macAddress, receipt.ID)
+
+	sessionEvent, err := m.createSessionEvent(session, purchase.pubkey, nostr.Tag{"zap", receipt.ID})
+	if err != nil {
+		log.Printf("Failed to create session event for zap purchase %s: %v", purchase.id, err)
+		return
+	}
+	m.publisher.Publish(sessionEvent)
+}
+
+// zapMintConfig prices zaps like a mint in sats at the zap price, with the gateway's metric and step size
+func zapMintConfig(config *config_manager.Config) config_manager.MintConfig {
+	return config_manager.MintConfig{
+		URL:              "zap",
+		PricePerStep:     config.Zaps.PricePerStep,
+		MinPurchaseSteps: config.Zaps.MinPurchaseSteps,
+	}
+}
+
+// publishZapNotice informs a zapping customer through the local relay, as the HTTP request has already returned
+func (m *Merchant) publishZapNotice(level, code, message, customerPubkey string) {
+	noticeEvent, err := m.CreateNoticeEvent(level, code, message, customerPubkey)
+	if err != nil {
+		log.Printf("Failed to create %s notice: %v", code, err)
+		return
+	}
+	m.publisher.Publish(noticeEvent)
+}
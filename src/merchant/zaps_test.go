@@ -0,0 +1,177 @@
+package merchant
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testInvoice encodes a BOLT11 invoice with an amount and a description hash, and a blank signature that
+// validateZapReceipt doesn't check
+func testInvoice(hrp string, descriptionHash [32]byte) string {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	data := make([]byte, 7) // Timestamp
+	hash := toGroups(descriptionHash[:])
+	data = append(data, 23, byte(len(hash)>>5), byte(len(hash)&31))
+	data = append(data, hash...)
+	data = append(data, make([]byte, 104)...) // Signature
+
+	values := make([]byte, 0, len(hrp)*2+1+len(data)+6)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	values = append(values, data...)
+	values = append(values, make([]byte, 6)...)
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	checksum ^= 1
+	for i := 0; i < 6; i++ {
+		data = append(data, byte(checksum>>(5*(5-i)))&31)
+	}
+
+	invoice := []byte(hrp + "1")
+	for _, value := range data {
+		invoice = append(invoice, charset[value])
+	}
+	return string(invoice)
+}
+
+// toGroups splits bytes into 5-bit groups, padding the last one with zeros
+func toGroups(data []byte) []byte {
+	var groups []byte
+	var accumulator uint32
+	var bits uint
+	for _, b := range data {
+		accumulator = accumulator<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			groups = append(groups, byte(accumulator>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		groups = append(groups, byte(accumulator<<(5-bits))&31)
+	}
+	return groups
+}
+
+func TestValidateZapReceipt(t *testing.T) {
+	customerKey, providerKey := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	customerPubkey, _ := nostr.GetPublicKey(customerKey)
+	providerPubkey, _ := nostr.GetPublicKey(providerKey)
+	purchase := &zapPurchase{
+		id:             "5f7e1a6b0c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f",
+		pubkey:         customerPubkey,
+		providerPubkey: providerPubkey,
+		createdAt:      time.Now().Add(-time.Minute),
+		expiresAt:      time.Now().Add(time.Minute),
+	}
+
+	zapRequest := nostr.Event{
+		Kind:      KindZapRequest,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"e", purchase.id}, {"amount", "1000000"}},
+	}
+	if err := zapRequest.Sign(customerKey); err != nil {
+		t.Fatalf("Failed to sign zap request: %v", err)
+	}
+	description, _ := json.Marshal(zapRequest)
+	receiptFor := func(invoice string, createdAt time.Time) *nostr.Event {
+		receipt := &nostr.Event{
+			Kind:      KindZapReceipt,
+			CreatedAt: nostr.Timestamp(createdAt.Unix()),
+			Tags:      nostr.Tags{{"e", purchase.id}, {"bolt11", invoice}, {"description", string(description)}},
+		}
+		if err := receipt.Sign(providerKey); err != nil {
+			t.Fatalf("Failed to sign receipt: %v", err)
+		}
+		return receipt
+	}
+	paid := testInvoice("lnbc10u", sha256.Sum256(description))
+
+	receipt := receiptFor(paid, time.Now())
+	amount, err := validateZapReceipt(receipt, purchase)
+	if err != nil {
+		t.Fatalf("validateZapReceipt() failed: %v", err)
+	}
+	if amount != 1000 {
+		t.Errorf("Expected 1000 sats, got %d", amount)
+	}
+
+	tests := []struct {
+		name    string
+		receipt *nostr.Event
+	}{
+		{"edited ID", func() *nostr.Event {
+			edited := *receipt
+			edited.ID = nostr.GeneratePrivateKey()
+			return &edited
+		}()},
+		{"receipt of an earlier purchase", receiptFor(paid, purchase.createdAt.Add(-time.Hour))},
+		{"invoice for another zap request", receiptFor(testInvoice("lnbc10u", sha256.Sum256([]byte("other"))), time.Now())},
+		{"invoice without description hash", receiptFor("lnbc10u1qqqqqqq", time.Now())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if amount, err := validateZapReceipt(tt.receipt, purchase); err == nil {
+				t.Errorf("Expected the receipt to be refused, got %d sats", amount)
+			}
+		})
+	}
+
+	m := newTestMerchant(t)
+	if err := m.redeemedZapReceipts.redeem(receipt.ID, time.Now().Add(zapReceiptRetention).Unix()); err != nil {
+		t.Fatalf("Failed to redeem receipt: %v", err)
+	}
+	reopened := newRedemptionRegistry(m.redeemedZapReceipts.path, "zap receipt")
+	if err := reopened.redeem(receipt.ID, time.Now().Add(zapReceiptRetention).Unix()); err == nil {
+		t.Error("Expected a receipt that granted a session to be refused after a restart")
+	}
+}
+
+func TestRequestZapPurchaseRejectsForgedID(t *testing.T) {
+	m := newTestMerchant(t)
+	if err := m.configManager.UpdateConfig(func(config *config_manager.Config) bool {
+		config.Zaps.Enabled = true
+		config.Zaps.PricePerStep = 1
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	request := nostr.Event{
+		Kind:      KindZapPurchaseRequest,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"device-identifier", "mac", "00:11:22:33:44:07"}},
+	}
+	if err := request.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Failed to sign request: %v", err)
+	}
+	request.ID = nostr.GeneratePrivateKey()
+
+	response, err := m.RequestZapPurchase(request)
+	if err != nil {
+		t.Fatalf("RequestZapPurchase() failed: %v", err)
+	}
+	if code := noticeCode(response); code != "invalid-purchase-request" {
+		t.Errorf("Expected a forged request ID to be refused, got %q: %s", code, response.Content)
+	}
+}
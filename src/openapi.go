@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/cli"
+)
+
+// HandleOpenAPI serves the OpenAPI document of the admin API, for generating clients
+func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	spec, err := cli.OpenAPISpec()
+	if err != nil {
+		mainLogger.WithError(err).Error("Error building OpenAPI document")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
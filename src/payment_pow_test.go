@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+func TestCheckPaymentPoWRejectsForgedID(t *testing.T) {
+	config := config_manager.PaymentPoWConfig{MinDifficulty: 8, RequireOnLAN: true}
+	r := httptest.NewRequest("POST", "/", nil)
+	key := nostr.GeneratePrivateKey()
+
+	// Commits to the difficulty, but the ID it hashes to almost certainly falls short of it
+	event := nostr.Event{
+		Kind:      21000,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"nonce", "0", "8"}},
+	}
+	if err := event.Sign(key); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	for nip13.Difficulty(event.ID) >= config.MinDifficulty {
+		event.CreatedAt++
+		if err := event.Sign(key); err != nil {
+			t.Fatalf("Failed to sign event: %v", err)
+		}
+	}
+
+	forged := event
+	forged.ID = "00" + event.ID[2:]
+	if ok, _ := forged.CheckSignature(); !ok {
+		t.Fatal("Expected the signature to hold with a forged ID")
+	}
+	if err := checkPaymentPoW(&forged, r, config); err == nil {
+		t.Error("Expected a payment with a forged ID to be refused")
+	}
+
+	// The ID is mined for the pubkey, so the event is signed with the same key
+	event.Tags = nil
+	mined, err := nip13.DoWork(t.Context(), event, config.MinDifficulty)
+	if err != nil {
+		t.Fatalf("Failed to mine event: %v", err)
+	}
+	event.Tags = nostr.Tags{mined}
+	if err := event.Sign(key); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	if err := checkPaymentPoW(&event, r, config); err != nil {
+		t.Errorf("checkPaymentPoW() refused a mined payment: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package tollwallet
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Financial events reported to the auditor
+const (
+	AuditReceive = "receive"
+	AuditSend    = "send"
+	AuditMelt    = "melt"
+)
+
+// Auditor records ecash moving in or out of the wallet, e.g. in a tamper-evident log kept for accounting
+type Auditor func(action string, details map[string]string)
+
+// auditHook holds the auditor, set after the wallet is loaded while its background recovery may already run
+type auditHook struct {
+	mu      sync.RWMutex
+	auditor Auditor
+}
+
+// SetAuditor sets where receives, sends and melts are recorded, nil to stop recording them
+func (w *TollWallet) SetAuditor(auditor Auditor) {
+	w.audits.mu.Lock()
+	defer w.audits.mu.Unlock()
+	w.audits.auditor = auditor
+}
+
+// audit reports a financial event to the auditor, if any
+func (w *TollWallet) audit(action string, details map[string]string) {
+	w.audits.mu.RLock()
+	auditor := w.audits.auditor
+	w.audits.mu.RUnlock()
+	if auditor != nil {
+		auditor(action, details)
+	}
+}
+
+// sats formats an amount for the audit details
+func sats(amount uint64) string {
+	return fmt.Sprintf("%d", amount)
+}
@@ -0,0 +1,74 @@
+package tollwallet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestConcurrentWalletAccess reconfigures the wallet while payments and payouts use it.
+// It only catches data races when run with the race detector: go test -race ./...
+func TestConcurrentWalletAccess(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	wallet := &TollWallet{
+		acceptedMints: []string{mintURL},
+		pool:          newOperationPool(DefaultMaxConcurrentOperations, DefaultMaxConcurrentPerMint, DefaultQueueTimeout),
+		held:          newHeldProofs(t.TempDir()),
+		mintInfo:      newMintInfoCache(DefaultMintInfoTTL),
+	}
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(4)
+
+		// Config reloads
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				wallet.SetAcceptedMints([]string{mintURL, fmt.Sprintf("https://mint-%d.example.com", worker)})
+				wallet.SetReceiveStrategies(map[string]string{mintURL: ReceiveStrategyHold})
+				wallet.SetConcurrencyLimits(worker+1, worker+1, time.Second)
+				wallet.SetMintInfoTTL(time.Duration(i+1) * time.Second)
+			}
+		}(worker)
+
+		// Payments, rejected before they reach the mint
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := wallet.Receive(createTestToken("https://untrusted-mint.example.com"))
+				assert.Error(t, err)
+				wallet.holdsProofsFrom(mintURL)
+			}
+		}()
+
+		// Proofs held and consolidated for payouts
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				secret := fmt.Sprintf("secret-%d-%d", worker, i)
+				assert.NoError(t, wallet.held.add(mintURL, cashu.Proofs{{Amount: 1, Secret: secret, C: secret, Id: "00ad268c4d1f5826"}}))
+				wallet.held.amount(mintURL)
+				wallet.held.total()
+				if i%10 == 0 {
+					assert.NoError(t, wallet.held.remove(mintURL, wallet.held.get(mintURL)))
+				}
+			}
+		}(worker)
+
+		// Mint operations queued while the limits change
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.NoError(t, wallet.pool.run(mintURL, func() error { return nil }))
+				wallet.GetQueueMetrics()
+			}
+		}()
+	}
+	wg.Wait()
+}
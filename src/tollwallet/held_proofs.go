@@ -0,0 +1,345 @@
+package tollwallet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut07"
+	"github.com/Origami74/gonuts-tollgate/crypto"
+	"github.com/Origami74/gonuts-tollgate/wallet/client"
+)
+
+// Receive strategies per mint
+const (
+	// ReceiveStrategySwap swaps received proofs at the mint right away (default)
+	ReceiveStrategySwap = "swap"
+	// ReceiveStrategyHold keeps received proofs as-is and swaps them in one batch before they are spent.
+	// This saves a swap fee per purchase, but the customer can still double-spend held proofs,
+	// so only use it for mints and customers you trust.
+	ReceiveStrategyHold = "hold"
+)
+
+// heldProofs stores unswapped proofs per mint, persisted as JSON next to the wallet
+type heldProofs struct {
+	mu        sync.Mutex
+	path      string
+	proofs    map[string]cashu.Proofs
+	holdMints map[string]bool // Mints whose proofs are held instead of swapped
+}
+
+func newHeldProofs(walletPath string) *heldProofs {
+	h := &heldProofs{
+		path:      filepath.Join(walletPath, "held_proofs.json"),
+		proofs:    make(map[string]cashu.Proofs),
+		holdMints: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read held proofs %s: %v", h.path, err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, &h.proofs); err != nil {
+		log.Printf("Warning: failed to parse held proofs %s: %v", h.path, err)
+		h.proofs = make(map[string]cashu.Proofs)
+	}
+	return h
+}
+
+// save persists the held proofs. Caller must hold mu.
+func (h *heldProofs) save() error {
+	data, err := json.Marshal(h.proofs)
+	if err != nil {
+		return fmt.Errorf("failed to encode held proofs: %w", err)
+	}
+	// Held proofs are the ecash itself, never left to a batched flush
+	if err := utils.WriteStateDurable(h.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save held proofs: %w", err)
+	}
+	return nil
+}
+
+// add stores proofs for a mint, rejecting proofs that are already held
+func (h *heldProofs) add(mintURL string, proofs cashu.Proofs) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	held := make(map[string]struct{}, len(h.proofs[mintURL]))
+	for _, proof := range h.proofs[mintURL] {
+		held[proof.Secret] = struct{}{}
+	}
+	for _, proof := range proofs {
+		if _, exists := held[proof.Secret]; exists {
+			return fmt.Errorf("Token already spent")
+		}
+	}
+
+	h.proofs[mintURL] = append(h.proofs[mintURL], proofs...)
+	if err := h.save(); err != nil {
+		h.proofs[mintURL] = h.proofs[mintURL][:len(h.proofs[mintURL])-len(proofs)]
+		return err
+	}
+	return nil
+}
+
+// get returns a copy of the proofs held for a mint
+func (h *heldProofs) get(mintURL string) cashu.Proofs {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append(cashu.Proofs(nil), h.proofs[mintURL]...)
+}
+
+// remove drops the given proofs held for a mint, keeping those held since
+func (h *heldProofs) remove(mintURL string, proofs cashu.Proofs) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removed := make(map[string]struct{}, len(proofs))
+	for _, proof := range proofs {
+		removed[proof.Secret] = struct{}{}
+	}
+	previous := h.proofs[mintURL]
+	kept := make(cashu.Proofs, 0, len(previous))
+	for _, proof := range previous {
+		if _, drop := removed[proof.Secret]; !drop {
+			kept = append(kept, proof)
+		}
+	}
+	if len(kept) == len(previous) {
+		return nil
+	}
+
+	if len(kept) == 0 {
+		delete(h.proofs, mintURL)
+	} else {
+		h.proofs[mintURL] = kept
+	}
+	if err := h.save(); err != nil {
+		h.proofs[mintURL] = previous
+		return err
+	}
+	return nil
+}
+
+// amount returns the value held for a mint
+func (h *heldProofs) amount(mintURL string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.proofs[mintURL].Amount()
+}
+
+// total returns the value held across all mints
+func (h *heldProofs) total() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var total uint64
+	for _, proofs := range h.proofs {
+		total += proofs.Amount()
+	}
+	return total
+}
+
+// ImportHeldProofs holds proofs moved over from another gateway, skipping those already held, and returns the
+// value added. They are swapped with the other held proofs of their mint before its next payout.
+func (w *TollWallet) ImportHeldProofs(proofs map[string]cashu.Proofs) (uint64, error) {
+	var imported uint64
+	for mintURL, mintProofs := range proofs {
+		held := make(map[string]struct{})
+		for _, proof := range w.held.get(mintURL) {
+			held[proof.Secret] = struct{}{}
+		}
+		var fresh cashu.Proofs
+		for _, proof := range mintProofs {
+			if _, exists := held[proof.Secret]; !exists {
+				held[proof.Secret] = struct{}{}
+				fresh = append(fresh, proof)
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := w.held.add(mintURL, fresh); err != nil {
+			return imported, fmt.Errorf("failed to hold imported proofs from %s: %w", mintURL, err)
+		}
+		imported += fresh.Amount()
+	}
+	return imported, nil
+}
+
+// SetReceiveStrategies selects the receive strategy per mint URL. Mints without an entry are swapped.
+func (w *TollWallet) SetReceiveStrategies(strategies map[string]string) {
+	holdMints := make(map[string]bool)
+	for mintURL, strategy := range strategies {
+		if strategy == ReceiveStrategyHold {
+			holdMints[mintURL] = true
+		}
+	}
+
+	w.held.mu.Lock()
+	defer w.held.mu.Unlock()
+	w.held.holdMints = holdMints
+}
+
+// holdsProofsFrom reports whether proofs from the mint are held instead of swapped
+func (w *TollWallet) holdsProofsFrom(mintURL string) bool {
+	w.held.mu.Lock()
+	defer w.held.mu.Unlock()
+	return w.held.holdMints[mintURL]
+}
+
+// unspentProofs asks the mint which of the proofs are still unspent
+func (w *TollWallet) unspentProofs(mintURL string, proofs cashu.Proofs) (cashu.Proofs, error) {
+	states, err := w.proofStates(mintURL, proofs)
+	if err != nil {
+		return nil, err
+	}
+	return proofsInState(proofs, states, nut07.Unspent), nil
+}
+
+// proofStates asks the mint for the state of each proof through the operation pool
+func (w *TollWallet) proofStates(mintURL string, proofs cashu.Proofs) ([]nut07.State, error) {
+	var states []nut07.State
+	err := w.pool.run(mintURL, func() error {
+		var checkErr error
+		states, checkErr = proofStates(mintURL, proofs)
+		return checkErr
+	})
+	return states, err
+}
+
+// proofStates asks the mint for the state of each proof, in the order of the proofs
+func proofStates(mintURL string, proofs cashu.Proofs) ([]nut07.State, error) {
+	Ys := make([]string, len(proofs))
+	for i, proof := range proofs {
+		Y, err := crypto.HashToCurve([]byte(proof.Secret))
+		if err != nil {
+			return nil, fmt.Errorf("invalid proof secret: %w", err)
+		}
+		Ys[i] = hex.EncodeToString(Y.SerializeCompressed())
+	}
+
+	stateResponse, err := client.PostCheckProofState(mintURL, nut07.PostCheckStateRequest{Ys: Ys})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check proof state at %s: %w", mintURL, err)
+	}
+	if len(stateResponse.States) != len(Ys) {
+		return nil, fmt.Errorf("mint %s returned %d proof states for %d proofs", mintURL, len(stateResponse.States), len(Ys))
+	}
+
+	// The mint answers in request order
+	states := make([]nut07.State, len(stateResponse.States))
+	for i, state := range stateResponse.States {
+		states[i] = state.State
+	}
+	return states, nil
+}
+
+// proofsInState returns the proofs the mint reported in the state
+func proofsInState(proofs cashu.Proofs, states []nut07.State, want nut07.State) cashu.Proofs {
+	selected := make(cashu.Proofs, 0, len(proofs))
+	for i, state := range states {
+		if state == want {
+			selected = append(selected, proofs[i])
+		}
+	}
+	return selected
+}
+
+// hold verifies with the mint that the token's proofs are unspent and stores them without swapping
+func (w *TollWallet) hold(token cashu.Token) (uint64, error) {
+	mintURL := token.Mint()
+	proofs := token.Proofs()
+
+	unspent, err := w.unspentProofs(mintURL, proofs)
+	if err != nil {
+		return 0, err
+	}
+	if len(unspent) != len(proofs) {
+		return 0, fmt.Errorf("Token already spent")
+	}
+
+	if err := w.held.add(mintURL, proofs); err != nil {
+		return 0, err
+	}
+
+	log.Printf("TollWallet.Receive: Holding %d sats from %s without swapping", proofs.Amount(), mintURL)
+	w.audit(AuditReceive, map[string]string{
+		"mint":         mintURL,
+		"amount":       sats(proofs.Amount()),
+		"token_amount": sats(proofs.Amount()),
+		"held":         "true",
+	})
+	return proofs.Amount(), nil
+}
+
+// ConsolidateHeldProofs swaps all proofs held for a mint into the wallet in a single swap.
+// The proofs stay held until the swap succeeded, and the swap goes through the receive journal,
+// so a crash at any point loses neither the held proofs nor the swapped ones.
+// Proofs the customer spent elsewhere in the meantime are dropped.
+func (w *TollWallet) ConsolidateHeldProofs(mintURL string) (uint64, error) {
+	proofs := w.held.get(mintURL)
+	if len(proofs) == 0 {
+		return 0, nil
+	}
+
+	token, err := cashu.NewTokenV4(proofs, mintURL, cashu.Sat, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create token from held proofs: %w", err)
+	}
+
+	key := receiveKey(token)
+	if err := w.journal.begin(key, mintURL, proofs); err != nil {
+		w.dropSpentHeldProofs(mintURL, proofs)
+		return 0, fmt.Errorf("failed to consolidate %d held sats from %s: %w", proofs.Amount(), mintURL, err)
+	}
+
+	var amount uint64
+	err = w.pool.run(mintURL, func() error {
+		var receiveErr error
+		amount, receiveErr = w.wallet.Receive(token, false)
+		return receiveErr
+	})
+	if err != nil {
+		w.settleFailedReceive(key, mintURL, proofs, err)
+		w.dropSpentHeldProofs(mintURL, proofs)
+		return 0, fmt.Errorf("failed to consolidate %d held sats from %s: %w", proofs.Amount(), mintURL, err)
+	}
+	w.journal.finish(key, amount)
+
+	// A crash before this leaves spent proofs held, which the next consolidation drops
+	if err := w.held.remove(mintURL, proofs); err != nil {
+		log.Printf("Warning: failed to drop consolidated proofs from %s: %v", mintURL, err)
+	}
+
+	log.Printf("TollWallet: Consolidated %d held sats from %s into %d sats", proofs.Amount(), mintURL, amount)
+	return amount, nil
+}
+
+// dropSpentHeldProofs drops the held proofs the mint reports spent, by the customer elsewhere or by a swap whose
+// result the receive journal restores. The others stay held for the next attempt.
+func (w *TollWallet) dropSpentHeldProofs(mintURL string, proofs cashu.Proofs) {
+	states, err := w.proofStates(mintURL, proofs)
+	if err != nil {
+		log.Printf("Warning: could not check held proofs from %s: %v", mintURL, err)
+		return
+	}
+	spent := proofsInState(proofs, states, nut07.Spent)
+	if len(spent) == 0 {
+		return
+	}
+	if err := w.held.remove(mintURL, spent); err != nil {
+		log.Printf("Warning: failed to drop spent held proofs from %s: %v", mintURL, err)
+		return
+	}
+	log.Printf("TollWallet: %d held sats from %s were spent, dropped them", spent.Amount(), mintURL)
+}
@@ -0,0 +1,67 @@
+package tollwallet
+
+import (
+	"testing"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeldProofs(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	proofs := cashu.Proofs{
+		{Amount: 8, Secret: "secret-1", C: "c1", Id: "00ad268c4d1f5826"},
+		{Amount: 2, Secret: "secret-2", C: "c2", Id: "00ad268c4d1f5826"},
+	}
+
+	t.Run("Held proofs persist and count towards the mint", func(t *testing.T) {
+		dir := t.TempDir()
+		held := newHeldProofs(dir)
+		assert.NoError(t, held.add(mintURL, proofs))
+		assert.Equal(t, uint64(10), held.amount(mintURL))
+
+		reloaded := newHeldProofs(dir)
+		assert.Equal(t, uint64(10), reloaded.amount(mintURL))
+		assert.Equal(t, uint64(10), reloaded.total())
+	})
+
+	t.Run("Same proofs cannot be held twice", func(t *testing.T) {
+		held := newHeldProofs(t.TempDir())
+		assert.NoError(t, held.add(mintURL, proofs))
+
+		err := held.add(mintURL, proofs[:1])
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "already spent")
+		assert.Equal(t, uint64(10), held.amount(mintURL))
+	})
+
+	t.Run("Removed proofs leave the others held", func(t *testing.T) {
+		dir := t.TempDir()
+		held := newHeldProofs(dir)
+		assert.NoError(t, held.add(mintURL, proofs))
+
+		assert.Len(t, held.get(mintURL), 2)
+		assert.Equal(t, uint64(10), held.amount(mintURL), "get keeps the proofs held")
+
+		assert.NoError(t, held.remove(mintURL, proofs[:1]))
+		assert.Equal(t, uint64(2), held.amount(mintURL))
+		assert.Equal(t, uint64(2), newHeldProofs(dir).amount(mintURL))
+
+		assert.NoError(t, held.remove(mintURL, proofs))
+		assert.Empty(t, held.get(mintURL))
+	})
+
+	t.Run("Imported proofs merge with those held", func(t *testing.T) {
+		dir := t.TempDir()
+		wallet := &TollWallet{held: newHeldProofs(dir)}
+		assert.NoError(t, wallet.held.add(mintURL, proofs[:1]))
+
+		imported, err := wallet.ImportHeldProofs(map[string]cashu.Proofs{
+			mintURL:                     proofs,
+			"https://other.example.com": {{Amount: 4, Secret: "secret-3", C: "c3", Id: "00ad268c4d1f5826"}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), imported, "proofs already held are skipped")
+		assert.Equal(t, uint64(14), newHeldProofs(dir).total())
+	})
+}
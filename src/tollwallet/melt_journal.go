@@ -0,0 +1,212 @@
+package tollwallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut05"
+	"github.com/Origami74/gonuts-tollgate/wallet"
+)
+
+// meltRecheckInterval is how often melts still pending at the mint are checked again
+const meltRecheckInterval = 5 * time.Minute
+
+// MeltRecord is a melt whose proofs went to the mint, kept until the mint reports the payment paid or failed
+type MeltRecord struct {
+	QuoteID    string `json:"quote_id"`
+	MintURL    string `json:"mint_url"`
+	Amount     uint64 `json:"amount"`
+	FeeReserve uint64 `json:"fee_reserve"`
+	StartedAt  int64  `json:"started_at"`
+}
+
+// meltJournal persists the melt quotes in progress next to the wallet, so a payout interrupted by a crash is
+// finalized or its proofs reclaimed on the next start instead of staying stuck as pending
+type meltJournal struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*MeltRecord // By quote ID
+}
+
+func newMeltJournal(walletPath string) *meltJournal {
+	j := &meltJournal{
+		path:    filepath.Join(walletPath, "melt_journal.json"),
+		records: make(map[string]*MeltRecord),
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read melt journal %s: %v", j.path, err)
+		}
+		return j
+	}
+	if err := json.Unmarshal(data, &j.records); err != nil {
+		log.Printf("Warning: failed to parse melt journal %s: %v", j.path, err)
+		j.records = make(map[string]*MeltRecord)
+	}
+	return j
+}
+
+// save persists the journal. Caller must hold mu.
+func (j *meltJournal) save() error {
+	data, err := json.Marshal(j.records)
+	if err != nil {
+		return fmt.Errorf("failed to encode melt journal: %w", err)
+	}
+	// A melt is rare and moves the whole payout, so it is never left to a batched flush
+	if err := utils.WriteStateDurable(j.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save melt journal: %w", err)
+	}
+	return nil
+}
+
+// begin records a melt before its proofs are sent to the mint
+func (j *meltJournal) begin(record MeltRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.records[record.QuoteID] = &record
+	if err := j.save(); err != nil {
+		delete(j.records, record.QuoteID)
+		return err
+	}
+	return nil
+}
+
+// finish forgets a melt the mint settled
+func (j *meltJournal) finish(quoteID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.records[quoteID]; !exists {
+		return
+	}
+	delete(j.records, quoteID)
+	if err := j.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// pending returns copies of the melts not settled yet
+func (j *meltJournal) pending() []MeltRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records := make([]MeltRecord, 0, len(j.records))
+	for _, record := range j.records {
+		records = append(records, *record)
+	}
+	return records
+}
+
+// GetPendingMelts returns the melts waiting for the mint to settle them
+func (w *TollWallet) GetPendingMelts() []MeltRecord {
+	return w.melts.pending()
+}
+
+// StopMelts keeps new melts from starting and waits up to the timeout for the running one to return, so a
+// shutdown doesn't kill a payout between sending its proofs and recording the result. It returns false if a melt
+// was still running; the journal settles it on the next start then.
+func (w *TollWallet) StopMelts(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		// Never released, the wallet doesn't melt again until it is loaded anew
+		w.meltLock.Lock()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// watchPendingMelts settles the melts a crash interrupted or the mint left pending, at startup and then until
+// the mint has settled them
+func (w *TollWallet) watchPendingMelts() {
+	for {
+		w.settlePendingMelts()
+		time.Sleep(meltRecheckInterval)
+	}
+}
+
+// settlePendingMelts asks the mint for the state of each journaled melt, and of melts the wallet database holds
+// pending proofs for. A paid melt is finalized, the proofs of an unpaid one are reclaimed into the wallet, and
+// melts the mint still has pending or can't be asked about are checked again later.
+func (w *TollWallet) settlePendingMelts() {
+	// A melt in progress has a journal record but no final state yet, it is left to finish on its own
+	if !w.meltLock.TryLock() {
+		return
+	}
+	defer w.meltLock.Unlock()
+
+	records := w.melts.pending()
+	for _, quoteID := range w.wallet.GetPendingMeltQuotes() {
+		if !slices.ContainsFunc(records, func(record MeltRecord) bool { return record.QuoteID == quoteID }) {
+			records = append(records, MeltRecord{QuoteID: quoteID})
+		}
+	}
+
+	for _, record := range records {
+		quote := w.wallet.GetMeltQuoteById(record.QuoteID)
+		if quote == nil {
+			// The quote never reached the wallet database, so no proofs were set aside for it
+			w.melts.finish(record.QuoteID)
+			continue
+		}
+
+		var state *nut05.PostMeltQuoteBolt11Response
+		err := w.pool.run(quote.Mint, func() error {
+			var checkErr error
+			state, checkErr = w.wallet.CheckMeltQuoteState(record.QuoteID)
+			return checkErr
+		})
+		if errors.Is(err, wallet.ErrQuoteNotFound) {
+			w.melts.finish(record.QuoteID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: could not check pending melt %s at %s, retrying later: %v", record.QuoteID, quote.Mint, err)
+			continue
+		}
+
+		switch state.State {
+		case nut05.Paid:
+			w.melts.finish(record.QuoteID)
+			log.Printf("TollWallet: interrupted melt %s of %d sats at %s was paid, finalized it", record.QuoteID, quote.Amount, quote.Mint)
+			w.audit(AuditMelt, map[string]string{
+				"mint":        quote.Mint,
+				"quote":       record.QuoteID,
+				"amount":      sats(quote.Amount),
+				"fee_reserve": sats(quote.FeeReserve),
+				"interrupted": "true",
+			})
+			// Change of overpaid fees wasn't stored with the interrupted melt, a repair restores it from the seed
+			if len(state.Change) > 0 {
+				if err := w.ScheduleRepair(quote.Mint); err != nil {
+					log.Printf("Warning: failed to schedule recovery of melt change from %s: %v", quote.Mint, err)
+				}
+			}
+		case nut05.Unpaid:
+			w.melts.finish(record.QuoteID)
+			log.Printf("TollWallet: interrupted melt %s of %d sats at %s was not paid, reclaimed its proofs", record.QuoteID, quote.Amount, quote.Mint)
+		default:
+			log.Printf("TollWallet: melt %s of %d sats at %s is still pending at the mint", record.QuoteID, quote.Amount, quote.Mint)
+		}
+	}
+}
+
+// meltPending reports whether the wallet still holds proofs set aside for a melt quote
+func (w *TollWallet) meltPending(quoteID string) bool {
+	return slices.Contains(w.wallet.GetPendingMeltQuotes(), quoteID)
+}
@@ -0,0 +1,30 @@
+package tollwallet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeltJournal(t *testing.T) {
+	record := MeltRecord{QuoteID: "quote-1", MintURL: "https://mint.example.com", Amount: 100, FeeReserve: 2}
+
+	t.Run("Melts in progress survive a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, newMeltJournal(dir).begin(record))
+
+		pending := newMeltJournal(dir).pending()
+		assert.Len(t, pending, 1)
+		assert.Equal(t, record, pending[0])
+	})
+
+	t.Run("Settled melts are forgotten", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newMeltJournal(dir)
+		assert.NoError(t, journal.begin(record))
+
+		journal.finish(record.QuoteID)
+		assert.Empty(t, journal.pending())
+		assert.Empty(t, newMeltJournal(dir).pending())
+	})
+}
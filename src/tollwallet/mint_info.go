@@ -0,0 +1,92 @@
+package tollwallet
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut02"
+	"github.com/Origami74/gonuts-tollgate/wallet/client"
+)
+
+// DefaultMintInfoTTL is how long fetched mint fees and keysets are reused
+const DefaultMintInfoTTL = 10 * time.Minute
+
+// MintFees describes the active sat keysets of a mint and what it charges per input
+type MintFees struct {
+	InputFeePPK   uint      `json:"input_fee_ppk"` // Highest fee of the active keysets, in parts per thousand sat per input
+	ActiveKeysets []string  `json:"active_keysets"`
+	FetchedAt     time.Time `json:"fetched_at"`
+}
+
+// EstimateReceiveFee returns the swap fee for receiving a payment of the given amount.
+// The payment is assumed to consist of one proof per power of two, as wallets split amounts that way.
+func (f MintFees) EstimateReceiveFee(amount uint64) uint64 {
+	inputs := uint64(bits.OnesCount64(amount))
+	return (inputs*uint64(f.InputFeePPK) + 999) / 1000
+}
+
+// mintInfoCache keeps the fees and keysets of each mint for a TTL
+type mintInfoCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]MintFees
+}
+
+func newMintInfoCache(ttl time.Duration) *mintInfoCache {
+	return &mintInfoCache{ttl: ttl, entries: make(map[string]MintFees)}
+}
+
+// feesFromKeysets summarizes the active sat keysets of a keysets response
+func feesFromKeysets(response *nut02.GetKeysetsResponse) MintFees {
+	fees := MintFees{FetchedAt: time.Now()}
+	for _, keyset := range response.Keysets {
+		if !keyset.Active || keyset.Unit != "sat" {
+			continue
+		}
+		fees.ActiveKeysets = append(fees.ActiveKeysets, keyset.Id)
+		fees.InputFeePPK = max(fees.InputFeePPK, keyset.InputFeePpk)
+	}
+	slices.Sort(fees.ActiveKeysets)
+	return fees
+}
+
+// SetMintInfoTTL sets how long fetched mint fees and keysets are reused. A TTL of 0 restores the default.
+func (w *TollWallet) SetMintInfoTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultMintInfoTTL
+	}
+	w.mintInfo.mu.Lock()
+	defer w.mintInfo.mu.Unlock()
+	w.mintInfo.ttl = ttl
+}
+
+// GetMintFees returns the fees and active keysets of a mint, fetching them again once the cached copy expired
+func (w *TollWallet) GetMintFees(mintURL string) (MintFees, error) {
+	w.mintInfo.mu.Lock()
+	cached, exists := w.mintInfo.entries[mintURL]
+	ttl := w.mintInfo.ttl
+	w.mintInfo.mu.Unlock()
+
+	if exists && time.Since(cached.FetchedAt) < ttl {
+		return cached, nil
+	}
+
+	var response *nut02.GetKeysetsResponse
+	err := w.pool.run(mintURL, func() error {
+		var fetchErr error
+		response, fetchErr = client.GetAllKeysets(mintURL)
+		return fetchErr
+	})
+	if err != nil {
+		return MintFees{}, fmt.Errorf("failed to fetch keysets of %s: %w", mintURL, err)
+	}
+
+	fees := feesFromKeysets(response)
+	w.mintInfo.mu.Lock()
+	w.mintInfo.entries[mintURL] = fees
+	w.mintInfo.mu.Unlock()
+	return fees, nil
+}
@@ -0,0 +1,51 @@
+package tollwallet
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut02"
+)
+
+func TestEstimateReceiveFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		ppk      uint
+		amount   uint64
+		expected uint64
+	}{
+		{"No fees", 0, 21, 0},
+		{"Single proof rounds up", 100, 64, 1},
+		{"Three proofs rounds up", 100, 21, 1}, // 16 + 4 + 1
+		{"Full sat per input", 1000, 21, 3},
+		{"Many inputs", 400, 255, 4}, // 8 inputs * 0.4 sat
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fees := MintFees{InputFeePPK: tt.ppk}
+			if fee := fees.EstimateReceiveFee(tt.amount); fee != tt.expected {
+				t.Errorf("EstimateReceiveFee(%d) with %d ppk = %d, want %d", tt.amount, tt.ppk, fee, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFeesFromKeysets(t *testing.T) {
+	response := &nut02.GetKeysetsResponse{
+		Keysets: []nut02.Keyset{
+			{Id: "00b", Unit: "sat", Active: true, InputFeePpk: 100},
+			{Id: "00a", Unit: "sat", Active: true, InputFeePpk: 250},
+			{Id: "00c", Unit: "sat", Active: false, InputFeePpk: 900},
+			{Id: "00d", Unit: "usd", Active: true, InputFeePpk: 1000},
+		},
+	}
+
+	fees := feesFromKeysets(response)
+	if fees.InputFeePPK != 250 {
+		t.Errorf("expected highest active sat fee 250, got %d", fees.InputFeePPK)
+	}
+	if !slices.Equal(fees.ActiveKeysets, []string{"00a", "00b"}) {
+		t.Errorf("expected active sat keysets [00a 00b], got %v", fees.ActiveKeysets)
+	}
+}
@@ -0,0 +1,171 @@
+package tollwallet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default limits for wallet network operations
+const (
+	DefaultMaxConcurrentOperations = 8
+	DefaultMaxConcurrentPerMint    = 2
+	DefaultQueueTimeout            = 30 * time.Second
+)
+
+// MintQueueMetrics reports the load of wallet network operations against a single mint
+type MintQueueMetrics struct {
+	Waiting   int64  `json:"waiting"`
+	Active    int64  `json:"active"`
+	Completed uint64 `json:"completed"`
+	Rejected  uint64 `json:"rejected"` // Operations that timed out waiting for a slot
+	AvgWaitMs int64  `json:"avg_wait_ms"`
+}
+
+// mintMetrics accumulates the queue metrics of a mint
+type mintMetrics struct {
+	MintQueueMetrics
+	totalWait time.Duration
+}
+
+// operationPool bounds concurrent mint operations globally and per mint,
+// so a slow mint only queues its own operations instead of stalling every purchase
+type operationPool struct {
+	mu           sync.Mutex
+	global       chan struct{}
+	perMint      int
+	mintSlots    map[string]chan struct{}
+	metrics      map[string]*mintMetrics
+	queueTimeout time.Duration
+}
+
+func newOperationPool(maxOperations, maxPerMint int, queueTimeout time.Duration) *operationPool {
+	p := &operationPool{
+		mintSlots: make(map[string]chan struct{}),
+		metrics:   make(map[string]*mintMetrics),
+	}
+	p.setLimits(maxOperations, maxPerMint, queueTimeout)
+	return p
+}
+
+// setLimits replaces the limits. Running operations finish under the limits they started with.
+func (p *operationPool) setLimits(maxOperations, maxPerMint int, queueTimeout time.Duration) {
+	if maxOperations <= 0 {
+		maxOperations = DefaultMaxConcurrentOperations
+	}
+	if maxPerMint <= 0 {
+		maxPerMint = DefaultMaxConcurrentPerMint
+	}
+	if queueTimeout <= 0 {
+		queueTimeout = DefaultQueueTimeout
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.global = make(chan struct{}, maxOperations)
+	p.perMint = maxPerMint
+	p.mintSlots = make(map[string]chan struct{})
+	p.queueTimeout = queueTimeout
+}
+
+// slots returns the semaphores an operation against the mint has to acquire
+func (p *operationPool) slots(mintURL string) (chan struct{}, chan struct{}, *mintMetrics, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mintSlot, exists := p.mintSlots[mintURL]
+	if !exists {
+		mintSlot = make(chan struct{}, p.perMint)
+		p.mintSlots[mintURL] = mintSlot
+	}
+	metrics, exists := p.metrics[mintURL]
+	if !exists {
+		metrics = &mintMetrics{}
+		p.metrics[mintURL] = metrics
+	}
+	return mintSlot, p.global, metrics, p.queueTimeout
+}
+
+// run executes op once a slot for the mint and a global slot are free.
+// It fails without running op if no slot frees up within the queue timeout.
+func (p *operationPool) run(mintURL string, op func() error) error {
+	mintSlot, global, metrics, queueTimeout := p.slots(mintURL)
+
+	p.mu.Lock()
+	metrics.Waiting++
+	p.mu.Unlock()
+
+	start := time.Now()
+	timeout := time.NewTimer(queueTimeout)
+	defer timeout.Stop()
+
+	// Take the mint slot first so operations against a slow mint don't hold global slots while queued
+	acquired := 0
+	select {
+	case mintSlot <- struct{}{}:
+		acquired++
+		select {
+		case global <- struct{}{}:
+			acquired++
+		case <-timeout.C:
+		}
+	case <-timeout.C:
+	}
+
+	if acquired < 2 {
+		if acquired == 1 {
+			<-mintSlot
+		}
+		p.mu.Lock()
+		metrics.Waiting--
+		metrics.Rejected++
+		p.mu.Unlock()
+		return fmt.Errorf("mint %s is busy: no free slot after %s", mintURL, queueTimeout)
+	}
+
+	p.mu.Lock()
+	metrics.Waiting--
+	metrics.Active++
+	metrics.totalWait += time.Since(start)
+	p.mu.Unlock()
+
+	defer func() {
+		<-global
+		<-mintSlot
+
+		p.mu.Lock()
+		metrics.Active--
+		metrics.Completed++
+		p.mu.Unlock()
+	}()
+
+	return op()
+}
+
+// snapshot returns the queue metrics of every mint seen so far
+func (p *operationPool) snapshot() map[string]MintQueueMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot := make(map[string]MintQueueMetrics, len(p.metrics))
+	for mintURL, metrics := range p.metrics {
+		current := metrics.MintQueueMetrics
+		started := metrics.Completed + uint64(metrics.Active)
+		if started > 0 {
+			current.AvgWaitMs = metrics.totalWait.Milliseconds() / int64(started)
+		}
+		snapshot[mintURL] = current
+	}
+	return snapshot
+}
+
+// SetConcurrencyLimits limits concurrent network operations in total and per mint.
+// Operations waiting longer than queueTimeout for a slot fail. Zero values select the defaults.
+func (w *TollWallet) SetConcurrencyLimits(maxOperations, maxPerMint int, queueTimeout time.Duration) {
+	w.pool.setLimits(maxOperations, maxPerMint, queueTimeout)
+}
+
+// GetQueueMetrics returns the operation queue metrics per mint
+func (w *TollWallet) GetQueueMetrics() map[string]MintQueueMetrics {
+	return w.pool.snapshot()
+}
@@ -0,0 +1,95 @@
+package tollwallet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationPool(t *testing.T) {
+	t.Run("Slow mint does not block other mints", func(t *testing.T) {
+		pool := newOperationPool(4, 1, time.Second)
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		go pool.run("https://slow-mint.com", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		<-started
+
+		done := make(chan error, 1)
+		go func() {
+			done <- pool.run("https://fast-mint.com", func() error { return nil })
+		}()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("operation against another mint was blocked by the slow mint")
+		}
+		close(release)
+	})
+
+	t.Run("Per-mint limit rejects after queue timeout", func(t *testing.T) {
+		pool := newOperationPool(4, 1, 50*time.Millisecond)
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		go pool.run("https://slow-mint.com", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		<-started
+
+		err := pool.run("https://slow-mint.com", func() error { return nil })
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "busy")
+		close(release)
+
+		metrics := pool.snapshot()["https://slow-mint.com"]
+		assert.Equal(t, uint64(1), metrics.Rejected)
+	})
+
+	t.Run("Global limit bounds concurrent operations", func(t *testing.T) {
+		pool := newOperationPool(2, 2, time.Second)
+
+		var mu sync.Mutex
+		active, maxActive := 0, 0
+		var wg sync.WaitGroup
+		for _, mint := range []string{"https://a.com", "https://b.com", "https://c.com", "https://a.com"} {
+			wg.Add(1)
+			go func(mintURL string) {
+				defer wg.Done()
+				pool.run(mintURL, func() error {
+					mu.Lock()
+					active++
+					if active > maxActive {
+						maxActive = active
+					}
+					mu.Unlock()
+
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					active--
+					mu.Unlock()
+					return nil
+				})
+			}(mint)
+		}
+		wg.Wait()
+
+		assert.LessOrEqual(t, maxActive, 2)
+		var completed uint64
+		for _, metrics := range pool.snapshot() {
+			completed += metrics.Completed
+		}
+		assert.Equal(t, uint64(4), completed)
+	})
+}
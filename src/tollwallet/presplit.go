@@ -0,0 +1,287 @@
+package tollwallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+)
+
+// Denomination strategies, the proofs the wallet splits ahead of payments so sending them needs no swap
+const (
+	// DenominationPowersOfTwo keeps single proofs of each power of two up to the largest presplit amount, and pays
+	// any amount up to it by combining them (default)
+	DenominationPowersOfTwo = "powers-of-two"
+	// DenominationExact keeps bundles adding up exactly to each presplit amount, and pays those amounts only
+	DenominationExact = "exact"
+)
+
+// presplitProofs stores bundles of proofs per mint and amount, persisted as JSON next to the wallet. The wallet
+// sent them to itself, so they are no longer in the wallet database.
+type presplitProofs struct {
+	mu       sync.Mutex
+	path     string
+	bundles  map[string]map[uint64][]cashu.Proofs // By mint and bundle amount
+	strategy string
+	count    int // Bundles kept per amount, 0 disables presplitting
+}
+
+func newPresplitProofs(walletPath string) *presplitProofs {
+	p := &presplitProofs{
+		path:     filepath.Join(walletPath, "presplit_proofs.json"),
+		bundles:  make(map[string]map[uint64][]cashu.Proofs),
+		strategy: DenominationPowersOfTwo,
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read presplit proofs %s: %v", p.path, err)
+		}
+		return p
+	}
+	if err := json.Unmarshal(data, &p.bundles); err != nil {
+		log.Printf("Warning: failed to parse presplit proofs %s: %v", p.path, err)
+		p.bundles = make(map[string]map[uint64][]cashu.Proofs)
+	}
+	return p
+}
+
+// save persists the bundles. Caller must hold mu.
+func (p *presplitProofs) save() error {
+	data, err := json.Marshal(p.bundles)
+	if err != nil {
+		return fmt.Errorf("failed to encode presplit proofs: %w", err)
+	}
+	// Presplit proofs are the ecash itself, never left to a batched flush
+	if err := utils.WriteStateDurable(p.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save presplit proofs: %w", err)
+	}
+	return nil
+}
+
+// add stores a bundle for a mint
+func (p *presplitProofs) add(mintURL string, proofs cashu.Proofs) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.bundles[mintURL] == nil {
+		p.bundles[mintURL] = make(map[uint64][]cashu.Proofs)
+	}
+	amount := proofs.Amount()
+	p.bundles[mintURL][amount] = append(p.bundles[mintURL][amount], proofs)
+	if err := p.save(); err != nil {
+		p.bundles[mintURL][amount] = p.bundles[mintURL][amount][:len(p.bundles[mintURL][amount])-1]
+		return err
+	}
+	return nil
+}
+
+// take removes and returns bundles paying exactly an amount: a bundle of the amount, or else a bundle for each
+// power of two the amount is made of. It returns nil if the bundles can't make up the amount.
+func (p *presplitProofs) take(mintURL string, amount uint64) cashu.Proofs {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bundles := p.bundles[mintURL]
+	parts := []uint64{amount}
+	if len(bundles[amount]) == 0 {
+		parts = cashu.AmountSplit(amount)
+	}
+	needed := make(map[uint64]int)
+	for _, part := range parts {
+		needed[part]++
+		if len(bundles[part]) < needed[part] {
+			return nil
+		}
+	}
+
+	var proofs cashu.Proofs
+	for _, part := range parts {
+		last := len(bundles[part]) - 1
+		proofs = append(proofs, bundles[part][last]...)
+		bundles[part] = bundles[part][:last]
+	}
+	if err := p.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return proofs
+}
+
+// takeAll removes and returns all bundles of a mint
+func (p *presplitProofs) takeAll(mintURL string) cashu.Proofs {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var proofs cashu.Proofs
+	for _, bundles := range p.bundles[mintURL] {
+		for _, bundle := range bundles {
+			proofs = append(proofs, bundle...)
+		}
+	}
+	delete(p.bundles, mintURL)
+	if err := p.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return proofs
+}
+
+// amount returns the value of the bundles of a mint
+func (p *presplitProofs) amount(mintURL string) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var total uint64
+	for amount, bundles := range p.bundles[mintURL] {
+		total += amount * uint64(len(bundles))
+	}
+	return total
+}
+
+// total returns the value of the bundles across all mints
+func (p *presplitProofs) total() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var total uint64
+	for _, byAmount := range p.bundles {
+		for amount, bundles := range byAmount {
+			total += amount * uint64(len(bundles))
+		}
+	}
+	return total
+}
+
+// secrets returns the secrets of all bundled proofs
+func (p *presplitProofs) secrets() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	secrets := make(map[string]bool)
+	for _, byAmount := range p.bundles {
+		for _, bundles := range byAmount {
+			for _, bundle := range bundles {
+				for _, proof := range bundle {
+					secrets[proof.Secret] = true
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+// missing returns the bundle amounts to split for a mint to keep the configured bundles of the amounts paid
+func (p *presplitProofs) missing(mintURL string, amounts []uint64) []uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	targets := bundleAmounts(p.strategy, amounts)
+	var missing []uint64
+	for _, target := range targets {
+		for i := len(p.bundles[mintURL][target]); i < p.count; i++ {
+			missing = append(missing, target)
+		}
+	}
+	return missing
+}
+
+// bundleAmounts returns the bundles a strategy keeps to pay the amounts, smallest first
+func bundleAmounts(strategy string, amounts []uint64) []uint64 {
+	var bundles []uint64
+	if strategy == DenominationExact {
+		for _, amount := range amounts {
+			if amount > 0 && !slices.Contains(bundles, amount) {
+				bundles = append(bundles, amount)
+			}
+		}
+		slices.Sort(bundles)
+		return bundles
+	}
+
+	largest := uint64(0)
+	for _, amount := range amounts {
+		largest = max(largest, amount)
+	}
+	for power := uint64(1); power <= largest; power *= 2 {
+		bundles = append(bundles, power)
+	}
+	return bundles
+}
+
+// SetDenominations selects the denomination strategy and how many bundles of each amount are kept. A count of 0
+// stops presplitting, bundles already split are kept until they are paid or released.
+func (w *TollWallet) SetDenominations(strategy string, count int) {
+	if strategy != DenominationExact {
+		strategy = DenominationPowersOfTwo
+	}
+	w.presplit.mu.Lock()
+	defer w.presplit.mu.Unlock()
+	w.presplit.strategy = strategy
+	w.presplit.count = max(count, 0)
+}
+
+// Presplit splits proofs of a mint into the bundles the denomination strategy keeps for paying the amounts, so
+// Send pays them without a swap. It splits what the wallet database holds and returns the sats bundled.
+func (w *TollWallet) Presplit(mintURL string, amounts []uint64) (uint64, error) {
+	var bundled uint64
+	for _, amount := range w.presplit.missing(mintURL, amounts) {
+		if w.wallet.GetBalanceByMints()[mintURL] < amount {
+			break
+		}
+		var proofs cashu.Proofs
+		err := w.pool.run(mintURL, func() error {
+			var sendErr error
+			proofs, sendErr = w.wallet.Send(amount, mintURL, false)
+			return sendErr
+		})
+		if err != nil {
+			return bundled, fmt.Errorf("failed to presplit %d sats at %s: %w", amount, mintURL, err)
+		}
+		if err := w.presplit.add(mintURL, proofs); err != nil {
+			// The proofs left the wallet database, keep them rather than lose them
+			if addErr := w.held.add(mintURL, proofs); addErr != nil {
+				log.Printf("Warning: failed to keep presplit proofs from %s: %v", mintURL, addErr)
+			}
+			return bundled, err
+		}
+		bundled += amount
+	}
+	if bundled > 0 {
+		log.Printf("TollWallet: Presplit %d sats from %s", bundled, mintURL)
+	}
+	return bundled, nil
+}
+
+// ReleasePresplitProofs swaps the bundles of a mint back into the wallet, e.g. before a payout spends them
+func (w *TollWallet) ReleasePresplitProofs(mintURL string) (uint64, error) {
+	proofs := w.presplit.takeAll(mintURL)
+	if len(proofs) == 0 {
+		return 0, nil
+	}
+	// Held proofs are swapped in with the next consolidation, which keeps the proofs if the swap fails
+	if err := w.held.add(mintURL, proofs); err != nil {
+		return 0, fmt.Errorf("failed to release presplit proofs of %s: %w", mintURL, err)
+	}
+	return w.ConsolidateHeldProofs(mintURL)
+}
+
+// sendPresplit returns bundles paying exactly an amount, or nil if there are none. Bundles don't cover the
+// receiver's input fees, so they aren't used when fees are included and the mint charges them.
+func (w *TollWallet) sendPresplit(amount uint64, mintURL string, includeFees bool) cashu.Proofs {
+	if w.presplit.amount(mintURL) < amount {
+		return nil
+	}
+	if includeFees {
+		fees, err := w.GetMintFees(mintURL)
+		if err != nil || fees.InputFeePPK > 0 {
+			return nil
+		}
+	}
+	return w.presplit.take(mintURL, amount)
+}
@@ -0,0 +1,56 @@
+package tollwallet
+
+import (
+	"testing"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresplitProofs(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	proof := func(amount uint64, secret string) cashu.Proofs {
+		return cashu.Proofs{{Amount: amount, Secret: secret, C: "c-" + secret, Id: "00ad268c4d1f5826"}}
+	}
+
+	t.Run("Bundle amounts follow the strategy", func(t *testing.T) {
+		assert.Equal(t, []uint64{1, 2, 4, 8}, bundleAmounts(DenominationPowersOfTwo, []uint64{3, 12}))
+		assert.Equal(t, []uint64{3, 12}, bundleAmounts(DenominationExact, []uint64{12, 3, 0, 12}))
+		assert.Empty(t, bundleAmounts(DenominationPowersOfTwo, []uint64{0}))
+	})
+
+	t.Run("Exact bundles are taken first and persist", func(t *testing.T) {
+		dir := t.TempDir()
+		presplit := newPresplitProofs(dir)
+		assert.NoError(t, presplit.add(mintURL, append(proof(8, "a"), proof(4, "b")...)))
+		assert.NoError(t, presplit.add(mintURL, proof(4, "c")))
+		assert.Equal(t, uint64(16), newPresplitProofs(dir).amount(mintURL))
+
+		taken := presplit.take(mintURL, 12)
+		assert.Equal(t, uint64(12), taken.Amount())
+		assert.Len(t, taken, 2)
+		assert.Equal(t, uint64(4), presplit.amount(mintURL))
+	})
+
+	t.Run("Amounts are combined from powers of two", func(t *testing.T) {
+		presplit := newPresplitProofs(t.TempDir())
+		for i, amount := range []uint64{1, 2, 4} {
+			assert.NoError(t, presplit.add(mintURL, proof(amount, string(rune('a'+i)))))
+		}
+
+		assert.Nil(t, presplit.take(mintURL, 9))
+		assert.Equal(t, uint64(7), presplit.amount(mintURL))
+
+		assert.Equal(t, uint64(5), presplit.take(mintURL, 5).Amount())
+		assert.Equal(t, uint64(2), presplit.total())
+		assert.True(t, presplit.secrets()["b"])
+	})
+
+	t.Run("Missing bundles up to the configured count", func(t *testing.T) {
+		presplit := newPresplitProofs(t.TempDir())
+		presplit.strategy, presplit.count = DenominationExact, 2
+		assert.NoError(t, presplit.add(mintURL, proof(8, "a")))
+
+		assert.Equal(t, []uint64{3, 3, 8}, presplit.missing(mintURL, []uint64{8, 3}))
+	})
+}
@@ -0,0 +1,304 @@
+package tollwallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut07"
+)
+
+// States of a receive in the journal
+const (
+	ReceivePending    = "pending"    // Intent recorded, the swap may or may not have reached the mint
+	ReceiveDone       = "done"       // Swapped and stored in the wallet
+	ReceiveRecovering = "recovering" // The mint swapped the proofs, the new ones are restored from the seed on load
+)
+
+// receiveJournalRetention is how long finished receives are remembered to recognise a token received again
+const receiveJournalRetention = 7 * 24 * time.Hour
+
+// ErrAlreadyReceived is returned for a token the wallet already received or is receiving
+var ErrAlreadyReceived = errors.New("Token already spent")
+
+// ReceiveRecord is a receive tracked through record intent, swap, persist and mark done
+type ReceiveRecord struct {
+	Key       string       `json:"key"`
+	MintURL   string       `json:"mint_url"`
+	State     string       `json:"state"`
+	Amount    uint64       `json:"amount"`           // Value of the token, or of the stored proofs once done
+	Proofs    cashu.Proofs `json:"proofs,omitempty"` // Kept while pending to check their state after a crash
+	UpdatedAt int64        `json:"updated_at"`
+}
+
+// receiveJournal persists receives in progress next to the wallet, so a crash between the swap at the mint
+// and storing the proofs is noticed on the next start instead of losing or double counting the token
+type receiveJournal struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*ReceiveRecord
+}
+
+func newReceiveJournal(walletPath string) *receiveJournal {
+	j := &receiveJournal{
+		path:    filepath.Join(walletPath, "receive_journal.json"),
+		records: make(map[string]*ReceiveRecord),
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read receive journal %s: %v", j.path, err)
+		}
+		return j
+	}
+	if err := json.Unmarshal(data, &j.records); err != nil {
+		log.Printf("Warning: failed to parse receive journal %s: %v", j.path, err)
+		j.records = make(map[string]*ReceiveRecord)
+	}
+	return j
+}
+
+// receiveKey is the idempotency key of a token: its proofs can only be redeemed once, so their secrets identify it
+func receiveKey(token cashu.Token) string {
+	secrets := make([]string, 0, len(token.Proofs()))
+	for _, proof := range token.Proofs() {
+		secrets = append(secrets, proof.Secret)
+	}
+	sort.Strings(secrets)
+
+	hash := sha256.New()
+	for _, secret := range secrets {
+		hash.Write([]byte(secret))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// save persists the journal, dropping finished receives past their retention. Durable saves are on flash when
+// they return, others are batched like other state rewritten on every payment. Caller must hold mu.
+func (j *receiveJournal) save(durable bool) error {
+	cutoff := time.Now().Add(-receiveJournalRetention).Unix()
+	for key, record := range j.records {
+		if record.State == ReceiveDone && record.UpdatedAt < cutoff {
+			delete(j.records, key)
+		}
+	}
+
+	data, err := json.Marshal(j.records)
+	if err != nil {
+		return fmt.Errorf("failed to encode receive journal: %w", err)
+	}
+	write := utils.WriteState
+	if durable {
+		write = utils.WriteStateDurable
+	}
+	if err := write(j.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save receive journal: %w", err)
+	}
+	return nil
+}
+
+// begin records the intent to receive a token before it is swapped, refusing a token already in the journal.
+// The intent is synced to flash first: the outputs of the swap are derived from the wallet seed at the keyset
+// counter the wallet database keeps, so with the intent and the seed the new proofs can be restored from the mint
+// however the swap was interrupted.
+func (j *receiveJournal) begin(key, mintURL string, proofs cashu.Proofs) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if record, exists := j.records[key]; exists {
+		return fmt.Errorf("%w (receive %s)", ErrAlreadyReceived, record.State)
+	}
+	j.records[key] = &ReceiveRecord{
+		Key:       key,
+		MintURL:   mintURL,
+		State:     ReceivePending,
+		Amount:    proofs.Amount(),
+		Proofs:    proofs,
+		UpdatedAt: time.Now().Unix(),
+	}
+	if err := j.save(true); err != nil {
+		delete(j.records, key)
+		return err
+	}
+	return nil
+}
+
+// finish marks a receive done with the amount stored in the wallet
+func (j *receiveJournal) finish(key string, amount uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record, exists := j.records[key]
+	if !exists {
+		return
+	}
+	record.State = ReceiveDone
+	record.Amount = amount
+	record.Proofs = nil
+	record.UpdatedAt = time.Now().Unix()
+	if err := j.save(false); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// abort forgets a receive that never reached the mint or was rejected by it, so the token can be paid again
+func (j *receiveJournal) abort(key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.records[key]; !exists {
+		return
+	}
+	delete(j.records, key)
+	if err := j.save(false); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// markRecovering marks a receive the mint swapped and whose proofs a scheduled balance repair restores
+func (j *receiveJournal) markRecovering(key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record, exists := j.records[key]
+	if !exists {
+		return
+	}
+	record.State = ReceiveRecovering
+	record.UpdatedAt = time.Now().Unix()
+	if err := j.save(true); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// recovered marks the recovering receives from a mint done once a balance repair restored its proofs, and returns
+// copies of them
+func (j *receiveJournal) recovered(mintURL string) []ReceiveRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var records []ReceiveRecord
+	for _, record := range j.records {
+		if record.State == ReceiveRecovering && record.MintURL == mintURL {
+			record.State = ReceiveDone
+			record.Proofs = nil
+			record.UpdatedAt = time.Now().Unix()
+			records = append(records, *record)
+		}
+	}
+	if len(records) > 0 {
+		if err := j.save(false); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return records
+}
+
+// pending returns copies of the receives interrupted before they were marked done
+func (j *receiveJournal) pending() []ReceiveRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var records []ReceiveRecord
+	for _, record := range j.records {
+		if record.State == ReceivePending {
+			records = append(records, *record)
+		}
+	}
+	return records
+}
+
+// settle decides from the state of its proofs at the mint what an interrupted or failed receive left behind.
+// The swap is atomic, so a token with unspent proofs was not received and is dropped, leaving it to the customer.
+// If the mint spent all proofs the swap went through but its result was lost: a balance repair is scheduled, which
+// restores the new proofs from the seed (NUT-09) and moves the keyset counter past them, as later swaps would
+// reuse their outputs otherwise. Proofs still pending at the mint are checked again later.
+func (j *receiveJournal) settle(walletPath string, record ReceiveRecord, states []nut07.State) {
+	if len(proofsInState(record.Proofs, states, nut07.Unspent)) > 0 {
+		log.Printf("TollWallet: interrupted receive of %d sats from %s never reached the mint, dropped it", record.Amount, record.MintURL)
+		j.abort(record.Key)
+		return
+	}
+	if len(proofsInState(record.Proofs, states, nut07.Spent)) != len(record.Proofs) {
+		log.Printf("TollWallet: receive of %d sats from %s is still pending at the mint", record.Amount, record.MintURL)
+		return
+	}
+	if err := scheduleRepair(walletPath, record.MintURL); err != nil {
+		log.Printf("CRITICAL: failed to schedule restoring the receive of %d sats from %s, retrying at the next start: %v",
+			record.Amount, record.MintURL, err)
+		return
+	}
+	j.markRecovering(record.Key)
+	log.Printf("TollWallet: receive of %d sats from %s was swapped at the mint but not stored, restoring it from the seed",
+		record.Amount, record.MintURL)
+}
+
+// recoverInterruptedReceives settles the receives a crash interrupted before the wallet is loaded, so the balance
+// repairs it schedules restore their proofs on this start. Receives whose mint can't be reached at boot are left
+// to recoverReceives.
+func recoverInterruptedReceives(walletPath string, journal *receiveJournal) {
+	for _, record := range journal.pending() {
+		states, err := proofStates(record.MintURL, record.Proofs)
+		if err != nil {
+			log.Printf("Warning: could not check interrupted receive of %d sats from %s at boot: %v", record.Amount, record.MintURL, err)
+			continue
+		}
+		journal.settle(walletPath, record, states)
+	}
+}
+
+// settleRepairs marks the receives restored by the balance repairs applied while the wallet was loaded done
+func settleRepairs(journal *receiveJournal, repairs []BalanceRepair) {
+	for _, repair := range repairs {
+		if repair.Error != "" {
+			continue
+		}
+		for _, record := range journal.recovered(repair.MintURL) {
+			log.Printf("TollWallet: restored interrupted receive of %d sats from %s", record.Amount, record.MintURL)
+		}
+	}
+}
+
+// recoverReceives settles the receives still pending once the wallet runs, because their mint couldn't be
+// reached at boot. Their proofs are restored at the next start, as the wallet database can't be changed under the
+// running wallet. Receives whose mint still can't be reached stay pending.
+func (w *TollWallet) recoverReceives() {
+	for _, record := range w.journal.pending() {
+		states, err := w.proofStates(record.MintURL, record.Proofs)
+		if err != nil {
+			log.Printf("Warning: could not recover interrupted receive of %d sats from %s: %v", record.Amount, record.MintURL, err)
+			continue
+		}
+		w.journal.settle(w.walletPath, record, states)
+	}
+}
+
+// settleFailedReceive decides what a failed swap left behind. A token the mint refused as spent was not received,
+// after any other failure the state of its proofs tells, see settle. If the mint can't be asked, the receive stays
+// pending for the next start.
+func (w *TollWallet) settleFailedReceive(key, mintURL string, proofs cashu.Proofs, receiveErr error) {
+	if strings.Contains(receiveErr.Error(), "already spent") {
+		w.journal.abort(key)
+		return
+	}
+	states, err := w.proofStates(mintURL, proofs)
+	if err != nil {
+		log.Printf("Warning: could not settle failed receive from %s, retrying at the next start: %v", mintURL, err)
+		return
+	}
+	log.Printf("TollWallet: receive of %d sats from %s failed: %v", proofs.Amount(), mintURL, receiveErr)
+	w.journal.settle(w.walletPath, ReceiveRecord{Key: key, MintURL: mintURL, Amount: proofs.Amount(), Proofs: proofs}, states)
+}
@@ -0,0 +1,99 @@
+package tollwallet
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut07"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveJournal(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	proofs := cashu.Proofs{
+		{Amount: 8, Secret: "secret-1", C: "c1", Id: "00ad268c4d1f5826"},
+		{Amount: 2, Secret: "secret-2", C: "c2", Id: "00ad268c4d1f5826"},
+	}
+	key := receiveKey(createTestToken(mintURL))
+
+	t.Run("Interrupted receives survive a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newReceiveJournal(dir)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+
+		pending := newReceiveJournal(dir).pending()
+		assert.Len(t, pending, 1)
+		assert.Equal(t, uint64(10), pending[0].Amount)
+		assert.Len(t, pending[0].Proofs, 2)
+	})
+
+	t.Run("A token is received once", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newReceiveJournal(dir)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+
+		err := journal.begin(key, mintURL, proofs)
+		assert.True(t, errors.Is(err, ErrAlreadyReceived))
+
+		journal.finish(key, 9)
+		assert.Empty(t, journal.pending())
+		err = newReceiveJournal(dir).begin(key, mintURL, proofs)
+		assert.True(t, errors.Is(err, ErrAlreadyReceived))
+	})
+
+	t.Run("Aborted receives can be tried again", func(t *testing.T) {
+		journal := newReceiveJournal(t.TempDir())
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+		journal.abort(key)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+	})
+
+	t.Run("Receives the mint didn't swap are dropped", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newReceiveJournal(dir)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+
+		journal.settle(dir, journal.pending()[0], []nut07.State{nut07.Spent, nut07.Unspent})
+		assert.Empty(t, journal.pending())
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+		_, err := os.Stat(repairsPath(dir))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Receives pending at the mint are checked again", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newReceiveJournal(dir)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+
+		journal.settle(dir, journal.pending()[0], []nut07.State{nut07.Spent, nut07.Pending})
+		assert.Len(t, journal.pending(), 1)
+	})
+
+	t.Run("Swapped receives are restored by a balance repair", func(t *testing.T) {
+		dir := t.TempDir()
+		journal := newReceiveJournal(dir)
+		assert.NoError(t, journal.begin(key, mintURL, proofs))
+
+		journal.settle(dir, journal.pending()[0], []nut07.State{nut07.Spent, nut07.Spent})
+		assert.Empty(t, journal.pending())
+		data, err := os.ReadFile(repairsPath(dir))
+		assert.NoError(t, err)
+		var mints []string
+		assert.NoError(t, json.Unmarshal(data, &mints))
+		assert.Equal(t, []string{mintURL}, mints)
+
+		// The recovering state survives a restart, until a repair of the mint succeeded
+		journal = newReceiveJournal(dir)
+		settleRepairs(journal, []BalanceRepair{{MintURL: mintURL, Error: "mint unreachable"}})
+		assert.Equal(t, ReceiveRecovering, journal.records[key].State)
+		settleRepairs(journal, []BalanceRepair{{MintURL: mintURL, Recovered: 9}})
+		assert.Equal(t, ReceiveDone, journal.records[key].State)
+		assert.Empty(t, journal.records[key].Proofs)
+
+		err = journal.begin(key, mintURL, proofs)
+		assert.True(t, errors.Is(err, ErrAlreadyReceived))
+	})
+}
@@ -0,0 +1,297 @@
+package tollwallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut07"
+	"github.com/Origami74/gonuts-tollgate/wallet"
+	"github.com/Origami74/gonuts-tollgate/wallet/client"
+	"github.com/Origami74/gonuts-tollgate/wallet/storage"
+)
+
+// QuarantineSpent marks a stored proof the mint reports spent, removed by a balance repair
+const QuarantineSpent = "spent"
+
+// BalanceReconciliation compares the balance the wallet tracks for a mint with the balance the mint confirms:
+// the unspent proofs it signed for the wallet seed, found by restoring them (NUT-09, NUT-07), and the held proofs
+// it reports unspent. Presplit proofs were split from the seed too, so they count as tracked.
+type BalanceReconciliation struct {
+	MintURL     string `json:"mint_url"`
+	CheckedAt   int64  `json:"checked_at"`
+	Tracked     uint64 `json:"tracked"`      // Balance of the wallet database
+	Restored    uint64 `json:"restored"`     // Unspent proofs restored from the seed
+	HeldTracked uint64 `json:"held_tracked"` // Held proofs counted in the balance
+	HeldUnspent uint64 `json:"held_unspent"` // Held proofs the mint reports unspent
+	Presplit    uint64 `json:"presplit"`     // Presplit proofs, restored with the seed
+	// Tracked minus confirmed sats: positive if the wallet counts sats it no longer has, negative if it lost track
+	// of sats it owns
+	Drift int64  `json:"drift"`
+	Error string `json:"error,omitempty"` // Set if the reconciliation could not run, Drift is not meaningful then
+}
+
+// BalanceRepair is the outcome of a scheduled balance repair, applied while the wallet is loaded
+type BalanceRepair struct {
+	MintURL    string `json:"mint_url"`
+	RepairedAt int64  `json:"repaired_at"`
+	Removed    uint64 `json:"removed"`   // Sats of stored proofs the mint reports spent, moved to the quarantine
+	Recovered  uint64 `json:"recovered"` // Sats of unspent proofs restored from the seed that were missing
+	// Keyset counters moved past outputs the mint already signed, swaps would fail on them otherwise
+	CountersMoved int    `json:"counters_moved"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Reconcile compares the tracked balance of a mint with the balance the mint confirms. It restores the wallet
+// seed into a scratch wallet, which takes many requests to the mint, so it runs outside the operation pool
+// rather than hold up payments to the mint.
+func (w *TollWallet) Reconcile(mintURL string) BalanceReconciliation {
+	report := BalanceReconciliation{MintURL: mintURL, CheckedAt: time.Now().Unix()}
+
+	tracked := w.wallet.GetBalanceByMints()[mintURL]
+	presplit := w.presplit.amount(mintURL)
+	restored, err := restoreFromSeed(w.wallet.Mnemonic(), mintURL, nil)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	// A payment or withdrawal during the restore moves the balance, the next run compares again
+	if w.wallet.GetBalanceByMints()[mintURL] != tracked || w.presplit.amount(mintURL) != presplit {
+		report.Error = "wallet balance changed during reconciliation"
+		return report
+	}
+	report.Tracked = tracked
+	report.Restored = restored.Amount()
+	report.Presplit = presplit
+
+	w.held.mu.Lock()
+	held := slices.Clone(w.held.proofs[mintURL])
+	w.held.mu.Unlock()
+	if len(held) > 0 {
+		unspent, err := w.unspentProofs(mintURL, held)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		report.HeldTracked = held.Amount()
+		report.HeldUnspent = unspent.Amount()
+	}
+
+	report.Drift = int64(report.Tracked+report.Presplit+report.HeldTracked) - int64(report.Restored+report.HeldUnspent)
+	return report
+}
+
+// restoreFromSeed restores the unspent proofs the mint signed for the seed into a scratch wallet and returns
+// them. If counters isn't nil, it is filled with the keyset counters the restore reached.
+func restoreFromSeed(mnemonic, mintURL string, counters map[string]uint32) (cashu.Proofs, error) {
+	// Without these the restore skips the mint and finds nothing, which would look like all sats are gone
+	info, err := client.GetMintInfo(mintURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of %s: %w", mintURL, err)
+	}
+	if !info.Nuts.Nut07.Supported || !info.Nuts.Nut09.Supported {
+		return nil, fmt.Errorf("mint %s doesn't support restoring proofs (NUT-07 and NUT-09)", mintURL)
+	}
+
+	scratchPath, err := os.MkdirTemp("", "tollwallet-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch wallet: %w", err)
+	}
+	defer os.RemoveAll(scratchPath)
+
+	if _, err := wallet.Restore(scratchPath, mnemonic, []string{mintURL}); err != nil {
+		return nil, fmt.Errorf("failed to restore proofs from %s: %w", mintURL, err)
+	}
+	scratch, err := wallet.InitStorage(scratchPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scratch wallet: %w", err)
+	}
+	defer scratch.Close()
+
+	if counters != nil {
+		for _, keyset := range scratch.GetKeysets()[mintURL] {
+			counters[keyset.Id] = scratch.GetKeysetCounter(keyset.Id)
+		}
+	}
+	return scratch.GetProofs(), nil
+}
+
+// repairsPath is the file listing the mints to repair the next time the wallet is loaded
+func repairsPath(walletPath string) string {
+	return filepath.Join(walletPath, "balance_repairs.json")
+}
+
+// ScheduleRepair repairs the balance of a mint the next time the wallet is loaded, as the wallet database can't
+// be changed under the running wallet. The repair removes stored proofs the mint reports spent, adds unspent
+// proofs restored from the seed that are missing, and moves keyset counters past outputs already signed.
+func (w *TollWallet) ScheduleRepair(mintURL string) error {
+	return scheduleRepair(w.walletPath, mintURL)
+}
+
+// scheduleRepair adds a mint to the balance repairs applied the next time the wallet at walletPath is loaded
+func scheduleRepair(walletPath, mintURL string) error {
+	path := repairsPath(walletPath)
+	var mints []string
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &mints); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if slices.Contains(mints, mintURL) {
+		return nil
+	}
+
+	data, err := json.Marshal(append(mints, mintURL))
+	if err != nil {
+		return fmt.Errorf("failed to encode scheduled repairs: %w", err)
+	}
+	if err := utils.WriteStateDurable(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to schedule repair: %w", err)
+	}
+	log.Printf("TollWallet: balance repair of %s scheduled for the next start", mintURL)
+	return nil
+}
+
+// GetRepairs returns the outcome of the balance repairs applied when the wallet was loaded
+func (w *TollWallet) GetRepairs() []BalanceRepair {
+	return w.repairs
+}
+
+// applyRepairs runs the scheduled balance repairs before the wallet is loaded. Repairs that failed, e.g. because
+// the mint was unreachable at boot, stay scheduled for the next start. Proofs in presplit are outside the wallet
+// database on purpose and are not recovered into it.
+func applyRepairs(walletPath string, presplit *presplitProofs) []BalanceRepair {
+	path := repairsPath(walletPath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read scheduled balance repairs %s: %v", path, err)
+		}
+		return nil
+	}
+	var mints []string
+	if err := json.Unmarshal(data, &mints); err != nil {
+		log.Printf("Warning: failed to parse scheduled balance repairs %s: %v", path, err)
+		return nil
+	}
+	if len(mints) == 0 {
+		return nil
+	}
+
+	db, err := wallet.InitStorage(walletPath)
+	if err != nil {
+		log.Printf("Warning: failed to open wallet database for balance repairs: %v", err)
+		return nil
+	}
+	defer db.Close()
+
+	presplitSecrets := presplit.secrets()
+	var repairs []BalanceRepair
+	var pending []string
+	for _, mintURL := range mints {
+		repair := repairBalance(walletPath, db, mintURL, presplitSecrets)
+		if repair.Error != "" {
+			log.Printf("Warning: balance repair of %s failed, retrying at the next start: %s", mintURL, repair.Error)
+			pending = append(pending, mintURL)
+		} else {
+			log.Printf("TollWallet: repaired balance of %s, removed %d spent sats, recovered %d sats, moved %d keyset counters",
+				mintURL, repair.Removed, repair.Recovered, repair.CountersMoved)
+		}
+		repairs = append(repairs, repair)
+	}
+
+	if len(pending) == 0 {
+		err = os.Remove(path)
+	} else if data, err = json.Marshal(pending); err == nil {
+		err = utils.WriteStateDurable(path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to update scheduled balance repairs %s: %v", path, err)
+	}
+	return repairs
+}
+
+// repairBalance brings the proofs of a mint in the wallet database in line with the mint, leaving out the proofs
+// with the skipped secrets
+func repairBalance(walletPath string, db storage.WalletDB, mintURL string, skip map[string]bool) BalanceRepair {
+	repair := BalanceRepair{MintURL: mintURL, RepairedAt: time.Now().Unix()}
+
+	var stored cashu.Proofs
+	for _, keyset := range db.GetKeysets()[mintURL] {
+		stored = append(stored, db.GetProofsByKeysetId(keyset.Id)...)
+	}
+
+	// Only proofs the mint reports spent are removed, pending ones may still come back
+	if len(stored) > 0 {
+		states, err := proofStates(mintURL, stored)
+		if err != nil {
+			repair.Error = err.Error()
+			return repair
+		}
+		spent := proofsInState(stored, states, nut07.Spent)
+		if len(spent) > 0 {
+			quarantined := make([]QuarantinedProof, len(spent))
+			for i, proof := range spent {
+				quarantined[i] = QuarantinedProof{MintURL: mintURL, Reason: QuarantineSpent, Proof: proof}
+			}
+			if err := appendQuarantine(walletPath, quarantined); err != nil {
+				repair.Error = err.Error()
+				return repair
+			}
+			for _, proof := range spent {
+				if err := db.DeleteProof(proof.Secret); err != nil {
+					repair.Error = fmt.Sprintf("failed to remove spent proof: %v", err)
+					return repair
+				}
+				repair.Removed += proof.Amount
+			}
+		}
+	}
+
+	counters := make(map[string]uint32)
+	restored, err := restoreFromSeed(db.GetMnemonic(), mintURL, counters)
+	if err != nil {
+		repair.Error = err.Error()
+		return repair
+	}
+
+	known := make(map[string]bool, len(stored))
+	for _, proof := range stored {
+		known[proof.Secret] = true
+	}
+	var missing cashu.Proofs
+	for _, proof := range restored {
+		if !known[proof.Secret] && !skip[proof.Secret] {
+			missing = append(missing, proof)
+		}
+	}
+	if len(missing) > 0 {
+		if err := db.SaveProofs(missing); err != nil {
+			repair.Error = fmt.Sprintf("failed to save recovered proofs: %v", err)
+			return repair
+		}
+		repair.Recovered = missing.Amount()
+	}
+
+	for keysetID, restoredCounter := range counters {
+		if db.GetKeyset(keysetID) == nil {
+			continue
+		}
+		if current := db.GetKeysetCounter(keysetID); restoredCounter > current {
+			if err := db.IncrementKeysetCounter(keysetID, restoredCounter-current); err != nil {
+				repair.Error = fmt.Sprintf("failed to move keyset counter: %v", err)
+				return repair
+			}
+			repair.CountersMoved++
+		}
+	}
+	return repair
+}
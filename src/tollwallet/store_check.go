@@ -0,0 +1,195 @@
+package tollwallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/wallet"
+	"github.com/Origami74/gonuts-tollgate/wallet/storage"
+)
+
+// Reasons a proof is quarantined by the store check
+const (
+	QuarantineDuplicate     = "duplicate"      // Same proof stored twice, it can only be spent once
+	QuarantineUnknownKeyset = "unknown-keyset" // Signed by a keyset the wallet has no keys for
+	QuarantineInvalidAmount = "invalid-amount" // Zero or so large it is a wrapped negative number
+)
+
+// maxProofAmount is the largest amount a sane proof carries; anything above looks like an underflow
+const maxProofAmount = uint64(1) << 62
+
+// QuarantinedProof is a proof moved out of the wallet because it would miscount the balance
+type QuarantinedProof struct {
+	MintURL string      `json:"mint_url,omitempty"`
+	Reason  string      `json:"reason"`
+	Held    bool        `json:"held"` // From the held proofs rather than the wallet database
+	Proof   cashu.Proof `json:"proof"`
+}
+
+// StoreCheckReport is the result of the consistency check run when the wallet is loaded
+type StoreCheckReport struct {
+	CheckedAt         int64              `json:"checked_at"`
+	ProofsChecked     int                `json:"proofs_checked"`
+	Quarantined       []QuarantinedProof `json:"quarantined,omitempty"`
+	QuarantinedAmount uint64             `json:"quarantined_amount"`
+	Error             string             `json:"error,omitempty"` // Set if the check could not run
+}
+
+// suspiciousProofs returns the proofs that can't be trusted to count toward the balance.
+// keysetMints maps the keyset IDs the wallet knows to their mint. The first copy of a duplicate is kept.
+func suspiciousProofs(stored cashu.Proofs, keysetMints map[string]string, held map[string]cashu.Proofs) []QuarantinedProof {
+	var suspects []QuarantinedProof
+	seenSignatures := make(map[string]bool, len(stored))
+	seenSecrets := make(map[string]bool, len(stored))
+
+	for _, proof := range stored {
+		mintURL, knownKeyset := keysetMints[proof.Id]
+		switch {
+		case proof.Amount == 0 || proof.Amount > maxProofAmount:
+			suspects = append(suspects, QuarantinedProof{MintURL: mintURL, Reason: QuarantineInvalidAmount, Proof: proof})
+		case !knownKeyset:
+			suspects = append(suspects, QuarantinedProof{Reason: QuarantineUnknownKeyset, Proof: proof})
+		case seenSignatures[proof.C]:
+			suspects = append(suspects, QuarantinedProof{MintURL: mintURL, Reason: QuarantineDuplicate, Proof: proof})
+		default:
+			seenSignatures[proof.C] = true
+			seenSecrets[proof.Secret] = true
+		}
+	}
+
+	// Held proofs come from mints the wallet may have no keys for, so only amounts and duplicates are checked
+	for mintURL, proofs := range held {
+		for _, proof := range proofs {
+			switch {
+			case proof.Amount == 0 || proof.Amount > maxProofAmount:
+				suspects = append(suspects, QuarantinedProof{MintURL: mintURL, Reason: QuarantineInvalidAmount, Held: true, Proof: proof})
+			case seenSecrets[proof.Secret]:
+				suspects = append(suspects, QuarantinedProof{MintURL: mintURL, Reason: QuarantineDuplicate, Held: true, Proof: proof})
+			default:
+				seenSecrets[proof.Secret] = true
+			}
+		}
+	}
+
+	return suspects
+}
+
+// checkStore runs the consistency check on the wallet database and held proofs before the wallet is loaded,
+// and moves suspicious proofs to quarantined_proofs.json so they don't count toward the balance
+func checkStore(walletPath string, held *heldProofs) StoreCheckReport {
+	report := StoreCheckReport{CheckedAt: time.Now().Unix()}
+
+	var stored cashu.Proofs
+	keysetMints := make(map[string]string)
+	var db storage.WalletDB
+
+	if _, err := os.Stat(filepath.Join(walletPath, "wallet.db")); err == nil {
+		store, err := wallet.InitStorage(walletPath)
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to open wallet database: %v", err)
+			return report
+		}
+		defer store.Close()
+		db = store
+
+		stored = store.GetProofs()
+		for mintURL, keysets := range store.GetKeysets() {
+			for _, keyset := range keysets {
+				keysetMints[keyset.Id] = mintURL
+			}
+		}
+	}
+
+	held.mu.Lock()
+	defer held.mu.Unlock()
+
+	report.ProofsChecked = len(stored)
+	for _, proofs := range held.proofs {
+		report.ProofsChecked += len(proofs)
+	}
+
+	suspects := suspiciousProofs(stored, keysetMints, held.proofs)
+	if len(suspects) == 0 {
+		return report
+	}
+
+	if err := appendQuarantine(walletPath, suspects); err != nil {
+		// Without a copy on disk the proofs stay where they are, miscounted but not lost
+		report.Error = err.Error()
+		return report
+	}
+
+	heldChanged := false
+	for _, suspect := range suspects {
+		if suspect.Held {
+			held.proofs[suspect.MintURL] = removeProof(held.proofs[suspect.MintURL], suspect.Proof)
+			heldChanged = true
+		} else {
+			// The database is keyed by secret, so a duplicate signature under another secret is removed on its own
+			if err := db.DeleteProof(suspect.Proof.Secret); err != nil {
+				log.Printf("Warning: failed to remove quarantined proof from the wallet database: %v", err)
+				continue
+			}
+		}
+		report.Quarantined = append(report.Quarantined, suspect)
+		report.QuarantinedAmount += suspect.Proof.Amount
+	}
+	if heldChanged {
+		if err := held.save(); err != nil {
+			report.Error = err.Error()
+		}
+	}
+
+	log.Printf("CRITICAL: quarantined %d proofs worth %d sats found inconsistent in the wallet store",
+		len(report.Quarantined), report.QuarantinedAmount)
+	return report
+}
+
+// removeProof drops the first proof with the same secret and signature
+func removeProof(proofs cashu.Proofs, target cashu.Proof) cashu.Proofs {
+	for i, proof := range proofs {
+		if proof.Secret == target.Secret && proof.C == target.C {
+			return append(proofs[:i], proofs[i+1:]...)
+		}
+	}
+	return proofs
+}
+
+// appendQuarantine adds proofs to the quarantine file next to the wallet, keeping earlier entries
+func appendQuarantine(walletPath string, proofs []QuarantinedProof) error {
+	path := filepath.Join(walletPath, "quarantined_proofs.json")
+
+	var quarantined []QuarantinedProof
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &quarantined); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	data, err := json.MarshalIndent(append(quarantined, proofs...), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantined proofs: %w", err)
+	}
+	if err := utils.WriteStateDurable(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save quarantined proofs: %w", err)
+	}
+	return nil
+}
+
+// ImportQuarantine adds proofs quarantined on another gateway to the quarantine file, keeping earlier entries
+func (w *TollWallet) ImportQuarantine(proofs []QuarantinedProof) error {
+	return appendQuarantine(w.walletPath, proofs)
+}
+
+// GetStoreCheck returns the result of the consistency check run when the wallet was loaded
+func (w *TollWallet) GetStoreCheck() StoreCheckReport {
+	return w.storeCheck
+}
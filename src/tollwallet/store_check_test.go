@@ -0,0 +1,69 @@
+package tollwallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuspiciousProofs(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	keysetMints := map[string]string{"00ad268c4d1f5826": mintURL}
+
+	stored := cashu.Proofs{
+		{Amount: 8, Secret: "secret-1", C: "c1", Id: "00ad268c4d1f5826"},
+		{Amount: 8, Secret: "secret-2", C: "c1", Id: "00ad268c4d1f5826"},
+		{Amount: 4, Secret: "secret-3", C: "c3", Id: "00ffffffffffffff"},
+		{Amount: ^uint64(0) - 3, Secret: "secret-4", C: "c4", Id: "00ad268c4d1f5826"},
+		{Amount: 2, Secret: "secret-5", C: "c5", Id: "00ad268c4d1f5826"},
+	}
+	held := map[string]cashu.Proofs{
+		mintURL: {
+			{Amount: 8, Secret: "secret-1", C: "c1", Id: "00ad268c4d1f5826"},
+			{Amount: 1, Secret: "secret-6", C: "c6", Id: "00ad268c4d1f5826"},
+		},
+	}
+
+	suspects := suspiciousProofs(stored, keysetMints, held)
+
+	reasons := make(map[string]string, len(suspects))
+	for _, suspect := range suspects {
+		key := suspect.Proof.Secret
+		if suspect.Held {
+			key = "held:" + key
+		}
+		reasons[key] = suspect.Reason
+	}
+	assert.Equal(t, map[string]string{
+		"secret-2":      QuarantineDuplicate,
+		"secret-3":      QuarantineUnknownKeyset,
+		"secret-4":      QuarantineInvalidAmount,
+		"held:secret-1": QuarantineDuplicate,
+	}, reasons)
+}
+
+func TestCheckStoreQuarantinesHeldProofs(t *testing.T) {
+	mintURL := "https://mint.example.com"
+	dir := t.TempDir()
+
+	held := newHeldProofs(dir)
+	assert.NoError(t, held.add(mintURL, cashu.Proofs{
+		{Amount: 8, Secret: "secret-1", C: "c1", Id: "00ad268c4d1f5826"},
+		{Amount: 0, Secret: "secret-2", C: "c2", Id: "00ad268c4d1f5826"},
+	}))
+
+	report := checkStore(dir, held)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, 2, report.ProofsChecked)
+	assert.Len(t, report.Quarantined, 1)
+	assert.Equal(t, QuarantineInvalidAmount, report.Quarantined[0].Reason)
+
+	// The suspect is moved out of the held proofs and kept in the quarantine file
+	assert.Equal(t, uint64(8), newHeldProofs(dir).amount(mintURL))
+	data, err := os.ReadFile(filepath.Join(dir, "quarantined_proofs.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "secret-2")
+}
@@ -3,9 +3,12 @@ package tollwallet
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/lightning"
 	"github.com/Origami74/gonuts-tollgate/cashu"
+	"github.com/Origami74/gonuts-tollgate/cashu/nuts/nut05"
 	"github.com/Origami74/gonuts-tollgate/wallet"
 )
 
@@ -13,7 +16,29 @@ import (
 type TollWallet struct {
 	wallet                     *wallet.Wallet
 	acceptedMints              []string
+	acceptedMintsMu            sync.RWMutex
 	allowAndSwapUntrustedMints bool
+	// Bounds concurrent network operations so a slow mint doesn't stall the others
+	pool *operationPool
+	// Proofs received from mints with the hold strategy, swapped in before they are spent
+	held *heldProofs
+	// Proofs split ahead of payments for the common amounts, sent without a swap
+	presplit *presplitProofs
+	// Fees and keysets of the mints, refreshed after a TTL
+	mintInfo *mintInfoCache
+	// Receives in progress, to recover the ones a crash interrupted
+	journal *receiveJournal
+	// Melts sent to the mint and not settled yet, and a lock held while melting that shutdown waits for
+	melts    *meltJournal
+	meltLock sync.RWMutex
+	// Where receives, sends and melts are recorded for accounting
+	audits auditHook
+	// Consistency check of the stored proofs run before the wallet was loaded
+	storeCheck StoreCheckReport
+	// Scheduled balance repairs applied before the wallet was loaded
+	repairs []BalanceRepair
+	// Directory of the wallet database, where balance repairs are scheduled
+	walletPath string
 }
 
 // New creates a new Cashu wallet instance
@@ -28,6 +53,19 @@ func New(walletPath string, acceptedMints []string, allowAndSwapUntrustedMints b
 		return nil, fmt.Errorf("No mints provided. Wallet requires at least 1 accepted mint, none were provided")
 	}
 
+	// Quarantine proofs that would miscount the balance before the wallet loads them
+	held := newHeldProofs(walletPath)
+	storeCheck := checkStore(walletPath, held)
+	if storeCheck.Error != "" {
+		log.Printf("Warning: wallet store check incomplete: %s", storeCheck.Error)
+	}
+	presplit := newPresplitProofs(walletPath)
+	// Receives a crash interrupted after the swap schedule a repair, which restores their proofs from the seed
+	journal := newReceiveJournal(walletPath)
+	recoverInterruptedReceives(walletPath, journal)
+	repairs := applyRepairs(walletPath, presplit)
+	settleRepairs(journal, repairs)
+
 	config := wallet.Config{WalletPath: walletPath, CurrentMintURL: acceptedMints[0]}
 	log.Printf("TollWallet.New: Loading wallet with config: %+v", config)
 
@@ -40,11 +78,25 @@ func New(walletPath string, acceptedMints []string, allowAndSwapUntrustedMints b
 		return nil, fmt.Errorf("failed to create wallet: %w", err)
 	}
 
-	return &TollWallet{
+	tollWallet := &TollWallet{
 		wallet:                     cashuWallet,
 		acceptedMints:              acceptedMints,
 		allowAndSwapUntrustedMints: allowAndSwapUntrustedMints,
-	}, nil
+		pool:                       newOperationPool(DefaultMaxConcurrentOperations, DefaultMaxConcurrentPerMint, DefaultQueueTimeout),
+		held:                       held,
+		presplit:                   presplit,
+		mintInfo:                   newMintInfoCache(DefaultMintInfoTTL),
+		journal:                    journal,
+		melts:                      newMeltJournal(walletPath),
+		storeCheck:                 storeCheck,
+		repairs:                    repairs,
+		walletPath:                 walletPath,
+	}
+	// The mints may not be reachable yet at boot, so receives left pending are settled again in the background
+	go tollWallet.recoverReceives()
+	go tollWallet.watchPendingMelts()
+
+	return tollWallet, nil
 }
 
 func (w *TollWallet) Receive(token cashu.Token) (uint64, error) {
@@ -55,7 +107,7 @@ func (w *TollWallet) Receive(token cashu.Token) (uint64, error) {
 	swapToTrusted := false
 
 	// If mint is untrusted, check if operator allows swapping or rejects untrusted mints.
-	if !contains(w.acceptedMints, mint) {
+	if !w.isAcceptedMint(mint) {
 		if !w.allowAndSwapUntrustedMints {
 			err := fmt.Errorf("Token rejected. Token for mint %s is not accepted and wallet does not allow swapping of untrusted mints.", mint)
 			log.Printf("TollWallet.Receive: %v", err)
@@ -65,13 +117,37 @@ func (w *TollWallet) Receive(token cashu.Token) (uint64, error) {
 		log.Printf("TollWallet.Receive: Token will be swapped to trusted mint")
 	}
 
+	if !swapToTrusted && w.holdsProofsFrom(mint) {
+		return w.hold(token)
+	}
+
+	// Record the intent before the swap, so a crash before the proofs are stored is recovered on the next start
+	key := receiveKey(token)
+	if err := w.journal.begin(key, mint, token.Proofs()); err != nil {
+		log.Printf("TollWallet.Receive: %v", err)
+		return 0, err
+	}
+
 	log.Printf("TollWallet.Receive: Calling wallet.Receive")
-	amountAfterSwap, err := w.wallet.Receive(token, swapToTrusted)
+	var amountAfterSwap uint64
+	err := w.pool.run(mint, func() error {
+		var receiveErr error
+		amountAfterSwap, receiveErr = w.wallet.Receive(token, swapToTrusted)
+		return receiveErr
+	})
 	if err != nil {
 		log.Printf("TollWallet.Receive: wallet.Receive failed: %v", err)
+		w.settleFailedReceive(key, mint, token.Proofs(), err)
 		return 0, err
 	}
+	w.journal.finish(key, amountAfterSwap)
 	log.Printf("TollWallet.Receive: Successfully received %d sats", amountAfterSwap)
+	w.audit(AuditReceive, map[string]string{
+		"mint":         mint,
+		"amount":       sats(amountAfterSwap),
+		"token_amount": sats(token.Amount()),
+		"swapped":      fmt.Sprintf("%t", swapToTrusted),
+	})
 
 	return amountAfterSwap, err
 }
@@ -79,7 +155,34 @@ func (w *TollWallet) Receive(token cashu.Token) (uint64, error) {
 func (w *TollWallet) Send(amount uint64, mintUrl string, includeFees bool) (cashu.Token, error) {
 	log.Printf("TollWallet.Send: attempting to send %d sats from mint %s (includeFees=%t)", amount, mintUrl, includeFees)
 
-	proofs, err := w.wallet.Send(amount, mintUrl, includeFees)
+	if proofs := w.sendPresplit(amount, mintUrl, includeFees); proofs != nil {
+		token, err := cashu.NewTokenV4(proofs, mintUrl, cashu.Sat, true)
+		if err != nil {
+			// Swapped back in with the held proofs rather than lost
+			if addErr := w.held.add(mintUrl, proofs); addErr != nil {
+				log.Printf("Warning: failed to keep presplit proofs from %s: %v", mintUrl, addErr)
+			}
+			return nil, fmt.Errorf("Failed to create token: %w", err)
+		}
+		log.Printf("TollWallet.Send: sent %d sats in %d presplit proofs", amount, len(proofs))
+		w.audit(AuditSend, map[string]string{"mint": mintUrl, "amount": sats(proofs.Amount()), "presplit": "true"})
+		return token, nil
+	}
+
+	w.consolidateBeforeSpending(mintUrl)
+	// Bundles that can't pay the amount exactly are swapped back in if the wallet needs them
+	if w.wallet.GetBalanceByMints()[mintUrl] < amount {
+		if _, err := w.ReleasePresplitProofs(mintUrl); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	var proofs cashu.Proofs
+	err := w.pool.run(mintUrl, func() error {
+		var sendErr error
+		proofs, sendErr = w.wallet.Send(amount, mintUrl, includeFees)
+		return sendErr
+	})
 	if err != nil {
 		log.Printf("TollWallet.Send: wallet.Send failed: %v", err)
 		return nil, fmt.Errorf("Failed to send %d to %s: %w", amount, mintUrl, err)
@@ -97,7 +200,7 @@ func (w *TollWallet) Send(amount uint64, mintUrl string, includeFees bool) (cash
 	totalProofAmount := uint64(0)
 	for i, proof := range proofs {
 		totalProofAmount += proof.Amount
-		log.Printf("TollWallet.Send: proof[%d]: amount=%d, secret=%s...", i, proof.Amount, proof.Secret[:min(10, len(proof.Secret))])
+		log.Printf("TollWallet.Send: proof[%d]: amount=%d", i, proof.Amount)
 	}
 	log.Printf("TollWallet.Send: total proof amount=%d (requested=%d)", totalProofAmount, amount)
 
@@ -108,11 +211,14 @@ func (w *TollWallet) Send(amount uint64, mintUrl string, includeFees bool) (cash
 	}
 
 	log.Printf("TollWallet.Send: successfully created token")
+	w.audit(AuditSend, map[string]string{"mint": mintUrl, "amount": sats(totalProofAmount)})
 	return token, nil
 }
 
 // SendWithOverpayment sends tokens with overpayment capability using gonuts SendWithOptions
 func (w *TollWallet) SendWithOverpayment(amount uint64, mintUrl string, maxOverpaymentPercent uint64, MaxOverpaymentAbsolute uint64) (string, error) {
+	w.consolidateBeforeSpending(mintUrl)
+
 	// Set up send options with overpayment capability
 	options := wallet.SendOptions{
 		IncludeFees:            true,
@@ -122,7 +228,12 @@ func (w *TollWallet) SendWithOverpayment(amount uint64, mintUrl string, maxOverp
 	}
 
 	// Use the gonuts SendWithOptions method
-	result, err := w.wallet.SendWithOptions(amount, mintUrl, options)
+	var result *wallet.SendResult
+	err := w.pool.run(mintUrl, func() error {
+		var sendErr error
+		result, sendErr = w.wallet.SendWithOptions(amount, mintUrl, options)
+		return sendErr
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to send with overpayment to %s: %w", mintUrl, err)
 	}
@@ -141,6 +252,11 @@ func (w *TollWallet) SendWithOverpayment(amount uint64, mintUrl string, maxOverp
 
 	log.Printf("Send successful with %d%% overpayment tolerance: requested=%d, overpayment=%d",
 		maxOverpaymentPercent, result.RequestedAmount, result.Overpayment)
+	w.audit(AuditSend, map[string]string{
+		"mint":        mintUrl,
+		"amount":      sats(result.Proofs.Amount()),
+		"overpayment": sats(result.Overpayment),
+	})
 
 	return tokenString, nil
 }
@@ -149,6 +265,20 @@ func ParseToken(token string) (cashu.Token, error) {
 	return cashu.DecodeToken(token)
 }
 
+// SetAcceptedMints replaces the mints whose tokens are received without swapping
+func (w *TollWallet) SetAcceptedMints(mintURLs []string) {
+	w.acceptedMintsMu.Lock()
+	defer w.acceptedMintsMu.Unlock()
+	w.acceptedMints = append([]string{}, mintURLs...)
+}
+
+// isAcceptedMint reports whether tokens of a mint are received without swapping
+func (w *TollWallet) isAcceptedMint(mintURL string) bool {
+	w.acceptedMintsMu.RLock()
+	defer w.acceptedMintsMu.RUnlock()
+	return contains(w.acceptedMints, mintURL)
+}
+
 // contains checks if a string exists in a slice of strings
 func contains(slice []string, str string) bool {
 	for _, item := range slice {
@@ -159,9 +289,9 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
-// GetBalance returns the current balance of the wallet
+// GetBalance returns the current balance of the wallet, including held and presplit proofs
 func (w *TollWallet) GetBalance() uint64 {
-	balance := w.wallet.GetBalance()
+	balance := w.wallet.GetBalance() + w.held.total() + w.presplit.total()
 
 	return balance
 }
@@ -170,10 +300,18 @@ func (w *TollWallet) GetBalance() uint64 {
 func (w *TollWallet) GetBalanceByMint(mintUrl string) uint64 {
 	balanceByMints := w.wallet.GetBalanceByMints()
 
+	kept := w.held.amount(mintUrl) + w.presplit.amount(mintUrl)
 	if balance, exists := balanceByMints[mintUrl]; exists {
-		return balance
+		return balance + kept
+	}
+	return kept
+}
+
+// consolidateBeforeSpending swaps in held proofs so they can be spent
+func (w *TollWallet) consolidateBeforeSpending(mintUrl string) {
+	if _, err := w.ConsolidateHeldProofs(mintUrl); err != nil {
+		log.Printf("Warning: %v", err)
 	}
-	return 0
 }
 
 // MeltToLightning melts a token to a lightning invoice using LNURL
@@ -181,6 +319,12 @@ func (w *TollWallet) GetBalanceByMint(mintUrl string) uint64 {
 func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCost uint64, lnurl string) error {
 	log.Printf("Attempting to melt %d sats to LNURL %s with max %d sats", targetAmount, lnurl, maxCost)
 
+	// Payouts spend the whole balance, including the bundles kept for payments
+	if _, err := w.ReleasePresplitProofs(mintUrl); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	w.consolidateBeforeSpending(mintUrl)
+
 	// Start with the aimed payment amount
 	currentAmount := targetAmount
 	maxAttempts := 10
@@ -202,7 +346,12 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 		}
 
 		// Try to pay the invoice using the wallet
-		meltQuote, meltQuoteErr := w.wallet.RequestMeltQuote(invoice, mintUrl)
+		var meltQuote *nut05.PostMeltQuoteBolt11Response
+		meltQuoteErr := w.pool.run(mintUrl, func() error {
+			var err error
+			meltQuote, err = w.wallet.RequestMeltQuote(invoice, mintUrl)
+			return err
+		})
 
 		if meltQuoteErr != nil {
 			log.Printf("Error requesting melt quote for %s: %v", mintUrl, meltQuoteErr)
@@ -219,17 +368,61 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 			continue
 		}
 
-		meltResult, meltErr := w.wallet.Melt(meltQuote.Quote)
+		// Recorded before the proofs go to the mint, so a crash mid-melt is settled on the next start
+		if !w.meltLock.TryRLock() {
+			return fmt.Errorf("wallet is shutting down, melt of %d sats from %s not started", currentAmount, mintUrl)
+		}
+		record := MeltRecord{
+			QuoteID:    meltQuote.Quote,
+			MintURL:    mintUrl,
+			Amount:     meltQuote.Amount,
+			FeeReserve: meltQuote.FeeReserve,
+			StartedAt:  time.Now().Unix(),
+		}
+		if err := w.melts.begin(record); err != nil {
+			w.meltLock.RUnlock()
+			return err
+		}
+
+		var meltResult *nut05.PostMeltQuoteBolt11Response
+		meltErr := w.pool.run(mintUrl, func() error {
+			var err error
+			meltResult, err = w.wallet.Melt(meltQuote.Quote)
+			return err
+		})
+		pending := w.meltPending(meltQuote.Quote)
+		if !pending {
+			w.melts.finish(meltQuote.Quote)
+		}
+		w.meltLock.RUnlock()
 
 		if meltErr != nil {
 			log.Printf("Error melting quote %s for %s: %v", meltQuote.Quote, mintUrl, meltErr)
+			// The payment may still go through, paying another invoice could pay twice
+			if pending {
+				return fmt.Errorf("melt %s of %d sats at %s is pending, it is settled in the background: %w",
+					meltQuote.Quote, currentAmount, mintUrl, meltErr)
+			}
 			meltError = meltErr
 			attempts++
 			continue
 		}
+		if meltResult.State == nut05.Unpaid {
+			log.Printf("Mint %s did not pay melt quote %s, its proofs are back in the wallet", mintUrl, meltQuote.Quote)
+			meltError = fmt.Errorf("mint did not pay melt quote %s", meltQuote.Quote)
+			attempts++
+			continue
+		}
 
 		log.Printf("meltResult: %s", meltResult.State)
 		log.Printf("Successfully melted %d sats with %d sats in fees", currentAmount, meltResult.FeeReserve)
+		w.audit(AuditMelt, map[string]string{
+			"mint":              mintUrl,
+			"quote":             meltQuote.Quote,
+			"amount":            sats(meltQuote.Amount),
+			"fee_reserve":       sats(meltQuote.FeeReserve),
+			"lightning_address": lnurl,
+		})
 		return nil
 
 	}
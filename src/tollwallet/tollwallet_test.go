@@ -103,7 +103,7 @@ func TestReceive(t *testing.T) {
 		token := createTestToken("https://unaccepted-mint.com")
 
 		// Call the function being tested - should reject before trying to use wallet
-		err, _ := tollWallet.Receive(token)
+		_, err := tollWallet.Receive(token)
 
 		// Assert expectations
 		assert.Error(t, err)
@@ -145,3 +145,12 @@ func TestContains(t *testing.T) {
 		assert.False(t, result)
 	})
 }
+
+func TestSetAcceptedMints(t *testing.T) {
+	wallet := &TollWallet{acceptedMints: []string{"https://old-mint.com"}}
+
+	wallet.SetAcceptedMints([]string{"https://new-mint.com"})
+
+	assert.True(t, wallet.isAcceptedMint("https://new-mint.com"))
+	assert.False(t, wallet.isAcceptedMint("https://old-mint.com"))
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DHCPLease is a single entry of the dnsmasq lease file
+type DHCPLease struct {
+	MacAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+	Hostname   string `json:"hostname"` // Empty if the client sent none
+	Expires    int64  `json:"expires"`  // Unix timestamp, 0 for infinite leases
+}
+
+// ParseDHCPLeases parses dnsmasq leases in the format "<expiry> <mac> <ip> <hostname|*> <client-id>".
+// Malformed lines are skipped.
+func ParseDHCPLeases(r io.Reader) ([]DHCPLease, error) {
+	var leases []DHCPLease
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		expires, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || !ValidateMACAddress(fields[1]) {
+			continue
+		}
+
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+
+		leases = append(leases, DHCPLease{
+			MacAddress: strings.ToLower(fields[1]),
+			IPAddress:  fields[2],
+			Hostname:   hostname,
+			Expires:    expires,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read DHCP leases: %w", err)
+	}
+
+	return leases, nil
+}
+
+// LeaseTable maps MAC addresses, IP addresses and hostnames using the dnsmasq lease file.
+// The file is only parsed again when it changed.
+type LeaseTable struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	leases  []DHCPLease
+}
+
+// NewLeaseTable creates a lease table backed by the given lease file
+func NewLeaseTable(path string) *LeaseTable {
+	return &LeaseTable{path: path}
+}
+
+// Refresh reloads the lease file if it was modified and reports whether the leases changed
+func (t *LeaseTable) Refresh() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refresh()
+}
+
+// refresh reloads the lease file if it was modified. Caller must hold mu.
+func (t *LeaseTable) refresh() (bool, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat DHCP leases: %w", err)
+	}
+	if info.ModTime().Equal(t.modTime) {
+		return false, nil
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open DHCP leases: %w", err)
+	}
+	defer file.Close()
+
+	leases, err := ParseDHCPLeases(file)
+	if err != nil {
+		return false, err
+	}
+
+	t.leases = leases
+	t.modTime = info.ModTime()
+	return true, nil
+}
+
+// Leases returns all current leases
+func (t *LeaseTable) Leases() ([]DHCPLease, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := t.refresh(); err != nil {
+		return nil, err
+	}
+	return append([]DHCPLease(nil), t.leases...), nil
+}
+
+// ByIP returns the lease of an IP address
+func (t *LeaseTable) ByIP(ipAddress string) (DHCPLease, bool) {
+	leases, err := t.Leases()
+	if err != nil {
+		return DHCPLease{}, false
+	}
+	for _, lease := range leases {
+		if lease.IPAddress == ipAddress {
+			return lease, true
+		}
+	}
+	return DHCPLease{}, false
+}
+
+// ByMAC returns the lease of a MAC address in any of the formats ValidateMACAddress accepts
+func (t *LeaseTable) ByMAC(macAddress string) (DHCPLease, bool) {
+	leases, err := t.Leases()
+	if err != nil {
+		return DHCPLease{}, false
+	}
+	normalized := NormalizeMAC(macAddress)
+	for _, lease := range leases {
+		if NormalizeMAC(lease.MacAddress) == normalized {
+			return lease, true
+		}
+	}
+	return DHCPLease{}, false
+}
+
+// NormalizeMAC strips separators and lowercases a MAC address, so addresses in different formats compare equal
+func NormalizeMAC(macAddress string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(macAddress)))
+}
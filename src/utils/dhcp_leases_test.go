@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLeases = `1760000000 AA:BB:CC:DD:EE:01 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:01
+1760000100 aa:bb:cc:dd:ee:02 192.168.1.11 * *
+garbage line
+0 aa:bb:cc:dd:ee:03 192.168.1.12 printer *
+`
+
+func TestParseDHCPLeases(t *testing.T) {
+	leases, err := ParseDHCPLeases(strings.NewReader(testLeases))
+	if err != nil {
+		t.Fatalf("ParseDHCPLeases returned error: %v", err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("expected 3 leases, got %d", len(leases))
+	}
+
+	expected := DHCPLease{MacAddress: "aa:bb:cc:dd:ee:01", IPAddress: "192.168.1.10", Hostname: "laptop", Expires: 1760000000}
+	if leases[0] != expected {
+		t.Errorf("leases[0] = %+v, want %+v", leases[0], expected)
+	}
+	if leases[1].Hostname != "" {
+		t.Errorf("expected empty hostname for '*', got %q", leases[1].Hostname)
+	}
+	if leases[2].Expires != 0 {
+		t.Errorf("expected infinite lease, got expiry %d", leases[2].Expires)
+	}
+}
+
+func TestLeaseTableLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcp.leases")
+	if err := os.WriteFile(path, []byte(testLeases), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table := NewLeaseTable(path)
+
+	// 192.168.1.1 is a prefix of all leased IPs and must not match any of them
+	if _, found := table.ByIP("192.168.1.1"); found {
+		t.Error("ByIP matched a partial IP address")
+	}
+
+	lease, found := table.ByIP("192.168.1.11")
+	if !found || lease.MacAddress != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("ByIP(192.168.1.11) = %+v, %v", lease, found)
+	}
+
+	lease, found = table.ByMAC("AA-BB-CC-DD-EE-03")
+	if !found || lease.Hostname != "printer" {
+		t.Errorf("ByMAC(AA-BB-CC-DD-EE-03) = %+v, %v", lease, found)
+	}
+
+	// The client renews and gets a new IP address
+	updated := strings.Replace(testLeases, "192.168.1.10", "192.168.1.20", 1)
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := table.Refresh()
+	if err != nil || !changed {
+		t.Fatalf("Refresh() = %v, %v, want true, nil", changed, err)
+	}
+	lease, found = table.ByMAC("aa:bb:cc:dd:ee:01")
+	if !found || lease.IPAddress != "192.168.1.20" {
+		t.Errorf("expected updated IP 192.168.1.20, got %+v", lease)
+	}
+
+	changed, err = table.Refresh()
+	if err != nil || changed {
+		t.Errorf("Refresh() on unchanged file = %v, %v, want false, nil", changed, err)
+	}
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Device types returned by ClassifyDevice
+const (
+	DeviceTypePhone      = "phone"
+	DeviceTypeLaptop     = "laptop"
+	DeviceTypeIoT        = "iot"
+	DeviceTypeRandomized = "randomized"
+	DeviceTypeUnknown    = "unknown"
+)
+
+// ouiVendor maps an OUI prefix to a vendor and the device type it most likely belongs to
+type ouiVendor struct {
+	vendor     string
+	deviceType string
+}
+
+// knownOUIs is a small table of vendors commonly seen on public hotspots.
+// It is intentionally incomplete; unmatched prefixes are reported as unknown.
+var knownOUIs = map[string]ouiVendor{
+	// Apple
+	"001B63": {"Apple", DeviceTypePhone},
+	"28CFE9": {"Apple", DeviceTypePhone},
+	"3C0754": {"Apple", DeviceTypePhone},
+	"A483E7": {"Apple", DeviceTypePhone},
+	"ACBC32": {"Apple", DeviceTypePhone},
+	"D0817A": {"Apple", DeviceTypePhone},
+	"F01898": {"Apple", DeviceTypePhone},
+	"F40F24": {"Apple", DeviceTypePhone},
+	// Samsung
+	"001632": {"Samsung", DeviceTypePhone},
+	"5C0A5B": {"Samsung", DeviceTypePhone},
+	"8C7712": {"Samsung", DeviceTypePhone},
+	"FCA13E": {"Samsung", DeviceTypePhone},
+	// Google
+	"3C5AB4": {"Google", DeviceTypePhone},
+	"F4F5D8": {"Google", DeviceTypePhone},
+	// Xiaomi
+	"286C07": {"Xiaomi", DeviceTypePhone},
+	"640980": {"Xiaomi", DeviceTypePhone},
+	// Huawei
+	"00E0FC": {"Huawei", DeviceTypePhone},
+	// Intel wireless cards
+	"001B77": {"Intel", DeviceTypeLaptop},
+	"3CA9F4": {"Intel", DeviceTypeLaptop},
+	"7C5CF8": {"Intel", DeviceTypeLaptop},
+	"A434D9": {"Intel", DeviceTypeLaptop},
+	// Raspberry Pi
+	"B827EB": {"Raspberry Pi", DeviceTypeIoT},
+	"DCA632": {"Raspberry Pi", DeviceTypeIoT},
+	"E45F01": {"Raspberry Pi", DeviceTypeIoT},
+	// Espressif (ESP8266/ESP32)
+	"240AC4": {"Espressif", DeviceTypeIoT},
+	"30AEA4": {"Espressif", DeviceTypeIoT},
+	"84F3EB": {"Espressif", DeviceTypeIoT},
+	// Amazon
+	"44650D": {"Amazon", DeviceTypeIoT},
+	"F0272D": {"Amazon", DeviceTypeIoT},
+}
+
+// ClassifyDevice returns the vendor and likely device type of a MAC address based on its OUI.
+// Locally administered (randomized) addresses carry no vendor information and are reported as such.
+func ClassifyDevice(mac string) (vendor string, deviceType string) {
+	if !ValidateMACAddress(mac) {
+		return "unknown", DeviceTypeUnknown
+	}
+
+	if IsRandomizedMAC(mac) {
+		return "randomized", DeviceTypeRandomized
+	}
+
+	normalized := strings.ToUpper(strings.TrimSpace(mac))
+	normalized = strings.NewReplacer(":", "", "-", "").Replace(normalized)
+	if known, exists := knownOUIs[normalized[:6]]; exists {
+		return known.vendor, known.deviceType
+	}
+
+	return "unknown", DeviceTypeUnknown
+}
+
+// IsRandomizedMAC reports whether a MAC address is locally administered, as the private/randomized
+// addresses of phones and laptops are. Such an address may change on every connection.
+func IsRandomizedMAC(mac string) bool {
+	if !ValidateMACAddress(mac) {
+		return false
+	}
+	firstOctet, err := strconv.ParseUint(strings.TrimSpace(mac)[:2], 16, 8)
+	if err != nil {
+		return false
+	}
+	// The locally administered bit is set on private/randomized addresses
+	return firstOctet&0x02 != 0
+}
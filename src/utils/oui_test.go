@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestClassifyDevice(t *testing.T) {
+	tests := []struct {
+		name           string
+		mac            string
+		expectedVendor string
+		expectedType   string
+	}{
+		{"Known phone vendor", "F0:18:98:12:34:56", "Apple", DeviceTypePhone},
+		{"Known laptop vendor lowercase", "3c:a9:f4:12:34:56", "Intel", DeviceTypeLaptop},
+		{"Known IoT vendor hyphen format", "B8-27-EB-12-34-56", "Raspberry Pi", DeviceTypeIoT},
+		{"Randomized address", "DA:A1:19:12:34:56", "randomized", DeviceTypeRandomized},
+		{"Unknown vendor", "00:11:22:33:44:55", "unknown", DeviceTypeUnknown},
+		{"Invalid MAC", "not-a-mac", "unknown", DeviceTypeUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vendor, deviceType := ClassifyDevice(tt.mac)
+			if vendor != tt.expectedVendor || deviceType != tt.expectedType {
+				t.Errorf("ClassifyDevice(%q) = (%q, %q), want (%q, %q)",
+					tt.mac, vendor, deviceType, tt.expectedVendor, tt.expectedType)
+			}
+		})
+	}
+}
+
+func TestIsRandomizedMAC(t *testing.T) {
+	tests := []struct {
+		mac      string
+		expected bool
+	}{
+		{"DA:A1:19:12:34:56", true},
+		{"02-00-00-00-00-01", true},
+		{"F0:18:98:12:34:56", false},
+		{"00:11:22:33:44:55", false},
+		{"not-a-mac", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsRandomizedMAC(tt.mac); got != tt.expected {
+			t.Errorf("IsRandomizedMAC(%q) = %v, want %v", tt.mac, got, tt.expected)
+		}
+	}
+}
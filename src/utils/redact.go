@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"regexp"
+)
+
+// LogSecretsEnv disables log redaction when set to 1. It is meant for development only,
+// logs of a gateway with real funds must never contain spendable tokens or keys.
+const LogSecretsEnv = "TOLLGATE_LOG_SECRETS"
+
+// secretPattern matches values that give away funds or identities when they end up in a log:
+// cashu tokens and bech32 nostr private keys
+var secretPattern = regexp.MustCompile(`cashu[AB][A-Za-z0-9_\-+/=]+|nsec1[02-9ac-hj-np-z]+`)
+
+// LogSecrets reports whether the development override that disables log redaction is set
+func LogSecrets() bool {
+	return os.Getenv(LogSecretsEnv) == "1"
+}
+
+// Redact replaces a sensitive value with a short hash of it. The same value always redacts to the same
+// hash, so log lines about one token can still be correlated without the token being recoverable.
+func Redact(value string) string {
+	if value == "" || LogSecrets() {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// RedactSecrets replaces every token and private key in a text with its redacted form
+func RedactSecrets(text string) string {
+	if LogSecrets() {
+		return text
+	}
+	return secretPattern.ReplaceAllStringFunc(text, Redact)
+}
+
+// redactingWriter redacts secrets from whatever a logger writes before passing it on
+type redactingWriter struct {
+	out io.Writer
+}
+
+// NewRedactingWriter wraps the output of a logger so secrets logged by any module are redacted.
+// Loggers write one entry per call, so a secret is never split across writes.
+func NewRedactingWriter(out io.Writer) io.Writer {
+	if LogSecrets() {
+		return out
+	}
+	return &redactingWriter{out: out}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if !secretPattern.Match(p) {
+		return w.out.Write(p)
+	}
+	if _, err := w.out.Write(secretPattern.ReplaceAllFunc(p, func(secret []byte) []byte {
+		return []byte(Redact(string(secret)))
+	})); err != nil {
+		return 0, err
+	}
+	// The caller wrote all of p, even though less reached the output
+	return len(p), nil
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	t.Setenv(LogSecretsEnv, "")
+
+	token := "cashuBo2FteCJodHRwczovL21pbnQuZXhhbXBsZS5jb20="
+	nsec := "nsec1vl029mgpspedva04g90vltkh6fvh240zqtv9k0t9af8935ke9laqsnlfe5"
+	tests := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{"Token", "refund token: " + token + "\n", "refund token: " + Redact(token) + "\n"},
+		{"Private key", "key " + nsec + " loaded\n", "key " + Redact(nsec) + " loaded\n"},
+		{"Nothing secret", "gate opened for aa:bb:cc:dd:ee:ff\n", "gate opened for aa:bb:cc:dd:ee:ff\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			n, err := NewRedactingWriter(&out).Write([]byte(tt.line))
+			if err != nil || n != len(tt.line) {
+				t.Fatalf("Write() = (%d, %v), want (%d, nil)", n, err, len(tt.line))
+			}
+			if out.String() != tt.expected {
+				t.Errorf("Write(%q) wrote %q, want %q", tt.line, out.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Setenv(LogSecretsEnv, "")
+
+	if Redact("cashuAsecret") != Redact("cashuAsecret") {
+		t.Errorf("Redact() is not consistent for the same value")
+	}
+	if redacted := Redact("cashuAsecret"); strings.Contains(redacted, "secret") || !strings.HasPrefix(redacted, "redacted:") {
+		t.Errorf("Redact() = %q, want a hash", redacted)
+	}
+
+	t.Setenv(LogSecretsEnv, "1")
+	if Redact("cashuAsecret") != "cashuAsecret" {
+		t.Errorf("Redact() with %s=1 should leave the value as is", LogSecretsEnv)
+	}
+}
@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateWriter coalesces writes of state files to spare the flash of routers, which wears out after a limited
+// number of erase cycles. Files rewritten on every payment are staged in tmpfs and written to flash at most
+// once per flush interval, however often they change.
+//
+// Crash consistency:
+//   - WriteState returns once the content is staged. A crash or restart of the process loses nothing: the
+//     next StateWriter on the same staging directory writes staged content to flash before it is used.
+//   - Power loss or a reboot clears tmpfs and loses the writes since the last flush, at most the flush interval.
+//   - WriteStateDurable writes through to flash and syncs before it returns, for state that must survive
+//     power loss, such as ecash.
+//   - A file on flash is never torn: it is written to a temporary file, synced and renamed over the old one,
+//     then its directory is synced. Readers see the old or the new content, nothing in between.
+type StateWriter struct {
+	mu         sync.Mutex
+	stagingDir string
+	interval   time.Duration
+	pending    map[string]pendingState // Content by path, staged but not yet on flash
+	version    uint64                  // Counts writes, tells a flushed write from a newer one
+	flushing   bool
+}
+
+type pendingState struct {
+	data    []byte
+	perm    os.FileMode
+	version uint64
+}
+
+var (
+	defaultStateWriter     = NewStateWriter("", 0)
+	defaultStateWriterLock sync.RWMutex
+)
+
+// NewStateWriter returns a writer staging in a directory on tmpfs and flushing at the interval. It first writes
+// to flash what a previous process staged and didn't flush. Without a staging directory or interval, writes go
+// straight to flash.
+func NewStateWriter(stagingDir string, interval time.Duration) *StateWriter {
+	w := &StateWriter{
+		stagingDir: stagingDir,
+		interval:   interval,
+		pending:    make(map[string]pendingState),
+	}
+	if stagingDir != "" {
+		if err := w.recoverStaged(); err != nil {
+			log.Printf("Warning: failed to recover staged state from %s: %v", stagingDir, err)
+		}
+	}
+	return w
+}
+
+// ConfigureStateWrites replaces the writer behind WriteState, flushing what the previous one had pending
+func ConfigureStateWrites(stagingDir string, interval time.Duration) {
+	defaultStateWriterLock.Lock()
+	defer defaultStateWriterLock.Unlock()
+
+	current := defaultStateWriter
+	if current.stagingDir == stagingDir && current.interval == interval {
+		return
+	}
+	if err := current.Flush(); err != nil {
+		log.Printf("Warning: failed to flush state before reconfiguring writes: %v", err)
+	}
+	defaultStateWriter = NewStateWriter(stagingDir, interval)
+}
+
+func stateWriter() *StateWriter {
+	defaultStateWriterLock.RLock()
+	defer defaultStateWriterLock.RUnlock()
+	return defaultStateWriter
+}
+
+// WriteState writes a state file through the configured writer, see StateWriter
+func WriteState(path string, data []byte, perm os.FileMode) error {
+	return stateWriter().WriteState(path, data, perm)
+}
+
+// WriteStateDurable writes a state file to flash before returning, see StateWriter
+func WriteStateDurable(path string, data []byte, perm os.FileMode) error {
+	return stateWriter().WriteStateDurable(path, data, perm)
+}
+
+// ReadState reads a state file, including writes still pending in the configured writer
+func ReadState(path string) ([]byte, error) {
+	return stateWriter().ReadState(path)
+}
+
+// FlushStateWrites writes everything pending in the configured writer to flash, e.g. before shutting down
+// or before the state files are read by something else
+func FlushStateWrites() error {
+	return stateWriter().Flush()
+}
+
+// WriteState stages a state file and schedules it to be written to flash
+func (w *StateWriter) WriteState(path string, data []byte, perm os.FileMode) error {
+	if w.stagingDir == "" || w.interval <= 0 {
+		return WriteFileAtomic(path, data, perm)
+	}
+
+	// Staging and flushing under the lock, so a flush never removes a newer staged copy
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Staged first, so a crash after returning doesn't lose the write
+	if err := os.MkdirAll(w.stagingDir, 0700); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	staged := w.stagedPath(path)
+	tmp := staged + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, staged); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+
+	w.version++
+	w.pending[path] = pendingState{data: append([]byte(nil), data...), perm: perm, version: w.version}
+	if !w.flushing {
+		w.flushing = true
+		go w.flushLoop()
+	}
+	return nil
+}
+
+// WriteStateDurable writes a state file to flash right away, replacing any staged content
+func (w *StateWriter) WriteStateDurable(path string, data []byte, perm os.FileMode) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := WriteFileAtomic(path, data, perm); err != nil {
+		return err
+	}
+	if _, staged := w.pending[path]; staged {
+		delete(w.pending, path)
+		os.Remove(w.stagedPath(path))
+	}
+	return nil
+}
+
+// ReadState returns the pending content of a state file, or its content on flash
+func (w *StateWriter) ReadState(path string) ([]byte, error) {
+	w.mu.Lock()
+	state, pending := w.pending[path]
+	w.mu.Unlock()
+	if pending {
+		return append([]byte(nil), state.data...), nil
+	}
+	return os.ReadFile(path)
+}
+
+// Flush writes all pending state files to flash
+func (w *StateWriter) Flush() error {
+	w.mu.Lock()
+	pending := make(map[string]pendingState, len(w.pending))
+	for path, state := range w.pending {
+		pending[path] = state
+	}
+	w.mu.Unlock()
+
+	var failed []string
+	for path, state := range pending {
+		if err := WriteFileAtomic(path, state.data, state.perm); err != nil {
+			log.Printf("Warning: failed to flush %s: %v", path, err)
+			failed = append(failed, path)
+			continue
+		}
+
+		// Written again meanwhile: keep it pending for the next flush
+		w.mu.Lock()
+		if current, exists := w.pending[path]; exists && current.version == state.version {
+			delete(w.pending, path)
+			os.Remove(w.stagedPath(path))
+		}
+		w.mu.Unlock()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to flush %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// flushLoop flushes at the interval while writes are pending
+func (w *StateWriter) flushLoop() {
+	for {
+		time.Sleep(w.interval)
+		w.Flush()
+
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.flushing = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+	}
+}
+
+// stagedPath returns where a state file is staged, its path escaped into a single file name
+func (w *StateWriter) stagedPath(path string) string {
+	return filepath.Join(w.stagingDir, url.PathEscape(path)+".state")
+}
+
+// recoverStaged writes content staged by a previous process to flash. Staged files are removed once flushed,
+// so whatever is left is newer than the flash copy.
+func (w *StateWriter) recoverStaged() error {
+	entries, err := os.ReadDir(w.stagingDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".state") {
+			// Half-staged writes never returned to their caller
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(w.stagingDir, name))
+			}
+			continue
+		}
+		path, err := url.PathUnescape(strings.TrimSuffix(name, ".state"))
+		if err != nil {
+			continue
+		}
+
+		staged := filepath.Join(w.stagingDir, name)
+		data, err := os.ReadFile(staged)
+		if err != nil {
+			log.Printf("Warning: failed to read staged %s: %v", path, err)
+			continue
+		}
+		perm := os.FileMode(0600)
+		if info, err := entry.Info(); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := WriteFileAtomic(path, data, perm); err != nil {
+			log.Printf("Warning: failed to recover staged %s: %v", path, err)
+			continue
+		}
+		os.Remove(staged)
+		log.Printf("Recovered %s from the staging area", path)
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces a file on flash with new content that is synced before it takes the old one's place,
+// so a crash or power loss leaves either the old or the new content
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	// The rename is only durable once the directory is synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
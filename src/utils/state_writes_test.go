@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateWriterCoalescesWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	w := NewStateWriter(filepath.Join(dir, "staging"), time.Hour)
+
+	for _, content := range []string{"1", "2", "3"} {
+		if err := w.WriteState(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteState failed: %v", err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state reached flash before the flush: %v", err)
+	}
+	if data, err := w.ReadState(path); err != nil || string(data) != "3" {
+		t.Fatalf("ReadState = %q, %v; want the last write", data, err)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "3" {
+		t.Fatalf("flash has %q, %v; want the last write", data, err)
+	}
+	if staged, _ := os.ReadDir(filepath.Join(dir, "staging")); len(staged) != 0 {
+		t.Errorf("%d staged files left after the flush", len(staged))
+	}
+}
+
+func TestStateWriterRecoversAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process dies with the write staged but not flushed
+	crashed := NewStateWriter(staging, time.Hour)
+	if err := crashed.WriteState(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("WriteState failed: %v", err)
+	}
+	// And left a write that was being staged
+	if err := os.WriteFile(crashed.stagedPath(path)+".tmp", []byte("torn"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	NewStateWriter(staging, time.Hour)
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Fatalf("flash has %q, %v after recovery; want the staged write", data, err)
+	}
+	if staged, _ := os.ReadDir(staging); len(staged) != 0 {
+		t.Errorf("%d staged files left after recovery", len(staged))
+	}
+}
+
+func TestStateWriterDurableWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proofs.json")
+	w := NewStateWriter(filepath.Join(dir, "staging"), time.Hour)
+
+	if err := w.WriteState(path, []byte("staged"), 0600); err != nil {
+		t.Fatalf("WriteState failed: %v", err)
+	}
+	if err := w.WriteStateDurable(path, []byte("durable"), 0600); err != nil {
+		t.Fatalf("WriteStateDurable failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "durable" {
+		t.Fatalf("flash has %q, %v; want the durable write", data, err)
+	}
+
+	// The staged write it replaced must not come back on recovery
+	NewStateWriter(filepath.Join(dir, "staging"), time.Hour)
+	if data, _ := os.ReadFile(path); string(data) != "durable" {
+		t.Errorf("recovery replaced the durable write with %q", data)
+	}
+}
+
+func TestStateWriterWritesThroughWithoutInterval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	w := NewStateWriter(filepath.Join(dir, "staging"), 0)
+
+	if err := w.WriteState(path, []byte("direct"), 0600); err != nil {
+		t.Fatalf("WriteState failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "direct" {
+		t.Fatalf("flash has %q, %v; want the write", data, err)
+	}
+}
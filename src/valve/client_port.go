@@ -0,0 +1,95 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ClientPort returns the interface a client's traffic arrives on, e.g. the wireless interface of one SSID
+// bridged into the gateway interface. Clients of a gateway interface that is no bridge arrive on the interface itself.
+func ClientPort(macAddress string) (string, error) {
+	iface := interfaceFor(macAddress)
+	if _, err := os.Stat(filepath.Join("/sys/class/net", iface, "bridge")); err != nil {
+		return iface, nil
+	}
+
+	output, err := exec.Command("bridge", "fdb", "show", "br", iface).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read forwarding database of %s: %w", iface, err)
+	}
+	port, found := bridgePortOf(string(output), macAddress)
+	if !found {
+		return "", fmt.Errorf("%s not found on a port of %s", macAddress, iface)
+	}
+	return port, nil
+}
+
+// bridgePortOf finds the port of a MAC address in `bridge fdb show` output,
+// e.g. "aa:bb:cc:dd:ee:ff dev wlan0 master br-lan"
+func bridgePortOf(fdb, macAddress string) (string, bool) {
+	for _, line := range strings.Split(fdb, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.EqualFold(fields[0], macAddress) || fields[1] != "dev" {
+			continue
+		}
+		return fields[2], true
+	}
+	return "", false
+}
+
+// ClientLocations returns every port and access point each client is seen on, keyed by lower-case MAC address:
+// the bridge ports the forwarding databases learned it on and the wireless interfaces it is associated with.
+// A wireless client shows up on its interface in both, a client seen in more than one place is not one device.
+func ClientLocations() (map[string][]string, error) {
+	output, err := exec.Command("bridge", "fdb", "show").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forwarding databases: %w", err)
+	}
+	locations := learnedPorts(string(output))
+
+	// Access points are optional, wired-only gateways have no hostapd
+	objects, err := exec.Command("ubus", "list", "hostapd.*").Output()
+	if err != nil {
+		return locations, nil
+	}
+	for _, object := range strings.Fields(string(objects)) {
+		output, err := exec.Command("ubus", "call", object, "get_clients").Output()
+		if err != nil {
+			continue
+		}
+		var stations hostapdClients
+		if err := json.Unmarshal(output, &stations); err != nil {
+			return nil, fmt.Errorf("failed to parse clients of %s: %w", object, err)
+		}
+		for macAddress := range stations.Clients {
+			addLocation(locations, macAddress, strings.TrimPrefix(object, "hostapd."))
+		}
+	}
+	return locations, nil
+}
+
+// learnedPorts returns the bridge ports of the dynamically learned entries in `bridge fdb show` output,
+// leaving out the permanent entries of the gateway's own interfaces
+func learnedPorts(fdb string) map[string][]string {
+	ports := make(map[string][]string)
+	for _, line := range strings.Split(fdb, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "dev" || !slices.Contains(fields, "master") || slices.Contains(fields, "permanent") {
+			continue
+		}
+		addLocation(ports, fields[0], fields[2])
+	}
+	return ports
+}
+
+func addLocation(locations map[string][]string, macAddress, location string) {
+	macAddress = strings.ToLower(macAddress)
+	if !slices.Contains(locations[macAddress], location) {
+		locations[macAddress] = append(locations[macAddress], location)
+	}
+}
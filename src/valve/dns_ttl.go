@@ -0,0 +1,180 @@
+package valve
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS record types looked up for the walled garden
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// dnsQueryTimeout bounds a single query to the resolver
+const dnsQueryTimeout = 3 * time.Second
+
+// resolverAddress returns the first nameserver of /etc/resolv.conf, the router's dnsmasq if there is none
+func resolverAddress() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// resolveWithTTL looks up the IPv4 and IPv6 addresses of a host and the shortest TTL among them.
+// net.LookupIP doesn't report TTLs, so the resolver is queried directly.
+func resolveWithTTL(host string) ([]net.IP, time.Duration, error) {
+	resolver := resolverAddress()
+	var addresses []net.IP
+	var ttl time.Duration
+	var lastErr error
+	for _, recordType := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		ips, recordTTL, err := queryDNS(resolver, host, recordType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addresses = append(addresses, ips...)
+		if len(ips) > 0 && (ttl == 0 || recordTTL < ttl) {
+			ttl = recordTTL
+		}
+	}
+	if len(addresses) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, 0, lastErr
+	}
+	return addresses, ttl, nil
+}
+
+// queryDNS asks the resolver for the records of one type over UDP
+func queryDNS(resolver, host string, recordType uint16) ([]net.IP, time.Duration, error) {
+	query, id, err := buildDNSQuery(host, recordType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn, err := net.DialTimeout("udp", resolver, dnsQueryTimeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to reach resolver %s: %w", resolver, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, fmt.Errorf("failed to query resolver %s: %w", resolver, err)
+	}
+	response := make([]byte, 4096)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, 0, fmt.Errorf("no answer from resolver %s: %w", resolver, err)
+	}
+	return parseDNSResponse(response[:n], id, recordType)
+}
+
+// buildDNSQuery encodes a recursive query for the records of one type, returning it with its ID
+func buildDNSQuery(host string, recordType uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// Header: ID, recursion desired, one question
+	query := []byte{idBytes[0], idBytes[1], 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid host %q", host)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, recordType)
+	query = binary.BigEndian.AppendUint16(query, 1) // Class IN
+	return query, id, nil
+}
+
+// parseDNSResponse returns the addresses of the requested type in a response and the shortest TTL among them.
+// CNAME records leading to the addresses are skipped, the resolver includes the records they point to.
+func parseDNSResponse(response []byte, id, recordType uint16) ([]net.IP, time.Duration, error) {
+	if len(response) < 12 {
+		return nil, 0, fmt.Errorf("truncated DNS response")
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != id {
+		return nil, 0, fmt.Errorf("DNS response for another query")
+	}
+	if rcode := response[3] & 0x0f; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS error code %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(response[4:6]))
+	answers := int(binary.BigEndian.Uint16(response[6:8]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		end, err := skipDNSName(response, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = end + 4 // Type and class
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for i := 0; i < answers; i++ {
+		end, err := skipDNSName(response, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if end+10 > len(response) {
+			return nil, 0, fmt.Errorf("truncated DNS record")
+		}
+		rrType := binary.BigEndian.Uint16(response[end : end+2])
+		rrTTL := time.Duration(binary.BigEndian.Uint32(response[end+4:end+8])) * time.Second
+		length := int(binary.BigEndian.Uint16(response[end+8 : end+10]))
+		data := end + 10
+		if data+length > len(response) {
+			return nil, 0, fmt.Errorf("truncated DNS record data")
+		}
+		if rrType == recordType && (length == net.IPv4len || length == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), response[data:data+length]...)))
+			if ttl == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		offset = data + length
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset after a possibly compressed name
+func skipDNSName(message []byte, offset int) (int, error) {
+	for offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			return offset + 2, nil // Pointer to a name elsewhere in the message
+		default:
+			offset += 1 + length
+		}
+	}
+	return 0, fmt.Errorf("truncated DNS name")
+}
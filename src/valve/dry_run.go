@@ -0,0 +1,27 @@
+package valve
+
+import "sync"
+
+// Clients whose gates are only tracked, without touching nodogsplash, traffic control or the firewall
+var (
+	dryRunMACs  = make(map[string]bool)
+	dryRunMutex = &sync.Mutex{}
+)
+
+// SetDryRun makes gates of a MAC address open and close in the valve's bookkeeping only,
+// e.g. for a self-test purchasing access for a device that doesn't exist. Hooks don't run for it either.
+func SetDryRun(macAddress string, dryRun bool) {
+	dryRunMutex.Lock()
+	defer dryRunMutex.Unlock()
+	if dryRun {
+		dryRunMACs[macAddress] = true
+	} else {
+		delete(dryRunMACs, macAddress)
+	}
+}
+
+func isDryRun(macAddress string) bool {
+	dryRunMutex.Lock()
+	defer dryRunMutex.Unlock()
+	return dryRunMACs[macAddress]
+}
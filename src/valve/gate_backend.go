@@ -0,0 +1,156 @@
+package valve
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// GateBackend opens and closes the gates of clients on the router. The gate mode of the config selects the
+// backend, so the module runs on routers with or without a captive portal daemon.
+type GateBackend interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Setup builds the rules of the backend, allowing the MAC addresses that have an open gate
+	Setup(allowed []string) error
+	// Teardown removes the rules of the backend when another backend takes over
+	Teardown() error
+	// Allow opens the gate of a MAC address
+	Allow(macAddress string) error
+	// Block closes the gate of a MAC address
+	Block(macAddress string) error
+	// Traffic returns the bytes a client downloaded and uploaded since its gate was opened
+	Traffic(macAddress string) (downloaded, uploaded uint64, err error)
+	// Verify fails unless the open gate of a client passes traffic
+	Verify(macAddress string) error
+	// WalledGarden lets unpaid clients reach the destinations over HTTP(S). It reports whether applying them had
+	// to be postponed.
+	WalledGarden(destinations []string) (bool, error)
+}
+
+var (
+	currentGates     = make(map[string]GateBackend) // Backend of each interface, the captive portal until its gate mode is set
+	gateApplied      = make(map[string]bool)        // The backend of the interface was set up since startup, removing any rules left over from a previous mode
+	gateBackendMutex = &sync.RWMutex{}
+)
+
+// leftoverGates returns the backends whose rules may be left over on a bridge from a previous run in another mode
+func leftoverGates(bridge string) []GateBackend {
+	return []GateBackend{nftGate{bridge: bridge}, iptablesGate{bridge: bridge}}
+}
+
+// gateBackendOf returns the backend enforcing the gate of a client, the one of the interface it was bound to
+func gateBackendOf(macAddress string) GateBackend {
+	return interfaceGate(interfaceFor(macAddress))
+}
+
+// interfaceGate returns the backend enforcing gates on an interface
+func interfaceGate(iface string) GateBackend {
+	gateBackendMutex.RLock()
+	defer gateBackendMutex.RUnlock()
+	if backend, exists := currentGates[interfaceName(iface)]; exists {
+		return backend
+	}
+	return openNDSGate{}
+}
+
+// gateBackends returns the distinct backends in use, e.g. the captive portal shared by several interfaces once
+func gateBackends() []GateBackend {
+	gateBackendMutex.RLock()
+	defer gateBackendMutex.RUnlock()
+	backends := []GateBackend{}
+	if _, exists := currentGates[defaultInterface]; !exists {
+		backends = append(backends, openNDSGate{})
+	}
+	for _, backend := range currentGates {
+		if !slices.Contains(backends, backend) {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// gateBackendFor returns the backend of a gate mode
+func gateBackendFor(config config_manager.NDSConfig) (GateBackend, error) {
+	bridge := interfaceName(config.GatewayInterface)
+	portalPort := config.PortalPort
+	if portalPort == 0 {
+		portalPort = 8080
+	}
+
+	switch config.Mode {
+	case "", config_manager.GateModeCaptivePortal:
+		return openNDSGate{}, nil
+	case config_manager.GateModeWired:
+		return nftGate{bridge: bridge, portalPort: portalPort}, nil
+	case config_manager.GateModeIptables:
+		return iptablesGate{bridge: bridge, portalPort: portalPort}, nil
+	case config_manager.GateModeHostapd:
+		return hostapdGate{}, nil
+	}
+	return nil, fmt.Errorf("unknown gate mode %q", config.Mode)
+}
+
+// SetGateMode selects how gates are enforced on the gateway interface of the config. Switching backends removes
+// the rules of the interface's previous one and allows its clients with an open gate in the new one.
+func SetGateMode(config config_manager.NDSConfig) error {
+	backend, err := gateBackendFor(config)
+	if err != nil {
+		return err
+	}
+	iface := interfaceName(config.GatewayInterface)
+
+	// Hold the gates so none opens between listing them and setting up the backend
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+
+	var allowed []string
+	for macAddress := range openGates {
+		if !isDryRun(macAddress) && boundTo(macAddress, iface) {
+			allowed = append(allowed, macAddress)
+		}
+	}
+
+	gateBackendMutex.Lock()
+	defer gateBackendMutex.Unlock()
+
+	// Rebuilding the rules resets the traffic counters of open gates, so only do it when the mode changed
+	current, exists := currentGates[iface]
+	if !exists {
+		current = openNDSGate{}
+	}
+	if gateApplied[iface] && backend == current {
+		return nil
+	}
+
+	previous := []GateBackend{current}
+	if !gateApplied[iface] {
+		previous = leftoverGates(iface)
+	}
+	for _, old := range previous {
+		if err := old.Teardown(); err != nil {
+			logger.WithFields(logrus.Fields{
+				"interface": iface,
+				"backend":   old.Name(),
+				"error":     err,
+			}).Debug("Failed to remove gate rules of the previous mode")
+		}
+	}
+	if err := backend.Setup(allowed); err != nil {
+		return fmt.Errorf("failed to set up %s gates: %w", backend.Name(), err)
+	}
+
+	if backend != current {
+		logger.WithFields(logrus.Fields{
+			"interface": iface,
+			"backend":   backend.Name(),
+			"allowed":   len(allowed),
+		}).Info("Changed gate mode")
+	}
+	currentGates[iface] = backend
+	gateApplied[iface] = true
+	return nil
+}
@@ -0,0 +1,138 @@
+package valve
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hostapdGate lets only paid MAC addresses associate with the access points, through the accept lists of hostapd.
+// The access points must have `option macfilter 'allow'`, so hostapd refuses and disconnects stations missing
+// from the list. Unpaid clients can't reach a payment page, so they pay through another network, e.g. an open
+// payment SSID, or out of band. There is no walled garden.
+type hostapdGate struct{}
+
+func (hostapdGate) Name() string {
+	return "hostapd"
+}
+
+// hostapdInterfaces lists the interfaces of the running hostapd instances
+func hostapdInterfaces() ([]string, error) {
+	output, err := exec.Command("ubus", "list", "hostapd.*").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hostapd instances: %w", err)
+	}
+	var interfaces []string
+	for _, object := range strings.Fields(string(output)) {
+		interfaces = append(interfaces, strings.TrimPrefix(object, "hostapd."))
+	}
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no hostapd instances running")
+	}
+	return interfaces, nil
+}
+
+// hostapdCommand runs a hostapd_cli command on every access point
+func hostapdCommand(args ...string) error {
+	interfaces, err := hostapdInterfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range interfaces {
+		output, err := exec.Command("hostapd_cli", append([]string{"-i", iface}, args...)...).CombinedOutput()
+		// hostapd_cli exits 0 on refused commands, which print FAIL
+		if err == nil && strings.HasPrefix(strings.TrimSpace(string(output)), "FAIL") {
+			err = fmt.Errorf("command refused")
+		}
+		if err != nil {
+			return fmt.Errorf("hostapd_cli %s on %s failed: %w (output: %s)", strings.Join(args, " "), iface, err, string(output))
+		}
+	}
+	return nil
+}
+
+// Setup replaces the accept lists with the allowed MAC addresses
+func (hostapdGate) Setup(allowed []string) error {
+	if err := hostapdCommand("accept_acl", "CLEAR"); err != nil {
+		return err
+	}
+	sorted := append([]string(nil), allowed...)
+	sort.Strings(sorted)
+	for _, macAddress := range sorted {
+		if err := hostapdCommand("accept_acl", "ADD_MAC", macAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Teardown leaves the accept lists alone, clearing them would lock out every client until macfilter is turned off
+func (hostapdGate) Teardown() error {
+	return nil
+}
+
+func (hostapdGate) Allow(macAddress string) error {
+	return hostapdCommand("accept_acl", "ADD_MAC", macAddress)
+}
+
+// Block removes a MAC address from the accept lists and disconnects it, on hostapd versions that don't already
+func (hostapdGate) Block(macAddress string) error {
+	if err := hostapdCommand("accept_acl", "DEL_MAC", macAddress); err != nil {
+		return err
+	}
+	if err := hostapdCommand("deauthenticate", macAddress); err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"error":       err,
+		}).Debug("Failed to disconnect blocked station")
+	}
+	return nil
+}
+
+// Traffic returns the bytes hostapd counted for the station. Stations can only associate once their gate is open,
+// so the counters start with the gate unless the station reconnected since.
+func (hostapdGate) Traffic(macAddress string) (downloaded, uploaded uint64, err error) {
+	interfaces, err := hostapdInterfaces()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, iface := range interfaces {
+		output, err := exec.Command("hostapd_cli", "-i", iface, "sta", macAddress).Output()
+		if err != nil || !strings.HasPrefix(strings.ToLower(string(output)), strings.ToLower(macAddress)) {
+			continue // Not associated with this access point
+		}
+		counters := make(map[string]uint64)
+		for _, line := range strings.Split(string(output), "\n") {
+			key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+			if !found || (key != "rx_bytes" && key != "tx_bytes") {
+				continue
+			}
+			if counters[key], err = strconv.ParseUint(value, 10, 64); err != nil {
+				return 0, 0, fmt.Errorf("invalid hostapd counter %s: %w", key, err)
+			}
+		}
+		// The access point transmits what the station downloads
+		return counters["tx_bytes"], counters["rx_bytes"], nil
+	}
+	return 0, 0, fmt.Errorf("%s is not associated with any access point", macAddress)
+}
+
+// Verify fails unless the station is associated and passed traffic
+func (g hostapdGate) Verify(macAddress string) error {
+	downloaded, uploaded, err := g.Traffic(macAddress)
+	if err != nil {
+		return err
+	}
+	if downloaded+uploaded == 0 {
+		return fmt.Errorf("no traffic from %s since it associated", macAddress)
+	}
+	return nil
+}
+
+func (hostapdGate) WalledGarden(destinations []string) (bool, error) {
+	return false, nil
+}
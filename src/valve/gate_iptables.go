@@ -0,0 +1,213 @@
+package valve
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// With iptables the forward chain jumps to iptablesGateChain for traffic from the bridge. Allowed MAC addresses
+// return to the forward chain, everything else goes on to iptablesGardenChain, which only lets walled garden
+// destinations through. iptablesPortalChain redirects unpaid HTTP requests to the payment page.
+// iptables can't match destination MAC addresses, so only the upload of a client is counted, by its rule in
+// iptablesGateChain, and the walled garden only takes IPv4 destinations. Other bridges than br-lan have chains
+// of their own.
+const (
+	iptablesGateChain   = "tollgate_gate"
+	iptablesGardenChain = "tollgate_garden"
+	iptablesPortalChain = "tollgate_portal"
+)
+
+// iptablesGate allows paid MAC addresses on a bridge with iptables chains, for routers without nftables
+type iptablesGate struct {
+	bridge     string
+	portalPort int
+}
+
+// chains returns the gate, walled garden and portal chains of the bridge. The chains of br-lan keep their names,
+// other bridges get chains of their own with shorter names, as iptables takes at most 28 characters.
+func (g iptablesGate) chains() (gate, garden, portal string) {
+	suffix := interfaceSuffix(g.bridge)
+	if suffix == "" {
+		return iptablesGateChain, iptablesGardenChain, iptablesPortalChain
+	}
+	return "tg_gate" + suffix, "tg_garden" + suffix, "tg_portal" + suffix
+}
+
+func (iptablesGate) Name() string {
+	return "iptables"
+}
+
+// iptablesRestore loads rules without flushing the tables, chains declared in the rules are flushed
+func iptablesRestore(rules string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(rules)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply iptables gate rules: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// iptablesMACRule returns the arguments of the rule letting a MAC address through a chain
+func iptablesMACRule(macAddress string) []string {
+	return []string{"-m", "mac", "--mac-source", macAddress, "-j", "RETURN"}
+}
+
+// iptablesGardenRules returns the rules of a walled garden chain
+func iptablesGardenRules(gardenChain string, destinations []string) string {
+	ipv4, _ := splitByFamily(destinations)
+	var rules strings.Builder
+	fmt.Fprintf(&rules, ":%s - [0:0]\n", gardenChain)
+	for _, destination := range ipv4 {
+		fmt.Fprintf(&rules, "-A %s -d %s -p tcp -m multiport --dports 80,443 -j RETURN\n", gardenChain, destination)
+	}
+	fmt.Fprintf(&rules, "-A %s -j DROP\n", gardenChain)
+	return rules.String()
+}
+
+// Setup recreates the gate chains with the allowed MAC addresses and the walled garden, and hooks them into
+// the forward and prerouting chains
+func (g iptablesGate) Setup(allowed []string) error {
+	gateChain, gardenChain, portalChain := g.chains()
+	sorted := append([]string(nil), allowed...)
+	sort.Strings(sorted)
+
+	var rules strings.Builder
+	rules.WriteString("*filter\n")
+	fmt.Fprintf(&rules, ":%s - [0:0]\n", gateChain)
+	rules.WriteString(iptablesGardenRules(gardenChain, trackedWalledGarden(g.bridge)))
+	for _, macAddress := range sorted {
+		fmt.Fprintf(&rules, "-A %s %s\n", gateChain, strings.Join(iptablesMACRule(macAddress), " "))
+	}
+	fmt.Fprintf(&rules, "-A %s -g %s\n", gateChain, gardenChain)
+	rules.WriteString("COMMIT\n*nat\n")
+	fmt.Fprintf(&rules, ":%s - [0:0]\n", portalChain)
+	for _, macAddress := range sorted {
+		fmt.Fprintf(&rules, "-A %s %s\n", portalChain, strings.Join(iptablesMACRule(macAddress), " "))
+	}
+	fmt.Fprintf(&rules, "-A %s -p tcp --dport 80 -m addrtype ! --dst-type LOCAL -j REDIRECT --to-ports %d\n",
+		portalChain, g.portalPort)
+	rules.WriteString("COMMIT\n")
+	if err := iptablesRestore(rules.String()); err != nil {
+		return err
+	}
+
+	for _, jump := range [][]string{
+		{"-t", "filter", "FORWARD", "-i", g.bridge, "-j", gateChain},
+		{"-t", "nat", "PREROUTING", "-i", g.bridge, "-j", portalChain},
+	} {
+		check := append([]string{jump[0], jump[1], "-C"}, jump[2:]...)
+		if exec.Command("iptables", check...).Run() == nil {
+			continue
+		}
+		insert := append([]string{jump[0], jump[1], "-I"}, jump[2:]...)
+		if output, err := exec.Command("iptables", insert...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to hook %s into %s: %w (output: %s)", jump[len(jump)-1], jump[2], err, string(output))
+		}
+	}
+	return nil
+}
+
+// Teardown removes the jumps to the gate chains, whichever bridge they were added for, and the chains
+func (g iptablesGate) Teardown() error {
+	gateChain, gardenChain, portalChain := g.chains()
+	for _, hook := range []struct{ table, chain, target string }{
+		{"filter", "FORWARD", gateChain},
+		{"nat", "PREROUTING", portalChain},
+	} {
+		output, err := exec.Command("iptables", "-t", hook.table, "-S", hook.chain).Output()
+		if err != nil {
+			return fmt.Errorf("failed to list %s rules: %w", hook.chain, err)
+		}
+		for _, rule := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(rule)
+			if len(fields) < 2 || fields[0] != "-A" || !strings.HasSuffix(rule, "-j "+hook.target) {
+				continue
+			}
+			fields[0] = "-D"
+			exec.Command("iptables", append([]string{"-t", hook.table}, fields...)...).Run() // Ignore errors, rule may be gone
+		}
+	}
+
+	// The gate chain refers to the garden chain, so all chains are flushed before any is deleted
+	chains := []struct{ table, name string }{
+		{"filter", gateChain},
+		{"filter", gardenChain},
+		{"nat", portalChain},
+	}
+	for _, flag := range []string{"-F", "-X"} {
+		for _, chain := range chains {
+			exec.Command("iptables", "-t", chain.table, flag, chain.name).Run() // Ignore errors, chain may not exist
+		}
+	}
+	return nil
+}
+
+// Allow inserts the rules of a MAC address ahead of the walled garden and the redirect
+func (g iptablesGate) Allow(macAddress string) error {
+	gateChain, _, portalChain := g.chains()
+	for _, chain := range []struct{ table, name string }{
+		{"filter", gateChain},
+		{"nat", portalChain},
+	} {
+		args := append([]string{"-t", chain.table, "-I", chain.name, "1"}, iptablesMACRule(macAddress)...)
+		if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to allow MAC in %s: %w (output: %s)", chain.name, err, string(output))
+		}
+	}
+	return nil
+}
+
+// Block removes the rules of a MAC address
+func (g iptablesGate) Block(macAddress string) error {
+	gateChain, _, portalChain := g.chains()
+	args := append([]string{"-t", "filter", "-D", gateChain}, iptablesMACRule(macAddress)...)
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	args = append([]string{"-t", "nat", "-D", portalChain}, iptablesMACRule(macAddress)...)
+	exec.Command("iptables", args...).Run() // Ignore errors, rule may not exist
+	if err != nil {
+		return fmt.Errorf("failed to block MAC: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// Traffic returns the bytes counted by the rule of a MAC address, which only sees the upload
+func (g iptablesGate) Traffic(macAddress string) (downloaded, uploaded uint64, err error) {
+	gateChain, _, _ := g.chains()
+	output, err := exec.Command("iptables", "-t", "filter", "-L", gateChain, "-v", "-x", "-n").Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read iptables counters: %w", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(strings.ToUpper(line), "MAC "+strings.ToUpper(macAddress)) {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid iptables counter: %w", err)
+		}
+		return 0, bytes, nil
+	}
+	return 0, 0, fmt.Errorf("no iptables rule for %s", macAddress)
+}
+
+// Verify fails unless the rule of the client counted traffic
+func (g iptablesGate) Verify(macAddress string) error {
+	_, uploaded, err := g.Traffic(macAddress)
+	if err != nil {
+		return err
+	}
+	if uploaded == 0 {
+		return fmt.Errorf("no traffic from %s on the bridge since its gate opened", macAddress)
+	}
+	return nil
+}
+
+// WalledGarden replaces the rules of the walled garden chain
+func (g iptablesGate) WalledGarden(destinations []string) (bool, error) {
+	_, gardenChain, _ := g.chains()
+	return false, iptablesRestore("*filter\n" + iptablesGardenRules(gardenChain, destinations) + "COMMIT\n")
+}
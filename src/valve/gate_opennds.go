@@ -0,0 +1,94 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// openNDSGate lets the captive portal daemon authorize clients with ndsctl. The portal is set up outside the
+// module, see CheckNDSConfig.
+type openNDSGate struct{}
+
+// ndsClientStats is the part of `ndsctl json <mac>` holding the traffic of a client, in kB
+type ndsClientStats struct {
+	Downloaded uint64 `json:"downloaded"`
+	Uploaded   uint64 `json:"uploaded"`
+}
+
+// ndsClient is the part of `ndsctl json <mac>` telling whether a client is authenticated, with its traffic
+type ndsClient struct {
+	IP    string `json:"ip"`
+	State string `json:"state"`
+	ndsClientStats
+}
+
+func (openNDSGate) Name() string {
+	return "opennds"
+}
+
+func (openNDSGate) Setup(allowed []string) error {
+	return nil
+}
+
+func (openNDSGate) Teardown() error {
+	return nil
+}
+
+func (openNDSGate) Allow(macAddress string) error {
+	if output, err := exec.Command("ndsctl", "auth", macAddress).CombinedOutput(); err != nil {
+		return fmt.Errorf("ndsctl auth failed: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (openNDSGate) Block(macAddress string) error {
+	if output, err := exec.Command("ndsctl", "deauth", macAddress).CombinedOutput(); err != nil {
+		return fmt.Errorf("ndsctl deauth failed: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// client reads the state and traffic of a client from the captive portal
+func (openNDSGate) client(macAddress string) (ndsClient, error) {
+	output, err := exec.Command("ndsctl", "json", macAddress).Output()
+	if err != nil {
+		return ndsClient{}, fmt.Errorf("failed to query ndsctl: %w", err)
+	}
+	var client ndsClient
+	if err := json.Unmarshal(output, &client); err != nil {
+		return ndsClient{}, fmt.Errorf("failed to parse ndsctl output: %w", err)
+	}
+	return client, nil
+}
+
+func (g openNDSGate) Traffic(macAddress string) (downloaded, uploaded uint64, err error) {
+	client, err := g.client(macAddress)
+	if err != nil {
+		return 0, 0, err
+	}
+	return client.Downloaded * 1024, client.Uploaded * 1024, nil
+}
+
+// Verify fails unless the captive portal authenticated the client and it has counted traffic or open connections
+func (g openNDSGate) Verify(macAddress string) error {
+	client, err := g.client(macAddress)
+	if err != nil {
+		return err
+	}
+
+	if client.State != "Authenticated" {
+		return fmt.Errorf("captive portal lists the client as %q instead of authenticated", client.State)
+	}
+	if client.Downloaded+client.Uploaded > 0 {
+		return nil
+	}
+	if client.IP != "" && conntrackEntries(client.IP) > 0 {
+		return nil
+	}
+	return fmt.Errorf("no traffic from %s since its gate opened", client.IP)
+}
+
+func (openNDSGate) WalledGarden(destinations []string) (bool, error) {
+	return applyCaptivePortalWalledGarden(destinations)
+}
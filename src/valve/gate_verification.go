@@ -0,0 +1,180 @@
+package valve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// conntrackTable lists the tracked connections when the nf_conntrack module exposes it
+const conntrackTable = "/proc/net/nf_conntrack"
+
+// defaultVerificationDelay applies when no verification delay is configured
+const defaultVerificationDelay = 30 * time.Second
+
+// GateVerificationFailure reports an opened gate that didn't pass traffic
+type GateVerificationFailure struct {
+	MacAddress string
+	Reason     string
+	Repaired   bool // The client was re-authorized and checked again, the failure persisted
+}
+
+// Verification settings and the function alerted of failures, of each interface
+var (
+	gateVerification         = make(map[string]config_manager.GateVerificationConfig)
+	onGateVerificationFailed = make(map[string]func(GateVerificationFailure))
+	gateVerificationMutex    = &sync.RWMutex{}
+)
+
+// SetGateVerification configures the check that newly opened gates on an interface pass traffic
+func SetGateVerification(iface string, config config_manager.GateVerificationConfig) {
+	gateVerificationMutex.Lock()
+	defer gateVerificationMutex.Unlock()
+	gateVerification[interfaceName(iface)] = config
+}
+
+// OnGateVerificationFailed sets the function alerted when an opened gate on an interface doesn't pass traffic
+func OnGateVerificationFailed(iface string, alert func(GateVerificationFailure)) {
+	gateVerificationMutex.Lock()
+	defer gateVerificationMutex.Unlock()
+	onGateVerificationFailed[interfaceName(iface)] = alert
+}
+
+// scheduleGateVerification checks a newly opened gate once the client had time to use it
+func scheduleGateVerification(macAddress string, gate *openGate) {
+	iface := interfaceFor(macAddress)
+	gateVerificationMutex.RLock()
+	config := gateVerification[iface]
+	gateVerificationMutex.RUnlock()
+	if !config.Enabled || isDryRun(macAddress) {
+		return
+	}
+
+	delay := time.Duration(config.DelaySeconds) * time.Second
+	if delay <= 0 {
+		delay = defaultVerificationDelay
+	}
+	time.AfterFunc(delay, func() {
+		verifyGate(macAddress, gate, config.Repair, delay)
+	})
+}
+
+// verifyGate checks that the captive portal lists the client as authenticated and that its traffic flows.
+// A failing gate is alerted and, if repair is on, re-authorized and checked once more after the delay.
+func verifyGate(macAddress string, gate *openGate, repair bool, delay time.Duration) {
+	if !gateStillOpen(macAddress, gate) {
+		return
+	}
+	err := checkGateTraffic(macAddress)
+	if err == nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+		}).Debug("Verified gate passes traffic")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"error":       err,
+	}).Warn("Opened gate doesn't pass traffic")
+	if !repair {
+		alertGateVerification(GateVerificationFailure{MacAddress: macAddress, Reason: err.Error()})
+		return
+	}
+
+	if err := reauthorizeMAC(macAddress); err != nil {
+		alertGateVerification(GateVerificationFailure{MacAddress: macAddress, Reason: err.Error()})
+		return
+	}
+	time.AfterFunc(delay, func() {
+		if !gateStillOpen(macAddress, gate) {
+			return
+		}
+		if err := checkGateTraffic(macAddress); err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+			}).Error("Gate still doesn't pass traffic after re-authorizing the client")
+			alertGateVerification(GateVerificationFailure{MacAddress: macAddress, Reason: err.Error(), Repaired: true})
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+		}).Info("Gate passes traffic after re-authorizing the client")
+	})
+}
+
+// gateStillOpen reports whether the gate being verified wasn't closed or reopened meanwhile
+func gateStillOpen(macAddress string, gate *openGate) bool {
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+	current, exists := openGates[macAddress]
+	if !exists {
+		return false
+	}
+	// Extensions replace the gate, it's the same gate as long as it wasn't closed in between
+	return current.opened.Equal(gate.opened)
+}
+
+// checkGateTraffic fails unless the gate backend sees traffic of the client
+func checkGateTraffic(macAddress string) error {
+	return gateBackendOf(macAddress).Verify(macAddress)
+}
+
+// conntrackEntries counts the tracked connections from an IP address, 0 if they can't be read
+func conntrackEntries(ipAddress string) int {
+	match := "src=" + ipAddress + " "
+	if data, err := os.ReadFile(conntrackTable); err == nil {
+		return strings.Count(string(data), match)
+	}
+
+	output, err := exec.Command("conntrack", "-L", "-s", ipAddress).Output()
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(output), match)
+}
+
+// reauthorizeMAC deauthorizes and authorizes a client with an open gate again, so the gate backend
+// rebuilds its rules
+func reauthorizeMAC(macAddress string) error {
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+	gate, exists := openGates[macAddress]
+	if !exists {
+		return nil
+	}
+	tier := gate.tier
+
+	if err := gateBackendOf(macAddress).Block(macAddress); err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"error":       err,
+		}).Warn("Failed to deauthorize MAC before re-authorizing it")
+	}
+	if err := authorizeMAC(macAddress, tier); err != nil {
+		return fmt.Errorf("failed to re-authorize client: %w", err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"tier":        tier,
+	}).Info("Re-authorized client whose gate didn't pass traffic")
+	return nil
+}
+
+func alertGateVerification(failure GateVerificationFailure) {
+	iface := interfaceFor(failure.MacAddress)
+	gateVerificationMutex.RLock()
+	alert := onGateVerificationFailed[iface]
+	gateVerificationMutex.RUnlock()
+	if alert != nil {
+		alert(failure)
+	}
+}
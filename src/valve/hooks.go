@@ -0,0 +1,119 @@
+package valve
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook events passed to operator scripts in TOLLGATE_EVENT
+const (
+	hookAuthorize   = "authorize"
+	hookDeauthorize = "deauthorize"
+	hookLimitChange = "limit_change"
+	hookIPChange    = "ip_change"
+)
+
+var (
+	hooks      = make(map[string]config_manager.HooksConfig) // Hooks of each interface
+	hooksMutex = &sync.RWMutex{}
+)
+
+// hookEvent holds the session metadata exposed to a hook script
+type hookEvent struct {
+	event          string
+	macAddress     string
+	tier           string
+	limitKbps      int
+	untilTimestamp int64
+	ipAddress      string
+}
+
+// SetHooks configures the scripts run when gates on an interface are opened, closed or rate limited, or a
+// client's IP changes
+func SetHooks(iface string, config config_manager.HooksConfig) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks[interfaceName(iface)] = config
+}
+
+// hookScript returns the script configured for an event of a client and the hook timeout
+func hookScript(macAddress, event string) (string, time.Duration) {
+	iface := interfaceFor(macAddress)
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	config := hooks[iface]
+
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	switch event {
+	case hookAuthorize:
+		return config.OnAuthorize, timeout
+	case hookDeauthorize:
+		return config.OnDeauthorize, timeout
+	case hookLimitChange:
+		return config.OnLimitChange, timeout
+	case hookIPChange:
+		return config.OnIPChange, timeout
+	}
+	return "", timeout
+}
+
+// environ returns the environment variables describing the event
+func (e hookEvent) environ() []string {
+	return append(os.Environ(),
+		"TOLLGATE_EVENT="+e.event,
+		"TOLLGATE_MAC="+e.macAddress,
+		"TOLLGATE_TIER="+e.tier,
+		fmt.Sprintf("TOLLGATE_LIMIT_KBPS=%d", e.limitKbps),
+		fmt.Sprintf("TOLLGATE_UNTIL=%d", e.untilTimestamp),
+		"TOLLGATE_IP="+e.ipAddress,
+	)
+}
+
+// runHook runs the script configured for the event in the background.
+// Hooks never block or fail gate changes; errors are only logged.
+func runHook(e hookEvent) {
+	if isDryRun(e.macAddress) {
+		return
+	}
+	script, timeout := hookScript(e.macAddress, e.event)
+	if script == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, script)
+		cmd.Env = e.environ()
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"event":       e.event,
+				"script":      script,
+				"mac_address": e.macAddress,
+				"error":       err,
+				"output":      string(output),
+			}).Warn("Hook script failed")
+			return
+		}
+
+		logger.WithFields(logrus.Fields{
+			"event":       e.event,
+			"script":      script,
+			"mac_address": e.macAddress,
+			"output":      string(output),
+		}).Debug("Hook script completed")
+	}()
+}
@@ -0,0 +1,292 @@
+package valve
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// Delegated prefixes are accepted inbound by a chain in the fw4 table, as an accept in a table
+// of our own wouldn't stop fw4 from dropping traffic from the WAN. Every interface has its own chain and
+// set, suffixed with the interface except for br-lan.
+const (
+	ipv6Table        = "fw4"
+	ipv6ForwardWAN   = "forward_wan"
+	ipv6InboundChain = "tollgate_ipv6_inbound"
+	ipv6PrefixSet    = "tollgate_ipv6_prefixes"
+)
+
+// delegatedPrefix is a /64 routed to a client
+type delegatedPrefix struct {
+	prefix *net.IPNet
+	iface  string
+}
+
+var (
+	ipv6Configs       = make(map[string]config_manager.IPv6PrefixConfig) // Delegation settings of each interface
+	ipv6Pools         = make(map[string]*net.IPNet)                      // Pool of each interface delegating prefixes
+	delegatedPrefixes = make(map[string]*delegatedPrefix)                // MAC address -> prefix
+	ipv6Mutex         = &sync.Mutex{}
+)
+
+// SetIPv6Prefixes configures the prefixes routed to clients of eligible tiers on an interface and rebuilds the
+// firewall rules accepting inbound connections to them. Delegations outside a changed pool are withdrawn.
+func SetIPv6Prefixes(iface string, config config_manager.IPv6PrefixConfig) error {
+	iface = interfaceName(iface)
+
+	ipv6Mutex.Lock()
+	defer ipv6Mutex.Unlock()
+
+	var pool *net.IPNet
+	if config.Enabled {
+		_, network, err := net.ParseCIDR(config.Pool)
+		if err != nil {
+			return fmt.Errorf("invalid IPv6 prefix pool %q: %w", config.Pool, err)
+		}
+		if ones, bits := network.Mask.Size(); bits != 128 || ones >= 64 {
+			return fmt.Errorf("IPv6 prefix pool %s must be an IPv6 prefix shorter than /64", config.Pool)
+		}
+		pool = network
+	}
+
+	ipv6Configs[iface] = config
+	if pool != nil {
+		ipv6Pools[iface] = pool
+	} else {
+		delete(ipv6Pools, iface)
+	}
+	delegations := make(map[string]*delegatedPrefix)
+	for macAddress, delegation := range delegatedPrefixes {
+		if delegation.iface != iface {
+			continue
+		}
+		if pool == nil || !pool.Contains(delegation.prefix.IP) {
+			withdrawPrefix(macAddress, delegation)
+			continue
+		}
+		delegations[macAddress] = delegation
+	}
+
+	chain := ipv6InboundChain + interfaceSuffix(iface)
+	if pool == nil {
+		exec.Command("nft", "flush", "chain", "inet", ipv6Table, chain).Run() // Ignore errors, chain may not exist
+		return nil
+	}
+
+	script, err := ipv6FirewallScript(iface, config.InboundPorts, delegations)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply IPv6 inbound rules: %w (output: %s)", err, string(output))
+	}
+
+	// fw4 drops the jump into our chain whenever it reloads, so add it back
+	output, err := exec.Command("nft", "list", "chain", "inet", ipv6Table, ipv6ForwardWAN).Output()
+	if err != nil {
+		return fmt.Errorf("failed to read %s chain: %w", ipv6ForwardWAN, err)
+	}
+	if !slices.Contains(strings.Fields(string(output)), chain) {
+		cmd := exec.Command("nft", "insert", "rule", "inet", ipv6Table, ipv6ForwardWAN, "jump", chain)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to hook IPv6 inbound rules into %s: %w (output: %s)", ipv6ForwardWAN, err, string(output))
+		}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"interface": iface,
+		"pool":      pool.String(),
+		"tiers":     config.Tiers,
+		"delegated": len(delegations),
+	}).Info("Applied IPv6 prefix delegation")
+	return nil
+}
+
+// ipv6FirewallScript builds the nft script recreating the inbound chain and the set of delegated prefixes of an
+// interface
+func ipv6FirewallScript(iface string, ports []int, delegations map[string]*delegatedPrefix) (string, error) {
+	chain, set := ipv6InboundChain+interfaceSuffix(iface), ipv6PrefixSet+interfaceSuffix(iface)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "add chain inet %s %s\nflush chain inet %s %s\n", ipv6Table, chain, ipv6Table, chain)
+	fmt.Fprintf(&script, "add set inet %s %s { type ipv6_addr; flags interval; }\nflush set inet %s %s\n",
+		ipv6Table, set, ipv6Table, set)
+
+	if len(delegations) > 0 {
+		prefixes := make([]string, 0, len(delegations))
+		for _, delegation := range delegations {
+			prefixes = append(prefixes, delegation.prefix.String())
+		}
+		slices.Sort(prefixes)
+		fmt.Fprintf(&script, "add element inet %s %s { %s }\n", ipv6Table, set, strings.Join(prefixes, ", "))
+	}
+
+	match := ""
+	if len(ports) > 0 {
+		portList := make([]string, 0, len(ports))
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return "", fmt.Errorf("invalid inbound port %d", port)
+			}
+			portList = append(portList, strconv.Itoa(port))
+		}
+		match = fmt.Sprintf(" meta l4proto { tcp, udp } th dport { %s }", strings.Join(portList, ", "))
+	}
+	fmt.Fprintf(&script, "add rule inet %s %s ip6 daddr @%s%s accept\n", ipv6Table, chain, set, match)
+
+	return script.String(), nil
+}
+
+// assignIPv6Prefix routes a /64 to a client whose tier is eligible, and withdraws it from a client whose tier isn't
+func assignIPv6Prefix(macAddress, tier string) {
+	iface := interfaceFor(macAddress)
+
+	ipv6Mutex.Lock()
+	defer ipv6Mutex.Unlock()
+
+	pool := ipv6Pools[iface]
+	delegation, delegated := delegatedPrefixes[macAddress]
+	if pool == nil || !slices.Contains(ipv6Configs[iface].Tiers, tier) {
+		if delegated {
+			withdrawPrefix(macAddress, delegation)
+		}
+		return
+	}
+	if delegated {
+		return
+	}
+
+	index, err := freePrefixIndex(pool)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"error":       err,
+		}).Warn("Failed to delegate IPv6 prefix")
+		return
+	}
+	delegation = &delegatedPrefix{prefix: nthPrefix(pool, index), iface: iface}
+
+	gateway, err := linkLocalAddress(delegation.iface, macAddress)
+	if err == nil {
+		cmd := exec.Command("ip", "-6", "route", "replace", delegation.prefix.String(), "via", gateway, "dev", delegation.iface)
+		if output, routeErr := cmd.CombinedOutput(); routeErr != nil {
+			err = fmt.Errorf("failed to add route: %w (output: %s)", routeErr, string(output))
+		}
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"prefix":      delegation.prefix.String(),
+			"error":       err,
+		}).Warn("Failed to delegate IPv6 prefix")
+		return
+	}
+	cmd := exec.Command("nft", "add", "element", "inet", ipv6Table, ipv6PrefixSet+interfaceSuffix(iface), "{ "+delegation.prefix.String()+" }")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"prefix":      delegation.prefix.String(),
+			"error":       err,
+			"output":      string(output),
+		}).Warn("Failed to open firewall for delegated IPv6 prefix")
+	}
+	delegatedPrefixes[macAddress] = delegation
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"prefix":      delegation.prefix.String(),
+		"via":         gateway,
+	}).Info("Delegated IPv6 prefix")
+}
+
+// releaseIPv6Prefix withdraws the prefix of a client once its gate closes
+func releaseIPv6Prefix(macAddress string) {
+	ipv6Mutex.Lock()
+	defer ipv6Mutex.Unlock()
+
+	if delegation, delegated := delegatedPrefixes[macAddress]; delegated {
+		withdrawPrefix(macAddress, delegation)
+	}
+}
+
+// withdrawPrefix removes the route and firewall hole of a delegated prefix. Caller must hold ipv6Mutex.
+func withdrawPrefix(macAddress string, delegation *delegatedPrefix) {
+	prefix, set := delegation.prefix.String(), ipv6PrefixSet+interfaceSuffix(delegation.iface)
+	exec.Command("ip", "-6", "route", "del", prefix, "dev", delegation.iface).Run()          // Ignore errors, route may be gone
+	exec.Command("nft", "delete", "element", "inet", ipv6Table, set, "{ "+prefix+" }").Run() // Ignore errors, element may not exist
+	delete(delegatedPrefixes, macAddress)
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"prefix":      prefix,
+	}).Info("Withdrew IPv6 prefix")
+}
+
+// DelegatedPrefix returns the IPv6 prefix routed to a client, or "" if it has none
+func DelegatedPrefix(macAddress string) string {
+	ipv6Mutex.Lock()
+	defer ipv6Mutex.Unlock()
+	if delegation, delegated := delegatedPrefixes[macAddress]; delegated {
+		return delegation.prefix.String()
+	}
+	return ""
+}
+
+// freePrefixIndex returns the first /64 of a pool not delegated yet, skipping the LAN's. Pools of several
+// interfaces may overlap, so prefixes delegated from any pool are skipped. Caller must hold ipv6Mutex.
+func freePrefixIndex(pool *net.IPNet) (uint64, error) {
+	used := make(map[string]bool, len(delegatedPrefixes))
+	for _, delegation := range delegatedPrefixes {
+		used[delegation.prefix.String()] = true
+	}
+	ones, _ := pool.Mask.Size()
+	size := uint64(1) << (64 - ones)
+	for index := uint64(1); index < size; index++ {
+		if !used[nthPrefix(pool, index).String()] {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d prefixes of %s are delegated", size-1, pool.String())
+}
+
+// nthPrefix returns the /64 at a position in the pool
+func nthPrefix(pool *net.IPNet, index uint64) *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, pool.IP.To16())
+	binary.BigEndian.PutUint64(ip[:8], binary.BigEndian.Uint64(ip[:8])|index)
+	binary.BigEndian.PutUint64(ip[8:], 0)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+}
+
+// linkLocalAddress returns the link-local address of a client to route its prefix through, from the
+// neighbour table or, for clients that haven't talked IPv6 yet, derived from its MAC address (EUI-64)
+func linkLocalAddress(iface, macAddress string) (string, error) {
+	output, err := exec.Command("ip", "-6", "neigh", "show", "dev", iface).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && strings.HasPrefix(fields[0], "fe80:") &&
+				fields[1] == "lladdr" && strings.EqualFold(fields[2], macAddress) {
+				return fields[0], nil
+			}
+		}
+	}
+
+	hardwareAddr, err := net.ParseMAC(macAddress)
+	if err != nil || len(hardwareAddr) != 6 {
+		return "", fmt.Errorf("no link-local address for %s", macAddress)
+	}
+	ip := net.IP{0xfe, 0x80, 0, 0, 0, 0, 0, 0,
+		hardwareAddr[0] ^ 0x02, hardwareAddr[1], hardwareAddr[2], 0xff, 0xfe, hardwareAddr[3], hardwareAddr[4], hardwareAddr[5]}
+	return ip.String(), nil
+}
@@ -0,0 +1,117 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// LegacyClient is a client another captive portal authorized, with the access it has left
+type LegacyClient struct {
+	MacAddress string
+	IP         string
+	Remaining  time.Duration // 0 when the portal authorized the client without an end
+}
+
+// ReadLegacyClients lists the clients an openNDS or CoovaChilli captive portal authorized, from the saved output
+// of `ndsctl json` or `chilli_query list` in stateFile, or from the running portal if stateFile is empty.
+// Clients whose access already ended are left out.
+func ReadLegacyClients(source, stateFile string) ([]LegacyClient, error) {
+	var output []byte
+	var err error
+	if stateFile != "" {
+		output, err = os.ReadFile(stateFile)
+	} else if source == config_manager.LegacySourceCoovaChilli {
+		output, err = exec.Command("chilli_query", "list").Output()
+	} else {
+		output, err = exec.Command("ndsctl", "json").Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s client state: %w", source, err)
+	}
+
+	switch source {
+	case config_manager.LegacySourceOpenNDS:
+		return parseOpenNDSClients(output, time.Now())
+	case config_manager.LegacySourceCoovaChilli:
+		return parseChilliClients(output), nil
+	}
+	return nil, fmt.Errorf("unknown captive portal %q", source)
+}
+
+// parseOpenNDSClients reads the authenticated clients of `ndsctl json`. openNDS prints numbers as strings
+// and a session_end of "null" for clients without an end.
+func parseOpenNDSClients(output []byte, now time.Time) ([]LegacyClient, error) {
+	var list struct {
+		Clients map[string]struct {
+			MAC        string          `json:"mac"`
+			IP         string          `json:"ip"`
+			State      string          `json:"state"`
+			SessionEnd json.RawMessage `json:"session_end"`
+		} `json:"clients"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse ndsctl output: %w", err)
+	}
+
+	var clients []LegacyClient
+	for key, client := range list.Clients {
+		if client.State != "Authenticated" {
+			continue
+		}
+		macAddress := client.MAC
+		if macAddress == "" {
+			macAddress = key
+		}
+		legacy := LegacyClient{MacAddress: normalizeMAC(macAddress), IP: client.IP}
+		end, err := strconv.ParseInt(strings.Trim(string(client.SessionEnd), `"`), 10, 64)
+		if err == nil && end > 0 {
+			if end <= now.Unix() {
+				continue
+			}
+			legacy.Remaining = time.Unix(end, 0).Sub(now)
+		}
+		clients = append(clients, legacy)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].MacAddress < clients[j].MacAddress })
+	return clients, nil
+}
+
+// parseChilliClients reads the authenticated clients of `chilli_query list`, one per line:
+// MAC, IP, state, session ID, authenticated (1 or 0), username, session time/max session time, ...
+// A max session time of 0 means no end.
+func parseChilliClients(output []byte) []LegacyClient {
+	var clients []LegacyClient
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || fields[4] != "1" {
+			continue
+		}
+		legacy := LegacyClient{MacAddress: normalizeMAC(fields[0]), IP: fields[1]}
+		used, limit, found := strings.Cut(fields[6], "/")
+		if found {
+			usedSeconds, usedErr := strconv.ParseInt(used, 10, 64)
+			limitSeconds, limitErr := strconv.ParseInt(limit, 10, 64)
+			if usedErr == nil && limitErr == nil && limitSeconds > 0 {
+				if usedSeconds >= limitSeconds {
+					continue
+				}
+				legacy.Remaining = time.Duration(limitSeconds-usedSeconds) * time.Second
+			}
+		}
+		clients = append(clients, legacy)
+	}
+	return clients
+}
+
+// normalizeMAC writes a MAC address the way nodogsplash and the merchant do, lowercase with colons
+func normalizeMAC(macAddress string) string {
+	return strings.ToLower(strings.ReplaceAll(macAddress, "-", ":"))
+}
@@ -0,0 +1,235 @@
+package valve
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// NDSSetting is a UCI option the gate depends on. List options only need to contain the value.
+type NDSSetting struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	List  bool   `json:"list"`
+}
+
+// NDSIssue is a setting whose current value doesn't match what the gate expects
+type NDSIssue struct {
+	NDSSetting
+	Actual string `json:"actual"`
+}
+
+// ndsFlavour returns the UCI package of the installed captive portal, "nodogsplash" or "opennds"
+func ndsFlavour() string {
+	if _, err := os.Stat("/etc/config/opennds"); err == nil {
+		return "opennds"
+	}
+	return "nodogsplash"
+}
+
+// ExpectedNDSSettings returns the captive portal and uhttpd settings the gate needs to open
+func ExpectedNDSSettings(config config_manager.NDSConfig) []NDSSetting {
+	if config.GatewayInterface == "" {
+		config.GatewayInterface = "br-lan"
+	}
+	if config.PortalPort == 0 {
+		config.PortalPort = 8080
+	}
+	if config.ProtocolPort == 0 {
+		config.ProtocolPort = 2121
+	}
+
+	flavour := ndsFlavour()
+	section := fmt.Sprintf("%s.@%s[0]", flavour, flavour)
+
+	settings := []NDSSetting{
+		{Key: section + ".enabled", Value: "1"},
+		{Key: section + ".gatewayinterface", Value: config.GatewayInterface},
+		// Customers have to reach the TollGate protocol and the portal before they paid
+		{Key: section + ".users_to_router", Value: fmt.Sprintf("allow tcp port %d", config.ProtocolPort), List: true},
+		{Key: section + ".users_to_router", Value: fmt.Sprintf("allow tcp port %d", config.PortalPort), List: true},
+		{Key: section + ".preauthenticated_users", Value: "allow tcp port 53", List: true},
+		{Key: section + ".preauthenticated_users", Value: "allow udp port 53", List: true},
+		{Key: "uhttpd.main.listen_http", Value: fmt.Sprintf("0.0.0.0:%d", config.PortalPort), List: true},
+	}
+
+	// Walled garden destinations customers reach before they paid, e.g. their mint to top up their wallet.
+	// Once the walled garden is tracked its current addresses are expected instead of resolving the config now.
+	destinations := walledGardenDestinations(config.WalledGarden)
+	if tracked := trackedWalledGarden(config.GatewayInterface); tracked != nil {
+		destinations, _ = splitByFamily(tracked)
+	}
+	for _, destination := range destinations {
+		for _, port := range []int{80, 443} {
+			settings = append(settings, NDSSetting{
+				Key:   section + ".preauthenticated_users",
+				Value: fmt.Sprintf("allow tcp port %d to %s", port, destination),
+				List:  true,
+			})
+		}
+	}
+
+	if flavour == "opennds" {
+		// openNDS forwards customers to the portal served by uhttpd
+		settings = append(settings, NDSSetting{Key: section + ".fasport", Value: fmt.Sprintf("%d", config.PortalPort)})
+	}
+
+	return settings
+}
+
+// walledGardenDestinations resolves walled garden hosts to the IPv4 addresses the captive portal firewall
+// rules need. IP addresses and networks are kept as they are, hosts that don't resolve are skipped.
+func walledGardenDestinations(entries []string) []string {
+	var destinations []string
+	for _, entry := range entries {
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			destinations = append(destinations, entry)
+			continue
+		}
+
+		ips, err := net.LookupIP(entry)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"host":  entry,
+				"error": err,
+			}).Warn("Failed to resolve walled garden host")
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil && !slices.Contains(destinations, ip.String()) {
+				destinations = append(destinations, ip.String())
+			}
+		}
+	}
+	return destinations
+}
+
+// ValidateNDSConfig compares the UCI configuration with the expected settings and returns the mismatches
+func ValidateNDSConfig(config config_manager.NDSConfig) ([]NDSIssue, error) {
+	if _, err := exec.LookPath("uci"); err != nil {
+		return nil, fmt.Errorf("uci not available: %w", err)
+	}
+
+	var issues []NDSIssue
+	for _, setting := range ExpectedNDSSettings(config) {
+		// Print list values one per line, as values may contain spaces
+		output, _ := exec.Command("uci", "-q", "-d", "\n", "get", setting.Key).Output()
+		actual := strings.TrimSpace(string(output))
+
+		if setting.List {
+			if slices.Contains(strings.Split(actual, "\n"), setting.Value) {
+				continue
+			}
+		} else if actual == setting.Value {
+			continue
+		}
+
+		issues = append(issues, NDSIssue{NDSSetting: setting, Actual: actual})
+	}
+
+	return issues, nil
+}
+
+// FixNDSConfig applies the expected settings for the given issues and restarts the affected services
+func FixNDSConfig(issues []NDSIssue) error {
+	var packages []string
+	for _, issue := range issues {
+		if err := ensureUCISection(issue.Key); err != nil {
+			return err
+		}
+
+		var cmd *exec.Cmd
+		if issue.List {
+			cmd = exec.Command("uci", "add_list", fmt.Sprintf("%s=%s", issue.Key, issue.Value))
+		} else {
+			cmd = exec.Command("uci", "set", fmt.Sprintf("%s=%s", issue.Key, issue.Value))
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set %s: %w (%s)", issue.Key, err, strings.TrimSpace(string(output)))
+		}
+
+		pkg := strings.SplitN(issue.Key, ".", 2)[0]
+		if !slices.Contains(packages, pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+
+	for _, pkg := range packages {
+		if output, err := exec.Command("uci", "commit", pkg).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to commit %s: %w (%s)", pkg, err, strings.TrimSpace(string(output)))
+		}
+		if output, err := exec.Command("/etc/init.d/"+pkg, "restart").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restart %s: %w (%s)", pkg, err, strings.TrimSpace(string(output)))
+		}
+		logger.WithField("package", pkg).Info("Applied captive portal configuration")
+	}
+
+	return nil
+}
+
+// ensureUCISection creates the first anonymous or the named section of an option key if it is missing
+func ensureUCISection(key string) error {
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid UCI option key: %s", key)
+	}
+	pkg, section := parts[0], parts[1]
+
+	if err := exec.Command("uci", "-q", "get", pkg+"."+section).Run(); err == nil {
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	if strings.HasPrefix(section, "@") {
+		sectionType := strings.TrimPrefix(strings.SplitN(section, "[", 2)[0], "@")
+		cmd = exec.Command("uci", "add", pkg, sectionType)
+	} else {
+		// Named sections share the package name as type, e.g. uhttpd.main
+		cmd = exec.Command("uci", "set", fmt.Sprintf("%s.%s=%s", pkg, section, pkg))
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create %s.%s: %w (%s)", pkg, section, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CheckNDSConfig validates the captive portal configuration at startup and fixes it if auto-fix is enabled
+func CheckNDSConfig(config config_manager.NDSConfig) {
+	if config.Mode != "" && config.Mode != config_manager.GateModeCaptivePortal {
+		logger.WithField("mode", config.Mode).Info("Gates aren't enforced by the captive portal, no configuration to check")
+		return
+	}
+
+	issues, err := ValidateNDSConfig(config)
+	if err != nil {
+		logger.WithError(err).Warn("Skipping captive portal configuration check")
+		return
+	}
+	if len(issues) == 0 {
+		logger.Info("Captive portal configuration OK")
+		return
+	}
+
+	for _, issue := range issues {
+		logger.WithFields(logrus.Fields{
+			"key":      issue.Key,
+			"expected": issue.Value,
+			"actual":   issue.Actual,
+		}).Warn("Captive portal misconfigured, gates may never open")
+	}
+
+	if !config.AutoFix {
+		logger.Warn("Run 'tollgate nds fix' or enable nds.auto_fix in config.json to repair the captive portal configuration")
+		return
+	}
+
+	if err := FixNDSConfig(issues); err != nil {
+		logger.WithError(err).Error("Failed to fix captive portal configuration")
+	}
+}
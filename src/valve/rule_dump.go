@@ -0,0 +1,91 @@
+package valve
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GateDump is the valve's bookkeeping of an open gate
+type GateDump struct {
+	MacAddress string `json:"mac_address"`
+	Tier       string `json:"tier"`
+	Until      int64  `json:"until"` // Unix timestamp the gate closes at
+	Opened     int64  `json:"opened"`
+	Interface  string `json:"interface"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+}
+
+// RuleDump is the state of the gates and of the rules enforcing them, for debugging field-deployed routers
+type RuleDump struct {
+	Gates    []GateDump        `json:"gates"`
+	Commands map[string]string `json:"commands"` // Output of each command listing rules, or its error
+}
+
+// DumpRules lists the open gates and the captive portal, firewall and traffic control rules behind them
+func DumpRules() RuleDump {
+	dump := RuleDump{Commands: make(map[string]string)}
+
+	gatesMutex.Lock()
+	for macAddress, gate := range openGates {
+		dump.Gates = append(dump.Gates, GateDump{
+			MacAddress: macAddress,
+			Tier:       gate.tier,
+			Until:      gate.until,
+			Opened:     gate.opened.Unix(),
+		})
+	}
+	gatesMutex.Unlock()
+	sort.Slice(dump.Gates, func(i, j int) bool { return dump.Gates[i].MacAddress < dump.Gates[j].MacAddress })
+	for i := range dump.Gates {
+		dump.Gates[i].Interface = interfaceFor(dump.Gates[i].MacAddress)
+		dump.Gates[i].DryRun = isDryRun(dump.Gates[i].MacAddress)
+	}
+
+	commands := [][]string{
+		{"nft", "list", "ruleset"},
+	}
+	var ndsctl, iptables bool
+	for _, backend := range gateBackends() {
+		switch backend.(type) {
+		case openNDSGate:
+			ndsctl = true
+		case iptablesGate:
+			iptables = true
+		}
+	}
+	if ndsctl {
+		commands = append(commands, []string{"ndsctl", "json"})
+	}
+	if iptables {
+		commands = append(commands, []string{"iptables-save"})
+	}
+	interfacesMutex.Lock()
+	for iface := range tcInitialized {
+		commands = append(commands,
+			[]string{"tc", "-s", "class", "show", "dev", iface},
+			[]string{"tc", "filter", "show", "dev", iface})
+	}
+	interfacesMutex.Unlock()
+
+	for _, command := range commands {
+		dump.Commands[strings.Join(command, " ")] = runDumpCommand(command)
+	}
+	return dump
+}
+
+// dumpCommandTimeout keeps a hanging command from holding up the dump
+const dumpCommandTimeout = 10 * time.Second
+
+func runDumpCommand(command []string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), dumpCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Sprintf("error: %v\n%s", err, output)
+	}
+	return string(output)
+}
@@ -0,0 +1,63 @@
+package valve
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Shutdown stops the timers of all open gates and removes the traffic control set up on the gateway interfaces,
+// so the router is left in a known state when the service stops. With deauthorize every open gate is closed too,
+// otherwise clients keep their access while the service restarts and the merchant reopens their gates from its
+// stored sessions. Gates opened afterwards are not tracked anymore.
+func Shutdown(deauthorize bool) {
+	gatesMutex.Lock()
+	gates := openGates
+	openGates = make(map[string]*openGate)
+	gatesMutex.Unlock()
+
+	closed := 0
+	for macAddress, gate := range gates {
+		gate.timer.Stop()
+		if !deauthorize {
+			continue
+		}
+		if err := deauthorizeMAC(macAddress); err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+			}).Warn("Failed to close gate on shutdown")
+			continue
+		}
+		closed++
+	}
+
+	// Deleting the root qdisc takes the classes and filters of all gates along
+	interfacesMutex.Lock()
+	var interfaces []string
+	for iface, initialized := range tcInitialized {
+		if initialized {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	tcInitialized = make(map[string]bool)
+	interfacesMutex.Unlock()
+
+	for _, iface := range interfaces {
+		if err := tc().removeRoot(iface); err != nil {
+			logger.WithFields(logrus.Fields{
+				"interface": iface,
+				"error":     err,
+			}).Warn("Failed to remove traffic control on shutdown")
+		}
+	}
+
+	limitedGatesMutex.Lock()
+	limitedGates = make(map[string]int)
+	gatePriorities = make(map[string]int)
+	limitedGatesMutex.Unlock()
+
+	logger.WithFields(logrus.Fields{
+		"open_gates":   len(gates),
+		"closed_gates": closed,
+		"interfaces":   len(interfaces),
+	}).Info("Valve shut down")
+}
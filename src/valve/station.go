@@ -0,0 +1,61 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StationMetrics is the radio link of a wireless client as reported by hostapd
+type StationMetrics struct {
+	Interface  string // Wireless interface the client is associated with
+	SignalDBm  int    // Signal strength of the client as received by the access point
+	TxRateKbps int    // Rate the access point currently sends to the client at
+}
+
+// hostapdClients is the output of `ubus call hostapd.<iface> get_clients`
+type hostapdClients struct {
+	Clients map[string]struct {
+		Signal int `json:"signal"`
+		Rate   struct {
+			Tx int `json:"tx"` // kbps
+		} `json:"rate"`
+	} `json:"clients"`
+}
+
+// GetStationMetrics looks up a client in the stations of every hostapd instance.
+// Returns false for clients that are not associated with a local access point, e.g. wired clients.
+func GetStationMetrics(macAddress string) (StationMetrics, bool, error) {
+	output, err := exec.Command("ubus", "list", "hostapd.*").Output()
+	if err != nil {
+		return StationMetrics{}, false, fmt.Errorf("failed to list hostapd instances: %w", err)
+	}
+
+	for _, object := range strings.Fields(string(output)) {
+		output, err := exec.Command("ubus", "call", object, "get_clients").Output()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"object": object,
+				"error":  err,
+			}).Debug("Failed to read hostapd clients")
+			continue
+		}
+		var stations hostapdClients
+		if err := json.Unmarshal(output, &stations); err != nil {
+			return StationMetrics{}, false, fmt.Errorf("failed to parse clients of %s: %w", object, err)
+		}
+		for mac, station := range stations.Clients {
+			if strings.EqualFold(mac, macAddress) {
+				return StationMetrics{
+					Interface:  strings.TrimPrefix(object, "hostapd."),
+					SignalDBm:  station.Signal,
+					TxRateKbps: station.Rate.Tx,
+				}, true, nil
+			}
+		}
+	}
+	return StationMetrics{}, false, nil
+}
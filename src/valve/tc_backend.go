@@ -0,0 +1,135 @@
+package valve
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// trafficControl manages the HTB qdisc, classes and filters that limit the bandwidth of gates. Classes are
+// given by their minor number under the 1: qdisc, filters by their priority.
+type trafficControl interface {
+	// name identifies the backend in logs
+	name() string
+	// hasHTB reports whether the root qdisc of the interface is HTB
+	hasHTB(iface string) (bool, error)
+	// initRoot replaces the root qdisc with HTB handle 1:, sending unclassified traffic to the root class 1:1
+	initRoot(iface string, kbps int) error
+	// changeRoot changes the rate of the root class 1:1
+	changeRoot(iface string, kbps int) error
+	// removeRoot deletes the root qdisc, which takes all classes and filters along
+	removeRoot(iface string) error
+	// replaceClass creates or changes the class 1:classID under the root class
+	replaceClass(iface, classID string, kbps, priority int) error
+	// deleteClass removes the class 1:classID
+	deleteClass(iface, classID string) error
+	// addFilter steers frames sent to a MAC address into the class 1:classID
+	addFilter(iface string, method filterMethod, hw net.HardwareAddr, classID, priority string) error
+	// deleteFilter removes the filters of a priority, created with the method
+	deleteFilter(iface string, method filterMethod, priority string) error
+}
+
+var (
+	tcBackend     trafficControl
+	tcBackendOnce sync.Once
+)
+
+// tc returns the traffic control backend, netlink where the kernel supports it and the tc command otherwise.
+// BusyBox systems without a full tc build or with a slow fork are spared a process per change.
+func tc() trafficControl {
+	tcBackendOnce.Do(func() {
+		if backend, err := newNetlinkTC(); err == nil {
+			tcBackend = backend
+		} else {
+			logger.WithError(err).Info("Netlink traffic control unavailable, falling back to the tc command")
+			tcBackend = execTC{}
+		}
+		logger.WithField("backend", tcBackend.name()).Info("Selected traffic control backend")
+	})
+	return tcBackend
+}
+
+// execTC runs the tc command for every change
+type execTC struct{}
+
+func (execTC) name() string {
+	return "tc"
+}
+
+func (execTC) hasHTB(iface string) (bool, error) {
+	output, err := exec.Command("tc", "qdisc", "show", "dev", iface).Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to check tc qdisc: %w", err)
+	}
+	return strings.Contains(string(output), "htb"), nil
+}
+
+func (execTC) initRoot(iface string, kbps int) error {
+	exec.Command("tc", "qdisc", "del", "dev", iface, "root").Run() // Ignore errors, may not exist
+
+	addCmd := exec.Command("tc", "qdisc", "add", "dev", iface, "root", "handle", "1:", "htb", "default", "1")
+	if output, err := addCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add HTB qdisc: %w (output: %s)", err, string(output))
+	}
+
+	rate := strconv.Itoa(kbps) + "kbit"
+	rootCmd := exec.Command("tc", "class", "add", "dev", iface, "parent", "1:", "classid", "1:1", "htb", "rate", rate, "ceil", rate)
+	if output, err := rootCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add root class: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) changeRoot(iface string, kbps int) error {
+	rate := strconv.Itoa(kbps) + "kbit"
+	cmd := exec.Command("tc", "class", "change", "dev", iface, "parent", "1:", "classid", "1:1",
+		"htb", "rate", rate, "ceil", rate)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to change root class rate: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) removeRoot(iface string) error {
+	if output, err := exec.Command("tc", "qdisc", "del", "dev", iface, "root").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove root qdisc: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) replaceClass(iface, classID string, kbps, priority int) error {
+	rate := strconv.Itoa(kbps) + "kbit"
+	cmd := exec.Command("tc", "class", "replace", "dev", iface, "parent", "1:1",
+		"classid", "1:"+classID, "htb", "rate", rate, "ceil", rate, "prio", strconv.Itoa(priority))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set tc class rate: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) deleteClass(iface, classID string) error {
+	if output, err := exec.Command("tc", "class", "del", "dev", iface, "classid", "1:"+classID).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove tc class: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) addFilter(iface string, method filterMethod, hw net.HardwareAddr, classID, priority string) error {
+	add := append([]string{"filter", "add", "dev", iface, "parent", "1:0", "protocol", "all", "prio", priority},
+		filterMatch(method, hw)...)
+	add = append(add, "flowid", "1:"+classID)
+	if output, err := exec.Command("tc", add...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add tc filter: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+func (execTC) deleteFilter(iface string, method filterMethod, priority string) error {
+	if output, err := exec.Command("tc", "filter", "del", "dev", iface, "parent", "1:0", "prio", priority).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove tc filter: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
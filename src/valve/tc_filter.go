@@ -0,0 +1,108 @@
+package valve
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// filterMethod is how tc filters steer a client's traffic into its class
+type filterMethod string
+
+const (
+	// filterFlower matches the destination MAC with the flower classifier
+	filterFlower filterMethod = "flower"
+	// filterU32 matches the destination MAC bytes in the ethernet header with u32, for kernels without flower
+	filterU32 filterMethod = "u32"
+)
+
+// probeMAC is a locally administered address used to test filter support without matching real clients
+const probeMAC = "02:00:00:00:00:00"
+
+// probePriority keeps the probe filter away from the priorities used by client filters
+const probePriority = "65535"
+
+// filterMethods caches the filter method that works on each interface
+var (
+	filterMethods      = make(map[string]filterMethod)
+	filterMethodsMutex = &sync.Mutex{}
+)
+
+// filterMethodFor returns the filter method of an interface, probing it the first time
+func filterMethodFor(iface string) filterMethod {
+	filterMethodsMutex.Lock()
+	defer filterMethodsMutex.Unlock()
+
+	if method, known := filterMethods[iface]; known {
+		return method
+	}
+
+	method := filterU32
+	if probeFilter(iface, filterFlower) {
+		method = filterFlower
+	}
+	filterMethods[iface] = method
+
+	logger.WithFields(logrus.Fields{
+		"interface": iface,
+		"method":    method,
+	}).Info("Selected tc filter method")
+	return method
+}
+
+// probeFilter adds and removes a filter on the interface to check the method is supported
+func probeFilter(iface string, method filterMethod) bool {
+	hw, _ := net.ParseMAC(probeMAC)
+	if err := tc().addFilter(iface, method, hw, "1", probePriority); err != nil {
+		logger.WithFields(logrus.Fields{
+			"interface": iface,
+			"method":    method,
+			"error":     err,
+		}).Debug("tc filter method not supported")
+		return false
+	}
+
+	tc().deleteFilter(iface, method, probePriority)
+	return true
+}
+
+// parseGateMAC parses the MAC address of a gate for its filter
+func parseGateMAC(macAddress string) (net.HardwareAddr, error) {
+	hw, err := net.ParseMAC(macAddress)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", macAddress)
+	}
+	return hw, nil
+}
+
+// filterMatch returns the tc classifier arguments matching frames sent to a MAC address
+func filterMatch(method filterMethod, hw net.HardwareAddr) []string {
+	switch method {
+	case filterFlower:
+		return []string{"flower", "dst_mac", hw.String()}
+	default:
+		// Offsets are relative to the network header, the destination MAC starts 14 bytes before it.
+		// Values are written byte by byte so they don't depend on the host byte order.
+		return []string{"u32",
+			"match", "u32", fmt.Sprintf("0x%02x%02x%02x%02x", hw[0], hw[1], hw[2], hw[3]), "0xffffffff", "at", "-14",
+			"match", "u16", fmt.Sprintf("0x%02x%02x", hw[4], hw[5]), "0xffff", "at", "-10",
+		}
+	}
+}
+
+// addGateFilter steers the traffic of a MAC address into its class.
+// Each class gets its own filter priority, so the filter can be removed without knowing its handle.
+func addGateFilter(iface, macAddress, classID string) error {
+	hw, err := parseGateMAC(macAddress)
+	if err != nil {
+		return err
+	}
+	return tc().addFilter(iface, filterMethodFor(iface), hw, classID, classID)
+}
+
+// removeGateFilter removes the filter of a class
+func removeGateFilter(iface, classID string) {
+	tc().deleteFilter(iface, filterMethodFor(iface), classID) // Ignore errors, filter may not exist
+}
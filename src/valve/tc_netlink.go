@@ -0,0 +1,250 @@
+//go:build linux
+// +build linux
+
+package valve
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// rootClassMinor is the minor of the root class 1:1, which also takes unclassified traffic
+const rootClassMinor = 1
+
+// netlinkTC changes the qdisc, classes and filters over netlink, without forking tc
+type netlinkTC struct {
+	handle *netlink.Handle
+}
+
+// newNetlinkTC opens a netlink socket and checks it can list the qdiscs, which needs the kernel's tc support
+func newNetlinkTC() (trafficControl, error) {
+	handle, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if _, err := handle.QdiscList(nil); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to list qdiscs over netlink: %w", err)
+	}
+	return &netlinkTC{handle: handle}, nil
+}
+
+func (n *netlinkTC) name() string {
+	return "netlink"
+}
+
+// link looks up the index of an interface
+func (n *netlinkTC) link(iface string) (netlink.Link, error) {
+	link, err := n.handle.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", iface, err)
+	}
+	return link, nil
+}
+
+// parseMinor parses a class ID or filter priority, which both fit 16 bits
+func parseMinor(value string) (uint16, error) {
+	minor, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tc class or priority %q", value)
+	}
+	return uint16(minor), nil
+}
+
+// htbClass returns the class 1:minor with the rate as both rate and ceil
+func htbClass(link netlink.Link, parent uint32, minor uint16, kbps, priority int) *netlink.HtbClass {
+	rate := uint64(kbps) * 1000 // Bits per second
+	return netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Handle:    netlink.MakeHandle(1, minor),
+	}, netlink.HtbClassAttrs{
+		Rate: rate,
+		Ceil: rate,
+		Prio: uint32(priority),
+	})
+}
+
+// rootQdisc returns the HTB qdisc 1: at the root of the interface
+func rootQdisc(link netlink.Link) *netlink.Htb {
+	return netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.HANDLE_ROOT,
+		Handle:    netlink.MakeHandle(1, 0),
+	})
+}
+
+func (n *netlinkTC) hasHTB(iface string) (bool, error) {
+	link, err := n.link(iface)
+	if err != nil {
+		return false, err
+	}
+	qdiscs, err := n.handle.QdiscList(link)
+	if err != nil {
+		return false, fmt.Errorf("failed to check tc qdisc: %w", err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent == netlink.HANDLE_ROOT && qdisc.Type() == "htb" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (n *netlinkTC) initRoot(iface string, kbps int) error {
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+
+	// Remove any existing qdisc, the kernel finds the root one without its handle
+	n.handle.QdiscDel(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Parent: netlink.HANDLE_ROOT},
+	}) // Ignore errors, may not exist
+
+	qdisc := rootQdisc(link)
+	qdisc.Defcls = rootClassMinor
+	if err := n.handle.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("failed to add HTB qdisc: %w", err)
+	}
+
+	root := htbClass(link, netlink.MakeHandle(1, 0), rootClassMinor, kbps, 0)
+	if err := n.handle.ClassAdd(root); err != nil {
+		return fmt.Errorf("failed to add root class: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) changeRoot(iface string, kbps int) error {
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	root := htbClass(link, netlink.MakeHandle(1, 0), rootClassMinor, kbps, 0)
+	if err := n.handle.ClassChange(root); err != nil {
+		return fmt.Errorf("failed to change root class rate: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) removeRoot(iface string) error {
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	if err := n.handle.QdiscDel(rootQdisc(link)); err != nil {
+		return fmt.Errorf("failed to remove root qdisc: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) replaceClass(iface, classID string, kbps, priority int) error {
+	minor, err := parseMinor(classID)
+	if err != nil {
+		return err
+	}
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	class := htbClass(link, netlink.MakeHandle(1, rootClassMinor), minor, kbps, priority)
+	if err := n.handle.ClassReplace(class); err != nil {
+		return fmt.Errorf("failed to set tc class rate: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) deleteClass(iface, classID string) error {
+	minor, err := parseMinor(classID)
+	if err != nil {
+		return err
+	}
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	class := htbClass(link, netlink.MakeHandle(1, rootClassMinor), minor, 0, 0)
+	if err := n.handle.ClassDel(class); err != nil {
+		return fmt.Errorf("failed to remove tc class: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) addFilter(iface string, method filterMethod, hw net.HardwareAddr, classID, priority string) error {
+	minor, err := parseMinor(classID)
+	if err != nil {
+		return err
+	}
+	prio, err := parseMinor(priority)
+	if err != nil {
+		return err
+	}
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+
+	attrs := netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(1, 0),
+		Priority:  prio,
+		Protocol:  unix.ETH_P_ALL,
+	}
+	var filter netlink.Filter
+	switch method {
+	case filterFlower:
+		filter = &netlink.Flower{
+			FilterAttrs: attrs,
+			ClassId:     netlink.MakeHandle(1, minor),
+			DestMac:     hw,
+		}
+	default:
+		// Same match as the tc command: the destination MAC starts 14 bytes before the network header.
+		// Values are in network byte order, netlink converts them for the kernel.
+		filter = &netlink.U32{
+			FilterAttrs: attrs,
+			ClassId:     netlink.MakeHandle(1, minor),
+			Sel: &netlink.TcU32Sel{
+				Flags: netlink.TC_U32_TERMINAL,
+				Keys: []netlink.TcU32Key{
+					{Mask: 0xffffffff, Val: uint32(hw[0])<<24 | uint32(hw[1])<<16 | uint32(hw[2])<<8 | uint32(hw[3]), Off: -14},
+					{Mask: 0x0000ffff, Val: uint32(hw[4])<<8 | uint32(hw[5]), Off: -12},
+				},
+			},
+		}
+	}
+	if err := n.handle.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to add tc filter: %w", err)
+	}
+	return nil
+}
+
+func (n *netlinkTC) deleteFilter(iface string, method filterMethod, priority string) error {
+	prio, err := parseMinor(priority)
+	if err != nil {
+		return err
+	}
+	link, err := n.link(iface)
+	if err != nil {
+		return err
+	}
+	// Without a handle or protocol the kernel removes every filter of the priority, like `tc filter del prio`,
+	// but unlike tc the request names a kind, which must be the one of the filters
+	attrs := netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.MakeHandle(1, 0),
+		Priority:  prio,
+	}
+	var filter netlink.Filter = &netlink.U32{FilterAttrs: attrs}
+	if method == filterFlower {
+		filter = &netlink.Flower{FilterAttrs: attrs}
+	}
+	if err := n.handle.FilterDel(filter); err != nil {
+		return fmt.Errorf("failed to remove tc filter: %w", err)
+	}
+	return nil
+}
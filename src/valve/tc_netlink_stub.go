@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package valve
+
+import "fmt"
+
+// newNetlinkTC is unavailable outside Linux, traffic control falls back to the tc command
+func newNetlinkTC() (trafficControl, error) {
+	return nil, fmt.Errorf("netlink traffic control is only available on Linux")
+}
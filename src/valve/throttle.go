@@ -0,0 +1,104 @@
+package valve
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// limitedGates holds the rate of every MAC address with a tc class and filter, in kbps, and gatePriorities
+// the HTB priority of their class
+var (
+	limitedGates      = make(map[string]int)
+	gatePriorities    = make(map[string]int)
+	limitedGatesMutex = &sync.Mutex{}
+)
+
+// setGatePriority sets the HTB priority the class of a MAC address gets from its next rate change
+func setGatePriority(macAddress string, priority int) {
+	limitedGatesMutex.Lock()
+	defer limitedGatesMutex.Unlock()
+	gatePriorities[macAddress] = priority
+}
+
+// setGateRate creates or changes the tc class of a MAC address and adds its filter the first time
+func setGateRate(macAddress string, kbps int) error {
+	iface := interfaceFor(macAddress)
+	classID := getClassID(macAddress)
+
+	limitedGatesMutex.Lock()
+	defer limitedGatesMutex.Unlock()
+
+	if err := replaceGateClass(macAddress, kbps); err != nil {
+		return err
+	}
+
+	if _, filtered := limitedGates[macAddress]; !filtered {
+		if err := addGateFilter(iface, macAddress, classID); err != nil {
+			return err
+		}
+	}
+
+	limitedGates[macAddress] = kbps
+	return nil
+}
+
+// replaceGateClass sets the tc class of a MAC address to its rate, at most the rate of the root class, and to
+// the priority of its tier. Caller must hold limitedGatesMutex.
+func replaceGateClass(macAddress string, kbps int) error {
+	iface := interfaceFor(macAddress)
+	return tc().replaceClass(iface, getClassID(macAddress), min(kbps, currentRootRate(iface)), gatePriorities[macAddress])
+}
+
+// forgetGateRate drops the rate of a MAC address once its tc class was removed
+func forgetGateRate(macAddress string) {
+	limitedGatesMutex.Lock()
+	defer limitedGatesMutex.Unlock()
+	delete(limitedGates, macAddress)
+	delete(gatePriorities, macAddress)
+}
+
+// ThrottleGate changes the rate of an open gate in place, without closing it
+func ThrottleGate(macAddress string, kbps int) error {
+	if !IsGateOpen(macAddress) {
+		return fmt.Errorf("gate of %s is not open", macAddress)
+	}
+	if kbps <= 0 {
+		return fmt.Errorf("invalid rate %d kbps", kbps)
+	}
+
+	if err := setGateRate(macAddress, kbps); err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"limit_kbps":  kbps,
+	}).Info("Throttled gate")
+
+	runHook(hookEvent{event: hookLimitChange, macAddress: macAddress, limitKbps: kbps})
+	return nil
+}
+
+// RestoreTierLimit puts an open gate back on the bandwidth limit of its tier after throttling
+func RestoreTierLimit(macAddress, tier string) error {
+	if !IsGateOpen(macAddress) {
+		return fmt.Errorf("gate of %s is not open", macAddress)
+	}
+	return setBandwidthLimit(macAddress, tier)
+}
+
+// GetUsage returns the bytes a client transferred since its gate was opened, as counted by the gate backend
+func GetUsage(macAddress string) (uint64, error) {
+	downloaded, uploaded, err := gateTraffic(macAddress)
+	if err != nil {
+		return 0, err
+	}
+	return downloaded + uploaded, nil
+}
+
+// gateTraffic returns the bytes a client downloaded and uploaded since its gate was opened
+func gateTraffic(macAddress string) (downloaded, uploaded uint64, err error) {
+	return gateBackendOf(macAddress).Traffic(macAddress)
+}
@@ -0,0 +1,195 @@
+package valve
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// tierPolicyTable holds the nft sets of clients per tier and the rules dropping their blocked destinations. Every
+// interface has its own table, suffixed with the interface except for br-lan.
+const tierPolicyTable = "tollgate_tiers"
+
+// policyMember is the tier of an authorized MAC address and the interface whose policies apply to it
+type policyMember struct {
+	iface string
+	tier  string
+}
+
+var (
+	tierPolicies      = make(map[string]map[string]config_manager.DestinationPolicy) // Policies of the tiers of each interface
+	policyTiers       = make(map[string]policyMember)                                // Tier of every authorized MAC address
+	tierPoliciesMutex = &sync.Mutex{}
+)
+
+// SetTierPolicies replaces the destination policies of the tiers on an interface and rebuilds the nft table
+// enforcing them. Clients of the interface with an open gate are put back into the set of their tier.
+func SetTierPolicies(iface string, policies map[string]config_manager.DestinationPolicy) error {
+	iface = interfaceName(iface)
+
+	tierPoliciesMutex.Lock()
+	defer tierPoliciesMutex.Unlock()
+
+	tierPolicies[iface] = policies
+
+	members := make(map[string]string)
+	for macAddress, member := range policyTiers {
+		if member.iface == iface {
+			members[macAddress] = member.tier
+		}
+	}
+	script, err := tierPolicyScript(tierPolicyTableFor(iface), policies, members)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply tier policies: %w (output: %s)", err, string(output))
+	}
+
+	logger.WithFields(logrus.Fields{
+		"interface": iface,
+		"tiers":     len(policies),
+	}).Info("Applied tier destination policies")
+	return nil
+}
+
+// tierPolicyTableFor returns the nft table enforcing the tier policies of an interface
+func tierPolicyTableFor(iface string) string {
+	return tierPolicyTable + interfaceSuffix(iface)
+}
+
+// tierSetName returns the nft set holding the clients of a tier
+func tierSetName(tier string) string {
+	return "tier_" + ruleIdentifier(tier)
+}
+
+// tierPolicyScript builds the nft script recreating a policy table with the clients of each tier
+func tierPolicyScript(table string, policies map[string]config_manager.DestinationPolicy, members map[string]string) (string, error) {
+	tiers := make([]string, 0, len(policies))
+	for tier := range policies {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+
+	var script strings.Builder
+	// Declaring the table first makes the delete succeed on the first run
+	fmt.Fprintf(&script, "table inet %s {}\ndelete table inet %s\n", table, table)
+	if len(tiers) == 0 {
+		return script.String(), nil
+	}
+
+	fmt.Fprintf(&script, "table inet %s {\n", table)
+	for _, tier := range tiers {
+		fmt.Fprintf(&script, "\tset %s {\n\t\ttype ether_addr\n", tierSetName(tier))
+		var macs []string
+		for mac, memberTier := range members {
+			if memberTier == tier {
+				macs = append(macs, mac)
+			}
+		}
+		if len(macs) > 0 {
+			sort.Strings(macs)
+			fmt.Fprintf(&script, "\t\telements = { %s }\n", strings.Join(macs, ", "))
+		}
+		script.WriteString("\t}\n")
+	}
+
+	script.WriteString("\tchain forward {\n\t\ttype filter hook forward priority -1; policy accept;\n")
+	for _, tier := range tiers {
+		policy := policies[tier]
+		set := "@" + tierSetName(tier)
+
+		if len(policy.BlockedPorts) > 0 {
+			ports := make([]string, 0, len(policy.BlockedPorts))
+			for _, port := range policy.BlockedPorts {
+				if port < 1 || port > 65535 {
+					return "", fmt.Errorf("invalid blocked port %d for tier %s", port, tier)
+				}
+				ports = append(ports, strconv.Itoa(port))
+			}
+			portList := strings.Join(ports, ", ")
+			fmt.Fprintf(&script, "\t\tether saddr %s tcp dport { %s } drop\n", set, portList)
+			fmt.Fprintf(&script, "\t\tether saddr %s udp dport { %s } drop\n", set, portList)
+		}
+
+		var ipv4, ipv6 []string
+		for _, cidr := range policy.BlockedCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return "", fmt.Errorf("invalid blocked network %q for tier %s: %w", cidr, tier, err)
+			}
+			if network.IP.To4() != nil {
+				ipv4 = append(ipv4, network.String())
+			} else {
+				ipv6 = append(ipv6, network.String())
+			}
+		}
+		if len(ipv4) > 0 {
+			fmt.Fprintf(&script, "\t\tether saddr %s ip daddr { %s } drop\n", set, strings.Join(ipv4, ", "))
+		}
+		if len(ipv6) > 0 {
+			fmt.Fprintf(&script, "\t\tether saddr %s ip6 daddr { %s } drop\n", set, strings.Join(ipv6, ", "))
+		}
+	}
+	script.WriteString("\t}\n}\n")
+
+	return script.String(), nil
+}
+
+// assignTierPolicy moves a MAC address into the set of its tier, so the tier's blocked destinations apply
+func assignTierPolicy(macAddress, tier string) {
+	member := policyMember{iface: interfaceFor(macAddress), tier: tier}
+
+	tierPoliciesMutex.Lock()
+	defer tierPoliciesMutex.Unlock()
+
+	previous, known := policyTiers[macAddress]
+	if known && previous == member {
+		return
+	}
+	if known {
+		removeFromTierSet(macAddress, previous)
+	}
+	policyTiers[macAddress] = member
+
+	if _, restricted := tierPolicies[member.iface][tier]; !restricted {
+		return
+	}
+	cmd := exec.Command("nft", "add", "element", "inet", tierPolicyTableFor(member.iface), tierSetName(tier), "{ "+macAddress+" }")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"tier":        tier,
+			"error":       err,
+			"output":      string(output),
+		}).Warn("Failed to apply tier destination policy")
+	}
+}
+
+// releaseTierPolicy removes a MAC address from the set of its tier once its gate closes
+func releaseTierPolicy(macAddress string) {
+	tierPoliciesMutex.Lock()
+	defer tierPoliciesMutex.Unlock()
+
+	if member, known := policyTiers[macAddress]; known {
+		removeFromTierSet(macAddress, member)
+		delete(policyTiers, macAddress)
+	}
+}
+
+// removeFromTierSet deletes a MAC address from a tier set. Caller must hold tierPoliciesMutex.
+func removeFromTierSet(macAddress string, member policyMember) {
+	if _, restricted := tierPolicies[member.iface][member.tier]; !restricted {
+		return
+	}
+	exec.Command("nft", "delete", "element", "inet", tierPolicyTableFor(member.iface), tierSetName(member.tier), "{ "+macAddress+" }").Run() // Ignore errors, element may not exist
+}
@@ -0,0 +1,162 @@
+package valve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of the usage tracker when the config leaves them at 0
+const (
+	defaultUsageSampleInterval = time.Minute
+	// closedUsageRetention is how long the last sample of a closed gate is kept, for its final usage report
+	closedUsageRetention = time.Hour
+)
+
+// Usage is the traffic of a gate since it opened, as of its last sample
+type Usage struct {
+	MacAddress string `json:"mac_address"`
+	Downloaded uint64 `json:"downloaded"` // Bytes
+	Uploaded   uint64 `json:"uploaded"`   // Bytes
+	OpenedAt   int64  `json:"opened_at"`
+	SampledAt  int64  `json:"sampled_at"`
+	ClosedAt   int64  `json:"closed_at,omitempty"` // Set once the gate closed, the sample is final
+}
+
+var (
+	usageTracking = make(map[string]config_manager.UsageConfig) // Usage tracker settings of each interface
+	usageTrackers = make(map[string]bool)                       // Interfaces whose gates are sampled by a tracker
+	usageSamples  = make(map[string]Usage)
+	usageMutex    = &sync.Mutex{}
+)
+
+// SetUsageTracking configures the usage tracker of the gates on an interface, starting it the first time
+func SetUsageTracking(iface string, config config_manager.UsageConfig) {
+	iface = interfaceName(iface)
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	usageTracking[iface] = config
+	if !usageTrackers[iface] {
+		usageTrackers[iface] = true
+		go trackUsage(iface)
+	}
+}
+
+// LastUsage returns the last sample of a gate, open or closed within the last hour
+func LastUsage(macAddress string) (Usage, bool) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	usage, exists := usageSamples[macAddress]
+	return usage, exists
+}
+
+// trackUsage samples the traffic counters of every open gate on an interface at its configured interval
+func trackUsage(iface string) {
+	for {
+		usageMutex.Lock()
+		config := usageTracking[iface]
+		usageMutex.Unlock()
+
+		interval := time.Duration(config.SampleIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultUsageSampleInterval
+		}
+		time.Sleep(interval)
+
+		if config.Enabled {
+			sampleUsage(iface)
+		}
+	}
+}
+
+// sampleUsage reads the traffic counters of the open gates on an interface and forgets samples of its gates
+// closed long ago
+func sampleUsage(iface string) {
+	gatesMutex.Lock()
+	opened := make(map[string]time.Time, len(openGates))
+	for macAddress, gate := range openGates {
+		if !isDryRun(macAddress) && boundTo(macAddress, iface) {
+			opened[macAddress] = gate.opened
+		}
+	}
+	gatesMutex.Unlock()
+
+	for macAddress, openedAt := range opened {
+		downloaded, uploaded, err := gateTraffic(macAddress)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+			}).Debug("Failed to sample gate traffic")
+			continue
+		}
+		recordUsage(Usage{
+			MacAddress: macAddress,
+			Downloaded: downloaded,
+			Uploaded:   uploaded,
+			OpenedAt:   openedAt.Unix(),
+			SampledAt:  time.Now().Unix(),
+		})
+	}
+
+	cutoff := time.Now().Add(-closedUsageRetention).Unix()
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	for macAddress, usage := range usageSamples {
+		if _, open := opened[macAddress]; open || !boundTo(macAddress, iface) {
+			continue
+		}
+		if usage.ClosedAt == 0 || usage.ClosedAt < cutoff {
+			delete(usageSamples, macAddress)
+		}
+	}
+}
+
+// recordUsage stores a sample, unless it belongs to an earlier opening of the gate than the stored one or the
+// gate closed after it was taken
+func recordUsage(usage Usage) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	if last, exists := usageSamples[usage.MacAddress]; exists {
+		if last.OpenedAt > usage.OpenedAt || (last.OpenedAt == usage.OpenedAt && last.ClosedAt != 0) {
+			return
+		}
+	}
+	usageSamples[usage.MacAddress] = usage
+}
+
+// sampleClosingGate takes the final sample of a gate before its counters are reset by closing it.
+// Caller must hold gatesMutex.
+func sampleClosingGate(macAddress string, gate *openGate) {
+	iface := interfaceFor(macAddress)
+	usageMutex.Lock()
+	enabled := usageTracking[iface].Enabled
+	usageMutex.Unlock()
+	if !enabled || isDryRun(macAddress) {
+		return
+	}
+
+	now := time.Now().Unix()
+	downloaded, uploaded, err := gateTraffic(macAddress)
+	if err != nil {
+		// The last periodic sample becomes the final one
+		usageMutex.Lock()
+		if last, exists := usageSamples[macAddress]; exists && last.OpenedAt == gate.opened.Unix() {
+			last.ClosedAt = now
+			usageSamples[macAddress] = last
+		}
+		usageMutex.Unlock()
+		return
+	}
+	recordUsage(Usage{
+		MacAddress: macAddress,
+		Downloaded: downloaded,
+		Uploaded:   uploaded,
+		OpenedAt:   gate.opened.Unix(),
+		SampledAt:  now,
+		ClosedAt:   now,
+	})
+}
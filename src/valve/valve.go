@@ -2,96 +2,224 @@ package valve
 
 import (
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
 	"github.com/sirupsen/logrus"
 )
 
 // Module-level logger with pre-configured module field
 var logger = logrus.WithField("module", "valve")
 
+// openGate is an authorized MAC address and when its access ends
+type openGate struct {
+	timer  *time.Timer
+	tier   string
+	until  int64
+	opened time.Time // Kept when the gate is extended
+}
+
+// GateResult tells callers of ExtendGate what happened to the gate
+type GateResult struct {
+	Opened        bool   // The gate was closed and has been opened, otherwise an open gate was extended
+	TierChanged   bool   // An open gate moved to another tier and its bandwidth limit was changed
+	PreviousTier  string // Tier of an extended gate before the call
+	PreviousUntil int64  // Deadline of an extended gate before the call
+}
+
 // openGates keeps track of MAC addresses that have been authorized
 var (
-	openGates  = make(map[string]*time.Timer)
+	openGates  = make(map[string]*openGate)
 	gatesMutex = &sync.Mutex{}
-	// Bandwidth limits for different tiers (in kbps)
-	bandwidthLimits = map[string]int{
+	// Bandwidth limits (in kbps) and HTB priorities of the tiers of each interface, replaced by SetTiers
+	bandwidthLimits = make(map[string]map[string]int)
+	tierPriorities  = make(map[string]map[string]int)
+	tiersMutex      = &sync.RWMutex{}
+	// Interfaces clients connect through, for merchant profiles serving other interfaces than br-lan
+	gateInterfaces  = make(map[string]string)
+	tcInitialized   = make(map[string]bool)
+	interfacesMutex = &sync.Mutex{}
+)
+
+// Tiers of interfaces SetTiers wasn't called for
+var (
+	defaultBandwidthLimits = map[string]int{
 		"free":    2048, // 2Mbps for free tier
 		"premium": 0,    // 0 = unlimited for premium
 		"staff":   0,    // 0 = unlimited for staff
 	}
+	defaultTierPriorities = map[string]int{
+		"free": 1,
+	}
 )
 
+// defaultInterface carries clients that were not bound to another interface
+const defaultInterface = "br-lan"
+
+// Every merchant profile serves the customers of its own interface. The settings the profile's merchant passes
+// to the valve are kept per interface, and a client is served with the settings of the interface it was bound
+// to, so profiles don't override each other's settings.
+
+// interfaceName returns the interface a merchant profile serves, br-lan if it has none configured
+func interfaceName(iface string) string {
+	if iface == "" {
+		return defaultInterface
+	}
+	return iface
+}
+
+// interfaceSuffix tells apart the nft and iptables names of the profile serving an interface. It is empty for
+// br-lan, whose rules keep the names they had before there were profiles.
+func interfaceSuffix(iface string) string {
+	if interfaceName(iface) == defaultInterface {
+		return ""
+	}
+	return "_" + ruleIdentifier(iface)
+}
+
+// ruleIdentifier lowercases a name and replaces what nft and iptables don't take in set and chain names
+func ruleIdentifier(name string) string {
+	var identifier strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			identifier.WriteRune(r)
+		} else {
+			identifier.WriteRune('_')
+		}
+	}
+	return identifier.String()
+}
+
+// BindInterface records the interface a client connects through, so traffic control for its gate
+// is applied there. Traffic control is set up on the interface the first time a client is bound to it.
+func BindInterface(macAddress, iface string) {
+	iface = interfaceName(iface)
+
+	interfacesMutex.Lock()
+	defer interfacesMutex.Unlock()
+
+	gateInterfaces[macAddress] = iface
+	if tcInitialized[iface] {
+		return
+	}
+	if err := initTrafficControl(iface); err != nil {
+		logger.WithFields(logrus.Fields{
+			"interface": iface,
+			"error":     err,
+		}).Warn("Failed to initialize traffic control, bandwidth limiting may not work")
+		return
+	}
+	tcInitialized[iface] = true
+}
+
+// interfaceFor returns the interface a client was bound to, br-lan by default
+func interfaceFor(macAddress string) string {
+	interfacesMutex.Lock()
+	defer interfacesMutex.Unlock()
+	if iface, exists := gateInterfaces[macAddress]; exists {
+		return iface
+	}
+	return defaultInterface
+}
+
+// boundTo reports whether a client was bound to the interface, clients that never were belong to br-lan
+func boundTo(macAddress, iface string) bool {
+	return interfaceFor(macAddress) == interfaceName(iface)
+}
+
+// SetTiers replaces the bandwidth limit and priority of each tier on the interface a merchant profile serves.
+// The staff tier stays unlimited unless it is configured. Gates already open keep their limit until their tier
+// is applied again.
+func SetTiers(iface string, tiers []config_manager.TierConfig) {
+	limits := map[string]int{"staff": 0}
+	priorities := make(map[string]int, len(tiers))
+	for _, tier := range tiers {
+		limits[tier.Name] = max(tier.BandwidthKbps, 0)
+		priorities[tier.Name] = min(max(tier.Priority, 0), 7)
+	}
+
+	tiersMutex.Lock()
+	bandwidthLimits[interfaceName(iface)] = limits
+	tierPriorities[interfaceName(iface)] = priorities
+	tiersMutex.Unlock()
+}
+
+// GetBandwidthLimit returns the bandwidth limit in kbps of a tier on an interface (0 = unlimited)
+func GetBandwidthLimit(iface, tier string) (int, bool) {
+	tiersMutex.RLock()
+	defer tiersMutex.RUnlock()
+	limits, configured := bandwidthLimits[interfaceName(iface)]
+	if !configured {
+		limits = defaultBandwidthLimits
+	}
+	limit, exists := limits[tier]
+	return limit, exists
+}
+
+// tierPriority returns the HTB priority of the limited gates of a tier on an interface
+func tierPriority(iface, tier string) int {
+	tiersMutex.RLock()
+	defer tiersMutex.RUnlock()
+	priorities, configured := tierPriorities[interfaceName(iface)]
+	if !configured {
+		priorities = defaultTierPriorities
+	}
+	return priorities[tier]
+}
+
 // setBandwidthLimit applies traffic control rules to limit bandwidth for a MAC address
 func setBandwidthLimit(macAddress string, tier string) error {
-	limit, exists := bandwidthLimits[tier]
+	iface := interfaceFor(macAddress)
+	limit, exists := GetBandwidthLimit(iface, tier)
 	if !exists {
 		return fmt.Errorf("unknown tier: %s", tier)
 	}
 
 	// If limit is 0, remove any existing limits (unlimited)
 	if limit == 0 {
-		return removeBandwidthLimit(macAddress)
+		err := removeBandwidthLimit(macAddress)
+		runHook(hookEvent{event: hookLimitChange, macAddress: macAddress, tier: tier, limitKbps: limit})
+		return err
 	}
 
 	// Apply bandwidth limit using tc (traffic control)
 	// This requires the interface to be configured with HTB qdisc
-	cmd := exec.Command("tc", "class", "add", "dev", "br-lan", "parent", "1:1", "classid", "1:"+getClassID(macAddress),
-		"htb", "rate", strconv.Itoa(limit)+"kbit", "ceil", strconv.Itoa(limit)+"kbit")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
+	setGatePriority(macAddress, tierPriority(iface, tier))
+	if err := setGateRate(macAddress, limit); err != nil {
 		logger.WithFields(logrus.Fields{
 			"mac_address": macAddress,
 			"tier":        tier,
 			"limit":       limit,
 			"error":       err,
-			"output":      string(output),
-		}).Warn("Failed to set bandwidth limit, may already exist or tc not configured")
+		}).Warn("Failed to set bandwidth limit, tc may not be configured")
 		// Don't return error - some systems may not have tc configured
 	}
 
-	// Add filter to match the MAC address to the class
-	filterCmd := exec.Command("tc", "filter", "add", "dev", "br-lan", "protocol", "ip", "parent", "1:0",
-		"prio", "1", "u32", "match", "u16", "0x0800", "0xFFFF", "at", "-2",
-		"match", "u32", "0x"+strings.Replace(macAddress, ":", "", -1), "0xFFFFFFFF", "at", "-12",
-		"flowid", "1:"+getClassID(macAddress))
-	filterOutput, filterErr := filterCmd.CombinedOutput()
-	if filterErr != nil {
-		logger.WithFields(logrus.Fields{
-			"mac_address": macAddress,
-			"tier":        tier,
-			"error":       filterErr,
-			"output":      string(filterOutput),
-		}).Warn("Failed to add tc filter")
-	}
-
 	logger.WithFields(logrus.Fields{
 		"mac_address": macAddress,
 		"tier":        tier,
 		"limit_kbps":  limit,
 	}).Info("Applied bandwidth limit")
 
+	runHook(hookEvent{event: hookLimitChange, macAddress: macAddress, tier: tier, limitKbps: limit})
+
 	return nil
 }
 
 // removeBandwidthLimit removes traffic control rules for a MAC address
 func removeBandwidthLimit(macAddress string) error {
 	classID := getClassID(macAddress)
+	iface := interfaceFor(macAddress)
 
 	// Remove filter first
-	filterCmd := exec.Command("tc", "filter", "del", "dev", "br-lan", "protocol", "ip", "parent", "1:0",
-		"prio", "1", "u32", "match", "u16", "0x0800", "0xFFFF", "at", "-2",
-		"match", "u32", "0x"+strings.Replace(macAddress, ":", "", -1), "0xFFFFFFFF", "at", "-12",
-		"flowid", "1:"+classID)
-	filterCmd.Run() // Ignore errors, filter may not exist
+	removeGateFilter(iface, classID)
 
 	// Remove class
-	classCmd := exec.Command("tc", "class", "del", "dev", "br-lan", "classid", "1:"+classID)
-	classCmd.Run() // Ignore errors, class may not exist
+	tc().deleteClass(iface, classID) // Ignore errors, class may not exist
+	forgetGateRate(macAddress)
 
 	logger.WithFields(logrus.Fields{
 		"mac_address": macAddress,
@@ -117,55 +245,64 @@ func getClassID(macAddress string) string {
 	return "2" // Fallback
 }
 
-// initTrafficControl initializes the traffic control qdisc on the bridge interface
+// initTrafficControl initializes the traffic control qdisc on a bridge interface
 // This must be called before applying bandwidth limits
-func initTrafficControl() error {
+func initTrafficControl(iface string) error {
 	// Check if HTB qdisc is already set up
-	cmd := exec.Command("tc", "qdisc", "show", "dev", "br-lan")
-	output, err := cmd.Output()
+	configured, err := tc().hasHTB(iface)
 	if err != nil {
-		return fmt.Errorf("failed to check tc qdisc: %w", err)
+		return err
 	}
 
-	// If HTB is already configured, don't reconfigure
-	if strings.Contains(string(output), "htb") {
-		logger.Debug("Traffic control already initialized on br-lan")
+	// If HTB is already configured, don't reconfigure, but size its root class to the current WAN capacity
+	if configured {
+		tc().changeRoot(iface, currentRootRate(iface))
+		logger.WithField("interface", iface).Debug("Traffic control already initialized")
 		return nil
 	}
 
-	// Remove any existing qdisc
-	delCmd := exec.Command("tc", "qdisc", "del", "dev", "br-lan", "root")
-	delCmd.Run() // Ignore errors, may not exist
-
-	// Add HTB qdisc
-	addCmd := exec.Command("tc", "qdisc", "add", "dev", "br-lan", "root", "handle", "1:", "htb", "default", "1")
-	if output, err := addCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add HTB qdisc: %w (output: %s)", err, string(output))
-	}
-
-	// Add root class with unlimited bandwidth
-	rootCmd := exec.Command("tc", "class", "add", "dev", "br-lan", "parent", "1:", "classid", "1:1", "htb", "rate", "1000mbit", "ceil", "1000mbit")
-	if output, err := rootCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add root class: %w (output: %s)", err, string(output))
+	// Replace any existing qdisc by HTB with a root class sized to the WAN capacity, 1000mbit while it is unknown
+	if err := tc().initRoot(iface, currentRootRate(iface)); err != nil {
+		return err
 	}
 
-	logger.Info("Initialized traffic control on br-lan interface")
+	logger.WithField("interface", iface).Info("Initialized traffic control")
 	return nil
 }
 
 // InitTrafficControl initializes traffic control on the bridge interface
 func InitTrafficControl() error {
-	return initTrafficControl()
+	return InitTrafficControlOn(defaultInterface)
+}
+
+// InitTrafficControlOn initializes traffic control on the interface a merchant profile serves
+func InitTrafficControlOn(iface string) error {
+	iface = interfaceName(iface)
+	if err := initTrafficControl(iface); err != nil {
+		return err
+	}
+	interfacesMutex.Lock()
+	tcInitialized[iface] = true
+	interfacesMutex.Unlock()
+	return nil
 }
 
-// authorizeMAC authorizes a MAC address using ndsctl and applies bandwidth limits
+// authorizeMAC opens the gate of a MAC address with the gate backend and applies bandwidth limits
 func authorizeMAC(macAddress string, tier string) error {
-	cmd := exec.Command("ndsctl", "auth", macAddress)
-	output, err := cmd.Output()
-	if err != nil {
+	if isDryRun(macAddress) {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"tier":        tier,
+		}).Info("Dry run, not authorizing MAC")
+		return nil
+	}
+
+	backend := gateBackendOf(macAddress)
+	if err := backend.Allow(macAddress); err != nil {
 		logger.WithFields(logrus.Fields{
 			"mac_address": macAddress,
 			"tier":        tier,
+			"backend":     backend.Name(),
 			"error":       err,
 		}).Error("Error authorizing MAC address")
 		return err
@@ -174,7 +311,7 @@ func authorizeMAC(macAddress string, tier string) error {
 	logger.WithFields(logrus.Fields{
 		"mac_address": macAddress,
 		"tier":        tier,
-		"output":      string(output),
+		"backend":     backend.Name(),
 	}).Info("Authorization successful for MAC")
 
 	// Apply bandwidth limiting based on tier
@@ -185,17 +322,26 @@ func authorizeMAC(macAddress string, tier string) error {
 			"error":       err,
 		}).Warn("Failed to apply bandwidth limit, but authorization succeeded")
 	}
+	assignTierPolicy(macAddress, tier)
+	assignIPv6Prefix(macAddress, tier)
 
 	return nil
 }
 
-// deauthorizeMAC deauthorizes a MAC address using ndsctl and removes bandwidth limits
+// deauthorizeMAC closes the gate of a MAC address with the gate backend and removes bandwidth limits
 func deauthorizeMAC(macAddress string) error {
-	cmd := exec.Command("ndsctl", "deauth", macAddress)
-	output, err := cmd.Output()
-	if err != nil {
+	if isDryRun(macAddress) {
 		logger.WithFields(logrus.Fields{
 			"mac_address": macAddress,
+		}).Info("Dry run, not deauthorizing MAC")
+		return nil
+	}
+
+	backend := gateBackendOf(macAddress)
+	if err := backend.Block(macAddress); err != nil {
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+			"backend":     backend.Name(),
 			"error":       err,
 		}).Error("Error deauthorizing MAC address")
 		return err
@@ -203,7 +349,7 @@ func deauthorizeMAC(macAddress string) error {
 
 	logger.WithFields(logrus.Fields{
 		"mac_address": macAddress,
-		"output":      string(output),
+		"backend":     backend.Name(),
 	}).Debug("Deauthorization successful for MAC")
 
 	// Remove bandwidth limiting
@@ -213,6 +359,8 @@ func deauthorizeMAC(macAddress string) error {
 			"error":       err,
 		}).Warn("Failed to remove bandwidth limit, but deauthorization succeeded")
 	}
+	releaseTierPolicy(macAddress)
+	releaseIPv6Prefix(macAddress)
 
 	return nil
 }
@@ -220,6 +368,13 @@ func deauthorizeMAC(macAddress string) error {
 // OpenGateUntil opens the gate (if not opened yet) and sets a timer until the timestamp.
 // If there is already a timer running, it will extend the timer.
 func OpenGateUntil(macAddress string, untilTimestamp int64, tier string) error {
+	_, err := ExtendGate(macAddress, untilTimestamp, tier)
+	return err
+}
+
+// ExtendGate opens a closed gate until the timestamp, or moves the deadline of an open gate to it.
+// An open gate changing tier gets the bandwidth limit of the new tier, an empty tier keeps the current one.
+func ExtendGate(macAddress string, untilTimestamp int64, tier string) (GateResult, error) {
 	now := time.Now().Unix()
 
 	// Calculate duration until the target timestamp
@@ -227,63 +382,149 @@ func OpenGateUntil(macAddress string, untilTimestamp int64, tier string) error {
 
 	// If the timestamp is in the past, return an error
 	if durationSeconds <= 0 {
-		return fmt.Errorf("timestamp %d is in the past (current time: %d)", untilTimestamp, now)
+		return GateResult{}, fmt.Errorf("timestamp %d is in the past (current time: %d)", untilTimestamp, now)
 	}
 
-	logger.WithFields(logrus.Fields{
-		"mac_address":      macAddress,
-		"until_timestamp":  untilTimestamp,
-		"duration_seconds": durationSeconds,
-	}).Info("Opening gate until timestamp")
-
 	gatesMutex.Lock()
 	defer gatesMutex.Unlock()
 
-	// Check if the MAC is already in openGates
-	existingTimer, exists := openGates[macAddress]
+	var result GateResult
+	existing, exists := openGates[macAddress]
 
 	if !exists {
 		// MAC not in openGates, authorize it
 		err := authorizeMAC(macAddress, tier)
 		if err != nil {
-			return fmt.Errorf("error authorizing MAC: %w", err)
+			return GateResult{}, fmt.Errorf("error authorizing MAC: %w", err)
 		}
+		result.Opened = true
+
 		logger.WithFields(logrus.Fields{
-			"mac_address": macAddress,
-		}).Debug("New authorization for MAC")
+			"mac_address":      macAddress,
+			"tier":             tier,
+			"until_timestamp":  untilTimestamp,
+			"duration_seconds": durationSeconds,
+		}).Info("Opened gate")
+
+		limit, _ := GetBandwidthLimit(interfaceFor(macAddress), tier)
+		runHook(hookEvent{
+			event:          hookAuthorize,
+			macAddress:     macAddress,
+			tier:           tier,
+			limitKbps:      limit,
+			untilTimestamp: untilTimestamp,
+		})
 	} else {
 		// MAC already in openGates, stop the existing timer
-		if existingTimer != nil {
-			existingTimer.Stop()
+		existing.timer.Stop()
+		result.PreviousTier = existing.tier
+		result.PreviousUntil = existing.until
+
+		if tier == "" {
+			tier = existing.tier
+		} else if tier != existing.tier {
+			if err := setBandwidthLimit(macAddress, tier); err != nil {
+				logger.WithFields(logrus.Fields{
+					"mac_address": macAddress,
+					"tier":        tier,
+					"error":       err,
+				}).Warn("Failed to apply bandwidth limit of the new tier")
+			}
+			assignTierPolicy(macAddress, tier)
+			assignIPv6Prefix(macAddress, tier)
+			result.TierChanged = true
 		}
+
 		logger.WithFields(logrus.Fields{
-			"mac_address": macAddress,
-		}).Debug("Extending access for already authorized MAC")
+			"mac_address":     macAddress,
+			"tier":            tier,
+			"previous_until":  existing.until,
+			"until_timestamp": untilTimestamp,
+		}).Info("Extended gate")
 	}
 
-	// Create a new timer that will call deauthorizeMAC when it expires
-	duration := time.Duration(durationSeconds) * time.Second
-	timer := time.AfterFunc(duration, func() {
+	// Close the gate when the deadline passes, unless it was extended or closed meanwhile
+	gate := &openGate{tier: tier, until: untilTimestamp, opened: time.Now()}
+	if exists {
+		gate.opened = existing.opened
+	}
+	gate.timer = time.AfterFunc(time.Duration(durationSeconds)*time.Second, func() {
+		gatesMutex.Lock()
+		defer gatesMutex.Unlock()
+		if openGates[macAddress] != gate {
+			return
+		}
+		delete(openGates, macAddress)
+		sampleClosingGate(macAddress, gate)
+
 		err := deauthorizeMAC(macAddress)
 		if err != nil {
 			logger.WithFields(logrus.Fields{
 				"mac_address": macAddress,
 				"error":       err,
 			}).Error("Error deauthorizing MAC after timeout")
-		} else {
-			logger.WithFields(logrus.Fields{
-				"mac_address": macAddress,
-			}).Debug("Successfully deauthorized MAC after timeout")
+			return
 		}
+		logger.WithFields(logrus.Fields{
+			"mac_address": macAddress,
+		}).Debug("Successfully deauthorized MAC after timeout")
 
-		// Remove the MAC from openGates once timer expires
-		gatesMutex.Lock()
-		delete(openGates, macAddress)
-		gatesMutex.Unlock()
+		runHook(hookEvent{event: hookDeauthorize, macAddress: macAddress, tier: gate.tier, untilTimestamp: gate.until})
 	})
+	openGates[macAddress] = gate
+	if result.Opened {
+		scheduleGateVerification(macAddress, gate)
+	}
 
-	// Store the timer in openGates
-	openGates[macAddress] = timer
+	return result, nil
+}
 
-	return nil
+// CloseGate deauthorizes a MAC address right away and cancels its pending timer.
+// Returns false if the gate was not open.
+func CloseGate(macAddress string) (bool, error) {
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+
+	gate, exists := openGates[macAddress]
+	if !exists {
+		return false, nil
+	}
+	gate.timer.Stop()
+	delete(openGates, macAddress)
+	sampleClosingGate(macAddress, gate)
+
+	if err := deauthorizeMAC(macAddress); err != nil {
+		return true, fmt.Errorf("error deauthorizing MAC: %w", err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+	}).Info("Closed gate")
+
+	runHook(hookEvent{event: hookDeauthorize, macAddress: macAddress, tier: gate.tier, untilTimestamp: time.Now().Unix()})
+	return true, nil
+}
+
+// IsGateOpen reports whether a MAC address is currently authorized
+func IsGateOpen(macAddress string) bool {
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+	_, exists := openGates[macAddress]
+	return exists
+}
+
+// NotifyIPChange runs the IP change hook for a MAC address with an open gate, so rules
+// operator scripts keyed on the client's IP can follow it
+func NotifyIPChange(macAddress, oldIP, newIP string) {
+	if !IsGateOpen(macAddress) {
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"mac_address": macAddress,
+		"old_ip":      oldIP,
+		"new_ip":      newIP,
+	}).Info("Client with open gate changed IP address")
+
+	runHook(hookEvent{event: hookIPChange, macAddress: macAddress, ipAddress: newIP})
 }
@@ -0,0 +1,284 @@
+package valve
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// seedGate registers an open gate without calling ndsctl, which isn't available in tests
+func seedGate(macAddress string, tier string) {
+	gatesMutex.Lock()
+	defer gatesMutex.Unlock()
+	openGates[macAddress] = &openGate{timer: time.AfterFunc(time.Hour, func() {}), tier: tier, until: time.Now().Add(time.Hour).Unix()}
+}
+
+// TestConcurrentGateExpiries extends, closes and expires gates at the same time.
+// It only catches data races when run with the race detector: go test -race ./...
+func TestConcurrentGateExpiries(t *testing.T) {
+	const workers = 8
+	macAddresses := make([]string, workers)
+	for i := range macAddresses {
+		macAddresses[i] = fmt.Sprintf("00:11:22:33:44:%02x", i)
+		seedGate(macAddresses[i], "premium")
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		macAddress := macAddresses[worker]
+		wg.Add(3)
+
+		// Purchases extending the gate until it expires a second from now
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				ExtendGate(macAddress, time.Now().Unix()+1, "")
+			}
+		}()
+
+		// Sessions ending early
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if i == 10 {
+					CloseGate(macAddress)
+				}
+				IsGateOpen(macAddress)
+			}
+		}()
+
+		// Clients moving to another IP address
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				NotifyIPChange(macAddress, "10.0.0.2", "10.0.0.3")
+				interfaceFor(macAddress)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Let the extended gates expire and their timers run
+	time.Sleep(2500 * time.Millisecond)
+	for _, macAddress := range macAddresses {
+		if IsGateOpen(macAddress) {
+			t.Errorf("Gate of %s still open after its deadline", macAddress)
+		}
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, id, err := buildDNSQuery("mint.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatalf("buildDNSQuery() failed: %v", err)
+	}
+
+	// The resolver answers with a CNAME to a CDN host and the address of that host, both names compressed
+	response := append([]byte(nil), query...)
+	response[2], response[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(response[6:8], 2)
+	cname := []byte{3, 'c', 'd', 'n', 0xc0, 17} // cdn.example.com, pointing into the question
+	response = append(response, 0xc0, 12, 0, 5, 0, 1, 0, 0, 0x0e, 0x10, 0, byte(len(cname)))
+	response = append(response, cname...)
+	cnameOffset := byte(len(response) - len(cname))
+	response = append(response, 0xc0, cnameOffset, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 203, 0, 113, 7)
+
+	ips, ttl, err := parseDNSResponse(response, id, dnsTypeA)
+	if err != nil {
+		t.Fatalf("parseDNSResponse() failed: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "203.0.113.7" {
+		t.Errorf("parseDNSResponse() addresses = %v, want [203.0.113.7]", ips)
+	}
+	if ttl != time.Minute {
+		t.Errorf("parseDNSResponse() TTL = %s, want the TTL of the address record, 1m0s", ttl)
+	}
+
+	if _, _, err := parseDNSResponse(response, id+1, dnsTypeA); err == nil {
+		t.Errorf("parseDNSResponse() accepted a response to another query")
+	}
+}
+
+func TestTargetRootRate(t *testing.T) {
+	defer func() {
+		delete(wanCapacity, defaultInterface)
+		delete(wanMeasurements, defaultInterface)
+	}()
+
+	tests := []struct {
+		name         string
+		config       config_manager.WANCapacityConfig
+		measurements []int
+		want         int
+	}{
+		{"unknown capacity keeps 1000 Mbit/s", config_manager.WANCapacityConfig{}, nil, defaultRootRateKbps},
+		{"configured capacity", config_manager.WANCapacityConfig{CapacityMbps: 50}, []int{900000}, 47500},
+		{"peak of the measurements", config_manager.WANCapacityConfig{MeasureURL: "http://example.com/file"}, []int{30000, 80000, 20000}, 76000},
+		{"no measurement yet", config_manager.WANCapacityConfig{MeasureURL: "http://example.com/file"}, nil, defaultRootRateKbps},
+		{"starved measurement", config_manager.WANCapacityConfig{MeasureURL: "http://example.com/file"}, []int{100}, minRootRateKbps},
+	}
+	for _, tt := range tests {
+		wanCapacity[defaultInterface] = tt.config
+		wanMeasurements[defaultInterface] = tt.measurements
+		if got := targetRootRate(defaultInterface); got != tt.want {
+			t.Errorf("%s: targetRootRate() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLearnedPorts(t *testing.T) {
+	fdb := `33:33:00:00:00:01 dev br-lan self permanent
+aa:bb:cc:dd:ee:01 dev wlan0 master br-lan
+AA:BB:CC:DD:EE:02 dev lan1 vlan 1 master br-lan
+aa:bb:cc:dd:ee:02 dev lan1 master br-lan
+aa:bb:cc:dd:ee:02 dev wlan1 master br-guest
+f2:00:00:00:00:01 dev lan1 master br-lan permanent
+`
+	ports := learnedPorts(fdb)
+
+	if got := ports["aa:bb:cc:dd:ee:01"]; len(got) != 1 || got[0] != "wlan0" {
+		t.Errorf("ports of a wireless client = %v, want [wlan0]", got)
+	}
+	if got := ports["aa:bb:cc:dd:ee:02"]; len(got) != 2 || got[0] != "lan1" || got[1] != "wlan1" {
+		t.Errorf("ports of a MAC address on two bridges = %v, want [lan1 wlan1]", got)
+	}
+	if _, found := ports["f2:00:00:00:00:01"]; found {
+		t.Errorf("permanent entry of a port was taken for a client")
+	}
+	if len(ports) != 2 {
+		t.Errorf("learnedPorts() found %d clients, want 2", len(ports))
+	}
+}
+
+func TestGateBackendFor(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "opennds"},
+		{config_manager.GateModeCaptivePortal, "opennds"},
+		{config_manager.GateModeWired, "nftables"},
+		{config_manager.GateModeIptables, "iptables"},
+		{config_manager.GateModeHostapd, "hostapd"},
+	}
+	for _, tt := range tests {
+		backend, err := gateBackendFor(config_manager.NDSConfig{Mode: tt.mode})
+		if err != nil {
+			t.Fatalf("gateBackendFor(%q) failed: %v", tt.mode, err)
+		}
+		if backend.Name() != tt.want {
+			t.Errorf("gateBackendFor(%q) = %s, want %s", tt.mode, backend.Name(), tt.want)
+		}
+	}
+	if _, err := gateBackendFor(config_manager.NDSConfig{Mode: "bogus"}); err == nil {
+		t.Errorf("gateBackendFor() accepted an unknown mode")
+	}
+}
+
+func TestUtilizationPercent(t *testing.T) {
+	// 75 MB in a minute is 10 Mbit/s
+	if got := utilizationPercent(75_000_000, time.Minute, 20_000); got != 50 {
+		t.Errorf("utilizationPercent() = %d, want 50", got)
+	}
+	if got := utilizationPercent(75_000_000, 0, 20_000); got != 0 {
+		t.Errorf("utilizationPercent() without elapsed time = %d, want 0", got)
+	}
+}
+
+// TestProfileSettings configures two merchant profiles and checks each keeps its own settings for its clients
+func TestProfileSettings(t *testing.T) {
+	const guest, staff = "br-lan", "br-staff"
+	const guestMAC, staffMAC = "00:11:22:33:55:01", "00:11:22:33:55:02"
+	interfacesMutex.Lock()
+	gateInterfaces[guestMAC] = guest
+	gateInterfaces[staffMAC] = staff
+	interfacesMutex.Unlock()
+	defer func() {
+		interfacesMutex.Lock()
+		delete(gateInterfaces, guestMAC)
+		delete(gateInterfaces, staffMAC)
+		interfacesMutex.Unlock()
+		for _, iface := range []string{guest, staff} {
+			delete(hooks, iface)
+			delete(bandwidthLimits, iface)
+			delete(tierPriorities, iface)
+			delete(gateVerification, iface)
+			delete(wanCapacity, iface)
+			delete(rootRates, iface)
+		}
+	}()
+
+	for _, profile := range []struct {
+		iface    string
+		script   string
+		kbps     int
+		priority int
+		delay    int
+		mbps     uint64
+	}{
+		{guest, "/etc/tollgate/guest-authorize", 2048, 3, 30, 50},
+		{staff, "/etc/tollgate/staff-authorize", 0, 0, 60, 200},
+	} {
+		SetHooks(profile.iface, config_manager.HooksConfig{OnAuthorize: profile.script})
+		SetTiers(profile.iface, []config_manager.TierConfig{{Name: "basic", BandwidthKbps: profile.kbps, Priority: profile.priority}})
+		SetGateVerification(profile.iface, config_manager.GateVerificationConfig{Enabled: true, DelaySeconds: profile.delay})
+		SetWANCapacity(profile.iface, config_manager.WANCapacityConfig{CapacityMbps: profile.mbps})
+	}
+
+	if script, _ := hookScript(guestMAC, hookAuthorize); script != "/etc/tollgate/guest-authorize" {
+		t.Errorf("guest hook = %q, want the guest profile's", script)
+	}
+	if script, _ := hookScript(staffMAC, hookAuthorize); script != "/etc/tollgate/staff-authorize" {
+		t.Errorf("staff hook = %q, want the staff profile's", script)
+	}
+
+	if limit, _ := GetBandwidthLimit(guest, "basic"); limit != 2048 {
+		t.Errorf("guest basic tier limit = %d, want 2048", limit)
+	}
+	if limit, _ := GetBandwidthLimit(staff, "basic"); limit != 0 {
+		t.Errorf("staff basic tier limit = %d, want unlimited", limit)
+	}
+	if priority := tierPriority(guest, "basic"); priority != 3 {
+		t.Errorf("guest basic tier priority = %d, want 3", priority)
+	}
+	if _, known := GetBandwidthLimit("br-other", "free"); !known {
+		t.Errorf("interface without tiers lost the default tiers")
+	}
+
+	if delay := gateVerification[guest].DelaySeconds; delay != 30 {
+		t.Errorf("guest verification delay = %d, want 30", delay)
+	}
+	if delay := gateVerification[staff].DelaySeconds; delay != 60 {
+		t.Errorf("staff verification delay = %d, want 60", delay)
+	}
+
+	if rate := currentRootRate(guest); rate != 47500 {
+		t.Errorf("guest root rate = %d, want 47500", rate)
+	}
+	if rate := currentRootRate(staff); rate != 190000 {
+		t.Errorf("staff root rate = %d, want 190000", rate)
+	}
+
+	if tierPolicyTableFor(guest) == tierPolicyTableFor(staff) {
+		t.Errorf("profiles share the tier policy table %s", tierPolicyTableFor(guest))
+	}
+	guestTable, _ := nftGate{bridge: guest}.tables()
+	staffTable, _ := nftGate{bridge: staff}.tables()
+	if guestTable != wiredTable || staffTable == wiredTable {
+		t.Errorf("wired tables = %s and %s, want %s for br-lan only", guestTable, staffTable, wiredTable)
+	}
+	guestChain, _, _ := iptablesGate{bridge: guest}.chains()
+	staffChain, staffGarden, staffPortal := iptablesGate{bridge: staff}.chains()
+	if guestChain != iptablesGateChain || staffChain == iptablesGateChain {
+		t.Errorf("iptables gate chains = %s and %s, want %s for br-lan only", guestChain, staffChain, iptablesGateChain)
+	}
+	for _, chain := range []string{staffChain, staffGarden, staffPortal} {
+		if len(chain) > 28 {
+			t.Errorf("iptables chain %s is longer than 28 characters", chain)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Addresses are resolved again when their TTL runs out, within these bounds
+	walledGardenMinRefresh = time.Minute
+	walledGardenMaxRefresh = time.Hour
+	// walledGardenRetention keeps addresses a host moved away from allowed for a while, so customers whose
+	// devices cached the old address can still pay and the captive portal isn't restarted for every DNS rotation
+	walledGardenRetention = 24 * time.Hour
+	// walledGardenRestartInterval is the least time between captive portal restarts for new walled garden addresses
+	walledGardenRestartInterval = 10 * time.Minute
+)
+
+// walledGardenEntry matches the preauthenticated_users entries the walled garden owns
+var walledGardenEntry = regexp.MustCompile(`^allow tcp port (80|443) to (\S+)$`)
+
+var (
+	walledGardenHosts     = make(map[string][]string)              // Hosts of each interface set with SetWalledGarden, the tracked addresses replace resolving its config
+	walledGardenAddresses = make(map[string]map[string]time.Time) // Addresses of each host and until when they stay allowed
+	walledGardenRestarted time.Time
+	walledGardenMutex     = &sync.Mutex{}
+	walledGardenOnce      sync.Once
+	walledGardenWake      = make(chan struct{}, 1)
+)
+
+// SetWalledGarden replaces the hosts and IP networks customers on an interface reach before paying. Hosts are
+// resolved again when their DNS TTL runs out and the firewall follows their addresses, so payments keep working
+// when a mint moves to another host.
+func SetWalledGarden(iface string, hosts []string) {
+	walledGardenMutex.Lock()
+	walledGardenHosts[interfaceName(iface)] = append([]string{}, hosts...)
+	walledGardenMutex.Unlock()
+
+	walledGardenOnce.Do(func() { go trackWalledGarden() })
+	select {
+	case walledGardenWake <- struct{}{}:
+	default:
+	}
+}
+
+// trackWalledGarden resolves the walled garden hosts whenever the shortest TTL runs out or the hosts change
+func trackWalledGarden() {
+	for {
+		select {
+		case <-walledGardenWake:
+		case <-time.After(refreshWalledGarden()):
+		}
+	}
+}
+
+// refreshWalledGarden resolves the walled garden hosts of every interface, applies their addresses and returns
+// when to refresh them again
+func refreshWalledGarden() time.Duration {
+	walledGardenMutex.Lock()
+	var hosts []string
+	for _, interfaceHosts := range walledGardenHosts {
+		for _, host := range interfaceHosts {
+			if !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	walledGardenMutex.Unlock()
+
+	now := time.Now()
+	refresh := walledGardenMaxRefresh
+	resolved := make(map[string][]net.IP)
+	ttls := make(map[string]time.Duration)
+	for _, host := range hosts {
+		if _, _, err := net.ParseCIDR(host); err == nil || net.ParseIP(host) != nil {
+			continue
+		}
+		ips, ttl, err := resolveWithTTL(host)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"host":  host,
+				"error": err,
+			}).Warn("Failed to resolve walled garden host, keeping its known addresses")
+			refresh = walledGardenMinRefresh
+			continue
+		}
+		resolved[host] = ips
+		ttls[host] = ttl
+		refresh = min(refresh, max(ttl, walledGardenMinRefresh))
+	}
+
+	walledGardenMutex.Lock()
+	for host := range walledGardenAddresses {
+		if !slices.Contains(hosts, host) {
+			delete(walledGardenAddresses, host)
+		}
+	}
+	for host, ips := range resolved {
+		addresses := walledGardenAddresses[host]
+		if addresses == nil {
+			addresses = make(map[string]time.Time)
+			walledGardenAddresses[host] = addresses
+		}
+		for _, ip := range ips {
+			addresses[ip.String()] = now.Add(ttls[host] + walledGardenRetention)
+		}
+	}
+	for _, addresses := range walledGardenAddresses {
+		for address, until := range addresses {
+			if now.After(until) {
+				delete(addresses, address)
+			}
+		}
+	}
+	walledGardenMutex.Unlock()
+
+	pending, err := applyWalledGarden()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to apply walled garden addresses")
+	}
+	if pending || err != nil {
+		refresh = walledGardenMinRefresh
+	}
+	return refresh
+}
+
+// trackedWalledGarden returns the IP addresses and networks of the walled garden of an interface, nil before
+// SetWalledGarden was called for it
+func trackedWalledGarden(iface string) []string {
+	walledGardenMutex.Lock()
+	defer walledGardenMutex.Unlock()
+	hosts, tracked := walledGardenHosts[interfaceName(iface)]
+	if !tracked {
+		return nil
+	}
+
+	destinations := []string{}
+	for _, host := range hosts {
+		if _, _, err := net.ParseCIDR(host); err == nil || net.ParseIP(host) != nil {
+			destinations = append(destinations, host)
+			continue
+		}
+		for address := range walledGardenAddresses[host] {
+			if !slices.Contains(destinations, address) {
+				destinations = append(destinations, address)
+			}
+		}
+	}
+	sort.Strings(destinations)
+	return destinations
+}
+
+// splitByFamily separates IPv4 from IPv6 addresses and networks, skipping anything else
+func splitByFamily(destinations []string) (ipv4, ipv6 []string) {
+	for _, destination := range destinations {
+		ip := net.ParseIP(destination)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(destination); err != nil {
+				continue
+			}
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, destination)
+		} else {
+			ipv6 = append(ipv6, destination)
+		}
+	}
+	return ipv4, ipv6
+}
+
+// applyWalledGarden lets unpaid customers reach the walled garden addresses through the gate backend of their
+// interface, e.g. the sets of the wired gate table or the preauthenticated_users of the captive portal. A backend
+// serving several interfaces, like the captive portal, gets the walled gardens of all of them. It reports whether
+// applying had to be postponed.
+func applyWalledGarden() (bool, error) {
+	walledGardenMutex.Lock()
+	interfaces := make([]string, 0, len(walledGardenHosts))
+	for iface := range walledGardenHosts {
+		interfaces = append(interfaces, iface)
+	}
+	walledGardenMutex.Unlock()
+	sort.Strings(interfaces)
+
+	var backends []GateBackend
+	destinations := make(map[GateBackend][]string)
+	for _, iface := range interfaces {
+		backend := interfaceGate(iface)
+		if _, exists := destinations[backend]; !exists {
+			backends = append(backends, backend)
+			destinations[backend] = []string{}
+		}
+		for _, destination := range trackedWalledGarden(iface) {
+			if !slices.Contains(destinations[backend], destination) {
+				destinations[backend] = append(destinations[backend], destination)
+			}
+		}
+	}
+
+	pending := false
+	var errs []error
+	for _, backend := range backends {
+		sort.Strings(destinations[backend])
+		postponed, err := backend.WalledGarden(destinations[backend])
+		pending = pending || postponed
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", backend.Name(), err))
+		}
+	}
+	return pending, errors.Join(errs...)
+}
+
+// applyWiredWalledGarden replaces the elements of the walled garden sets of a wired gate table
+func applyWiredWalledGarden(table string, destinations []string) error {
+	ipv4, ipv6 := splitByFamily(destinations)
+	var script strings.Builder
+	for _, set := range []struct {
+		name     string
+		elements []string
+	}{{"walled_garden4", ipv4}, {"walled_garden6", ipv6}} {
+		fmt.Fprintf(&script, "flush set inet %s %s\n", table, set.name)
+		if len(set.elements) > 0 {
+			fmt.Fprintf(&script, "add element inet %s %s { %s }\n", table, set.name, strings.Join(set.elements, ", "))
+		}
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to update wired walled garden: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// applyCaptivePortalWalledGarden brings the walled garden entries of the captive portal in line with the
+// addresses. The captive portal only reads them when it starts, so it is restarted when an address is missing,
+// at most every walledGardenRestartInterval, and the open gates are authorized again afterwards.
+// Entries that are no longer needed are removed with the next restart.
+func applyCaptivePortalWalledGarden(destinations []string) (bool, error) {
+	if _, err := exec.LookPath("uci"); err != nil {
+		return false, nil // Not an OpenWrt router, nothing to configure
+	}
+	ipv4, _ := splitByFamily(destinations)
+
+	flavour := ndsFlavour()
+	key := fmt.Sprintf("%s.@%s[0].preauthenticated_users", flavour, flavour)
+	output, _ := exec.Command("uci", "-q", "-d", "\n", "get", key).Output()
+
+	wanted := make(map[string]bool)
+	for _, destination := range ipv4 {
+		for _, port := range []int{80, 443} {
+			wanted[fmt.Sprintf("allow tcp port %d to %s", port, destination)] = true
+		}
+	}
+	var stale []string
+	present := make(map[string]bool)
+	for _, entry := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if !walledGardenEntry.MatchString(entry) {
+			continue
+		}
+		present[entry] = true
+		if !wanted[entry] {
+			stale = append(stale, entry)
+		}
+	}
+	var missing []string
+	for entry := range wanted {
+		if !present[entry] {
+			missing = append(missing, entry)
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	walledGardenMutex.Lock()
+	if time.Since(walledGardenRestarted) < walledGardenRestartInterval {
+		walledGardenMutex.Unlock()
+		return true, nil
+	}
+	walledGardenRestarted = time.Now()
+	walledGardenMutex.Unlock()
+
+	sort.Strings(missing)
+	for _, entry := range stale {
+		if output, err := exec.Command("uci", "del_list", fmt.Sprintf("%s=%s", key, entry)).CombinedOutput(); err != nil {
+			return false, fmt.Errorf("failed to remove walled garden entry %q: %w (%s)", entry, err, strings.TrimSpace(string(output)))
+		}
+	}
+	for _, entry := range missing {
+		if output, err := exec.Command("uci", "add_list", fmt.Sprintf("%s=%s", key, entry)).CombinedOutput(); err != nil {
+			return false, fmt.Errorf("failed to add walled garden entry %q: %w (%s)", entry, err, strings.TrimSpace(string(output)))
+		}
+	}
+	if output, err := exec.Command("uci", "commit", flavour).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to commit %s: %w (%s)", flavour, err, strings.TrimSpace(string(output)))
+	}
+	if output, err := exec.Command("/etc/init.d/"+flavour, "restart").CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to restart %s: %w (%s)", flavour, err, strings.TrimSpace(string(output)))
+	}
+	reauthorizeOpenGates()
+
+	logger.WithFields(logrus.Fields{
+		"added":   len(missing),
+		"removed": len(stale),
+	}).Info("Updated walled garden of the captive portal")
+	return false, nil
+}
+
+// reauthorizeOpenGates authorizes the clients with an open gate in the captive portal again after it restarted
+func reauthorizeOpenGates() {
+	gatesMutex.Lock()
+	var macAddresses []string
+	for macAddress := range openGates {
+		if _, captive := gateBackendOf(macAddress).(openNDSGate); captive && !isDryRun(macAddress) {
+			macAddresses = append(macAddresses, macAddress)
+		}
+	}
+	gatesMutex.Unlock()
+
+	for _, macAddress := range macAddresses {
+		if output, err := exec.Command("ndsctl", "auth", macAddress).CombinedOutput(); err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+				"output":      string(output),
+			}).Error("Failed to authorize open gate again after the captive portal restarted")
+		}
+	}
+}
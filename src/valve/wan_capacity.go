@@ -0,0 +1,213 @@
+package valve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRootRateKbps is the root class rate while the WAN capacity is unknown
+	defaultRootRateKbps = 1000 * 1000
+	// rootRatePercent of the WAN capacity is given to the root class, so the queue forms here and not in the modem
+	rootRatePercent = 95
+	// wanMeasurementWindow is how many measurements the peak is taken from, measurements during busy hours
+	// only see what the customers left over
+	wanMeasurementWindow = 28
+	// minRootRateKbps keeps a failed or starved measurement from choking the gateway
+	minRootRateKbps = 1000
+)
+
+var (
+	wanCapacity      = make(map[string]config_manager.WANCapacityConfig) // WAN capacity settings of each interface
+	wanMeasurements  = make(map[string][]int)                            // Measured downlink rates in kbps of each interface, newest last
+	rootRates        = make(map[string]int)                              // Root class rate of each interface in kbps, defaultRootRateKbps until sized
+	wanMeasurers     = make(map[string]chan struct{})                    // Wakes the measurements of each interface
+	wanCapacityMutex = &sync.Mutex{}
+)
+
+// SetWANCapacity sizes the root class of traffic control on an interface to the configured WAN capacity, or to
+// the peak of periodic measurements if only a measurement URL is configured
+func SetWANCapacity(iface string, config config_manager.WANCapacityConfig) {
+	iface = interfaceName(iface)
+
+	wanCapacityMutex.Lock()
+	previous := wanCapacity[iface]
+	wanCapacity[iface] = config
+	if config.MeasureURL != previous.MeasureURL {
+		delete(wanMeasurements, iface)
+	}
+	wanCapacityMutex.Unlock()
+
+	applyRootRate(iface, targetRootRate(iface))
+	if config.CapacityMbps == 0 && config.MeasureURL != "" {
+		wanCapacityMutex.Lock()
+		wakeup, started := wanMeasurers[iface]
+		if !started {
+			wakeup = make(chan struct{}, 1)
+			wanMeasurers[iface] = wakeup
+			go measureWANCapacity(iface, wakeup)
+		}
+		wanCapacityMutex.Unlock()
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// targetRootRate returns the root class rate of an interface for its configured or measured WAN capacity
+func targetRootRate(iface string) int {
+	wanCapacityMutex.Lock()
+	defer wanCapacityMutex.Unlock()
+
+	config, measurements := wanCapacity[iface], wanMeasurements[iface]
+	capacityKbps := 0
+	if config.CapacityMbps > 0 {
+		capacityKbps = int(config.CapacityMbps) * 1000
+	} else if config.MeasureURL != "" && len(measurements) > 0 {
+		capacityKbps = slices.Max(measurements)
+	}
+	if capacityKbps == 0 {
+		return defaultRootRateKbps
+	}
+	return max(capacityKbps*rootRatePercent/100, minRootRateKbps)
+}
+
+// currentRootRate returns the rate of the root class of an interface in kbps
+func currentRootRate(iface string) int {
+	wanCapacityMutex.Lock()
+	defer wanCapacityMutex.Unlock()
+	if kbps, sized := rootRates[iface]; sized {
+		return kbps
+	}
+	return defaultRootRateKbps
+}
+
+// applyRootRate changes the root class of an interface if it has traffic control, and the gates on it whose
+// tier limit was clamped to the old rate or is above the new one
+func applyRootRate(iface string, kbps int) {
+	wanCapacityMutex.Lock()
+	current, sized := rootRates[iface]
+	if !sized {
+		current = defaultRootRateKbps
+	}
+	if kbps == current {
+		wanCapacityMutex.Unlock()
+		return
+	}
+	rootRates[iface] = kbps
+	wanCapacityMutex.Unlock()
+
+	interfacesMutex.Lock()
+	initialized := tcInitialized[iface]
+	interfacesMutex.Unlock()
+
+	if initialized {
+		if err := tc().changeRoot(iface, kbps); err != nil {
+			logger.WithFields(logrus.Fields{
+				"interface": iface,
+				"error":     err,
+			}).Warn("Failed to change root class rate")
+		}
+	}
+
+	limitedGatesMutex.Lock()
+	for macAddress, gateKbps := range limitedGates {
+		if !boundTo(macAddress, iface) {
+			continue
+		}
+		if err := replaceGateClass(macAddress, gateKbps); err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+			}).Warn("Failed to fit gate rate to the root class")
+		}
+	}
+	limitedGatesMutex.Unlock()
+
+	logger.WithFields(logrus.Fields{
+		"interface": iface,
+		"rate_kbps": kbps,
+	}).Info("Sized root class to the WAN capacity")
+}
+
+// measureWANCapacity measures the downlink at the configured interval of an interface and resizes its root class
+// to the peak
+func measureWANCapacity(iface string, wakeup chan struct{}) {
+	for {
+		wanCapacityMutex.Lock()
+		config := wanCapacity[iface]
+		wanCapacityMutex.Unlock()
+
+		if config.CapacityMbps == 0 && config.MeasureURL != "" {
+			kbps, err := measureDownlink(config.MeasureURL, time.Duration(config.MeasureSeconds)*time.Second)
+			if err != nil {
+				logger.WithError(err).WithField("interface", iface).Warn("Failed to measure WAN capacity")
+			} else {
+				wanCapacityMutex.Lock()
+				measurements := append(wanMeasurements[iface], kbps)
+				if len(measurements) > wanMeasurementWindow {
+					measurements = measurements[len(measurements)-wanMeasurementWindow:]
+				}
+				wanMeasurements[iface] = measurements
+				wanCapacityMutex.Unlock()
+				logger.WithFields(logrus.Fields{
+					"interface":     iface,
+					"downlink_kbps": kbps,
+				}).Info("Measured WAN capacity")
+				applyRootRate(iface, targetRootRate(iface))
+			}
+		}
+
+		interval := time.Duration(config.MeasureIntervalMinutes) * time.Minute
+		if interval <= 0 {
+			interval = 6 * time.Hour
+		}
+		select {
+		case <-wakeup:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// measureDownlink downloads from the URL for at most the duration and returns the rate in kbps
+func measureDownlink(url string, duration time.Duration) (int, error) {
+	if duration <= 0 {
+		duration = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid measurement URL: %w", err)
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download of %s returned %s", url, resp.Status)
+	}
+
+	// Stopping at the deadline is expected, the rate is what arrived until then
+	downloaded, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && ctx.Err() == nil {
+		return 0, fmt.Errorf("download of %s failed: %w", url, err)
+	}
+	if elapsed < time.Second || downloaded == 0 {
+		return 0, fmt.Errorf("download of %s too short to measure, use a larger file", url)
+	}
+	return int(float64(downloaded) * 8 / 1000 / elapsed.Seconds()), nil
+}
@@ -0,0 +1,83 @@
+package valve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gateDownload is the download counter of a gate opening at the previous utilization sample
+type gateDownload struct {
+	opened     time.Time
+	downloaded uint64
+}
+
+// Download counters of the gates on each interface at its previous sample, and when it was taken
+var (
+	utilizationSamples = make(map[string]map[string]gateDownload)
+	utilizationSampled = make(map[string]time.Time)
+	utilizationMutex   = &sync.Mutex{}
+)
+
+// SampleWANUtilization returns the share of the WAN capacity of an interface, in percent, the open gates on it
+// downloaded since the previous sample. The capacity is the rate of the interface's root class, configured or
+// measured. It returns false on the first sample, as there is nothing to compare with yet.
+func SampleWANUtilization(iface string) (int, bool) {
+	iface = interfaceName(iface)
+
+	gatesMutex.Lock()
+	opened := make(map[string]time.Time, len(openGates))
+	for macAddress, gate := range openGates {
+		if !isDryRun(macAddress) && boundTo(macAddress, iface) {
+			opened[macAddress] = gate.opened
+		}
+	}
+	gatesMutex.Unlock()
+
+	now := time.Now()
+	samples := make(map[string]gateDownload, len(opened))
+	for macAddress, openedAt := range opened {
+		downloaded, _, err := gateTraffic(macAddress)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"mac_address": macAddress,
+				"error":       err,
+			}).Debug("Failed to sample gate traffic for WAN utilization")
+			continue
+		}
+		samples[macAddress] = gateDownload{opened: openedAt, downloaded: downloaded}
+	}
+
+	utilizationMutex.Lock()
+	defer utilizationMutex.Unlock()
+	previous, previousAt := utilizationSamples[iface], utilizationSampled[iface]
+	utilizationSamples[iface], utilizationSampled[iface] = samples, now
+	if previousAt.IsZero() {
+		return 0, false
+	}
+
+	// Gates opened since the previous sample count from 0, their counters started with the opening
+	var downloaded uint64
+	for macAddress, sample := range samples {
+		last, exists := previous[macAddress]
+		switch {
+		case !exists || !last.opened.Equal(sample.opened):
+			if sample.opened.After(previousAt) {
+				downloaded += sample.downloaded
+			}
+		case sample.downloaded >= last.downloaded:
+			downloaded += sample.downloaded - last.downloaded
+		}
+	}
+	return utilizationPercent(downloaded, now.Sub(previousAt), currentRootRate(iface)), true
+}
+
+// utilizationPercent returns the share of a rate in kbps that downloading the bytes over the duration used
+func utilizationPercent(downloaded uint64, elapsed time.Duration, capacityKbps int) int {
+	if elapsed <= 0 || capacityKbps <= 0 {
+		return 0
+	}
+	kbps := float64(downloaded) * 8 / 1000 / elapsed.Seconds()
+	return int(kbps * 100 / float64(capacityKbps))
+}
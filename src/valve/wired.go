@@ -0,0 +1,182 @@
+package valve
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// In wired mode there is no captive portal daemon: the forward chain of wiredTable drops traffic from the bridge
+// unless its source MAC address is allowed. DNS, DHCP and the payment page on the router stay reachable,
+// as they are input traffic, and unpaid HTTP requests are redirected to the payment page.
+// wiredUsageTable counts the traffic of allowed clients in the bridge family, where their MAC addresses are
+// known in both directions. Every bridge has its own tables, suffixed with the bridge except for br-lan.
+const (
+	wiredTable      = "tollgate_wired"
+	wiredUsageTable = "tollgate_wired_usage"
+)
+
+// wiredCounterBytes matches the byte counter of a set element in nft output
+var wiredCounterBytes = regexp.MustCompile(`bytes (\d+)`)
+
+// nftGate allows paid MAC addresses on a wired bridge with nft sets, without a captive portal daemon
+type nftGate struct {
+	bridge     string
+	portalPort int
+}
+
+func (nftGate) Name() string {
+	return "nftables"
+}
+
+// tables returns the gate table and the usage table of the bridge
+func (g nftGate) tables() (string, string) {
+	return wiredTable + interfaceSuffix(g.bridge), wiredUsageTable + interfaceSuffix(g.bridge)
+}
+
+// Setup recreates the gate tables with the allowed MAC addresses and the walled garden
+func (g nftGate) Setup(allowed []string) error {
+	return applyWiredScript(wiredScript(g, allowed, trackedWalledGarden(g.bridge)))
+}
+
+// Teardown removes the gate tables
+func (g nftGate) Teardown() error {
+	return applyWiredScript(wiredScript(nftGate{bridge: g.bridge}, nil, nil))
+}
+
+// applyWiredScript loads an nft script
+func applyWiredScript(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply wired gate rules: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// wiredScript builds the nft script recreating the wired gate tables of a bridge with the allowed MAC addresses
+// and the walled garden addresses unpaid clients reach over HTTP(S). A gate without portal port only removes the
+// tables.
+func wiredScript(g nftGate, allowed, walledGarden []string) string {
+	bridge, portalPort := interfaceName(g.bridge), g.portalPort
+	table, usageTable := g.tables()
+
+	var script strings.Builder
+	// Declaring the tables first makes the deletes succeed on the first run
+	fmt.Fprintf(&script, "table inet %s {}\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&script, "table bridge %s {}\ndelete table bridge %s\n", usageTable, usageTable)
+	if portalPort == 0 {
+		return script.String()
+	}
+
+	elements := ""
+	if len(allowed) > 0 {
+		sorted := append([]string(nil), allowed...)
+		sort.Strings(sorted)
+		elements = fmt.Sprintf("\t\telements = { %s }\n", strings.Join(sorted, ", "))
+	}
+
+	fmt.Fprintf(&script, "table inet %s {\n", table)
+	fmt.Fprintf(&script, "\tset allowed {\n\t\ttype ether_addr\n%s\t}\n", elements)
+	ipv4, ipv6 := splitByFamily(walledGarden)
+	for _, set := range []struct {
+		name, addressType string
+		elements          []string
+	}{{"walled_garden4", "ipv4_addr", ipv4}, {"walled_garden6", "ipv6_addr", ipv6}} {
+		fmt.Fprintf(&script, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n", set.name, set.addressType)
+		if len(set.elements) > 0 {
+			fmt.Fprintf(&script, "\t\telements = { %s }\n", strings.Join(set.elements, ", "))
+		}
+		script.WriteString("\t}\n")
+	}
+	fmt.Fprintf(&script, "\tchain forward {\n\t\ttype filter hook forward priority -1; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tiifname %q ip daddr @walled_garden4 tcp dport { 80, 443 } accept\n", bridge)
+	fmt.Fprintf(&script, "\t\tiifname %q ip6 daddr @walled_garden6 tcp dport { 80, 443 } accept\n", bridge)
+	fmt.Fprintf(&script, "\t\tiifname %q ether saddr != @allowed drop\n\t}\n", bridge)
+	fmt.Fprintf(&script, "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat - 1; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tiifname %q ether saddr != @allowed fib daddr type != local tcp dport 80 redirect to :%d\n\t}\n",
+		bridge, portalPort)
+	script.WriteString("}\n")
+
+	fmt.Fprintf(&script, "table bridge %s {\n", usageTable)
+	for _, set := range []string{"upload", "download"} {
+		fmt.Fprintf(&script, "\tset %s {\n\t\ttype ether_addr\n\t\tcounter\n%s\t}\n", set, elements)
+	}
+	script.WriteString("\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n\t\tether saddr @upload\n\t}\n")
+	script.WriteString("\tchain output {\n\t\ttype filter hook output priority 0; policy accept;\n\t\tether daddr @download\n\t}\n")
+	script.WriteString("}\n")
+
+	return script.String()
+}
+
+// Allow adds a MAC address to the allowlist of the bridge and starts counting its traffic
+func (g nftGate) Allow(macAddress string) error {
+	table, usageTable := g.tables()
+	element := "{ " + macAddress + " }"
+	script := fmt.Sprintf("add element inet %s allowed %s\n", table, element) +
+		fmt.Sprintf("add element bridge %s upload %s\n", usageTable, element) +
+		fmt.Sprintf("add element bridge %s download %s\n", usageTable, element)
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to allow MAC on wired bridge: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// Block removes a MAC address from the allowlist of the bridge and drops its traffic counters
+func (g nftGate) Block(macAddress string) error {
+	table, usageTable := g.tables()
+	element := "{ " + macAddress + " }"
+	output, err := exec.Command("nft", "delete", "element", "inet", table, "allowed", element).CombinedOutput()
+	for _, set := range []string{"upload", "download"} {
+		exec.Command("nft", "delete", "element", "bridge", usageTable, set, element).Run() // Ignore errors, element may not exist
+	}
+	if err != nil {
+		return fmt.Errorf("failed to block MAC on wired bridge: %w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// Traffic returns the bytes a client on the wired bridge downloaded and uploaded since its gate was opened
+func (g nftGate) Traffic(macAddress string) (downloaded, uploaded uint64, err error) {
+	_, usageTable := g.tables()
+	counters := make(map[string]uint64, 2)
+	for _, set := range []string{"upload", "download"} {
+		output, err := exec.Command("nft", "get", "element", "bridge", usageTable, set, "{ "+macAddress+" }").Output()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read wired traffic counter: %w", err)
+		}
+		match := wiredCounterBytes.FindSubmatch(output)
+		if match == nil {
+			return 0, 0, fmt.Errorf("no traffic counter for %s in %s", macAddress, set)
+		}
+		bytes, err := strconv.ParseUint(string(match[1]), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid wired traffic counter: %w", err)
+		}
+		counters[set] = bytes
+	}
+	return counters["download"], counters["upload"], nil
+}
+
+// Verify fails unless the bridge counted traffic of the client
+func (g nftGate) Verify(macAddress string) error {
+	downloaded, uploaded, err := g.Traffic(macAddress)
+	if err != nil {
+		return err
+	}
+	if downloaded+uploaded == 0 {
+		return fmt.Errorf("no traffic from %s on the wired bridge since its gate opened", macAddress)
+	}
+	return nil
+}
+
+func (g nftGate) WalledGarden(destinations []string) (bool, error) {
+	table, _ := g.tables()
+	return false, applyWiredWalledGarden(table, destinations)
+}
@@ -3,6 +3,7 @@ package wireless_gateway_manager
 import (
 	"context"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"unsafe"
 
@@ -253,6 +254,6 @@ func setConfigField(cm *config_manager.ConfigManager, config *config_manager.Con
 		configField = reflect.NewAt(configField.Type(), unsafe.Pointer(configField.UnsafeAddr())).Elem()
 	}
 
-	// Set the new config value
-	configField.Set(reflect.ValueOf(config))
+	// The config is held in an atomic pointer, store the new config value through it
+	configField.Addr().Interface().(*atomic.Pointer[config_manager.Config]).Store(config)
 }